@@ -7,8 +7,12 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"slot-machine/internal/engine"
 )
 
 type agentService struct {
@@ -19,13 +23,63 @@ type agentService struct {
 	configPath   string
 	dataDir      string
 	envFunc      func() []string
-	authMode     string   // "hmac", "trusted", "none"
-	authSecret   string   // hex-encoded HMAC secret (for "hmac" mode)
-	allowedTools []string // claude --allowed-tools
+	authMode     string        // "hmac", "trusted", "none"
+	authSecret   string        // hex-encoded HMAC secret (for "hmac" mode)
+	authMaxAge   time.Duration // how long a signed header is good for; 0 for the default
+	authReplay   *replayCache  // set with agent_auth_replay_cache
+	authLegacy   bool          // also accept the old, unexpiring "user:sig"
+	allowedTools []string      // claude --allowed-tools
 	chatTitle    string
 	chatAccent   string
+	prices       *engine.TokenPrices // agent_prices, for cost estimates
+	model        string              // agent_model
+	modelRules   []modelRule         // agent_model_rules
+	extraRepos   []extraRepo         // agent_extra_repos, read-only
+	promptFile   string              // agent_system_prompt_file, resolved
+	promptInfo   func(*promptVars)   // fills in the daemon's state for the template
+
+	stagingChanges func() engine.WorktreeChanges // uncommitted work in stagingDir
+
+	// Web Push notifications for the chat (see webpush.go); nil if the
+	// VAPID key couldn't be loaded.
+	pusher *webPusher
+
+	// The daemon API served under /api/ (see agent_api.go); off unless
+	// apiToken is set.
+	apiToken string
+	control  http.Handler
+
+	// Whether the daemon API is read-only, which the agent's endpoints
+	// are too: only GETs are answered.
+	readOnly func() bool
+
+	// The daemon's GET /status, given to the agent as
+	// SLOT_MACHINE_STATUS_URL.
+	statusURL string
+
+	// Stream pacing, for tests; zero means heartbeatInterval and
+	// progressAfter.
+	heartbeat  time.Duration
+	progressAt time.Duration
+
+	// Store retention (agent_retain_days, agent_db_max_mb), and the last
+	// pruning pass and WAL checkpoint, for /agent/store.
+	retainDays     int
+	dbMaxMB        int
+	pruneMu        sync.Mutex
+	lastPrune      *pruneResult
+	lastCheckpoint *checkpointResult // guarded by pruneMu
 }
 
+// While an agent runs, its streams get a heartbeat comment every
+// heartbeatInterval, so proxies don't close them during long quiet tool
+// runs, and with it a progress event for each tool that has been running
+// for progressAfter or more. Neither is stored.
+const (
+	heartbeatInterval = 5 * time.Second
+	progressAfter     = 10 * time.Second
+)
+
 var titlePattern = regexp.MustCompile(`\[\[TITLE:\s*(.+?)\]\]`)
 
 func (a *agentService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -41,15 +95,67 @@ func (a *agentService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		a.handleChatConfig(w, r)
 		return
 	}
+	if r.URL.Path == "/chat/sw.js" {
+		a.handleChatWorker(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/chat/shared/") {
+		a.handleShared(w, r)
+		return
+	}
+	if r.URL.Path == "/chat/push-subscriptions" {
+		a.handlePushSubscriptions(w, r)
+		return
+	}
+
+	if r.URL.Path == "/dashboard" {
+		a.handleDashboard(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		a.handleControl(w, r)
+		return
+	}
 
 	// Auth check for /agent/* paths in hmac mode.
 	if strings.HasPrefix(r.URL.Path, "/agent/") && a.authMode == "hmac" {
-		if a.extractUser(r) == "" {
+		var user string
+		if r, user = a.withUser(r); user == "" {
 			http.Error(w, "unauthorized", 401)
 			return
 		}
 	}
 
+	if strings.HasPrefix(r.URL.Path, "/agent/") && r.Method != "GET" && r.Method != "HEAD" && a.readOnly != nil && a.readOnly() {
+		writeJSON(w, 403, map[string]string{"error": "the daemon API is read-only"})
+		return
+	}
+
+	if r.URL.Path == "/agent/config" {
+		a.handleAgentConfig(w, r)
+		return
+	}
+
+	if r.URL.Path == "/agent/search" {
+		a.handleSearch(w, r)
+		return
+	}
+
+	if r.URL.Path == "/agent/usage" {
+		a.handleUsage(w, r)
+		return
+	}
+
+	if r.URL.Path == "/agent/store" {
+		a.handleStoreStats(w, r)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/agent/deploys/") {
+		a.handleDeployDecision(w, r)
+		return
+	}
+
 	if r.URL.Path == "/agent/conversations" {
 		switch r.Method {
 		case "GET":
@@ -71,16 +177,26 @@ func (a *agentService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	parts := strings.SplitN(rest, "/", 2)
 	convID := parts[0]
 	if len(parts) == 1 {
-		a.handleGetConversation(w, r, convID)
+		if r.Method == "PATCH" {
+			a.handlePatchConversation(w, r, convID)
+		} else {
+			a.handleGetConversation(w, r, convID)
+		}
 		return
 	}
 	switch parts[1] {
 	case "messages":
-		a.handleSendMessage(w, r, convID)
+		if r.Method == "GET" {
+			a.handleListMessages(w, r, convID)
+		} else {
+			a.handleSendMessage(w, r, convID)
+		}
 	case "stream":
 		a.handleStream(w, r, convID)
 	case "cancel":
 		a.handleCancel(w, r, convID)
+	case "share":
+		a.handleShare(w, r, convID)
 	default:
 		http.NotFound(w, r)
 	}
@@ -95,20 +211,52 @@ func (a *agentService) handleListConversations(w http.ResponseWriter, r *http.Re
 	if list == nil {
 		list = []conversationRow{}
 	}
+	for i := range list {
+		list[i].QueuePosition = a.manager.position(list[i].ID)
+	}
 	writeJSON(w, 200, list)
 }
 
+// searchLimit caps /agent/search results unless ?limit= asks for fewer.
+const searchLimit = 50
+
+func (a *agentService) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	limit := searchLimit
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 && n < limit {
+		limit = n
+	}
+	hits, err := a.store.search(r.URL.Query().Get("q"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if hits == nil {
+		hits = []searchHit{}
+	}
+	writeJSON(w, 200, hits)
+}
+
 func (a *agentService) handleCreateConversation(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		User         string   `json:"user"`
+		AllowedTools []string `json:"allowed_tools"` // optional tool list for this conversation
+	}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&req)
+	}
+	if err := validateTools(req.AllowedTools); err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+
 	user := a.extractUser(r)
 
 	// Fallback: allow user from body in "none" mode.
 	if user == "" && a.authMode != "hmac" {
-		var req struct {
-			User string `json:"user"`
-		}
-		if r.Body != nil {
-			json.NewDecoder(r.Body).Decode(&req)
-		}
 		user = req.User
 	}
 
@@ -118,6 +266,13 @@ func (a *agentService) handleCreateConversation(w http.ResponseWriter, r *http.R
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	if req.AllowedTools != nil {
+		if err := a.store.setConversationTools(id, req.AllowedTools); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		conv.AllowedTools = req.AllowedTools
+	}
 	writeJSON(w, 200, conv)
 }
 
@@ -132,15 +287,88 @@ func (a *agentService) handleGetConversation(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	msgs, err := a.store.getMessages(convID, 0)
+	after, before, limit, err := pageQuery(r, 0)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	msgs, more, err := a.store.messagePage(convID, after, before, limit)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	conv.QueuePosition = a.manager.position(convID)
 
 	writeJSON(w, 200, map[string]any{
 		"conversation": conv,
 		"messages":     msgs,
+		"has_more":     more,
+	})
+}
+
+// A page of GET /agent/conversations/:id/messages holds messagePageSize
+// messages unless ?limit= asks for fewer, and at most maxMessagePage.
+const (
+	messagePageSize = 200
+	maxMessagePage  = 1000
+)
+
+// pageQuery reads ?after=, ?before=, and ?limit= (def if absent, capped
+// at maxMessagePage).
+func pageQuery(r *http.Request, def int) (after, before int64, limit int, err error) {
+	q := r.URL.Query()
+	for _, p := range []struct {
+		name string
+		v    *int64
+	}{{"after", &after}, {"before", &before}} {
+		if s := q.Get(p.name); s != "" {
+			if *p.v, err = strconv.ParseInt(s, 10, 64); err != nil || *p.v < 0 {
+				return 0, 0, 0, fmt.Errorf("bad %s: %q", p.name, s)
+			}
+		}
+	}
+	limit = def
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return 0, 0, 0, fmt.Errorf("bad limit: %q", s)
+		}
+	}
+	if limit > maxMessagePage {
+		limit = maxMessagePage
+	}
+	return after, before, limit, nil
+}
+
+// --- GET /agent/conversations/:id/messages ---
+
+// handleListMessages serves a page of a conversation's messages, without
+// the conversation, for loading a long one a piece at a time.
+func (a *agentService) handleListMessages(w http.ResponseWriter, r *http.Request, convID string) {
+	conv, err := a.store.getConversation(convID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if conv == nil {
+		http.NotFound(w, r)
+		return
+	}
+	after, before, limit, err := pageQuery(r, messagePageSize)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	msgs, more, err := a.store.messagePage(convID, after, before, limit)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if msgs == nil {
+		msgs = []messageRow{}
+	}
+	writeJSON(w, 200, map[string]any{
+		"messages": msgs,
+		"has_more": more,
 	})
 }
 
@@ -168,7 +396,21 @@ func (a *agentService) handleSendMessage(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	a.store.addMessage(convID, "user", msg.Content)
+	if _, err := a.store.addMessage(convID, "user", msg.Content); err != nil {
+		writeJSON(w, 503, map[string]string{"error": "storing the message: " + err.Error()})
+		return
+	}
+
+	// Daemon commands are answered here, without the agent.
+	if cmd, args, ok := parseCommand(msg.Content); ok {
+		res := a.runCommand(cmd, args, a.person(r))
+		data, _ := json.Marshal(res)
+		if _, err := a.store.addMessage(convID, "command", string(data)); err != nil {
+			fmt.Printf("warning: agent store: command result of %s lost: %v\n", convID, err)
+		}
+		writeJSON(w, 200, res)
+		return
+	}
 
 	// Generate deny rules before spawning agent.
 	a.generateDenySettings()
@@ -178,10 +420,7 @@ func (a *agentService) handleSendMessage(w http.ResponseWriter, r *http.Request,
 	if bin == "" {
 		bin = "claude"
 	}
-	tools := a.allowedTools
-	if len(tools) == 0 {
-		tools = []string{"Bash", "Edit", "Read", "Write", "Glob", "Grep"}
-	}
+	tools := a.policyFor(conv).AllowedTools
 	args := []string{
 		"--output-format", "stream-json",
 		"--verbose",
@@ -189,9 +428,16 @@ func (a *agentService) handleSendMessage(w http.ResponseWriter, r *http.Request,
 		"-p", msg.Content,
 		"--system-prompt", a.buildSystemPrompt(),
 	}
+	model := a.modelFor(a.store.userMessageCount(convID), msg.Content)
+	if model != "" {
+		args = append(args, "--model", model)
+	}
 	if conv.SessionID != "" {
 		args = append(args, "--resume", conv.SessionID)
 	}
+	for _, r := range a.availableExtraRepos() {
+		args = append(args, "--add-dir", r.dir)
+	}
 
 	env := a.buildAgentEnv()
 
@@ -199,6 +445,7 @@ func (a *agentService) handleSendMessage(w http.ResponseWriter, r *http.Request,
 		convID:    convID,
 		message:   msg.Content,
 		sessionID: conv.SessionID,
+		model:     model,
 		bin:       bin,
 		args:      args,
 		dir:       a.stagingDir,
@@ -212,6 +459,36 @@ func (a *agentService) handleSendMessage(w http.ResponseWriter, r *http.Request,
 	w.WriteHeader(200)
 }
 
+// reportEvent passes the engine's health_failure, staging_restored, and
+// deploy_pending events on to the chat.
+func (a *agentService) reportEvent(e engine.DaemonEvent) {
+	switch d := e.Data.(type) {
+	case engine.HealthFailure:
+		a.reportHealthFailure(d)
+	case engine.StagingRestore:
+		a.reportStagingRestore(d)
+	case engine.PendingDeploy:
+		a.reportPendingDeploy(d)
+	}
+}
+
+// reportHealthFailure tells the chat that a deploy's new slot never turned
+// healthy, with the reason and the slot's last output, as a deploy_failed
+// event in the conversations whose agent is running: one of them most
+// likely made the deploy, and can fix what the log shows.
+func (a *agentService) reportHealthFailure(f engine.HealthFailure) {
+	data, _ := json.Marshal(f)
+	a.manager.broadcastRunning("deploy_failed", string(data))
+}
+
+// reportStagingRestore tells running agents' conversations that uncommitted
+// changes in staging were stashed for a deploy and applied again, as a
+// staging_restored event; with conflicts, the files need resolving.
+func (a *agentService) reportStagingRestore(r engine.StagingRestore) {
+	data, _ := json.Marshal(r)
+	a.manager.broadcastRunning("staging_restored", string(data))
+}
+
 func (a *agentService) buildAgentEnv() []string {
 	var env []string
 	if a.envFunc != nil {
@@ -233,7 +510,13 @@ func (a *agentService) buildAgentEnv() []string {
 			}
 		}
 	}
-	env = append(env, "DISABLE_AUTOUPDATER=1")
+	env = append(env, "DISABLE_AUTOUPDATER=1", "SLOT_MACHINE_DEPLOY_SOURCE=agent")
+	if sr, ok := a.daemonStatus(); ok {
+		env = append(env, "SLOT_MACHINE_LIVE_COMMIT="+sr.LiveCommit)
+	}
+	if a.statusURL != "" {
+		env = append(env, "SLOT_MACHINE_STATUS_URL="+a.statusURL)
+	}
 	return env
 }
 
@@ -286,6 +569,9 @@ func (a *agentService) handleStream(w http.ResponseWriter, r *http.Request, conv
 		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", m.ID, m.Type, m.Content)
 		afterID = m.ID
 	}
+	// Not stored: it's the tools in effect now, for the UI to show.
+	policy, _ := json.Marshal(a.policyFor(conv))
+	fmt.Fprintf(w, "event: policy\ndata: %s\n\n", policy)
 	flusher.Flush()
 
 	// Subscribe to live broadcast if agent is running.
@@ -296,14 +582,30 @@ func (a *agentService) handleStream(w http.ResponseWriter, r *http.Request, conv
 		return
 	}
 
+	heartbeat, progressAt := a.heartbeat, a.progressAt
+	if heartbeat == 0 {
+		heartbeat = heartbeatInterval
+	}
+	if progressAt == 0 {
+		progressAt = progressAfter
+	}
+	beatDue := false // guarded by ra.mu
+
 	// Live subscription loop with ticker-based wakeup.
 	ticker := time.NewTicker(500 * time.Millisecond)
 	defer ticker.Stop()
+	beat := time.NewTicker(heartbeat)
+	defer beat.Stop()
 	go func() {
 		for {
 			select {
 			case <-ticker.C:
 				ra.cond.Broadcast()
+			case <-beat.C:
+				ra.mu.Lock()
+				beatDue = true
+				ra.mu.Unlock()
+				ra.cond.Broadcast()
 			case <-ra.done:
 				ra.cond.Broadcast()
 				return
@@ -315,27 +617,75 @@ func (a *agentService) handleStream(w http.ResponseWriter, r *http.Request, conv
 	lastSeq := ra.eventSeq
 	ra.mu.Unlock()
 
+	// Not stored: the run's events that couldn't be, so the client knows
+	// the conversation is missing them.
+	sentErrors := 0
+	sendStorageErrors := func() {
+		ra.mu.Lock()
+		errs := ra.storageErrors[sentErrors:]
+		sentErrors = len(ra.storageErrors)
+		ra.mu.Unlock()
+		for _, e := range errs {
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "event: storage_error\ndata: %s\n\n", data)
+		}
+	}
+
+	// Not stored either: while the agent waits for a free slot, its place
+	// in the queue, and "running" once it starts.
+	lastPos := 0
+	sendPosition := func() {
+		pos := a.manager.position(convID)
+		if pos == lastPos {
+			return
+		}
+		if pos > 0 {
+			fmt.Fprintf(w, "event: queued\ndata: {\"position\":%d}\n\n", pos)
+		} else {
+			fmt.Fprintf(w, "event: status\ndata: {\"status\":\"running\"}\n\n")
+		}
+		flusher.Flush()
+		lastPos = pos
+	}
+	sendPosition()
+
 	for {
 		if r.Context().Err() != nil {
 			return
 		}
 
 		ra.mu.Lock()
-		for ra.eventSeq == lastSeq && r.Context().Err() == nil {
+		for ra.eventSeq == lastSeq && !beatDue && r.Context().Err() == nil {
 			ra.cond.Wait()
 		}
 		lastSeq = ra.eventSeq
+		due := beatDue
+		beatDue = false
+		var slow []toolProgress
+		if due {
+			slow = ra.slowTools(progressAt)
+		}
 		ra.mu.Unlock()
 
 		if r.Context().Err() != nil {
 			return
 		}
 
+		if due {
+			fmt.Fprintf(w, ": heartbeat\n\n")
+			for _, p := range slow {
+				data, _ := json.Marshal(p)
+				fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+			}
+			flusher.Flush()
+		}
+
 		newMsgs, _ := a.store.getMessages(convID, afterID)
 		for _, msg := range newMsgs {
 			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", msg.ID, msg.Type, msg.Content)
 			afterID = msg.ID
 		}
+		sendStorageErrors()
 		flusher.Flush()
 
 		select {
@@ -344,6 +694,7 @@ func (a *agentService) handleStream(w http.ResponseWriter, r *http.Request, conv
 			for _, msg := range finalMsgs {
 				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", msg.ID, msg.Type, msg.Content)
 			}
+			sendStorageErrors()
 			conv, _ := a.store.getConversation(convID)
 			status := "idle"
 			if conv != nil {
@@ -353,6 +704,7 @@ func (a *agentService) handleStream(w http.ResponseWriter, r *http.Request, conv
 			flusher.Flush()
 			return
 		default:
+			sendPosition()
 		}
 	}
 }
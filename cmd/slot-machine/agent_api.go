@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"slot-machine/internal/engine"
+)
+
+// With intercept_prefix set and SLOT_MACHINE_API_TOKEN in the environment,
+// part of the daemon API is also served on the app's port under
+// <prefix>/api/, with the dashboard that uses it at <prefix>/dashboard, so
+// neither needs the API port to be exposed. Every API request needs the
+// token as a Bearer header. Browsers may only call it from the same origin:
+// a request whose Origin is another host is refused, and same-origin ones
+// get the CORS headers back in case the browser asks. The token's holder
+// is a person, so their deploys aren't held for approval (see
+// engine.Vouch).
+
+// controlRoutes are the API routes served under /api/, with their methods.
+var controlRoutes = map[string][]string{
+	"/status":   {"GET"},
+	"/events":   {"GET"},
+	"/history":  {"GET"},
+	"/logs":     {"GET"},
+	"/deploy":   {"POST"},
+	"/rollback": {"POST"},
+	"/restart":  {"POST"},
+	"/lock":     {"POST", "DELETE"},
+
+	"/deploys/pending": {"GET"},
+}
+
+// pendingDecisionRoute is the API route that approves or rejects a pending
+// deploy, served under /api/ for POSTs.
+var pendingDecisionRoute = regexp.MustCompile(`^/deploys/pending/[^/]+/(approve|reject)$`)
+
+// --- GET /dashboard ---
+
+func (a *agentService) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if a.apiToken == "" || a.control == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardHTML))
+}
+
+// --- /api/* ---
+
+func (a *agentService) handleControl(w http.ResponseWriter, r *http.Request) {
+	if a.apiToken == "" || a.control == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if !sameOrigin(origin, r.Host) {
+			writeJSON(w, 403, map[string]string{"error": "cross-origin requests are not allowed"})
+			return
+		}
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		h.Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+		h.Add("Vary", "Origin")
+	}
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(204)
+		return
+	}
+
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.apiToken)) != 1 {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api")
+	methods, ok := controlRoutes[path]
+	if !ok && pendingDecisionRoute.MatchString(path) {
+		methods, ok = []string{"POST"}, true
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !slices.Contains(methods, r.Method) {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path, u.RawPath = path, ""
+	r2.URL = &u
+	a.control.ServeHTTP(w, engine.Vouch(r2))
+}
+
+// sameOrigin reports whether an Origin header names host.
+func sameOrigin(origin, host string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, host)
+}
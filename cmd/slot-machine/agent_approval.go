@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"slot-machine/internal/engine"
+	"slot-machine/internal/proxy"
+)
+
+// With agent_deploy_approval, the daemon holds the agent's deploys (see
+// internal/engine/approval.go). The chat shows each as a deploy_pending
+// event in the conversations whose agent is running, one of which asked
+// for it, with Approve and Reject buttons that post here. The daemon only
+// takes a decision from a person (see engine.Vouch), so these need a
+// signed-in user, which agent_auth none doesn't have.
+
+// person reports whether r comes from a signed-in chat user, whom the
+// daemon may take for a person rather than the agent. With agent_auth none
+// anyone who reaches the chat, the agent included, looks the same. So does
+// anyone with trusted, unless the header came through a proxy listed in
+// trusted_proxies: the agent can send X-SlotMachine-User itself, and the
+// proxy only drops it from unlisted peers.
+func (a *agentService) person(r *http.Request) bool {
+	switch a.authMode {
+	case "hmac":
+		return a.extractUser(r) != ""
+	case "trusted":
+		return proxy.FromTrustedProxy(r) && a.extractUser(r) != ""
+	default:
+		return false
+	}
+}
+
+// reportPendingDeploy tells the chat that a deploy waits for approval.
+func (a *agentService) reportPendingDeploy(p engine.PendingDeploy) {
+	data, _ := json.Marshal(p)
+	a.manager.broadcastRunning("deploy_pending", string(data))
+}
+
+// --- POST /agent/deploys/:id/{approve,reject} ---
+
+// handleDeployDecision passes an approval or rejection from the chat on
+// to the daemon API, and answers as it does: for an approval, with the
+// deploy's result.
+func (a *agentService) handleDeployDecision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/agent/deploys/"), "/")
+	if id == "" || (action != "approve" && action != "reject") {
+		http.NotFound(w, r)
+		return
+	}
+	if !a.person(r) {
+		writeJSON(w, 403, map[string]string{"error": "deciding on deploys from the chat needs agent_auth hmac, or trusted behind a proxy in trusted_proxies: use the dashboard, or slot-machine " + action + " with SLOT_MACHINE_ADMIN_TOKEN"})
+		return
+	}
+	if a.control == nil {
+		writeJSON(w, 503, map[string]string{"error": "the daemon API isn't available"})
+		return
+	}
+	req, err := http.NewRequest("POST", "/deploys/pending/"+url.PathEscape(id)+"/"+action, http.NoBody)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	a.control.ServeHTTP(w, engine.Vouch(req))
+}
@@ -1,32 +1,45 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"math"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"slot-machine/internal/engine"
 )
 
+// In hmac mode, X-SlotMachine-User is "user:timestamp:nonce:signature":
+// the timestamp is Unix seconds, with a fraction if the client likes, the
+// nonce a random string fresh for each request, and the signature the hex
+// HMAC-SHA256 of "user:timestamp:nonce" keyed with SLOT_MACHINE_AUTH_SECRET.
+// It's good for authMaxAge either side of the daemon's clock, and with
+// agent_auth_replay_cache only once: the cache remembers nonces, so two
+// requests signed in the same millisecond are still two. With
+// agent_auth_legacy, the old "user:signature", signed over the user alone,
+// is accepted too, and never expires.
+
+// authUserKey is the request context key of the user ServeHTTP
+// authenticated, so a signed header only counted once is checked once.
+type authUserKey struct{}
+
 func (a *agentService) extractUser(r *http.Request) string {
+	if user, ok := r.Context().Value(authUserKey{}).(string); ok {
+		return user
+	}
 	header := r.Header.Get("X-SlotMachine-User")
 	switch a.authMode {
 	case "hmac":
-		idx := strings.LastIndex(header, ":")
-		if idx < 1 {
-			return ""
-		}
-		user, sig := header[:idx], header[idx+1:]
-		mac := hmac.New(sha256.New, []byte(a.authSecret))
-		mac.Write([]byte(user))
-		expected := hex.EncodeToString(mac.Sum(nil))
-		if !hmac.Equal([]byte(sig), []byte(expected)) {
-			return ""
-		}
-		return user
+		return a.verifyUser(header, time.Now())
 	case "trusted":
 		return header
 	default:
@@ -34,6 +47,82 @@ func (a *agentService) extractUser(r *http.Request) string {
 	}
 }
 
+// withUser returns r carrying the user extractUser found in it.
+func (a *agentService) withUser(r *http.Request) (*http.Request, string) {
+	user := a.extractUser(r)
+	return r.WithContext(context.WithValue(r.Context(), authUserKey{}, user)), user
+}
+
+// verifyUser returns the user a signed X-SlotMachine-User header is for,
+// or "" if it isn't valid at now.
+func (a *agentService) verifyUser(header string, now time.Time) string {
+	signed, sig, ok := cutLast(header, ":")
+	if !ok || signed == "" || !hmac.Equal([]byte(sig), []byte(signUser(a.authSecret, signed))) {
+		return ""
+	}
+	// What's signed is "user:timestamp:nonce", or for a legacy header the
+	// user.
+	rest, nonce, ok := cutLast(signed, ":")
+	user, ts, ok2 := cutLast(rest, ":")
+	sec, err := strconv.ParseFloat(ts, 64)
+	if !ok || !ok2 || user == "" || nonce == "" || err != nil || math.IsNaN(sec) || math.IsInf(sec, 0) {
+		if a.authLegacy {
+			return signed
+		}
+		return ""
+	}
+	at := time.Unix(0, int64(sec*float64(time.Second)))
+	maxAge := a.authMaxAge
+	if maxAge <= 0 {
+		maxAge = engine.AuthMaxAge(engine.Config{})
+	}
+	if d := now.Sub(at); d > maxAge || d < -maxAge {
+		return ""
+	}
+	if a.authReplay != nil && !a.authReplay.first(nonce, at.Add(maxAge), now) {
+		return ""
+	}
+	return user
+}
+
+// signUser is the hex HMAC-SHA256 of msg keyed with secret.
+func signUser(secret, msg string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(msg))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// replayCache remembers the nonces of the signed headers accepted until
+// they expire, so none is accepted twice.
+type replayCache struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time // nonce -> when its header expires
+	swept time.Time
+}
+
+// first reports whether key hasn't been seen before, and remembers it until
+// expires.
+func (c *replayCache) first(key string, expires, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen == nil {
+		c.seen = make(map[string]time.Time)
+	}
+	if now.Sub(c.swept) > time.Minute {
+		for k, exp := range c.seen {
+			if now.After(exp) {
+				delete(c.seen, k)
+			}
+		}
+		c.swept = now
+	}
+	if exp, ok := c.seen[key]; ok && !now.After(exp) {
+		return false
+	}
+	c.seen[key] = expires
+	return true
+}
+
 // agentMDCandidates is the priority order for agent instruction files.
 // First file found wins.
 var agentMDCandidates = []string{
@@ -60,8 +149,10 @@ When you complete a task, commit and deploy:
   slot-machine deploy
 
 slot-machine deploy deploys the HEAD of this worktree. The old version keeps serving until the new one passes health checks — zero downtime.
+Only committed work is deployed. Uncommitted changes here are stashed during any deploy and applied again afterwards; if that conflicts, resolve the conflict markers before going on.
 
 Commit freely — atomic, descriptive messages. Deploy when you believe the task is done.
+Deploys may be rate-limited: one refused as "too soon" says when to retry, so batch your commits into one deploy rather than deploying each.
 
 ## Git workflow
 
@@ -89,7 +180,7 @@ Include this in your first response. You may include it again to update the titl
 
 func (a *agentService) buildSystemPrompt() string {
 	var b strings.Builder
-	b.WriteString(systemPromptBase)
+	b.WriteString(a.systemPromptTemplate(systemPromptBase + a.extraReposPrompt() + a.statusPrompt() + a.upstreamPrompt()))
 
 	// Load app-specific instructions: first file found wins.
 	for _, name := range agentMDCandidates {
@@ -121,19 +212,27 @@ func (a *agentService) generateDenySettings() error {
 		"Write(" + absBin + "/*)",
 	}
 
-	// Protect SSH keys from agent access.
+	// The extra repos are for reading only.
+	for _, r := range a.extraRepos {
+		deny = append(deny, "Edit("+r.dir+"/**)", "Write("+r.dir+"/**)")
+	}
+
+	// Protect SSH keys from agent access: ~/.ssh and the deploy key.
+	keys := []string{filepath.Join(a.dataDir, engine.DeployKeyName) + "*"}
 	if home, err := os.UserHomeDir(); err == nil {
-		sshDir := filepath.Join(home, ".ssh")
+		keys = append(keys, filepath.Join(home, ".ssh")+"/*")
+	}
+	for _, k := range keys {
 		deny = append(deny,
-			"Read("+sshDir+"/*)",
-			"Edit("+sshDir+"/*)",
-			"Write("+sshDir+"/*)",
-			"Bash(cat "+sshDir+"/*)",
-			"Bash(head "+sshDir+"/*)",
-			"Bash(tail "+sshDir+"/*)",
-			"Bash(less "+sshDir+"/*)",
-			"Bash(more "+sshDir+"/*)",
-			"Bash(cp "+sshDir+"/*)",
+			"Read("+k+")",
+			"Edit("+k+")",
+			"Write("+k+")",
+			"Bash(cat "+k+")",
+			"Bash(head "+k+")",
+			"Bash(tail "+k+")",
+			"Bash(less "+k+")",
+			"Bash(more "+k+")",
+			"Bash(cp "+k+")",
 		)
 	}
 
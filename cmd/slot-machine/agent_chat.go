@@ -10,6 +10,12 @@ import (
 //go:embed static/chat.html
 var chatHTML string
 
+//go:embed static/dashboard.html
+var dashboardHTML string
+
+//go:embed static/sw.js
+var chatWorkerJS string
+
 func (a *agentService) handleChat(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.Write([]byte(chatHTML))
@@ -20,12 +26,29 @@ func (a *agentService) handleChatConfig(w http.ResponseWriter, r *http.Request)
 	if title == "" {
 		title = "slot-machine"
 	}
-	writeJSON(w, 200, map[string]string{
+	cfg := map[string]any{
 		"authMode":   a.authMode,
 		"authSecret": a.authSecret,
 		"chatTitle":  title,
 		"chatAccent": a.chatAccent,
-	})
+	}
+	if a.pusher != nil {
+		cfg["vapidPublicKey"] = a.pusher.publicKey()
+	}
+	if a.stagingChanges != nil {
+		c := a.stagingChanges()
+		cfg["stagingDirty"] = c.Dirty()
+		cfg["stagingChanges"] = c
+	}
+	writeJSON(w, 200, cfg)
+}
+
+// handleChatWorker serves the chat's service worker, which shows push
+// notifications.
+func (a *agentService) handleChatWorker(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/javascript")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(chatWorkerJS))
 }
 
 func (a *agentService) handleChatCSS(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"slot-machine/internal/engine"
+)
+
+// A chat message that starts with /deploy, /rollback, /status, or /logs is
+// a command for the daemon, not a prompt: it runs the matching control API
+// call and stores the outcome as a "command" message, which the stream
+// replays like any other event. It's quick, does the same thing every
+// time, and costs no tokens. Anything else starting with a slash goes to
+// the agent as usual. A signed-in user's /deploy is a person's, so
+// agent_deploy_approval doesn't hold it.
+
+// commandLogLines is how many lines /logs shows unless given a number.
+const commandLogLines = 50
+
+// commandResult is the content of a "command" message.
+type commandResult struct {
+	Command string          `json:"command"` // "deploy", "rollback", "status", or "logs"
+	Args    string          `json:"args,omitempty"`
+	OK      bool            `json:"ok"`
+	Text    string          `json:"text"`             // one-line summary
+	Output  string          `json:"output,omitempty"` // log lines, or a failed slot's last output
+	Result  json.RawMessage `json:"result,omitempty"` // the daemon API's response
+}
+
+// parseCommand splits a message into a daemon command and its arguments,
+// or returns ok false if it isn't one.
+func parseCommand(content string) (cmd, args string, ok bool) {
+	content = strings.TrimSpace(content)
+	if !strings.HasPrefix(content, "/") {
+		return "", "", false
+	}
+	cmd, args, _ = strings.Cut(content[1:], " ")
+	switch cmd {
+	case "deploy", "rollback", "status", "logs":
+		return cmd, strings.TrimSpace(args), true
+	}
+	return "", "", false
+}
+
+// runCommand runs a daemon command through the control API, for a person
+// if person is set.
+func (a *agentService) runCommand(cmd, args string, person bool) commandResult {
+	res := commandResult{Command: cmd, Args: args}
+	if a.control == nil {
+		res.Text = "the daemon API isn't available"
+		return res
+	}
+
+	switch cmd {
+	case "deploy":
+		commit := args
+		if commit == "" {
+			c, err := gitHeadCommit(a.stagingDir)
+			if err != nil {
+				res.Text = "cannot determine staging's HEAD: " + err.Error()
+				return res
+			}
+			commit = c
+		}
+		var dr engine.DeployResponse
+		res.Result = a.callControlAs(person, "POST", "/deploy", map[string]string{"commit": commit}, &dr)
+		res.OK = dr.Success
+		switch {
+		case dr.Success:
+			res.Text = fmt.Sprintf("deployed %s to %s", engine.ShortHash(dr.Commit), dr.Slot)
+		case dr.HealthError != "":
+			res.Text = fmt.Sprintf("deploy of %s failed its health check: %s", engine.ShortHash(commit), dr.HealthError)
+			res.Output = dr.LogTail
+		default:
+			res.Text = fmt.Sprintf("deploy of %s failed: %s", engine.ShortHash(commit), dr.Error)
+			res.Output = dr.SmokeOutput
+		}
+
+	case "rollback":
+		var rr engine.RollbackResponse
+		res.Result = a.callControl("POST", "/rollback", map[string]string{"commit": args}, &rr)
+		res.OK = rr.Success
+		if rr.Success {
+			res.Text = fmt.Sprintf("rolled back to %s (%s)", engine.ShortHash(rr.Commit), rr.Slot)
+		} else {
+			res.Text = "rollback failed: " + rr.Error
+		}
+
+	case "status":
+		var sr engine.StatusResponse
+		res.Result = a.callControl("GET", "/status", nil, &sr)
+		res.OK = res.Result != nil
+		res.Text = statusSummary(sr)
+
+	case "logs":
+		lines := commandLogLines
+		if args != "" {
+			n, err := strconv.Atoi(args)
+			if err != nil || n <= 0 {
+				res.Text = "usage: /logs [lines]"
+				return res
+			}
+			lines = n
+		}
+		var lr engine.LogsResponse
+		res.Result = a.callControl("GET", fmt.Sprintf("/logs?lines=%d", lines), nil, &lr)
+		res.OK = lr.Error == "" && res.Result != nil
+		if res.OK {
+			res.Text = fmt.Sprintf("last %d lines of %s", len(lr.Lines), lr.Slot)
+			res.Output = strings.Join(lr.Lines, "\n")
+		} else {
+			res.Text = "logs: " + lr.Error
+		}
+	}
+	return res
+}
+
+// callControl makes a request to the daemon API in-process, decodes the
+// response into v, and returns it as it came (nil if it wasn't JSON).
+func (a *agentService) callControl(method, path string, body any, v any) json.RawMessage {
+	return a.callControlAs(false, method, path, body, v)
+}
+
+// callControlAs is callControl, vouching for the request as a person's if
+// person is set (see engine.Vouch).
+func (a *agentService) callControlAs(person bool, method, path string, body any, v any) json.RawMessage {
+	var rd io.Reader = http.NoBody
+	if body != nil {
+		data, _ := json.Marshal(body)
+		rd = bytes.NewReader(data)
+	}
+	r, err := http.NewRequest(method, path, rd)
+	if err != nil {
+		return nil
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if person {
+		r = engine.Vouch(r)
+	}
+	var w bufferedResponse
+	a.control.ServeHTTP(&w, r)
+	if json.Unmarshal(w.body.Bytes(), v) != nil {
+		return nil
+	}
+	return json.RawMessage(bytes.TrimSpace(w.body.Bytes()))
+}
+
+// statusSummary is /status's one-line answer.
+func statusSummary(sr engine.StatusResponse) string {
+	var b strings.Builder
+	switch sr.State {
+	case "live", "recovering", "crash-loop":
+		fmt.Fprintf(&b, "%s: %s (%s)", sr.State, engine.ShortHash(sr.LiveCommit), sr.LiveSlot)
+	default:
+		b.WriteString("nothing is live")
+	}
+	if sr.PreviousCommit != "" {
+		fmt.Fprintf(&b, ", previous %s", engine.ShortHash(sr.PreviousCommit))
+	}
+	if sr.DeployingCommit != "" {
+		fmt.Fprintf(&b, ", deploying %s", engine.ShortHash(sr.DeployingCommit))
+	}
+	if c := sr.CrashLoop; c != nil {
+		fmt.Fprintf(&b, ", %s", c.Suggestion)
+	}
+	if sr.Locked != nil {
+		b.WriteString(", deploys locked")
+	}
+	if sr.ReadOnly {
+		b.WriteString(", the daemon API is read-only")
+	}
+	for _, d := range sr.Drift {
+		fmt.Fprintf(&b, ", %s has hand-edited files", d.Slot)
+	}
+	switch n := len(sr.PendingDeploys); {
+	case n == 1:
+		b.WriteString(", a deploy is waiting for approval")
+	case n > 1:
+		fmt.Fprintf(&b, ", %d deploys are waiting for approval", n)
+	}
+	if s := sr.Standby; s != nil {
+		fmt.Fprintf(&b, ", standing by for %s", s.Primary)
+	}
+	if u := sr.Upstream; u != nil {
+		fmt.Fprintf(&b, ", %s", u)
+	}
+	if sr.StagingDirty {
+		b.WriteString(", staging has uncommitted changes")
+	}
+	return b.String()
+}
+
+// bufferedResponse is an http.ResponseWriter that keeps what's written.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponse) Header() http.Header {
+	if w.header == nil {
+		w.header = http.Header{}
+	}
+	return w.header
+}
+
+func (w *bufferedResponse) WriteHeader(code int) { w.code = code }
+
+func (w *bufferedResponse) Write(p []byte) (int, error) { return w.body.Write(p) }
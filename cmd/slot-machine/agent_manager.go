@@ -4,17 +4,23 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
+
+	"slot-machine/internal/engine"
 )
 
 type agentWork struct {
 	convID    string
 	message   string
 	sessionID string
+	model     string // --model, "" for claude's default
 	bin       string
 	args      []string
 	dir       string
@@ -23,28 +29,121 @@ type agentWork struct {
 }
 
 type runningAgent struct {
-	cmd      *exec.Cmd
+	proc     *os.Process // the agent's, once started; guarded by mu
 	convID   string
 	eventSeq uint64
 	mu       sync.Mutex
 	cond     *sync.Cond
 	done     chan struct{}
+	tools    map[string]toolRun // in flight, by tool_use id; guarded by mu
+	model    string             // as asked for, then as claude's init event says; runAgent's goroutine only
+
+	storageErrors []storageError // events that couldn't be stored; guarded by mu
+
+	batch      []newMessage // events not stored yet, in order; guarded by mu
+	batchTimer *time.Timer  // writes batch storeBatchDelay after its first event; guarded by mu
+	flushMu    sync.Mutex   // held while a batch is written, so batches are stored in order
+}
+
+// storageError is the body of the SSE storage_error event: an event of the
+// run that couldn't be stored, so it's missing from the conversation. Not
+// stored either, for the obvious reason.
+type storageError struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
+
+// toolRun is a tool the agent called and hasn't had the result of yet.
+type toolRun struct {
+	name    string
+	started time.Time
 }
 
+// toolProgress is the body of the SSE progress event: a tool that has been
+// running a while.
+type toolProgress struct {
+	Tool      string `json:"tool"`
+	ID        string `json:"id"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+}
+
+func (ra *runningAgent) toolStarted(id, name string) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if ra.tools == nil {
+		ra.tools = make(map[string]toolRun)
+	}
+	ra.tools[id] = toolRun{name: name, started: time.Now()}
+}
+
+func (ra *runningAgent) toolDone(id string) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	delete(ra.tools, id)
+}
+
+// slowTools lists the tools running for at least after, oldest first.
+// Caller holds ra.mu.
+func (ra *runningAgent) slowTools(after time.Duration) []toolProgress {
+	var slow []toolProgress
+	for id, t := range ra.tools {
+		if elapsed := time.Since(t.started); elapsed >= after {
+			slow = append(slow, toolProgress{Tool: t.name, ID: id, ElapsedMs: elapsed.Milliseconds()})
+		}
+	}
+	sort.Slice(slow, func(i, j int) bool { return slow[i].ElapsedMs > slow[j].ElapsedMs })
+	return slow
+}
+
+// queuedAgent is work waiting for a free agent slot.
+type queuedAgent struct {
+	work agentWork
+	ra   *runningAgent
+}
+
+// agentManager runs at most limit agents at once; further work waits in
+// queue, first come first served. A conversation has at most one agent,
+// running or queued, and it's in running either way, so streams can follow
+// it from the start.
 type agentManager struct {
 	store   *agentStore
 	workCh  chan agentWork
 	running map[string]*runningAgent
+	queue   []queuedAgent
+	active  int // agents started and not yet finished
+	limit   int
 	mu      sync.Mutex
 	stopCh  chan struct{}
 	wg      sync.WaitGroup
+
+	logs *engine.LogStream // agents' stderr goes here, if set
+
+	publish func(typ, commit, slot string, data any) // the daemon's GET /events, if set
+}
+
+// agentRunEvent is the data of the agent_started and agent_finished events.
+type agentRunEvent struct {
+	Conversation string `json:"conversation"`
+	Status       string `json:"status"` // "running", then "idle" or "error"
+}
+
+// event publishes a run starting or ending on GET /events.
+func (m *agentManager) event(typ, convID, status string) {
+	if m.publish != nil {
+		m.publish(typ, "", "", agentRunEvent{Conversation: convID, Status: status})
+	}
 }
 
+// defaultAgentConcurrency is how many agents run at once unless
+// agent_concurrency says otherwise.
+const defaultAgentConcurrency = 1
+
 func newAgentManager(store *agentStore) *agentManager {
 	m := &agentManager{
 		store:   store,
 		workCh:  make(chan agentWork, 16),
 		running: make(map[string]*runningAgent),
+		limit:   defaultAgentConcurrency,
 		stopCh:  make(chan struct{}),
 	}
 	m.wg.Add(1)
@@ -52,6 +151,18 @@ func newAgentManager(store *agentStore) *agentManager {
 	return m
 }
 
+// setConcurrency sets how many agents may run at once; n <= 0 means the
+// default.
+func (m *agentManager) setConcurrency(n int) {
+	if n <= 0 {
+		n = defaultAgentConcurrency
+	}
+	m.mu.Lock()
+	m.limit = n
+	m.mu.Unlock()
+	m.startQueued()
+}
+
 func (m *agentManager) loop() {
 	defer m.wg.Done()
 	for {
@@ -65,20 +176,97 @@ func (m *agentManager) loop() {
 				work.resultCh <- fmt.Errorf("agent already running")
 				continue
 			}
+			ra := &runningAgent{
+				convID: work.convID,
+				model:  work.model,
+				done:   make(chan struct{}),
+			}
+			ra.cond = sync.NewCond(&ra.mu)
+			m.running[work.convID] = ra
+			m.queue = append(m.queue, queuedAgent{work, ra})
+			queued := m.active >= m.limit
 			m.mu.Unlock()
+			if queued {
+				m.store.setConversationStatus(work.convID, "queued")
+			}
 			work.resultCh <- nil
-			m.wg.Add(1)
-			go m.runAgent(work)
+			m.startQueued()
 		}
 	}
 }
 
+// startQueued starts queued agents while there's room, and wakes the
+// streams of those still waiting, whose position may have changed.
+func (m *agentManager) startQueued() {
+	m.mu.Lock()
+	var start []queuedAgent
+	for len(m.queue) > 0 && m.active < m.limit {
+		select {
+		case <-m.stopCh:
+			m.mu.Unlock()
+			return
+		default:
+		}
+		start = append(start, m.queue[0])
+		m.queue = m.queue[1:]
+		m.active++
+		m.wg.Add(1)
+	}
+	waiting := make([]*runningAgent, len(m.queue))
+	for i, q := range m.queue {
+		waiting[i] = q.ra
+	}
+	m.mu.Unlock()
+
+	for _, q := range start {
+		go m.runAgent(q.work, q.ra)
+	}
+	for _, ra := range waiting {
+		ra.wake()
+	}
+}
+
+// position returns convID's place in the queue, 1 for next, or 0 if it
+// isn't waiting.
+func (m *agentManager) position(convID string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, q := range m.queue {
+		if q.ra.convID == convID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// wake bumps ra's event counter so its streams look for news.
+func (ra *runningAgent) wake() {
+	ra.mu.Lock()
+	ra.eventSeq++
+	ra.mu.Unlock()
+	ra.cond.Broadcast()
+}
+
+// started records proc as ra's agent process.
+func (ra *runningAgent) started(proc *os.Process) {
+	ra.mu.Lock()
+	ra.proc = proc
+	ra.mu.Unlock()
+}
+
+// process is ra's agent process, or nil if it hasn't started.
+func (ra *runningAgent) process() *os.Process {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	return ra.proc
+}
+
 func (m *agentManager) stop() {
 	close(m.stopCh)
 	m.mu.Lock()
 	for _, ra := range m.running {
-		if ra.cmd != nil && ra.cmd.Process != nil {
-			ra.cmd.Process.Kill()
+		if p := ra.process(); p != nil {
+			p.Kill()
 		}
 	}
 	m.mu.Unlock()
@@ -95,27 +283,36 @@ func (m *agentManager) enqueue(work agentWork) error {
 	}
 }
 
-func (m *agentManager) runAgent(work agentWork) {
-	defer m.wg.Done()
-
-	ra := &runningAgent{
-		convID: work.convID,
-		done:   make(chan struct{}),
+// agentStderr sends cmd's stderr to the merged log stream, tagged with
+// the conversation. Close flushes a last unfinished line.
+func (m *agentManager) agentStderr(cmd *exec.Cmd, convID string) io.Closer {
+	w := m.logs.Writer(engine.LogRecord{Source: engine.SourceAgent, Conversation: convID})
+	if m.logs != nil {
+		cmd.Stderr = w
+		// A tool the agent left running in the background may hold stderr
+		// open; don't wait on it once the agent is gone.
+		cmd.WaitDelay = time.Second
 	}
-	ra.cond = sync.NewCond(&ra.mu)
+	return w
+}
 
-	m.mu.Lock()
-	m.running[work.convID] = ra
-	m.mu.Unlock()
+func (m *agentManager) runAgent(work agentWork, ra *runningAgent) {
+	defer m.wg.Done()
 
 	m.store.setConversationStatus(work.convID, "running")
+	// Streams waiting on a queued agent learn it started.
+	ra.wake()
+	m.event("agent_started", work.convID, "running")
+	status := "error"
+	defer func() { m.event("agent_finished", work.convID, status) }()
 
 	cmd := exec.Command(work.bin, work.args...)
 	cmd.Dir = work.dir
 	if work.env != nil {
 		cmd.Env = work.env
 	}
-	ra.cmd = cmd
+	stderr := m.agentStderr(cmd, work.convID)
+	defer stderr.Close()
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -137,6 +334,7 @@ func (m *agentManager) runAgent(work agentWork) {
 		m.cleanup(ra)
 		return
 	}
+	ra.started(cmd.Process)
 
 	scanner := bufio.NewScanner(stdout)
 	scanner.Buffer(make([]byte, 0, 1024*1024), 1024*1024)
@@ -169,10 +367,11 @@ func (m *agentManager) runAgent(work agentWork) {
 		retryCmd := exec.Command(work.bin, retryArgs...)
 		retryCmd.Dir = work.dir
 		retryCmd.Env = work.env
-		ra.cmd = retryCmd
+		defer m.agentStderr(retryCmd, work.convID).Close()
 
 		if retryOut, err := retryCmd.StdoutPipe(); err == nil {
 			if err := retryCmd.Start(); err == nil {
+				ra.started(retryCmd.Process)
 				retryScanner := bufio.NewScanner(retryOut)
 				retryScanner.Buffer(make([]byte, 0, 1024*1024), 1024*1024)
 				for retryScanner.Scan() {
@@ -191,9 +390,12 @@ func (m *agentManager) runAgent(work agentWork) {
 		m.storeAndBroadcast(work.convID, ra, "system", string(errContent))
 	} else {
 		m.store.setConversationStatus(work.convID, "idle")
+		status = "idle"
 	}
 
-	// Broadcast final event so SSE clients know to close.
+	// Store what's still batched, then broadcast a final event so SSE
+	// clients know to close.
+	m.flushMessages(ra)
 	ra.mu.Lock()
 	ra.eventSeq++
 	ra.mu.Unlock()
@@ -205,9 +407,11 @@ func (m *agentManager) runAgent(work agentWork) {
 func (m *agentManager) cleanup(ra *runningAgent) {
 	m.mu.Lock()
 	delete(m.running, ra.convID)
+	m.active--
 	m.mu.Unlock()
 	close(ra.done)
 	ra.cond.Broadcast()
+	m.startQueued()
 }
 
 func (m *agentManager) getRunning(convID string) *runningAgent {
@@ -219,23 +423,45 @@ func (m *agentManager) getRunning(convID string) *runningAgent {
 func (m *agentManager) cancel(convID string) error {
 	m.mu.Lock()
 	ra, ok := m.running[convID]
+	if ok && m.dequeue(convID) {
+		// Never started: drop it from the queue.
+		delete(m.running, convID)
+		m.mu.Unlock()
+		m.store.setConversationStatus(convID, "idle")
+		close(ra.done)
+		ra.wake()
+		m.startQueued()
+		return nil
+	}
 	m.mu.Unlock()
 	if !ok {
 		return fmt.Errorf("no running agent for %s", convID)
 	}
-	if ra.cmd != nil && ra.cmd.Process != nil {
-		ra.cmd.Process.Signal(syscall.SIGTERM)
+	if p := ra.process(); p != nil {
+		p.Signal(syscall.SIGTERM)
 		select {
 		case <-ra.done:
 			return nil
 		case <-time.After(5 * time.Second):
-			ra.cmd.Process.Kill()
+			p.Kill()
 		}
 	}
 	<-ra.done
 	return nil
 }
 
+// dequeue removes convID's queued work, reporting whether there was any.
+// Caller holds m.mu.
+func (m *agentManager) dequeue(convID string) bool {
+	for i, q := range m.queue {
+		if q.ra.convID == convID {
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 func (m *agentManager) processLine(convID string, ra *runningAgent, line string) {
 	var raw map[string]any
 	if json.Unmarshal([]byte(line), &raw) != nil {
@@ -250,8 +476,11 @@ func (m *agentManager) processLine(convID string, ra *runningAgent, line string)
 			if sid, ok := raw["session_id"].(string); ok {
 				m.store.updateSessionID(convID, sid)
 			}
+			if model, _ := raw["model"].(string); model != "" {
+				ra.model = model
+			}
 		}
-		m.storeAndBroadcast(convID, ra, "system", line)
+		m.queueMessage(ra, "system", line)
 
 	case "assistant":
 		var blocks []any
@@ -268,7 +497,8 @@ func (m *agentManager) processLine(convID string, ra *runningAgent, line string)
 				toolName, _ := block["name"].(string)
 				toolID, _ := block["id"].(string)
 				data, _ := json.Marshal(map[string]string{"tool": toolName, "id": toolID})
-				m.storeAndBroadcast(convID, ra, "tool_use", string(data))
+				ra.toolStarted(toolID, toolName)
+				m.queueMessage(ra, "tool_use", string(data))
 			}
 		}
 
@@ -292,8 +522,8 @@ func (m *agentManager) processLine(convID string, ra *runningAgent, line string)
 		}
 
 		if text != "" {
-			data, _ := json.Marshal(map[string]string{"content": text})
-			m.storeAndBroadcast(convID, ra, "assistant", string(data))
+			data, _ := json.Marshal(map[string]string{"content": text, "html": renderMarkdown(text)})
+			m.queueMessage(ra, "assistant", string(data))
 		}
 
 	case "user":
@@ -310,7 +540,8 @@ func (m *agentManager) processLine(convID string, ra *runningAgent, line string)
 				toolID, _ := block["tool_use_id"].(string)
 				content, _ := block["content"].(string)
 				data, _ := json.Marshal(map[string]string{"id": toolID, "output": content})
-				m.storeAndBroadcast(convID, ra, "tool_result", string(data))
+				ra.toolDone(toolID)
+				m.queueMessage(ra, "tool_result", string(data))
 			}
 		}
 
@@ -322,21 +553,110 @@ func (m *agentManager) processLine(convID string, ra *runningAgent, line string)
 			cacheRead, _ = usage["cache_read_input_tokens"].(float64)
 			cacheWrite, _ = usage["cache_creation_input_tokens"].(float64)
 		}
-		m.store.addUsage(convID, int(inputTok), int(outputTok), int(cacheRead), int(cacheWrite))
+		m.store.addUsage(convID, ra.model, int(inputTok), int(outputTok), int(cacheRead), int(cacheWrite))
 
+		changed := false
 		if resultText, _ := raw["result"].(string); resultText != "" {
 			if match := titlePattern.FindStringSubmatch(resultText); match != nil {
 				m.store.updateTitle(convID, strings.TrimSpace(match[1]))
 			}
+			raw["result_html"] = renderMarkdown(strings.TrimSpace(titlePattern.ReplaceAllString(resultText, "")))
+			changed = true
+		}
+		if _, ok := raw["model"]; !ok && ra.model != "" {
+			raw["model"] = ra.model
+			changed = true
+		}
+		if changed {
+			if data, err := json.Marshal(raw); err == nil {
+				line = string(data)
+			}
 		}
 
 		m.storeAndBroadcast(convID, ra, "done", line)
 	}
 }
 
+// broadcastRunning stores an event in every conversation whose agent is
+// running, not queued, and wakes their streams. It returns how many there
+// were.
+func (m *agentManager) broadcastRunning(msgType, content string) int {
+	m.mu.Lock()
+	queued := make(map[*runningAgent]bool, len(m.queue))
+	for _, q := range m.queue {
+		queued[q.ra] = true
+	}
+	running := make([]*runningAgent, 0, len(m.running))
+	for _, ra := range m.running {
+		if !queued[ra] {
+			running = append(running, ra)
+		}
+	}
+	m.mu.Unlock()
+	for _, ra := range running {
+		m.storeAndBroadcast(ra.convID, ra, msgType, content)
+	}
+	return len(running)
+}
+
+// storeAndBroadcast stores an event, with any still batched before it, and
+// wakes the conversation's streams.
 func (m *agentManager) storeAndBroadcast(convID string, ra *runningAgent, msgType, content string) {
-	m.store.addMessage(convID, msgType, content)
+	m.queueMessage(ra, msgType, content)
+	m.flushMessages(ra)
+}
+
+// Events from claude's output are stored in batches, one transaction for
+// up to storeBatchMax of them, written at most storeBatchDelay after the
+// first, instead of an INSERT and an UPDATE for each. Streams read events
+// back from the store, so they get them, with their IDs, once the batch is
+// written.
+const (
+	storeBatchMax   = 32
+	storeBatchDelay = 50 * time.Millisecond
+)
+
+// queueMessage adds an event to ra's batch, and writes the batch if it's
+// full.
+func (m *agentManager) queueMessage(ra *runningAgent, msgType, content string) {
+	ra.mu.Lock()
+	ra.batch = append(ra.batch, newMessage{Type: msgType, Content: content})
+	n := len(ra.batch)
+	if n == 1 {
+		ra.batchTimer = time.AfterFunc(storeBatchDelay, func() { m.flushMessages(ra) })
+	}
+	ra.mu.Unlock()
+	if n >= storeBatchMax {
+		m.flushMessages(ra)
+	}
+}
+
+// flushMessages writes ra's batch and wakes its streams.
+func (m *agentManager) flushMessages(ra *runningAgent) {
+	ra.flushMu.Lock()
+	defer ra.flushMu.Unlock()
+	ra.mu.Lock()
+	batch := ra.batch
+	ra.batch = nil
+	if ra.batchTimer != nil {
+		ra.batchTimer.Stop()
+		ra.batchTimer = nil
+	}
+	ra.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	_, err := m.store.addMessages(ra.convID, batch)
+	if err != nil {
+		fmt.Printf("warning: agent store: %d events of %s lost: %v\n", len(batch), ra.convID, err)
+	}
 	ra.mu.Lock()
+	if err != nil {
+		for _, msg := range batch {
+			ra.storageErrors = append(ra.storageErrors, storageError{Type: msg.Type, Error: err.Error()})
+		}
+	}
 	ra.eventSeq++
 	ra.mu.Unlock()
 	ra.cond.Broadcast()
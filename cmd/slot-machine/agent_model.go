@@ -0,0 +1,50 @@
+package main
+
+import (
+	"regexp"
+
+	"slot-machine/internal/engine"
+)
+
+// The agent's model for a message comes from the first of
+// agent_model_rules that matches it, e.g. a small model while a
+// conversation is short and a big one when the message asks for a
+// refactor, and otherwise from agent_model; with neither, claude picks.
+// The model a run used, as claude reports it, is kept with its usage and
+// its done event, so /agent/usage can sum the runs by model.
+
+// modelRule is a ModelRule with its regexp compiled.
+type modelRule struct {
+	model       string
+	maxMessages int
+	match       *regexp.Regexp // nil matches everything
+}
+
+// compileModelRules compiles rules, which engine.CheckModelRules has
+// validated.
+func compileModelRules(rules []engine.ModelRule) []modelRule {
+	var compiled []modelRule
+	for _, r := range rules {
+		mr := modelRule{model: r.Model, maxMessages: r.MaxMessages}
+		if r.Match != "" {
+			mr.match = regexp.MustCompile("(?i)" + r.Match)
+		}
+		compiled = append(compiled, mr)
+	}
+	return compiled
+}
+
+// modelFor is the model for message, the conversation's userMessages-th
+// from the user, or "" for claude's default.
+func (a *agentService) modelFor(userMessages int, message string) string {
+	for _, r := range a.modelRules {
+		if r.maxMessages > 0 && userMessages > r.maxMessages {
+			continue
+		}
+		if r.match != nil && !r.match.MatchString(message) {
+			continue
+		}
+		return r.model
+	}
+	return a.model
+}
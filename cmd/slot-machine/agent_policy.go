@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The tools the agent may use come from, first match wins: the
+// conversation's own list, the runtime list set with PATCH /agent/config
+// (kept in the store, so it survives restarts), agent_allowed_tools in the
+// config, and defaultAgentTools.
+
+var defaultAgentTools = []string{"Bash", "Edit", "Read", "Write", "Glob", "Grep"}
+
+// toolsSetting is the store key of the runtime tool list.
+const toolsSetting = "allowed_tools"
+
+// toolPolicy is the tool list in effect and where it came from; it's the
+// body of /agent/config and of the SSE policy event.
+type toolPolicy struct {
+	AllowedTools []string `json:"allowed_tools"`
+	Source       string   `json:"source"` // "conversation", "runtime", "config", or "default"
+}
+
+// globalPolicy is the daemon-wide tool list.
+func (a *agentService) globalPolicy() toolPolicy {
+	if s, err := a.store.getSetting(toolsSetting); err == nil && s != "" {
+		return toolPolicy{AllowedTools: decodeTools(s), Source: "runtime"}
+	}
+	if len(a.allowedTools) > 0 {
+		return toolPolicy{AllowedTools: a.allowedTools, Source: "config"}
+	}
+	return toolPolicy{AllowedTools: defaultAgentTools, Source: "default"}
+}
+
+// policyFor is the tool list for conv's next agent run.
+func (a *agentService) policyFor(conv *conversationRow) toolPolicy {
+	if conv.AllowedTools != nil {
+		return toolPolicy{AllowedTools: conv.AllowedTools, Source: "conversation"}
+	}
+	return a.globalPolicy()
+}
+
+// decodeToolsPatch reads {"allowed_tools": [...]} from a PATCH body. A null
+// list means "back to the inherited one" and returns nil.
+func decodeToolsPatch(r *http.Request) ([]string, error) {
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("bad request")
+	}
+	raw, ok := body["allowed_tools"]
+	if !ok {
+		return nil, fmt.Errorf("allowed_tools is required")
+	}
+	var tools []string
+	if err := json.Unmarshal(raw, &tools); err != nil {
+		return nil, fmt.Errorf("allowed_tools must be a list of tool names")
+	}
+	if err := validateTools(tools); err != nil {
+		return nil, err
+	}
+	return tools, nil
+}
+
+// validateTools rejects names that can't be passed to claude, which takes
+// the list comma-separated.
+func validateTools(tools []string) error {
+	for _, t := range tools {
+		if strings.TrimSpace(t) == "" || strings.Contains(t, ",") {
+			return fmt.Errorf("invalid tool name %q", t)
+		}
+	}
+	return nil
+}
+
+// --- GET/PATCH /agent/config ---
+
+func (a *agentService) handleAgentConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PATCH":
+		tools, err := decodeToolsPatch(r)
+		if err != nil {
+			writeJSON(w, 400, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := a.store.setSetting(toolsSetting, encodeTools(tools)); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	writeJSON(w, 200, a.globalPolicy())
+}
+
+// --- PATCH /agent/conversations/:id ---
+
+func (a *agentService) handlePatchConversation(w http.ResponseWriter, r *http.Request, convID string) {
+	conv, err := a.store.getConversation(convID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if conv == nil {
+		http.NotFound(w, r)
+		return
+	}
+	tools, err := decodeToolsPatch(r)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := a.store.setConversationTools(convID, tools); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	conv.AllowedTools = tools
+	writeJSON(w, 200, a.policyFor(conv))
+}
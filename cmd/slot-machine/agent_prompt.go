@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"slot-machine/internal/engine"
+)
+
+// agent_system_prompt_file replaces the built-in system prompt with a
+// text/template, read again for every agent run so it can be edited without
+// a restart. {{.Base}} is the built-in prompt, so a template can wrap it
+// rather than replace it. App-specific instructions (AGENTS.md and the like)
+// are still appended after it. A template that fails to parse or run is
+// reported and the built-in prompt is used instead.
+
+// promptVars are the variables a system prompt template can use.
+type promptVars struct {
+	Base           string // the built-in prompt
+	AppName        string
+	LiveCommit     string // "" when nothing is live
+	HealthEndpoint string
+	StagingDir     string                 // the agent's working directory
+	Deploys        []engine.JournalEntry  // the last promptDeploys journal entries, oldest first
+	Upstream       *engine.UpstreamStatus // the live commit against the upstream branch; nil if unknown
+}
+
+// promptDeploys is how many journal entries a template gets.
+const promptDeploys = 10
+
+// resolvePromptFile makes a relative agent_system_prompt_file relative to
+// the repo.
+func resolvePromptFile(path, repoDir string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(repoDir, path)
+}
+
+// systemPromptTemplate renders the template file, if there is one, or
+// returns base.
+func (a *agentService) systemPromptTemplate(base string) string {
+	if a.promptFile == "" {
+		return base
+	}
+	data, err := os.ReadFile(a.promptFile)
+	if err != nil {
+		fmt.Printf("warning: agent_system_prompt_file: %v; using the built-in prompt\n", err)
+		return base
+	}
+	tmpl, err := template.New("prompt").Parse(string(data))
+	if err != nil {
+		fmt.Printf("warning: agent_system_prompt_file: %v; using the built-in prompt\n", err)
+		return base
+	}
+	vars := promptVars{Base: base, StagingDir: a.stagingDir}
+	if a.promptInfo != nil {
+		a.promptInfo(&vars)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, vars); err != nil {
+		fmt.Printf("warning: agent_system_prompt_file: %v; using the built-in prompt\n", err)
+		return base
+	}
+	return b.String()
+}
+
+// upstreamPrompt tells the agent about commits on the upstream branch that
+// aren't live yet, so it can mention them; "" when there are none.
+func (a *agentService) upstreamPrompt() string {
+	if a.promptInfo == nil {
+		return ""
+	}
+	var v promptVars
+	a.promptInfo(&v)
+	u := v.Upstream
+	if u == nil || u.Behind == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\n## Undeployed commits\n\nThe live release is %s: %d commit(s) there, up to %s, haven't been deployed yet. Mention this when the user asks what's running, or about a change that may be among them.\n",
+		u, u.Behind, engine.ShortHash(u.Commit))
+}
+
+// daemonStatus is GET /status, asked in-process, or false without the
+// daemon API.
+func (a *agentService) daemonStatus() (engine.StatusResponse, bool) {
+	var sr engine.StatusResponse
+	if a.control == nil {
+		return sr, false
+	}
+	return sr, a.callControl("GET", "/status", nil, &sr) != nil
+}
+
+// statusPrompt tells the agent what's deployed when its run starts, so it
+// needn't ask the daemon first; "" without the daemon API.
+func (a *agentService) statusPrompt() string {
+	sr, ok := a.daemonStatus()
+	if !ok {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n## Current state\n\nWhen this message was sent: %s.", statusSummary(sr))
+	b.WriteString(" $SLOT_MACHINE_LIVE_COMMIT has the live commit")
+	if a.statusURL != "" {
+		b.WriteString(", and $SLOT_MACHINE_STATUS_URL returns the daemon's full status as JSON; ask it again after a deploy or rollback")
+	}
+	b.WriteString(".\n")
+	return b.String()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"slot-machine/internal/engine"
+)
+
+// agent_extra_repos gives the agent other repositories to read, such as a
+// shared library a fix depends on. Repos with a URL are shallow-cloned into
+// .slot-machine/agent-repos/<name> and fetched again every
+// extraRepoInterval; repos with a path are used where they are. Either way
+// they sit outside the staging worktree, so nothing in them is committed or
+// deployed. The agent gets them with --add-dir, Edit and Write on them are
+// denied in its settings, and the system prompt lists them as read-only.
+
+const extraRepoInterval = time.Hour
+
+var extraRepoName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// extraRepo is an agent_extra_repos entry and the directory it's in.
+type extraRepo struct {
+	engine.ExtraRepo
+	dir string
+}
+
+// resolveExtraRepos turns the config's entries into directories: path
+// relative to repoDir, or a clone under dataDir. Invalid entries are
+// reported and skipped.
+func resolveExtraRepos(repos []engine.ExtraRepo, repoDir, dataDir string) []extraRepo {
+	var out []extraRepo
+	seen := map[string]bool{}
+	for _, r := range repos {
+		switch {
+		case !extraRepoName.MatchString(r.Name) || seen[r.Name]:
+			fmt.Printf("warning: agent_extra_repos: skipping %q: name must be unique and a plain directory name\n", r.Name)
+			continue
+		case (r.URL == "") == (r.Path == ""):
+			fmt.Printf("warning: agent_extra_repos: skipping %q: set one of url and path\n", r.Name)
+			continue
+		}
+		seen[r.Name] = true
+		dir := r.Path
+		if r.URL != "" {
+			dir = filepath.Join(dataDir, "agent-repos", r.Name)
+		} else if !filepath.IsAbs(dir) {
+			dir = filepath.Join(repoDir, dir)
+		}
+		out = append(out, extraRepo{ExtraRepo: r, dir: dir})
+	}
+	return out
+}
+
+// runExtraRepoSync clones or updates the URL repos now and then every
+// extraRepoInterval. It never returns if there are any.
+func (a *agentService) runExtraRepoSync() {
+	if !slices.ContainsFunc(a.extraRepos, func(r extraRepo) bool { return r.URL != "" }) {
+		return
+	}
+	for {
+		a.syncExtraRepos()
+		time.Sleep(extraRepoInterval)
+	}
+}
+
+// syncExtraRepos brings each URL repo to the tip of its ref.
+func (a *agentService) syncExtraRepos() {
+	for _, r := range a.extraRepos {
+		if r.URL == "" {
+			continue
+		}
+		if err := syncExtraRepo(r); err != nil {
+			fmt.Printf("warning: agent_extra_repos: %s: %v\n", r.Name, err)
+		}
+	}
+}
+
+func syncExtraRepo(r extraRepo) error {
+	if _, err := os.Stat(filepath.Join(r.dir, ".git")); err != nil {
+		os.MkdirAll(filepath.Dir(r.dir), 0755)
+		args := []string{"clone", "--quiet", "--depth", "1"}
+		if r.Ref != "" {
+			args = append(args, "--branch", r.Ref)
+		}
+		return runGit("", append(args, r.URL, r.dir)...)
+	}
+	ref := r.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if err := runGit(r.dir, "fetch", "--quiet", "--depth", "1", "origin", ref); err != nil {
+		return err
+	}
+	return runGit(r.dir, "reset", "--quiet", "--hard", "FETCH_HEAD")
+}
+
+// redactURL drops any credentials from a clone URL.
+func redactURL(s string) string {
+	if u, err := url.Parse(s); err == nil && u.User != nil {
+		u.User = nil
+		return u.String()
+	}
+	return s
+}
+
+func runGit(dir string, args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// availableExtraRepos are the extra repos whose directory exists.
+func (a *agentService) availableExtraRepos() []extraRepo {
+	var out []extraRepo
+	for _, r := range a.extraRepos {
+		if info, err := os.Stat(r.dir); err == nil && info.IsDir() {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// extraReposPrompt is the system prompt section listing the extra repos.
+func (a *agentService) extraReposPrompt() string {
+	repos := a.availableExtraRepos()
+	if len(repos) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\n## Other repositories (read-only)\n\n")
+	b.WriteString("These checkouts are available for reference, e.g. to see how a shared library works:\n\n")
+	for _, r := range repos {
+		fmt.Fprintf(&b, "- %s: %s", r.Name, r.dir)
+		if r.URL != "" {
+			ref := r.Ref
+			if ref == "" {
+				ref = "default branch"
+			}
+			fmt.Fprintf(&b, " (%s, %s)", redactURL(r.URL), ref)
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("\nRead them, but never modify them: they are shared, refreshed from their remote, and never deployed. Make your changes in this directory only.\n")
+	return b.String()
+}
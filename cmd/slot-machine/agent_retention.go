@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Every SSE event is a row, so agent.db grows for as long as the agent is
+// used. With agent_retain_days, messages older than that are deleted, and
+// the conversations left empty with them; with agent_db_max_mb, the oldest
+// messages go until the rest fits. Conversations whose agent is running or
+// queued are never touched. Pruning runs at startup and every
+// retentionInterval, and VACUUMs the file when it deleted anything.
+//
+// agent.db is in WAL mode, and the chat's streams read it all the time,
+// which can keep SQLite's automatic checkpoints from ever finishing. So
+// every checkpointInterval the WAL is checkpointed and truncated.
+
+const (
+	retentionInterval  = time.Hour
+	checkpointInterval = 5 * time.Minute
+)
+
+// checkpointResult is what the last WAL checkpoint did.
+type checkpointResult struct {
+	At    string `json:"at"`
+	Busy  bool   `json:"busy,omitempty"` // readers kept it from finishing
+	Error string `json:"error,omitempty"`
+}
+
+// pruneResult is what one pruning pass did.
+type pruneResult struct {
+	At            string `json:"at"`
+	Messages      int64  `json:"messages_deleted"`
+	Conversations int64  `json:"conversations_deleted"`
+	SizeBefore    int64  `json:"size_before"`
+	SizeAfter     int64  `json:"size_after"`
+	Error         string `json:"error,omitempty"`
+}
+
+// storeStats is the body of GET /agent/store.
+type storeStats struct {
+	SizeBytes     int64        `json:"size_bytes"`
+	FreeBytes     int64        `json:"free_bytes"` // reclaimed by the next VACUUM
+	Conversations int64        `json:"conversations"`
+	Messages      int64        `json:"messages"`
+	OldestMessage string       `json:"oldest_message,omitempty"`
+	RetainDays    int          `json:"retain_days,omitempty"`
+	MaxMB         int          `json:"max_mb,omitempty"`
+	LastPrune     *pruneResult `json:"last_prune,omitempty"`
+
+	LastCheckpoint *checkpointResult `json:"last_checkpoint,omitempty"`
+	WriteErrors    int64             `json:"write_errors"` // messages lost since the daemon started
+}
+
+// runRetention prunes now and then every retentionInterval, if a retention
+// limit is set. It never returns.
+func (a *agentService) runRetention() {
+	if a.retainDays <= 0 && a.dbMaxMB <= 0 {
+		return
+	}
+	for {
+		res := a.prune(time.Now())
+		switch {
+		case res.Error != "":
+			fmt.Printf("warning: agent store pruning: %s\n", res.Error)
+		case res.Messages > 0:
+			fmt.Printf("agent store: pruned %d messages, %d conversations (%d -> %d bytes)\n",
+				res.Messages, res.Conversations, res.SizeBefore, res.SizeAfter)
+		}
+		time.Sleep(retentionInterval)
+	}
+}
+
+// runCheckpoints checkpoints the WAL every checkpointInterval. It never
+// returns.
+func (a *agentService) runCheckpoints() {
+	for {
+		time.Sleep(checkpointInterval)
+		if res := a.checkpoint(time.Now()); res.Error != "" {
+			fmt.Printf("warning: agent store checkpoint: %s\n", res.Error)
+		}
+	}
+}
+
+// checkpoint checkpoints the WAL once.
+func (a *agentService) checkpoint(now time.Time) checkpointResult {
+	res := checkpointResult{At: now.Format(time.RFC3339)}
+	busy, err := a.store.checkpoint()
+	res.Busy = busy
+	if err != nil {
+		res.Error = err.Error()
+	}
+	a.pruneMu.Lock()
+	a.lastCheckpoint = &res
+	a.pruneMu.Unlock()
+	return res
+}
+
+// prune applies the retention limits once.
+func (a *agentService) prune(now time.Time) pruneResult {
+	a.pruneMu.Lock()
+	defer a.pruneMu.Unlock()
+
+	res := pruneResult{At: now.Format(time.RFC3339)}
+	res.SizeBefore, _ = a.store.dbSize()
+	err := func() error {
+		if a.retainDays > 0 {
+			cutoff := now.AddDate(0, 0, -a.retainDays).Format(time.RFC3339)
+			msgs, convs, err := a.store.pruneBefore(cutoff)
+			res.Messages += msgs
+			res.Conversations += convs
+			if err != nil {
+				return err
+			}
+		}
+		if limit := int64(a.dbMaxMB) << 20; limit > 0 {
+			size, free := a.store.dbSize()
+			if used := size - free; used > limit {
+				msgs, err := a.store.pruneOldest(used - limit)
+				res.Messages += msgs
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if res.Messages > 0 {
+			return a.store.vacuum()
+		}
+		return nil
+	}()
+	if err != nil {
+		res.Error = err.Error()
+	}
+	res.SizeAfter, _ = a.store.dbSize()
+	a.lastPrune = &res
+	return res
+}
+
+// --- GET /agent/store ---
+
+func (a *agentService) handleStoreStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	st := storeStats{RetainDays: a.retainDays, MaxMB: a.dbMaxMB, WriteErrors: a.store.writeErrors.Load()}
+	st.SizeBytes, st.FreeBytes = a.store.dbSize()
+	st.Conversations, st.Messages, st.OldestMessage = a.store.counts()
+	a.pruneMu.Lock()
+	st.LastPrune = a.lastPrune
+	st.LastCheckpoint = a.lastCheckpoint
+	a.pruneMu.Unlock()
+	writeJSON(w, 200, st)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A conversation can be shared with someone who has no access to the
+// chat: POST /agent/conversations/:id/share returns a link,
+// <base>/chat/shared/<token>, to a read-only transcript rendered on the
+// server, with no send box and nothing that runs the agent or a command.
+// The token is the conversation's ID and an expiry, signed with a secret
+// the store keeps (share_secret, made the first time), so links need no
+// bookkeeping: each works until it expires, or until the conversation is
+// pruned.
+
+const (
+	defaultShareTTL = 7 * 24 * time.Hour
+	maxShareTTL     = 90 * 24 * time.Hour
+	shareSecretKey  = "share_secret"
+
+	// sharedOutputMax is how much of a tool's output a transcript shows.
+	sharedOutputMax = 4000
+)
+
+//go:embed static/shared.html
+var sharedHTML string
+
+var sharedTemplate = template.Must(template.New("shared").Parse(sharedHTML))
+
+// shareResponse is the body of POST /agent/conversations/:id/share.
+type shareResponse struct {
+	Path      string `json:"path"` // under the chat's base: the intercept prefix, if any
+	ExpiresAt string `json:"expires_at"`
+}
+
+// shareSecret returns the key share links are signed with, making it the
+// first time.
+func (a *agentService) shareSecret() ([]byte, error) {
+	secret, err := a.store.getSetting(shareSecretKey)
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(b)
+		if err := a.store.setSetting(shareSecretKey, secret); err != nil {
+			return nil, err
+		}
+	}
+	return []byte(secret), nil
+}
+
+func shareSignature(secret []byte, convID string, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(convID + "." + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// shareToken is a link token for convID until expires.
+func (a *agentService) shareToken(convID string, expires time.Time) (string, error) {
+	secret, err := a.shareSecret()
+	if err != nil {
+		return "", err
+	}
+	exp := expires.Unix()
+	return convID + "." + strconv.FormatInt(exp, 10) + "." + shareSignature(secret, convID, exp), nil
+}
+
+// sharedConversation returns the conversation token shares, or "" if the
+// token is forged or expired.
+func (a *agentService) sharedConversation(token string, now time.Time) string {
+	rest, sig, ok := cutLast(token, ".")
+	if !ok {
+		return ""
+	}
+	convID, expStr, ok := cutLast(rest, ".")
+	exp, err := strconv.ParseInt(expStr, 10, 64)
+	if !ok || err != nil || now.Unix() >= exp {
+		return ""
+	}
+	secret, err := a.shareSecret()
+	if err != nil || !hmac.Equal([]byte(sig), []byte(shareSignature(secret, convID, exp))) {
+		return ""
+	}
+	return convID
+}
+
+func cutLast(s, sep string) (before, after string, ok bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+// --- POST /agent/conversations/:id/share ---
+
+func (a *agentService) handleShare(w http.ResponseWriter, r *http.Request, convID string) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	var req struct {
+		TTLMs int64 `json:"ttl_ms"` // default: 7 days
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSON(w, 400, map[string]string{"error": "invalid body"})
+		return
+	}
+	ttl := defaultShareTTL
+	if req.TTLMs > 0 {
+		ttl = time.Duration(req.TTLMs) * time.Millisecond
+	}
+	if ttl > maxShareTTL {
+		writeJSON(w, 400, map[string]string{"error": "ttl_ms is at most 90 days"})
+		return
+	}
+	conv, err := a.store.getConversation(convID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if conv == nil {
+		http.NotFound(w, r)
+		return
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	token, err := a.shareToken(convID, expires)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, shareResponse{Path: "/chat/shared/" + token, ExpiresAt: expires.UTC().Format(time.RFC3339)})
+}
+
+// --- GET /chat/shared/<token> ---
+
+// sharedEntry is one item of a shared transcript.
+type sharedEntry struct {
+	Role   string        // "user", "assistant", "tool", or "command"
+	Text   string        // user messages, tool and command names
+	HTML   template.HTML // assistant messages, rendered and sanitized when stored
+	Output string        // a tool's or command's output, cut to sharedOutputMax
+}
+
+func (a *agentService) handleShared(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/chat/shared/")
+	convID := a.sharedConversation(token, time.Now())
+	if convID == "" {
+		http.Error(w, "this link is invalid or has expired", 404)
+		return
+	}
+	conv, err := a.store.getConversation(convID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if conv == nil {
+		http.Error(w, "this conversation was pruned", 404)
+		return
+	}
+	msgs, err := a.store.getMessages(convID, 0)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	title := conv.Title
+	if title == "" {
+		title = "Conversation"
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	sharedTemplate.Execute(w, map[string]any{
+		"Title":   title,
+		"Created": conv.CreatedAt,
+		"Accent":  a.chatAccent,
+		"Entries": sharedEntries(msgs),
+	})
+}
+
+// sharedEntries turns stored messages into a transcript: what the user and
+// the agent wrote, the tools it used and what they returned, and commands.
+func sharedEntries(msgs []messageRow) []sharedEntry {
+	var entries []sharedEntry
+	tools := map[string]int{} // tool_use id → its entry
+	hasAssistant := false
+	for _, m := range msgs {
+		hasAssistant = hasAssistant || m.Type == "assistant"
+	}
+	for _, m := range msgs {
+		var d struct {
+			Content    string `json:"content"`
+			HTML       string `json:"html"`
+			Tool       string `json:"tool"`
+			ID         string `json:"id"`
+			Output     string `json:"output"`
+			Result     string `json:"result"`
+			ResultHTML string `json:"result_html"`
+			Command    string `json:"command"`
+			Args       string `json:"args"`
+			Text       string `json:"text"`
+		}
+		if m.Type != "user" {
+			json.Unmarshal([]byte(m.Content), &d)
+		}
+		switch m.Type {
+		case "user":
+			entries = append(entries, sharedEntry{Role: "user", Text: m.Content})
+		case "assistant":
+			if d.HTML == "" {
+				d.HTML = template.HTMLEscapeString(d.Content)
+			}
+			entries = append(entries, sharedEntry{Role: "assistant", HTML: template.HTML(d.HTML)})
+		case "done":
+			if d.Result != "" && !hasAssistant {
+				if d.ResultHTML == "" {
+					d.ResultHTML = template.HTMLEscapeString(d.Result)
+				}
+				entries = append(entries, sharedEntry{Role: "assistant", HTML: template.HTML(d.ResultHTML)})
+			}
+		case "tool_use":
+			tools[d.ID] = len(entries)
+			entries = append(entries, sharedEntry{Role: "tool", Text: d.Tool})
+		case "tool_result":
+			if i, ok := tools[d.ID]; ok {
+				entries[i].Output = cutOutput(d.Output)
+			}
+		case "command":
+			text := "/" + strings.TrimSpace(d.Command+" "+d.Args)
+			entries = append(entries, sharedEntry{Role: "command", Text: text, Output: cutOutput(strings.TrimSpace(d.Text + "\n" + d.Output))})
+		}
+	}
+	return entries
+}
+
+func cutOutput(s string) string {
+	if len(s) > sharedOutputMax {
+		return strings.ToValidUTF8(s[:sharedOutputMax], "") + "\n…"
+	}
+	return s
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"slot-machine/internal/engine"
+)
+
+// usageReport is the body of GET /agent/usage: token use since a time,
+// overall and by day, user, conversation, and model, with an estimated cost
+// when agent_prices is configured.
+type usageReport struct {
+	Since         string       `json:"since,omitempty"`
+	Total         usageTotals  `json:"total"`
+	Days          []usageGroup `json:"days"`
+	Users         []usageGroup `json:"users"`
+	Conversations []usageGroup `json:"conversations"`
+	Models        []usageGroup `json:"models"`
+}
+
+// parseSince reads ?since=: a duration back from now ("24h", "7d"), a date
+// ("2026-01-31", local midnight), or an RFC 3339 time. It returns RFC 3339,
+// or "" for no bound.
+func parseSince(s string, now time.Time) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n).Format(time.RFC3339), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d).Format(time.RFC3339), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t.Format(time.RFC3339), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.Format(time.RFC3339), nil
+	}
+	return "", fmt.Errorf("since must be a duration like 24h or 7d, a date, or an RFC 3339 time")
+}
+
+// estimateCost sets t.CostUSD from p, if there are prices.
+func estimateCost(p *engine.TokenPrices, t *usageTotals) {
+	if p == nil {
+		return
+	}
+	cost := (float64(t.InputTokens)*p.Input + float64(t.OutputTokens)*p.Output +
+		float64(t.CacheRead)*p.CacheRead + float64(t.CacheWrite)*p.CacheWrite) / 1e6
+	t.CostUSD = &cost
+}
+
+func (a *agentService) usage(since string) (*usageReport, error) {
+	rep := &usageReport{Since: since}
+	total, err := a.store.usageSince(since, "")
+	if err != nil {
+		return nil, err
+	}
+	rep.Total = total[0].usageTotals
+	estimateCost(a.prices, &rep.Total)
+	for _, g := range []struct {
+		key string
+		out *[]usageGroup
+	}{{"day", &rep.Days}, {"user", &rep.Users}, {"conversation", &rep.Conversations}, {"model", &rep.Models}} {
+		groups, err := a.store.usageSince(since, g.key)
+		if err != nil {
+			return nil, err
+		}
+		for i := range groups {
+			estimateCost(a.prices, &groups[i].usageTotals)
+		}
+		if groups == nil {
+			groups = []usageGroup{}
+		}
+		*g.out = groups
+	}
+	return rep, nil
+}
+
+// --- GET /agent/usage ---
+
+func (a *agentService) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	since, err := parseSince(r.URL.Query().Get("since"), time.Now())
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	rep, err := a.usage(since)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, 200, rep)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+
+	"slot-machine/internal/engine"
+)
+
+const (
+	autoUpdateInterval = 24 * time.Hour
+	autoUpdateTick     = 5 * time.Minute
+)
+
+// autoUpdater checks for a new release once a day and stages it next to
+// the daemon's binary once it verifies. In the maintenance window it moves
+// the release into place and re-execs the daemon onto it, handing the new
+// daemon the listening sockets and the live slot's process so the app
+// keeps serving (see engine.Handoff).
+type autoUpdater struct {
+	cfg    engine.AutoUpdate
+	window [2]int // minutes since midnight; equal means any time
+	self   string
+	env    []string // the daemon's environment before it dropped its tokens
+	app    string
+	o      *engine.Orchestrator
+
+	handoff  func() (*engine.Handoff, error) // readies the re-exec, leaving the live slot running
+	shutdown func()                          // stops the agents, slots, and proxies, if handoff fails
+
+	staged  string // where a verified release waits for the window: self.next
+	pending string // the release at staged
+}
+
+func newAutoUpdater(cfg engine.AutoUpdate, o *engine.Orchestrator, env []string, handoff func() (*engine.Handoff, error), shutdown func()) (*autoUpdater, error) {
+	if Version == "dev" {
+		return nil, fmt.Errorf("this is a dev build; auto_update needs a release")
+	}
+	if cfg.Channel == "" {
+		cfg.Channel = "stable"
+	}
+	if cfg.Channel != "stable" && cfg.Channel != "prerelease" {
+		return nil, fmt.Errorf("channel must be stable or prerelease")
+	}
+	window, err := parseWindow(cfg.Window)
+	if err != nil {
+		return nil, err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	self, _ = filepath.EvalSymlinks(self)
+	return &autoUpdater{cfg: cfg, window: window, self: self, env: env, app: o.App(), o: o, handoff: handoff, shutdown: shutdown, staged: self + ".next"}, nil
+}
+
+func (u *autoUpdater) run() {
+	var nextCheck time.Time
+	for {
+		now := time.Now()
+		if !now.Before(nextCheck) {
+			u.check()
+			nextCheck = now.Add(autoUpdateInterval)
+		}
+		if to := u.pending; to != "" && inWindow(u.window, now) {
+			if err := u.o.SelfUpdate(Version, to, u.install, u.reexec); err != nil {
+				fmt.Printf("auto-update: restart onto %s postponed: %v\n", to, err)
+			}
+		}
+		time.Sleep(autoUpdateTick)
+	}
+}
+
+// check stages the newest release on the channel if it isn't the one
+// running or staged already.
+func (u *autoUpdater) check() {
+	rel, err := fetchRelease(u.cfg.Channel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "auto-update: %v\n", err)
+		return
+	}
+	if rel.TagName == Version || rel.TagName == u.pending {
+		return
+	}
+	u.pending = ""
+	if err := downloadRelease(rel, u.staged, updatePublicKey()); err != nil {
+		fmt.Fprintf(os.Stderr, "auto-update: %s: %v\n", rel.TagName, err)
+		u.notify("update_failed", rel.TagName, err)
+		return
+	}
+	u.pending = rel.TagName
+	fmt.Printf("auto-update: downloaded %s, installing it and restarting onto it in the maintenance window\n", rel.TagName)
+	u.notify("update_downloaded", rel.TagName, nil)
+}
+
+// install moves the staged release over the daemon's binary. If it can't,
+// the release is downloaded again at the next check.
+func (u *autoUpdater) install() error {
+	if err := installBinary(u.staged, u.self); err != nil {
+		u.notify("update_failed", u.pending, err)
+		u.pending = ""
+		return err
+	}
+	return nil
+}
+
+// reexec replaces the daemon with the binary now at self, handing it the
+// listening sockets and the live slot's process. If they can't be handed
+// off, everything is stopped instead, and the new daemon recovers the live
+// slot as after any restart. reexec only returns if exec fails, and by
+// then the daemon has stopped serving, so it exits for the service manager
+// to start it again.
+func (u *autoUpdater) reexec() error {
+	fmt.Printf("auto-update: restarting %s → %s\n", Version, u.pending)
+	u.notify("update_restarting", u.pending, nil)
+	env := u.env
+	if h, err := u.handoff(); err != nil {
+		fmt.Fprintf(os.Stderr, "auto-update: cannot hand off to the new daemon (%v); stopping the app for the restart\n", err)
+		u.shutdown()
+	} else {
+		env = append(slices.Clone(u.env), engine.HandoffEnv+"="+h.Encode())
+	}
+	err := syscall.Exec(u.self, os.Args, env)
+	fmt.Fprintf(os.Stderr, "auto-update: exec %s: %v\n", u.self, err)
+	u.notify("update_failed", u.pending, err)
+	os.Exit(1)
+	return err
+}
+
+// notify POSTs an event to each configured webhook. Failures are logged
+// and otherwise ignored: a webhook being down mustn't hold up an update.
+func (u *autoUpdater) notify(event, version string, err error) {
+	payload := map[string]string{
+		"event":        event,
+		"app":          u.app,
+		"version":      version,
+		"prev_version": Version,
+		"time":         time.Now().Format(time.RFC3339),
+	}
+	if err != nil {
+		payload["error"] = err.Error()
+	}
+	body, _ := json.Marshal(payload)
+	hc := &http.Client{Timeout: 10 * time.Second}
+	for _, url := range u.cfg.Webhooks {
+		resp, err := hc.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "auto-update: webhook %s: %v\n", url, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			fmt.Fprintf(os.Stderr, "auto-update: webhook %s returned %d\n", url, resp.StatusCode)
+		}
+	}
+}
+
+// parseWindow parses "HH:MM-HH:MM" into minutes since midnight. An empty
+// window allows restarts at any time.
+func parseWindow(s string) ([2]int, error) {
+	var w [2]int
+	if s == "" {
+		return w, nil
+	}
+	var h1, m1, h2, m2 int
+	if n, _ := fmt.Sscanf(s, "%d:%d-%d:%d", &h1, &m1, &h2, &m2); n != 4 ||
+		h1 < 0 || h1 > 23 || h2 < 0 || h2 > 23 || m1 < 0 || m1 > 59 || m2 < 0 || m2 > 59 {
+		return w, fmt.Errorf("window %q is not HH:MM-HH:MM", s)
+	}
+	w[0], w[1] = h1*60+m1, h2*60+m2
+	if w[0] == w[1] {
+		return w, fmt.Errorf("window %q is empty", s)
+	}
+	return w, nil
+}
+
+// inWindow reports whether t's local time of day falls in w, which may
+// wrap past midnight.
+func inWindow(w [2]int, t time.Time) bool {
+	if w[0] == w[1] {
+		return true
+	}
+	m := t.Hour()*60 + t.Minute()
+	if w[0] < w[1] {
+		return m >= w[0] && m < w[1]
+	}
+	return m >= w[0] || m < w[1]
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"archive/tar"
+	"cmp"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"slot-machine/internal/engine"
+)
+
+// A backup is a gzipped tar of the daemon's metadata, enough to rebuild it
+// on another machine from a clone of the repo: the config, the journal,
+// state.json, a consistent copy of agent.db, and manifest.json. Slot
+// directories aren't included; restore checks them out again. Neither are
+// shared_dirs or env_file, which hold the app's data and secrets.
+
+const backupFormat = 1
+
+// backupFiles are the data dir files a backup carries, besides the config.
+var backupFiles = []string{"journal.ndjson", "state.json", "agent.db"}
+
+type backupManifest struct {
+	Format   int               `json:"format"`
+	Created  string            `json:"created"`
+	Version  string            `json:"version"` // slot-machine that wrote it
+	App      string            `json:"app"`
+	Head     string            `json:"head,omitempty"`     // the repo's HEAD at backup time
+	Symlinks map[string]string `json:"symlinks,omitempty"` // live/prev → slot directory
+}
+
+func cmdBackup(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dataDir := fs.String("data", "", "path to data directory (default: <repo>/.slot-machine)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fatal(false, exitError, "usage: slot-machine backup [--data dir] <file>")
+	}
+
+	repo, ok := findConfigDir()
+	if !ok {
+		fatal(false, exitError, "cannot find slot-machine.json in current or parent directories")
+	}
+	if *dataDir == "" {
+		*dataDir = filepath.Join(repo, ".slot-machine")
+	}
+	if err := writeBackup(fs.Arg(0), repo, *dataDir); err != nil {
+		fatal(false, exitError, "%v", err)
+	}
+	fmt.Printf("backed up %s to %s\n", *dataDir, fs.Arg(0))
+}
+
+func writeBackup(path, repo, dataDir string) error {
+	m := backupManifest{
+		Format:   backupFormat,
+		Created:  time.Now().UTC().Format(time.RFC3339),
+		Version:  Version,
+		App:      filepath.Base(repo),
+		Symlinks: map[string]string{},
+	}
+	m.Head, _ = gitHeadCommit(repo)
+	for _, name := range []string{"live", "prev"} {
+		if target, err := os.Readlink(filepath.Join(dataDir, name)); err == nil {
+			m.Symlinks[name] = target
+		}
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	manifest, _ := json.MarshalIndent(m, "", "  ")
+	if err := addTarFile(tw, "manifest.json", manifest); err != nil {
+		f.Close()
+		return err
+	}
+	config, err := os.ReadFile(filepath.Join(repo, "slot-machine.json"))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := addTarFile(tw, "slot-machine.json", config); err != nil {
+		f.Close()
+		return err
+	}
+	for _, name := range backupFiles {
+		data, err := readBackupFile(dataDir, name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			err = addTarFile(tw, name, data)
+		}
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	return os.Rename(tmp, path)
+}
+
+// readBackupFile reads a data dir file for the backup. agent.db is copied
+// with VACUUM INTO, which gives a consistent snapshot even while the
+// daemon is writing to it.
+func readBackupFile(dataDir, name string) ([]byte, error) {
+	path := filepath.Join(dataDir, name)
+	if name != "agent.db" {
+		return os.ReadFile(path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	snap := filepath.Join(os.TempDir(), fmt.Sprintf("slot-machine-agent-%d.db", os.Getpid()))
+	os.Remove(snap)
+	defer os.Remove(snap)
+	if _, err := db.Exec("VACUUM INTO '" + strings.ReplaceAll(snap, "'", "''") + "'"); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(snap)
+}
+
+func addTarFile(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func cmdRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	repoDir := fs.String("repo", "", "path to the git repo to restore into (default: .)")
+	dataDir := fs.String("data", "", "path to data directory (default: <repo>/.slot-machine)")
+	force := fs.Bool("force", false, "overwrite an existing data dir and slot-machine.json")
+	from := fs.String("from", "", "fetch the backup from s3://bucket/key instead of a file (default endpoint, region, and credentials: the repo config's state_backup)")
+	endpoint := fs.String("endpoint", "", "S3-compatible endpoint for --from (default: state_backup.endpoint, else AWS S3)")
+	region := fs.String("region", "", "region for --from (default: state_backup.region, else us-east-1)")
+	fs.Parse(args)
+	if (*from == "") == (fs.NArg() != 1) || fs.NArg() > 1 {
+		fatal(false, exitError, "usage: slot-machine restore [--repo dir] [--data dir] [--force] <file> | --from s3://bucket/key [--endpoint url] [--region r]")
+	}
+
+	if *repoDir == "" {
+		*repoDir, _ = os.Getwd()
+	}
+	repo, err := filepath.Abs(*repoDir)
+	if err != nil {
+		fatal(false, exitError, "%v", err)
+	}
+	if *dataDir == "" {
+		*dataDir = filepath.Join(repo, ".slot-machine")
+	}
+
+	path := fs.Arg(0)
+	if *from != "" {
+		if path, err = fetchBackup(*from, *endpoint, *region, repo); err != nil {
+			fatal(false, exitError, "%v", err)
+		}
+	}
+	m, err := restoreBackup(path, repo, *dataDir, *force)
+	if *from != "" {
+		os.Remove(path)
+	}
+	if err != nil {
+		fatal(false, exitError, "%v", err)
+	}
+	fmt.Printf("restored %s (backed up %s by slot-machine %s)\n", m.App, m.Created, m.Version)
+
+	if _, err := os.Stat(filepath.Join(*dataDir, "state.json")); err != nil {
+		fmt.Println("the backup has no slots; the first deploy creates them")
+		return
+	}
+	cfg, err := loadConfig(filepath.Join(repo, "slot-machine.json"))
+	if err != nil {
+		fatal(false, exitError, "%v", err)
+	}
+	o := engine.New(engine.Options{Config: cfg, RepoDir: repo, DataDir: *dataDir})
+	rebuilt, err := o.RebuildSlots(os.Stdout)
+	if err != nil {
+		fatal(false, exitError, "rebuilding slots: %v", err)
+	}
+	fmt.Printf("rebuilt %d slots; start the daemon with: slot-machine start\n", len(rebuilt))
+}
+
+// fetchBackup downloads the backup at from, an s3:// URL, to a temporary
+// file and returns its path. The repo config's state_backup, if it has one,
+// says where and how to reach the storage, unless endpoint or region do.
+func fetchBackup(from, endpoint, region, repo string) (string, error) {
+	var sb engine.StateBackup
+	if cfg, err := loadConfig(filepath.Join(repo, "slot-machine.json")); err == nil && cfg.StateBackup != nil {
+		sb = *cfg.StateBackup
+	}
+	sb.URL = from
+	sb.Endpoint = cmp.Or(endpoint, sb.Endpoint)
+	sb.Region = cmp.Or(region, sb.Region)
+	obj, err := newS3Object(sb, filepath.Base(repo))
+	if err != nil {
+		return "", fmt.Errorf("--from: %w", err)
+	}
+	data, err := obj.get()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp("", "slot-machine-restore-*.tar.gz")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	fmt.Printf("fetched %s (%d bytes)\n", obj, len(data))
+	return f.Name(), nil
+}
+
+// restoreBackup unpacks the backup at path into dataDir, and its config
+// into repo unless one is there already. It refuses to overwrite existing
+// state without force, and always while a daemon holds the data dir.
+func restoreBackup(path, repo, dataDir string, force bool) (*backupManifest, error) {
+	if pid, _, held := daemonLockState(dataDir); held {
+		return nil, fmt.Errorf("a daemon (pid %d) is running on %s; stop it first", pid, dataDir)
+	}
+	if !force {
+		for _, name := range backupFiles {
+			if _, err := os.Stat(filepath.Join(dataDir, name)); err == nil {
+				return nil, fmt.Errorf("%s already has %s; use --force to overwrite it", dataDir, name)
+			}
+		}
+	}
+
+	files, err := readBackup(path)
+	if err != nil {
+		return nil, err
+	}
+	var m backupManifest
+	if err := json.Unmarshal(files["manifest.json"], &m); err != nil {
+		return nil, fmt.Errorf("%s: bad manifest.json: %w", path, err)
+	}
+	if m.Format != backupFormat {
+		return nil, fmt.Errorf("%s: backup format %d, this slot-machine reads %d", path, m.Format, backupFormat)
+	}
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+	for _, name := range backupFiles {
+		data, ok := files[name]
+		if !ok {
+			os.Remove(filepath.Join(dataDir, name)) // left over from before --force
+			continue
+		}
+		if name == "agent.db" {
+			// A stale WAL would be replayed over the restored database.
+			os.Remove(filepath.Join(dataDir, name+"-wal"))
+			os.Remove(filepath.Join(dataDir, name+"-shm"))
+		}
+		if err := os.WriteFile(filepath.Join(dataDir, name), data, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	configPath := filepath.Join(repo, "slot-machine.json")
+	if _, err := os.Stat(configPath); err == nil && !force {
+		fmt.Printf("keeping the existing %s (--force replaces it with the backup's)\n", configPath)
+	} else if err := os.WriteFile(configPath, files["slot-machine.json"], 0644); err != nil {
+		return nil, err
+	}
+
+	if m.Head != "" {
+		if head, err := gitHeadCommit(repo); err == nil && head != m.Head {
+			fmt.Printf("note: the repo's HEAD is %s, it was %s when backed up\n", engine.ShortHash(head), engine.ShortHash(m.Head))
+		}
+	}
+	return &m, nil
+}
+
+// readBackup returns the files in a backup by name. Only the names a
+// backup writes are accepted.
+func readBackup(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	known := map[string]bool{"manifest.json": true, "slot-machine.json": true}
+	for _, name := range backupFiles {
+		known[name] = true
+	}
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if !known[hdr.Name] || hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%s: unexpected entry %q", path, hdr.Name)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		files[hdr.Name] = data
+	}
+	for _, name := range []string{"manifest.json", "slot-machine.json"} {
+		if _, ok := files[name]; !ok {
+			return nil, fmt.Errorf("%s: not a slot-machine backup (no %s)", path, name)
+		}
+	}
+	return files, nil
+}
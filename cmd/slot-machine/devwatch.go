@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"slot-machine/internal/engine"
+)
+
+// devWatchInterval is how often start --dev looks at the branch's ref.
+const devWatchInterval = 500 * time.Millisecond
+
+// devWatcher deploys every commit that lands on a branch of the repo, for
+// start --dev: commit locally and the app swaps to it, as in production. It
+// watches the ref files under .git and only asks git for the branch's tip
+// when one of them changed.
+type devWatcher struct {
+	repoDir string
+	gitDir  string // the repo's common .git dir, where branch refs live
+	branch  string // refs/heads/...
+	deploy  func(commit string) (engine.DeployResponse, int)
+
+	stamp    string // mtimes and sizes of the ref files when last looked at
+	deployed string // the last commit deployed, successfully or not
+	waiting  string // a commit waiting for another deploy to finish
+}
+
+// newDevWatcher watches the branch checked out in repoDir. It deploys
+// nothing until deploy is set.
+func newDevWatcher(repoDir string) (*devWatcher, error) {
+	out, err := exec.Command("git", "-C", repoDir, "symbolic-ref", "-q", "HEAD").Output()
+	if err != nil {
+		return nil, fmt.Errorf("--dev needs a branch checked out in %s, not a detached HEAD", repoDir)
+	}
+	branch := strings.TrimSpace(string(out))
+	out, err = exec.Command("git", "-C", repoDir, "rev-parse", "--git-common-dir").Output()
+	if err != nil {
+		return nil, fmt.Errorf("git rev-parse --git-common-dir: %w", err)
+	}
+	gitDir := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(repoDir, gitDir)
+	}
+	return &devWatcher{repoDir: repoDir, gitDir: gitDir, branch: branch}, nil
+}
+
+func (w *devWatcher) run() {
+	fmt.Printf("dev mode: deploying new commits on %s\n", strings.TrimPrefix(w.branch, "refs/heads/"))
+	for {
+		w.check()
+		time.Sleep(devWatchInterval)
+	}
+}
+
+// check deploys the branch's tip if its ref files changed since the last
+// check and it isn't the commit last deployed (or live when the watcher
+// started). A deploy refused because another one is running is tried
+// again on the next check.
+func (w *devWatcher) check() {
+	stamp := w.refStamp()
+	if stamp == w.stamp {
+		return
+	}
+	out, err := exec.Command("git", "-C", w.repoDir, "rev-parse", "--verify", "-q", w.branch+"^{commit}").Output()
+	if err != nil {
+		// Mid-update, or the branch is gone; look again next time.
+		return
+	}
+	commit := strings.TrimSpace(string(out))
+	if commit == w.deployed {
+		w.stamp = stamp
+		return
+	}
+
+	if commit != w.waiting {
+		fmt.Printf("dev mode: %s is now %s, deploying\n", strings.TrimPrefix(w.branch, "refs/heads/"), engine.ShortHash(commit))
+	}
+	resp, code := w.deploy(commit)
+	if code == 409 {
+		w.waiting = commit
+		return
+	}
+	w.stamp, w.deployed, w.waiting = stamp, commit, ""
+	if resp.Success {
+		fmt.Printf("dev mode: deployed %s to %s\n", engine.ShortHash(commit), resp.Slot)
+	} else {
+		fmt.Fprintf(os.Stderr, "dev mode: deploy of %s failed: %s\n", engine.ShortHash(commit), resp.Error)
+	}
+}
+
+// refStamp sums up the modification times of the files git keeps the
+// branch's tip in: its loose ref and packed-refs.
+func (w *devWatcher) refStamp() string {
+	var b strings.Builder
+	for _, path := range []string{filepath.Join(w.gitDir, filepath.FromSlash(w.branch)), filepath.Join(w.gitDir, "packed-refs")} {
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&b, "%d/%d ", info.ModTime().UnixNano(), info.Size())
+		} else {
+			b.WriteString("- ")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"slot-machine/internal/engine"
+	"slot-machine/pkg/client"
+)
+
+// events follows the daemon's event stream, one line per event. It starts
+// with the events the daemon kept and, if the daemon goes away, reconnects
+// from the last one it printed.
+
+// eventsReconnect is how long events waits before reconnecting.
+const eventsReconnect = time.Second
+
+func cmdEvents(args []string) {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print each event as a line of JSON")
+	types := fs.String("types", "", "comma-separated event types to show (default: all)")
+	fs.Parse(args)
+
+	var filter []string
+	if *types != "" {
+		filter = strings.Split(*types, ",")
+	}
+	c := newClient()
+	ctx := context.Background()
+
+	var after int64
+	for {
+		err := c.Events(ctx, after, func(e client.DaemonEvent) error {
+			after = e.ID
+			if *jsonOut {
+				data, _ := json.Marshal(e)
+				fmt.Println(string(data))
+			} else {
+				fmt.Println(formatEvent(e))
+			}
+			return nil
+		}, filter...)
+		var apiErr *client.APIError
+		if errors.As(err, &apiErr) {
+			fatal(*jsonOut, exitError, "%v", err)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "events: %v; reconnecting\n", err)
+		}
+		time.Sleep(eventsReconnect)
+	}
+}
+
+// formatEvent is an event's line: time, type, commit, slot, and what its
+// data says, e.g. "10:04:05  deploy_finished   3f2a9c1e  slot-3f2a9c1e  ok in 4.2s".
+func formatEvent(e client.DaemonEvent) string {
+	when := e.Time
+	if t, err := time.Parse(time.RFC3339, e.Time); err == nil {
+		when = t.Local().Format("15:04:05")
+	}
+	line := fmt.Sprintf("%s  %-18s  %-8s  %s", when, e.Type, engine.ShortHash(e.Commit), e.Slot)
+
+	var d struct {
+		Success      *bool  `json:"success"`
+		Error        string `json:"error"`
+		DurationMs   int64  `json:"duration_ms"`
+		Phase        string `json:"phase"`
+		Message      string `json:"message"`
+		Status       string `json:"status"`
+		Reason       string `json:"reason"`
+		Conversation string `json:"conversation"`
+		Suggestion   string `json:"suggestion"`
+		RestartInMs  int64  `json:"restart_in_ms"`
+		Action       string `json:"action"`
+	}
+	json.Unmarshal(e.Data, &d)
+	var detail string
+	switch {
+	case d.Success != nil && *d.Success:
+		detail = fmt.Sprintf("ok in %.1fs", float64(d.DurationMs)/1000)
+	case d.Success != nil:
+		detail = fmt.Sprintf("failed in %.1fs: %s", float64(d.DurationMs)/1000, d.Error)
+	case d.Phase != "":
+		detail = d.Phase + ": " + d.Message
+	case d.Conversation != "":
+		detail = fmt.Sprintf("conversation %s %s", d.Conversation, d.Status)
+	case d.Suggestion != "":
+		detail = d.Suggestion
+	case d.RestartInMs > 0:
+		detail = fmt.Sprintf("restarting in %.1fs", float64(d.RestartInMs)/1000)
+	case d.Status != "":
+		detail = d.Status
+		if d.Error != "" {
+			detail += ": " + d.Error
+		}
+	case d.Reason != "":
+		detail = d.Reason
+	case d.Action != "":
+		detail = d.Action
+	case d.Error != "":
+		detail = d.Error
+	}
+	if detail != "" {
+		line += "  " + detail
+	}
+	return strings.TrimRight(line, " ")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"slot-machine/internal/engine"
+)
+
+// install-hook sets up push-to-deploy: a post-receive hook in the repo
+// pushed to runs `slot-machine deploy` for each push to the branch, so
+// `git push production main` deploys through the daemon and its progress
+// comes back over the push connection as "remote:" lines. The hook goes
+// in the app's repo itself, or in a bare repo that pushes land in, in
+// which case it first fetches the branch into the app's repo.
+
+// hookMarker identifies a post-receive hook written by install-hook.
+const hookMarker = "# slot-machine push-to-deploy"
+
+func cmdInstallHook(args []string) {
+	fs := flag.NewFlagSet("install-hook", flag.ExitOnError)
+	gitDir := fs.String("git-dir", "", "bare repo that receives the pushes (default: the app's repo)")
+	branch := fs.String("branch", "", "branch whose pushes are deployed (default: the one checked out)")
+	force := fs.Bool("force", false, "replace a post-receive hook slot-machine didn't write")
+	fs.Parse(args)
+
+	repoDir, ok := findConfigDir()
+	if !ok {
+		fmt.Fprintln(os.Stderr, "error: cannot find slot-machine.json in current or parent directories")
+		os.Exit(1)
+	}
+	if *branch == "" {
+		out, err := exec.Command("git", "-C", repoDir, "symbolic-ref", "-q", "--short", "HEAD").Output()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: no branch checked out; pass --branch")
+			os.Exit(1)
+		}
+		*branch = strings.TrimSpace(string(out))
+	}
+	self, err := os.Executable()
+	if err == nil {
+		self, err = filepath.EvalSymlinks(self)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: cannot determine own path: %v\n", err)
+		os.Exit(1)
+	}
+
+	path, err := installHook(self, repoDir, *gitDir, *branch, *force)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("installed %s\n", path)
+	fmt.Printf("pushes to %s now deploy, e.g. git push <remote> %s\n", *branch, *branch)
+}
+
+// installHook writes the post-receive hook into gitDir, or into repoDir's
+// own repo if gitDir is empty, and returns its path. A pushed-to repo with
+// a work tree gets receive.denyCurrentBranch updateInstead, or git would
+// refuse pushes to its checked-out branch.
+func installHook(bin, repoDir, gitDir, branch string, force bool) (string, error) {
+	repoDir, err := filepath.Abs(repoDir)
+	if err != nil {
+		return "", err
+	}
+	target := repoDir
+	if gitDir != "" {
+		if target, err = filepath.Abs(gitDir); err != nil {
+			return "", err
+		}
+	}
+	git := func(args ...string) (string, error) {
+		out, err := exec.Command("git", append([]string{"-C", target}, args...)...).Output()
+		if err != nil {
+			return "", fmt.Errorf("%s: git %s: %w", target, strings.Join(args, " "), err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	bare, err := git("rev-parse", "--is-bare-repository")
+	if err != nil {
+		return "", err
+	}
+	hooks, err := git("rev-parse", "--git-path", "hooks")
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(hooks) {
+		hooks = filepath.Join(target, hooks)
+	}
+	path := filepath.Join(hooks, "post-receive")
+	if old, err := os.ReadFile(path); err == nil && !strings.Contains(string(old), hookMarker) && !force {
+		return "", fmt.Errorf("%s exists and wasn't written by slot-machine; pass --force to replace it", path)
+	}
+
+	fetchFrom := ""
+	if target != repoDir {
+		fetchFrom = target
+	}
+	if bare != "true" {
+		if v, _ := git("config", "receive.denyCurrentBranch"); v == "" {
+			if _, err := git("config", "receive.denyCurrentBranch", "updateInstead"); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if err := os.MkdirAll(hooks, 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(postReceiveHook(bin, repoDir, fetchFrom, branch)), 0755); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// postReceiveHook is the hook's script. With fetchFrom set, the pushed
+// commit is fetched from that repo into repoDir before it's deployed.
+func postReceiveHook(bin, repoDir, fetchFrom, branch string) string {
+	ref := "refs/heads/" + branch
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!/bin/sh\n%s: deploys what's pushed to %s.\n", hookMarker, branch)
+	b.WriteString("# Written by `slot-machine install-hook`; run it again to update.\n")
+	// Git points hooks at the repo pushed to; the commands below run in
+	// the app's.
+	b.WriteString("unset $(git rev-parse --local-env-vars)\n")
+	b.WriteString("while read old new ref; do\n")
+	fmt.Fprintf(&b, "\t[ \"$ref\" = %s ] || continue\n", engine.ShellQuote(ref))
+	b.WriteString("\tcase \"$new\" in *[!0]*) ;; *) continue ;; esac # deleted\n")
+	fmt.Fprintf(&b, "\tcd %s || exit 1\n", engine.ShellQuote(repoDir))
+	if fetchFrom != "" {
+		fmt.Fprintf(&b, "\tgit fetch -q --update-head-ok %s \"+$ref:$ref\" || exit 1\n", engine.ShellQuote(fetchFrom))
+	}
+	fmt.Fprintf(&b, "\t%s deploy --source webhook \"$new\" 2>&1\n", engine.ShellQuote(bin))
+	b.WriteString("done\n")
+	return b.String()
+}
@@ -2,21 +2,28 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"slot-machine/internal/engine"
 )
 
-func cmdInit() {
+func cmdInit(args []string) {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	verify := fs.Bool("verify", false, "then set up and boot HEAD with the config on scratch ports to check it works")
+	fs.Parse(args)
+
 	cwd, err := os.Getwd()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
 
-	cfg := config{
+	cfg := engine.Config{
 		Port:            3000,
 		InternalPort:    3000,
 		HealthEndpoint:  "/healthz",
@@ -40,6 +47,31 @@ func cmdInit() {
 		cfg.StartCommand = "bundle exec ruby app.rb"
 	}
 
+	// A Procfile says how the app starts better than a guess does.
+	procs, err := readProcfile(filepath.Join(cwd, "Procfile"))
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "warning: Procfile: %v\n", err)
+	}
+	var fromProcfile bool
+	var others []procfileEntry
+	for _, p := range procs {
+		if p.name == "web" {
+			cfg.StartCommand, fromProcfile = p.command, true
+		} else {
+			others = append(others, p)
+		}
+	}
+
+	var dockerCmd string
+	if cfg.StartCommand == "" {
+		if cmd, err := readDockerfileCmd(filepath.Join(cwd, "Dockerfile")); err == nil {
+			dockerCmd = cmd
+			cfg.StartCommand = cmd
+		}
+	}
+
+	cfg.StopSignal = detectStopSignal(cfg.StartCommand)
+
 	if fileExists(filepath.Join(cwd, ".env")) {
 		cfg.EnvFile = ".env"
 	}
@@ -51,6 +83,19 @@ func cmdInit() {
 		os.Exit(1)
 	}
 	fmt.Printf("wrote %s\n", cfgPath)
+	if fromProcfile {
+		fmt.Println("start_command is the Procfile's web process")
+	}
+	if len(others) > 0 {
+		// Slots run one process, the web one; nothing else is supervised.
+		fmt.Println("slot-machine runs only the web process; run these from the Procfile under your own supervisor:")
+		for _, p := range others {
+			fmt.Printf("  %s: %s\n", p.name, p.command)
+		}
+	}
+	if dockerCmd != "" {
+		fmt.Println("start_command is the Dockerfile's CMD: slot-machine runs the app as a process on the host, not in a container, so setup_command must install what the image would")
+	}
 
 	gitignorePath := filepath.Join(cwd, ".gitignore")
 	if !gitignoreContains(gitignorePath, ".slot-machine") {
@@ -72,6 +117,13 @@ func cmdInit() {
 			fmt.Println("added .slot-machine to .gitignore")
 		}
 	}
+
+	if *verify {
+		if err := verifyInit(cwd, cfg); err != nil {
+			fatal(false, exitHealthFailed, "verify: %v", err)
+		}
+		fmt.Println("verify: ok, the config sets up and boots HEAD")
+	}
 }
 
 func fileExists(path string) bool {
@@ -79,6 +131,65 @@ func fileExists(path string) bool {
 	return err == nil
 }
 
+// procfileEntry is a process type in a Procfile.
+type procfileEntry struct {
+	name    string
+	command string
+}
+
+// readProcfile parses a Heroku-style Procfile, "name: command" per line, in
+// order. Blank lines and # comments are skipped.
+func readProcfile(path string) ([]procfileEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var procs []procfileEntry
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, command, ok := strings.Cut(line, ":")
+		name, command = strings.TrimSpace(name), strings.TrimSpace(command)
+		if !ok || name == "" || command == "" || strings.ContainsAny(name, " \t") {
+			return procs, fmt.Errorf("line %d: want \"name: command\", not %q", i+1, line)
+		}
+		procs = append(procs, procfileEntry{name, command})
+	}
+	return procs, nil
+}
+
+// readDockerfileCmd returns the command of a Dockerfile's last CMD, the
+// one an image runs, as a shell command.
+func readDockerfileCmd(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var cmd string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) < 4 || !strings.EqualFold(line[:4], "CMD ") {
+			continue
+		}
+		arg := strings.TrimSpace(line[4:])
+		var argv []string
+		if json.Unmarshal([]byte(arg), &argv) == nil {
+			// Exec form: ["bin/server", "--port", "3000"].
+			if len(argv) == 3 && (argv[0] == "sh" || argv[0] == "/bin/sh") && argv[1] == "-c" {
+				argv = argv[2:]
+			}
+			arg = shellCommand(argv)
+		}
+		cmd = arg
+	}
+	if cmd == "" {
+		return "", fmt.Errorf("%s has no CMD", path)
+	}
+	return cmd, nil
+}
+
 func readStartScript(dir, runtime string) string {
 	data, err := os.ReadFile(filepath.Join(dir, "package.json"))
 	if err != nil {
@@ -100,6 +211,22 @@ func readStartScript(dir, runtime string) string {
 	return runtime + " index.js"
 }
 
+// interruptStarters are start commands that stop cleanly on SIGINT, as
+// after Ctrl-C, and may not on SIGTERM: dev servers that leave a child
+// behind or skip cleanup, and Python, where SIGTERM skips finally blocks
+// and atexit.
+var interruptStarters = []string{"next dev", "vite", "nodemon", "webpack serve", "--watch", "python "}
+
+// detectStopSignal returns the stop_signal for start, or "" for SIGTERM.
+func detectStopSignal(start string) string {
+	for _, s := range interruptStarters {
+		if strings.Contains(start, s) {
+			return "SIGINT"
+		}
+	}
+	return ""
+}
+
 func gitignoreContains(path, entry string) bool {
 	data, err := os.ReadFile(path)
 	if err != nil {
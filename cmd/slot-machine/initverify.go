@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"slot-machine/internal/engine"
+)
+
+// init --verify tries the config it wrote before a deploy relies on it: it
+// checks HEAD out in a throwaway worktree, runs setup_command there, starts
+// start_command on scratch ports with the environment a slot gets, and
+// polls health_endpoint on INTERNAL_PORT (and app_health_endpoint on PORT)
+// as a deploy would. The first thing that fails is reported, with the tail
+// of the output of the command that failed and, where it can tell, why.
+
+const (
+	verifyOutputLines = 20
+	verifyStopTimeout = 5 * time.Second
+)
+
+// lockedBuffer collects a command's output while it runs.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// tail returns the output's last n lines, indented for printing under an
+// error.
+func (b *lockedBuffer) tail(n int) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines := strings.Split(strings.TrimRight(b.buf.String(), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	if len(lines) == 1 && lines[0] == "" {
+		return "  (no output)"
+	}
+	return "  " + strings.Join(lines, "\n  ")
+}
+
+// verifyInit sets up and boots HEAD of repo with cfg, and returns the first
+// thing that went wrong.
+func verifyInit(repo string, cfg engine.Config) error {
+	if cfg.StartCommand == "" {
+		return fmt.Errorf("no start_command: set it in slot-machine.json")
+	}
+	dir, err := os.MkdirTemp("", "slot-machine-verify-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if out, err := exec.Command("git", "-C", repo, "worktree", "add", "--detach", dir, "HEAD").CombinedOutput(); err != nil {
+		return fmt.Errorf("checking out HEAD: %s", strings.TrimSpace(string(out)))
+	}
+	defer exec.Command("git", "-C", repo, "worktree", "remove", "--force", dir).Run()
+	fmt.Printf("verify: checked out HEAD in %s (uncommitted changes aren't in it)\n", dir)
+
+	appPort, err := scratchPort()
+	if err != nil {
+		return err
+	}
+	intPort, err := scratchPort()
+	if err != nil {
+		return err
+	}
+	env := os.Environ()
+	if cfg.EnvFile != "" {
+		envPath := cfg.EnvFile
+		if !filepath.IsAbs(envPath) {
+			envPath = filepath.Join(repo, envPath)
+		}
+		extra, err := engine.LoadEnvFile(envPath)
+		if err != nil {
+			return fmt.Errorf("env_file: %w", err)
+		}
+		env = append(env, extra...)
+	}
+	env = append(env, "SLOT_MACHINE=1", fmt.Sprintf("PORT=%d", appPort), fmt.Sprintf("INTERNAL_PORT=%d", intPort))
+
+	if cfg.SetupCommand != "" {
+		fmt.Printf("verify: setup: %s\n", cfg.SetupCommand)
+		started := time.Now()
+		out := &lockedBuffer{}
+		cmd := exec.Command("/bin/sh", "-c", cfg.SetupCommand)
+		cmd.Dir, cmd.Env, cmd.Stdout, cmd.Stderr = dir, env, out, out
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("setup_command failed (%v):\n%s", err, out.tail(verifyOutputLines))
+		}
+		fmt.Printf("verify: setup done in %s\n", time.Since(started).Round(100*time.Millisecond))
+	}
+
+	fmt.Printf("verify: start: %s (PORT=%d, INTERNAL_PORT=%d)\n", cfg.StartCommand, appPort, intPort)
+	out := &lockedBuffer{}
+	cmd := exec.Command("/bin/sh", "-c", cfg.StartCommand)
+	cmd.Dir, cmd.Env, cmd.Stdout, cmd.Stderr = dir, env, out, out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start_command: %w", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer stopVerifyApp(cmd, exited)
+
+	timeout := time.Duration(cmp.Or(cfg.HealthTimeoutMs, 10000)) * time.Millisecond
+	if p := cfg.StartupProbe; p != nil && p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	type check struct {
+		port int
+		path string
+	}
+	checks := []check{{intPort, cmp.Or(cfg.HealthEndpoint, "/")}}
+	if cfg.AppHealthEndpoint != "" {
+		checks = append(checks, check{appPort, cfg.AppHealthEndpoint})
+	}
+	deadline := time.Now().Add(timeout)
+	for _, c := range checks {
+		if err := pollVerifyHealth(c.port, c.path, deadline, exited); err != nil {
+			why := err.Error()
+			if c.port == intPort && answers(appPort, c.path) {
+				why += fmt.Sprintf("; it answers on PORT (%d): listen on INTERNAL_PORT too, or set internal_port to the same as port", appPort)
+			}
+			return fmt.Errorf("%s:\n%s", why, out.tail(verifyOutputLines))
+		}
+		fmt.Printf("verify: :%d%s answered 200\n", c.port, c.path)
+	}
+	return nil
+}
+
+// pollVerifyHealth polls path on port until it answers 200, the app exits,
+// or deadline passes.
+func pollVerifyHealth(port int, path string, deadline time.Time, exited chan error) error {
+	url := fmt.Sprintf("http://127.0.0.1:%d%s", port, path)
+	client := &http.Client{Timeout: 500 * time.Millisecond}
+	last := "nothing answered"
+	for time.Now().Before(deadline) {
+		resp, err := client.Get(url)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == 200 {
+				return nil
+			}
+			last = "it answered " + resp.Status
+			if resp.StatusCode == 404 {
+				last += ": is health_endpoint right?"
+			}
+		}
+		select {
+		case err := <-exited:
+			exited <- err // for stopVerifyApp
+			status := "exit status 0"
+			if err != nil {
+				status = err.Error()
+			}
+			return fmt.Errorf("start_command exited (%s) before %s answered 200", status, url)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	return fmt.Errorf("%s never answered 200 (%s) within the health timeout", url, last)
+}
+
+// answers reports whether anything answers path on port with 200.
+func answers(port int, path string) bool {
+	client := &http.Client{Timeout: 500 * time.Millisecond}
+	resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, path))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == 200
+}
+
+// stopVerifyApp stops the app's process group: SIGTERM, then SIGKILL if
+// it's still there after verifyStopTimeout.
+func stopVerifyApp(cmd *exec.Cmd, exited chan error) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(verifyStopTimeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-exited
+	}
+}
+
+// scratchPort returns a port free right now.
+func scratchPort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"slot-machine/internal/engine"
+)
+
+// keygen makes the SSH key the daemon reaches a private remote with: an
+// ed25519 key in the data dir, whose public half goes in the repo's deploy
+// keys. From its next start the daemon hands it to every git it runs
+// through GIT_SSH_COMMAND: its fetches, deploys' setup, and the agent's
+// pushes.
+
+func cmdKeygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	dataDir := fs.String("data", "", "path to data directory (default: <repo>/.slot-machine)")
+	force := fs.Bool("force", false, "replace the existing key")
+	fs.Parse(args)
+
+	repo, ok := findConfigDir()
+	if !ok {
+		fatal(false, exitError, "cannot find slot-machine.json in current or parent directories")
+	}
+	if *dataDir == "" {
+		*dataDir = filepath.Join(repo, ".slot-machine")
+	}
+	cfg, err := loadConfig(filepath.Join(repo, "slot-machine.json"))
+	if err != nil {
+		fatal(false, exitError, "%v", err)
+	}
+
+	host, _ := os.Hostname()
+	path := filepath.Join(*dataDir, engine.DeployKeyName)
+	pub, created, err := deployKeygen(path, "slot-machine@"+host, *force)
+	if err != nil {
+		fatal(false, exitError, "%v", err)
+	}
+	if created {
+		fmt.Printf("generated %s\n", path)
+	} else {
+		fmt.Printf("%s already exists (--force replaces it)\n", path)
+	}
+	fmt.Printf("\n%s\n\n", pub)
+	fmt.Println("Add this public key to the repo's deploy keys (GitHub: Settings → Deploy keys).")
+	fmt.Println("Read access is enough to deploy; allow write access if the agent should push.")
+	if cfg.DeployKeyFile != "" {
+		fmt.Printf("warning: slot-machine.json sets deploy_key_file %s, which the daemon uses instead\n", cfg.DeployKeyFile)
+	} else {
+		fmt.Println("The daemon uses it for git over SSH from its next start; deploy --fetch uses it right away.")
+	}
+}
+
+// deployKeygen generates an ed25519 key without a passphrase at path,
+// unless one is there and force is false, and returns its public key.
+func deployKeygen(path, comment string, force bool) (pub string, created bool, err error) {
+	if _, err := os.Stat(path); err == nil && !force {
+		out, err := exec.Command("ssh-keygen", "-y", "-f", path).Output()
+		if err != nil {
+			return "", false, fmt.Errorf("ssh-keygen -y %s: %w", path, err)
+		}
+		return strings.TrimSpace(string(out)), false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", false, err
+	}
+	os.Remove(path)
+	os.Remove(path + ".pub")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", comment, "-f", path).CombinedOutput(); err != nil {
+		return "", false, fmt.Errorf("ssh-keygen: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	data, err := os.ReadFile(path + ".pub")
+	if err != nil {
+		return "", false, err
+	}
+	return strings.TrimSpace(string(data)), true, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const pidFileName = "daemon.pid"
+
+// daemonLock is an flock-held PID file in the data dir. Two daemons sharing a
+// data dir would fight over symlinks and worktrees, so only one may hold it.
+type daemonLock struct {
+	f    *os.File
+	path string
+}
+
+// acquireDaemonLock takes an exclusive, non-blocking lock on <dataDir>/daemon.pid
+// and writes our PID into it. The kernel drops the lock if the process dies,
+// so a crashed daemon never blocks the next start.
+func acquireDaemonLock(dataDir string) (*daemonLock, error) {
+	path := filepath.Join(dataDir, pidFileName)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			if pid := readPIDFile(path); pid > 0 {
+				return nil, fmt.Errorf("another slot-machine daemon (pid %d) is already using %s", pid, dataDir)
+			}
+			return nil, fmt.Errorf("another slot-machine daemon is already using %s", dataDir)
+		}
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	f.Sync()
+	return &daemonLock{f: f, path: path}, nil
+}
+
+func (l *daemonLock) release() {
+	if l == nil {
+		return
+	}
+	os.Remove(l.path)
+	l.f.Close()
+}
+
+func readPIDFile(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
+
+// daemonLockState inspects the PID file without taking the lock.
+// held is true when a live process holds the flock; a PID file that exists
+// but isn't held was left behind by a daemon that didn't shut down cleanly.
+func daemonLockState(dataDir string) (pid int, exists, held bool) {
+	path := filepath.Join(dataDir, pidFileName)
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, false
+	}
+	defer f.Close()
+	pid = readPIDFile(path)
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != nil {
+		return pid, true, true
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return pid, true, false
+}
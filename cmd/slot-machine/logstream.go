@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"slot-machine/internal/engine"
+)
+
+// teeOutput sends what the daemon prints to stdout and stderr into logs as
+// well, as daemon records, while still printing it. The returned func puts
+// stdout and stderr back and waits for what was printed to be copied; call
+// it before exiting. A panic writes to the original stderr directly and
+// only reaches the terminal.
+func teeOutput(logs *engine.LogStream) (stop func()) {
+	var wg sync.WaitGroup
+	var restore []func()
+	for _, std := range []**os.File{&os.Stdout, &os.Stderr} {
+		orig := *std
+		r, w, err := os.Pipe()
+		if err != nil {
+			continue
+		}
+		tagged := logs.Writer(engine.LogRecord{Source: engine.SourceDaemon})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			io.Copy(io.MultiWriter(orig, tagged), r)
+			tagged.Close()
+			r.Close()
+		}()
+		*std = w
+		restore = append(restore, func() {
+			*std = orig
+			w.Close()
+		})
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, fn := range restore {
+				fn()
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -5,10 +5,27 @@
 //	slot-machine init                  # scaffold slot-machine.json + update .gitignore
 //	slot-machine start [flags]         # start daemon, auto-deploy HEAD
 //	slot-machine deploy [commit]       # tell running daemon to deploy (defaults to HEAD)
-//	slot-machine rollback              # tell running daemon to rollback
+//	slot-machine deploy --artifact f   # deploy a release tarball instead
+//	slot-machine deploy --fetch [ref]  # have the daemon fetch its remote and deploy a ref
+//	slot-machine rollback [commit]     # swap back to prev, or to a retained release
+//	slot-machine approve|reject [id]   # decide on a deploy the agent asked for
+//	slot-machine restart --rolling     # replace the live process with a fresh one
+//	slot-machine mirror <commit>|stop  # copy sampled live traffic to a candidate
 //	slot-machine status                # get status from running daemon
+//	slot-machine history               # show recent deploys and rollbacks
+//	slot-machine verify [slot]         # check the live slot's files against its manifest
+//	slot-machine logs                  # show the live slot's output
+//	slot-machine events                # follow deploys, health changes, and locks as they happen
+//	slot-machine exec -- <cmd>         # run a command in the live slot's environment
+//	slot-machine journal verify        # check the deploy journal for corruption
+//	slot-machine doctor                # repair slot worktrees a crash left broken
+//	slot-machine keygen                # make the SSH deploy key the daemon's git uses
+//	slot-machine backup <file>         # save the daemon's state to move or recover it
+//	slot-machine restore <file>        # unpack a backup and rebuild its slots
+//	slot-machine restore --from s3://… # the same, with the backup state_backup exported
 //	slot-machine install               # copy binary to ~/.local/bin
-//	slot-machine update                # update to latest GitHub release
+//	slot-machine update [--check]      # update to latest GitHub release (--rollback undoes it)
+//	slot-machine version [--daemon]    # print build details
 //
 // Build:
 //
@@ -16,56 +33,128 @@
 package main
 
 import (
-	"bytes"
+	"cmp"
 	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"maps"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"syscall"
-)
+	"time"
 
-// Version is injected at build time via -ldflags="-X main.Version=v1.0.0".
-var Version = "dev"
+	"slot-machine/internal/engine"
+	"slot-machine/internal/proxy"
+	"slot-machine/pkg/client"
+)
 
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Fprintln(os.Stderr, "usage: slot-machine <command> [args]")
 		fmt.Fprintln(os.Stderr, "")
 		fmt.Fprintln(os.Stderr, "commands:")
-		fmt.Fprintln(os.Stderr, "  init       scaffold slot-machine.json")
+		fmt.Fprintln(os.Stderr, "  init       scaffold slot-machine.json (--verify: and try it)")
 		fmt.Fprintln(os.Stderr, "  start      start the daemon")
 		fmt.Fprintln(os.Stderr, "  deploy     deploy a commit")
 		fmt.Fprintln(os.Stderr, "  rollback   rollback to previous")
+		fmt.Fprintln(os.Stderr, "  restart    replace the live process with a fresh one, without downtime")
+		fmt.Fprintln(os.Stderr, "  promote    make a standby daemon the primary")
+		fmt.Fprintln(os.Stderr, "  mirror     copy live traffic to a candidate commit")
+		fmt.Fprintln(os.Stderr, "  preview    boot a branch on its own subdomain")
+		fmt.Fprintln(os.Stderr, "  lock       refuse deploys until unlocked")
+		fmt.Fprintln(os.Stderr, "  unlock     allow deploys again")
+		fmt.Fprintln(os.Stderr, "  read-only  refuse every API request that changes something")
+		fmt.Fprintln(os.Stderr, "  read-write allow changes through the API again")
 		fmt.Fprintln(os.Stderr, "  status     show current status")
+		fmt.Fprintln(os.Stderr, "  inspect    show a slot and the environment it started with")
+		fmt.Fprintln(os.Stderr, "  verify     check that a slot's files still match its manifest")
+		fmt.Fprintln(os.Stderr, "  history    show recent deploys")
+		fmt.Fprintln(os.Stderr, "  logs       show live slot output")
+		fmt.Fprintln(os.Stderr, "  events     follow the daemon's events (deploys, health, locks, agent runs)")
+		fmt.Fprintln(os.Stderr, "  exec       run a command in the live slot's environment")
+		fmt.Fprintln(os.Stderr, "  journal    verify the deploy journal")
+		fmt.Fprintln(os.Stderr, "  doctor     repair the slots' git worktrees after a crash")
+		fmt.Fprintln(os.Stderr, "  keygen     make an SSH deploy key for fetching private repos")
+		fmt.Fprintln(os.Stderr, "  backup     save the journal, state, agent.db, and config to a file")
+		fmt.Fprintln(os.Stderr, "  restore    restore a backup and rebuild its slots")
 		fmt.Fprintln(os.Stderr, "  install    copy binary to ~/.local/bin")
-		fmt.Fprintln(os.Stderr, "  update     update to latest GitHub release")
-		fmt.Fprintln(os.Stderr, "  version    print version info")
+		fmt.Fprintln(os.Stderr, "  install-hook  deploy on git push to this server")
+		fmt.Fprintln(os.Stderr, "  update     update to latest GitHub release (--check, --channel, --rollback)")
+		fmt.Fprintln(os.Stderr, "  version    print build details (--daemon: the running daemon's too)")
 		os.Exit(1)
 	}
 
 	switch os.Args[1] {
 	case "init":
-		cmdInit()
+		cmdInit(os.Args[2:])
 	case "start":
 		cmdStart(os.Args[2:])
 	case "deploy":
 		cmdDeploy(os.Args[2:])
 	case "rollback":
-		cmdRollback()
+		cmdRollback(os.Args[2:])
+	case "restart":
+		cmdRestart(os.Args[2:])
+	case "promote":
+		cmdPromote(os.Args[2:])
+	case "approve":
+		cmdApprove(os.Args[2:], true)
+	case "reject":
+		cmdApprove(os.Args[2:], false)
+	case "mirror":
+		cmdMirror(os.Args[2:])
+	case "preview":
+		cmdPreview(os.Args[2:])
+	case "lock":
+		cmdLock(os.Args[2:], true)
+	case "unlock":
+		cmdLock(os.Args[2:], false)
+	case "read-only":
+		cmdReadOnly(os.Args[2:], true)
+	case "read-write":
+		cmdReadOnly(os.Args[2:], false)
 	case "status":
-		cmdStatus()
+		cmdStatus(os.Args[2:])
+	case "inspect":
+		cmdInspect(os.Args[2:])
+	case "verify":
+		cmdVerify(os.Args[2:])
+	case "history":
+		cmdHistory(os.Args[2:])
+	case "logs":
+		cmdLogs(os.Args[2:])
+	case "events":
+		cmdEvents(os.Args[2:])
+	case "exec":
+		cmdExec(os.Args[2:])
+	case "journal":
+		cmdJournal(os.Args[2:])
+	case "doctor":
+		cmdDoctor(os.Args[2:])
+	case "keygen":
+		cmdKeygen(os.Args[2:])
+	case "backup":
+		cmdBackup(os.Args[2:])
+	case "restore":
+		cmdRestore(os.Args[2:])
 	case "install":
 		cmdInstall()
+	case "install-hook":
+		cmdInstallHook(os.Args[2:])
 	case "update":
-		cmdUpdate()
+		cmdUpdate(os.Args[2:])
 	case "version":
-		fmt.Println(Version)
+		cmdVersion(os.Args[2:])
 	default:
 		fmt.Fprintf(os.Stderr, "unknown command: %s\n", os.Args[1])
 		os.Exit(1)
@@ -83,8 +172,19 @@ func cmdStart(args []string) {
 	dataDir := fs.String("data", "", "path to data directory (default: <repo>/.slot-machine)")
 	port := fs.Int("port", 0, "API listen port (default: config api_port or 9100)")
 	_ = fs.Bool("no-proxy", false, "ignored (kept for backward compatibility)")
+	dev := fs.Bool("dev", false, "deploy every new commit on the repo's current branch")
+	chaosOn := fs.Bool("chaos", false, "randomly delay proxy switches and drains, for testing (needs SLOT_MACHINE_CHAOS=1)")
+	chaosMaxDelay := fs.Duration("chaos-max-delay", time.Second, "longest delay --chaos adds")
+	chaosSeed := fs.Int64("chaos-seed", 0, "seed for --chaos's delays (default: random)")
+	readOnly := fs.Bool("read-only", false, "refuse API requests that change anything, such as deploys (default: config read_only)")
 	fs.Parse(args)
 
+	chaos, err := newChaos(*chaosOn, *chaosMaxDelay, *chaosSeed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
 	cwd, _ := os.Getwd()
 
 	if *configPath == "" {
@@ -97,15 +197,14 @@ func cmdStart(args []string) {
 		*dataDir = filepath.Join(*repoDir, ".slot-machine")
 	}
 
-	cfgData, err := os.ReadFile(*configPath)
-	if err != nil {
+	if _, err := os.Stat(*configPath); err != nil {
 		fmt.Fprintf(os.Stderr, "error: cannot read %s\n", *configPath)
 		fmt.Fprintln(os.Stderr, "run 'slot-machine init' to create it")
 		os.Exit(1)
 	}
-	var cfg config
-	if err := json.Unmarshal(cfgData, &cfg); err != nil {
-		fmt.Fprintf(os.Stderr, "error parsing config: %v\n", err)
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
 
@@ -123,15 +222,47 @@ func cmdStart(args []string) {
 		os.Exit(1)
 	}
 
+	var devWatch *devWatcher
+	if *dev {
+		if devWatch, err = newDevWatcher(absRepo); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	os.MkdirAll(*dataDir, 0755)
 
-	appProxyAddr := ""
-	if cfg.Port != 0 {
-		appProxyAddr = fmt.Sprintf(":%d", cfg.Port)
+	lock, err := acquireDaemonLock(*dataDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// From here on, what the daemon prints also goes to the merged log
+	// stream, along with slot and agent output.
+	logs := engine.NewLogStream(filepath.Join(*dataDir, engine.LogStreamName))
+	stopTee := teeOutput(logs)
+
+	appProxyAddrs, tlsProxyAddrs, intProxyAddrs, err := engine.ProxyAddrs(cfg)
+	if err == nil {
+		err = engine.CheckClientAddrs(cfg)
 	}
-	intProxyAddr := ""
-	if cfg.InternalPort != 0 && cfg.InternalPort != cfg.Port {
-		intProxyAddr = fmt.Sprintf(":%d", cfg.InternalPort)
+	if err == nil {
+		err = engine.CheckExpose(cfg)
+	}
+	if err == nil {
+		err = engine.CheckSlotPortRange(cfg)
+	}
+	if err == nil {
+		err = engine.CheckPeer(cfg)
+	}
+	if err == nil {
+		err = engine.CheckModelRules(cfg)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		stopTee()
+		os.Exit(1)
 	}
 
 	// Auth setup.
@@ -144,12 +275,53 @@ func cmdStart(args []string) {
 		secretBytes := make([]byte, 32)
 		if _, err := rand.Read(secretBytes); err != nil {
 			fmt.Fprintf(os.Stderr, "error generating auth secret: %v\n", err)
+			stopTee()
 			os.Exit(1)
 		}
 		authSecret = hex.EncodeToString(secretBytes)
 	}
 	fmt.Printf("agent auth: %s\n", authMode)
 
+	// A daemon that re-exec'd onto a new binary (auto_update) left its
+	// sockets and live slot for this one to take over.
+	handoff, err := engine.ParseHandoff(os.Getenv(engine.HandoffEnv))
+	os.Unsetenv(engine.HandoffEnv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+
+	// The admin token overrides deploy_policy.allowed_refs, the debug token
+	// opens /debug on the API port, and the API token opens the deploy API
+	// under intercept_prefix on the app's port. Drop them from the
+	// environment so neither the app nor the agent inherits them. An
+	// auto-update re-execs the daemon with the environment it started with.
+	startEnv := os.Environ()
+	adminToken := os.Getenv("SLOT_MACHINE_ADMIN_TOKEN")
+	os.Unsetenv("SLOT_MACHINE_ADMIN_TOKEN")
+	debugToken := os.Getenv("SLOT_MACHINE_DEBUG_TOKEN")
+	os.Unsetenv("SLOT_MACHINE_DEBUG_TOKEN")
+	apiToken := os.Getenv("SLOT_MACHINE_API_TOKEN")
+	os.Unsetenv("SLOT_MACHINE_API_TOKEN")
+
+	// state_backup's credentials, likewise: the app gets its own in
+	// env_file.
+	var exporter *stateExporter
+	if sb := cfg.StateBackup; sb != nil {
+		if exporter, err = newStateExporter(*sb, absRepo, *dataDir); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: state_backup disabled: %v\n", err)
+		}
+		os.Unsetenv(cmp.Or(sb.AccessKeyEnv, "AWS_ACCESS_KEY_ID"))
+		os.Unsetenv(cmp.Or(sb.SecretKeyEnv, "AWS_SECRET_ACCESS_KEY"))
+	}
+
+	// Every git the daemon runs, the setup commands it starts, and the agent
+	// reach private remotes with the deploy key, unless GIT_SSH_COMMAND
+	// already says how.
+	if key := engine.DeployKey(cfg, absRepo, *dataDir); key != "" && os.Getenv("GIT_SSH_COMMAND") == "" {
+		os.Setenv("GIT_SSH_COMMAND", engine.GitSSHCommand(key))
+		fmt.Printf("deploy key: %s\n", key)
+	}
+
 	if os.Getenv("CLAUDE_CODE_OAUTH_TOKEN") != "" {
 		fmt.Println("agent auth source: oauth token")
 	} else if home, err := os.UserHomeDir(); err == nil {
@@ -161,10 +333,13 @@ func cmdStart(args []string) {
 	store, err := openAgentStore(filepath.Join(*dataDir, "agent.db"))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error opening agent store: %v\n", err)
+		stopTee()
 		os.Exit(1)
 	}
 
 	mgr := newAgentManager(store)
+	mgr.logs = logs
+	mgr.setConcurrency(cfg.AgentConcurrency)
 
 	if n, err := store.recoverInterrupted(); err == nil && n > 0 {
 		fmt.Printf("recovered %d interrupted agent sessions\n", n)
@@ -192,9 +367,18 @@ func cmdStart(args []string) {
 		dataDir:      *dataDir,
 		authMode:     authMode,
 		authSecret:   authSecret,
+		authMaxAge:   engine.AuthMaxAge(cfg),
+		authLegacy:   cfg.AgentAuthLegacy,
 		allowedTools: cfg.AgentAllowedTools,
 		chatTitle:    cfg.ChatTitle,
 		chatAccent:   cfg.ChatAccent,
+		prices:       cfg.AgentPrices,
+		model:        cfg.AgentModel,
+		modelRules:   compileModelRules(cfg.AgentModelRules),
+		retainDays:   cfg.AgentRetainDays,
+		dbMaxMB:      cfg.AgentDBMaxMB,
+		extraRepos:   resolveExtraRepos(cfg.AgentExtraRepos, absRepo, *dataDir),
+		promptFile:   resolvePromptFile(cfg.AgentPromptFile, absRepo),
 		envFunc: func() []string {
 			env := os.Environ()
 			if cfg.EnvFile != "" {
@@ -202,7 +386,7 @@ func cmdStart(args []string) {
 				if !filepath.IsAbs(envPath) {
 					envPath = filepath.Join(absRepo, envPath)
 				}
-				if extra, err := loadEnvFile(envPath); err == nil {
+				if extra, err := engine.LoadEnvFile(envPath); err == nil {
 					env = append(env, extra...)
 				}
 			}
@@ -210,54 +394,225 @@ func cmdStart(args []string) {
 		},
 	}
 
-	o := &orchestrator{
-		cfg:        cfg,
-		repoDir:    absRepo,
-		dataDir:    *dataDir,
-		authSecret: authSecret,
-		appProxy:   newDynamicProxy(appProxyAddr, agent),
-		intProxy:   newDynamicProxy(intProxyAddr, nil),
+	if cfg.AgentAuthReplay {
+		agent.authReplay = &replayCache{}
+	}
+	go agent.runRetention()
+	go agent.runCheckpoints()
+	if exporter != nil {
+		go exporter.run()
+	}
+	go agent.runExtraRepoSync()
+
+	appProxy := proxy.New("", agent)
+	appProxy.SetAddrs(appProxyAddrs...)
+	appProxy.SetTLSAddr(tlsProxyAddrs...)
+	appProxy.SetProtocols(cfg.H2C, cfg.HTTP1Only)
+	if pp := cfg.ProxyProtocol; pp != nil {
+		appProxy.SetProxyProtocol(pp.Accept, pp.Send)
 	}
+	intProxy := proxy.New("", nil)
+	intProxy.SetAddrs(intProxyAddrs...)
 
-	// Recover state from symlinks, or auto-deploy HEAD.
-	o.recoverState()
-	if o.liveSlot == nil {
+	// Serve on the sockets a re-exec'd daemon handed off rather than bind
+	// them again: connections are already waiting on them.
+	apiAddr := fmt.Sprintf(":%d", apiPort)
+	var apiLn net.Listener
+	for addr, ln := range handoff.TakeListeners() {
+		switch {
+		case addr == apiAddr:
+			apiLn = ln
+		case appProxy.Inherit(addr, ln), intProxy.Inherit(addr, ln):
+		default:
+			ln.Close() // no longer configured
+		}
+	}
+	o := engine.New(engine.Options{
+		Config:     cfg,
+		RepoDir:    absRepo,
+		DataDir:    *dataDir,
+		AuthSecret: authSecret,
+		AdminToken: adminToken,
+		DebugToken: debugToken,
+		ReadOnly:   *readOnly || cfg.ReadOnly,
+		APIURL:     fmt.Sprintf("http://127.0.0.1:%d", apiPort),
+		AppProxy:   appProxy,
+		IntProxy:   intProxy,
+		Logs:       logs,
+		Chaos:      chaos,
+		Handoff:    handoff,
+
+		StagingIgnore: []string{".claude/settings.json"}, // generateDenySettings
+	})
+	agent.stagingChanges = o.StagingChanges
+	o.Subscribe(agent.reportEvent, engine.EventHealthFailure, engine.EventStagingRestored, engine.EventDeployPending)
+	if pusher, err := newWebPusher(store, *dataDir, cfg.ChatPushSubject); err != nil {
+		fmt.Printf("warning: chat notifications are off: %v\n", err)
+	} else {
+		pusher.app = o.App
+		agent.pusher = pusher
+		o.Subscribe(pusher.pushEvent, engine.EventDeployFinished, engine.EventRollbackFinished, engine.EventDeployPending, "agent_finished")
+	}
+	mgr.publish = o.Publish
+	go o.WatchEnvFile()
+	go o.WatchDrift()
+	go o.WatchUpstream()
+	go o.Expose()
+	agent.apiToken, agent.control = apiToken, o
+	agent.readOnly = o.ReadOnly
+	agent.statusURL = fmt.Sprintf("http://127.0.0.1:%d/status", apiPort)
+	if apiToken != "" && cfg.InterceptPrefix == "" {
+		fmt.Println("warning: SLOT_MACHINE_API_TOKEN is set but intercept_prefix is not; the deploy API is not served on the app port")
+	}
+	agent.promptInfo = func(v *promptVars) {
+		v.AppName = o.App()
+		v.LiveCommit = o.LiveCommit()
+		v.HealthEndpoint = cfg.HealthEndpoint
+		v.Deploys = o.RecentDeploys(promptDeploys)
+		v.Upstream = o.Upstream()
+	}
+
+	// Bind the public ports up front so clients see a 503 page rather than
+	// connection refused until the first slot goes live. After a re-exec,
+	// connections already wait on them: they're served once the live slot
+	// is taken over.
+	if handoff == nil {
+		if err := o.EnsureProxies(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+	}
+
+	// Recover the last live slot, or auto-deploy HEAD. A recovered slot boots
+	// in the background (it may take minutes) while the API comes up; HEAD is
+	// deployed only if it never gets healthy.
+	autoDeploy := func() {
 		commit, err := gitHeadCommit(absRepo)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "warning: cannot determine HEAD: %v\n", err)
+			return
+		}
+		fmt.Printf("auto-deploying HEAD (%s)...\n", engine.ShortHash(commit))
+		resp, _ := o.Deploy(commit)
+		if resp.Success {
+			fmt.Printf("deployed %s to %s\n", engine.ShortHash(resp.Commit), resp.Slot)
 		} else {
-			fmt.Printf("auto-deploying HEAD (%s)...\n", shortHash(commit))
-			resp, _ := o.doDeploy(commit)
-			if resp.Success {
-				fmt.Printf("deployed %s to %s\n", shortHash(resp.Commit), resp.Slot)
-			} else {
-				fmt.Fprintf(os.Stderr, "auto-deploy failed: %s\n", resp.Error)
-			}
+			fmt.Fprintf(os.Stderr, "auto-deploy failed: %s\n", resp.Error)
 		}
 	}
+	// In dev mode, commits made from then on are deployed as they land. A
+	// standby runs nothing until it's promoted: it follows the primary.
+	afterRecovery := func(ok bool) {
+		if o.Standby() {
+			go o.FollowPrimary()
+			return
+		}
+		if !ok && !o.HasLive() {
+			autoDeploy()
+		}
+		if devWatch != nil {
+			devWatch.deploy = o.Deploy
+			devWatch.deployed = o.LiveCommit()
+			go devWatch.run()
+		}
+	}
+	recovered := o.RecoverState()
+	if handoff != nil {
+		if err := o.EnsureProxies(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+	}
+	select {
+	case ok := <-recovered:
+		afterRecovery(ok)
+	default:
+		go func() { afterRecovery(<-recovered) }()
+	}
 
 	// API server.
-	apiAddr := fmt.Sprintf(":%d", apiPort)
-	apiSrv := &http.Server{Addr: apiAddr, Handler: o}
+	apiSrv := &http.Server{Addr: apiAddr, Handler: apiHandler(o, agent)}
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
-	go func() {
-		<-sigCh
-		fmt.Println("\nshutting down...")
+	shutdown := func() {
+		mgr.stop()
+		o.Shutdown()
+		store.close()
+		lock.release()
+		stopTee()
+	}
+	// reexecShutdown is shutdown before a re-exec onto a new binary: the
+	// live slot keeps running and the sockets stay open, for the new daemon
+	// to take over. On an error, nothing was stopped.
+	reexecShutdown := func() (*engine.Handoff, error) {
+		h, err := o.Handoff()
+		if err != nil {
+			return nil, err
+		}
+		if err := h.AddListener(apiAddr, apiLn); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v; the API refuses connections during the restart\n", err)
+		}
 		mgr.stop()
-		o.drainAll()
-		o.appProxy.shutdown()
-		o.intProxy.shutdown()
 		store.close()
-		apiSrv.Shutdown(context.Background())
+		lock.release()
+		stopTee()
+		return h, nil
+	}
+
+	if cfg.AutoUpdate != nil {
+		if u, err := newAutoUpdater(*cfg.AutoUpdate, o, startEnv, reexecShutdown, shutdown); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: auto_update disabled: %v\n", err)
+		} else {
+			go u.run()
+		}
+	}
+
+	// SIGHUP reloads the config, SIGQUIT dumps state for debugging, and
+	// SIGTERM/SIGINT shut down gracefully. A second SIGTERM/SIGINT while
+	// draining kills the slot processes outright.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT)
+	go func() {
+		shuttingDown := false
+		for sig := range sigCh {
+			switch sig {
+			case syscall.SIGHUP:
+				reloadConfig(o, *configPath, cfg)
+			case syscall.SIGQUIT:
+				if path, err := o.DumpState(); err != nil {
+					fmt.Fprintf(os.Stderr, "state dump failed: %v\n", err)
+				} else {
+					fmt.Printf("state dumped to %s\n", path)
+				}
+			default:
+				if shuttingDown {
+					fmt.Println("second signal: killing slot processes")
+					o.KillAll()
+					continue
+				}
+				shuttingDown = true
+				go func() {
+					fmt.Println("\nshutting down...")
+					shutdown()
+					apiSrv.Shutdown(context.Background())
+				}()
+			}
+		}
 	}()
 
+	go runWatchdog(func() bool { return o.Livez().OK() })
+
+	if apiLn == nil {
+		if apiLn, err = net.Listen("tcp", apiAddr); err != nil {
+			fmt.Fprintf(os.Stderr, "listen: %v\n", err)
+			stopTee()
+			os.Exit(1)
+		}
+	}
 	fmt.Printf("slot-machine listening on %s\n", apiAddr)
-	if err := apiSrv.ListenAndServe(); err != http.ErrServerClosed {
+	if err := apiSrv.Serve(apiLn); err != http.ErrServerClosed {
 		fmt.Fprintf(os.Stderr, "listen: %v\n", err)
+		stopTee()
 		os.Exit(1)
 	}
+	stopTee()
 }
 
 // ---------------------------------------------------------------------------
@@ -265,70 +620,315 @@ func cmdStart(args []string) {
 // ---------------------------------------------------------------------------
 
 func cmdDeploy(args []string) {
-	commit := ""
-	if len(args) > 0 {
-		commit = args[0]
+	fs := flag.NewFlagSet("deploy", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print the daemon response as JSON")
+	forceSetup := fs.Bool("force-setup", false, "run setup even if setup_cache_keys are unchanged")
+	artifact := fs.String("artifact", "", "upload and deploy this release tarball instead of a commit")
+	artifactURL := fs.String("artifact-url", "", "have the daemon download and deploy this release tarball")
+	sum := fs.String("sha256", "", "expected sha256 of the tarball (required with --artifact-url)")
+	force := fs.Bool("force", false, "discard uncommitted changes in staging instead of keeping them")
+	override := fs.Bool("override", false, "deploy outside deploy_policy.allowed_refs, using $SLOT_MACHINE_ADMIN_TOKEN")
+	quiet := fs.Bool("quiet", false, "print only the outcome, not each step as the deploy runs")
+	fetch := fs.Bool("fetch", false, "have the daemon fetch its remote and deploy the given ref (default: the upstream branch)")
+	source := fs.String("source", os.Getenv("SLOT_MACHINE_DEPLOY_SOURCE"), "who asks, for deploy_rate_limits: agent, human, or webhook (default: $SLOT_MACHINE_DEPLOY_SOURCE, else human)")
+	var message string
+	fs.StringVar(&message, "m", "", "a note on why, kept in the history and shown in status")
+	fs.StringVar(&message, "message", "", "same as -m")
+	var env map[string]string
+	fs.Func("env", "deploy a release that runs with `KEY=VALUE` over env_file (repeatable)", func(s string) error {
+		k, v, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("%q is not KEY=VALUE", s)
+		}
+		if env == nil {
+			env = map[string]string{}
+		}
+		env[k] = v
+		return nil
+	})
+	config := fs.String("config", "", "deploy a release set up and started with this JSON config fragment, e.g. '{\"start_command\": \"...\"}'; '{}' clears it")
+	fs.Parse(args)
+
+	var opts []client.DeployOption
+	var progress *progressPrinter
+	if !*quiet && !*jsonOut {
+		progress = newProgressPrinter(os.Stderr)
+		opts = append(opts, client.OnProgress(progress.print))
+	}
+	if *forceSetup {
+		opts = append(opts, client.ForceSetup())
+	}
+	if *force {
+		opts = append(opts, client.Force())
+	}
+	if *source != "" {
+		opts = append(opts, client.Source(*source))
 	}
+	if message != "" {
+		opts = append(opts, client.DeployMessage(message))
+	}
+	if env != nil {
+		opts = append(opts, client.ReleaseEnv(env))
+	}
+	if *config != "" {
+		if !json.Valid([]byte(*config)) {
+			fatal(*jsonOut, exitError, "--config is not valid JSON")
+		}
+		opts = append(opts, client.ReleaseConfig(json.RawMessage(*config)))
+	}
+	if *override {
+		token := os.Getenv("SLOT_MACHINE_ADMIN_TOKEN")
+		if token == "" {
+			fatal(*jsonOut, exitError, "--override needs SLOT_MACHINE_ADMIN_TOKEN")
+		}
+		opts = append(opts, client.Override(token))
+	}
+	ctx := context.Background()
 
-	if commit == "" {
-		cwd, _ := os.Getwd()
-		c, err := gitHeadCommit(cwd)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error: cannot determine HEAD commit: %v\n", err)
-			os.Exit(1)
+	var dr *client.DeployResult
+	var err error
+	switch {
+	case *artifact != "":
+		f, ferr := os.Open(*artifact)
+		if ferr != nil {
+			fatal(*jsonOut, exitError, "%v", ferr)
 		}
-		commit = c
+		dr, err = newClient().DeployArtifact(ctx, f, *sum, opts...)
+		f.Close()
+	case *artifactURL != "":
+		if *sum == "" {
+			fatal(*jsonOut, exitError, "--artifact-url requires --sha256")
+		}
+		dr, err = newClient().DeployArtifactURL(ctx, *artifactURL, *sum, opts...)
+	case *fetch:
+		dr, err = newClient().DeployRef(ctx, fs.Arg(0), append(opts, client.Fetch())...)
+	default:
+		commit := fs.Arg(0)
+		if commit == "" {
+			cwd, _ := os.Getwd()
+			c, gerr := gitHeadCommit(cwd)
+			if gerr != nil {
+				fatal(*jsonOut, exitError, "cannot determine HEAD commit: %v", gerr)
+			}
+			commit = c
+		}
+		dr, err = newClient().Deploy(ctx, commit, opts...)
+	}
+	if progress != nil {
+		progress.done()
+	}
+	if dr == nil {
+		fatal(*jsonOut, exitCode(err, exitDeployFailed), "%v", err)
 	}
 
-	port := readAPIPort()
-	body, _ := json.Marshal(map[string]string{"commit": commit})
-	resp, err := http.Post(
-		fmt.Sprintf("http://127.0.0.1:%d/deploy", port),
-		"application/json",
-		bytes.NewReader(body),
-	)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: cannot reach slot-machine daemon: %v\n", err)
-		os.Exit(1)
+	if *jsonOut {
+		printJSON(dr)
+	} else if p := dr.Pending; p != nil {
+		fmt.Printf("deploy of %s is waiting for approval (%s): approve it in the chat or dashboard, or with slot-machine approve %s\n", engine.ShortHash(p.Commit), p.ID, p.ID)
+	} else if dr.Success {
+		if dr.SetupSkipped {
+			fmt.Println("setup skipped (dependencies unchanged)")
+		}
+		fmt.Printf("deployed %s to %s\n", engine.ShortHash(dr.Commit), dr.Slot)
+	} else {
+		if dr.LogTail != "" {
+			fmt.Fprintf(os.Stderr, "last output of the new slot:\n%s\n", strings.TrimRight(dr.LogTail, "\n"))
+		}
+		if dr.HealthError != "" {
+			fmt.Fprintf(os.Stderr, "health check: %s\n", dr.HealthError)
+		}
+		if dr.SmokeOutput != "" {
+			fmt.Fprintf(os.Stderr, "smoke test output:\n%s\n", strings.TrimRight(dr.SmokeOutput, "\n"))
+		}
+		if dr.SupersededBy != "" {
+			fmt.Fprintf(os.Stderr, "not deployed: a newer deploy of %s came in and superseded it\n", engine.ShortHash(dr.SupersededBy))
+		} else {
+			fmt.Fprintf(os.Stderr, "deploy failed: %s\n", dr.Error)
+		}
+	}
+	if !*jsonOut {
+		printStagingRestore(dr.StagingRestore)
+	}
+	os.Exit(exitCode(err, exitDeployFailed))
+}
+
+// ---------------------------------------------------------------------------
+// Subcommand: rollback
+// ---------------------------------------------------------------------------
+
+func cmdRollback(args []string) {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print the daemon response as JSON")
+	force := fs.Bool("force", false, "roll back even to a slot whose files drifted from its commit (drift_check.block_rollback)")
+	fs.Parse(args)
+
+	var opts []client.RollbackOption
+	if *force {
+		opts = append(opts, client.ForceRollback())
+	}
+	rr, err := newClient().RollbackTo(context.Background(), fs.Arg(0), opts...)
+	if rr == nil {
+		fatal(*jsonOut, exitCode(err, exitDeployFailed), "%v", err)
 	}
-	defer resp.Body.Close()
 
-	var dr deployResponse
-	json.NewDecoder(resp.Body).Decode(&dr)
+	if *jsonOut {
+		printJSON(rr)
+	} else if rr.Success {
+		fmt.Printf("rolled back to %s (%s)\n", engine.ShortHash(rr.Commit), rr.Slot)
+	} else {
+		fmt.Fprintf(os.Stderr, "rollback failed: %s\n", rr.Error)
+	}
+	if !*jsonOut {
+		printStagingRestore(rr.StagingRestore)
+	}
+	os.Exit(exitCode(err, exitDeployFailed))
+}
+
+// ---------------------------------------------------------------------------
+// Subcommand: restart
+// ---------------------------------------------------------------------------
 
-	if dr.Success {
-		fmt.Printf("deployed %s to %s\n", shortHash(dr.Commit), dr.Slot)
+func cmdRestart(args []string) {
+	fs := flag.NewFlagSet("restart", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print the daemon response as JSON")
+	rolling := fs.Bool("rolling", true, "boot the new process and health check it before stopping the old one (the only mode)")
+	fs.Parse(args)
+	if !*rolling {
+		fatal(*jsonOut, exitError, "only rolling restarts are supported")
+	}
+
+	rr, err := newClient().Restart(context.Background())
+	if rr == nil {
+		fatal(*jsonOut, exitCode(err, exitDeployFailed), "%v", err)
+	}
+
+	if *jsonOut {
+		printJSON(rr)
+	} else if rr.Success {
+		fmt.Printf("restarted %s (%s)\n", engine.ShortHash(rr.Commit), rr.Slot)
 	} else {
-		fmt.Fprintf(os.Stderr, "deploy failed: %s\n", dr.Error)
-		os.Exit(1)
+		if rr.LogTail != "" {
+			fmt.Fprintf(os.Stderr, "last output of the new process:\n%s\n", strings.TrimRight(rr.LogTail, "\n"))
+		}
+		if rr.HealthError != "" {
+			fmt.Fprintf(os.Stderr, "health check: %s\n", rr.HealthError)
+		}
+		fmt.Fprintf(os.Stderr, "restart failed: %s\n", rr.Error)
 	}
+	os.Exit(exitCode(err, exitDeployFailed))
 }
 
 // ---------------------------------------------------------------------------
-// Subcommand: rollback
+// Subcommand: promote
 // ---------------------------------------------------------------------------
 
-func cmdRollback() {
-	port := readAPIPort()
-	resp, err := http.Post(
-		fmt.Sprintf("http://127.0.0.1:%d/rollback", port),
-		"application/json",
-		nil,
-	)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: cannot reach slot-machine daemon: %v\n", err)
-		os.Exit(1)
+func cmdPromote(args []string) {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print the daemon response as JSON")
+	fs.Parse(args)
+
+	rr, err := newClient().Promote(context.Background())
+	if rr == nil {
+		fatal(*jsonOut, exitCode(err, exitDeployFailed), "%v", err)
+	}
+
+	if *jsonOut {
+		printJSON(rr)
+	} else if rr.Success {
+		fmt.Printf("promoted: %s (%s) is live here; this daemon is the primary now\n", engine.ShortHash(rr.Commit), rr.Slot)
+		fmt.Println("point traffic at this host, and remove peer from its config")
+	} else {
+		fmt.Fprintf(os.Stderr, "promote failed: %s\n", rr.Error)
+	}
+	os.Exit(exitCode(err, exitDeployFailed))
+}
+
+// ---------------------------------------------------------------------------
+// Subcommands: approve, reject
+// ---------------------------------------------------------------------------
+
+func cmdApprove(args []string, approve bool) {
+	name := "reject"
+	if approve {
+		name = "approve"
 	}
-	defer resp.Body.Close()
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print the daemon response as JSON")
+	fs.Parse(args)
 
-	var rr rollbackResponse
-	json.NewDecoder(resp.Body).Decode(&rr)
+	ctx := context.Background()
+	c := newClient()
+	id := fs.Arg(0)
+	if id == "" {
+		pending, err := c.PendingDeploys(ctx)
+		if err != nil {
+			fatal(*jsonOut, exitCode(err, exitError), "%v", err)
+		}
+		switch len(pending) {
+		case 0:
+			fatal(*jsonOut, exitError, "no deploy is waiting for approval")
+		case 1:
+			id = pending[0].ID
+		default:
+			var lines []string
+			for _, p := range pending {
+				lines = append(lines, fmt.Sprintf("  %s  %s  %s", p.ID, engine.ShortHash(p.Commit), p.Message))
+			}
+			fatal(*jsonOut, exitError, "%d deploys are waiting; say which:\n%s", len(pending), strings.Join(lines, "\n"))
+		}
+	}
 
-	if rr.Success {
-		fmt.Printf("rolled back to %s (%s)\n", shortHash(rr.Commit), rr.Slot)
+	if !approve {
+		if err := c.RejectDeploy(ctx, id); err != nil {
+			fatal(*jsonOut, exitCode(err, exitError), "%v", err)
+		}
+		if *jsonOut {
+			printJSON(map[string]any{"success": true, "id": id})
+		} else {
+			fmt.Printf("rejected %s\n", id)
+		}
+		return
+	}
+
+	var opts []client.DeployOption
+	var progress *progressPrinter
+	if !*jsonOut {
+		progress = newProgressPrinter(os.Stderr)
+		opts = append(opts, client.OnProgress(progress.print))
+	}
+	dr, err := c.ApproveDeploy(ctx, id, opts...)
+	if progress != nil {
+		progress.done()
+	}
+	if dr == nil || errors.Is(err, client.ErrNotFound) {
+		fatal(*jsonOut, exitCode(err, exitDeployFailed), "%v", err)
+	}
+	if *jsonOut {
+		printJSON(dr)
+	} else if dr.Success {
+		fmt.Printf("approved %s: deployed %s to %s\n", id, engine.ShortHash(dr.Commit), dr.Slot)
 	} else {
-		fmt.Fprintf(os.Stderr, "rollback failed: %s\n", rr.Error)
-		os.Exit(1)
+		if dr.HealthError != "" {
+			fmt.Fprintf(os.Stderr, "health check: %s\n", dr.HealthError)
+		}
+		fmt.Fprintf(os.Stderr, "approved %s, but the deploy failed: %s\n", id, dr.Error)
+	}
+	os.Exit(exitCode(err, exitDeployFailed))
+}
+
+// printStagingRestore says what became of staging's uncommitted changes, if
+// there were any.
+func printStagingRestore(r *client.StagingRestore) {
+	switch {
+	case r == nil:
+	case r.Error != "":
+		fmt.Fprintf(os.Stderr, "warning: uncommitted staging changes not re-applied: %s\n", r.Error)
+		fmt.Fprintf(os.Stderr, "recover them in staging with: git stash apply %s\n", r.Stash)
+	case len(r.Conflicts) > 0:
+		fmt.Fprintf(os.Stderr, "warning: uncommitted staging changes re-applied with conflicts in %s\n", strings.Join(r.Conflicts, ", "))
+	default:
+		fmt.Printf("uncommitted staging changes kept (%d modified, %d deleted, %d untracked)\n",
+			r.Changes.Modified, r.Changes.Deleted, r.Changes.Untracked)
 	}
 }
 
@@ -336,33 +936,704 @@ func cmdRollback() {
 // Subcommand: status
 // ---------------------------------------------------------------------------
 
-func cmdStatus() {
-	port := readAPIPort()
-	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/status", port))
+func cmdStatus(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print the daemon response as JSON")
+	fs.Parse(args)
+
+	sr, err := newClient().Status(context.Background())
+	if errors.Is(err, client.ErrUnreachable) {
+		msg := err.Error()
+		if dir, ok := findConfigDir(); ok {
+			pid, exists, held := daemonLockState(filepath.Join(dir, ".slot-machine"))
+			switch {
+			case held:
+				msg += fmt.Sprintf(" (daemon pid %d holds the lock but its API is not answering)", pid)
+			case exists:
+				msg += fmt.Sprintf(" (stale pid file: daemon pid %d is no longer running)", pid)
+			}
+		}
+		fatal(*jsonOut, exitUnreachable, "%s", msg)
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: cannot reach slot-machine daemon: %v\n", err)
-		os.Exit(1)
+		fatal(*jsonOut, exitError, "%v", err)
 	}
-	defer resp.Body.Close()
 
-	var sr statusResponse
-	json.NewDecoder(resp.Body).Decode(&sr)
+	if *jsonOut {
+		printJSON(sr)
+		return
+	}
 
 	healthy := "no"
 	if sr.Healthy {
 		healthy = "yes"
+	} else if sr.State == "recovering" || sr.State == "crash-loop" || sr.State == "standby" {
+		healthy = sr.State
 	}
 
-	fmt.Printf("live:     %s  %s  healthy=%s\n", sr.LiveSlot, sr.LiveCommit, healthy)
+	fmt.Printf("live:     %s  %s  healthy=%s%s\n", sr.LiveSlot, sr.LiveCommit, healthy, formatDeployMessage(sr.LiveMessage))
 	if sr.PreviousSlot != "" {
-		fmt.Printf("previous: %s  %s\n", sr.PreviousSlot, sr.PreviousCommit)
+		fmt.Printf("previous: %s  %s%s\n", sr.PreviousSlot, sr.PreviousCommit, formatDeployMessage(sr.PreviousMessage))
+	}
+	if r := sr.LiveRelease; r != nil {
+		if len(r.Env) > 0 {
+			fmt.Printf("release env:    %s\n", strings.Join(r.Env, ", "))
+		}
+		if len(r.Config) > 0 {
+			fmt.Printf("release config: %s\n", r.Config)
+		}
 	}
 	if sr.StagingDir != "" {
-		fmt.Printf("staging:  %s\n", sr.StagingDir)
+		fmt.Printf("staging:  %s", sr.StagingDir)
+		if c := sr.StagingChanges; sr.StagingDirty {
+			fmt.Printf("  uncommitted: %d modified, %d deleted", c.Modified, c.Deleted)
+		}
+		fmt.Println()
 	}
 	if sr.LastDeployTime != "" {
 		fmt.Printf("last deploy: %s\n", sr.LastDeployTime)
 	}
+	if l := sr.Locked; l != nil {
+		fmt.Printf("deploys locked since %s", l.Since)
+		if l.Reason != "" {
+			fmt.Printf(": %s", l.Reason)
+		}
+		fmt.Println()
+	}
+	if sr.ReadOnly {
+		fmt.Println("the daemon API is read-only (slot-machine read-write allows changes again)")
+	}
+	if s := sr.Standby; s != nil {
+		fmt.Printf("standby:  following %s", s.Primary)
+		if s.WarmSlot != "" {
+			fmt.Printf("  warm: %s  %s", s.WarmSlot, s.WarmCommit)
+		}
+		fmt.Println()
+		if s.LastSync != "" {
+			fmt.Printf("  last sync %s", s.LastSync)
+			if s.Error != "" {
+				fmt.Printf(": %s", s.Error)
+			}
+			fmt.Println()
+		}
+	}
+	for _, p := range sr.PendingDeploys {
+		fmt.Printf("pending:  %s  %s from the %s, waiting for approval since %s", p.ID, engine.ShortHash(p.Commit), p.Source, p.RequestedAt)
+		if p.Message != "" {
+			fmt.Printf(": %s", p.Message)
+		}
+		fmt.Println()
+	}
+	for _, d := range sr.Drift {
+		fmt.Printf("drift:    %s (%s) differs from %s since %s: %d modified, %d deleted\n",
+			d.Slot, d.Role, engine.ShortHash(d.Commit), d.Since, d.Changes.Modified, d.Changes.Deleted)
+	}
+	if c := sr.CrashLoop; c != nil {
+		fmt.Printf("crash loop: %d crashes in %ds, not restarting since %s\n", c.Crashes, c.WindowSec, c.Since)
+		fmt.Printf("  %s\n", c.Suggestion)
+	}
+	if sr.EnvStale {
+		fmt.Println("env_file changed since the live slot started (slot-machine restart --rolling applies it)")
+	}
+	if u := sr.Upstream; u != nil {
+		printUpstream(u)
+	}
+	if e := sr.Expose; e != nil {
+		fmt.Println(formatExpose(e))
+	}
+	if sr.ProxyError != "" {
+		fmt.Printf("proxy error: %s\n", sr.ProxyError)
+	}
+	if t := sr.AppTraffic; t.Circuit == "open" || t.Circuit == "half-open" {
+		fmt.Printf("circuit:  %s, the live slot keeps failing  (%d requests turned away)\n", t.Circuit, t.CircuitRejected)
+	}
+	if m := sr.Mirror; m != nil {
+		fmt.Printf("mirror:   %s  %d%%  mirrored=%d mismatches=%d errors=%d\n",
+			engine.ShortHash(m.Commit), m.Percent, m.Mirrored, m.Mismatches, m.Errors)
+	}
+	if len(sr.EnvDiff) > 0 {
+		fmt.Println("env changes since previous:")
+		printEnvDiff(sr.EnvDiff)
+	}
+
+	// Agent usage over the last 30 days; nothing if the agent never ran or
+	// the daemon predates /agent/usage.
+	if u, err := newClient().Usage(context.Background(), "30d"); err == nil && u.Total.Runs > 0 {
+		t := u.Total
+		fmt.Printf("agent (30d): %d runs  in=%d out=%d cache_read=%d cache_write=%d",
+			t.Runs, t.InputTokens, t.OutputTokens, t.CacheRead, t.CacheWrite)
+		if t.CostUSD != nil {
+			fmt.Printf("  ~$%.2f", *t.CostUSD)
+		}
+		fmt.Println()
+		if len(u.Models) > 1 || (len(u.Models) == 1 && u.Models[0].Model != "") {
+			var models []string
+			for _, m := range u.Models {
+				models = append(models, fmt.Sprintf("%s %d", cmp.Or(m.Model, "unknown"), m.Runs))
+			}
+			fmt.Printf("  by model: %s\n", strings.Join(models, ", "))
+		}
+	}
+	if st, err := newClient().AgentStore(context.Background()); err == nil && st.Messages > 0 {
+		fmt.Printf("agent db: %.1f MB  %d conversations  %d messages\n",
+			float64(st.SizeBytes)/(1<<20), st.Conversations, st.Messages)
+	}
+}
+
+// printUpstream prints how far the live commit is from the upstream branch.
+func printUpstream(u *client.Upstream) {
+	fmt.Printf("upstream: %s  %s", u.Ref, engine.ShortHash(u.Commit))
+	switch {
+	case u.Ahead == 0 && u.Behind == 0:
+		fmt.Print("  up to date")
+	case u.Behind > 0 && u.Ahead > 0:
+		fmt.Printf("  %d undeployed, %d live commits not upstream", u.Behind, u.Ahead)
+	case u.Behind > 0:
+		fmt.Printf("  %d undeployed", u.Behind)
+	default:
+		fmt.Printf("  %d live commits not upstream", u.Ahead)
+	}
+	if u.LatestTag != "" {
+		fmt.Printf("  latest tag %s", u.LatestTag)
+	}
+	fmt.Println()
+	if u.FetchError != "" {
+		fmt.Printf("upstream fetch failed: %s\n", u.FetchError)
+	}
+}
+
+// formatExpose is the tunnel's line, e.g. "public:   https://x.trycloudflare.com  (cloudflared)".
+func formatExpose(e *client.Expose) string {
+	line := "public:   "
+	switch {
+	case e.Running && e.URL != "":
+		line += e.URL
+	case e.Running:
+		line += "waiting for the tunnel's URL"
+	default:
+		line += "tunnel down"
+		if e.Error != "" {
+			line += ": " + e.Error
+		}
+	}
+	line += fmt.Sprintf("  (%s", e.Provider)
+	if e.Restarts > 0 {
+		line += fmt.Sprintf(", restarted %d times", e.Restarts)
+	}
+	return line + ")"
+}
+
+// printEnvDiff prints one line per changed variable. Values other than
+// injected ones are hashes, which only tell whether they differ.
+func printEnvDiff(diff []client.EnvChange) {
+	for _, c := range diff {
+		switch {
+		case c.Prev == "":
+			fmt.Printf("  + %-30s %s\n", c.Name, c.Source)
+		case c.Live == "":
+			fmt.Printf("  - %-30s %s\n", c.Name, c.Source)
+		case c.Source == "injected":
+			fmt.Printf("  ~ %-30s %s  %s -> %s\n", c.Name, c.Source, c.Prev, c.Live)
+		default:
+			fmt.Printf("  ~ %-30s %s\n", c.Name, c.Source)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Subcommands: lock, unlock
+// ---------------------------------------------------------------------------
+
+func cmdLock(args []string, lock bool) {
+	name := "unlock"
+	if lock {
+		name = "lock"
+	}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print the daemon response as JSON")
+	fs.Parse(args)
+
+	ctx := context.Background()
+	if !lock {
+		if err := newClient().Unlock(ctx); err != nil {
+			fatal(*jsonOut, exitCode(err, exitError), "%v", err)
+		}
+		if *jsonOut {
+			printJSON(map[string]bool{"success": true})
+		} else {
+			fmt.Println("deploys unlocked")
+		}
+		return
+	}
+
+	l, err := newClient().Lock(ctx, strings.Join(fs.Args(), " "))
+	if err != nil {
+		fatal(*jsonOut, exitCode(err, exitError), "%v", err)
+	}
+	if *jsonOut {
+		printJSON(l)
+	} else {
+		fmt.Printf("deploys locked since %s; run slot-machine unlock to allow them again\n", l.Since)
+	}
+}
+
+// cmdReadOnly turns the daemon API's read-only mode on or off. Turning it
+// off takes $SLOT_MACHINE_ADMIN_TOKEN if the daemon has an admin token.
+func cmdReadOnly(args []string, on bool) {
+	name := "read-write"
+	if on {
+		name = "read-only"
+	}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print the daemon response as JSON")
+	fs.Parse(args)
+
+	ctx := context.Background()
+	var err error
+	if on {
+		err = newClient().ReadOnly(ctx)
+	} else {
+		err = newClient().ReadWrite(ctx, os.Getenv("SLOT_MACHINE_ADMIN_TOKEN"))
+	}
+	if err != nil {
+		fatal(*jsonOut, exitCode(err, exitError), "%v", err)
+	}
+	switch {
+	case *jsonOut:
+		printJSON(map[string]bool{"read_only": on})
+	case on:
+		fmt.Println("the daemon API is read-only; run slot-machine read-write to allow changes again")
+	default:
+		fmt.Println("the daemon API is read-write")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Subcommand: inspect
+// ---------------------------------------------------------------------------
+
+func cmdInspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print the daemon response as JSON")
+	fs.Parse(args)
+
+	name := fs.Arg(0)
+	if name == "" {
+		name = "live"
+	}
+	s, err := newClient().Slot(context.Background(), name)
+	if err != nil {
+		fatal(*jsonOut, exitCode(err, exitError), "%v", err)
+	}
+	if *jsonOut {
+		printJSON(s)
+		return
+	}
+
+	fmt.Printf("slot:    %s  (%s, alive=%v)\n", s.Name, s.Role, s.Alive)
+	fmt.Printf("commit:  %s\n", s.Commit)
+	e := s.Env
+	if e == nil {
+		fmt.Println("no environment recorded (started by an older slot-machine)")
+		return
+	}
+	fmt.Printf("started: %s  %q\n", e.StartedAt, e.StartCommand)
+	fmt.Printf("ports:   app=%d internal=%d\n", e.AppPort, e.IntPort)
+	if e.EnvFile != "" {
+		fmt.Printf("env file: %s  sha256=%s\n", e.EnvFile, e.EnvFileHash)
+	}
+	fmt.Println("injected:")
+	for _, k := range slices.Sorted(maps.Keys(e.Injected)) {
+		fmt.Printf("  %s=%s\n", k, e.Injected[k])
+	}
+	if len(e.FromEnvFile) > 0 {
+		fmt.Println("from env file (value hashes):")
+		for _, k := range slices.Sorted(maps.Keys(e.FromEnvFile)) {
+			fmt.Printf("  %s  %s\n", k, e.FromEnvFile[k])
+		}
+	}
+	fmt.Printf("inherited: %d variables from the daemon's environment (see --json)\n", len(e.Inherited))
+}
+
+// ---------------------------------------------------------------------------
+// Subcommand: verify
+// ---------------------------------------------------------------------------
+
+func cmdVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print the daemon response as JSON")
+	fs.Parse(args)
+
+	name := fs.Arg(0)
+	if name == "" {
+		name = "live"
+	}
+	mc, err := newClient().VerifySlot(context.Background(), name)
+	if err != nil {
+		fatal(*jsonOut, exitCode(err, exitError), "%v", err)
+	}
+	if *jsonOut {
+		printJSON(mc)
+	} else {
+		fmt.Printf("slot:     %s  %s\n", mc.Slot, mc.Commit)
+		fmt.Printf("manifest: %s\n", mc.Digest)
+		if !mc.SignatureOK {
+			fmt.Println("signature: INVALID (the manifest isn't what this daemon signed)")
+		}
+		for _, group := range []struct {
+			label string
+			paths []string
+		}{{"modified", mc.Modified}, {"added", mc.Added}, {"deleted", mc.Deleted}} {
+			for _, p := range group.paths {
+				fmt.Printf("  %-9s %s\n", group.label, p)
+			}
+		}
+		if mc.OK {
+			fmt.Println("ok: the slot's files match its manifest")
+		} else {
+			fmt.Println("FAILED: the slot's files don't match its manifest")
+		}
+	}
+	if !mc.OK {
+		os.Exit(exitVerifyFailed)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Subcommand: mirror
+// ---------------------------------------------------------------------------
+
+func cmdMirror(args []string) {
+	fs := flag.NewFlagSet("mirror", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print the daemon response as JSON")
+	percent := fs.Int("percent", 10, "percentage of live requests to copy")
+	allMethods := fs.Bool("all-methods", false, "also copy POST, PUT, DELETE... (the candidate shares the app's data)")
+	fs.Parse(args)
+
+	ctx := context.Background()
+	if fs.Arg(0) == "stop" {
+		err := newClient().StopMirror(ctx)
+		if err != nil {
+			fatal(*jsonOut, exitCode(err, exitError), "%v", err)
+		}
+		if *jsonOut {
+			printJSON(map[string]bool{"success": true})
+		} else {
+			fmt.Println("mirror stopped")
+		}
+		return
+	}
+
+	commit := fs.Arg(0)
+	if commit == "" {
+		cwd, _ := os.Getwd()
+		c, err := gitHeadCommit(cwd)
+		if err != nil {
+			fatal(*jsonOut, exitError, "cannot determine HEAD commit: %v", err)
+		}
+		commit = c
+	}
+	mr, err := newClient().StartMirror(ctx, commit, client.MirrorOptions{Percent: *percent, AllMethods: *allMethods})
+	if mr == nil {
+		fatal(*jsonOut, exitCode(err, exitDeployFailed), "%v", err)
+	}
+	if *jsonOut {
+		printJSON(mr)
+	} else if mr.Success {
+		fmt.Printf("mirroring %d%% of live traffic to %s; see slot-machine status\n", *percent, engine.ShortHash(mr.Commit))
+	} else {
+		fmt.Fprintf(os.Stderr, "mirror failed: %s\n", mr.Error)
+	}
+	os.Exit(exitCode(err, exitDeployFailed))
+}
+
+// ---------------------------------------------------------------------------
+// Subcommand: preview
+// ---------------------------------------------------------------------------
+
+func cmdPreview(args []string) {
+	fs := flag.NewFlagSet("preview", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print the daemon response as JSON")
+	ttl := fs.Duration("ttl", 0, "remove the preview after this long (default: preview_ttl_ms)")
+	fs.Parse(args)
+
+	ctx := context.Background()
+	c := newClient()
+	switch fs.Arg(0) {
+	case "", "list":
+		list, err := c.Previews(ctx)
+		if err != nil {
+			fatal(*jsonOut, exitCode(err, exitError), "%v", err)
+		}
+		if *jsonOut {
+			printJSON(list)
+			return
+		}
+		if len(list) == 0 {
+			fmt.Println("no previews")
+		}
+		for _, p := range list {
+			state := "alive"
+			if !p.Alive {
+				state = "dead"
+			}
+			fmt.Printf("%-20s %s  %s  %s  expires %s\n", p.Name, engine.ShortHash(p.Commit), p.Host, state, p.ExpiresAt)
+		}
+
+	case "stop":
+		name := fs.Arg(1)
+		if name == "" {
+			fatal(*jsonOut, exitError, "usage: slot-machine preview stop <name>")
+		}
+		if err := c.StopPreview(ctx, name); err != nil {
+			fatal(*jsonOut, exitCode(err, exitError), "%v", err)
+		}
+		if *jsonOut {
+			printJSON(map[string]bool{"success": true})
+		} else {
+			fmt.Printf("preview %s stopped\n", name)
+		}
+
+	default:
+		p, err := c.StartPreview(ctx, fs.Arg(0), *ttl)
+		if err != nil {
+			fatal(*jsonOut, exitCode(err, exitDeployFailed), "%v", err)
+		}
+		if *jsonOut {
+			printJSON(p)
+		} else {
+			fmt.Printf("preview %s (%s) at %s until %s\n", p.Name, engine.ShortHash(p.Commit), p.Host, p.ExpiresAt)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Subcommand: history
+// ---------------------------------------------------------------------------
+
+func cmdHistory(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print the daemon response as JSON")
+	limit := fs.Int("n", 20, "number of entries to show")
+	fs.Parse(args)
+
+	entries, err := newClient().History(context.Background(), *limit)
+	if err != nil {
+		fatal(*jsonOut, exitCode(err, exitError), "%v", err)
+	}
+	if entries == nil {
+		entries = []client.HistoryEntry{}
+	}
+
+	if *jsonOut {
+		printJSON(entries)
+		return
+	}
+	for _, e := range entries {
+		took := ""
+		if e.DurationMs > 0 {
+			took = fmt.Sprintf("%.1fs", float64(e.DurationMs)/1000)
+		}
+		if e.Action == "update" {
+			fmt.Printf("%s  %-8s  %s  %s → %s\n", e.Time, e.Action, engine.ShortHash(e.Commit), e.PrevVersion, e.Version)
+			continue
+		}
+		fmt.Printf("%s  %-8s  %s  %-20s  %-7s  %s%s\n", e.Time, e.Action, engine.ShortHash(e.Commit), e.SlotDir, took, e.Release, formatDeployMessage(e.Message))
+	}
+}
+
+// formatDeployMessage is a deploy's message as status and history print
+// it after the rest of the line.
+func formatDeployMessage(message string) string {
+	if message == "" {
+		return ""
+	}
+	return fmt.Sprintf("  %q", message)
+}
+
+// ---------------------------------------------------------------------------
+// Subcommand: logs
+// ---------------------------------------------------------------------------
+
+func cmdLogs(args []string) {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print the daemon response as JSON")
+	lines := fs.Int("n", 100, "number of lines to show")
+	prev := fs.Bool("prev", false, "show the previous slot's log instead of live")
+	correlate := fs.String("correlate", "", "show every proxy and slot log line for this request ID")
+	all := fs.Bool("all", false, "show the merged stream of slot, daemon, and agent output")
+	fs.Parse(args)
+
+	slotName := "live"
+	if *prev {
+		slotName = "prev"
+	}
+
+	var lr *client.Logs
+	var err error
+	switch {
+	case *correlate != "":
+		lr, err = newClient().Correlate(context.Background(), *correlate)
+	case *all:
+		lr, err = newClient().MergedLogs(context.Background(), "all", *lines)
+	default:
+		lr, err = newClient().Logs(context.Background(), slotName, *lines)
+	}
+	if err != nil {
+		fatal(*jsonOut, exitCode(err, exitError), "%v", err)
+	}
+
+	if *jsonOut {
+		printJSON(lr)
+		return
+	}
+	if *correlate != "" && len(lr.Lines) == 0 {
+		fmt.Fprintf(os.Stderr, "no log lines mention %s\n", *correlate)
+	}
+	for _, l := range lr.Lines {
+		fmt.Println(l)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Subcommand: exec
+// ---------------------------------------------------------------------------
+
+func cmdExec(args []string) {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	slotName := fs.String("slot", "live", `slot to run in: "live", "prev", or a slot name`)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: slot-machine exec [--slot prev] -- <command> [args...]")
+		os.Exit(exitError)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	code, err := newClient().Exec(ctx, *slotName, shellCommand(fs.Args()), os.Stdin, os.Stdout, os.Stderr)
+	if ctx.Err() != nil {
+		os.Exit(130) // interrupted; the daemon kills the command
+	}
+	if err != nil {
+		fatal(false, exitCode(err, exitError), "%v", err)
+	}
+	os.Exit(code)
+}
+
+// shellCommand joins args into a /bin/sh command line. A single argument is
+// taken as a command line already, so `exec -- 'a | b'` works.
+func shellCommand(args []string) string {
+	if len(args) == 1 {
+		return args[0]
+	}
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = engine.ShellQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// ---------------------------------------------------------------------------
+// Subcommand: journal
+// ---------------------------------------------------------------------------
+
+func cmdJournal(args []string) {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "usage: slot-machine journal verify [--data dir] [--json]")
+		os.Exit(exitError)
+	}
+
+	fs := flag.NewFlagSet("journal verify", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print the report as JSON")
+	dataDir := fs.String("data", "", "path to data directory (default: <repo>/.slot-machine)")
+	fs.Parse(args[1:])
+
+	if *dataDir == "" {
+		dir, ok := findConfigDir()
+		if !ok {
+			fatal(*jsonOut, exitError, "cannot find slot-machine.json in current or parent directories")
+		}
+		*dataDir = filepath.Join(dir, ".slot-machine")
+	}
+
+	report, err := engine.VerifyJournal(*dataDir)
+	if err != nil {
+		fatal(*jsonOut, exitError, "%v", err)
+	}
+
+	if *jsonOut {
+		printJSON(report)
+	} else {
+		fmt.Printf("journal: %d entries ok, %d legacy (no checksum)\n", report.Entries, report.Legacy)
+		if len(report.Corrupt) > 0 {
+			fmt.Printf("corrupt lines: %v\n", report.Corrupt)
+		}
+		if report.TornTail {
+			fmt.Println("last record has no trailing newline (torn write)")
+		}
+	}
+	if !report.OK() {
+		os.Exit(exitError)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Subcommand: doctor
+// ---------------------------------------------------------------------------
+
+// cmdDoctor repairs the slots' git worktrees, as the daemon does when it
+// starts, for a data dir no daemon is running on.
+func cmdDoctor(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	dataDir := fs.String("data", "", "path to data directory (default: <repo>/.slot-machine)")
+	fs.Parse(args)
+
+	repo, ok := findConfigDir()
+	if !ok {
+		fatal(false, exitError, "cannot find slot-machine.json in current or parent directories")
+	}
+	if *dataDir == "" {
+		*dataDir = filepath.Join(repo, ".slot-machine")
+	}
+	if pid, _, held := daemonLockState(*dataDir); held {
+		fatal(false, exitError, "a daemon (pid %d) is running on %s; it repaired its worktrees when it started", pid, *dataDir)
+	}
+	cfg, err := loadConfig(filepath.Join(repo, "slot-machine.json"))
+	if err != nil {
+		fatal(false, exitError, "%v", err)
+	}
+
+	o := engine.New(engine.Options{Config: cfg, RepoDir: repo, DataDir: *dataDir})
+	fixed := o.RepairWorktrees()
+	for _, fix := range fixed {
+		fmt.Println(fix)
+	}
+	if len(fixed) == 0 {
+		fmt.Println("worktrees ok")
+	}
+}
+
+// chaosEnv must be "1" for start --chaos: a daemon that stalls its own
+// deploys on purpose shouldn't be one flag away in production.
+const chaosEnv = "SLOT_MACHINE_CHAOS"
+
+// newChaos returns the engine's chaos mode for start's flags, or nil if
+// --chaos isn't set. A zero seed picks one, which is printed for replays.
+func newChaos(on bool, maxDelay time.Duration, seed int64) (*engine.Chaos, error) {
+	if !on {
+		return nil, nil
+	}
+	if os.Getenv(chaosEnv) != "1" {
+		return nil, fmt.Errorf("--chaos needs %s=1 in the environment", chaosEnv)
+	}
+	if maxDelay <= 0 {
+		return nil, fmt.Errorf("--chaos-max-delay must be positive")
+	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	fmt.Printf("chaos: delaying proxy switches and drains by up to %s (--chaos-seed %d)\n", maxDelay, seed)
+	return engine.NewChaos(maxDelay, seed), nil
 }
 
 // ---------------------------------------------------------------------------
@@ -429,33 +1700,192 @@ func cmdInstall() {
 	}
 }
 
-func shortHash(s string) string {
-	if len(s) > 8 {
-		return s[:8]
+// Exit codes for client subcommands. Scripts rely on these — don't renumber.
+const (
+	exitError        = 1 // usage or unexpected error
+	exitUnreachable  = 2 // daemon not running or not reachable
+	exitDeployFailed = 3 // deploy or rollback rejected or failed
+	exitHealthFailed = 4 // new process never passed its health check
+	exitVerifyFailed = 5 // a slot's files don't match its manifest
+	exitPending      = 6 // deploy held until someone approves it (agent_deploy_approval)
+)
+
+// exitCode maps a client error to the CLI exit code. failed is used when the
+// daemon answered but reported a failure.
+func exitCode(err error, failed int) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, client.ErrUnreachable):
+		return exitUnreachable
+	case errors.Is(err, client.ErrHealthCheckFailed):
+		return exitHealthFailed
+	case errors.Is(err, client.ErrPendingApproval):
+		return exitPending
 	}
-	return s
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) {
+		return failed
+	}
+	return exitError
 }
 
-func readAPIPort() int {
-	cwd, _ := os.Getwd()
-	dir := cwd
+// fatal reports an error and exits. In JSON mode the error goes to stdout as
+// {"error": "..."} so scripts only have one stream to parse.
+func fatal(jsonOut bool, code int, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if jsonOut {
+		printJSON(map[string]string{"error": msg})
+	} else {
+		fmt.Fprintf(os.Stderr, "error: %s\n", msg)
+	}
+	os.Exit(code)
+}
+
+func printJSON(v any) {
+	data, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Println(string(data))
+}
+
+// findConfigDir walks up from the working directory to the first directory
+// containing slot-machine.json.
+func findConfigDir() (string, bool) {
+	dir, _ := os.Getwd()
 	for {
-		data, err := os.ReadFile(filepath.Join(dir, "slot-machine.json"))
-		if err == nil {
-			var cfg config
-			json.Unmarshal(data, &cfg)
-			if cfg.APIPort != 0 {
-				return cfg.APIPort
-			}
-			return 9100
+		if _, err := os.Stat(filepath.Join(dir, "slot-machine.json")); err == nil {
+			return dir, true
 		}
 		parent := filepath.Dir(dir)
 		if parent == dir {
-			break
+			return "", false
 		}
 		dir = parent
 	}
-	fmt.Fprintln(os.Stderr, "error: cannot find slot-machine.json in current or parent directories")
-	os.Exit(1)
-	return 0
+}
+
+// loadConfig reads and parses slot-machine.json.
+func loadConfig(path string) (engine.Config, error) {
+	var cfg engine.Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parsing config: %w", err)
+	}
+	return cfg, nil
+}
+
+// apiHandler serves the engine's API, plus the agent's token usage and
+// store stats, so `slot-machine status` can show them without agent
+// credentials, and the daemon's build at /version.
+func apiHandler(o *engine.Orchestrator, agent *agentService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/agent/usage":
+			agent.handleUsage(w, r)
+			return
+		case "/agent/store":
+			agent.handleStoreStats(w, r)
+			return
+		case "/version":
+			handleVersion(w, r)
+			return
+		}
+		o.ServeHTTP(w, r)
+	})
+}
+
+// reloadConfig re-reads the config on SIGHUP and hands it to the engine.
+// Settings read once at startup (API port, agent and chat options) are
+// reported as needing a restart.
+func reloadConfig(o *engine.Orchestrator, path string, started engine.Config) {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reload: %v\n", err)
+		return
+	}
+	kept, err := o.Reload(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reload: %v\n", err)
+		return
+	}
+	if cfg.APIPort != started.APIPort {
+		kept = append(kept, "api_port")
+	}
+	if cfg.AgentAuth != started.AgentAuth {
+		kept = append(kept, "agent_auth")
+	}
+	if cfg.AgentAuthMaxAge != started.AgentAuthMaxAge || cfg.AgentAuthReplay != started.AgentAuthReplay || cfg.AgentAuthLegacy != started.AgentAuthLegacy {
+		kept = append(kept, "agent_auth_max_age_sec/agent_auth_replay_cache/agent_auth_legacy")
+	}
+	if cfg.ReadOnly != started.ReadOnly {
+		kept = append(kept, "read_only")
+	}
+	if !slices.Equal(cfg.AgentAllowedTools, started.AgentAllowedTools) {
+		kept = append(kept, "agent_allowed_tools")
+	}
+	if !slices.Equal(cfg.AgentExtraRepos, started.AgentExtraRepos) {
+		kept = append(kept, "agent_extra_repos")
+	}
+	if cfg.AgentPromptFile != started.AgentPromptFile {
+		kept = append(kept, "agent_system_prompt_file")
+	}
+	if cfg.AgentConcurrency != started.AgentConcurrency {
+		kept = append(kept, "agent_concurrency")
+	}
+	if cfg.AgentModel != started.AgentModel || !reflect.DeepEqual(cfg.AgentModelRules, started.AgentModelRules) {
+		kept = append(kept, "agent_model/agent_model_rules")
+	}
+	if !reflect.DeepEqual(cfg.AgentPrices, started.AgentPrices) {
+		kept = append(kept, "agent_prices")
+	}
+	if cfg.AgentRetainDays != started.AgentRetainDays || cfg.AgentDBMaxMB != started.AgentDBMaxMB {
+		kept = append(kept, "agent_retain_days/agent_db_max_mb")
+	}
+	if cfg.ChatTitle != started.ChatTitle || cfg.ChatAccent != started.ChatAccent {
+		kept = append(kept, "chat_title/chat_accent")
+	}
+	if cfg.ChatPushSubject != started.ChatPushSubject {
+		kept = append(kept, "chat_push_subject")
+	}
+	if !reflect.DeepEqual(cfg.AutoUpdate, started.AutoUpdate) {
+		kept = append(kept, "auto_update")
+	}
+	if !reflect.DeepEqual(cfg.StateBackup, started.StateBackup) {
+		kept = append(kept, "state_backup")
+	}
+	fmt.Printf("config reloaded from %s\n", path)
+	if len(kept) > 0 {
+		fmt.Printf("restart to apply: %s\n", strings.Join(kept, ", "))
+	}
+}
+
+// newClient returns an API client for the daemon configured in the nearest
+// slot-machine.json.
+// newClient talks to the daemon of the config found from the working
+// directory. With SLOT_MACHINE_ADMIN_TOKEN set, it sends the token, which
+// vouches for its deploys and approvals as a person's (see
+// agent_deploy_approval).
+func newClient() *client.Client {
+	opts := []client.Option{client.WithHost(fmt.Sprintf("http://127.0.0.1:%d", readAPIPort()))}
+	if token := os.Getenv("SLOT_MACHINE_ADMIN_TOKEN"); token != "" {
+		opts = append(opts, client.WithToken(token))
+	}
+	return client.New(opts...)
+}
+
+func readAPIPort() int {
+	dir, ok := findConfigDir()
+	if !ok {
+		fmt.Fprintln(os.Stderr, "error: cannot find slot-machine.json in current or parent directories")
+		os.Exit(1)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "slot-machine.json"))
+	var cfg engine.Config
+	json.Unmarshal(data, &cfg)
+	if cfg.APIPort != 0 {
+		return cfg.APIPort
+	}
+	return 9100
 }
@@ -1,124 +1,45 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hkdf"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"net"
+	"io"
+	"maps"
+	"math"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
-)
-
-func TestShortHash(t *testing.T) {
-	t.Parallel()
-	tests := []struct {
-		in, want string
-	}{
-		{"abcdef1234567890", "abcdef12"},
-		{"abcdef12", "abcdef12"},
-		{"d4f80a3", "d4f80a3"}, // 7-char short hash (common git default)
-		{"abc", "abc"},
-		{"", ""},
-	}
-	for _, tt := range tests {
-		if got := shortHash(tt.in); got != tt.want {
-			t.Errorf("shortHash(%q) = %q, want %q", tt.in, got, tt.want)
-		}
-	}
-}
-
-func TestLoadEnvFile(t *testing.T) {
-	t.Parallel()
-	dir := t.TempDir()
-	path := filepath.Join(dir, ".env")
-
-	content := `# comment
-FOO=bar
-BAZ=qux
-
-# another comment
-EMPTY=
-NOEQ
-`
-	os.WriteFile(path, []byte(content), 0644)
-
-	env, err := loadEnvFile(path)
-	if err != nil {
-		t.Fatalf("loadEnvFile: %v", err)
-	}
-
-	want := []string{"FOO=bar", "BAZ=qux", "EMPTY="}
-	if len(env) != len(want) {
-		t.Fatalf("got %d entries, want %d: %v", len(env), len(want), env)
-	}
-	for i, w := range want {
-		if env[i] != w {
-			t.Errorf("env[%d] = %q, want %q", i, env[i], w)
-		}
-	}
-}
-
-func TestLoadEnvFileMissing(t *testing.T) {
-	t.Parallel()
-	_, err := loadEnvFile("/nonexistent/.env")
-	if err == nil {
-		t.Fatal("expected error for missing file")
-	}
-}
-
-func TestAtomicSymlink(t *testing.T) {
-	t.Parallel()
-	dir := t.TempDir()
-	link := filepath.Join(dir, "live")
-
-	// Create initial symlink.
-	if err := atomicSymlink(link, "slot-a"); err != nil {
-		t.Fatalf("atomicSymlink: %v", err)
-	}
-	target, err := os.Readlink(link)
-	if err != nil {
-		t.Fatalf("readlink: %v", err)
-	}
-	if target != "slot-a" {
-		t.Fatalf("got %q, want slot-a", target)
-	}
-
-	// Overwrite atomically.
-	if err := atomicSymlink(link, "slot-b"); err != nil {
-		t.Fatalf("atomicSymlink overwrite: %v", err)
-	}
-	target, err = os.Readlink(link)
-	if err != nil {
-		t.Fatalf("readlink after overwrite: %v", err)
-	}
-	if target != "slot-b" {
-		t.Fatalf("got %q, want slot-b", target)
-	}
-}
-
-func TestFindFreePort(t *testing.T) {
-	t.Parallel()
-	port, err := findFreePort()
-	if err != nil {
-		t.Fatalf("findFreePort: %v", err)
-	}
-	if port <= 0 || port > 65535 {
-		t.Fatalf("port %d out of range", port)
-	}
 
-	// Port should actually be available.
-	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
-	if err != nil {
-		t.Fatalf("port %d not available: %v", port, err)
-	}
-	l.Close()
-}
+	"slot-machine/internal/engine"
+	"slot-machine/internal/proxy"
+	"slot-machine/pkg/client"
+)
 
 func TestGitignoreContains(t *testing.T) {
 	t.Parallel()
@@ -203,20 +124,19 @@ func TestReadStartScript(t *testing.T) {
 	})
 }
 
-func TestBuildEnvIncludesSlotMachine(t *testing.T) {
+func TestDetectStopSignal(t *testing.T) {
 	t.Parallel()
-	o := &orchestrator{cfg: config{}}
-	env := o.buildEnv(3000, 3900)
-	found := false
-	for _, e := range env {
-		if e == "SLOT_MACHINE=1" {
-			found = true
-			break
+	for start, want := range map[string]string{
+		"next dev":                "SIGINT",
+		"bun --watch server.ts":   "SIGINT",
+		"uv run python app.py":    "SIGINT",
+		"node server.js":          "",
+		"bundle exec ruby app.rb": "",
+	} {
+		if got := detectStopSignal(start); got != want {
+			t.Errorf("detectStopSignal(%q) = %q, want %q", start, got, want)
 		}
 	}
-	if !found {
-		t.Fatal("expected SLOT_MACHINE=1 in env")
-	}
 }
 
 func TestWriteJSON(t *testing.T) {
@@ -234,186 +154,87 @@ func TestWriteJSON(t *testing.T) {
 	}
 }
 
-func TestDynamicProxyNoTarget(t *testing.T) {
-	t.Parallel()
-	p := newDynamicProxy("", nil)
-	w := httptest.NewRecorder()
-	r := httptest.NewRequest("GET", "/", nil)
-	p.serveHTTP(w, r)
-	if w.Code != http.StatusServiceUnavailable {
-		t.Fatalf("expected 503, got %d", w.Code)
-	}
-}
-
-func TestDynamicProxyWithTarget(t *testing.T) {
-	t.Parallel()
-
-	// Start a test backend.
-	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("ok"))
-	}))
-	defer backend.Close()
-
-	// Extract port from backend URL.
-	_, portStr, _ := net.SplitHostPort(backend.Listener.Addr().String())
-	var port int
-	fmt.Sscanf(portStr, "%d", &port)
-
-	p := newDynamicProxy("", nil)
-	p.port = port // set directly since addr="" means no listener management
-
-	w := httptest.NewRecorder()
-	r := httptest.NewRequest("GET", "/", nil)
-	p.serveHTTP(w, r)
-	if w.Code != http.StatusOK {
-		t.Fatalf("expected 200, got %d", w.Code)
-	}
-	if w.Body.String() != "ok" {
-		t.Fatalf("body = %q", w.Body.String())
-	}
-}
-
-func TestDynamicProxyLifecycle(t *testing.T) {
-	t.Parallel()
-
-	port, _ := findFreePort()
-	addr := fmt.Sprintf("127.0.0.1:%d", port)
-	p := newDynamicProxy(addr, nil)
-
-	// No target — no listener.
-	conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
-	if err == nil {
-		conn.Close()
-		t.Fatal("expected connection refused with no target")
-	}
-
-	// Start a backend.
-	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("backend"))
-	}))
-	defer backend.Close()
-	_, bPortStr, _ := net.SplitHostPort(backend.Listener.Addr().String())
-	var bPort int
-	fmt.Sscanf(bPortStr, "%d", &bPort)
-
-	// Set target — listener should start.
-	p.setTarget(bPort)
-	time.Sleep(50 * time.Millisecond) // let goroutine start
-
-	resp, err := http.Get(fmt.Sprintf("http://%s/", addr))
-	if err != nil {
-		t.Fatalf("GET after setTarget: %v", err)
-	}
-	resp.Body.Close()
-	if resp.StatusCode != 200 {
-		t.Fatalf("expected 200, got %d", resp.StatusCode)
-	}
-
-	// Clear target — listener should stop.
-	p.clearTarget()
-	time.Sleep(50 * time.Millisecond)
-
-	conn, err = net.DialTimeout("tcp", addr, 100*time.Millisecond)
-	if err == nil {
-		conn.Close()
-		t.Fatal("expected connection refused after clearTarget")
-	}
-}
-
-func TestOrchestratorServeHTTP(t *testing.T) {
+func TestExtractUser(t *testing.T) {
 	t.Parallel()
+	secret := "deadbeef1234"
 
-	o := &orchestrator{
-		appProxy: newDynamicProxy("", nil),
-		intProxy: newDynamicProxy("", nil),
-	}
-
-	t.Run("GET /", func(t *testing.T) {
-		w := httptest.NewRecorder()
+	t.Run("hmac valid", func(t *testing.T) {
+		a := &agentService{authMode: "hmac", authSecret: secret}
 		r := httptest.NewRequest("GET", "/", nil)
-		o.ServeHTTP(w, r)
-		if w.Code != 200 {
-			t.Fatalf("expected 200, got %d", w.Code)
+		r.Header.Set("X-SlotMachine-User", client.SignUser(secret, "alice", time.Now()))
+		if got := a.extractUser(r); got != "alice" {
+			t.Fatalf("got %q, want alice", got)
 		}
 	})
 
-	t.Run("GET /status", func(t *testing.T) {
-		w := httptest.NewRecorder()
-		r := httptest.NewRequest("GET", "/status", nil)
-		o.ServeHTTP(w, r)
-		if w.Code != 200 {
-			t.Fatalf("expected 200, got %d", w.Code)
+	t.Run("hmac expired", func(t *testing.T) {
+		a := &agentService{authMode: "hmac", authSecret: secret, authMaxAge: time.Minute}
+		now := time.Now()
+		for _, at := range []time.Time{now.Add(-2 * time.Minute), now.Add(2 * time.Minute)} {
+			if got := a.verifyUser(client.SignUser(secret, "alice", at), now); got != "" {
+				t.Errorf("signed at %v: got %q, want empty", at.Sub(now), got)
+			}
 		}
-	})
-
-	t.Run("404", func(t *testing.T) {
-		w := httptest.NewRecorder()
-		r := httptest.NewRequest("GET", "/nope", nil)
-		o.ServeHTTP(w, r)
-		if w.Code != 404 {
-			t.Fatalf("expected 404, got %d", w.Code)
+		if got := a.verifyUser(client.SignUser(secret, "alice", now.Add(-30*time.Second)), now); got != "alice" {
+			t.Errorf("signed 30s ago: got %q, want alice", got)
 		}
 	})
 
-	t.Run("POST /deploy missing body", func(t *testing.T) {
-		w := httptest.NewRecorder()
-		r := httptest.NewRequest("POST", "/deploy", nil)
-		o.ServeHTTP(w, r)
-		if w.Code != 400 {
-			t.Fatalf("expected 400, got %d", w.Code)
+	t.Run("hmac legacy", func(t *testing.T) {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte("team:alice"))
+		header := "team:alice:" + hex.EncodeToString(mac.Sum(nil))
+
+		a := &agentService{authMode: "hmac", authSecret: secret}
+		if got := a.verifyUser(header, time.Now()); got != "" {
+			t.Errorf("without agent_auth_legacy: got %q, want empty", got)
+		}
+		a.authLegacy = true
+		if got := a.verifyUser(header, time.Now()); got != "team:alice" {
+			t.Errorf("with agent_auth_legacy: got %q, want team:alice", got)
 		}
 	})
-}
-
-func TestStatusHandler(t *testing.T) {
-	t.Parallel()
-
-	now := time.Now()
-	o := &orchestrator{
-		appProxy: newDynamicProxy("", nil),
-		intProxy: newDynamicProxy("", nil),
-		liveSlot: &slot{
-			name:   "slot-abc12345",
-			commit: "abc1234567890",
-			alive:  true,
-		},
-		prevSlot: &slot{
-			name:   "slot-def12345",
-			commit: "def1234567890",
-		},
-		lastDeploy: now,
-	}
-
-	w := httptest.NewRecorder()
-	r := httptest.NewRequest("GET", "/status", nil)
-	o.ServeHTTP(w, r)
-
-	if w.Code != 200 {
-		t.Fatalf("expected 200, got %d", w.Code)
-	}
 
-	body := w.Body.String()
-	for _, want := range []string{"slot-abc12345", "abc1234567890", "slot-def12345", "def1234567890", "slot-staging"} {
-		if !contains(body, want) {
-			t.Errorf("body missing %q: %s", want, body)
+	t.Run("hmac replay", func(t *testing.T) {
+		a := &agentService{authMode: "hmac", authSecret: secret, authReplay: &replayCache{}}
+		header := client.SignUser(secret, "alice", time.Now())
+		if got := a.verifyUser(header, time.Now()); got != "alice" {
+			t.Fatalf("first use: got %q, want alice", got)
+		}
+		if got := a.verifyUser(header, time.Now()); got != "" {
+			t.Fatalf("replayed: got %q, want empty", got)
 		}
-	}
-}
-
-func TestExtractUser(t *testing.T) {
-	t.Parallel()
-	secret := "deadbeef1234"
 
-	t.Run("hmac valid", func(t *testing.T) {
-		a := &agentService{authMode: "hmac", authSecret: secret}
-		mac := hmac.New(sha256.New, []byte(secret))
-		mac.Write([]byte("alice"))
-		sig := hex.EncodeToString(mac.Sum(nil))
+		// Concurrent requests signed in the same millisecond aren't replays.
+		at := time.Now()
+		var wg sync.WaitGroup
+		var rejected atomic.Int32
+		for range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if a.verifyUser(client.SignUser(secret, "alice", at), at) != "alice" {
+					rejected.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := rejected.Load(); n != 0 {
+			t.Fatalf("%d of 20 concurrent headers rejected", n)
+		}
 
-		r := httptest.NewRequest("GET", "/", nil)
-		r.Header.Set("X-SlotMachine-User", "alice:"+sig)
-		if got := a.extractUser(r); got != "alice" {
-			t.Fatalf("got %q, want alice", got)
+		// Handlers asking for the user again don't count as a replay.
+		store, _ := openAgentStore(filepath.Join(t.TempDir(), "agent.db"))
+		defer store.close()
+		a.store = store
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/agent/conversations", strings.NewReader(`{}`))
+		r.Header.Set("X-SlotMachine-User", client.SignUser(secret, "bob", time.Now()))
+		a.ServeHTTP(w, r)
+		var conv conversationRow
+		json.Unmarshal(w.Body.Bytes(), &conv)
+		if w.Code != 200 || conv.User != "bob" {
+			t.Fatalf("create: %d %s", w.Code, w.Body)
 		}
 	})
 
@@ -453,6 +274,42 @@ func TestExtractUser(t *testing.T) {
 	})
 }
 
+func TestAgentReadOnly(t *testing.T) {
+	t.Parallel()
+	store, err := openAgentStore(filepath.Join(t.TempDir(), "agent.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	readOnly := true
+	a := &agentService{store: store, authMode: "none", readOnly: func() bool { return readOnly }}
+
+	for _, tc := range []struct{ method, path string }{
+		{"POST", "/agent/conversations"},
+		{"PATCH", "/agent/config"},
+		{"POST", "/agent/conversations/c1/messages"},
+		{"POST", "/agent/conversations/c1/cancel"},
+	} {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, strings.NewReader(`{}`)))
+		if w.Code != 403 {
+			t.Errorf("%s %s: %d %s", tc.method, tc.path, w.Code, w.Body)
+		}
+	}
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest("GET", "/agent/conversations", nil))
+	if w.Code != 200 {
+		t.Errorf("GET /agent/conversations: %d %s", w.Code, w.Body)
+	}
+
+	readOnly = false
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest("POST", "/agent/conversations", strings.NewReader(`{}`)))
+	if w.Code == 403 {
+		t.Errorf("POST /agent/conversations once read-write: %d %s", w.Code, w.Body)
+	}
+}
+
 func TestTitlePattern(t *testing.T) {
 	t.Parallel()
 
@@ -583,6 +440,19 @@ func TestChatConfigEndpoint(t *testing.T) {
 			t.Fatalf("expected authSecret, got: %s", body)
 		}
 	})
+
+	t.Run("uncommitted staging changes", func(t *testing.T) {
+		a := &agentService{authMode: "none", stagingChanges: func() engine.WorktreeChanges {
+			return engine.WorktreeChanges{Modified: 2, Untracked: 1}
+		}}
+		w := httptest.NewRecorder()
+		a.handleChatConfig(w, httptest.NewRequest("GET", "/chat/config", nil))
+
+		body := w.Body.String()
+		if !strings.Contains(body, `"stagingDirty":true`) || !strings.Contains(body, `"modified":2`) {
+			t.Fatalf("expected staging changes, got: %s", body)
+		}
+	})
 }
 
 func TestChatServesStaticHTML(t *testing.T) {
@@ -602,25 +472,70 @@ func TestChatServesStaticHTML(t *testing.T) {
 	}
 }
 
-func TestBuildEnvResolvesEnvFileRelativeToRepoDir(t *testing.T) {
+func TestMessagePages(t *testing.T) {
 	t.Parallel()
-	dir := t.TempDir()
-	os.WriteFile(filepath.Join(dir, ".env"), []byte("SECRET=hunter2\n"), 0644)
+	store, _ := openAgentStore(filepath.Join(t.TempDir(), "agent.db"))
+	defer store.close()
+	mgr := newAgentManager(store)
+	defer mgr.stop()
+	a := &agentService{store: store, manager: mgr, authMode: "none"}
+	store.createConversation("c1", "u")
+	var ids []int64
+	for i := range 5 {
+		id, _ := store.addMessage("c1", "user", fmt.Sprint(i))
+		ids = append(ids, id)
+	}
 
-	o := &orchestrator{
-		cfg:     config{EnvFile: ".env"},
-		repoDir: dir,
+	get := func(path string) (msgs []messageRow, more bool) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 200 {
+			t.Fatalf("GET %s: %d %s", path, w.Code, w.Body)
+		}
+		var body struct {
+			Messages []messageRow `json:"messages"`
+			HasMore  bool         `json:"has_more"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return body.Messages, body.HasMore
 	}
-	env := o.buildEnv(3000, 3900)
-	found := false
-	for _, e := range env {
-		if e == "SECRET=hunter2" {
-			found = true
-			break
+	contents := func(msgs []messageRow) string {
+		var s []string
+		for _, m := range msgs {
+			s = append(s, m.Content)
 		}
+		return strings.Join(s, ",")
 	}
-	if !found {
-		t.Fatal("expected SECRET=hunter2 from .env resolved relative to repoDir")
+
+	for _, tc := range []struct {
+		path string
+		want string
+		more bool
+	}{
+		{"/agent/conversations/c1", "0,1,2,3,4", false},
+		{"/agent/conversations/c1?limit=2", "3,4", true},
+		{"/agent/conversations/c1/messages", "0,1,2,3,4", false},
+		{fmt.Sprintf("/agent/conversations/c1/messages?before=%d&limit=2", ids[3]), "1,2", true},
+		{fmt.Sprintf("/agent/conversations/c1/messages?before=%d&limit=2", ids[1]), "0", false},
+		{fmt.Sprintf("/agent/conversations/c1/messages?after=%d&limit=2", ids[1]), "2,3", true},
+		{fmt.Sprintf("/agent/conversations/c1/messages?after=%d", ids[4]), "", false},
+	} {
+		msgs, more := get(tc.path)
+		if got := contents(msgs); got != tc.want || more != tc.more {
+			t.Errorf("GET %s = %q, more %v; want %q, %v", tc.path, got, more, tc.want, tc.more)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest("GET", "/agent/conversations/c1/messages?limit=-1", nil))
+	if w.Code != 400 {
+		t.Errorf("limit=-1: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest("GET", "/agent/conversations/nope/messages", nil))
+	if w.Code != 404 {
+		t.Errorf("unknown conversation: %d", w.Code)
 	}
 }
 
@@ -671,128 +586,115 @@ func TestSendMessageOnlyStoresDoesNotStartAgent(t *testing.T) {
 	}
 }
 
-func TestApplySharedDirs(t *testing.T) {
+func TestToolPolicy(t *testing.T) {
 	t.Parallel()
+	store, err := openAgentStore(filepath.Join(t.TempDir(), "agent.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	a := &agentService{store: store, authMode: "none", allowedTools: []string{"Bash", "Read"}}
 
-	t.Run("symlinks slot dir to repo dir", func(t *testing.T) {
-		repoDir := t.TempDir()
-		slotDir := t.TempDir()
-
-		// Repo has the canonical data with a file.
-		os.MkdirAll(filepath.Join(repoDir, "data"), 0755)
-		os.WriteFile(filepath.Join(repoDir, "data", "test.db"), []byte("content"), 0644)
-
-		// Slot has a stale copy (from CoW clone).
-		os.MkdirAll(filepath.Join(slotDir, "data"), 0755)
-		os.WriteFile(filepath.Join(slotDir, "data", "stale.db"), []byte("stale"), 0644)
-
-		o := &orchestrator{
-			cfg:     config{SharedDirs: []string{"data"}},
-			repoDir: repoDir,
-		}
-		o.applySharedDirs(slotDir)
-
-		// Slot's data should now be a symlink.
-		info, err := os.Lstat(filepath.Join(slotDir, "data"))
-		if err != nil {
-			t.Fatalf("lstat: %v", err)
-		}
-		if info.Mode()&os.ModeSymlink == 0 {
-			t.Fatal("expected symlink")
-		}
-
-		// Slot should see the repo's file, not the stale copy.
-		content, _ := os.ReadFile(filepath.Join(slotDir, "data", "test.db"))
-		if string(content) != "content" {
-			t.Fatal("expected repo file through symlink")
-		}
-		if _, err := os.Stat(filepath.Join(slotDir, "data", "stale.db")); err == nil {
-			t.Fatal("stale file should not be visible")
-		}
-	})
-
-	t.Run("seeds repo dir from slot checkout on first deploy", func(t *testing.T) {
-		repoDir := t.TempDir()
-		slotDir := t.TempDir()
-
-		// Slot has data from the git checkout (first deploy).
-		os.MkdirAll(filepath.Join(slotDir, "data"), 0755)
-		os.WriteFile(filepath.Join(slotDir, "data", "seed.db"), []byte("seeded"), 0644)
-
-		o := &orchestrator{
-			cfg:     config{SharedDirs: []string{"data"}},
-			repoDir: repoDir,
-		}
-		o.applySharedDirs(slotDir)
-
-		// Repo's data dir should contain the seeded file.
-		content, err := os.ReadFile(filepath.Join(repoDir, "data", "seed.db"))
-		if err != nil || string(content) != "seeded" {
-			t.Fatal("expected repo data dir to be seeded from slot checkout")
-		}
-
-		// Slot should symlink to it.
-		info, _ := os.Lstat(filepath.Join(slotDir, "data"))
-		if info.Mode()&os.ModeSymlink == 0 {
-			t.Fatal("expected symlink")
-		}
-	})
-
-	t.Run("creates empty repo dir if slot has no data", func(t *testing.T) {
-		repoDir := t.TempDir()
-		slotDir := t.TempDir()
+	call := func(method, path, body string) (int, toolPolicy) {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		var p toolPolicy
+		json.Unmarshal(w.Body.Bytes(), &p)
+		return w.Code, p
+	}
 
-		o := &orchestrator{
-			cfg:     config{SharedDirs: []string{"data"}},
-			repoDir: repoDir,
-		}
-		o.applySharedDirs(slotDir)
+	if code, p := call("GET", "/agent/config", ""); code != 200 || p.Source != "config" || !slices.Equal(p.AllowedTools, []string{"Bash", "Read"}) {
+		t.Fatalf("GET /agent/config = %d %+v", code, p)
+	}
+	if code, p := call("PATCH", "/agent/config", `{"allowed_tools":["Read","Grep"]}`); code != 200 || p.Source != "runtime" || !slices.Equal(p.AllowedTools, []string{"Read", "Grep"}) {
+		t.Fatalf("PATCH /agent/config = %d %+v", code, p)
+	}
+	if code, _ := call("PATCH", "/agent/config", `{"allowed_tools":["Bash,Write"]}`); code != 400 {
+		t.Errorf("comma in a tool name = %d, want 400", code)
+	}
 
-		// Repo's data dir should have been created (empty).
-		info, err := os.Stat(filepath.Join(repoDir, "data"))
-		if err != nil || !info.IsDir() {
-			t.Fatal("expected repo data dir to be created")
-		}
+	// A read-only conversation overrides the runtime list, and survives a
+	// reload from the store.
+	store.createConversation("c1", "u")
+	if code, p := call("PATCH", "/agent/conversations/c1", `{"allowed_tools":["Read"]}`); code != 200 || p.Source != "conversation" {
+		t.Fatalf("PATCH conversation = %d %+v", code, p)
+	}
+	conv, _ := store.getConversation("c1")
+	if p := a.policyFor(conv); !slices.Equal(p.AllowedTools, []string{"Read"}) {
+		t.Errorf("conversation policy = %+v", p)
+	}
 
-		// Slot should symlink to it.
-		info, _ = os.Lstat(filepath.Join(slotDir, "data"))
-		if info.Mode()&os.ModeSymlink == 0 {
-			t.Fatal("expected symlink")
-		}
-	})
+	// null goes back to the daemon-wide list, and resetting that falls back
+	// to the config.
+	call("PATCH", "/agent/conversations/c1", `{"allowed_tools":null}`)
+	call("PATCH", "/agent/config", `{"allowed_tools":null}`)
+	conv, _ = store.getConversation("c1")
+	if p := a.policyFor(conv); p.Source != "config" {
+		t.Errorf("after reset = %+v", p)
+	}
 
-	t.Run("no shared dirs configured", func(t *testing.T) {
-		slotDir := t.TempDir()
-		os.MkdirAll(filepath.Join(slotDir, "data"), 0755)
+	if code, _ := call("PATCH", "/agent/conversations/nope", `{"allowed_tools":[]}`); code != 404 {
+		t.Errorf("unknown conversation = %d", code)
+	}
+}
 
-		o := &orchestrator{cfg: config{}}
-		o.applySharedDirs(slotDir)
+func TestSearch(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "agent.db")
+	store, err := openAgentStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.createConversation("c1", "u")
+	store.updateTitle("c1", "Billing")
+	store.addMessage("c1", "user", "can you move the billing cron to 3am?")
+	store.addMessage("c1", "assistant", `{"content":"Done: the <billing> cron now runs at 03:00."}`)
+	store.addMessage("c1", "tool_result", `{"id":"t1","output":"billing.go"}`)
+	store.createConversation("c2", "u")
+	store.addMessage("c2", "user", "fix the login page")
+	store.close()
+
+	// Reopening keeps the index (and doesn't index twice).
+	store, err = openAgentStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	a := &agentService{store: store, authMode: "none"}
 
-		// data should still be a real directory.
-		info, _ := os.Lstat(filepath.Join(slotDir, "data"))
-		if info.Mode()&os.ModeSymlink != 0 {
-			t.Fatal("should not create symlinks when not configured")
+	search := func(q string) []searchHit {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", "/agent/search?q="+url.QueryEscape(q), nil))
+		if w.Code != 200 {
+			t.Fatalf("search %q = %d %s", q, w.Code, w.Body.String())
 		}
-	})
-
-	t.Run("ignores absolute and dot paths", func(t *testing.T) {
-		repoDir := t.TempDir()
-		slotDir := t.TempDir()
+		var hits []searchHit
+		json.Unmarshal(w.Body.Bytes(), &hits)
+		return hits
+	}
 
-		o := &orchestrator{
-			cfg:     config{SharedDirs: []string{"/etc", ".", ".."}},
-			repoDir: repoDir,
+	hits := search("bill cron")
+	if len(hits) != 2 {
+		t.Fatalf("hits = %+v, want the user and assistant messages", hits)
+	}
+	for _, h := range hits {
+		if h.ConversationID != "c1" || h.Title != "Billing" || h.MessageID == 0 {
+			t.Errorf("hit = %+v", h)
 		}
-		o.applySharedDirs(slotDir)
-
-		// No symlinks should have been created in the slot.
-		entries, _ := os.ReadDir(slotDir)
-		for _, e := range entries {
-			if e.Type()&os.ModeSymlink != 0 {
-				t.Fatalf("unexpected symlink: %s", e.Name())
-			}
+		if h.Type == "assistant" && h.Snippet != "Done: the &lt;<mark>billing</mark>&gt; <mark>cron</mark> now runs at 03:00." {
+			t.Errorf("snippet = %q", h.Snippet)
 		}
-	})
+	}
+	if hits := search("login"); len(hits) != 1 || hits[0].ConversationID != "c2" {
+		t.Errorf("login hits = %+v", hits)
+	}
+	// FTS syntax in the query is taken literally.
+	if hits := search(`"billing AND -cron`); len(hits) != 0 {
+		t.Errorf("hits = %+v", hits)
+	}
+	if hits := search(""); len(hits) != 0 {
+		t.Errorf("empty query hits = %+v", hits)
+	}
 }
 
 func TestStoreStatusMigration(t *testing.T) {
@@ -868,20 +770,6 @@ func TestRecoverInterrupted(t *testing.T) {
 	}
 }
 
-func contains(s, substr string) bool {
-	return len(s) >= len(substr) && (s == substr || len(substr) == 0 ||
-		findSubstring(s, substr))
-}
-
-func findSubstring(s, sub string) bool {
-	for i := 0; i <= len(s)-len(sub); i++ {
-		if s[i:i+len(sub)] == sub {
-			return true
-		}
-	}
-	return false
-}
-
 func TestAgentManagerStartStop(t *testing.T) {
 	t.Parallel()
 	s, _ := openAgentStore(filepath.Join(t.TempDir(), "test.db"))
@@ -927,7 +815,53 @@ func TestAgentManagerRunAgent(t *testing.T) {
 	}
 }
 
-func TestAgentManagerRejectsConcurrent(t *testing.T) {
+func TestAgentManagerBatchesEvents(t *testing.T) {
+	t.Parallel()
+	s, _ := openAgentStore(filepath.Join(t.TempDir(), "test.db"))
+	defer s.close()
+	s.createConversation("c1", "user1")
+	mgr := newAgentManager(s)
+	defer mgr.stop()
+	ra := &runningAgent{convID: "c1", done: make(chan struct{})}
+	ra.cond = sync.NewCond(&ra.mu)
+
+	text := func(i int) string {
+		return fmt.Sprintf(`{"type":"assistant","message":{"content":[{"type":"text","text":"part %d"}]}}`, i)
+	}
+	for i := range 3 {
+		mgr.processLine("c1", ra, text(i))
+	}
+	if msgs, _ := s.getMessages("c1", 0); len(msgs) != 0 {
+		t.Fatalf("stored %d events before the batch was due", len(msgs))
+	}
+	time.Sleep(3 * storeBatchDelay)
+	msgs, _ := s.getMessages("c1", 0)
+	if len(msgs) != 3 {
+		t.Fatalf("stored %d events after the delay, want 3", len(msgs))
+	}
+
+	// A full batch is written at once, and the done event with whatever is
+	// batched before it, in order.
+	for i := 3; i < 3+storeBatchMax; i++ {
+		mgr.processLine("c1", ra, text(i))
+	}
+	if msgs, _ := s.getMessages("c1", 0); len(msgs) != 3+storeBatchMax {
+		t.Fatalf("stored %d events after a full batch, want %d", len(msgs), 3+storeBatchMax)
+	}
+	mgr.processLine("c1", ra, text(99))
+	mgr.processLine("c1", ra, `{"type":"result","result":"ok"}`)
+	msgs, _ = s.getMessages("c1", 0)
+	if n := len(msgs); n != 5+storeBatchMax || msgs[n-2].Type != "assistant" || msgs[n-1].Type != "done" {
+		t.Fatalf("stored %d events, last %+v", n, msgs[n-1])
+	}
+	for i, m := range msgs[:3+storeBatchMax] {
+		if !strings.Contains(m.Content, fmt.Sprintf(`"part %d"`, i)) {
+			t.Fatalf("event %d = %s", i, m.Content)
+		}
+	}
+}
+
+func TestAgentManagerRejectsConcurrent(t *testing.T) {
 	t.Parallel()
 	s, _ := openAgentStore(filepath.Join(t.TempDir(), "test.db"))
 	defer s.close()
@@ -953,6 +887,50 @@ func TestAgentManagerRejectsConcurrent(t *testing.T) {
 	}
 }
 
+func TestAgentManagerBroadcastRunning(t *testing.T) {
+	t.Parallel()
+	s, _ := openAgentStore(filepath.Join(t.TempDir(), "test.db"))
+	defer s.close()
+	s.createConversation("c1", "user1")
+	s.createConversation("c2", "user1")
+
+	mgr := newAgentManager(s)
+	defer mgr.stop()
+	mgr.enqueue(agentWork{
+		convID: "c1", bin: "sleep", args: []string{"2"}, dir: t.TempDir(),
+	})
+	deadline := time.After(5 * time.Second)
+	for {
+		if c, _ := s.getConversation("c1"); c != nil && c.Status == "running" {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("agent did not start in time")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if n := mgr.broadcastRunning("deploy_failed", `{"error":"process exited before becoming healthy"}`); n != 1 {
+		t.Fatalf("broadcast to %d conversations, want 1", n)
+	}
+	has := func(conv string) bool {
+		msgs, _ := s.getMessages(conv, 0)
+		for _, m := range msgs {
+			if m.Type == "deploy_failed" {
+				return true
+			}
+		}
+		return false
+	}
+	if !has("c1") {
+		t.Error("running conversation should get the event")
+	}
+	if has("c2") {
+		t.Error("idle conversation should not get the event")
+	}
+}
+
 func TestAgentManagerCancel(t *testing.T) {
 	t.Parallel()
 	s, _ := openAgentStore(filepath.Join(t.TempDir(), "test.db"))
@@ -989,36 +967,1652 @@ func TestAgentManagerCancel(t *testing.T) {
 	}
 }
 
-func TestResolveClaudeFromEnv(t *testing.T) {
-	dir := t.TempDir()
-	bin := filepath.Join(dir, "claude")
-	os.WriteFile(bin, []byte("#!/bin/sh\necho hi"), 0755)
+func TestAgentManagerQueue(t *testing.T) {
+	t.Parallel()
+	s, _ := openAgentStore(filepath.Join(t.TempDir(), "test.db"))
+	defer s.close()
+	s.createConversation("c1", "user1")
+	s.createConversation("c2", "user1")
 
-	t.Setenv("SLOT_MACHINE_AGENT_BIN", bin)
-	got := resolveClaude(dir)
-	if got != bin {
-		t.Fatalf("expected %s, got %s", bin, got)
+	mgr := newAgentManager(s)
+	defer mgr.stop()
+	mgr.setConcurrency(1)
+
+	waitStatus := func(conv, want string) {
+		t.Helper()
+		deadline := time.After(5 * time.Second)
+		for {
+			if c, _ := s.getConversation(conv); c != nil && c.Status == want {
+				return
+			}
+			select {
+			case <-deadline:
+				t.Fatalf("%s: status never became %q", conv, want)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
 	}
+
+	mgr.enqueue(agentWork{
+		convID: "c1", bin: "sleep", args: []string{"60"}, dir: t.TempDir(),
+	})
+	waitStatus("c1", "running")
+
+	c2 := agentWork{convID: "c2", bin: "sleep", args: []string{"0"}, dir: t.TempDir()}
+	if err := mgr.enqueue(c2); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus("c2", "queued")
+	if pos := mgr.position("c2"); pos != 1 {
+		t.Fatalf("c2 position = %d, want 1", pos)
+	}
+	if mgr.enqueue(c2) == nil {
+		t.Fatal("a queued conversation should not take a second agent")
+	}
+
+	// Cancelling a queued agent takes it out of the queue.
+	if err := mgr.cancel("c2"); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus("c2", "idle")
+	if pos := mgr.position("c2"); pos != 0 {
+		t.Fatalf("cancelled c2 position = %d, want 0", pos)
+	}
+
+	// Queued again, it starts once c1 is done.
+	if err := mgr.enqueue(c2); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus("c2", "queued")
+	if err := mgr.cancel("c1"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.After(5 * time.Second)
+	for mgr.getRunning("c2") != nil || mgr.position("c2") != 0 {
+		select {
+		case <-deadline:
+			t.Fatal("queued agent never ran")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	waitStatus("c2", "idle")
 }
 
-func TestResolveClaudeFromDataDir(t *testing.T) {
-	dir := t.TempDir()
-	binDir := filepath.Join(dir, ".local", "bin")
-	os.MkdirAll(binDir, 0755)
-	bin := filepath.Join(binDir, "claude")
-	os.WriteFile(bin, []byte("#!/bin/sh\necho hi"), 0755)
+func TestStoreBusyAndCheckpoint(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "agent.db")
+	s, err := openAgentStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	var mode string
+	s.db.QueryRow(`PRAGMA journal_mode`).Scan(&mode)
+	if mode != "wal" {
+		t.Fatalf("journal_mode = %q, want wal", mode)
+	}
+	s.createConversation("c1", "u")
 
-	t.Setenv("SLOT_MACHINE_AGENT_BIN", "")
-	got := resolveClaude(dir)
-	if got != bin {
-		t.Fatalf("expected %s, got %s", bin, got)
+	// Another connection holds the write lock for a while: the message
+	// waits for it instead of being lost.
+	other, err := openAgentStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.close()
+	tx, err := other.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Exec(`UPDATE conversations SET title = 'held' WHERE id = 'c1'`)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		tx.Commit()
+	}()
+	if _, err := s.addMessage("c1", "assistant", `{"content":"hi"}`); err != nil {
+		t.Fatalf("addMessage while locked: %v", err)
+	}
+	if msgs, _ := s.getMessages("c1", 0); len(msgs) != 1 {
+		t.Fatalf("messages = %+v", msgs)
+	}
+
+	if busy, err := s.checkpoint(); err != nil || busy {
+		t.Fatalf("checkpoint: busy %v, %v", busy, err)
+	}
+	if fi, err := os.Stat(path + "-wal"); err == nil && fi.Size() != 0 {
+		t.Errorf("WAL is %d bytes after the checkpoint", fi.Size())
 	}
 }
 
-func TestResolveClaudeNotFound(t *testing.T) {
-	dir := t.TempDir()
-	t.Setenv("SLOT_MACHINE_AGENT_BIN", "")
-	got := resolveClaude(dir)
-	// May find claude in PATH if installed, so just check it doesn't crash.
-	_ = got
+func TestStreamStorageError(t *testing.T) {
+	t.Parallel()
+	store, _ := openAgentStore(filepath.Join(t.TempDir(), "agent.db"))
+	defer store.close()
+	store.createConversation("c1", "u")
+	mgr := newAgentManager(store)
+	defer mgr.stop()
+	a := &agentService{store: store, manager: mgr, authMode: "none"}
+
+	mgr.enqueue(agentWork{convID: "c1", bin: "sleep", args: []string{"10"}, dir: t.TempDir()})
+	deadline := time.After(5 * time.Second)
+	for {
+		if c, _ := store.getConversation("c1"); c != nil && c.Status == "running" {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("agent did not start in time")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	store.db.Exec(`CREATE TRIGGER fail_tool_use BEFORE INSERT ON messages WHEN new.type = 'tool_use'
+		BEGIN SELECT RAISE(ABORT, 'disk full'); END`)
+
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/agent/conversations/c1/stream", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	mgr.storeAndBroadcast("c1", mgr.getRunning("c1"), "tool_use", `{"name":"Bash"}`)
+
+	var got storageError
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if sc.Text() == "event: storage_error" && sc.Scan() {
+			json.Unmarshal([]byte(strings.TrimPrefix(sc.Text(), "data: ")), &got)
+			break
+		}
+	}
+	if got.Type != "tool_use" || !strings.Contains(got.Error, "disk full") {
+		t.Fatalf("storage_error = %+v", got)
+	}
+	if n := store.writeErrors.Load(); n != 1 {
+		t.Errorf("write errors = %d, want 1", n)
+	}
+	cancel()
+	mgr.cancel("c1")
+}
+
+func TestStreamHeartbeatAndProgress(t *testing.T) {
+	t.Parallel()
+	store, _ := openAgentStore(filepath.Join(t.TempDir(), "agent.db"))
+	defer store.close()
+	store.createConversation("c1", "u")
+	mgr := newAgentManager(store)
+	defer mgr.stop()
+	a := &agentService{store: store, manager: mgr, authMode: "none", heartbeat: 50 * time.Millisecond, progressAt: 100 * time.Millisecond}
+
+	mgr.enqueue(agentWork{convID: "c1", bin: "sleep", args: []string{"10"}, dir: t.TempDir()})
+	deadline := time.After(5 * time.Second)
+	for {
+		if c, _ := store.getConversation("c1"); c != nil && c.Status == "running" {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("agent did not start in time")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	mgr.getRunning("c1").toolStarted("toolu_1", "Bash")
+
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/agent/conversations/c1/stream", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var heartbeat, progress bool
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() && !(heartbeat && progress) {
+		line := sc.Text()
+		if line == ": heartbeat" {
+			heartbeat = true
+		}
+		if strings.HasPrefix(line, "data: ") && strings.Contains(line, `"tool":"Bash","id":"toolu_1"`) {
+			var p toolProgress
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &p); err != nil || p.ElapsedMs < 100 {
+				t.Fatalf("bad progress event %q", line)
+			}
+			progress = true
+		}
+	}
+	if !heartbeat || !progress {
+		t.Fatalf("heartbeat %v, progress %v; want both", heartbeat, progress)
+	}
+	if msgs, _ := store.getMessages("c1", 0); len(msgs) != 0 {
+		t.Errorf("stored %d messages, want none", len(msgs))
+	}
+	cancel()
+	mgr.cancel("c1")
+}
+
+func TestUsage(t *testing.T) {
+	t.Parallel()
+	store, err := openAgentStore(filepath.Join(t.TempDir(), "agent.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	store.createConversation("c1", "alice")
+	store.createConversation("c2", "bob")
+
+	// A run from before the usage table is picked up from its done event.
+	store.addMessage("c1", "done", `{"type":"result","usage":{"input_tokens":100,"output_tokens":10,"cache_read_input_tokens":1000}}`)
+	store.db.Exec(`DROP TABLE usage`)
+	if err := initUsage(store.db); err != nil {
+		t.Fatal(err)
+	}
+	store.addUsage("c1", "", 200, 20, 0, 0)
+	store.addUsage("c2", "", 1000, 100, 0, 500)
+
+	a := &agentService{store: store, authMode: "none", prices: &engine.TokenPrices{Input: 3, Output: 15, CacheRead: 0.3, CacheWrite: 3.75}}
+	get := func(query string) (int, usageReport) {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", "/agent/usage"+query, nil))
+		var rep usageReport
+		json.Unmarshal(w.Body.Bytes(), &rep)
+		return w.Code, rep
+	}
+
+	code, rep := get("?since=7d")
+	if code != 200 {
+		t.Fatalf("GET /agent/usage = %d", code)
+	}
+	want := usageTotals{Runs: 3, InputTokens: 1300, OutputTokens: 130, CacheRead: 1000, CacheWrite: 500}
+	cost := rep.Total.CostUSD
+	rep.Total.CostUSD = nil
+	if rep.Total != want {
+		t.Errorf("total = %+v, want %+v", rep.Total, want)
+	}
+	// 1300*3 + 130*15 + 1000*0.3 + 500*3.75 per million.
+	if cost == nil || math.Abs(*cost-0.008025) > 1e-9 {
+		t.Errorf("cost = %v, want 0.008025", cost)
+	}
+	if len(rep.Days) != 1 || rep.Days[0].Runs != 3 {
+		t.Errorf("days = %+v", rep.Days)
+	}
+	if len(rep.Users) != 2 || rep.Users[0].User != "alice" || rep.Users[0].Runs != 2 || rep.Users[1].InputTokens != 1000 {
+		t.Errorf("users = %+v", rep.Users)
+	}
+	if len(rep.Conversations) != 2 {
+		t.Errorf("conversations = %+v", rep.Conversations)
+	}
+
+	if _, rep := get("?since=" + url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))); rep.Total.Runs != 0 || rep.Days == nil {
+		t.Errorf("future since = %+v, want no runs and empty lists", rep)
+	}
+	if code, _ := get("?since=yesterday"); code != 400 {
+		t.Errorf("bad since = %d, want 400", code)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	t.Parallel()
+	store, err := openAgentStore(filepath.Join(t.TempDir(), "agent.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	now := time.Now()
+	old := now.AddDate(0, 0, -40).Format(time.RFC3339)
+	for _, c := range []struct{ id, status, at string }{
+		{"old", "idle", old},
+		{"mixed", "idle", old},
+		{"running", "running", old},
+	} {
+		store.db.Exec(`INSERT INTO conversations (id, created_at, updated_at, status) VALUES (?, ?, ?, ?)`, c.id, c.at, c.at, c.status)
+		store.db.Exec(`INSERT INTO messages (conversation_id, type, content, created_at) VALUES (?, 'user', 'hi', ?)`, c.id, c.at)
+	}
+	store.addMessage("mixed", "user", "still here")
+
+	a := &agentService{store: store, authMode: "none", retainDays: 30}
+	res := a.prune(now)
+	if res.Error != "" || res.Messages != 2 || res.Conversations != 1 {
+		t.Fatalf("prune = %+v, want 2 messages and 1 conversation", res)
+	}
+	if c, _ := store.getConversation("old"); c != nil {
+		t.Error("emptied conversation should be deleted")
+	}
+	if msgs, _ := store.getMessages("mixed", 0); len(msgs) != 1 || msgs[0].Content != "still here" {
+		t.Errorf("mixed messages = %+v, want the recent one", msgs)
+	}
+	if msgs, _ := store.getMessages("running", 0); len(msgs) != 1 {
+		t.Error("a running conversation should be spared")
+	}
+
+	// Size limit: the oldest messages go until enough bytes are freed.
+	for i := 0; i < 5; i++ {
+		store.addMessage("mixed", "user", strings.Repeat("x", 1000))
+	}
+	if n, err := store.pruneOldest(1500); err != nil || n != 3 {
+		t.Errorf("pruneOldest(1500) = %d, %v; want the recent one and two more", n, err)
+	}
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest("GET", "/agent/store", nil))
+	var st storeStats
+	json.Unmarshal(w.Body.Bytes(), &st)
+	if w.Code != 200 || st.SizeBytes == 0 || st.Messages != 4 || st.RetainDays != 30 || st.LastPrune == nil {
+		t.Errorf("GET /agent/store = %d %+v", w.Code, st)
+	}
+}
+
+func TestExtraRepos(t *testing.T) {
+	t.Parallel()
+	git := func(dir string, args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t", "GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	remote := t.TempDir()
+	git(remote, "init", "-q", "-b", "main")
+	os.WriteFile(filepath.Join(remote, "lib.go"), []byte("package lib\n"), 0644)
+	git(remote, "add", ".")
+	git(remote, "commit", "-q", "-m", "one")
+
+	dataDir, repoDir := t.TempDir(), t.TempDir()
+	repos := resolveExtraRepos([]engine.ExtraRepo{
+		{Name: "lib", URL: remote, Ref: "main"},
+		{Name: "docs", Path: "../docs"},
+		{Name: "../escape", Path: "/tmp"},
+		{Name: "both", URL: remote, Path: "/tmp"},
+	}, repoDir, dataDir)
+	if len(repos) != 2 || repos[1].dir != filepath.Join(repoDir, "../docs") {
+		t.Fatalf("resolved %+v, want lib and docs", repos)
+	}
+
+	staging := t.TempDir()
+	a := &agentService{stagingDir: staging, dataDir: dataDir, configPath: filepath.Join(repoDir, "slot-machine.json"), extraRepos: repos}
+	a.syncExtraRepos()
+	clone := filepath.Join(dataDir, "agent-repos", "lib")
+	if _, err := os.Stat(filepath.Join(clone, "lib.go")); err != nil {
+		t.Fatalf("not cloned: %v", err)
+	}
+
+	// Only the repos that exist are offered, and they're read-only.
+	if got := a.availableExtraRepos(); len(got) != 1 || got[0].Name != "lib" {
+		t.Errorf("available = %+v, want lib only", got)
+	}
+	if p := a.buildSystemPrompt(); !strings.Contains(p, "read-only") || !strings.Contains(p, clone) {
+		t.Errorf("system prompt does not list the clone:\n%s", p)
+	}
+	a.generateDenySettings()
+	settings, _ := os.ReadFile(filepath.Join(staging, ".claude", "settings.json"))
+	if !strings.Contains(string(settings), "Write("+clone+"/**)") {
+		t.Errorf("settings do not deny writes to the clone:\n%s", settings)
+	}
+
+	// A later sync picks up new commits.
+	os.WriteFile(filepath.Join(remote, "new.go"), []byte("package lib\n"), 0644)
+	git(remote, "add", ".")
+	git(remote, "commit", "-q", "-m", "two")
+	a.syncExtraRepos()
+	if _, err := os.Stat(filepath.Join(clone, "new.go")); err != nil {
+		t.Errorf("not updated: %v", err)
+	}
+}
+
+func TestSystemPromptTemplate(t *testing.T) {
+	t.Parallel()
+	staging := t.TempDir()
+	file := filepath.Join(t.TempDir(), "prompt.tmpl")
+	a := &agentService{stagingDir: staging, configPath: filepath.Join(staging, "slot-machine.json"), promptFile: file}
+	a.promptInfo = func(v *promptVars) {
+		v.AppName = "shop"
+		v.LiveCommit = "abc123"
+		v.Deploys = []engine.JournalEntry{{Action: "deploy", Commit: "abc123"}}
+	}
+	os.WriteFile(filepath.Join(staging, "AGENTS.md"), []byte("Use tabs."), 0644)
+
+	// No file: the built-in prompt.
+	if p := a.buildSystemPrompt(); !strings.HasPrefix(p, systemPromptBase) {
+		t.Errorf("missing file: prompt does not start with the base:\n%s", p)
+	}
+
+	// Wrapping the base, with the app's instructions still appended.
+	os.WriteFile(file, []byte("{{.Base}}\nApp {{.AppName}} at {{.LiveCommit}}.{{range .Deploys}} {{.Action}} {{.Commit}}{{end}}"), 0644)
+	p := a.buildSystemPrompt()
+	if !strings.HasPrefix(p, systemPromptBase+"\nApp shop at abc123. deploy abc123") || !strings.Contains(p, "Use tabs.") {
+		t.Errorf("wrapped prompt:\n%s", p)
+	}
+
+	// Replacing it.
+	os.WriteFile(file, []byte("You are terse. Work in {{.StagingDir}}."), 0644)
+	if p := a.buildSystemPrompt(); !strings.HasPrefix(p, "You are terse. Work in "+staging+".") || strings.Contains(p, systemPromptBase) {
+		t.Errorf("replaced prompt:\n%s", p)
+	}
+
+	// A broken template falls back to the base.
+	for _, bad := range []string{"{{.Base", "{{.Nope}}"} {
+		os.WriteFile(file, []byte(bad), 0644)
+		if p := a.buildSystemPrompt(); !strings.HasPrefix(p, systemPromptBase) {
+			t.Errorf("%q: prompt does not fall back to the base:\n%s", bad, p)
+		}
+	}
+}
+
+func TestControlAPI(t *testing.T) {
+	t.Parallel()
+	control := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method + " " + r.URL.RequestURI()))
+	})
+	a := &agentService{authMode: "hmac", authSecret: "abc123", apiToken: "s3cret", control: control}
+
+	for _, tt := range []struct {
+		name, method, path, token, origin string
+		code                              int
+		want                              string
+	}{
+		{"status", "GET", "/api/status", "s3cret", "", 200, "GET /status"},
+		{"deploy", "POST", "/api/deploy?force=true", "s3cret", "http://app.test", 200, "POST /deploy?force=true"},
+		{"rollback", "POST", "/api/rollback", "s3cret", "", 200, "POST /rollback"},
+		{"unlock", "DELETE", "/api/lock", "s3cret", "", 200, "DELETE /lock"},
+		{"no token", "GET", "/api/status", "", "", 401, ""},
+		{"wrong token", "GET", "/api/status", "nope", "", 401, ""},
+		{"cross-origin", "POST", "/api/deploy", "s3cret", "http://evil.test", 403, ""},
+		{"preflight", "OPTIONS", "/api/deploy", "", "http://app.test", 204, ""},
+		{"not exposed", "GET", "/api/debug/pprof/", "s3cret", "", 404, ""},
+		{"wrong method", "GET", "/api/deploy", "s3cret", "", 405, ""},
+	} {
+		r := httptest.NewRequest(tt.method, "http://app.test"+tt.path, nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		if w.Code != tt.code || (tt.want != "" && w.Body.String() != tt.want) {
+			t.Errorf("%s: %d %q, want %d %q", tt.name, w.Code, w.Body.String(), tt.code, tt.want)
+		}
+		if tt.origin == "http://app.test" && w.Header().Get("Access-Control-Allow-Origin") != tt.origin {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q", tt.name, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+	}
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest("GET", "/dashboard", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "<html") {
+		t.Errorf("dashboard: %d", w.Code)
+	}
+
+	// Without a token neither the API nor the dashboard is served.
+	a.apiToken = ""
+	for _, path := range []string{"/api/status", "/dashboard"} {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 404 {
+			t.Errorf("%s with no api token: %d, want 404", path, w.Code)
+		}
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"bin/rails console"}, "bin/rails console"},
+		{[]string{"bin/rails", "db:migrate", "VERSION=2024"}, "bin/rails db:migrate VERSION=2024"},
+		{[]string{"echo", "it's", "$HOME", ""}, `echo 'it'\''s' '$HOME' ''`},
+	} {
+		if got := shellCommand(tt.args); got != tt.want {
+			t.Errorf("shellCommand(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestProgressPrinter(t *testing.T) {
+	t.Parallel()
+	var buf strings.Builder
+	p := &progressPrinter{w: &buf}
+	for _, ev := range []client.Progress{
+		{Phase: "setup", Message: "running bun install", ElapsedMs: 300},
+		{Phase: "setup", Line: "installed 12 packages", ElapsedMs: 1200},
+		{Phase: "health", Message: ":3001/healthz not answering", Attempt: 1, ElapsedMs: 1500},
+		{Phase: "health", Message: ":3001/healthz not answering", Attempt: 2, ElapsedMs: 1700},
+		{Phase: "promote", Message: "switching traffic", ElapsedMs: 2000},
+	} {
+		p.print(ev)
+	}
+	p.done()
+	want := "   0.3s  setup    running bun install\n" +
+		"   1.2s           | installed 12 packages\n" +
+		"   1.5s  health   attempt 1: :3001/healthz not answering\n" +
+		"   2.0s  promote  switching traffic\n"
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	// On a terminal, polls rewrite one line, ended before the next step.
+	buf.Reset()
+	p = &progressPrinter{w: &buf, tty: true}
+	p.print(client.Progress{Phase: "health", Message: "503 Service Unavailable", Attempt: 1})
+	p.print(client.Progress{Phase: "health", Message: "503 Service Unavailable", Attempt: 2})
+	p.print(client.Progress{Phase: "promote", Message: "switching traffic"})
+	if got := buf.String(); strings.Count(got, "\r\033[K") != 2 || !strings.HasSuffix(got, "attempt 2: 503 Service Unavailable\n   0.0s  promote  switching traffic\n") {
+		t.Errorf("tty output = %q", got)
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name, in, want string
+	}{
+		{"paragraphs", "one\ntwo\n\nthree", "<p>one<br>two</p><p>three</p>"},
+		{"heading", "## Plan", "<h2>Plan</h2>"},
+		{"emphasis", "**bold** and *it*", "<p><strong>bold</strong> and <em>it</em></p>"},
+		{"inline code", "run `a *b* <c>`", "<p>run <code>a *b* &lt;c&gt;</code></p>"},
+		{"unclosed backtick", "a ` b", "<p>a ` b</p>"},
+		{"code block", "```go\nif a < b {}\n```", `<pre><code class="language-go">if a &lt; b {}</code></pre>`},
+		{"unsafe language", "```\"><x\nx\n```", "<pre><code>x</code></pre>"},
+		{"list", "- a\n- b", "<ul><li>a</li><li>b</li></ul>"},
+		{"ordered list", "1. a\n2. b", "<ol><li>a</li><li>b</li></ol>"},
+		{"table", "| a | b |\n|---|---|\n| 1 | 2 |", "<table><thead><tr><th>a</th><th>b</th></tr></thead><tbody><tr><td>1</td><td>2</td></tr></tbody></table>"},
+		{"link", "[docs](https://x.dev/?a=1&b=2)", `<p><a href="https://x.dev/?a=1&amp;b=2" target="_blank" rel="noopener noreferrer">docs</a></p>`},
+		{"html", "<script>alert(1)</script><img src=x onerror=alert(1)>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;&lt;img src=x onerror=alert(1)&gt;</p>"},
+		{"javascript link", "[x](JavaScript:alert(1))", "<p>[x](JavaScript:alert(1))</p>"},
+		{"quote in link", `[x](/a"onmouseover="alert(1))`, `<p><a href="/a&#34;onmouseover=&#34;alert(1" target="_blank" rel="noopener noreferrer">x</a>)</p>`},
+	}
+	for _, tt := range tests {
+		if got := renderMarkdown(tt.in); got != tt.want {
+			t.Errorf("%s: renderMarkdown(%q)\n got %s\nwant %s", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestResolveClaudeFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "claude")
+	os.WriteFile(bin, []byte("#!/bin/sh\necho hi"), 0755)
+
+	t.Setenv("SLOT_MACHINE_AGENT_BIN", bin)
+	got := resolveClaude(dir)
+	if got != bin {
+		t.Fatalf("expected %s, got %s", bin, got)
+	}
+}
+
+func TestResolveClaudeFromDataDir(t *testing.T) {
+	dir := t.TempDir()
+	binDir := filepath.Join(dir, ".local", "bin")
+	os.MkdirAll(binDir, 0755)
+	bin := filepath.Join(binDir, "claude")
+	os.WriteFile(bin, []byte("#!/bin/sh\necho hi"), 0755)
+
+	t.Setenv("SLOT_MACHINE_AGENT_BIN", "")
+	got := resolveClaude(dir)
+	if got != bin {
+		t.Fatalf("expected %s, got %s", bin, got)
+	}
+}
+
+func TestResolveClaudeNotFound(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("SLOT_MACHINE_AGENT_BIN", "")
+	got := resolveClaude(dir)
+	// May find claude in PATH if installed, so just check it doesn't crash.
+	_ = got
+}
+
+func TestDaemonLock(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	if _, exists, _ := daemonLockState(dir); exists {
+		t.Fatal("expected no pid file before first acquire")
+	}
+
+	l, err := acquireDaemonLock(dir)
+	if err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+
+	if _, err := acquireDaemonLock(dir); err == nil || !strings.Contains(err.Error(), "already using") {
+		t.Fatalf("second acquire should fail with a clear error, got %v", err)
+	}
+
+	pid, exists, held := daemonLockState(dir)
+	if !exists || !held || pid != os.Getpid() {
+		t.Fatalf("state = (%d, %v, %v), want (%d, true, true)", pid, exists, held, os.Getpid())
+	}
+
+	l.release()
+	if _, exists, _ := daemonLockState(dir); exists {
+		t.Fatal("pid file should be removed on release")
+	}
+
+	// A leftover pid file without a lock holder is stale, not held.
+	os.WriteFile(filepath.Join(dir, pidFileName), []byte("999999\n"), 0644)
+	if pid, exists, held := daemonLockState(dir); !exists || held || pid != 999999 {
+		t.Fatalf("stale state = (%d, %v, %v), want (999999, true, false)", pid, exists, held)
+	}
+	l, err = acquireDaemonLock(dir)
+	if err != nil {
+		t.Fatalf("acquire over stale pid file: %v", err)
+	}
+	l.release()
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	defer func(v, c, d string) { Version, Commit, BuildDate = v, c, d }(Version, Commit, BuildDate)
+	Version, Commit, BuildDate = "v1.2.3", "abc123", "2025-01-02T15:04:05Z"
+
+	srv := httptest.NewServer(apiHandler(nil, nil))
+	defer srv.Close()
+
+	v, err := client.New(client.WithHost(srv.URL)).Version(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := client.Version{Version: "v1.2.3", Commit: "abc123", BuildDate: "2025-01-02T15:04:05Z", GoVersion: runtime.Version(), SpecVersion: engine.SpecVersion}
+	if *v != want {
+		t.Errorf("version = %+v, want %+v", *v, want)
+	}
+
+	resp, err := http.Post(srv.URL+"/version", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 405 {
+		t.Errorf("POST /version = %d, want 405", resp.StatusCode)
+	}
+}
+
+func TestInstallReleaseVerifies(t *testing.T) {
+	t.Parallel()
+	name := fmt.Sprintf("slot-machine-%s-%s", runtime.GOOS, runtime.GOARCH)
+	binary := []byte("new binary")
+	sum := sha256.Sum256(binary)
+	goodSums := []byte(hex.EncodeToString(sum[:]) + "  " + name + "\n")
+	badSums := []byte(strings.Repeat("0", 64) + "  " + name + "\n")
+	pub, priv, _ := ed25519.GenerateKey(nil)
+
+	assets := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := assets[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+	rel := &ghRelease{TagName: "v9.9.9", Assets: []ghAsset{
+		{Name: name, URL: srv.URL + "/bin"},
+		{Name: checksumsAsset, URL: srv.URL + "/sums"},
+		{Name: signatureAsset, URL: srv.URL + "/sig"},
+	}}
+
+	tests := []struct {
+		name    string
+		sums    []byte
+		sig     []byte
+		pub     ed25519.PublicKey
+		wantErr string
+	}{
+		{name: "checksum only", sums: goodSums},
+		{name: "checksum mismatch", sums: badSums, wantErr: "checksum mismatch"},
+		{name: "signed", sums: goodSums, sig: []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, goodSums))), pub: pub},
+		{name: "bad signature", sums: goodSums, sig: ed25519.Sign(priv, badSums), pub: pub, wantErr: "does not match"},
+	}
+	for _, tt := range tests {
+		assets = map[string][]byte{"/bin": binary, "/sums": tt.sums, "/sig": tt.sig}
+		self := filepath.Join(t.TempDir(), "slot-machine")
+		os.WriteFile(self, []byte("old binary"), 0755)
+
+		err := installRelease(rel, self, tt.pub)
+		got, _ := os.ReadFile(self)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			if string(got) != "old binary" {
+				t.Errorf("%s: binary replaced despite failed verification", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(got) != "new binary" {
+			t.Errorf("%s: binary = %q, want the new one", tt.name, got)
+		}
+
+		if err := rollbackBinary(self); err != nil {
+			t.Fatalf("%s: rollback: %v", tt.name, err)
+		}
+		if got, _ := os.ReadFile(self); string(got) != "old binary" {
+			t.Errorf("%s: after rollback binary = %q, want the old one", tt.name, got)
+		}
+	}
+}
+
+func TestAutoUpdateWindow(t *testing.T) {
+	t.Parallel()
+	at := func(h, m int) time.Time { return time.Date(2026, 1, 1, h, m, 0, 0, time.Local) }
+	tests := []struct {
+		window string
+		t      time.Time
+		want   bool
+	}{
+		{"", at(12, 0), true},
+		{"03:00-05:00", at(3, 0), true},
+		{"03:00-05:00", at(4, 59), true},
+		{"03:00-05:00", at(5, 0), false},
+		{"03:00-05:00", at(2, 59), false},
+		{"23:30-01:00", at(23, 45), true},
+		{"23:30-01:00", at(0, 30), true},
+		{"23:30-01:00", at(12, 0), false},
+	}
+	for _, tt := range tests {
+		w, err := parseWindow(tt.window)
+		if err != nil {
+			t.Fatalf("parseWindow(%q): %v", tt.window, err)
+		}
+		if got := inWindow(w, tt.t); got != tt.want {
+			t.Errorf("inWindow(%q, %s) = %v, want %v", tt.window, tt.t.Format("15:04"), got, tt.want)
+		}
+	}
+	for _, bad := range []string{"3am-5am", "03:00", "25:00-01:00", "03:00-03:00"} {
+		if _, err := parseWindow(bad); err == nil {
+			t.Errorf("parseWindow(%q) should fail", bad)
+		}
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	t.Parallel()
+	repo, dataDir := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(repo, "slot-machine.json"), []byte(`{"port": 3000}`), 0644)
+	os.WriteFile(filepath.Join(dataDir, "journal.ndjson"), []byte(`{"action":"deploy"}`+"\n"), 0644)
+	os.WriteFile(filepath.Join(dataDir, "state.json"), []byte(`{"version": 1}`), 0644)
+	os.Symlink("slot-aaa111", filepath.Join(dataDir, "live"))
+	store, err := openAgentStore(filepath.Join(dataDir, "agent.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.createConversation("conv-1", "alice")
+	defer store.close() // still open, as under a running daemon
+
+	backup := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := writeBackup(backup, repo, dataDir); err != nil {
+		t.Fatal(err)
+	}
+
+	newRepo := t.TempDir()
+	newData := filepath.Join(newRepo, ".slot-machine")
+	m, err := restoreBackup(backup, newRepo, newData, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.App != filepath.Base(repo) || m.Symlinks["live"] != "slot-aaa111" {
+		t.Errorf("manifest = %+v", m)
+	}
+	for _, name := range []string{"journal.ndjson", "state.json"} {
+		want, _ := os.ReadFile(filepath.Join(dataDir, name))
+		if got, _ := os.ReadFile(filepath.Join(newData, name)); string(got) != string(want) {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if got, _ := os.ReadFile(filepath.Join(newRepo, "slot-machine.json")); string(got) != `{"port": 3000}` {
+		t.Errorf("config = %q", got)
+	}
+	restored, err := openAgentStore(filepath.Join(newData, "agent.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.close()
+	if conv, err := restored.getConversation("conv-1"); err != nil || conv == nil || conv.User != "alice" {
+		t.Errorf("restored conversation = %+v, %v", conv, err)
+	}
+
+	if _, err := restoreBackup(backup, newRepo, newData, false); err == nil {
+		t.Error("restoring over existing state without --force should fail")
+	}
+}
+
+func TestStateBackupS3(t *testing.T) {
+	t.Setenv("TEST_S3_KEY", "AKID")
+	t.Setenv("TEST_S3_SECRET", "secret")
+	objects := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			http.Error(w, "unsigned", 403)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if sum := sha256.Sum256(body); r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+			http.Error(w, "bad payload hash", 400)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			objects[r.URL.Path] = body
+		case "GET":
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	defer srv.Close()
+
+	repo, dataDir := t.TempDir(), t.TempDir()
+	sb := engine.StateBackup{URL: "s3://backups/prod/", Endpoint: srv.URL, AccessKeyEnv: "TEST_S3_KEY", SecretKeyEnv: "TEST_S3_SECRET"}
+	config, _ := json.Marshal(engine.Config{Port: 3000, StateBackup: &sb})
+	os.WriteFile(filepath.Join(repo, "slot-machine.json"), config, 0644)
+	os.WriteFile(filepath.Join(dataDir, "journal.ndjson"), []byte(`{"action":"deploy"}`+"\n"), 0644)
+
+	e, err := newStateExporter(sb, repo, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.export(); err != nil {
+		t.Fatal(err)
+	}
+	key := "/backups/prod/" + filepath.Base(repo) + ".tar.gz"
+	if _, ok := objects[key]; !ok {
+		t.Fatalf("uploaded %v, want %s", slices.Collect(maps.Keys(objects)), key)
+	}
+
+	// A new server, with a clone of the repo: its config says where the
+	// backup is.
+	newRepo := filepath.Join(t.TempDir(), filepath.Base(repo))
+	os.Mkdir(newRepo, 0755)
+	os.WriteFile(filepath.Join(newRepo, "slot-machine.json"), config, 0644)
+	path, err := fetchBackup("s3://backups/prod/", "", "", newRepo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	newData := filepath.Join(newRepo, ".slot-machine")
+	if _, err := restoreBackup(path, newRepo, newData, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(newData, "journal.ndjson")); string(got) != `{"action":"deploy"}`+"\n" {
+		t.Errorf("restored journal = %q", got)
+	}
+
+	if _, err := fetchBackup("s3://backups/missing.tar.gz", "", "", newRepo); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("fetching a missing backup: %v", err)
+	}
+	sb.SecretKeyEnv = "TEST_S3_UNSET"
+	if _, err := newStateExporter(sb, repo, dataDir); err == nil {
+		t.Error("state_backup without credentials should be refused")
+	}
+}
+
+func TestDevWatcher(t *testing.T) {
+	t.Parallel()
+	repo := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t", "GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q", "-b", "main")
+	git("commit", "-q", "--allow-empty", "-m", "one")
+	one := git("rev-parse", "HEAD")
+
+	w, err := newDevWatcher(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deployed []string
+	busy := false
+	w.deploy = func(commit string) (engine.DeployResponse, int) {
+		if busy {
+			return engine.DeployResponse{Error: "deploy in progress"}, 409
+		}
+		deployed = append(deployed, commit)
+		return engine.DeployResponse{Success: true, Commit: commit}, 200
+	}
+	w.deployed = one
+
+	// What's live already isn't deployed again.
+	w.check()
+	if len(deployed) != 0 {
+		t.Fatalf("deployed %v, want nothing", deployed)
+	}
+
+	git("commit", "-q", "--allow-empty", "-m", "two")
+	two := git("rev-parse", "HEAD")
+	busy = true
+	w.check()
+	busy = false
+	w.check()
+	w.check()
+	if !slices.Equal(deployed, []string{two}) {
+		t.Errorf("deployed %v, want [%s] once another deploy finished", deployed, two)
+	}
+
+	// Commits on other branches are left alone.
+	git("checkout", "-q", "-b", "other")
+	git("commit", "-q", "--allow-empty", "-m", "three")
+	w.check()
+	if len(deployed) != 1 {
+		t.Errorf("deployed %v from another branch", deployed)
+	}
+
+	git("checkout", "-q", "--detach")
+	if _, err := newDevWatcher(repo); err == nil {
+		t.Error("a detached HEAD should be refused")
+	}
+}
+
+func TestInstallHook(t *testing.T) {
+	t.Parallel()
+	git := func(dir string, args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t", "GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	tmp := t.TempDir()
+	app, bare, dev := filepath.Join(tmp, "app"), filepath.Join(tmp, "app.git"), filepath.Join(tmp, "dev")
+	os.Mkdir(app, 0755)
+	git(app, "init", "-q", "-b", "main")
+	git(app, "commit", "-q", "--allow-empty", "-m", "one")
+	git(tmp, "clone", "-q", "--bare", app, bare)
+	git(tmp, "clone", "-q", app, dev)
+
+	// Stands in for slot-machine: records what it was asked to deploy.
+	deployed := filepath.Join(tmp, "deployed")
+	bin := filepath.Join(tmp, "fake slot-machine")
+	os.WriteFile(bin, []byte("#!/bin/sh\necho \"$@\" >> '"+deployed+"'\necho deploying \"$4\" >&2\n"), 0755)
+
+	hook, err := installHook(bin, app, bare, "main", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	git(dev, "commit", "-q", "--allow-empty", "-m", "two")
+	two := git(dev, "rev-parse", "HEAD")
+	if out := git(dev, "push", "-q", bare, "main"); !strings.Contains(out, "remote: deploying "+two) {
+		t.Errorf("push output = %q, want the deploy's", out)
+	}
+	git(dev, "push", "-q", bare, "main:other")
+	if got, _ := os.ReadFile(deployed); string(got) != "deploy --source webhook "+two+"\n" {
+		t.Errorf("deployed %q, want %s only", got, two)
+	}
+	if got := git(app, "rev-parse", "main"); got != two {
+		t.Errorf("app's main = %s, want the pushed %s", got, two)
+	}
+
+	// Someone else's hook is left alone.
+	os.WriteFile(hook, []byte("#!/bin/sh\n"), 0755)
+	if _, err := installHook(bin, app, bare, "main", false); err == nil {
+		t.Error("replaced a foreign hook without --force")
+	}
+
+	// Pushed straight to the app's repo, the checked-out branch is updated.
+	if _, err := installHook(bin, app, "", "main", false); err != nil {
+		t.Fatal(err)
+	}
+	git(dev, "commit", "-q", "--allow-empty", "-m", "three")
+	three := git(dev, "rev-parse", "HEAD")
+	git(dev, "push", "-q", app, "main")
+	if got, _ := os.ReadFile(deployed); !strings.HasSuffix(string(got), "deploy --source webhook "+three+"\n") {
+		t.Errorf("deployed %q, want %s last", got, three)
+	}
+}
+
+func TestDeployDecisionNeedsUser(t *testing.T) {
+	t.Parallel()
+	var calls []string
+	control := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		writeJSON(w, 200, map[string]string{"decision": "rejected"})
+	})
+	// Requests reach the chat through the app proxy, as from a browser or
+	// from the agent's shell.
+	for _, tt := range []struct {
+		mode, user, trusted, peer string
+		code                      int
+	}{
+		{"none", "", "", "127.0.0.1:40000", 403},
+		{"none", "alice", "", "127.0.0.1:40000", 403},
+		{"trusted", "", "10.0.0.1", "10.0.0.1:40000", 403},
+		{"trusted", "alice", "10.0.0.1", "10.0.0.1:40000", 200},
+		// The agent forging the header: with no trusted_proxies, or from
+		// a peer that isn't one.
+		{"trusted", "alice", "", "127.0.0.1:40000", 403},
+		{"trusted", "alice", "10.0.0.1", "127.0.0.1:40000", 403},
+	} {
+		calls = nil
+		a := &agentService{authMode: tt.mode, control: control}
+		p := proxy.New("", a)
+		if tt.trusted != "" {
+			p.SetTrustedProxies([]netip.Prefix{netip.MustParsePrefix(tt.trusted + "/32")})
+		}
+		r := httptest.NewRequest("POST", "/agent/deploys/abcd1234/reject", nil)
+		r.RemoteAddr = tt.peer
+		if tt.user != "" {
+			r.Header.Set("X-SlotMachine-User", tt.user)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code != tt.code || (tt.code == 200) != (len(calls) == 1) {
+			t.Errorf("%s %q via %s (trusted %q): %d %s, calls %v", tt.mode, tt.user, tt.peer, tt.trusted, w.Code, w.Body, calls)
+		}
+	}
+}
+
+func TestChatCommands(t *testing.T) {
+	t.Parallel()
+	store, err := openAgentStore(filepath.Join(t.TempDir(), "agent.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	mgr := newAgentManager(store)
+	defer mgr.stop()
+
+	var calls []string
+	control := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		calls = append(calls, strings.TrimSpace(r.Method+" "+r.URL.RequestURI()+" "+string(body)))
+		switch r.URL.Path {
+		case "/deploy":
+			writeJSON(w, 200, engine.DeployResponse{HealthError: "process exited", LogTail: "panic: boom", Error: "health check failed"})
+		case "/rollback":
+			writeJSON(w, 200, engine.RollbackResponse{Success: true, Slot: "slot-aaaa1111", Commit: "aaaa1111ffff"})
+		case "/status":
+			writeJSON(w, 200, engine.StatusResponse{State: "live", LiveSlot: "slot-aaaa1111", LiveCommit: "aaaa1111ffff",
+				Upstream: &engine.UpstreamStatus{Ref: "origin/main", Behind: 2}})
+		case "/logs":
+			writeJSON(w, 200, engine.LogsResponse{Slot: "slot-aaaa1111", Lines: []string{"one", "two"}})
+		}
+	})
+	a := &agentService{store: store, manager: mgr, agentBin: "false", stagingDir: t.TempDir(), authMode: "none", control: control}
+	store.createConversation("conv-cmd", "test")
+
+	for _, tt := range []struct {
+		content, call, text, output string
+		ok                          bool
+	}{
+		{"/deploy bbbb2222", `POST /deploy {"commit":"bbbb2222"}`, "deploy of bbbb2222 failed its health check: process exited", "panic: boom", false},
+		{" /rollback ", `POST /rollback {"commit":""}`, "rolled back to aaaa1111 (slot-aaaa1111)", "", true},
+		{"/status", "GET /status", "live: aaaa1111 (slot-aaaa1111), 2 behind origin/main", "", true},
+		{"/logs 2", "GET /logs?lines=2", "last 2 lines of slot-aaaa1111", "one\ntwo", true},
+	} {
+		calls = nil
+		w := httptest.NewRecorder()
+		body, _ := json.Marshal(map[string]string{"content": tt.content})
+		a.handleSendMessage(w, httptest.NewRequest("POST", "/agent/conversations/conv-cmd/messages", bytes.NewReader(body)), "conv-cmd")
+		var res commandResult
+		json.Unmarshal(w.Body.Bytes(), &res)
+		if w.Code != 200 || res.OK != tt.ok || res.Text != tt.text || res.Output != tt.output || len(res.Result) == 0 {
+			t.Errorf("%q: %d %+v", tt.content, w.Code, res)
+		}
+		if len(calls) != 1 || calls[0] != tt.call {
+			t.Errorf("%q: called %q, want %q", tt.content, calls, tt.call)
+		}
+	}
+
+	msgs, _ := store.getMessages("conv-cmd", 0)
+	commands := 0
+	for _, m := range msgs {
+		if m.Type == "command" {
+			commands++
+		}
+	}
+	if commands != 4 {
+		t.Errorf("stored %d command messages, want 4: %+v", commands, msgs)
+	}
+	if mgr.getRunning("conv-cmd") != nil {
+		t.Error("a command started the agent")
+	}
+
+	if _, _, ok := parseCommand("/deployment notes"); ok {
+		t.Error("/deployment taken for /deploy")
+	}
+	if cmd, args, ok := parseCommand("/logs"); !ok || cmd != "logs" || args != "" {
+		t.Errorf("/logs = %q %q %v", cmd, args, ok)
+	}
+}
+
+func TestAgentGetsDaemonStatus(t *testing.T) {
+	t.Parallel()
+	control := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 200, engine.StatusResponse{State: "live", LiveSlot: "slot-aaaa1111", LiveCommit: "aaaa1111ffff", PreviousCommit: "bbbb2222ffff"})
+	})
+	a := &agentService{stagingDir: t.TempDir(), control: control, statusURL: "http://127.0.0.1:9100/status"}
+
+	if p := a.buildSystemPrompt(); !strings.Contains(p, "live: aaaa1111 (slot-aaaa1111), previous bbbb2222.") || !strings.Contains(p, "$SLOT_MACHINE_STATUS_URL") {
+		t.Errorf("prompt lacks the status:\n%s", p)
+	}
+	env := strings.Join(a.buildAgentEnv(), "\n")
+	for _, want := range []string{"SLOT_MACHINE_LIVE_COMMIT=aaaa1111ffff", "SLOT_MACHINE_STATUS_URL=http://127.0.0.1:9100/status"} {
+		if !strings.Contains(env, want) {
+			t.Errorf("env lacks %s: %s", want, env)
+		}
+	}
+
+	// Without the daemon API, there's nothing to tell.
+	a.control = nil
+	if p := a.buildSystemPrompt(); strings.Contains(p, "Current state") {
+		t.Errorf("prompt has a status without the daemon API:\n%s", p)
+	}
+	if env := strings.Join(a.buildAgentEnv(), "\n"); strings.Contains(env, "SLOT_MACHINE_LIVE_COMMIT") {
+		t.Errorf("env has a live commit without the daemon API: %s", env)
+	}
+}
+
+func TestDeployKeygen(t *testing.T) {
+	t.Parallel()
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("no ssh-keygen")
+	}
+	path := filepath.Join(t.TempDir(), "data", engine.DeployKeyName)
+	pub, created, err := deployKeygen(path, "slot-machine@test", false)
+	if err != nil || !created {
+		t.Fatalf("keygen: %v, created %v", err, created)
+	}
+	if !strings.HasPrefix(pub, "ssh-ed25519 ") || !strings.HasSuffix(pub, " slot-machine@test") {
+		t.Errorf("public key = %q", pub)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("private key: %v, %v", info, err)
+	}
+
+	// Run again, it prints the key it made; --force replaces it.
+	again, created, err := deployKeygen(path, "ignored", false)
+	if err != nil || created || !strings.HasPrefix(pub, again) {
+		t.Errorf("again: %q, created %v, %v", again, created, err)
+	}
+	if fresh, created, err := deployKeygen(path, "slot-machine@test", true); err != nil || !created || fresh == pub {
+		t.Errorf("force: %q, created %v, %v", fresh, created, err)
+	}
+
+	if got := engine.DeployKey(engine.Config{}, "/repo", filepath.Dir(path)); got != path {
+		t.Errorf("DeployKey = %q, want the generated key", got)
+	}
+	if got := engine.DeployKey(engine.Config{DeployKeyFile: "keys/id"}, "/repo", filepath.Dir(path)); got != "/repo/keys/id" {
+		t.Errorf("DeployKey with deploy_key_file = %q", got)
+	}
+
+	// The agent can't read it.
+	staging := t.TempDir()
+	a := &agentService{stagingDir: staging, dataDir: filepath.Dir(path), configPath: filepath.Join(staging, "slot-machine.json")}
+	a.generateDenySettings()
+	settings, _ := os.ReadFile(filepath.Join(staging, ".claude", "settings.json"))
+	if !strings.Contains(string(settings), "Read("+path+"*)") {
+		t.Errorf("settings do not deny reading the deploy key:\n%s", settings)
+	}
+}
+
+func TestFormatEvent(t *testing.T) {
+	at := time.Date(2026, 1, 2, 10, 4, 5, 0, time.Local).Format(time.RFC3339)
+	for _, tc := range []struct {
+		typ, data, want string
+	}{
+		{"deploy_started", ``, "10:04:05  deploy_started      aaaa1111  slot-aaaa1111"},
+		{"deploy_progress", `{"phase":"setup","message":"running setup"}`, "setup: running setup"},
+		{"deploy_finished", `{"success":true,"duration_ms":4200}`, "ok in 4.2s"},
+		{"rollback_finished", `{"success":false,"error":"no previous slot","duration_ms":10}`, "failed in 0.0s: no previous slot"},
+		{"health", `{"status":"unhealthy","error":"connection refused"}`, "unhealthy: connection refused"},
+		{"slot_crashed", `{"restart_in_ms":2000}`, "restarting in 2.0s"},
+		{"locked", `{"reason":"freeze","since":"x"}`, "freeze"},
+		{"agent_finished", `{"conversation":"c1","status":"idle"}`, "conversation c1 idle"},
+		{"journaled", `{"action":"rollback","commit":"aaaa1111"}`, "rollback"},
+		{"health_failure", `{"commit":"aaaa1111","error":"timed out","log":"..."}`, "timed out"},
+	} {
+		line := formatEvent(client.DaemonEvent{ID: 1, Time: at, Type: tc.typ, Commit: "aaaa1111bbbb", Slot: "slot-aaaa1111", Data: json.RawMessage(tc.data)})
+		if !strings.HasSuffix(line, tc.want) {
+			t.Errorf("%s: %q, want it to end with %q", tc.typ, line, tc.want)
+		}
+	}
+}
+
+func TestNewChaos(t *testing.T) {
+	if c, err := newChaos(false, time.Second, 0); c != nil || err != nil {
+		t.Errorf("without --chaos: %v, %v", c, err)
+	}
+
+	t.Setenv(chaosEnv, "")
+	if _, err := newChaos(true, time.Second, 1); err == nil || !strings.Contains(err.Error(), chaosEnv) {
+		t.Errorf("without %s: err = %v", chaosEnv, err)
+	}
+
+	t.Setenv(chaosEnv, "1")
+	if _, err := newChaos(true, 0, 1); err == nil {
+		t.Error("zero --chaos-max-delay was accepted")
+	}
+	if c, err := newChaos(true, time.Second, 1); c == nil || err != nil {
+		t.Errorf("with %s=1: %v, %v", chaosEnv, c, err)
+	}
+}
+
+func TestFormatExpose(t *testing.T) {
+	for _, tc := range []struct {
+		e    client.Expose
+		want string
+	}{
+		{client.Expose{Provider: "cloudflared", Running: true, URL: "https://a-b.trycloudflare.com"}, "public:   https://a-b.trycloudflare.com  (cloudflared)"},
+		{client.Expose{Provider: "ngrok", Running: true, Restarts: 2}, "public:   waiting for the tunnel's URL  (ngrok, restarted 2 times)"},
+		{client.Expose{Provider: "ngrok", Error: "exit status 1"}, "public:   tunnel down: exit status 1  (ngrok)"},
+	} {
+		if got := formatExpose(&tc.e); got != tc.want {
+			t.Errorf("formatExpose(%+v) = %q, want %q", tc.e, got, tc.want)
+		}
+	}
+}
+
+func TestReadProcfile(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	p := filepath.Join(dir, "Procfile")
+	os.WriteFile(p, []byte("# processes\nweb: bundle exec puma -p $PORT\n\nworker:   bundle exec sidekiq\nrelease: bin/rails db:migrate\n"), 0644)
+	procs, err := readProcfile(p)
+	want := []procfileEntry{
+		{"web", "bundle exec puma -p $PORT"},
+		{"worker", "bundle exec sidekiq"},
+		{"release", "bin/rails db:migrate"},
+	}
+	if err != nil || !slices.Equal(procs, want) {
+		t.Fatalf("readProcfile = %v, %v; want %v", procs, err, want)
+	}
+
+	os.WriteFile(p, []byte("web: node server.js\nnot a process\n"), 0644)
+	if procs, err := readProcfile(p); err == nil || len(procs) != 1 {
+		t.Errorf("readProcfile of a bad line = %v, %v", procs, err)
+	}
+}
+
+func TestReadDockerfileCmd(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	p := filepath.Join(dir, "Dockerfile")
+	for dockerfile, want := range map[string]string{
+		"FROM node:22\nCMD node server.js\n":                                     "node server.js",
+		"FROM node:22\nCMD [\"node\", \"server.js\"]\n":                          "node server.js",
+		"FROM python:3\nCMD [\"gunicorn\", \"-b\", \"0.0.0.0:$PORT app:app\"]\n": "gunicorn -b '0.0.0.0:$PORT app:app'",
+		"FROM ruby\nCMD [\"sh\", \"-c\", \"bin/server -p $PORT\"]\n":             "bin/server -p $PORT",
+		"FROM ruby\ncmd echo first\nCMD echo last\n":                             "echo last",
+	} {
+		os.WriteFile(p, []byte(dockerfile), 0644)
+		if got, err := readDockerfileCmd(p); err != nil || got != want {
+			t.Errorf("readDockerfileCmd(%q) = %q, %v; want %q", dockerfile, got, err, want)
+		}
+	}
+	os.WriteFile(p, []byte("FROM scratch\n"), 0644)
+	if _, err := readDockerfileCmd(p); err == nil {
+		t.Error("readDockerfileCmd without a CMD: no error")
+	}
+}
+
+func TestVerifyInit(t *testing.T) {
+	t.Parallel()
+	repo := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t", "GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	git("init", "-q", "-b", "main")
+	os.WriteFile(filepath.Join(repo, "app.txt"), []byte("committed\n"), 0644)
+	git("add", ".")
+	git("commit", "-q", "-m", "one")
+
+	for name, tc := range map[string]struct {
+		cfg  engine.Config
+		want string
+	}{
+		"setup fails": {
+			engine.Config{SetupCommand: "echo installing; echo no such package >&2; exit 3", StartCommand: "true"},
+			"no such package",
+		},
+		"setup runs in HEAD": {
+			engine.Config{SetupCommand: "grep -q committed app.txt && exit 4", StartCommand: "true"},
+			"exit status 4",
+		},
+		"start exits": {
+			engine.Config{StartCommand: "echo cannot find module; exit 1", HealthEndpoint: "/healthz", HealthTimeoutMs: 5000},
+			"start_command exited (exit status 1)",
+		},
+		"never healthy": {
+			engine.Config{StartCommand: "sleep 30", HealthEndpoint: "/healthz", HealthTimeoutMs: 300},
+			"never answered 200",
+		},
+		"no start command": {engine.Config{}, "no start_command"},
+	} {
+		err := verifyInit(repo, tc.cfg)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: verifyInit = %v, want %q", name, err, tc.want)
+		}
+	}
+	if out, _ := exec.Command("git", "-C", repo, "worktree", "list").Output(); strings.Count(string(out), "\n") != 1 {
+		t.Errorf("worktrees left behind:\n%s", out)
+	}
+}
+
+func TestWebPush(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	store, err := openAgentStore(filepath.Join(dir, "agent.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	p, err := newWebPusher(store, dir, "mailto:ops@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := newWebPusher(store, dir, ""); err != nil || again.publicKey() != p.publicKey() {
+		t.Fatalf("the VAPID key wasn't kept: %v", err)
+	}
+	p.app = func() string { return "myapp" }
+	a := &agentService{store: store, authMode: "trusted", pusher: p}
+
+	w := httptest.NewRecorder()
+	a.handleChatConfig(w, httptest.NewRequest("GET", "/chat/config", nil))
+	var cfg map[string]any
+	json.Unmarshal(w.Body.Bytes(), &cfg)
+	if cfg["vapidPublicKey"] != p.publicKey() {
+		t.Errorf("chat config = %v", cfg)
+	}
+
+	// A browser's subscription.
+	browserKey, _ := ecdh.P256().GenerateKey(rand.Reader)
+	auth := make([]byte, 16)
+	rand.Read(auth)
+	subscribe := func(method, user, endpoint string) int {
+		body, _ := json.Marshal(map[string]any{"endpoint": endpoint, "keys": map[string]string{
+			"p256dh": base64.RawURLEncoding.EncodeToString(browserKey.PublicKey().Bytes()),
+			"auth":   base64.RawURLEncoding.EncodeToString(auth),
+		}})
+		r := httptest.NewRequest(method, "/chat/push-subscriptions", bytes.NewReader(body))
+		r.Header.Set("X-SlotMachine-User", user)
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := subscribe("POST", "alice", "http://push.example.com/x"); code != 400 {
+		t.Errorf("subscribe with an http endpoint: %d", code)
+	}
+	if code := subscribe("POST", "alice", "https://push.example.com/x"); code != 201 {
+		t.Fatalf("subscribe: %d", code)
+	}
+	if code := subscribe("DELETE", "bob", "https://push.example.com/x"); code != 404 {
+		t.Fatalf("unsubscribe someone else's: %d", code)
+	}
+	if code := subscribe("DELETE", "alice", "https://push.example.com/x"); code != 200 {
+		t.Fatalf("unsubscribe: %d", code)
+	}
+	if subs, _ := store.pushSubscriptions(""); len(subs) != 0 {
+		t.Fatalf("subscriptions after unsubscribing: %v", subs)
+	}
+
+	pushes := make(chan *http.Request, 4)
+	bodies := make(chan []byte, 4)
+	var status atomic.Int32
+	status.Store(201)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		pushes <- r
+		bodies <- body
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer srv.Close()
+	var sub pushSubscription
+	sub.Endpoint = srv.URL + "/push/alice"
+	sub.Keys.P256dh = base64.RawURLEncoding.EncodeToString(browserKey.PublicKey().Bytes())
+	sub.Keys.Auth = base64.RawURLEncoding.EncodeToString(auth)
+	store.addPushSubscription(sub, "alice")
+
+	// receive decrypts the next push as the browser would, after checking
+	// its VAPID signature.
+	receive := func() pushNotification {
+		t.Helper()
+		var r *http.Request
+		select {
+		case r = <-pushes:
+		case <-time.After(5 * time.Second):
+			t.Fatal("nothing pushed")
+		}
+		body := <-bodies
+		if r.Header.Get("Content-Encoding") != "aes128gcm" || r.Header.Get("TTL") == "" {
+			t.Errorf("push headers = %v", r.Header)
+		}
+		var token, key string
+		fmt.Sscanf(strings.ReplaceAll(r.Header.Get("Authorization"), ",", ""), "vapid t=%s k=%s", &token, &key)
+		token, key = strings.TrimPrefix(token, "t="), strings.TrimPrefix(key, "k=")
+		if key != p.publicKey() {
+			t.Errorf("k = %q", key)
+		}
+		parts := strings.Split(token, ".")
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[len(parts)-1])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if len(sig) != 64 || !ecdsa.Verify(&p.key.PublicKey, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			t.Fatal("bad VAPID signature")
+		}
+		var claims struct{ Aud, Sub string }
+		claimsJSON, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		json.Unmarshal(claimsJSON, &claims)
+		if claims.Aud != srv.URL || claims.Sub != "mailto:ops@example.com" {
+			t.Errorf("claims = %+v", claims)
+		}
+
+		salt, idLen := body[:16], int(body[20])
+		serverPub, _ := ecdh.P256().NewPublicKey(body[21 : 21+idLen])
+		secret, _ := browserKey.ECDH(serverPub)
+		prkKey, _ := hkdf.Extract(sha256.New, secret, auth)
+		ikm, _ := hkdf.Expand(sha256.New, prkKey, "WebPush: info\x00"+string(browserKey.PublicKey().Bytes())+string(serverPub.Bytes()), 32)
+		prk, _ := hkdf.Extract(sha256.New, ikm, salt)
+		cek, _ := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+		nonce, _ := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+		block, _ := aes.NewCipher(cek)
+		gcm, _ := cipher.NewGCM(block)
+		plain, err := gcm.Open(nil, nonce, body[21+idLen:], nil)
+		if err != nil || plain[len(plain)-1] != 2 {
+			t.Fatalf("decrypting the push: %v", err)
+		}
+		var n pushNotification
+		json.Unmarshal(plain[:len(plain)-1], &n)
+		return n
+	}
+
+	p.pushEvent(engine.DaemonEvent{Type: engine.EventDeployFinished, Commit: "abcdef1234567", Data: engine.EventOutcome{Error: "health check failed"}})
+	if n := receive(); n.Title != "myapp: deploy of abcdef12 failed" || n.Body != "health check failed" {
+		t.Errorf("deploy notification = %+v", n)
+	}
+
+	// Agent runs are pushed to the conversation's user only.
+	store.createConversation("bob-conv", "bob")
+	store.createConversation("alice-conv", "alice")
+	store.updateTitle("alice-conv", "Fix the login page")
+	p.pushEvent(engine.DaemonEvent{Type: "agent_finished", Data: agentRunEvent{Conversation: "bob-conv", Status: "idle"}})
+	p.pushEvent(engine.DaemonEvent{Type: "agent_finished", Data: agentRunEvent{Conversation: "alice-conv", Status: "idle"}})
+	if n := receive(); n.Tag != "agent-alice-conv" || n.Body != "Fix the login page" {
+		t.Errorf("agent notification = %+v", n)
+	}
+
+	// A subscription the push service says is gone is dropped.
+	status.Store(410)
+	p.pushEvent(engine.DaemonEvent{Type: engine.EventRollbackFinished, Commit: "abcdef1234567", Data: engine.EventOutcome{Success: true}})
+	receive()
+	for range 50 {
+		if subs, _ := store.pushSubscriptions(""); len(subs) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("a gone subscription was kept")
+}
+
+func TestShareLinks(t *testing.T) {
+	t.Parallel()
+	store, err := openAgentStore(filepath.Join(t.TempDir(), "agent.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	a := &agentService{store: store, authMode: "hmac", authSecret: "s3cret"}
+	conv, err := store.createConversation("c1", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.addMessage(conv.ID, "user", "why is <b>deploy</b> slow?")
+	store.addMessage(conv.ID, "assistant", `{"content":"Setup.","html":"<p>Setup runs <code>npm ci</code>.</p>"}`)
+	store.addMessage(conv.ID, "tool_use", `{"id":"t1","tool":"Bash","input":{}}`)
+	store.addMessage(conv.ID, "tool_result", `{"id":"t1","output":"added 812 packages"}`)
+
+	share := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.handleShare(w, httptest.NewRequest("POST", "/agent/conversations/c1/share", strings.NewReader(body)), "c1")
+		return w
+	}
+	w := share(`{}`)
+	var resp shareResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != 200 || !strings.HasPrefix(resp.Path, "/chat/shared/") {
+		t.Fatalf("share: %d %s", w.Code, w.Body)
+	}
+
+	// Anyone with the link reads it, without signing in.
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest("GET", resp.Path, nil))
+	body := w.Body.String()
+	if w.Code != 200 {
+		t.Fatalf("GET %s: %d %s", resp.Path, w.Code, body)
+	}
+	for _, want := range []string{"why is &lt;b&gt;deploy&lt;/b&gt; slow?", "<p>Setup runs <code>npm ci</code>.</p>", "Bash", "added 812 packages"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("transcript lacks %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "<textarea") {
+		t.Error("a shared transcript has a send box")
+	}
+
+	token := strings.TrimPrefix(resp.Path, "/chat/shared/")
+	if a.sharedConversation(token, time.Now().Add(defaultShareTTL+time.Minute)) != "" {
+		t.Error("an expired link still works")
+	}
+	for _, bad := range []string{strings.Replace(token, "c1.", "c2.", 1), token[:len(token)-2] + "AA", "c1"} {
+		w = httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", "/chat/shared/"+bad, nil))
+		if w.Code != 404 {
+			t.Errorf("GET /chat/shared/%s: %d", bad, w.Code)
+		}
+	}
+
+	if w := share(`{"ttl_ms": 8000000000}`); w.Code != 400 {
+		t.Errorf("share for 92 days: %d %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	a.handleShare(w, httptest.NewRequest("POST", "/agent/conversations/nope/share", nil), "nope")
+	if w.Code != 404 {
+		t.Errorf("share of a missing conversation: %d", w.Code)
+	}
+
+}
+
+func TestAgentModel(t *testing.T) {
+	t.Parallel()
+	rules := []engine.ModelRule{{Model: "haiku", MaxMessages: 1}, {Model: "opus", Match: `\brefactor`}}
+	if err := engine.CheckModelRules(engine.Config{AgentModelRules: rules}); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []engine.ModelRule{{Match: "x"}, {Model: "m", MaxMessages: -1}, {Model: "m", Match: "("}} {
+		if engine.CheckModelRules(engine.Config{AgentModelRules: []engine.ModelRule{bad}}) == nil {
+			t.Errorf("rule %+v passed", bad)
+		}
+	}
+	a := &agentService{model: "sonnet", modelRules: compileModelRules(rules)}
+	for _, tc := range []struct {
+		n    int
+		msg  string
+		want string
+	}{{1, "Refactor it", "haiku"}, {2, "Please REFACTOR the proxy", "opus"}, {2, "refactoring", "opus"}, {3, "why?", "sonnet"}} {
+		if got := a.modelFor(tc.n, tc.msg); got != tc.want {
+			t.Errorf("modelFor(%d, %q) = %q, want %q", tc.n, tc.msg, got, tc.want)
+		}
+	}
+	if got := (&agentService{}).modelFor(1, "hi"); got != "" {
+		t.Errorf("modelFor without a config = %q", got)
+	}
+
+	// The model goes to claude, and the one it reports is kept with the run.
+	dir := t.TempDir()
+	store, err := openAgentStore(filepath.Join(dir, "agent.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	mgr := newAgentManager(store)
+	defer mgr.stop()
+	bin := filepath.Join(dir, "claude")
+	args := filepath.Join(dir, "args")
+	os.WriteFile(bin, []byte(`#!/bin/sh
+echo "$@" > '`+args+`'
+echo '{"type":"system","subtype":"init","session_id":"s1","model":"claude-haiku-9"}'
+echo '{"type":"result","result":"ok","usage":{"input_tokens":5,"output_tokens":1}}'
+`), 0755)
+	a.store, a.manager, a.agentBin, a.authMode = store, mgr, bin, "none"
+	a.stagingDir, a.dataDir, a.configPath = dir, dir, filepath.Join(dir, "slot-machine.json")
+	store.createConversation("c1", "alice")
+	w := httptest.NewRecorder()
+	a.handleSendMessage(w, httptest.NewRequest("POST", "/agent/conversations/c1/messages", strings.NewReader(`{"content":"hi"}`)), "c1")
+	if w.Code != 200 {
+		t.Fatalf("send: %d %s", w.Code, w.Body)
+	}
+	var done string
+	for deadline := time.Now().Add(5 * time.Second); done == "" && time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		msgs, _ := store.getMessages("c1", 0)
+		for _, m := range msgs {
+			if m.Type == "done" {
+				done = m.Content
+			}
+		}
+	}
+	if !strings.Contains(done, `"model":"claude-haiku-9"`) {
+		t.Errorf("done event = %s", done)
+	}
+	if b, _ := os.ReadFile(args); !strings.Contains(string(b), "--model haiku") {
+		t.Errorf("claude args = %s", b)
+	}
+	rep, err := a.usage("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Models) != 1 || rep.Models[0].Model != "claude-haiku-9" || rep.Models[0].Runs != 1 {
+		t.Errorf("usage by model = %+v", rep.Models)
+	}
 }
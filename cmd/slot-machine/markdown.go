@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Agent output is untrusted: it can repeat anything it read, including
+// HTML. renderMarkdown turns the markdown the agent writes into HTML built
+// only from escaped text and a fixed set of tags, so the chat UI can insert
+// it as is. It covers what the agent uses: paragraphs, headings, fenced
+// code blocks (the language goes in a language-* class), lists, tables,
+// inline code, bold, italics, and links, which must be http(s), mailto, or
+// relative.
+
+var (
+	headingRe   = regexp.MustCompile(`^(#{1,4})\s+(.+)$`)
+	ulItemRe    = regexp.MustCompile(`^[-*]\s+(.+)$`)
+	olItemRe    = regexp.MustCompile(`^\d+\.\s+(.+)$`)
+	tableSepRe  = regexp.MustCompile(`^\|[\s\-:|]+\|$`)
+	fenceLangRe = regexp.MustCompile(`^[A-Za-z0-9_+#.-]+$`)
+	linkRe      = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	boldRe      = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	italicRe    = regexp.MustCompile(`\*(.+?)\*`)
+	placeholder = regexp.MustCompile("\x00(\\d+)\x00")
+)
+
+func renderMarkdown(src string) string {
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	var b strings.Builder
+	var para []string
+	flush := func() {
+		if len(para) > 0 {
+			b.WriteString("<p>" + strings.Join(para, "<br>") + "</p>")
+			para = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(trimmed, "```"):
+			flush()
+			lang := strings.TrimSpace(strings.TrimPrefix(trimmed, "```"))
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			b.WriteString("<pre><code")
+			if fenceLangRe.MatchString(lang) {
+				b.WriteString(` class="language-` + html.EscapeString(lang) + `"`)
+			}
+			b.WriteString(">" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>")
+
+		case trimmed == "":
+			flush()
+
+		case headingRe.MatchString(trimmed):
+			flush()
+			m := headingRe.FindStringSubmatch(trimmed)
+			fmt.Fprintf(&b, "<h%d>%s</h%d>", len(m[1]), renderInline(m[2]), len(m[1]))
+
+		case strings.HasPrefix(trimmed, "|") && i+1 < len(lines) && tableSepRe.MatchString(strings.TrimSpace(lines[i+1])):
+			flush()
+			b.WriteString("<table><thead><tr>")
+			for _, c := range tableCells(trimmed) {
+				b.WriteString("<th>" + renderInline(c) + "</th>")
+			}
+			b.WriteString("</tr></thead><tbody>")
+			for i += 2; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), "|"); i++ {
+				b.WriteString("<tr>")
+				for _, c := range tableCells(strings.TrimSpace(lines[i])) {
+					b.WriteString("<td>" + renderInline(c) + "</td>")
+				}
+				b.WriteString("</tr>")
+			}
+			i--
+			b.WriteString("</tbody></table>")
+
+		case ulItemRe.MatchString(trimmed), olItemRe.MatchString(trimmed):
+			flush()
+			item, tag := ulItemRe, "ul"
+			if !ulItemRe.MatchString(trimmed) {
+				item, tag = olItemRe, "ol"
+			}
+			b.WriteString("<" + tag + ">")
+			for ; i < len(lines) && item.MatchString(strings.TrimSpace(lines[i])); i++ {
+				m := item.FindStringSubmatch(strings.TrimSpace(lines[i]))
+				b.WriteString("<li>" + renderInline(m[1]) + "</li>")
+			}
+			i--
+			b.WriteString("</" + tag + ">")
+
+		default:
+			para = append(para, renderInline(line))
+		}
+	}
+	flush()
+	return b.String()
+}
+
+// tableCells splits a "| a | b |" row.
+func tableCells(row string) []string {
+	row = strings.TrimSuffix(strings.TrimPrefix(row, "|"), "|")
+	cells := strings.Split(row, "|")
+	for i, c := range cells {
+		cells[i] = strings.TrimSpace(c)
+	}
+	return cells
+}
+
+// renderInline escapes s and renders its code spans, links, bold, and
+// italics. Code spans and links are set aside first so the emphasis
+// patterns can't reach into them.
+func renderInline(s string) string {
+	var held []string
+	hold := func(h string) string {
+		held = append(held, h)
+		return fmt.Sprintf("\x00%d\x00", len(held)-1)
+	}
+
+	var b strings.Builder
+	s = strings.ReplaceAll(s, "\x00", "")
+	ticks := strings.Count(s, "`")
+	for i, part := range strings.Split(s, "`") {
+		// Odd parts are between backticks, unless the last one is unclosed.
+		switch {
+		case i%2 == 1 && i < ticks:
+			b.WriteString(hold("<code>" + html.EscapeString(part) + "</code>"))
+		case i%2 == 1:
+			b.WriteString("`" + html.EscapeString(part))
+		default:
+			b.WriteString(html.EscapeString(part))
+		}
+	}
+	out := b.String()
+
+	out = linkRe.ReplaceAllStringFunc(out, func(m string) string {
+		sub := linkRe.FindStringSubmatch(m)
+		href := html.UnescapeString(sub[2])
+		if !safeURL(href) {
+			return m
+		}
+		return hold(`<a href="` + html.EscapeString(href) + `" target="_blank" rel="noopener noreferrer">` + emphasis(sub[1]) + "</a>")
+	})
+	out = emphasis(out)
+
+	// Twice at most: a held link may contain a held code span.
+	for strings.Contains(out, "\x00") {
+		out = placeholder.ReplaceAllStringFunc(out, func(m string) string {
+			var n int
+			fmt.Sscanf(strings.Trim(m, "\x00"), "%d", &n)
+			return held[n]
+		})
+	}
+	return out
+}
+
+func emphasis(s string) string {
+	s = boldRe.ReplaceAllString(s, "<strong>$1</strong>")
+	return italicRe.ReplaceAllString(s, "<em>$1</em>")
+}
+
+// safeURL allows links that can't run script: http, https, mailto, and
+// scheme-less (relative) URLs.
+func safeURL(href string) bool {
+	u, err := url.Parse(href)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto":
+		return true
+	}
+	return false
+}
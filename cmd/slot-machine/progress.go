@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"slot-machine/pkg/client"
+)
+
+// progressPrinter shows a deploy's steps as the daemon streams them: one
+// line per phase with the time since the deploy started, and setup output
+// indented under it. On a terminal, failed health polls rewrite a single
+// line; elsewhere only the first and every tenth are printed.
+type progressPrinter struct {
+	w       io.Writer
+	tty     bool
+	polling bool // the last line is a health poll, not yet ended
+}
+
+func newProgressPrinter(f *os.File) *progressPrinter {
+	info, err := f.Stat()
+	return &progressPrinter{w: f, tty: err == nil && info.Mode()&os.ModeCharDevice != 0}
+}
+
+func (p *progressPrinter) print(ev client.Progress) {
+	elapsed := fmt.Sprintf("%6.1fs", float64(ev.ElapsedMs)/1000)
+	switch {
+	case ev.Line != "":
+		p.done()
+		fmt.Fprintf(p.w, "%s  %-8s | %s\n", elapsed, "", ev.Line)
+	case ev.Attempt > 0:
+		msg := fmt.Sprintf("%s  %-8s attempt %d: %s", elapsed, ev.Phase, ev.Attempt, ev.Message)
+		if p.tty {
+			fmt.Fprintf(p.w, "\r\033[K%s", msg)
+			p.polling = true
+		} else if ev.Attempt == 1 || ev.Attempt%10 == 0 {
+			fmt.Fprintln(p.w, msg)
+		}
+	default:
+		p.done()
+		fmt.Fprintf(p.w, "%s  %-8s %s\n", elapsed, ev.Phase, ev.Message)
+	}
+}
+
+// done ends a health poll line left open on a terminal.
+func (p *progressPrinter) done() {
+	if p.polling {
+		fmt.Fprintln(p.w)
+		p.polling = false
+	}
+}
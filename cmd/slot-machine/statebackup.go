@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"slot-machine/internal/engine"
+)
+
+// Losing the server loses the journal and the agent's conversations with
+// it, unless a backup was copied off it. With state_backup, the daemon
+// writes a backup every interval_sec and PUTs it to S3-compatible storage
+// (AWS S3, R2, MinIO, ...), always to the same key: turn on the bucket's
+// versioning to keep older ones. `slot-machine restore --from s3://...`
+// fetches it back. Requests are signed with AWS Signature Version 4 and
+// use path-style URLs, which every S3-compatible service takes.
+
+const (
+	defaultStateBackupInterval = time.Hour
+	stateBackupTimeout         = 5 * time.Minute
+)
+
+// s3Object is one object in S3-compatible storage, with what it takes to
+// read and write it.
+type s3Object struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	key       string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// newS3Object returns the object cfg.URL names, with credentials from the
+// environment variables cfg names. A key ending in / gets <app>.tar.gz.
+func newS3Object(cfg engine.StateBackup, app string) (*s3Object, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("url must be s3://bucket/key, not %q", cfg.URL)
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if key == "" || strings.HasSuffix(key, "/") {
+		key += app + ".tar.gz"
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("endpoint must be an http(s) URL, not %q", cfg.Endpoint)
+	}
+	if cfg.AccessKeyEnv == "" {
+		cfg.AccessKeyEnv = "AWS_ACCESS_KEY_ID"
+	}
+	if cfg.SecretKeyEnv == "" {
+		cfg.SecretKeyEnv = "AWS_SECRET_ACCESS_KEY"
+	}
+	obj := &s3Object{
+		endpoint:  endpoint,
+		region:    cfg.Region,
+		bucket:    u.Host,
+		key:       key,
+		accessKey: os.Getenv(cfg.AccessKeyEnv),
+		secretKey: os.Getenv(cfg.SecretKeyEnv),
+		client:    &http.Client{Timeout: stateBackupTimeout},
+	}
+	if obj.accessKey == "" || obj.secretKey == "" {
+		return nil, fmt.Errorf("$%s and $%s must be set", cfg.AccessKeyEnv, cfg.SecretKeyEnv)
+	}
+	return obj, nil
+}
+
+func (s *s3Object) String() string {
+	return "s3://" + s.bucket + "/" + s.key
+}
+
+// put uploads data as the object.
+func (s *s3Object) put(data []byte) error {
+	resp, err := s.do("PUT", data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// get downloads the object.
+func (s *s3Object) get() ([]byte, error) {
+	resp, err := s.do("GET", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// do sends a signed request for the object, and returns the response if
+// it's a 2xx.
+func (s *s3Object) do(method string, body []byte) (*http.Response, error) {
+	path := strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + "/" + s3Escape(s.bucket) + "/" + s3Escape(s.key)
+	req, err := http.NewRequest(method, s.endpoint.Scheme+"://"+s.endpoint.Host+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, path, body, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, s, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, s, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// sign adds AWS Signature Version 4 headers to req, whose escaped path is
+// path.
+func (s *s3Object) sign(req *http.Request, path string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payload := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	const signed = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		"", // no query
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payload,
+		"x-amz-date:" + amzDate,
+		"",
+		signed,
+		payload,
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signed, signature))
+}
+
+// s3Escape percent-encodes everything in a path but unreserved characters
+// and /, as Signature Version 4 wants.
+func s3Escape(path string) string {
+	var b strings.Builder
+	for _, c := range []byte(path) {
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// stateExporter uploads a backup of the daemon's data dir every interval.
+type stateExporter struct {
+	obj      *s3Object
+	repo     string
+	dataDir  string
+	interval time.Duration
+}
+
+func newStateExporter(cfg engine.StateBackup, repo, dataDir string) (*stateExporter, error) {
+	obj, err := newS3Object(cfg, filepath.Base(repo))
+	if err != nil {
+		return nil, err
+	}
+	interval := defaultStateBackupInterval
+	if cfg.IntervalSec > 0 {
+		interval = time.Duration(cfg.IntervalSec) * time.Second
+	}
+	return &stateExporter{obj: obj, repo: repo, dataDir: dataDir, interval: interval}, nil
+}
+
+// run exports now and then every interval. It never returns.
+func (e *stateExporter) run() {
+	for {
+		if n, err := e.export(); err != nil {
+			fmt.Printf("warning: state backup: %v\n", err)
+		} else {
+			fmt.Printf("state backup: %d bytes to %s\n", n, e.obj)
+		}
+		time.Sleep(e.interval)
+	}
+}
+
+// export writes a backup and uploads it, and returns its size.
+func (e *stateExporter) export() (int, error) {
+	tmp := filepath.Join(os.TempDir(), fmt.Sprintf("slot-machine-backup-%d.tar.gz", os.Getpid()))
+	defer os.Remove(tmp)
+	if err := writeBackup(tmp, e.repo, e.dataDir); err != nil {
+		return 0, err
+	}
+	data, err := os.ReadFile(tmp)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), e.obj.put(data)
+}
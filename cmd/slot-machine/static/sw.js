@@ -0,0 +1,24 @@
+// The chat's service worker: it shows the daemon's push notifications, and
+// opens the chat when one is clicked.
+'use strict';
+
+self.addEventListener('push', function(e) {
+  var n = {};
+  try { n = e.data.json(); } catch (err) {}
+  e.waitUntil(self.registration.showNotification(n.title || 'slot-machine', {
+    body: n.body || '',
+    tag: n.tag || undefined
+  }));
+});
+
+self.addEventListener('notificationclick', function(e) {
+  e.notification.close();
+  // This worker is at <base>/chat/sw.js; the chat is <base>/chat.
+  var chat = new URL('../chat', self.location).href;
+  e.waitUntil(self.clients.matchAll({ type: 'window' }).then(function(list) {
+    for (var i = 0; i < list.length; i++) {
+      if (list[i].url.split('#')[0] === chat && 'focus' in list[i]) return list[i].focus();
+    }
+    return self.clients.openWindow(chat);
+  }));
+});
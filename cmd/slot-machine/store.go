@@ -2,14 +2,23 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 type agentStore struct {
 	db *sql.DB
+
+	writeErrors atomic.Int64 // messages that couldn't be stored, even after retrying
 }
 
 type conversationRow struct {
@@ -24,6 +33,14 @@ type conversationRow struct {
 	CreatedAt    string `json:"created_at"`
 	UpdatedAt    string `json:"updated_at"`
 	Status       string `json:"status"`
+
+	// AllowedTools overrides the agent's tools for this conversation; nil
+	// means the daemon-wide list.
+	AllowedTools []string `json:"allowed_tools"`
+
+	// QueuePosition is the conversation's place in the agent queue, 1 for
+	// next; 0 when it isn't waiting. Not stored.
+	QueuePosition int `json:"queue_position,omitempty"`
 }
 
 type messageRow struct {
@@ -35,7 +52,10 @@ type messageRow struct {
 }
 
 func openAgentStore(path string) (*agentStore, error) {
-	db, err := sql.Open("sqlite", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	// Writers wait up to busy_timeout for each other, and transactions take
+	// the write lock when they begin, so one never finds the database
+	// locked halfway through (see retryBusy).
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_txlock=immediate")
 	if err != nil {
 		return nil, err
 	}
@@ -61,6 +81,17 @@ func openAgentStore(path string) (*agentStore, error) {
 		created_at TEXT NOT NULL
 	);
 	CREATE INDEX IF NOT EXISTS idx_messages_conversation ON messages(conversation_id);
+	CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS push_subscriptions (
+		endpoint TEXT PRIMARY KEY,
+		p256dh TEXT NOT NULL,
+		auth TEXT NOT NULL,
+		user TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL
+	);
 	`
 	if _, err := db.Exec(schema); err != nil {
 		db.Close()
@@ -69,12 +100,155 @@ func openAgentStore(path string) (*agentStore, error) {
 
 	// Migration: add status column if missing (idempotent).
 	db.Exec(`ALTER TABLE conversations ADD COLUMN status TEXT NOT NULL DEFAULT 'idle'`)
+	// Migration: per-conversation tool list, JSON; '' for none.
+	db.Exec(`ALTER TABLE conversations ADD COLUMN allowed_tools TEXT NOT NULL DEFAULT ''`)
+
+	if err := initSearch(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("search index: %w", err)
+	}
+	if err := initUsage(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("usage table: %w", err)
+	}
 
 	return &agentStore{db: db}, nil
 }
 
+// searchText is the SQL for the searchable text of message row t: what the
+// user wrote, or the text of the agent's answer.
+func searchText(t string) string {
+	return `CASE WHEN ` + t + `.type = 'assistant' AND json_valid(` + t + `.content)
+		THEN json_extract(` + t + `.content, '$.content') ELSE ` + t + `.content END`
+}
+
+// initSearch creates the full-text index over user and assistant messages,
+// and the triggers keeping it in sync, the first time the store is opened,
+// indexing the messages already there.
+func initSearch(db *sql.DB) error {
+	var exists int
+	db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'messages_fts'`).Scan(&exists)
+	if exists > 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		`CREATE VIRTUAL TABLE messages_fts USING fts5(text)`,
+		`CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages
+		 WHEN new.type IN ('user', 'assistant') BEGIN
+			INSERT INTO messages_fts (rowid, text) VALUES (new.id, ` + searchText("new") + `);
+		 END`,
+		`CREATE TRIGGER messages_fts_delete AFTER DELETE ON messages BEGIN
+			DELETE FROM messages_fts WHERE rowid = old.id;
+		 END`,
+		`INSERT INTO messages_fts (rowid, text)
+		 SELECT id, ` + searchText("messages") + ` FROM messages WHERE type IN ('user', 'assistant')`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// initUsage creates the usage table, one row per agent run, the first time
+// the store is opened, filling it from the done events already stored. Rows
+// outlive their conversation, so deleting one doesn't rewrite the totals.
+func initUsage(db *sql.DB) error {
+	var exists int
+	db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'usage'`).Scan(&exists)
+	if exists > 0 {
+		// Migration: the model of each run; '' where it isn't known.
+		db.Exec(`ALTER TABLE usage ADD COLUMN model TEXT NOT NULL DEFAULT ''`)
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		`CREATE TABLE usage (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			conversation_id TEXT NOT NULL,
+			user TEXT NOT NULL DEFAULT '',
+			model TEXT NOT NULL DEFAULT '',
+			input_tokens INTEGER NOT NULL DEFAULT 0,
+			output_tokens INTEGER NOT NULL DEFAULT 0,
+			cache_read INTEGER NOT NULL DEFAULT 0,
+			cache_write INTEGER NOT NULL DEFAULT 0,
+			created_at TEXT NOT NULL
+		)`,
+		`CREATE INDEX idx_usage_created ON usage(created_at)`,
+		`INSERT INTO usage (conversation_id, user, input_tokens, output_tokens, cache_read, cache_write, created_at)
+		 SELECT m.conversation_id, coalesce(c.user, ''),
+			coalesce(json_extract(m.content, '$.usage.input_tokens'), 0),
+			coalesce(json_extract(m.content, '$.usage.output_tokens'), 0),
+			coalesce(json_extract(m.content, '$.usage.cache_read_input_tokens'), 0),
+			coalesce(json_extract(m.content, '$.usage.cache_creation_input_tokens'), 0),
+			m.created_at
+		 FROM messages m LEFT JOIN conversations c ON c.id = m.conversation_id
+		 WHERE m.type = 'done' AND json_valid(m.content)`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func (s *agentStore) close() error { return s.db.Close() }
 
+// A write that finds the database busy, past busy_timeout, is tried again
+// storeRetries more times, waiting storeRetryWait, then twice as long each
+// time.
+const (
+	storeRetries   = 4
+	storeRetryWait = 50 * time.Millisecond
+)
+
+// retryBusy runs fn until it doesn't fail with SQLITE_BUSY or SQLITE_LOCKED,
+// or it has been retried storeRetries times.
+func retryBusy(fn func() error) error {
+	wait := storeRetryWait
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || i == storeRetries || !isBusy(err) {
+			return err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// isBusy reports whether err is SQLite finding the database locked by
+// another connection.
+func isBusy(err error) bool {
+	var se *sqlite.Error
+	if !errors.As(err, &se) {
+		return false
+	}
+	switch se.Code() & 0xff {
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return true
+	}
+	return false
+}
+
+// checkpoint copies the WAL into agent.db and truncates it. SSE streams
+// read all the time, and SQLite's own checkpoints can't finish while one
+// is reading, so the WAL grows until one does. busy is true if readers
+// kept this one from finishing too.
+func (s *agentStore) checkpoint() (busy bool, err error) {
+	var blocked, logPages, done int
+	err = s.db.QueryRow(`PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&blocked, &logPages, &done)
+	return blocked != 0, err
+}
+
 func (s *agentStore) createConversation(id, user string) (*conversationRow, error) {
 	now := time.Now().Format(time.RFC3339)
 	_, err := s.db.Exec(
@@ -89,22 +263,24 @@ func (s *agentStore) createConversation(id, user string) (*conversationRow, erro
 
 func (s *agentStore) getConversation(id string) (*conversationRow, error) {
 	row := s.db.QueryRow(
-		`SELECT id, title, session_id, user, input_tokens, output_tokens, cache_read, cache_write, created_at, updated_at, status
+		`SELECT id, title, session_id, user, input_tokens, output_tokens, cache_read, cache_write, created_at, updated_at, status, allowed_tools
 		 FROM conversations WHERE id = ?`, id,
 	)
 	var c conversationRow
+	var tools string
 	err := row.Scan(&c.ID, &c.Title, &c.SessionID, &c.User,
 		&c.InputTokens, &c.OutputTokens, &c.CacheRead, &c.CacheWrite,
-		&c.CreatedAt, &c.UpdatedAt, &c.Status)
+		&c.CreatedAt, &c.UpdatedAt, &c.Status, &tools)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
+	c.AllowedTools = decodeTools(tools)
 	return &c, err
 }
 
 func (s *agentStore) listConversations() ([]conversationRow, error) {
 	rows, err := s.db.Query(
-		`SELECT id, title, session_id, user, input_tokens, output_tokens, cache_read, cache_write, created_at, updated_at, status
+		`SELECT id, title, session_id, user, input_tokens, output_tokens, cache_read, cache_write, created_at, updated_at, status, allowed_tools
 		 FROM conversations ORDER BY updated_at DESC`,
 	)
 	if err != nil {
@@ -115,27 +291,78 @@ func (s *agentStore) listConversations() ([]conversationRow, error) {
 	var list []conversationRow
 	for rows.Next() {
 		var c conversationRow
+		var tools string
 		if err := rows.Scan(&c.ID, &c.Title, &c.SessionID, &c.User,
 			&c.InputTokens, &c.OutputTokens, &c.CacheRead, &c.CacheWrite,
-			&c.CreatedAt, &c.UpdatedAt, &c.Status); err != nil {
+			&c.CreatedAt, &c.UpdatedAt, &c.Status, &tools); err != nil {
 			return nil, err
 		}
+		c.AllowedTools = decodeTools(tools)
 		list = append(list, c)
 	}
 	return list, nil
 }
 
+// newMessage is a message for addMessages to store.
+type newMessage struct {
+	Type    string
+	Content string
+}
+
 func (s *agentStore) addMessage(conversationID, msgType, content string) (int64, error) {
-	now := time.Now().Format(time.RFC3339)
-	res, err := s.db.Exec(
-		`INSERT INTO messages (conversation_id, type, content, created_at) VALUES (?, ?, ?, ?)`,
-		conversationID, msgType, content, now,
-	)
+	ids, err := s.addMessages(conversationID, []newMessage{{msgType, content}})
 	if err != nil {
 		return 0, err
 	}
-	s.db.Exec(`UPDATE conversations SET updated_at = ? WHERE id = ?`, now, conversationID)
-	return res.LastInsertId()
+	return ids[0], nil
+}
+
+// addMessages stores messages in order and bumps their conversation's
+// updated_at, all in one transaction, retrying while the database is busy.
+// It returns their IDs; on error, none was stored.
+func (s *agentStore) addMessages(conversationID string, msgs []newMessage) ([]int64, error) {
+	now := time.Now().Format(time.RFC3339)
+	var ids []int64
+	err := retryBusy(func() error {
+		ids = ids[:0]
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		insert, err := tx.Prepare(`INSERT INTO messages (conversation_id, type, content, created_at) VALUES (?, ?, ?, ?)`)
+		if err != nil {
+			return err
+		}
+		defer insert.Close()
+		for _, m := range msgs {
+			res, err := insert.Exec(conversationID, m.Type, m.Content, now)
+			if err != nil {
+				return err
+			}
+			id, err := res.LastInsertId()
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		if _, err := tx.Exec(`UPDATE conversations SET updated_at = ? WHERE id = ?`, now, conversationID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		s.writeErrors.Add(int64(len(msgs)))
+		return nil, err
+	}
+	return ids, nil
+}
+
+// userMessageCount is how many messages the user sent in a conversation.
+func (s *agentStore) userMessageCount(conversationID string) int {
+	var n int
+	s.db.QueryRow(`SELECT count(*) FROM messages WHERE conversation_id = ? AND type = 'user'`, conversationID).Scan(&n)
+	return n
 }
 
 func (s *agentStore) getMessages(conversationID string, afterID int64) ([]messageRow, error) {
@@ -160,6 +387,46 @@ func (s *agentStore) getMessages(conversationID string, afterID int64) ([]messag
 	return list, nil
 }
 
+// messagePage returns up to limit messages of a conversation (0 for all),
+// oldest first: the first ones after afterID if it's set, or else the last
+// ones before beforeID (0 for the newest). more says whether there are
+// others past the page, in the direction it was read.
+func (s *agentStore) messagePage(conversationID string, afterID, beforeID int64, limit int) (msgs []messageRow, more bool, err error) {
+	order := "DESC"
+	if afterID > 0 {
+		order = "ASC"
+	}
+	n := -1 // no limit
+	if limit > 0 {
+		n = limit + 1
+	}
+	rows, err := s.db.Query(
+		`SELECT id, conversation_id, type, content, created_at
+		 FROM messages WHERE conversation_id = ? AND id > ? AND (? = 0 OR id < ?)
+		 ORDER BY id `+order+` LIMIT ?`,
+		conversationID, afterID, beforeID, beforeID, n,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m messageRow
+		if err := rows.Scan(&m.ID, &m.ConversationID, &m.Type, &m.Content, &m.CreatedAt); err != nil {
+			return nil, false, err
+		}
+		msgs = append(msgs, m)
+	}
+	if limit > 0 && len(msgs) > limit {
+		msgs, more = msgs[:limit], true
+	}
+	if order == "DESC" {
+		slices.Reverse(msgs)
+	}
+	return msgs, more, rows.Err()
+}
+
 func (s *agentStore) updateSessionID(id, sessionID string) error {
 	_, err := s.db.Exec(`UPDATE conversations SET session_id = ? WHERE id = ?`, sessionID, id)
 	return err
@@ -170,7 +437,7 @@ func (s *agentStore) updateTitle(id, title string) error {
 	return err
 }
 
-func (s *agentStore) addUsage(id string, input, output, cacheRead, cacheWrite int) error {
+func (s *agentStore) addUsage(id, model string, input, output, cacheRead, cacheWrite int) error {
 	_, err := s.db.Exec(
 		`UPDATE conversations SET
 			input_tokens = input_tokens + ?,
@@ -180,9 +447,84 @@ func (s *agentStore) addUsage(id string, input, output, cacheRead, cacheWrite in
 		 WHERE id = ?`,
 		input, output, cacheRead, cacheWrite, id,
 	)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO usage (conversation_id, user, model, input_tokens, output_tokens, cache_read, cache_write, created_at)
+		 SELECT id, user, ?, ?, ?, ?, ?, ? FROM conversations WHERE id = ?`,
+		model, input, output, cacheRead, cacheWrite, time.Now().Format(time.RFC3339), id,
+	)
 	return err
 }
 
+// usageTotals is token use summed over agent runs.
+type usageTotals struct {
+	Runs         int      `json:"runs"`
+	InputTokens  int      `json:"input_tokens"`
+	OutputTokens int      `json:"output_tokens"`
+	CacheRead    int      `json:"cache_read"`
+	CacheWrite   int      `json:"cache_write"`
+	CostUSD      *float64 `json:"cost_usd,omitempty"` // only with agent_prices
+}
+
+// usageGroup is the usage of one day, user, conversation, or model.
+type usageGroup struct {
+	Day            string `json:"day,omitempty"`
+	User           string `json:"user,omitempty"`
+	ConversationID string `json:"conversation_id,omitempty"`
+	Title          string `json:"title,omitempty"`
+	Model          string `json:"model,omitempty"` // "" for runs that didn't say
+	usageTotals
+}
+
+// usageSums is the SQL summing the usage table's columns into usageTotals.
+const usageSums = `count(*), coalesce(sum(u.input_tokens), 0), coalesce(sum(u.output_tokens), 0),
+	coalesce(sum(u.cache_read), 0), coalesce(sum(u.cache_write), 0)`
+
+// usageSince sums the runs since since (RFC 3339; "" for all), overall and
+// grouped by key: "day", "user", "conversation", or "model".
+func (s *agentStore) usageSince(since, key string) ([]usageGroup, error) {
+	var cols, group string
+	switch key {
+	case "":
+		cols = `'', '', '', '', ''`
+	case "day":
+		cols, group = `substr(u.created_at, 1, 10), '', '', '', ''`, `GROUP BY 1 ORDER BY 1`
+	case "user":
+		cols, group = `'', u.user, '', '', ''`, `GROUP BY 2 ORDER BY 2`
+	case "conversation":
+		cols, group = `'', '', u.conversation_id, coalesce(c.title, ''), ''`, `GROUP BY 3 ORDER BY max(u.created_at) DESC`
+	case "model":
+		cols, group = `'', '', '', '', u.model`, `GROUP BY 5 ORDER BY 5`
+	default:
+		return nil, fmt.Errorf("unknown usage grouping %q", key)
+	}
+	if since == "" {
+		since = "0001-01-01T00:00:00Z"
+	}
+	rows, err := s.db.Query(
+		`SELECT `+cols+`, `+usageSums+`
+		 FROM usage u LEFT JOIN conversations c ON c.id = u.conversation_id
+		 WHERE datetime(u.created_at) >= datetime(?) `+group,
+		since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var groups []usageGroup
+	for rows.Next() {
+		var g usageGroup
+		if err := rows.Scan(&g.Day, &g.User, &g.ConversationID, &g.Title, &g.Model,
+			&g.Runs, &g.InputTokens, &g.OutputTokens, &g.CacheRead, &g.CacheWrite); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
 func (s *agentStore) setConversationStatus(id, status string) error {
 	_, err := s.db.Exec(
 		`UPDATE conversations SET status = ?, updated_at = ? WHERE id = ?`,
@@ -191,9 +533,148 @@ func (s *agentStore) setConversationStatus(id, status string) error {
 	return err
 }
 
+type searchHit struct {
+	ConversationID string `json:"conversation_id"`
+	Title          string `json:"title"`
+	MessageID      int64  `json:"message_id"`
+	Type           string `json:"type"` // "user" or "assistant"
+	CreatedAt      string `json:"created_at"`
+	Snippet        string `json:"snippet"` // HTML: escaped text, matches in <mark>
+}
+
+// search returns up to limit messages matching every word of q (as a
+// prefix), best matches first.
+func (s *agentStore) search(q string, limit int) ([]searchHit, error) {
+	// Quote each word so FTS5 syntax in q (quotes, AND, -, *) is just text.
+	var terms []string
+	for _, w := range strings.Fields(q) {
+		terms = append(terms, `"`+strings.ReplaceAll(w, `"`, `""`)+`"*`)
+	}
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	rows, err := s.db.Query(
+		`SELECT m.conversation_id, c.title, m.id, m.type, m.created_at,
+			snippet(messages_fts, 0, char(2), char(3), '…', 16)
+		 FROM messages_fts
+		 JOIN messages m ON m.id = messages_fts.rowid
+		 JOIN conversations c ON c.id = m.conversation_id
+		 WHERE messages_fts MATCH ?
+		 ORDER BY rank LIMIT ?`,
+		strings.Join(terms, " "), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hits []searchHit
+	for rows.Next() {
+		var h searchHit
+		if err := rows.Scan(&h.ConversationID, &h.Title, &h.MessageID, &h.Type, &h.CreatedAt, &h.Snippet); err != nil {
+			return nil, err
+		}
+		h.Snippet = strings.NewReplacer("\x02", "<mark>", "\x03", "</mark>").Replace(html.EscapeString(h.Snippet))
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
+
+// setConversationTools sets a conversation's tool list; nil clears it, so
+// the conversation follows the daemon-wide list again.
+func (s *agentStore) setConversationTools(id string, tools []string) error {
+	_, err := s.db.Exec(`UPDATE conversations SET allowed_tools = ? WHERE id = ?`, encodeTools(tools), id)
+	return err
+}
+
+// getSetting returns a daemon-wide setting, "" if unset.
+func (s *agentStore) getSetting(key string) (string, error) {
+	var value string
+	err := s.db.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+// setSetting stores a daemon-wide setting; "" deletes it.
+func (s *agentStore) setSetting(key, value string) error {
+	if value == "" {
+		_, err := s.db.Exec(`DELETE FROM settings WHERE key = ?`, key)
+		return err
+	}
+	_, err := s.db.Exec(
+		`INSERT INTO settings (key, value) VALUES (?, ?)
+		 ON CONFLICT(key) DO UPDATE SET value = excluded.value`,
+		key, value,
+	)
+	return err
+}
+
+// Tool lists are stored as JSON so an empty list (no tools) differs from
+// none (inherit).
+func encodeTools(tools []string) string {
+	if tools == nil {
+		return ""
+	}
+	data, _ := json.Marshal(tools)
+	return string(data)
+}
+
+func decodeTools(s string) []string {
+	if s == "" {
+		return nil
+	}
+	tools := []string{}
+	json.Unmarshal([]byte(s), &tools)
+	return tools
+}
+
+// addPushSubscription stores a browser's push subscription for user,
+// replacing the one it had.
+func (s *agentStore) addPushSubscription(sub pushSubscription, user string) error {
+	_, err := s.db.Exec(
+		`INSERT INTO push_subscriptions (endpoint, p256dh, auth, user, created_at) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT(endpoint) DO UPDATE SET p256dh = excluded.p256dh, auth = excluded.auth, user = excluded.user`,
+		sub.Endpoint, sub.Keys.P256dh, sub.Keys.Auth, user, time.Now().Format(time.RFC3339),
+	)
+	return err
+}
+
+// deletePushSubscription removes user's subscription for endpoint,
+// reporting whether there was one.
+func (s *agentStore) deletePushSubscription(endpoint, user string) (bool, error) {
+	res, err := s.db.Exec(`DELETE FROM push_subscriptions WHERE endpoint = ? AND user = ?`, endpoint, user)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// pushSubscriptions lists the subscriptions of user, or every one if user
+// is "".
+func (s *agentStore) pushSubscriptions(user string) ([]pushSubscription, error) {
+	rows, err := s.db.Query(`SELECT endpoint, p256dh, auth, user FROM push_subscriptions WHERE ? = '' OR user = ? ORDER BY created_at`, user, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var subs []pushSubscription
+	for rows.Next() {
+		var sub pushSubscription
+		if err := rows.Scan(&sub.Endpoint, &sub.Keys.P256dh, &sub.Keys.Auth, &sub.User); err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
 func (s *agentStore) recoverInterrupted() (int, error) {
 	rows, err := s.db.Query(
-		`SELECT id FROM conversations WHERE status = 'running'`,
+		`SELECT id FROM conversations WHERE status IN ('running', 'queued')`,
 	)
 	if err != nil {
 		return 0, err
@@ -214,3 +695,75 @@ func (s *agentStore) recoverInterrupted() (int, error) {
 	}
 	return len(ids), nil
 }
+
+// dbSize returns the database's size on disk and how much of it is free
+// pages, which only VACUUM gives back.
+func (s *agentStore) dbSize() (size, free int64) {
+	var pages, pageSize, freePages int64
+	s.db.QueryRow(`PRAGMA page_count`).Scan(&pages)
+	s.db.QueryRow(`PRAGMA page_size`).Scan(&pageSize)
+	s.db.QueryRow(`PRAGMA freelist_count`).Scan(&freePages)
+	return pages * pageSize, freePages * pageSize
+}
+
+// notActive is the SQL condition sparing the messages of conversations
+// whose agent is running or queued.
+const notActive = `conversation_id NOT IN (SELECT id FROM conversations WHERE status IN ('running', 'queued'))`
+
+// pruneBefore deletes messages created before cutoff (RFC 3339), then the
+// conversations left without any that haven't changed since cutoff either.
+func (s *agentStore) pruneBefore(cutoff string) (msgs, convs int64, err error) {
+	res, err := s.db.Exec(
+		`DELETE FROM messages WHERE datetime(created_at) < datetime(?) AND `+notActive, cutoff)
+	if err != nil {
+		return 0, 0, err
+	}
+	msgs, _ = res.RowsAffected()
+	res, err = s.db.Exec(
+		`DELETE FROM conversations WHERE datetime(updated_at) < datetime(?)
+		 AND status NOT IN ('running', 'queued')
+		 AND id NOT IN (SELECT DISTINCT conversation_id FROM messages)`, cutoff)
+	if err != nil {
+		return msgs, 0, err
+	}
+	convs, _ = res.RowsAffected()
+	return msgs, convs, nil
+}
+
+// pruneOldest deletes the oldest messages until their contents add up to
+// at least bytes.
+func (s *agentStore) pruneOldest(bytes int64) (int64, error) {
+	res, err := s.db.Exec(
+		`DELETE FROM messages WHERE `+notActive+` AND id <= (
+			SELECT id FROM (
+				SELECT id, sum(length(content)) OVER (ORDER BY id) AS total
+				FROM messages WHERE `+notActive+`
+			) WHERE total >= ? ORDER BY id LIMIT 1
+		)`, bytes)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		// Fewer bytes in all of them than asked: delete them all.
+		res, err = s.db.Exec(`DELETE FROM messages WHERE ` + notActive)
+		if err != nil {
+			return 0, err
+		}
+		n, _ = res.RowsAffected()
+	}
+	return n, nil
+}
+
+func (s *agentStore) vacuum() error {
+	_, err := s.db.Exec(`VACUUM`)
+	return err
+}
+
+// counts returns how many conversations and messages there are, and when
+// the oldest message was stored.
+func (s *agentStore) counts() (convs, msgs int64, oldest string) {
+	s.db.QueryRow(`SELECT count(*) FROM conversations`).Scan(&convs)
+	s.db.QueryRow(`SELECT count(*), coalesce(min(created_at), '') FROM messages`).Scan(&msgs, &oldest)
+	return convs, msgs, oldest
+}
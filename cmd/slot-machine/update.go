@@ -1,19 +1,47 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+
+	"slot-machine/internal/engine"
+	"slot-machine/pkg/client"
+)
+
+// releasesURL is the GitHub API endpoint for this repo's releases. A var so
+// tests can point it at a fake server.
+var releasesURL = "https://api.github.com/repos/louije/slot-machine/releases"
+
+// Release assets that vouch for the binaries: checksums.txt in sha256sum
+// format, and an ed25519 signature of it.
+const (
+	checksumsAsset = "checksums.txt"
+	signatureAsset = "checksums.txt.sig"
 )
 
-const releaseURL = "https://api.github.com/repos/louije/slot-machine/releases/latest"
+// UpdatePublicKey is the base64 ed25519 key that release checksums are
+// signed with, injected at build time via -ldflags="-X main.UpdatePublicKey=...".
+// SLOT_MACHINE_UPDATE_KEY overrides it. With neither set, updates are
+// verified against checksums.txt only.
+var UpdatePublicKey = ""
 
 type ghRelease struct {
 	TagName string    `json:"tag_name"`
+	Draft   bool      `json:"draft"`
 	Assets  []ghAsset `json:"assets"`
 }
 
@@ -22,92 +50,300 @@ type ghAsset struct {
 	URL  string `json:"url"` // API URL — serves binary with Accept: application/octet-stream
 }
 
-func cmdUpdate() {
-	req, _ := http.NewRequest("GET", releaseURL, nil)
-	req.Header.Set("Accept", "application/vnd.github+json")
-	req.Header.Set("User-Agent", "slot-machine/"+Version)
-	resp, err := http.DefaultClient.Do(req)
+func (r *ghRelease) asset(name string) string {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL
+		}
+	}
+	return ""
+}
+
+func cmdUpdate(args []string) {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	channel := fs.String("channel", "stable", "release channel: stable or prerelease")
+	check := fs.Bool("check", false, "report whether an update is available without installing it")
+	rollback := fs.Bool("rollback", false, "restore the binary the last update replaced")
+	fs.Parse(args)
+
+	self, err := os.Executable()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: cannot reach GitHub: %v\n", err)
-		os.Exit(1)
+		fatal(false, exitError, "cannot determine own path: %v", err)
 	}
-	defer resp.Body.Close()
+	self, _ = filepath.EvalSymlinks(self)
 
-	if resp.StatusCode == 404 {
-		fmt.Fprintln(os.Stderr, "error: no releases found")
-		os.Exit(1)
+	if *rollback {
+		if err := refuseWhileDeploying(); err != nil {
+			fatal(false, exitError, "%v", err)
+		}
+		if err := rollbackBinary(self); err != nil {
+			fatal(false, exitError, "%v", err)
+		}
+		fmt.Printf("restored %s from %s\n", self, self+".bak")
+		return
 	}
-	if resp.StatusCode != 200 {
-		fmt.Fprintf(os.Stderr, "error: GitHub API returned %d\n", resp.StatusCode)
-		os.Exit(1)
+	if *channel != "stable" && *channel != "prerelease" {
+		fatal(false, exitError, "--channel must be stable or prerelease")
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	rel, err := fetchRelease(*channel)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: reading response: %v\n", err)
-		os.Exit(1)
-	}
-	var rel ghRelease
-	if err := json.Unmarshal(body, &rel); err != nil {
-		fmt.Fprintf(os.Stderr, "error: cannot parse release: %v\n", err)
-		os.Exit(1)
+		fatal(false, exitError, "%v", err)
 	}
-
 	if rel.TagName == Version {
 		fmt.Printf("already up to date (%s)\n", Version)
 		return
 	}
+	if *check {
+		fmt.Printf("update available: %s → %s\n", Version, rel.TagName)
+		return
+	}
 
-	wantName := fmt.Sprintf("slot-machine-%s-%s", runtime.GOOS, runtime.GOARCH)
-	var assetURL string
-	for _, a := range rel.Assets {
-		if a.Name == wantName {
-			assetURL = a.URL
-			break
-		}
+	if err := refuseWhileDeploying(); err != nil {
+		fatal(false, exitError, "%v", err)
 	}
-	if assetURL == "" {
-		fmt.Fprintf(os.Stderr, "error: no asset %q in release %s\n", wantName, rel.TagName)
-		os.Exit(1)
+	if err := installRelease(rel, self, updatePublicKey()); err != nil {
+		fatal(false, exitError, "%v", err)
 	}
+	fmt.Printf("%s → %s (previous binary kept as %s)\n", Version, rel.TagName, self+".bak")
+}
 
-	// Download to temp file next to current binary.
-	self, err := os.Executable()
+// fetchRelease returns the newest release on the channel: the latest
+// stable release, or the newest release of any kind for prerelease.
+func fetchRelease(channel string) (*ghRelease, error) {
+	url := releasesURL + "/latest"
+	if channel == "prerelease" {
+		url = releasesURL + "?per_page=20"
+	}
+	body, err := githubGet(url, "application/vnd.github+json")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: cannot determine own path: %v\n", err)
-		os.Exit(1)
+		return nil, err
 	}
-	self, _ = filepath.EvalSymlinks(self)
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+
+	if channel != "prerelease" {
+		var rel ghRelease
+		if err := json.Unmarshal(data, &rel); err != nil {
+			return nil, fmt.Errorf("cannot parse release: %w", err)
+		}
+		return &rel, nil
+	}
+	var rels []ghRelease
+	if err := json.Unmarshal(data, &rels); err != nil {
+		return nil, fmt.Errorf("cannot parse releases: %w", err)
+	}
+	for i := range rels {
+		if !rels[i].Draft {
+			return &rels[i], nil
+		}
+	}
+	return nil, errors.New("no releases found")
+}
 
-	dlReq, _ := http.NewRequest("GET", assetURL, nil)
-	dlReq.Header.Set("Accept", "application/octet-stream")
-	dlReq.Header.Set("User-Agent", "slot-machine/"+Version)
-	dlResp, err := http.DefaultClient.Do(dlReq)
+func githubGet(url, accept string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: download failed: %v\n", err)
-		os.Exit(1)
+		return nil, err
 	}
-	defer dlResp.Body.Close()
+	req.Header.Set("Accept", accept)
+	req.Header.Set("User-Agent", "slot-machine/"+Version)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach GitHub: %w", err)
+	}
+	switch resp.StatusCode {
+	case 200:
+		return resp.Body, nil
+	case 404:
+		resp.Body.Close()
+		return nil, errors.New("no releases found")
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("GitHub returned %d for %s", resp.StatusCode, url)
+	}
+}
 
+// installRelease downloads this platform's binary from rel next to self,
+// checks it against the release's checksums (and their signature when pub
+// is set), keeps the current binary as self.bak, and moves the new one
+// into place.
+func installRelease(rel *ghRelease, self string, pub ed25519.PublicKey) error {
 	tmp := self + ".tmp"
-	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err := downloadRelease(rel, tmp, pub); err != nil {
+		return err
+	}
+	return installBinary(tmp, self)
+}
+
+// downloadRelease downloads this platform's binary from rel to dst and
+// checks it against the release's checksums (and their signature when pub
+// is set). dst is removed if the check fails.
+func downloadRelease(rel *ghRelease, dst string, pub ed25519.PublicKey) error {
+	wantName := fmt.Sprintf("slot-machine-%s-%s", runtime.GOOS, runtime.GOARCH)
+	assetURL := rel.asset(wantName)
+	if assetURL == "" {
+		return fmt.Errorf("no asset %q in release %s", wantName, rel.TagName)
+	}
+	sumsURL := rel.asset(checksumsAsset)
+	if sumsURL == "" {
+		return fmt.Errorf("release %s has no %s; refusing to install an unverified binary", rel.TagName, checksumsAsset)
+	}
+
+	sums, err := downloadAsset(sumsURL)
+	if err != nil {
+		return err
+	}
+	if pub != nil {
+		sigURL := rel.asset(signatureAsset)
+		if sigURL == "" {
+			return fmt.Errorf("release %s has no %s but a signing key is configured", rel.TagName, signatureAsset)
+		}
+		sig, err := downloadAsset(sigURL)
+		if err != nil {
+			return err
+		}
+		if err := verifySignature(pub, sums, sig); err != nil {
+			return err
+		}
+	}
+	want, err := checksumFor(sums, wantName)
+	if err != nil {
+		return err
+	}
+
+	body, err := githubGet(assetURL, "application/octet-stream")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: cannot write %s: %v\n", tmp, err)
-		os.Exit(1)
+		return fmt.Errorf("download failed: %w", err)
 	}
-	if _, err := io.Copy(f, dlResp.Body); err != nil {
-		f.Close()
-		os.Remove(tmp)
-		fmt.Fprintf(os.Stderr, "error: download failed: %v\n", err)
-		os.Exit(1)
+	defer body.Close()
+
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return fmt.Errorf("cannot write %s: %w", dst, err)
 	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), body)
 	f.Close()
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("download failed: %w", err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		os.Remove(dst)
+		return fmt.Errorf("checksum mismatch for %s: got %s, want %s", wantName, got, want)
+	}
+	return nil
+}
 
-	if err := os.Rename(tmp, self); err != nil {
-		os.Remove(tmp)
-		fmt.Fprintf(os.Stderr, "error: cannot replace binary: %v\n", err)
-		os.Exit(1)
+// installBinary keeps the binary at self as self.bak and moves the one at
+// staged into its place. staged is removed if it can't be.
+func installBinary(staged, self string) error {
+	// Hard-link the running binary to .bak so self is never missing: the
+	// rename below swaps the new binary in atomically.
+	bak := self + ".bak"
+	os.Remove(bak)
+	if err := os.Link(self, bak); err != nil {
+		os.Remove(staged)
+		return fmt.Errorf("cannot keep previous binary as %s: %w", bak, err)
 	}
+	if err := os.Rename(staged, self); err != nil {
+		os.Remove(staged)
+		return fmt.Errorf("cannot replace binary: %w", err)
+	}
+	return nil
+}
+
+func downloadAsset(url string) ([]byte, error) {
+	body, err := githubGet(url, "application/octet-stream")
+	if err != nil {
+		return nil, fmt.Errorf("download failed: %w", err)
+	}
+	defer body.Close()
+	return io.ReadAll(io.LimitReader(body, 1<<20))
+}
 
-	fmt.Printf("%s → %s\n", Version, rel.TagName)
+// checksumFor finds name's SHA256 in sha256sum output ("<hex>  <name>").
+func checksumFor(sums []byte, name string) (string, error) {
+	sc := bufio.NewScanner(strings.NewReader(string(sums)))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			sum := strings.ToLower(fields[0])
+			if _, err := hex.DecodeString(sum); err != nil || len(sum) != 64 {
+				return "", fmt.Errorf("%s: malformed checksum for %s", checksumsAsset, name)
+			}
+			return sum, nil
+		}
+	}
+	return "", fmt.Errorf("%s has no checksum for %s", checksumsAsset, name)
+}
+
+// verifySignature checks an ed25519 signature of the checksums file. The
+// signature may be raw or base64.
+func verifySignature(pub ed25519.PublicKey, sums, sig []byte) error {
+	if len(sig) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+		if err != nil {
+			return fmt.Errorf("%s: malformed signature", signatureAsset)
+		}
+		sig = decoded
+	}
+	if !ed25519.Verify(pub, sums, sig) {
+		return fmt.Errorf("%s does not match %s; refusing to install", signatureAsset, checksumsAsset)
+	}
+	return nil
+}
+
+// updatePublicKey returns the configured signing key, or nil when updates
+// aren't signed. A malformed key is fatal: silently skipping verification
+// would defeat the point of setting one.
+func updatePublicKey() ed25519.PublicKey {
+	s := UpdatePublicKey
+	if env := os.Getenv("SLOT_MACHINE_UPDATE_KEY"); env != "" {
+		s = env
+	}
+	if s == "" {
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		fatal(false, exitError, "update signing key is not a base64 ed25519 public key")
+	}
+	return ed25519.PublicKey(key)
+}
+
+// rollbackBinary moves self.bak back over self.
+func rollbackBinary(self string) error {
+	bak := self + ".bak"
+	if _, err := os.Stat(bak); err != nil {
+		return fmt.Errorf("no previous binary at %s", bak)
+	}
+	if err := os.Rename(bak, self); err != nil {
+		return fmt.Errorf("cannot restore %s: %w", bak, err)
+	}
+	return nil
+}
+
+// refuseWhileDeploying fails if the daemon for the project in the working
+// directory is mid-deploy. Outside a project, or with no daemon running,
+// there's nothing to wait for.
+func refuseWhileDeploying() error {
+	if _, ok := findConfigDir(); !ok {
+		return nil
+	}
+	st, err := newClient().Status(context.Background())
+	if errors.Is(err, client.ErrUnreachable) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot check for a deploy in progress: %w", err)
+	}
+	if st.DeployingSince != "" {
+		return fmt.Errorf("a deploy of %s is in progress (since %s); try again when it finishes", engine.ShortHash(st.DeployingCommit), st.DeployingSince)
+	}
+	return nil
 }
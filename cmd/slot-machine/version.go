@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"slot-machine/internal/engine"
+	"slot-machine/pkg/client"
+)
+
+// Build details, injected at build time via
+// -ldflags="-X main.Version=v1.0.0 -X main.Commit=abc123 -X main.BuildDate=2025-01-02T15:04:05Z".
+// Without them, Commit and BuildDate fall back to the revision and commit
+// time the Go toolchain stamps into binaries built in a git checkout.
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+)
+
+// buildInfo is what `slot-machine version` prints and GET /version
+// returns.
+func buildInfo() client.Version {
+	v := client.Version{
+		Version:     Version,
+		Commit:      Commit,
+		BuildDate:   BuildDate,
+		GoVersion:   runtime.Version(),
+		SpecVersion: engine.SpecVersion,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && v.Commit == "":
+				v.Commit = s.Value
+			case s.Key == "vcs.time" && v.BuildDate == "":
+				v.BuildDate = s.Value
+			case s.Key == "vcs.modified" && Commit == "":
+				v.Modified = s.Value == "true"
+			}
+		}
+	}
+	return v
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSON(w, 405, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, 200, buildInfo())
+}
+
+func cmdVersion(args []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print as JSON")
+	daemon := fs.Bool("daemon", false, "also ask the running daemon for its build")
+	fs.Parse(args)
+
+	local := buildInfo()
+	var remote *client.Version
+	if *daemon {
+		var err error
+		remote, err = newClient().Version(context.Background())
+		if err != nil {
+			fatal(*jsonOut, exitCode(err, exitError), "%v", err)
+		}
+	}
+
+	if *jsonOut {
+		if remote == nil {
+			printJSON(local)
+		} else {
+			printJSON(map[string]any{"cli": local, "daemon": remote})
+		}
+		return
+	}
+	printVersion("", local)
+	if remote != nil {
+		fmt.Println()
+		printVersion("daemon ", *remote)
+	}
+}
+
+func printVersion(prefix string, v client.Version) {
+	fmt.Printf("%sslot-machine %s\n", prefix, v.Version)
+	if v.Commit != "" {
+		modified := ""
+		if v.Modified {
+			modified = " (modified)"
+		}
+		fmt.Printf("  commit: %s%s\n", v.Commit, modified)
+	}
+	if v.BuildDate != "" {
+		fmt.Printf("  built:  %s\n", v.BuildDate)
+	}
+	fmt.Printf("  go:     %s\n", v.GoVersion)
+	fmt.Printf("  spec:   %d\n", v.SpecVersion)
+}
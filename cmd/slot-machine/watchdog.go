@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Under systemd with WatchdogSec set, the daemon pings the watchdog at half
+// the interval, but only while /livez passes: a wedged daemon goes quiet
+// and systemd restarts it. The unit needs NotifyAccess=main for the pings
+// to count.
+
+// runWatchdog pings systemd's watchdog while live returns true. It returns
+// at once when the watchdog is off.
+func runWatchdog(live func() bool) {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	usec, _ := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if sock == "" || usec <= 0 {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	for {
+		if live() {
+			sdNotify(sock, "WATCHDOG=1")
+		}
+		time.Sleep(interval)
+	}
+}
+
+// sdNotify sends state to systemd's notification socket.
+func sdNotify(sock, state string) error {
+	if strings.HasPrefix(sock, "@") {
+		sock = "\x00" + sock[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
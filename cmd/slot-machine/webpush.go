@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"slot-machine/internal/engine"
+)
+
+// People close the chat tab on their phone and miss the agent finishing or
+// a deploy failing. The chat's settings can turn on notifications: the
+// browser subscribes to Web Push with the daemon's VAPID key (vapid.pem in
+// the data dir, made the first time) and POSTs the subscription to
+// /chat/push-subscriptions. The daemon then pushes a notification to every
+// subscription when a deploy or rollback finishes, and to the user's own
+// when one of their conversations' agent run ends. Payloads are encrypted
+// for the browser (RFC 8291) and requests signed with the VAPID key (RFC
+// 8292), so the push service can read neither. A subscription the push
+// service says is gone (404, 410) is dropped.
+
+const (
+	vapidKeyName   = "vapid.pem"
+	pushTTL        = 24 * time.Hour // how long a push service holds a notification for an offline browser
+	pushTimeout    = 10 * time.Second
+	pushRecordSize = 4096
+)
+
+// pushSubscription is a browser's PushSubscription, as its toJSON() has it.
+type pushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"` // the browser's P-256 public key, base64url
+		Auth   string `json:"auth"`   // 16-byte auth secret, base64url
+	} `json:"keys"`
+	User string `json:"-"` // who subscribed, in hmac and trusted modes
+}
+
+// pushNotification is the payload the chat's service worker shows.
+type pushNotification struct {
+	Title string `json:"title"`
+	Body  string `json:"body,omitempty"`
+	Tag   string `json:"tag,omitempty"` // a newer notification with the same tag replaces the older
+}
+
+// webPusher sends notifications to the stored subscriptions.
+type webPusher struct {
+	store   *agentStore
+	key     *ecdsa.PrivateKey
+	subject string // VAPID "sub": how the push service can reach the operator
+	app     func() string
+	client  *http.Client
+}
+
+func newWebPusher(store *agentStore, dataDir, subject string) (*webPusher, error) {
+	key, err := loadVAPIDKey(filepath.Join(dataDir, vapidKeyName))
+	if err != nil {
+		return nil, fmt.Errorf("VAPID key: %w", err)
+	}
+	if subject == "" {
+		subject = "mailto:slot-machine@localhost"
+	}
+	return &webPusher{
+		store:   store,
+		key:     key,
+		subject: subject,
+		app:     func() string { return "slot-machine" },
+		client:  &http.Client{Timeout: pushTimeout},
+	}, nil
+}
+
+// loadVAPIDKey reads the P-256 key at path, generating it the first time.
+func loadVAPIDKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s is not PEM", path)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		ec, ok := key.(*ecdsa.PrivateKey)
+		if !ok || ec.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%s is not a P-256 key", path)
+		}
+		return ec, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// publicKey is the VAPID public key as browsers take it for
+// applicationServerKey: the uncompressed point, base64url.
+func (p *webPusher) publicKey() string {
+	pub, _ := p.key.PublicKey.ECDH()
+	return base64.RawURLEncoding.EncodeToString(pub.Bytes())
+}
+
+// --- POST /chat/push-subscriptions, DELETE /chat/push-subscriptions ---
+
+func (a *agentService) handlePushSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if a.pusher == nil {
+		http.NotFound(w, r)
+		return
+	}
+	user := a.extractUser(r)
+	if a.authMode == "hmac" && user == "" {
+		http.Error(w, "unauthorized", 401)
+		return
+	}
+	var sub pushSubscription
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&sub); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid body"})
+		return
+	}
+	switch r.Method {
+	case "POST":
+		if err := checkPushSubscription(sub); err != nil {
+			writeJSON(w, 400, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := a.store.addPushSubscription(sub, user); err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, 201, map[string]bool{"subscribed": true})
+	case "DELETE":
+		ok, err := a.store.deletePushSubscription(sub.Endpoint, user)
+		if err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+		if !ok {
+			writeJSON(w, 404, map[string]string{"error": "no such subscription"})
+			return
+		}
+		writeJSON(w, 200, map[string]bool{"subscribed": false})
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+// checkPushSubscription checks that sub can be pushed to.
+func checkPushSubscription(sub pushSubscription) error {
+	u, err := url.Parse(sub.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return errors.New("endpoint must be an https URL")
+	}
+	if key, err := base64.RawURLEncoding.DecodeString(sub.Keys.P256dh); err != nil || len(key) != 65 {
+		return errors.New("keys.p256dh must be a base64url P-256 public key")
+	}
+	if auth, err := base64.RawURLEncoding.DecodeString(sub.Keys.Auth); err != nil || len(auth) != 16 {
+		return errors.New("keys.auth must be a base64url 16-byte secret")
+	}
+	return nil
+}
+
+// --- Sending ---
+
+// pushEvent turns the daemon's deploy, rollback, and agent run results, and
+// the agent's deploys waiting for approval, into notifications.
+func (p *webPusher) pushEvent(e engine.DaemonEvent) {
+	switch d := e.Data.(type) {
+	case engine.EventOutcome:
+		action := map[string]string{engine.EventDeployFinished: "deploy", engine.EventRollbackFinished: "rollback"}[e.Type]
+		if action == "" {
+			return
+		}
+		n := pushNotification{Tag: e.Type}
+		if d.Success {
+			n.Title = fmt.Sprintf("%s: %s of %s done", p.app(), action, engine.ShortHash(e.Commit))
+			n.Body = fmt.Sprintf("%s is live, after %.1fs", engine.ShortHash(e.Commit), float64(d.DurationMs)/1000)
+		} else {
+			n.Title = fmt.Sprintf("%s: %s of %s failed", p.app(), action, engine.ShortHash(e.Commit))
+			n.Body = d.Error
+		}
+		p.pushAll("", n)
+	case engine.PendingDeploy:
+		n := pushNotification{Title: fmt.Sprintf("%s: the agent wants to deploy %s", p.app(), engine.ShortHash(d.Commit)), Body: d.Message, Tag: "pending-" + d.ID}
+		if n.Body == "" {
+			n.Body = "Approve or reject it in the chat or dashboard"
+		}
+		p.pushAll("", n)
+	case agentRunEvent:
+		conv, err := p.store.getConversation(d.Conversation)
+		if err != nil || conv == nil {
+			return
+		}
+		n := pushNotification{Title: p.app() + ": the agent is done", Body: conv.Title, Tag: "agent-" + conv.ID}
+		if d.Status == "error" {
+			n.Title = p.app() + ": the agent stopped with an error"
+		}
+		p.pushAll(conv.User, n)
+	}
+}
+
+// pushAll sends n to user's subscriptions, or everyone's if user is "".
+func (p *webPusher) pushAll(user string, n pushNotification) {
+	subs, err := p.store.pushSubscriptions(user)
+	if err != nil {
+		fmt.Printf("warning: web push: %v\n", err)
+		return
+	}
+	payload, _ := json.Marshal(n)
+	for _, sub := range subs {
+		go func() {
+			err := p.push(sub, payload)
+			var gone errPushGone
+			if errors.As(err, &gone) {
+				p.store.deletePushSubscription(sub.Endpoint, sub.User)
+			} else if err != nil {
+				fmt.Printf("warning: web push: %v\n", err)
+			}
+		}()
+	}
+}
+
+// errPushGone is a push service saying a subscription no longer exists.
+type errPushGone struct{ status string }
+
+func (e errPushGone) Error() string { return "subscription gone: " + e.status }
+
+// push sends payload to sub, encrypted for it.
+func (p *webPusher) push(sub pushSubscription, payload []byte) error {
+	body, err := encryptPush(sub, payload)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+	jwt, err := p.vapidJWT(u.Scheme+"://"+u.Host, time.Now())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprint(int(pushTTL.Seconds())))
+	req.Header.Set("Authorization", "vapid t="+jwt+", k="+p.publicKey())
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", u.Host, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == 404 || resp.StatusCode == 410:
+		return errPushGone{resp.Status}
+	case resp.StatusCode/100 != 2:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s: %s", u.Host, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// vapidJWT is the ES256 token identifying the daemon to the push service at
+// audience, for 12 hours.
+func (p *webPusher) vapidJWT(audience string, now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, _ := json.Marshal(map[string]any{"aud": audience, "exp": now.Add(12 * time.Hour).Unix(), "sub": p.subject})
+	signing := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signing))
+	r, s, err := ecdsa.Sign(rand.Reader, p.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signing + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// encryptPush encrypts payload for sub as a single aes128gcm record, as
+// RFC 8291 says: the key comes from an ECDH exchange between a key made for
+// this message and the browser's, mixed with its auth secret.
+func encryptPush(sub pushSubscription, payload []byte) ([]byte, error) {
+	uaBytes, err := base64.RawURLEncoding.DecodeString(sub.Keys.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("p256dh: %w", err)
+	}
+	auth, err := base64.RawURLEncoding.DecodeString(sub.Keys.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	uaPub, err := ecdh.P256().NewPublicKey(uaBytes)
+	if err != nil {
+		return nil, fmt.Errorf("p256dh: %w", err)
+	}
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := asKey.ECDH(uaPub)
+	if err != nil {
+		return nil, err
+	}
+	asPub := asKey.PublicKey().Bytes()
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaBytes...), asPub...)
+	prkKey, err := hkdf.Extract(sha256.New, secret, auth)
+	if err != nil {
+		return nil, err
+	}
+	ikm, err := hkdf.Expand(sha256.New, prkKey, string(keyInfo), 32)
+	if err != nil {
+		return nil, err
+	}
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload)+1+gcm.Overhead() > pushRecordSize {
+		return nil, fmt.Errorf("payload of %d bytes is too big for a push", len(payload))
+	}
+
+	// Header: salt, record size, key ID (our public key); then the one
+	// record, the payload with its last-record delimiter.
+	out := append([]byte{}, salt...)
+	out = binary.BigEndian.AppendUint32(out, pushRecordSize)
+	out = append(out, byte(len(asPub)))
+	out = append(out, asPub...)
+	plain := append(append([]byte{}, payload...), 2)
+	return gcm.Seal(out, nonce, plain, nil), nil
+}
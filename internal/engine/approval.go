@@ -0,0 +1,179 @@
+package engine
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// With agent_deploy_approval, a deploy the agent asks for doesn't start:
+// it's held as a pending deploy, answered with a 202 and "pending", and a
+// deploy_pending event is published, which the chat and dashboard show
+// with Approve and Reject buttons. POST /deploys/pending/:id/approve runs
+// it as it was asked for; POST /deploys/pending/:id/reject drops it.
+// Another request for the same commit updates the one pending. Pending
+// deploys live in memory: a restart forgets them, and the agent has to ask
+// again.
+//
+// The agent has a shell on this box, so a request's source says nothing:
+// the agent can call the API with any. The daemon holds every deploy
+// requested through the API unless a person vouches for it: the admin
+// token as a bearer token, or, in-process, the chat for a signed-in user
+// and the dashboard for the API token's holder (see Vouch). Deciding on a
+// pending deploy takes the same.
+
+// PendingDeploy is a deploy held for approval.
+type PendingDeploy struct {
+	ID          string `json:"id"`
+	Commit      string `json:"commit"`
+	Message     string `json:"message,omitempty"`
+	Source      string `json:"source"`
+	RequestedAt string `json:"requested_at"` // RFC3339
+
+	opts DeployOptions
+}
+
+// PendingDecision is the data of deploy_approved and deploy_rejected.
+type PendingDecision struct {
+	PendingDeploy
+	Decision string `json:"decision"` // "approved" or "rejected"
+}
+
+type vouchKey struct{}
+
+// Vouch marks r as a person's, whom its caller authenticated, rather than
+// possibly the agent's. It's for handlers that call the API in-process;
+// nothing a client sends sets it.
+func Vouch(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), vouchKey{}, true))
+}
+
+// vouched reports whether r is a person's: vouched for in-process, or with
+// the admin token as a bearer token.
+func (o *Orchestrator) vouched(r *http.Request) bool {
+	if r.Context().Value(vouchKey{}) != nil {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && o.checkAdminToken(token)
+}
+
+// holdDeploy holds a deploy of commit for approval if agent_deploy_approval
+// says so, and returns it; nil means the deploy may go ahead. Deploys the
+// daemon starts itself, with no source, aren't held.
+func (o *Orchestrator) holdDeploy(commit string, opts DeployOptions) (*PendingDeploy, error) {
+	o.mu.Lock()
+	hold := o.cfg.AgentDeployApproval && opts.Source != "" && !opts.Approved
+	o.mu.Unlock()
+	if !hold {
+		return nil, nil
+	}
+	if opts.Artifact != "" {
+		return nil, fmt.Errorf("agent_deploy_approval holds deploys without the admin token, and artifacts can't wait: deploy a commit, or send the admin token")
+	}
+	opts.Progress = nil
+
+	o.mu.Lock()
+	p := o.pendingFor(commit)
+	if p == nil {
+		b := make([]byte, 4)
+		rand.Read(b)
+		p = &PendingDeploy{ID: hex.EncodeToString(b), Commit: commit}
+		o.pending = append(o.pending, p)
+	}
+	p.Message, p.Source, p.opts = opts.Message, opts.Source, opts
+	p.RequestedAt = time.Now().UTC().Format(time.RFC3339)
+	held := *p
+	o.mu.Unlock()
+
+	fmt.Printf("deploy %s (source %s) is waiting for approval (%s)\n", ShortHash(commit), held.Source, held.ID)
+	o.Publish(EventDeployPending, commit, "", held)
+	return &held, nil
+}
+
+// pendingFor is the pending deploy of commit, if any. o.mu must be held.
+func (o *Orchestrator) pendingFor(commit string) *PendingDeploy {
+	for _, p := range o.pending {
+		if p.Commit == commit {
+			return p
+		}
+	}
+	return nil
+}
+
+// PendingDeploys lists the deploys waiting for approval, oldest first.
+func (o *Orchestrator) PendingDeploys() []PendingDeploy {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.pendingDeploys()
+}
+
+// pendingDeploys is PendingDeploys with o.mu held.
+func (o *Orchestrator) pendingDeploys() []PendingDeploy {
+	var list []PendingDeploy
+	for _, p := range o.pending {
+		list = append(list, *p)
+	}
+	return list
+}
+
+// takePending removes the pending deploy id and returns it, or nil if
+// there's none.
+func (o *Orchestrator) takePending(id string) *PendingDeploy {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, p := range o.pending {
+		if p.ID == id {
+			o.pending = append(o.pending[:i], o.pending[i+1:]...)
+			return p
+		}
+	}
+	return nil
+}
+
+// --- GET /deploys/pending, POST /deploys/pending/:id/{approve,reject} ---
+
+func (o *Orchestrator) handlePending(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/deploys/pending")
+	if rest == "" {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+		list := o.PendingDeploys()
+		if list == nil {
+			list = []PendingDeploy{}
+		}
+		writeJSON(w, 200, list)
+		return
+	}
+	id, action, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+	if r.Method != "POST" || (action != "approve" && action != "reject") {
+		http.NotFound(w, r)
+		return
+	}
+	if !o.vouched(r) {
+		writeJSON(w, 401, map[string]string{"error": "deciding on a pending deploy needs the admin token (Authorization: Bearer), or a signed-in chat or dashboard user"})
+		return
+	}
+	p := o.takePending(id)
+	if p == nil {
+		writeJSON(w, 404, map[string]string{"error": "no pending deploy " + id + ": it was approved or rejected already, or the daemon restarted"})
+		return
+	}
+	if action == "reject" {
+		fmt.Printf("deploy %s rejected (%s)\n", ShortHash(p.Commit), p.ID)
+		o.Publish(EventDeployRejected, p.Commit, "", PendingDecision{*p, "rejected"})
+		writeJSON(w, 200, PendingDecision{*p, "rejected"})
+		return
+	}
+	fmt.Printf("deploy %s approved (%s)\n", ShortHash(p.Commit), p.ID)
+	o.Publish(EventDeployApproved, p.Commit, "", PendingDecision{*p, "approved"})
+	opts := p.opts
+	opts.Approved = true
+	o.serveDeploy(w, r, p.Commit, opts)
+}
@@ -0,0 +1,355 @@
+package engine
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Artifact deploys skip git: a tarball built elsewhere (CI) is uploaded or
+// fetched, verified, and unpacked into staging. From there it follows the
+// normal setup/start/health/promote flow. The slot's "commit" is the
+// tarball's digest, "sha256:<hex>".
+
+const artifactPrefix = "sha256:"
+
+// isArtifact reports whether commit names an artifact digest rather than a
+// git commit.
+func isArtifact(commit string) bool {
+	return strings.HasPrefix(commit, artifactPrefix)
+}
+
+// artifactFetchTimeout bounds downloading an artifact_url.
+const artifactFetchTimeout = 10 * time.Minute
+
+// Default artifact_max_mb and artifact_max_unpacked_mb.
+const (
+	defaultArtifactMaxMB         = 1024
+	defaultArtifactMaxUnpackedMB = 4096
+)
+
+// artifactLimits returns how many bytes an artifact may have as a tarball,
+// and unpacked.
+func (o *Orchestrator) artifactLimits() (size, unpacked int64) {
+	o.mu.Lock()
+	size, unpacked = int64(o.cfg.ArtifactMaxMB), int64(o.cfg.ArtifactMaxUnpackedMB)
+	o.mu.Unlock()
+	if size <= 0 {
+		size = defaultArtifactMaxMB
+	}
+	if unpacked <= 0 {
+		unpacked = defaultArtifactMaxUnpackedMB
+	}
+	return size << 20, unpacked << 20
+}
+
+// tooLargeError is an artifact over the limit setting sets, in bytes.
+type tooLargeError struct {
+	setting string
+	limit   int64
+}
+
+func (e *tooLargeError) Error() string {
+	return fmt.Sprintf("larger than %s (%d MB)", e.setting, e.limit>>20)
+}
+
+// artifactStatus is the status for an error receiving an artifact: 413 if
+// it was too large, else 400.
+func artifactStatus(err error) int {
+	var tooLarge *tooLargeError
+	if errors.As(err, &tooLarge) {
+		return 413
+	}
+	return 400
+}
+
+// handleArtifactUpload serves POST /deploy with a multipart body: an
+// "artifact" file part and optional "sha256", "admin_token", "source", and
+// "message" fields.
+func (o *Orchestrator) handleArtifactUpload(w http.ResponseWriter, r *http.Request) {
+	size, _ := o.artifactLimits()
+	// The other fields and the multipart framing get a little room besides.
+	r.Body = http.MaxBytesReader(w, r.Body, size+1<<20)
+	path, digest, fields, err := o.receiveMultipart(r, size)
+	if path != "" {
+		defer os.Remove(path)
+	}
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		err = &tooLargeError{"artifact_max_mb", size}
+	}
+	if err != nil {
+		writeJSON(w, artifactStatus(err), DeployResponse{Error: "artifact: " + err.Error()})
+		return
+	}
+	source, err := deploySource(fields["source"])
+	if err != nil {
+		writeJSON(w, 400, DeployResponse{Error: err.Error()})
+		return
+	}
+	o.deployArtifact(w, r, path, digest, fields["sha256"], DeployOptions{
+		ForceSetup: r.URL.Query().Get("force_setup") == "true",
+		Force:      r.URL.Query().Get("force") == "true",
+		AdminToken: fields["admin_token"],
+		Source:     source,
+		Message:    fields["message"],
+	})
+}
+
+// handleArtifactURL serves POST /deploy with an artifact_url, which must
+// come with its sha256 since the download itself proves nothing.
+func (o *Orchestrator) handleArtifactURL(w http.ResponseWriter, r *http.Request, req deployRequest) {
+	if req.SHA256 == "" {
+		writeJSON(w, 400, DeployResponse{Error: "artifact_url requires sha256"})
+		return
+	}
+	size, _ := o.artifactLimits()
+	path, digest, err := o.fetchArtifact(req.ArtifactURL, size)
+	if path != "" {
+		defer os.Remove(path)
+	}
+	if err != nil {
+		writeJSON(w, artifactStatus(err), DeployResponse{Error: "artifact: " + err.Error()})
+		return
+	}
+	o.deployArtifact(w, r, path, digest, req.SHA256, DeployOptions{ForceSetup: req.ForceSetup, Force: req.Force, AdminToken: req.AdminToken, Source: req.Source, Message: req.Message})
+}
+
+// deployArtifact checks the received tarball against the expected digest,
+// if any, and deploys it.
+func (o *Orchestrator) deployArtifact(w http.ResponseWriter, r *http.Request, path, digest, want string, opts DeployOptions) {
+	want = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(want)), artifactPrefix)
+	if want != "" && want != digest {
+		writeJSON(w, 400, DeployResponse{Error: fmt.Sprintf("artifact: sha256 mismatch: got %s, want %s", digest, want)})
+		return
+	}
+	opts.Artifact = path
+	o.serveDeploy(w, r, artifactPrefix+digest, opts)
+}
+
+// receiveMultipart stores the "artifact" part of a multipart upload, of at
+// most limit bytes, and returns the other fields.
+func (o *Orchestrator) receiveMultipart(r *http.Request, limit int64) (path, digest string, fields map[string]string, err error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return "", "", nil, err
+	}
+	fields = map[string]string{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return path, "", nil, err
+		}
+		switch part.FormName() {
+		case "artifact":
+			if path != "" {
+				return path, "", nil, fmt.Errorf("more than one artifact")
+			}
+			if path, digest, err = o.saveArtifact(part, limit); err != nil {
+				return path, "", nil, err
+			}
+		case "sha256", "admin_token", "source", "message":
+			data, _ := io.ReadAll(io.LimitReader(part, 1024))
+			fields[part.FormName()] = strings.TrimSpace(string(data))
+		}
+		part.Close()
+	}
+	if path == "" {
+		return "", "", nil, fmt.Errorf("missing artifact part")
+	}
+	return path, digest, fields, nil
+}
+
+// fetchArtifact downloads url, of at most limit bytes, into the data dir.
+func (o *Orchestrator) fetchArtifact(url string, limit int64) (path, digest string, err error) {
+	client := &http.Client{Timeout: artifactFetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", "", fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	if resp.ContentLength > limit {
+		return "", "", &tooLargeError{"artifact_max_mb", limit}
+	}
+	return o.saveArtifact(resp.Body, limit)
+}
+
+// saveArtifact copies r, of at most limit bytes, to a temp file in the data
+// dir, hashing it on the way. The caller removes the file.
+func (o *Orchestrator) saveArtifact(r io.Reader, limit int64) (path, digest string, err error) {
+	f, err := os.CreateTemp(o.dataDir, "artifact-*.tar")
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r, limit+1))
+	if err != nil {
+		return f.Name(), "", err
+	}
+	if n > limit {
+		return f.Name(), "", &tooLargeError{"artifact_max_mb", limit}
+	}
+	return f.Name(), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// unpackArtifact replaces dir with the contents of the tarball at path
+// (gzipped or not). Entries that would land outside dir are rejected, as are
+// entries under a symlink the tarball itself made, and symlinks whose target
+// goes through one (see linkWithin): "x -> ." followed by "x/y -> .." would
+// otherwise put "y" one level above dir. The files may hold at most limit
+// bytes in all, however well they compress.
+func unpackArtifact(path, dir string, limit int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	left := limit              // bytes the files may still take
+	links := map[string]bool{} // symlinks made so far, relative to dir
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target, ok := withinDir(dir, hdr.Name)
+		if !ok {
+			return fmt.Errorf("entry %q escapes the slot directory", hdr.Name)
+		}
+		rel, _ := filepath.Rel(dir, target)
+		if underLink(links, rel) {
+			return fmt.Errorf("entry %q is under a symlink", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|syscall.O_NOFOLLOW, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			n, err := io.Copy(out, io.LimitReader(tr, left+1))
+			out.Close()
+			if err != nil {
+				return err
+			}
+			if left -= n; left < 0 {
+				return &tooLargeError{"artifact_max_unpacked_mb", limit}
+			}
+		case tar.TypeSymlink:
+			if filepath.IsAbs(hdr.Linkname) {
+				return fmt.Errorf("symlink %q is absolute", hdr.Name)
+			}
+			if !linkWithin(links, rel, hdr.Linkname) {
+				return fmt.Errorf("symlink %q escapes the slot directory", hdr.Name)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+			links[rel] = true
+		default:
+			// Hard links, devices, and the like have no place in an app bundle.
+		}
+	}
+}
+
+// underLink reports whether any parent of rel is one of links.
+func underLink(links map[string]bool, rel string) bool {
+	for p := filepath.Dir(rel); p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+		if links[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// linkWithin reports whether a symlink at rel to linkname stays in the slot
+// directory. The target is walked a component at a time, as the kernel
+// resolves it, and mustn't go through another of links: ".." after a link
+// climbs from where the link points, not from the link, so "t -> ."
+// followed by "s -> t/.." is the slot's parent, though "t/.." cleans to ".".
+// A target that is a link is fine, since that link was checked in turn.
+func linkWithin(links map[string]bool, rel, linkname string) bool {
+	var parts []string
+	if d := filepath.Dir(rel); d != "." {
+		parts = strings.Split(d, string(filepath.Separator))
+	}
+	atLink := false
+	for _, c := range strings.Split(linkname, "/") {
+		if c == "" || c == "." {
+			continue
+		}
+		if atLink {
+			return false
+		}
+		if c == ".." {
+			if len(parts) == 0 {
+				return false
+			}
+			parts = parts[:len(parts)-1]
+			continue
+		}
+		parts = append(parts, c)
+		atLink = links[filepath.Join(parts...)]
+	}
+	return true
+}
+
+// withinDir joins name onto dir, reporting false if the result leaves dir.
+func withinDir(dir, name string) (string, bool) {
+	target := filepath.Join(dir, name)
+	rel, err := filepath.Rel(dir, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return target, true
+}
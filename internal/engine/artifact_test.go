@@ -0,0 +1,252 @@
+package engine
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tarball builds a gzipped tar of files, in order.
+func tarball(t *testing.T, files ...[2]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f[0], Mode: 0644, Size: int64(len(f[1])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(f[1]))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// uploadArtifact posts data as a multipart deploy, with sum and any other
+// fields as name/value pairs.
+func uploadArtifact(t *testing.T, f *fakeEngine, data []byte, sum string, fields ...[2]string) (DeployResponse, int) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if sum != "" {
+		mw.WriteField("sha256", sum)
+	}
+	for _, kv := range fields {
+		mw.WriteField(kv[0], kv[1])
+	}
+	part, _ := mw.CreateFormFile("artifact", "build.tar.gz")
+	part.Write(data)
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/deploy", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, r)
+	var resp DeployResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp, w.Code
+}
+
+func TestArtifactDeploy(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	data := tarball(t, [2]string{"server.js", "listen()"}, [2]string{"public/index.html", "<h1>hi</h1>"})
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	resp, code := uploadArtifact(t, f, data, digest)
+	if code != 200 || !resp.Success {
+		t.Fatalf("deploy = %d %+v", code, resp)
+	}
+	if resp.Commit != "sha256:"+digest {
+		t.Fatalf("commit = %q", resp.Commit)
+	}
+	if resp.Slot != "slot-"+digest[:8] {
+		t.Fatalf("slot = %q", resp.Slot)
+	}
+	got, err := os.ReadFile(filepath.Join(f.dataDir, resp.Slot, "public", "index.html"))
+	if err != nil || string(got) != "<h1>hi</h1>" {
+		t.Fatalf("unpacked file = %q, %v", got, err)
+	}
+
+	// A git deploy afterwards checks out a fresh staging dir.
+	if resp, _ := f.Deploy("aaaa1111"); !resp.Success {
+		t.Fatalf("git deploy after artifact: %s", resp.Error)
+	}
+	if f.prevSlot == nil || f.prevSlot.commit != "sha256:"+digest {
+		t.Fatalf("prev = %+v", f.prevSlot)
+	}
+}
+
+func TestArtifactSource(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{DeployRateLimits: map[string]DeployRateLimit{"agent": {Max: 1, WindowSec: 60}}})
+	agent := [2]string{"source", "agent"}
+
+	if resp, code := uploadArtifact(t, f, tarball(t, [2]string{"server.js", "v1"}), "", agent); code != 200 || !resp.Success {
+		t.Fatalf("first agent deploy = %d %+v", code, resp)
+	}
+	if resp, code := uploadArtifact(t, f, tarball(t, [2]string{"server.js", "v2"}), "", agent); code != 429 {
+		t.Fatalf("second agent deploy = %d %+v, want 429", code, resp)
+	}
+	// Without a source, the upload is a human's and isn't limited.
+	if resp, code := uploadArtifact(t, f, tarball(t, [2]string{"server.js", "v3"}), ""); code != 200 || !resp.Success {
+		t.Fatalf("human deploy = %d %+v", code, resp)
+	}
+}
+
+func TestArtifactMessage(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	data := tarball(t, [2]string{"server.js", "listen()"})
+	if resp, code := uploadArtifact(t, f, data, "", [2]string{"message", "hotfix for checkout bug"}); code != 200 || !resp.Success {
+		t.Fatalf("deploy = %d %+v", code, resp)
+	}
+	entries, _ := f.readJournal()
+	if len(entries) != 1 || entries[0].Message != "hotfix for checkout bug" {
+		t.Fatalf("journal = %+v", entries)
+	}
+}
+
+func TestArtifactChecksumMismatch(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	data := tarball(t, [2]string{"server.js", "listen()"})
+
+	resp, code := uploadArtifact(t, f, data, strings.Repeat("0", 64))
+	if code != 400 || !strings.Contains(resp.Error, "sha256 mismatch") {
+		t.Fatalf("deploy = %d %+v", code, resp)
+	}
+	if f.HasLive() {
+		t.Fatal("mismatched artifact should not deploy")
+	}
+
+	// artifact_url without a checksum is refused before downloading.
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("POST", "/deploy", strings.NewReader(`{"artifact_url":"http://example.invalid/a.tgz"}`)))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "requires sha256") {
+		t.Fatalf("artifact_url without sha256 = %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestArtifactTooLarge(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{ArtifactMaxMB: 1, ArtifactMaxUnpackedMB: 1})
+
+	// Random bytes don't compress, so the tarball is over 1 MB.
+	noise := make([]byte, 2<<20)
+	rand.Read(noise)
+	big := tarball(t, [2]string{"server.js", string(noise)})
+	if resp, code := uploadArtifact(t, f, big, ""); code != 413 || !strings.Contains(resp.Error, "artifact_max_mb") {
+		t.Fatalf("upload = %d %+v, want 413", code, resp)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(big)
+	}))
+	defer srv.Close()
+	sum := sha256.Sum256(big)
+	body := fmt.Sprintf(`{"artifact_url":%q,"sha256":%q}`, srv.URL, hex.EncodeToString(sum[:]))
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("POST", "/deploy", strings.NewReader(body)))
+	if w.Code != 413 || !strings.Contains(w.Body.String(), "artifact_max_mb") {
+		t.Fatalf("artifact_url = %d %s, want 413", w.Code, w.Body)
+	}
+
+	// Zeros compress to almost nothing, but unpack to 2 MB.
+	bomb := tarball(t, [2]string{"server.js", string(make([]byte, 2<<20))})
+	if len(bomb) > 1<<20 {
+		t.Fatalf("bomb is %d bytes", len(bomb))
+	}
+	if resp, code := uploadArtifact(t, f, bomb, ""); code != 413 || !strings.Contains(resp.Error, "artifact_max_unpacked_mb") {
+		t.Fatalf("unpacking = %d %+v, want 413", code, resp)
+	}
+	if f.HasLive() {
+		t.Fatal("an artifact over the limits should not deploy")
+	}
+	matches, _ := filepath.Glob(filepath.Join(f.dataDir, "artifact-*"))
+	if len(matches) != 0 {
+		t.Fatalf("left behind: %v", matches)
+	}
+}
+
+func TestUnpackArtifactRejectsEscapes(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "evil.tar.gz")
+	os.WriteFile(path, tarball(t, [2]string{"../evil", "x"}), 0644)
+
+	if err := unpackArtifact(path, filepath.Join(dir, "slot"), 1<<20); err == nil {
+		t.Fatal("expected an error for ../evil")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil")); err == nil {
+		t.Fatal("entry was written outside the slot dir")
+	}
+}
+
+func TestUnpackArtifactRejectsChainedSymlinks(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "x", Linkname: ".", Typeflag: tar.TypeSymlink})
+	tw.WriteHeader(&tar.Header{Name: "x/y", Linkname: "..", Typeflag: tar.TypeSymlink})
+	tw.WriteHeader(&tar.Header{Name: "y/evil", Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+	tw.Write([]byte("x"))
+	tw.Close()
+	path := filepath.Join(dir, "evil.tar")
+	os.WriteFile(path, buf.Bytes(), 0644)
+
+	if err := unpackArtifact(path, filepath.Join(dir, "slot"), 1<<20); err == nil {
+		t.Fatal("expected an error for x/y under the x symlink")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil")); err == nil {
+		t.Fatal("entry was written outside the slot dir")
+	}
+
+	// Nor through a symlink in another's target: "t/.." cleans to ".",
+	// but on disk it's the slot's parent.
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "t", Linkname: ".", Typeflag: tar.TypeSymlink})
+	tw.WriteHeader(&tar.Header{Name: "s", Linkname: "t/..", Typeflag: tar.TypeSymlink})
+	tw.Close()
+	os.WriteFile(path, buf.Bytes(), 0644)
+	if err := unpackArtifact(path, filepath.Join(dir, "slot"), 1<<20); err == nil {
+		t.Fatal("expected an error for s -> t/.. through the t symlink")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "slot", "s")); err == nil {
+		t.Fatal("s was made")
+	}
+
+	// A regular file doesn't follow a symlink already at its path.
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "out", Linkname: "../outside", Typeflag: tar.TypeSymlink})
+	tw.WriteHeader(&tar.Header{Name: "out", Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+	tw.Write([]byte("x"))
+	tw.Close()
+	os.WriteFile(path, buf.Bytes(), 0644)
+	os.MkdirAll(filepath.Join(dir, "slot2"), 0755)
+
+	if err := unpackArtifact(path, filepath.Join(dir, "slot2", "app"), 1<<20); err == nil {
+		t.Fatal("expected an error writing through the out symlink")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "slot2", "outside")); err == nil {
+		t.Fatal("file was written through the symlink")
+	}
+}
@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The proxies listen on port (and tls_port) on every interface unless
+// bind_address names the hosts to listen on instead: "127.0.0.1" behind
+// nginx, or ["0.0.0.0", "::"] for IPv4 and IPv6 apart. internal_port
+// listens on internal_bind_address, by default the same hosts, so health
+// checks can be kept to a private interface.
+
+// BindAddrs is a host or list of hosts to listen on. In JSON it's a string
+// or an array of strings.
+type BindAddrs []string
+
+func (b *BindAddrs) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*b = nil
+		if one != "" {
+			*b = BindAddrs{one}
+		}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("want a host or a list of hosts: %w", err)
+	}
+	*b = many
+	return nil
+}
+
+// listenAddrs joins each host with port, or returns ":port" for no hosts.
+// Hosts can't carry a port of their own.
+func listenAddrs(hosts BindAddrs, port int) ([]string, error) {
+	if port == 0 {
+		return nil, nil
+	}
+	p := strconv.Itoa(port)
+	if len(hosts) == 0 {
+		return []string{":" + p}, nil
+	}
+	var addrs []string
+	for _, h := range hosts {
+		h = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(h), "["), "]")
+		if h == "" {
+			return nil, fmt.Errorf("empty host")
+		}
+		if _, _, err := net.SplitHostPort(h); err == nil {
+			return nil, fmt.Errorf("%q: give a host without a port", h)
+		}
+		addrs = append(addrs, net.JoinHostPort(h, p))
+	}
+	return addrs, nil
+}
+
+// ProxyAddrs returns the addresses the app proxy listens on for port and
+// tls_port, and the internal proxy for internal_port (none when it's the
+// same as port: the app proxy serves both).
+func ProxyAddrs(cfg Config) (app, tls, internal []string, err error) {
+	if app, err = listenAddrs(cfg.BindAddress, cfg.Port); err != nil {
+		return nil, nil, nil, fmt.Errorf("bind_address: %w", err)
+	}
+	if tls, err = listenAddrs(cfg.BindAddress, cfg.TLSPort); err != nil {
+		return nil, nil, nil, fmt.Errorf("bind_address: %w", err)
+	}
+	if cfg.InternalPort == 0 || cfg.InternalPort == cfg.Port {
+		return app, tls, nil, nil
+	}
+	hosts := cfg.InternalBindAddress
+	if len(hosts) == 0 {
+		hosts = cfg.BindAddress
+	}
+	if internal, err = listenAddrs(hosts, cfg.InternalPort); err != nil {
+		return nil, nil, nil, fmt.Errorf("internal_bind_address: %w", err)
+	}
+	return app, tls, internal, nil
+}
@@ -0,0 +1,49 @@
+package engine
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Chaos mode makes the races the design claims to survive more likely: it
+// sleeps a random while around proxy switches (before the app proxy moves,
+// and between it and the internal one) and before a draining slot is
+// signalled, so that requests, crashes, and other deploys land in windows
+// that are usually a few microseconds wide. It's for the spec suite, never
+// for production; the daemon only turns it on behind an env guard.
+
+// Chaos randomly delays proxy switches and drains.
+type Chaos struct {
+	maxDelay time.Duration
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// NewChaos returns a Chaos that delays each point by up to maxDelay, drawn
+// from seed so a failing run can be replayed.
+func NewChaos(maxDelay time.Duration, seed int64) *Chaos {
+	return &Chaos{maxDelay: maxDelay, rng: rand.New(rand.NewSource(seed))}
+}
+
+// delay sleeps a random 0..maxDelay at the named point. A nil Chaos doesn't.
+func (c *Chaos) delay(point string) {
+	if c == nil || c.maxDelay <= 0 {
+		return
+	}
+	c.mu.Lock()
+	d := time.Duration(c.rng.Int63n(int64(c.maxDelay) + 1))
+	c.mu.Unlock()
+	fmt.Printf("chaos: delaying %s by %s\n", point, d.Round(time.Millisecond))
+	time.Sleep(d)
+}
+
+// switchTargets points the proxies at a slot's ports, app port first.
+func (o *Orchestrator) switchTargets(appPort, intPort int) {
+	o.chaos.delay("proxy switch")
+	o.appProxy.SetTarget(appPort)
+	o.chaos.delay("internal proxy switch")
+	o.intProxy.SetTarget(intPort)
+}
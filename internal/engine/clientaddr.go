@@ -0,0 +1,72 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Behind a TCP load balancer or tunnel, connections come from the balancer
+// and the client's address is lost. proxy_protocol reads it from a PROXY
+// header the balancer sends (accept), and passes it on to the app the same
+// way (send). trusted_proxies lists the peers whose PROXY headers and
+// X-Forwarded-* headers are believed; the rest have theirs ignored or
+// dropped. See internal/proxy/proxyproto.go.
+
+// ProxyProtocol turns on the PROXY protocol on the app proxy.
+type ProxyProtocol struct {
+	Accept bool   `json:"accept"` // read a v1 or v2 header on port and tls_port
+	Send   string `json:"send"`   // "v1" or "v2": write one to the app (default: none)
+}
+
+// trustedProxies parses trusted_proxies: IPs and CIDRs.
+func trustedProxies(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if prefix, err := netip.ParsePrefix(s); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("trusted_proxies: %q is neither an IP nor a CIDR", s)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+// CheckClientAddrs validates proxy_protocol and trusted_proxies.
+func CheckClientAddrs(cfg Config) error {
+	if _, err := trustedProxies(cfg.TrustedProxies); err != nil {
+		return err
+	}
+	pp := cfg.ProxyProtocol
+	if pp == nil {
+		return nil
+	}
+	switch pp.Send {
+	case "", "v1", "v2":
+	default:
+		return fmt.Errorf("proxy_protocol.send must be \"v1\" or \"v2\", not %q", pp.Send)
+	}
+	if pp.Accept && len(cfg.TrustedProxies) == 0 {
+		return errors.New("proxy_protocol.accept needs trusted_proxies: otherwise any client could send a PROXY header naming any address")
+	}
+	if pp.Send != "" && cfg.H2C {
+		return errors.New("proxy_protocol.send needs a connection to the app per request, which h2c doesn't make")
+	}
+	return nil
+}
+
+// applyTrustedProxies hands trusted_proxies to the app proxy.
+func (o *Orchestrator) applyTrustedProxies() error {
+	prefixes, err := trustedProxies(o.cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	o.appProxy.SetTrustedProxies(prefixes)
+	return nil
+}
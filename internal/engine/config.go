@@ -0,0 +1,346 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// Config is the contents of slot-machine.json.
+type Config struct {
+	SetupCommand      string        `json:"setup_command"`
+	SetupCacheKeys    []string      `json:"setup_cache_keys"` // lockfiles; setup is skipped when they're unchanged
+	StartCommand      string        `json:"start_command"`
+	Port              int           `json:"port"`
+	InternalPort      int           `json:"internal_port"`
+	HealthEndpoint    string        `json:"health_endpoint"`
+	HealthTimeoutMs   int           `json:"health_timeout_ms"`
+	RecoveryTimeoutMs int           `json:"recovery_timeout_ms"` // health wait when restarting the live slot (default: 5m)
+	DrainTimeoutMs    int           `json:"drain_timeout_ms"`
+	ShutdownTimeoutMs int           `json:"shutdown_timeout_ms"` // for requests in flight when the daemon stops (default: 10000)
+	RetainReleases    int           `json:"retain_releases"`     // releases kept beyond live and prev, for rollback
+	HealthCacheTTLMs  int           `json:"health_cache_ttl_ms"` // reuse health results this long (0 = off)
+	AppHealthEndpoint string        `json:"app_health_endpoint"` // also check this path on the app port, in parallel
+	WarmupURLs        []string      `json:"warmup_urls"`         // paths requested from a new slot before it takes traffic
+	SmokeCommand      string        `json:"smoke_command"`       // run once a new slot is live; failure rolls back
+	ProxyRetries      int           `json:"proxy_retries"`       // resends of idempotent requests the live slot drops
+	FailoverGraceMs   int           `json:"failover_grace_ms"`   // after a switch, the old slot answers what the new one drops
+	StickySessions    bool          `json:"sticky_sessions"`     // keep clients on the slot that first answered them
+	StickyTTLMs       int           `json:"sticky_ttl_ms"`       // affinity cookie lifetime (default: 1h)
+	DeployPolicy      *DeployPolicy `json:"deploy_policy"`       // allowed signing keys and authors (default: no restriction)
+	EnvFile           string        `json:"env_file"`
+	EnvReload         string        `json:"env_reload"` // "manual" (default) or "auto": restart the live slot when env_file changes
+	APIPort           int           `json:"api_port"`
+	AgentAuth         string        `json:"agent_auth"`          // "hmac" (default), "trusted", "none"
+	AgentAllowedTools []string      `json:"agent_allowed_tools"` // claude --allowed-tools (default: standard set)
+	AgentExtraRepos   []ExtraRepo   `json:"agent_extra_repos"`   // other repos the agent may read, never write
+	AgentConcurrency  int           `json:"agent_concurrency"`   // agents running at once, others queue (default: 1)
+	AgentModel        string        `json:"agent_model"`         // claude --model (default: the CLI's)
+	AgentModelRules   []ModelRule   `json:"agent_model_rules"`   // models for some messages, first match wins over agent_model
+	AgentPrices       *TokenPrices  `json:"agent_prices"`        // to estimate agent cost (default: tokens only)
+	AgentRetainDays   int           `json:"agent_retain_days"`   // delete agent messages older than this (0 = keep)
+	AgentDBMaxMB      int           `json:"agent_db_max_mb"`     // delete the oldest agent messages past this size (0 = no limit)
+	SharedDirs        []string      `json:"shared_dirs"`         // dirs symlinked to shared persistent location
+	ManifestIgnore    []string      `json:"manifest_ignore"`     // slot paths left out of manifests, e.g. "log", "tmp/*"
+	PreviewDomain     string        `json:"preview_domain"`      // previews are served on <branch>.<preview_domain>
+	PreviewTTLMs      int           `json:"preview_ttl_ms"`      // previews are removed after this long (default: 24h)
+	ChatTitle         string        `json:"chat_title"`          // header title (default: "slot-machine")
+	ChatAccent        string        `json:"chat_accent"`         // CSS accent color (default: "#2563eb")
+	ChatPushSubject   string        `json:"chat_push_subject"`   // contact for push services, "mailto:..." or "https://..." (default: "mailto:slot-machine@localhost")
+	InterceptPrefix   string        `json:"intercept_prefix"`    // serve /chat and /agent/* under this path, e.g. "/_slot"
+	SlotHeaders       bool          `json:"slot_headers"`        // tell the app which slot a request reached, in X-SlotMachine-* headers
+
+	// Host routing on the app proxy; tls_port serves the hosts with a cert.
+	Hosts     map[string]HostConfig `json:"hosts"`
+	TLSPort   int                   `json:"tls_port"`   // 0 = no HTTPS listener
+	H2C       bool                  `json:"h2c"`        // HTTP/2 without TLS to the app, and on port (gRPC)
+	HTTP1Only bool                  `json:"http1_only"` // no HTTP/2 anywhere, even on tls_port
+
+	// Deploys the agent asks for wait for a human to approve them in the
+	// chat or dashboard (see approval.go).
+	AgentDeployApproval bool `json:"agent_deploy_approval"`
+
+	// With agent_auth "hmac", how long a signed X-SlotMachine-User is good
+	// for (default 300s), whether each is accepted only once, and whether
+	// the old "user:sig", which never expires, still is.
+	AgentAuthMaxAge int  `json:"agent_auth_max_age_sec"`
+	AgentAuthReplay bool `json:"agent_auth_replay_cache"`
+	AgentAuthLegacy bool `json:"agent_auth_legacy"`
+
+	// A text/template that replaces the agent's system prompt; {{.Base}}
+	// is the built-in one. Relative to the repo.
+	AgentPromptFile string `json:"agent_system_prompt_file"`
+
+	// The daemon installs new slot-machine releases itself; off unless set.
+	AutoUpdate *AutoUpdate `json:"auto_update"`
+
+	// The daemon exports its backup to object storage; off unless set.
+	StateBackup *StateBackup `json:"state_backup"`
+
+	// Services told about each deploy and rollback.
+	DeployTrackers []DeployTracker `json:"deploy_trackers"`
+
+	// For apps that bind a hardcoded port whatever PORT says: every slot
+	// gets these ports, and the live one is stopped before the next starts.
+	FixedPortMode     bool `json:"fixed_port_mode"`
+	FixedPort         int  `json:"fixed_port"`          // the port the app binds
+	FixedInternalPort int  `json:"fixed_internal_port"` // where it serves health_endpoint (default: fixed_port)
+
+	// [low, high]: slots get their ports only from this range, for
+	// firewalls that open no others (default: any free port).
+	SlotPortRange []int `json:"slot_port_range"`
+
+	// Paces health polls while a new slot boots (default: every 200ms for
+	// health_timeout_ms).
+	StartupProbe *StartupProbe `json:"startup_probe"`
+
+	// How long a new slot's POST to SLOT_MACHINE_READY_URL is waited for
+	// before polling health_endpoint (0 = no callback, only polls).
+	ReadyCallbackTimeoutMs int `json:"ready_callback_timeout_ms"`
+
+	// The branch GET /status compares the live commit with, fetched
+	// periodically so it knows what hasn't been deployed yet.
+	Upstream         string `json:"upstream"`           // remote branch (default: "origin/main")
+	UpstreamFetchSec int    `json:"upstream_fetch_sec"` // seconds between fetches (default: 300; -1 = never fetch)
+
+	// How a slot is told to stop: pre_stop_command first, in the slot's dir
+	// and environment, then stop_signal, then SIGKILL after
+	// drain_timeout_ms.
+	StopSignal     string `json:"stop_signal"`      // e.g. "SIGINT" (default: "SIGTERM")
+	PreStopCommand string `json:"pre_stop_command"` // e.g. a curl asking the app to stop taking work
+
+	// Restarts of a live slot whose process exits on its own, until it
+	// crashes too often (default: on, 5 crashes in 5 minutes).
+	CrashRestart *CrashRestart `json:"crash_restart"`
+
+	// Checks of the slots' files against their commits; off unless set.
+	DriftCheck *DriftCheck `json:"drift_check"`
+
+	// Where deploys that ask for a fetch get commits the server's repo
+	// hasn't seen yet, and the SSH key to fetch with.
+	Remote        string `json:"remote"`          // default: upstream's remote
+	DeployKeyFile string `json:"deploy_key_file"` // private key, relative to the repo (default: ssh's own config)
+
+	// How large an artifact deploy may be, so one can't fill the disk the
+	// journal and state live on (see artifact.go).
+	ArtifactMaxMB         int `json:"artifact_max_mb"`          // the tarball as uploaded or fetched (default: 1024)
+	ArtifactMaxUnpackedMB int `json:"artifact_max_unpacked_mb"` // its files once unpacked (default: 4096)
+
+	// How often deploys requested by the agent, people, or webhooks may
+	// start, and whether a quick series of them deploys only the latest.
+	DeployMinIntervalMs int                        `json:"deploy_min_interval_ms"` // between any two (0 = no minimum)
+	DeployRateLimits    map[string]DeployRateLimit `json:"deploy_rate_limits"`     // by source: "agent", "human", or "webhook"
+	DeployCoalesceMs    int                        `json:"deploy_coalesce_ms"`     // wait this long for a newer deploy first (0 = off)
+
+	// The hosts the proxies listen on (default: all interfaces; see bind.go).
+	BindAddress         BindAddrs `json:"bind_address"`          // for port and tls_port, e.g. "127.0.0.1"
+	InternalBindAddress BindAddrs `json:"internal_bind_address"` // for internal_port (default: bind_address)
+
+	// Client addresses behind a load balancer or tunnel (see clientaddr.go).
+	ProxyProtocol  *ProxyProtocol `json:"proxy_protocol"`  // PROXY protocol on the app proxy
+	TrustedProxies []string       `json:"trusted_proxies"` // IPs and CIDRs whose PROXY and X-Forwarded-* headers count (default: all)
+
+	// A cloudflared or ngrok tunnel making the app public (see expose.go).
+	Expose *Expose `json:"expose"`
+
+	// Limits on how long the app proxy waits on the live slot, and a
+	// circuit breaker that stops sending it requests while it fails (see
+	// internal/proxy/breaker.go).
+	UpstreamTimeoutMs int             `json:"upstream_timeout_ms"` // for the response headers (0 = no limit)
+	PathTimeoutsMs    map[string]int  `json:"path_timeouts_ms"`    // by path prefix, the longest winning; 0 = no limit
+	CircuitBreaker    *CircuitBreaker `json:"circuit_breaker"`
+
+	// Stand by for another daemon, replicating it, until promoted (see
+	// peer.go).
+	Peer *Peer `json:"peer"`
+
+	// Start the daemon API read-only: only GETs are answered, everything
+	// else gets a 403 (see readonly.go).
+	ReadOnly bool `json:"read_only"`
+}
+
+// CircuitBreaker configures the app proxy's circuit breaker.
+type CircuitBreaker struct {
+	Failures int `json:"failures"` // failed requests in a row that open the circuit (default: 5)
+	OpenMs   int `json:"open_ms"`  // before a probe is let through (default: 10000)
+}
+
+// AutoUpdate has the daemon check for a new slot-machine release daily,
+// download and verify it, and restart onto it during Window.
+type AutoUpdate struct {
+	Channel  string   `json:"channel"`  // "stable" (default) or "prerelease"
+	Window   string   `json:"window"`   // local "HH:MM-HH:MM" to restart in, may wrap midnight (default: any time)
+	Webhooks []string `json:"webhooks"` // POSTed a JSON event when an update is installed or fails
+}
+
+// StateBackup has the daemon export a backup, as slot-machine backup
+// writes it, to S3-compatible storage every IntervalSec. The credentials
+// are read from the daemon's environment, never from the config.
+type StateBackup struct {
+	URL          string `json:"url"`            // s3://bucket/key; a key ending in / gets <app>.tar.gz
+	Endpoint     string `json:"endpoint"`       // e.g. "https://<account>.r2.cloudflarestorage.com" (default: AWS S3 in region)
+	Region       string `json:"region"`         // default: "us-east-1"
+	AccessKeyEnv string `json:"access_key_env"` // default: "AWS_ACCESS_KEY_ID"
+	SecretKeyEnv string `json:"secret_key_env"` // default: "AWS_SECRET_ACCESS_KEY"
+	IntervalSec  int    `json:"interval_sec"`   // default: 3600
+}
+
+// DeployTracker is an external service told about every deploy and
+// rollback, so its errors and graphs line up with releases. The API token
+// is read from the daemon's environment, never from the config.
+type DeployTracker struct {
+	Type        string   `json:"type"`        // "sentry", "grafana", or "honeycomb"
+	URL         string   `json:"url"`         // API base (default: the hosted service; required for grafana)
+	TokenEnv    string   `json:"token_env"`   // environment variable holding the API token
+	Org         string   `json:"org"`         // sentry organization
+	Project     string   `json:"project"`     // sentry project
+	Environment string   `json:"environment"` // sentry environment (default: "production")
+	Dataset     string   `json:"dataset"`     // honeycomb dataset (default: "__all__", environment-wide)
+	Tags        []string `json:"tags"`        // added to grafana annotations
+}
+
+// ExtraRepo is a repository the agent can read for context, e.g. a shared
+// library: cloned from URL into the data dir and kept up to date, or an
+// existing checkout at Path. It is never deployed.
+type ExtraRepo struct {
+	Name string `json:"name"` // directory name, and what the agent calls it
+	URL  string `json:"url"`
+	Ref  string `json:"ref"`  // branch or tag to check out (default: the remote's HEAD)
+	Path string `json:"path"` // instead of URL; relative to the repo
+}
+
+// ModelRule picks the agent's model for a message when all its conditions
+// hold; a rule without conditions always does.
+type ModelRule struct {
+	Model       string `json:"model"`
+	MaxMessages int    `json:"max_messages"` // the conversation has at most this many user messages, this one included (0 = any)
+	Match       string `json:"match"`        // a regexp the message matches, ignoring case
+}
+
+// defaultAuthMaxAge is how long a signed X-SlotMachine-User is good for
+// unless agent_auth_max_age_sec says otherwise.
+const defaultAuthMaxAge = 5 * time.Minute
+
+// AuthMaxAge is agent_auth_max_age_sec, or its default.
+func AuthMaxAge(cfg Config) time.Duration {
+	if cfg.AgentAuthMaxAge > 0 {
+		return time.Duration(cfg.AgentAuthMaxAge) * time.Second
+	}
+	return defaultAuthMaxAge
+}
+
+// CheckModelRules validates agent_model_rules.
+func CheckModelRules(cfg Config) error {
+	for i, r := range cfg.AgentModelRules {
+		if r.Model == "" {
+			return fmt.Errorf("agent_model_rules[%d]: model is required", i)
+		}
+		if r.MaxMessages < 0 {
+			return fmt.Errorf("agent_model_rules[%d]: max_messages must not be negative", i)
+		}
+		if _, err := regexp.Compile("(?i)" + r.Match); err != nil {
+			return fmt.Errorf("agent_model_rules[%d]: match: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// TokenPrices are the model's prices in USD per million tokens, used to
+// estimate what the agent costs.
+type TokenPrices struct {
+	Input      float64 `json:"input"`
+	Output     float64 `json:"output"`
+	CacheRead  float64 `json:"cache_read"`
+	CacheWrite float64 `json:"cache_write"`
+}
+
+// Reload swaps in cfg without restarting anything; the new settings apply
+// from the next deploy, health poll, or drain. The public ports can't change
+// under a running daemon, so they keep their old values and their JSON names
+// are returned. Reload fails while a deploy, rollback, or recovery runs.
+func (o *Orchestrator) Reload(cfg Config) (kept []string, err error) {
+	release, holder, ok := o.locks.TryAcquire(o.app, "reload", "")
+	if !ok {
+		return nil, fmt.Errorf("%s in progress", holder.Action)
+	}
+	defer release()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.recovering != nil {
+		return nil, errors.New("recovery in progress")
+	}
+
+	if cfg.Port != o.cfg.Port {
+		kept = append(kept, "port")
+		cfg.Port = o.cfg.Port
+	}
+	if cfg.InternalPort != o.cfg.InternalPort {
+		kept = append(kept, "internal_port")
+		cfg.InternalPort = o.cfg.InternalPort
+	}
+	if cfg.TLSPort != o.cfg.TLSPort {
+		kept = append(kept, "tls_port")
+		cfg.TLSPort = o.cfg.TLSPort
+	}
+	if !slices.Equal(cfg.BindAddress, o.cfg.BindAddress) {
+		kept = append(kept, "bind_address")
+		cfg.BindAddress = o.cfg.BindAddress
+	}
+	if !slices.Equal(cfg.InternalBindAddress, o.cfg.InternalBindAddress) {
+		kept = append(kept, "internal_bind_address")
+		cfg.InternalBindAddress = o.cfg.InternalBindAddress
+	}
+	if cfg.H2C != o.cfg.H2C {
+		kept = append(kept, "h2c")
+		cfg.H2C = o.cfg.H2C
+	}
+	if cfg.HTTP1Only != o.cfg.HTTP1Only {
+		kept = append(kept, "http1_only")
+		cfg.HTTP1Only = o.cfg.HTTP1Only
+	}
+	if !reflect.DeepEqual(cfg.ProxyProtocol, o.cfg.ProxyProtocol) {
+		kept = append(kept, "proxy_protocol")
+		cfg.ProxyProtocol = o.cfg.ProxyProtocol
+	}
+	if !reflect.DeepEqual(cfg.Expose, o.cfg.Expose) {
+		kept = append(kept, "expose")
+		cfg.Expose = o.cfg.Expose
+	}
+	if !reflect.DeepEqual(cfg.Peer, o.cfg.Peer) {
+		kept = append(kept, "peer")
+		cfg.Peer = o.cfg.Peer
+	}
+	if err := CheckClientAddrs(cfg); err != nil {
+		return nil, err
+	}
+	if err := CheckSlotPortRange(cfg); err != nil {
+		return nil, err
+	}
+	hosts, err := o.loadHosts(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// The live release's config still applies over the new file's.
+	o.releaseBase = cfg
+	o.releaseCfg.apply(&cfg)
+
+	o.healthMu.Lock()
+	o.cfg = cfg
+	o.lastHealth = nil
+	o.healthMu.Unlock()
+	o.applyHealthCache()
+	o.applyPreviewDomain()
+	o.appProxy.SetHosts(hosts)
+	o.appProxy.SetRetries(cfg.ProxyRetries)
+	o.appProxy.SetInterceptPrefix(cfg.InterceptPrefix)
+	o.appProxy.SetSlotHeaders(cfg.SlotHeaders)
+	o.applyAffinity()
+	o.applyTrustedProxies()
+	o.applyUpstreamLimits()
+	return kept, nil
+}
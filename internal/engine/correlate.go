@@ -0,0 +1,69 @@
+package engine
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// GET /logs?correlate=<id> follows one request through the logs: the
+// proxy's access log line for it, then every line of slot output that
+// mentions it, which there are when the app logs X-Request-Id. Each line is
+// prefixed with where it came from.
+
+// accessLogName is the app proxy's access log in the data dir.
+const accessLogName = "access.log"
+
+// minCorrelateID keeps a short id from matching half the logs.
+const minCorrelateID = 6
+
+// maxCorrelateLines caps the response for an id that's everywhere.
+const maxCorrelateLines = 1000
+
+func (o *Orchestrator) handleCorrelate(w http.ResponseWriter, id string) {
+	if len(id) < minCorrelateID {
+		writeJSON(w, 400, LogsResponse{Error: "correlate needs a request ID of at least 6 characters"})
+		return
+	}
+	lines := []string{}
+	access := filepath.Join(o.dataDir, accessLogName)
+	for _, path := range []string{access + ".1", access} {
+		lines = grepFile(lines, path, id, "[proxy] ")
+	}
+
+	// Slot output is kept as <slot dir>.log, previews' included, after the
+	// slot is gone.
+	logs, _ := filepath.Glob(filepath.Join(o.dataDir, "*.log"))
+	sort.Strings(logs)
+	for _, path := range logs {
+		if filepath.Base(path) == accessLogName {
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(path), ".log")
+		lines = grepFile(lines, path, id, "["+name+"] ")
+	}
+	if len(lines) > maxCorrelateLines {
+		lines = lines[:maxCorrelateLines]
+	}
+	writeJSON(w, 200, LogsResponse{Lines: lines})
+}
+
+// grepFile appends the lines of path containing s to lines, with prefix.
+func grepFile(lines []string, path, s, prefix string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return lines
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		if strings.Contains(sc.Text(), s) {
+			lines = append(lines, prefix+sc.Text())
+		}
+	}
+	return lines
+}
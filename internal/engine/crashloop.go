@@ -0,0 +1,177 @@
+package engine
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The live slot's process can exit on its own: a panic, an OOM kill, a bug
+// that only shows under traffic. The proxy answers 503 until something
+// replaces it, so the daemon restarts it in place, on the same ports,
+// after a delay that doubles with each crash. Restarting a release that
+// keeps crashing only burns CPU and floods the log, so once it has crashed
+// crash_restart.max_crashes times within window_sec the daemon stops
+// trying: GET /status says "crash-loop" and suggests a rollback, and
+// crash_restart.webhooks are told. A deploy, rollback, or restart ends it.
+
+const (
+	defaultMaxCrashes  = 5
+	defaultCrashWindow = 5 * time.Minute
+	maxCrashDelay      = 30 * time.Second
+)
+
+// CrashRestart configures restarts of a live slot whose process exits on
+// its own.
+type CrashRestart struct {
+	MaxCrashes int      `json:"max_crashes"` // crashes within the window that end the restarts (default: 5; -1 = never restart)
+	WindowSec  int      `json:"window_sec"`  // default: 300
+	Webhooks   []string `json:"webhooks"`    // POSTed a JSON crash_loop event
+}
+
+// CrashLoop is a live slot the daemon stopped restarting.
+type CrashLoop struct {
+	Slot       string `json:"slot"`
+	Commit     string `json:"commit"`
+	Crashes    int    `json:"crashes"` // within WindowSec
+	WindowSec  int    `json:"window_sec"`
+	Since      string `json:"since"`              // RFC3339, when restarts stopped
+	Rollback   string `json:"rollback,omitempty"` // the commit POST /rollback would go back to
+	Suggestion string `json:"suggestion"`
+	Log        string `json:"log,omitempty"` // tail of the slot's output
+}
+
+// crashLimits returns crash_restart's settings, with defaults filled in;
+// limit is negative when restarts are off. o.mu must be held.
+func (o *Orchestrator) crashLimits() (limit int, window time.Duration) {
+	limit, window = defaultMaxCrashes, defaultCrashWindow
+	if c := o.cfg.CrashRestart; c != nil {
+		if c.MaxCrashes != 0 {
+			limit = c.MaxCrashes
+		}
+		if c.WindowSec > 0 {
+			window = time.Duration(c.WindowSec) * time.Second
+		}
+	}
+	return limit, window
+}
+
+// liveCrashed restarts s, the live slot, whose process exited on its own,
+// until it stays up, something else replaces it, or it crashes too often.
+func (o *Orchestrator) liveCrashed(s *slot) {
+	for {
+		delay, loop := o.countCrash(s)
+		if loop != nil {
+			o.reportCrashLoop(*loop)
+			return
+		}
+		if delay < 0 {
+			return
+		}
+		o.Publish(EventSlotCrashed, s.commit, s.name, SlotCrash{RestartInMs: delay.Milliseconds()})
+		fmt.Printf("warning: live slot %s exited; restarting it in %s\n", s.name, delay)
+		time.Sleep(delay)
+
+		release, _, ok := o.locks.TryAcquire(o.app, "restart", s.commit)
+		if !ok {
+			return // a deploy or rollback is replacing it
+		}
+		o.mu.Lock()
+		current := o.liveSlot == s && o.recovering == nil && !o.stopping
+		o.mu.Unlock()
+		var r *slot
+		if current {
+			r = o.restartLive(newSlotState(s))
+		}
+		release()
+		if r == nil {
+			return
+		}
+		if o.awaitRecovery(r, o.startupTimeout()) {
+			o.Publish(EventSlotRestarted, r.commit, r.name, nil)
+			return
+		}
+		// It never came up: another crash, unless it was superseded.
+		o.mu.Lock()
+		current = o.liveSlot == s
+		o.mu.Unlock()
+		if !current {
+			return
+		}
+	}
+}
+
+// countCrash records a crash of s and returns how long to wait before
+// restarting it, negative if restarts are off, or the crash loop it makes.
+func (o *Orchestrator) countCrash(s *slot) (time.Duration, *CrashLoop) {
+	o.mu.Lock()
+	limit, window := o.crashLimits()
+	if limit < 0 {
+		o.mu.Unlock()
+		return -1, nil
+	}
+	now := time.Now()
+	o.crashes = append(slices.DeleteFunc(o.crashes, func(t time.Time) bool { return now.Sub(t) > window }), now)
+	n := len(o.crashes)
+	if n < limit {
+		o.mu.Unlock()
+		return min(time.Second<<(n-1), maxCrashDelay), nil
+	}
+
+	loop := &CrashLoop{
+		Slot:       s.name,
+		Commit:     s.commit,
+		Crashes:    n,
+		WindowSec:  int(window / time.Second),
+		Since:      now.Format(time.RFC3339),
+		Suggestion: "deploy a fix: POST /deploy, or slot-machine deploy",
+	}
+	if o.prevSlot != nil {
+		loop.Rollback = o.prevSlot.commit
+		loop.Suggestion = fmt.Sprintf("roll back to %s: POST /rollback, or slot-machine rollback", ShortHash(o.prevSlot.commit))
+	}
+	o.mu.Unlock()
+
+	if lines, err := tailFile(s.logPath, healthLogLines); err == nil && len(lines) > 0 {
+		loop.Log = strings.Join(lines, "\n") + "\n"
+	}
+	o.mu.Lock()
+	o.crashLoop = loop
+	o.mu.Unlock()
+	return 0, loop
+}
+
+// reportCrashLoop logs c and publishes it.
+func (o *Orchestrator) reportCrashLoop(c CrashLoop) {
+	fmt.Printf("warning: live slot %s crashed %d times in %ds; not restarting it again. To recover, %s\n", c.Slot, c.Crashes, c.WindowSec, c.Suggestion)
+	o.Publish(EventCrashLoop, c.Commit, c.Slot, c)
+}
+
+// postCrashWebhooks posts a crash_loop event to crash_restart.webhooks.
+func (o *Orchestrator) postCrashWebhooks(e DaemonEvent) {
+	c, ok := e.Data.(CrashLoop)
+	if !ok {
+		return
+	}
+	o.mu.Lock()
+	var hooks []string
+	if o.cfg.CrashRestart != nil {
+		hooks = o.cfg.CrashRestart.Webhooks
+	}
+	o.mu.Unlock()
+
+	event := struct {
+		Event string `json:"event"`
+		App   string `json:"app"`
+		CrashLoop
+	}{EventCrashLoop, o.app, c}
+	for _, url := range hooks {
+		go func() {
+			if err := postTrackerJSON(url, http.Header{}, event); err != nil {
+				fmt.Printf("warning: crash_restart webhook %s: %v\n", url, err)
+			}
+		}()
+	}
+}
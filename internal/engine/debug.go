@@ -0,0 +1,51 @@
+package engine
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// The /debug endpoints are for diagnosing a daemon in the field: memory
+// growth through pprof, deadlocks through /debug/state and the goroutine
+// profile. They exist only when the daemon has a debug token, and every
+// request must carry it, as "Authorization: Bearer <token>" or, for tools
+// that only take a URL (go tool pprof), "?token=<token>".
+
+func (o *Orchestrator) handleDebug(w http.ResponseWriter, r *http.Request) {
+	if o.debugToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !o.checkDebugToken(r) {
+		writeJSON(w, 401, map[string]string{"error": "invalid debug token"})
+		return
+	}
+
+	switch name, _ := strings.CutPrefix(r.URL.Path, "/debug/pprof/"); {
+	case r.URL.Path == "/debug/state":
+		writeJSON(w, 200, o.Snapshot())
+	case !strings.HasPrefix(r.URL.Path, "/debug/pprof/"):
+		http.NotFound(w, r)
+	case name == "cmdline":
+		pprof.Cmdline(w, r)
+	case name == "profile":
+		pprof.Profile(w, r)
+	case name == "symbol":
+		pprof.Symbol(w, r)
+	case name == "trace":
+		pprof.Trace(w, r)
+	default:
+		// The index, and named profiles: heap, goroutine, allocs, block...
+		pprof.Index(w, r)
+	}
+}
+
+func (o *Orchestrator) checkDebugToken(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = auth
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(o.debugToken)) == 1
+}
@@ -0,0 +1,3002 @@
+package engine
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"slot-machine/internal/proxy"
+)
+
+func TestDeployWithFakes(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		setup     func(f *fakeEngine)
+		wantCode  int
+		wantOK    bool
+		wantError string
+		wantSlot  string
+		wantProcs int
+	}{
+		{
+			name:      "healthy",
+			wantCode:  200,
+			wantOK:    true,
+			wantSlot:  "slot-aaaa1111",
+			wantProcs: 1,
+		},
+		{
+			name:      "health check fails",
+			setup:     func(f *fakeEngine) { f.health.results = []bool{false} },
+			wantCode:  200,
+			wantError: errHealthCheckFailed,
+			wantProcs: 1,
+		},
+		{
+			name:      "checkout fails",
+			setup:     func(f *fakeEngine) { f.worktrees.checkoutErr = errFake },
+			wantCode:  500,
+			wantError: "fake failure",
+		},
+		{
+			name: "setup fails",
+			setup: func(f *fakeEngine) {
+				f.cfg.SetupCommand = "make"
+				f.runner.setupErr = errFake
+			},
+			wantCode:  500,
+			wantError: "setup: fake failure",
+		},
+		{
+			name:      "start fails",
+			setup:     func(f *fakeEngine) { f.runner.startErr = errFake },
+			wantCode:  500,
+			wantError: "start: fake failure",
+		},
+		{
+			name:      "promotion fails",
+			setup:     func(f *fakeEngine) { f.worktrees.promoteErr = errFake },
+			wantCode:  200,
+			wantOK:    true,
+			wantSlot:  deployDirPrefix,
+			wantProcs: 1,
+		},
+		{
+			name:      "deploy in progress",
+			setup:     func(f *fakeEngine) { f.locks.TryAcquire(f.app, "deploy", "cccc3333") },
+			wantCode:  409,
+			wantError: errDeployInProgress,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			f := newFakeEngine(t, Config{})
+			if tt.setup != nil {
+				tt.setup(f)
+			}
+
+			resp, code := f.Deploy("aaaa1111bbbb2222")
+			if code != tt.wantCode {
+				t.Errorf("code = %d, want %d", code, tt.wantCode)
+			}
+			if resp.Success != tt.wantOK {
+				t.Errorf("success = %v, want %v (error %q)", resp.Success, tt.wantOK, resp.Error)
+			}
+			if tt.wantError != "" && !strings.Contains(resp.Error, tt.wantError) {
+				t.Errorf("error = %q, want %q", resp.Error, tt.wantError)
+			}
+			// A deploy that couldn't be promoted runs from its own dir.
+			if resp.Slot != tt.wantSlot && !(tt.wantSlot == deployDirPrefix && strings.HasPrefix(resp.Slot, deployDirPrefix)) {
+				t.Errorf("slot = %q, want %q", resp.Slot, tt.wantSlot)
+			}
+			if procs := f.runner.started(); len(procs) != tt.wantProcs {
+				t.Errorf("started %d processes, want %d", len(procs), tt.wantProcs)
+			}
+
+			if tt.wantOK {
+				if !f.HasLive() {
+					t.Error("expected a live slot")
+				}
+				if got := f.symlinkTarget("live"); got != resp.Slot {
+					t.Errorf("live symlink = %q, want %q", got, tt.wantSlot)
+				}
+				entries, _ := f.readJournal()
+				if len(entries) != 1 || entries[0].Action != "deploy" {
+					t.Errorf("journal = %+v", entries)
+				}
+				return
+			}
+
+			if f.HasLive() {
+				t.Error("failed deploy must not leave a live slot")
+			}
+			for _, p := range f.runner.started() {
+				if sigs := p.received(); len(sigs) == 0 || sigs[len(sigs)-1] != syscall.SIGKILL {
+					t.Errorf("failed slot should be killed, got signals %v", sigs)
+				}
+			}
+		})
+	}
+}
+
+func TestDeployDrainsPreviousLive(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+
+	if resp, _ := f.Deploy("aaaa1111"); !resp.Success {
+		t.Fatalf("first deploy: %s", resp.Error)
+	}
+	resp, _ := f.Deploy("bbbb2222")
+	if !resp.Success {
+		t.Fatalf("second deploy: %s", resp.Error)
+	}
+	if resp.PreviousCommit != "aaaa1111" {
+		t.Errorf("previous_commit = %q", resp.PreviousCommit)
+	}
+
+	procs := f.runner.started()
+	if sigs := procs[0].received(); len(sigs) != 1 || sigs[0] != syscall.SIGTERM {
+		t.Errorf("old live should get a single SIGTERM, got %v", sigs)
+	}
+	if got := f.symlinkTarget("prev"); got != "slot-aaaa1111" {
+		t.Errorf("prev symlink = %q", got)
+	}
+}
+
+func TestDrainStopSignalAndPreStop(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{StopSignal: "int", PreStopCommand: "pre-stop"})
+
+	f.Deploy("aaaa1111")
+	if resp, _ := f.Deploy("bbbb2222"); !resp.Success {
+		t.Fatalf("second deploy: %s", resp.Error)
+	}
+	if sigs := f.runner.started()[0].received(); len(sigs) != 1 || sigs[0] != syscall.SIGINT {
+		t.Errorf("old live should get a single SIGINT, got %v", sigs)
+	}
+	f.runner.mu.Lock()
+	preStops := f.runner.preStops
+	f.runner.mu.Unlock()
+	if want := []string{"slot-aaaa1111 []"}; !slices.Equal(preStops, want) {
+		t.Errorf("pre-stop runs = %q, want %q (before any signal)", preStops, want)
+	}
+
+	f.cfg.StopSignal = "SIGBOGUS"
+	if got := f.stopSignal(); got != syscall.SIGTERM {
+		t.Errorf("unknown stop_signal: %v, want SIGTERM", got)
+	}
+}
+
+func TestDeployDrainTimeout(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{DrainTimeoutMs: 50})
+	f.runner.ignoreTerm = true
+
+	f.Deploy("aaaa1111")
+	start := time.Now()
+	if resp, _ := f.Deploy("bbbb2222"); !resp.Success {
+		t.Fatalf("second deploy: %s", resp.Error)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("deploy returned after %v, before the drain timeout", elapsed)
+	}
+
+	sigs := f.runner.started()[0].received()
+	if len(sigs) != 2 || sigs[0] != syscall.SIGTERM || sigs[1] != syscall.SIGKILL {
+		t.Errorf("stubborn process should get SIGTERM then SIGKILL, got %v", sigs)
+	}
+}
+
+func TestRollbackWithFakes(t *testing.T) {
+	t.Parallel()
+
+	t.Run("no previous slot", func(t *testing.T) {
+		t.Parallel()
+		f := newFakeEngine(t, Config{})
+		f.Deploy("aaaa1111")
+		resp, code := f.Rollback()
+		if code != 400 || resp.Error != "no previous slot" {
+			t.Fatalf("got %d %q", code, resp.Error)
+		}
+	})
+
+	t.Run("swaps back", func(t *testing.T) {
+		t.Parallel()
+		f := newFakeEngine(t, Config{})
+		f.Deploy("aaaa1111")
+		f.Deploy("bbbb2222")
+
+		resp, code := f.Rollback()
+		if code != 200 || !resp.Success {
+			t.Fatalf("rollback: %d %q", code, resp.Error)
+		}
+		if resp.Commit != "aaaa1111" || resp.Slot != "slot-aaaa1111" {
+			t.Errorf("rolled back to %s (%s)", resp.Commit, resp.Slot)
+		}
+		if got := f.symlinkTarget("live"); got != "slot-aaaa1111" {
+			t.Errorf("live symlink = %q", got)
+		}
+		if got := f.symlinkTarget("prev"); got != "slot-bbbb2222" {
+			t.Errorf("prev symlink = %q", got)
+		}
+	})
+
+	t.Run("health check fails", func(t *testing.T) {
+		t.Parallel()
+		f := newFakeEngine(t, Config{})
+		f.Deploy("aaaa1111")
+		f.Deploy("bbbb2222")
+		f.health.results = []bool{false}
+
+		resp, code := f.Rollback()
+		if code != 500 || resp.Error != errHealthCheckFailed {
+			t.Fatalf("got %d %q", code, resp.Error)
+		}
+		if got := f.symlinkTarget("live"); got != "slot-bbbb2222" {
+			t.Errorf("live should be unchanged, got %q", got)
+		}
+	})
+}
+
+func TestCrashClearsLive(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	f.Deploy("aaaa1111")
+
+	f.runner.started()[0].exit()
+	<-f.liveSlot.done
+
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	var sr StatusResponse
+	json.Unmarshal(w.Body.Bytes(), &sr)
+	if sr.Healthy {
+		t.Errorf("crashed slot should not report healthy: %s", w.Body.String())
+	}
+}
+
+// restart builds a second engine over f's data dir with fresh fakes, as if
+// the daemon had been restarted.
+func (f *fakeEngine) restart(t *testing.T) *fakeEngine {
+	t.Helper()
+	f.DrainAll()
+	g := &fakeEngine{
+		runner:    &fakeRunner{},
+		worktrees: &fakeWorktrees{},
+		health:    &fakeHealth{},
+	}
+	g.Orchestrator = New(Options{
+		Config:    f.cfg,
+		RepoDir:   f.repoDir,
+		DataDir:   f.dataDir,
+		Runner:    g.runner,
+		Worktrees: g.worktrees,
+		Health:    g.health,
+	})
+	t.Cleanup(g.DrainAll)
+	return g
+}
+
+func TestRecoverStateFromStateFile(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	f.Deploy("aaaa1111")
+	f.Deploy("bbbb2222")
+	lastDeploy := f.lastDeploy.Truncate(time.Second)
+	oldApp := f.liveSlot.appPort
+
+	// The fresh fakes know no commits, so anything recovered came from
+	// state.json rather than the worktrees.
+	g := f.restart(t)
+	<-g.RecoverState()
+
+	if !g.HasLive() || g.liveSlot.commit != "bbbb2222" || g.liveSlot.name != "slot-bbbb2222" {
+		t.Fatalf("live = %+v", g.liveSlot)
+	}
+	if g.prevSlot == nil || g.prevSlot.commit != "aaaa1111" {
+		t.Fatalf("prev = %+v", g.prevSlot)
+	}
+	if !g.lastDeploy.Equal(lastDeploy) {
+		t.Errorf("lastDeploy = %v, want %v", g.lastDeploy, lastDeploy)
+	}
+	if g.liveSlot.appPort != oldApp {
+		t.Errorf("app port = %d, want previous port %d reused", g.liveSlot.appPort, oldApp)
+	}
+}
+
+func TestRecoverStateFallsBackToSymlinks(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	f.Deploy("aaaa1111")
+	f.Deploy("bbbb2222")
+	os.Remove(filepath.Join(f.dataDir, "state.json"))
+
+	g := f.restart(t)
+	g.worktrees.set(filepath.Join(f.dataDir, "slot-bbbb2222"), "bbbb2222")
+	g.worktrees.set(filepath.Join(f.dataDir, "slot-aaaa1111"), "aaaa1111")
+	<-g.RecoverState()
+
+	if !g.HasLive() || g.liveSlot.commit != "bbbb2222" {
+		t.Fatalf("live = %+v", g.liveSlot)
+	}
+	if g.prevSlot == nil || g.prevSlot.commit != "aaaa1111" {
+		t.Fatalf("prev = %+v", g.prevSlot)
+	}
+	if _, err := os.Stat(filepath.Join(f.dataDir, "state.json")); err != nil {
+		t.Errorf("recovery should write state.json: %v", err)
+	}
+}
+
+func TestRecoverStateIgnoresUnknownVersion(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	f.Deploy("aaaa1111")
+	os.WriteFile(filepath.Join(f.dataDir, "state.json"), []byte(`{"version":99,"live":{"name":"slot-zzz","commit":"zzz"}}`), 0644)
+
+	g := f.restart(t)
+	g.worktrees.set(filepath.Join(f.dataDir, "slot-aaaa1111"), "aaaa1111")
+	<-g.RecoverState()
+
+	if !g.HasLive() || g.liveSlot.commit != "aaaa1111" {
+		t.Fatalf("expected symlink fallback, live = %+v", g.liveSlot)
+	}
+}
+
+func (f *fakeEngine) status(t *testing.T) StatusResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	var sr StatusResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &sr); err != nil {
+		t.Fatalf("decoding status: %v", err)
+	}
+	return sr
+}
+
+func TestRecoveryRunsInBackground(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{HealthTimeoutMs: 100})
+	f.Deploy("aaaa1111")
+
+	g := f.restart(t)
+	g.health.hold = make(chan struct{})
+	recovered := g.RecoverState()
+	g.health.waitCalls(t, 1)
+
+	if g.HasLive() || !g.Recovering() {
+		t.Fatal("slot should be recovering, not live")
+	}
+	sr := g.status(t)
+	if sr.State != "recovering" || sr.Healthy || sr.LiveCommit != "aaaa1111" {
+		t.Fatalf("status while recovering = %+v", sr)
+	}
+	if got := g.health.timeouts[0]; got != defaultRecoveryTimeout {
+		t.Errorf("recovery health timeout = %v, want %v", got, defaultRecoveryTimeout)
+	}
+
+	close(g.health.hold)
+	if !<-recovered {
+		t.Fatal("recovery should succeed")
+	}
+	if sr := g.status(t); sr.State != "live" || !sr.Healthy {
+		t.Fatalf("status after recovery = %+v", sr)
+	}
+}
+
+func TestRecoveryTimeoutKillsSlot(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{RecoveryTimeoutMs: 1234})
+	f.Deploy("aaaa1111")
+
+	g := f.restart(t)
+	g.health.results = []bool{false}
+	if <-g.RecoverState() {
+		t.Fatal("recovery should fail")
+	}
+	if got := g.health.timeouts[0]; got != 1234*time.Millisecond {
+		t.Errorf("recovery health timeout = %v", got)
+	}
+	if g.HasLive() || g.Recovering() {
+		t.Fatal("failed recovery must leave nothing live")
+	}
+	if sigs := g.runner.started()[0].received(); len(sigs) == 0 || sigs[len(sigs)-1] != syscall.SIGKILL {
+		t.Errorf("unhealthy recovered slot should be killed, got %v", sigs)
+	}
+}
+
+func TestDeploySupersedesRecovery(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	f.Deploy("aaaa1111")
+
+	g := f.restart(t)
+	g.health.hold = make(chan struct{})
+	recovered := g.RecoverState()
+	g.health.waitCalls(t, 1)
+
+	// Only the recovery check blocks; the deploy's passes straight away.
+	g.health.mu.Lock()
+	g.health.hold = nil
+	g.health.mu.Unlock()
+
+	resp, _ := g.Deploy("bbbb2222")
+	if !resp.Success {
+		t.Fatalf("deploy during recovery: %s", resp.Error)
+	}
+	if <-recovered {
+		t.Fatal("superseded recovery should report false")
+	}
+	if g.liveSlot.commit != "bbbb2222" || g.Recovering() {
+		t.Fatalf("live = %+v, recovering = %v", g.liveSlot, g.Recovering())
+	}
+	if g.prevSlot == nil || g.prevSlot.commit != "aaaa1111" {
+		t.Fatalf("recovering slot should become prev, got %+v", g.prevSlot)
+	}
+	if sigs := g.runner.started()[0].received(); len(sigs) == 0 || sigs[0] != syscall.SIGTERM {
+		t.Errorf("superseded slot should be drained, got %v", sigs)
+	}
+}
+
+func TestDeployLockReleasedOnPanic(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	f.runner.startPanic = true
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected deploy to panic")
+			}
+		}()
+		f.Deploy("aaaa1111")
+	}()
+
+	if _, held := f.locks.Holder(f.app); held {
+		t.Fatal("lock still held after panic")
+	}
+	f.runner.startPanic = false
+	if resp, code := f.Deploy("aaaa1111"); !resp.Success {
+		t.Fatalf("deploy after panic: %d %s", code, resp.Error)
+	}
+}
+
+func TestStatusReportsDeployInProgress(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	f.health.hold = make(chan struct{})
+
+	done := make(chan DeployResponse)
+	go func() {
+		resp, _ := f.Deploy("aaaa1111")
+		done <- resp
+	}()
+	f.health.waitCalls(t, 1)
+
+	sr := f.status(t)
+	if sr.DeployingCommit != "aaaa1111" || sr.DeployingSince == "" {
+		t.Fatalf("status during deploy = %+v", sr)
+	}
+	if resp, code := f.Rollback(); code != 409 || resp.Error != errDeployInProgress {
+		t.Fatalf("rollback during deploy: %d %q", code, resp.Error)
+	}
+
+	close(f.health.hold)
+	if resp := <-done; !resp.Success {
+		t.Fatalf("deploy: %s", resp.Error)
+	}
+	if sr := f.status(t); sr.DeployingCommit != "" || sr.DeployingSince != "" {
+		t.Fatalf("status after deploy = %+v", sr)
+	}
+}
+
+func TestDeployKeepsStagingChanges(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	var reported []StagingRestore
+	f.Subscribe(func(e DaemonEvent) { reported = append(reported, e.Data.(StagingRestore)) }, EventStagingRestored)
+	if resp, _ := f.Deploy("aaaa1111"); !resp.Success || resp.StagingRestore != nil {
+		t.Fatalf("deploy: %+v", resp)
+	}
+
+	changes := WorktreeChanges{Modified: 2, Untracked: 1}
+	f.worktrees.changes = changes
+	if sr := f.status(t); !sr.StagingDirty || sr.StagingChanges != changes {
+		t.Errorf("status = dirty %v, %+v", sr.StagingDirty, sr.StagingChanges)
+	}
+	resp, _ := f.Deploy("bbbb2222")
+	if !resp.Success {
+		t.Fatalf("deploy over uncommitted changes: %s", resp.Error)
+	}
+	want := StagingRestore{Stash: "5ta5h000", Changes: changes, Restored: true}
+	if r := resp.StagingRestore; r == nil || !reflect.DeepEqual(*r, want) {
+		t.Errorf("staging_restore = %+v, want %+v", r, want)
+	}
+	if f.worktrees.changes != changes || len(reported) != 1 {
+		t.Errorf("changes after deploy = %+v, %d reported", f.worktrees.changes, len(reported))
+	}
+
+	// Conflicts are reported, and rollbacks keep the changes too.
+	f.worktrees.conflicts = []string{"app.go"}
+	rb, _ := f.Rollback()
+	if r := rb.StagingRestore; !rb.Success || r == nil || !slices.Equal(r.Conflicts, []string{"app.go"}) {
+		t.Errorf("rollback: %+v, staging_restore %+v", rb, r)
+	}
+
+	// Forced, they're left for the checkout to discard.
+	resp, _ = f.DeployWithOptions("cccc3333", DeployOptions{Force: true})
+	if !resp.Success || resp.StagingRestore != nil || f.worktrees.stashed != (WorktreeChanges{}) {
+		t.Errorf("forced deploy: %+v, stashed %+v", resp, f.worktrees.stashed)
+	}
+}
+
+func TestDeployStagesInItsOwnDir(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	if resp, _ := f.Deploy("aaaa1111"); !resp.Success {
+		t.Fatalf("deploy: %s", resp.Error)
+	}
+	staging := filepath.Join(f.dataDir, "slot-staging")
+	work := filepath.Join(staging, "wip.txt")
+	os.WriteFile(work, []byte("half done"), 0644)
+	deployDirs := func() []string {
+		dirs, _ := filepath.Glob(filepath.Join(f.dataDir, deployDirPrefix+"*"))
+		return dirs
+	}
+
+	f.health.hold = make(chan struct{})
+	done := make(chan DeployResponse)
+	go func() {
+		resp, _ := f.Deploy("bbbb2222")
+		done <- resp
+	}()
+	f.health.waitCalls(t, 2)
+	if _, err := os.Stat(work); err != nil {
+		t.Errorf("slot-staging touched mid-deploy: %v", err)
+	}
+	if got := f.worktrees.Commit(staging); got != "aaaa1111" {
+		t.Errorf("slot-staging at %q mid-deploy, want aaaa1111", got)
+	}
+	if dirs := deployDirs(); len(dirs) != 1 || f.worktrees.Commit(dirs[0]) != "bbbb2222" {
+		t.Errorf("deploy dirs = %v", dirs)
+	}
+	close(f.health.hold)
+	if resp := <-done; !resp.Success {
+		t.Fatalf("deploy: %s", resp.Error)
+	}
+	if got := f.worktrees.Commit(staging); got != "bbbb2222" {
+		t.Errorf("slot-staging at %q after deploy, want bbbb2222", got)
+	}
+
+	f.runner.mu.Lock()
+	f.runner.startErr = errFake
+	f.runner.mu.Unlock()
+	if resp, _ := f.Deploy("cccc3333"); resp.Success {
+		t.Fatal("deploy should fail")
+	}
+	if got := f.worktrees.Commit(staging); got != "bbbb2222" {
+		t.Errorf("failed deploy moved slot-staging to %q", got)
+	}
+	if dirs := deployDirs(); len(dirs) != 0 {
+		t.Errorf("deploy dirs left behind: %v", dirs)
+	}
+}
+
+func TestDeployLocksArePerApp(t *testing.T) {
+	t.Parallel()
+	locks := NewDeployLocks()
+
+	releaseA, _, ok := locks.TryAcquire("a", "deploy", "aaaa1111")
+	if !ok {
+		t.Fatal("first acquire failed")
+	}
+	if _, holder, ok := locks.TryAcquire("a", "rollback", "bbbb2222"); ok || holder.Commit != "aaaa1111" {
+		t.Fatalf("second acquire on same app: ok=%v holder=%+v", ok, holder)
+	}
+	releaseB, _, ok := locks.TryAcquire("b", "deploy", "cccc3333")
+	if !ok {
+		t.Fatal("other app should not be blocked")
+	}
+	releaseB()
+
+	releaseA()
+	releaseA() // idempotent
+	if _, _, ok := locks.TryAcquire("a", "deploy", "dddd4444"); !ok {
+		t.Fatal("acquire after release failed")
+	}
+}
+
+func TestReloadKeepsPorts(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{Port: 3000, InternalPort: 3001})
+
+	cfg := f.cfg
+	cfg.Port = 4000
+	cfg.DrainTimeoutMs = 42
+	cfg.HealthEndpoint = "/ready"
+	kept, err := f.Reload(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(kept, ",") != "port" {
+		t.Errorf("kept = %v", kept)
+	}
+	if f.cfg.Port != 3000 || f.cfg.DrainTimeoutMs != 42 || f.cfg.HealthEndpoint != "/ready" {
+		t.Errorf("cfg after reload = %+v", f.cfg)
+	}
+
+	// Not while a deploy holds the lock.
+	release, _, _ := f.locks.TryAcquire(f.app, "deploy", "aaaa1111")
+	defer release()
+	if _, err := f.Reload(cfg); err == nil || err.Error() != "deploy in progress" {
+		t.Errorf("reload during deploy: %v", err)
+	}
+}
+
+func TestReloadHosts(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{TLSPort: 8443})
+	blog := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("blog"))
+	}))
+	defer blog.Close()
+
+	cfg := f.cfg
+	cfg.TLSPort = 9443
+	cfg.Hosts = map[string]HostConfig{"blog.example.com": {Cert: "missing.pem", Key: "missing.key"}}
+	if _, err := f.Reload(cfg); err == nil || !strings.Contains(err.Error(), "hosts.blog.example.com") {
+		t.Fatalf("reload with a missing cert: %v", err)
+	}
+	if f.cfg.Hosts != nil {
+		t.Fatal("failed reload applied hosts")
+	}
+
+	cfg.Hosts = map[string]HostConfig{"blog.example.com": {Port: blog.Listener.Addr().(*net.TCPAddr).Port}}
+	kept, err := f.Reload(cfg)
+	if err != nil || strings.Join(kept, ",") != "tls_port" {
+		t.Fatalf("reload = %v, %v", kept, err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "blog.example.com"
+	f.appProxy.ServeHTTP(w, r)
+	if w.Body.String() != "blog" {
+		t.Fatalf("blog.example.com = %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestKillAllCutsDrainShort(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{DrainTimeoutMs: 60000})
+	f.runner.ignoreTerm = true
+	f.Deploy("aaaa1111")
+
+	drained := make(chan struct{})
+	go func() {
+		f.DrainAll()
+		close(drained)
+	}()
+	proc := f.runner.started()[0]
+	for len(proc.received()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	f.KillAll()
+
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("DrainAll still waiting after KillAll")
+	}
+	if sigs := proc.received(); len(sigs) != 2 || sigs[0] != syscall.SIGTERM || sigs[1] != syscall.SIGKILL {
+		t.Errorf("signals = %v", sigs)
+	}
+}
+
+func TestDumpState(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	f.Deploy("aaaa1111")
+
+	path, err := f.DumpState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"commit": "aaaa1111"`, `"app_proxy"`, "goroutine "} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("dump missing %q", want)
+		}
+	}
+}
+
+func TestHealthFailureReported(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{HealthEndpoint: "/healthz", HealthTimeoutMs: 2000})
+	f.health.results = []bool{false}
+	var got []HealthFailure
+	f.Subscribe(func(e DaemonEvent) { got = append(got, e.Data.(HealthFailure)) }, EventHealthFailure)
+	// The fake runner writes no output; stand in for the app's.
+	os.WriteFile(filepath.Join(f.dataDir, "slot-staging.log"), []byte("booting\npanic: missing DATABASE_URL\n"), 0644)
+
+	resp, _ := f.Deploy("aaaa1111")
+	if resp.Success || resp.Error != errHealthCheckFailed {
+		t.Fatalf("deploy = %+v", resp)
+	}
+	if !strings.Contains(resp.HealthError, "/healthz") || !strings.Contains(resp.HealthError, "2s") {
+		t.Errorf("health_error = %q", resp.HealthError)
+	}
+	if !strings.Contains(resp.LogTail, "panic: missing DATABASE_URL") {
+		t.Errorf("log_tail = %q", resp.LogTail)
+	}
+	if len(got) != 1 || got[0].Commit != "aaaa1111" || got[0].Log != resp.LogTail {
+		t.Errorf("reported = %+v", got)
+	}
+
+	// Healthy deploys report nothing.
+	f.Deploy("bbbb2222")
+	if len(got) != 1 {
+		t.Errorf("reported %d failures, want 1", len(got))
+	}
+}
+
+func TestDebugEndpoints(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	f.Deploy("aaaa1111")
+
+	get := func(path, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+		return w
+	}
+
+	// Without a debug token the endpoints don't exist.
+	if w := get("/debug/state", ""); w.Code != 404 {
+		t.Fatalf("no token configured: %d", w.Code)
+	}
+
+	f.debugToken = "s3cret"
+	if w := get("/debug/state", "wrong"); w.Code != 401 {
+		t.Errorf("wrong token: %d", w.Code)
+	}
+	w := get("/debug/state", "s3cret")
+	var snap Snapshot
+	json.Unmarshal(w.Body.Bytes(), &snap)
+	if w.Code != 200 || snap.Live == nil || snap.Live.Commit != "aaaa1111" || snap.Goroutines == 0 {
+		t.Errorf("/debug/state = %d %s", w.Code, w.Body.String())
+	}
+	if w := get("/debug/pprof/goroutine?debug=1&token=s3cret", ""); w.Code != 200 || !strings.Contains(w.Body.String(), "goroutine profile") {
+		t.Errorf("goroutine profile via ?token= = %d", w.Code)
+	}
+	if w := get("/debug/pprof/", "s3cret"); w.Code != 200 || !strings.Contains(w.Body.String(), "heap") {
+		t.Errorf("pprof index = %d", w.Code)
+	}
+}
+
+func TestAppPortCheckedInParallel(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{HealthEndpoint: "/health", AppHealthEndpoint: "/"})
+	f.health.hold = make(chan struct{})
+
+	done := make(chan DeployResponse)
+	go func() {
+		resp, _ := f.Deploy("aaaa1111")
+		done <- resp
+	}()
+	// Both checks are in flight before either returns.
+	f.health.waitCalls(t, 2)
+	close(f.health.hold)
+	if resp := <-done; !resp.Success {
+		t.Fatalf("deploy: %s", resp.Error)
+	}
+
+	s := f.liveSlot
+	want := map[string]bool{
+		fmt.Sprintf("%d /health", s.intPort): true,
+		fmt.Sprintf("%d /", s.appPort):       true,
+	}
+	for _, c := range f.health.checked {
+		if !want[c] {
+			t.Errorf("unexpected check %q", c)
+		}
+		delete(want, c)
+	}
+	if len(want) != 0 {
+		t.Errorf("missing checks: %v", want)
+	}
+}
+
+func TestAppPortCheckFailureFailsDeploy(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{AppHealthEndpoint: "/"})
+	f.health.results = []bool{true, false}
+
+	resp, _ := f.Deploy("aaaa1111")
+	if resp.Success || resp.Error != errHealthCheckFailed {
+		t.Fatalf("deploy = %+v", resp)
+	}
+	if f.HasLive() {
+		t.Fatal("failed deploy must not leave a live slot")
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var hits []string
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits = append(hits, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer app.Close()
+
+	o := &Orchestrator{cfg: Config{WarmupURLs: []string{"/", "/missing", "/api/products"}}}
+	o.warmup(&slot{appPort: app.Listener.Addr().(*net.TCPAddr).Port})
+
+	if got := strings.Join(hits, ","); got != "/,/missing,/api/products" {
+		t.Errorf("warmup hit %q", got)
+	}
+}
+
+func TestSetupSkippedWhenLockfileUnchanged(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{SetupCommand: "npm ci", SetupCacheKeys: []string{"package-lock.json"}})
+	f.worktrees.files = map[string]map[string]string{
+		"aaaa1111": {"package-lock.json": "v1"},
+		"bbbb2222": {"package-lock.json": "v1"},
+		"cccc3333": {"package-lock.json": "v2"},
+		"dddd4444": {"package-lock.json": "v3"},
+		"eeee5555": {"package-lock.json": "v2"},
+	}
+	setups := func() int {
+		f.runner.mu.Lock()
+		defer f.runner.mu.Unlock()
+		return len(f.runner.setups)
+	}
+
+	steps := []struct {
+		commit     string
+		opts       DeployOptions
+		setupErr   error
+		wantSkip   bool
+		wantSetups int
+	}{
+		{commit: "aaaa1111", wantSetups: 1},
+		{commit: "bbbb2222", wantSkip: true, wantSetups: 1},
+		{commit: "bbbb2222", opts: DeployOptions{ForceSetup: true}, wantSetups: 2},
+		{commit: "cccc3333", wantSetups: 3},
+		{commit: "dddd4444", setupErr: errFake, wantSetups: 4},
+		// The failed deploy's dir is gone; this one is cloned from live again.
+		{commit: "eeee5555", wantSkip: true, wantSetups: 4},
+	}
+	for _, step := range steps {
+		f.runner.mu.Lock()
+		f.runner.setupErr = step.setupErr
+		f.runner.mu.Unlock()
+
+		resp, _ := f.DeployWithOptions(step.commit, step.opts)
+		if resp.Success != (step.setupErr == nil) {
+			t.Fatalf("%s: deploy = %+v", step.commit, resp)
+		}
+		if resp.SetupSkipped != step.wantSkip {
+			t.Errorf("%s: setup_skipped = %v, want %v", step.commit, resp.SetupSkipped, step.wantSkip)
+		}
+		if got := setups(); got != step.wantSetups {
+			t.Errorf("%s: %d setups run, want %d", step.commit, got, step.wantSetups)
+		}
+	}
+}
+
+func TestRetainedReleases(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{RetainReleases: 2})
+	for _, c := range []string{"aaaa1111", "bbbb2222", "cccc3333", "dddd4444", "eeee5555"} {
+		if resp, _ := f.Deploy(c); !resp.Success {
+			t.Fatalf("deploy %s: %s", c, resp.Error)
+		}
+	}
+
+	// live eeee, prev dddd, retained cccc and bbbb; aaaa is gone.
+	names := func() []string {
+		var n []string
+		for _, s := range f.retained {
+			n = append(n, s.commit)
+		}
+		return n
+	}
+	if got := strings.Join(names(), ","); got != "cccc3333,bbbb2222" {
+		t.Fatalf("retained = %s", got)
+	}
+	if _, err := os.Stat(filepath.Join(f.dataDir, "slot-aaaa1111")); !os.IsNotExist(err) {
+		t.Errorf("oldest release should be removed: %v", err)
+	}
+
+	if resp, code := f.RollbackTo("ffff"); code != 404 {
+		t.Errorf("rollback to unknown release: %d %+v", code, resp)
+	}
+
+	resp, code := f.RollbackTo("bbbb")
+	if code != 200 || !resp.Success || resp.Commit != "bbbb2222" {
+		t.Fatalf("rollback to retained: %d %+v", code, resp)
+	}
+	if f.liveSlot.commit != "bbbb2222" || f.prevSlot.commit != "eeee5555" {
+		t.Fatalf("live %s prev %s", f.liveSlot.commit, f.prevSlot.commit)
+	}
+	// Old prev dddd is retained now; bbbb left the list.
+	if got := strings.Join(names(), ","); got != "dddd4444,cccc3333" {
+		t.Fatalf("retained after rollback = %s", got)
+	}
+
+	// History marks which releases are still on disk.
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/history", nil))
+	var history []HistoryEntry
+	json.Unmarshal(w.Body.Bytes(), &history)
+	release := map[string]string{}
+	for _, e := range history {
+		release[e.SlotDir] = e.Release
+	}
+	want := map[string]string{
+		"slot-aaaa1111": "",
+		"slot-bbbb2222": "live",
+		"slot-cccc3333": "retained",
+		"slot-dddd4444": "retained",
+		"slot-eeee5555": "prev",
+	}
+	for slot, rel := range want {
+		if release[slot] != rel {
+			t.Errorf("%s: release = %q, want %q", slot, release[slot], rel)
+		}
+	}
+
+	// Retained releases survive a restart.
+	g := f.restart(t)
+	<-g.RecoverState()
+	if len(g.retained) != 2 || g.retained[0].commit != "dddd4444" {
+		t.Fatalf("retained after restart = %+v", g.retained)
+	}
+}
+
+func TestRedeployOfRetainedCommit(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{RetainReleases: 3})
+	for _, c := range []string{"aaaa1111", "bbbb2222", "cccc3333", "aaaa1111"} {
+		if resp, _ := f.Deploy(c); !resp.Success {
+			t.Fatalf("deploy %s: %s", c, resp.Error)
+		}
+	}
+	if f.liveSlot.name != "slot-aaaa1111" {
+		t.Fatalf("live = %s", f.liveSlot.name)
+	}
+	for _, s := range f.retained {
+		if s.name == "slot-aaaa1111" {
+			t.Fatal("redeployed commit should leave the retained list")
+		}
+	}
+}
+
+func TestDeployPolicy(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{DeployPolicy: &DeployPolicy{
+		AllowedKeys:    []string{"sha256:nope", "SHA256:goodkey", "89AB CDEF 0123 4567"},
+		AllowedAuthors: []string{"ci@example.com"},
+	}})
+	f.verifier.sigs = map[string]CommitSignature{
+		"aaaa1111": {AuthorEmail: "dev@example.com", Signed: true, Keys: []string{"SHA256:goodkey"}},
+		"bbbb2222": {AuthorEmail: "dev@example.com", Signed: true, Keys: []string{"0123456789abcdef0123456789abcdef01234567"}},
+		"cccc3333": {AuthorEmail: "CI@example.com"},
+		"dddd4444": {AuthorEmail: "dev@example.com", Signed: true, Keys: []string{"SHA256:otherkey"}},
+		"eeee5555": {AuthorEmail: "dev@example.com", Detail: "gpg: Can't check signature: No public key"},
+		"ffff6666": {AuthorEmail: "dev@example.com"},
+	}
+
+	for commit, want := range map[string]string{
+		"aaaa1111": "",
+		"bbbb2222": "",
+		"cccc3333": "",
+		"dddd4444": "signed by SHA256:otherkey, which is not an allowed key; author dev@example.com is not allowed",
+		"eeee5555": "signature not verified: gpg: Can't check signature: No public key",
+		"ffff6666": "not signed; author dev@example.com is not allowed",
+	} {
+		resp, code := f.Deploy(commit)
+		if want == "" {
+			if !resp.Success {
+				t.Errorf("%s: %s", commit, resp.Error)
+			}
+			continue
+		}
+		if code != 403 || !strings.Contains(resp.Error, want) {
+			t.Errorf("%s: deploy = %d %q, want 403 containing %q", commit, code, resp.Error, want)
+		}
+	}
+	if resp, code := f.DeployWithOptions("sha256:0123456789", DeployOptions{Artifact: "unused"}); code != 403 {
+		t.Errorf("artifact under policy: %d %+v", code, resp)
+	}
+}
+
+func TestDeployPolicyAllowedRefs(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{DeployPolicy: &DeployPolicy{AllowedRefs: []string{"main", "release"}}})
+	f.adminToken = "s3cret"
+	f.verifier.refs = map[string][]string{
+		"aaaa1111": {"main"},
+		"bbbb2222": {"release"},
+	}
+
+	for _, c := range []string{"aaaa1111", "bbbb2222"} {
+		if resp, _ := f.Deploy(c); !resp.Success {
+			t.Fatalf("deploy %s: %s", c, resp.Error)
+		}
+	}
+
+	// A WIP commit on no allowed ref needs the admin token.
+	resp, code := f.Deploy("cccc3333")
+	if code != 403 || !strings.Contains(resp.Error, "not on an allowed ref (main, release)") {
+		t.Fatalf("off-ref deploy = %d %q", code, resp.Error)
+	}
+	resp, code = f.DeployWithOptions("cccc3333", DeployOptions{AdminToken: "wrong"})
+	if code != 403 || resp.Error != "invalid admin token" {
+		t.Fatalf("wrong token = %d %q", code, resp.Error)
+	}
+	if resp, _ := f.DeployWithOptions("cccc3333", DeployOptions{AdminToken: "s3cret"}); !resp.Success {
+		t.Fatalf("override: %s", resp.Error)
+	}
+
+	// Without an admin token configured, no override is possible.
+	f.adminToken = ""
+	if _, code := f.DeployWithOptions("dddd4444", DeployOptions{AdminToken: ""}); code != 403 {
+		t.Fatalf("expected 403, got %d", code)
+	}
+	if _, code := f.DeployWithOptions("dddd4444", DeployOptions{AdminToken: "s3cret"}); code != 403 {
+		t.Fatalf("expected 403 with no admin token configured, got %d", code)
+	}
+}
+
+func TestDeployProgressStream(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{SetupCommand: "make deps", HealthEndpoint: "/healthz"})
+	f.runner.setupOut = "fetching\ninstalled 3 packages"
+
+	r := httptest.NewRequest("POST", "/deploy", strings.NewReader(`{"commit":"aaaa1111"}`))
+	r.Header.Set("Accept", "application/x-ndjson")
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, r)
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	var phases, lines []string
+	var last progressLine
+	for _, l := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		last = progressLine{}
+		if err := json.Unmarshal([]byte(l), &last); err != nil {
+			t.Fatalf("bad line %q: %v", l, err)
+		}
+		if p := last.Progress; p != nil {
+			if p.Line != "" {
+				lines = append(lines, p.Line)
+			} else if len(phases) == 0 || phases[len(phases)-1] != p.Phase {
+				phases = append(phases, p.Phase)
+			}
+		}
+	}
+	if want := []string{"checkout", "setup", "start", "health", "promote"}; !slices.Equal(phases, want) {
+		t.Errorf("phases = %v, want %v", phases, want)
+	}
+	if want := []string{"fetching", "installed 3 packages"}; !slices.Equal(lines, want) {
+		t.Errorf("setup lines = %q, want %q", lines, want)
+	}
+	if last.Result == nil || !last.Result.Success || last.Code != 200 {
+		t.Errorf("last line = %+v", last)
+	}
+
+	// Without the Accept header, the response is the usual JSON.
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("POST", "/deploy", strings.NewReader(`{"commit":"bbbb2222"}`)))
+	var resp DeployResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !resp.Success {
+		t.Errorf("plain deploy: %s", w.Body.String())
+	}
+}
+
+func TestLockDeploys(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	f.Deploy("aaaa1111")
+	f.Deploy("bbbb2222")
+
+	l := f.LockDeploys("incident 42")
+	resp, code := f.Deploy("cccc3333")
+	if code != 423 || !strings.Contains(resp.Error, "incident 42") {
+		t.Fatalf("locked deploy = %d %q", code, resp.Error)
+	}
+	if rb, _ := f.RollbackTo(""); !rb.Success {
+		t.Fatalf("rollback while locked: %s", rb.Error)
+	}
+	if again := f.LockDeploys("still"); again.Since != l.Since || again.Reason != "still" {
+		t.Errorf("relock = %+v, want reason replaced and since %s kept", again, l.Since)
+	}
+
+	// The lock survives a restart.
+	g := f.restart(t)
+	<-g.RecoverState()
+	if got := g.Locked(); got == nil || got.Reason != "still" {
+		t.Fatalf("after restart: lock = %+v", got)
+	}
+	g.UnlockDeploys()
+	if resp, _ := g.Deploy("cccc3333"); !resp.Success {
+		t.Fatalf("deploy after unlock: %s", resp.Error)
+	}
+}
+
+func TestSmokeFailureRollsBack(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{SmokeCommand: "smoke"})
+	if resp, _ := f.Deploy("aaaa1111"); !resp.Success {
+		t.Fatalf("deploy: %s", resp.Error)
+	}
+	want := fmt.Sprintf("SLOT_MACHINE_URL=http://127.0.0.1:%d", f.liveSlot.appPort)
+	if env := f.runner.smokes[0]; !slices.Contains(env, want) {
+		t.Fatalf("smoke env lacks %s", want)
+	}
+
+	f.runner.mu.Lock()
+	f.runner.smokeErr = errFake
+	f.runner.smokeOutput = "GET /checkout: 500"
+	f.runner.mu.Unlock()
+
+	resp, _ := f.Deploy("bbbb2222")
+	if resp.Success || !resp.RolledBack || resp.SmokeOutput != "GET /checkout: 500" {
+		t.Fatalf("deploy = %+v", resp)
+	}
+	if !strings.Contains(resp.Error, "smoke test failed") || !strings.Contains(resp.Error, "rolled back to aaaa1111") {
+		t.Fatalf("error = %q", resp.Error)
+	}
+	if f.liveSlot.commit != "aaaa1111" || f.prevSlot.commit != "bbbb2222" {
+		t.Fatalf("live = %s, prev = %s", f.liveSlot.commit, f.prevSlot.commit)
+	}
+
+	entries, _ := f.readJournal()
+	if len(entries) != 3 {
+		t.Fatalf("journal = %+v", entries)
+	}
+	if e := entries[1]; e.Action != "deploy" || e.SmokeOutput != "GET /checkout: 500" {
+		t.Fatalf("deploy entry = %+v", e)
+	}
+	if e := entries[2]; e.Action != "rollback" || e.Commit != "aaaa1111" {
+		t.Fatalf("rollback entry = %+v", e)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	if resp, _ := f.Deploy("aaaa1111"); !resp.Success {
+		t.Fatalf("deploy: %s", resp.Error)
+	}
+
+	f.health.mu.Lock()
+	f.health.results = []bool{false}
+	f.health.mu.Unlock()
+	if resp, code := f.StartMirror("bbbb2222", 0, false); resp.Success || code != 500 {
+		t.Fatalf("unhealthy candidate = %d %+v", code, resp)
+	}
+	if _, ok := f.appProxy.MirrorStats(); ok {
+		t.Fatal("unhealthy candidate should not get traffic")
+	}
+
+	if resp, _ := f.StartMirror("bbbb2222", 25, false); !resp.Success {
+		t.Fatalf("mirror: %s", resp.Error)
+	}
+	st := f.status(t)
+	if st.Mirror == nil || st.Mirror.Commit != "bbbb2222" || st.Mirror.Percent != 25 || !st.Mirror.Alive {
+		t.Fatalf("status mirror = %+v", st.Mirror)
+	}
+	if st.LiveCommit != "aaaa1111" {
+		t.Fatalf("mirroring changed live to %s", st.LiveCommit)
+	}
+	candidate := f.mirrorSlot
+
+	if resp, code := f.StartMirror("cccc3333", 101, false); code != 400 {
+		t.Fatalf("percent 101 = %d %+v", code, resp)
+	}
+
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("DELETE", "/mirror", nil))
+	if w.Code != 200 {
+		t.Fatalf("DELETE /mirror = %d %s", w.Code, w.Body.String())
+	}
+	if st := f.status(t); st.Mirror != nil {
+		t.Fatalf("mirror still reported: %+v", st.Mirror)
+	}
+	if _, ok := f.appProxy.MirrorStats(); ok {
+		t.Fatal("proxy still mirroring")
+	}
+	if _, err := os.Stat(candidate.dir); !os.IsNotExist(err) {
+		t.Fatalf("mirror dir left behind: %v", err)
+	}
+	if candidate.alive {
+		t.Fatal("candidate still running")
+	}
+}
+
+func TestPreviews(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	if _, code := f.StartPreview("feature/X", 0); code != 400 {
+		t.Fatalf("preview without preview_domain = %d", code)
+	}
+
+	f.cfg.PreviewDomain = "preview.example.com"
+	info, code := f.StartPreview("feature/X", 0)
+	if code != 200 || info.Name != "feature-x" || info.Host != "feature-x.preview.example.com" || !info.Alive {
+		t.Fatalf("preview = %d %+v", code, info)
+	}
+	if list := f.Previews(); len(list) != 1 || list[0].Commit != "feature/X" {
+		t.Fatalf("previews = %+v", list)
+	}
+	p := f.previews["feature-x"]
+	os.WriteFile(p.slot.logPath, []byte("listening\n"), 0644)
+
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/previews/feature-x/logs", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "listening") {
+		t.Fatalf("GET logs = %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("DELETE", "/previews/feature-x", nil))
+	if w.Code != 200 {
+		t.Fatalf("DELETE = %d %s", w.Code, w.Body.String())
+	}
+	if len(f.Previews()) != 0 || p.slot.alive {
+		t.Fatal("preview still running after DELETE")
+	}
+	if _, err := os.Stat(p.slot.dir); !os.IsNotExist(err) {
+		t.Fatalf("preview dir left behind: %v", err)
+	}
+
+	// Previews expire on their own.
+	if _, code := f.StartPreview("short", 50*time.Millisecond); code != 200 {
+		t.Fatalf("short preview = %d", code)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(f.Previews()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("preview did not expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFailoverGrace(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{FailoverGraceMs: 300})
+	if resp, _ := f.Deploy("aaaa1111"); !resp.Success {
+		t.Fatalf("deploy: %s", resp.Error)
+	}
+	f.mu.Lock()
+	old := f.liveSlot
+	f.mu.Unlock()
+
+	done := make(chan DeployResponse)
+	go func() {
+		resp, _ := f.Deploy("bbbb2222")
+		done <- resp
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for f.appProxy.Target() == old.appPort {
+		if time.Now().After(deadline) {
+			t.Fatal("proxy never switched")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Inside the window the old slot is still running and takes what the
+	// new one drops (neither fake slot listens, so both attempts fail).
+	if sigs := old.proc.(*fakeProcess).received(); len(sigs) != 0 {
+		t.Fatalf("old slot signalled during the grace period: %v", sigs)
+	}
+	w := httptest.NewRecorder()
+	f.appProxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if n := f.appProxy.Stats().Failovers; n != 1 {
+		t.Fatalf("failovers = %d, want 1", n)
+	}
+
+	if resp := <-done; !resp.Success {
+		t.Fatalf("deploy: %s", resp.Error)
+	}
+	if sigs := old.proc.(*fakeProcess).received(); len(sigs) == 0 {
+		t.Fatal("old slot not drained after the grace period")
+	}
+}
+
+func TestEnvSnapshot(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{EnvFile: ".env"})
+	envPath := filepath.Join(f.repoDir, ".env")
+	os.WriteFile(envPath, []byte("DATABASE_URL=postgres://old\nFEATURE=on\n"), 0644)
+	f.Deploy("aaaa1111")
+	os.WriteFile(envPath, []byte("DATABASE_URL=postgres://new\nFEATURE=on\nEXTRA=1\n"), 0644)
+	f.Deploy("bbbb2222")
+
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/slots/prev", nil))
+	var prev SlotDetail
+	json.Unmarshal(w.Body.Bytes(), &prev)
+	if w.Code != 200 || prev.Name != "slot-aaaa1111" || prev.Role != "prev" || prev.Env == nil {
+		t.Fatalf("GET /slots/prev = %d %s", w.Code, w.Body.String())
+	}
+	if prev.Env.Commit != "aaaa1111" || prev.Env.EnvFile != envPath || prev.Env.EnvFileHash == "" {
+		t.Errorf("env = %+v", prev.Env)
+	}
+	if prev.Env.Injected["SLOT_MACHINE"] != "1" || prev.Env.FromEnvFile["FEATURE"] == "" {
+		t.Errorf("env = %+v", prev.Env)
+	}
+	if strings.Contains(w.Body.String(), "postgres://") {
+		t.Errorf("env_file values should be hashed: %s", w.Body.String())
+	}
+
+	got := map[string]EnvChange{}
+	for _, c := range f.status(t).EnvDiff {
+		got[c.Name] = c
+	}
+	if len(got) != 2 {
+		t.Fatalf("env_diff = %+v, want DATABASE_URL and EXTRA", got)
+	}
+	if c := got["DATABASE_URL"]; c.Source != "env_file" || c.Live == "" || c.Prev == "" || c.Live == c.Prev {
+		t.Errorf("DATABASE_URL = %+v", c)
+	}
+	if c := got["EXTRA"]; c.Prev != "" || c.Live == "" {
+		t.Errorf("EXTRA = %+v", c)
+	}
+
+	// The snapshot survives a restart, with the stopped prev slot.
+	g := f.restart(t)
+	<-g.RecoverState()
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest("GET", "/slots/slot-aaaa1111", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"env_file_vars"`) {
+		t.Errorf("after restart: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest("GET", "/slots/nope", nil))
+	if w.Code != 404 {
+		t.Errorf("unknown slot = %d", w.Code)
+	}
+}
+
+func TestExec(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{EnvFile: ".env"})
+	os.WriteFile(filepath.Join(f.repoDir, ".env"), []byte("FEATURE=on\n"), 0644)
+	f.Deploy("aaaa1111")
+	f.mu.Lock()
+	port := f.liveSlot.appPort
+	f.mu.Unlock()
+
+	post := func(body, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/exec", strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, r)
+		return w
+	}
+
+	// Without an admin token on the daemon, or the right one on the
+	// request, nothing runs.
+	if w := post(`{"command":"touch pwned"}`, ""); w.Code != 403 {
+		t.Errorf("exec on a daemon without an admin token = %d %s", w.Code, w.Body.String())
+	}
+	f.adminToken = "s3cret"
+	for _, token := range []string{"", "wrong"} {
+		if w := post(`{"command":"touch pwned"}`, token); w.Code != 401 {
+			t.Errorf("exec with token %q = %d %s", token, w.Code, w.Body.String())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(f.dataDir, "slot-aaaa1111", "pwned")); err == nil {
+		t.Error("an unauthenticated exec ran its command")
+	}
+
+	exec := func(body string) (stdout, stderr string, last execLine) {
+		w := post(body, "s3cret")
+		if w.Code != 200 {
+			t.Fatalf("POST /exec = %d %s", w.Code, w.Body.String())
+		}
+		for _, l := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+			last = execLine{}
+			if err := json.Unmarshal([]byte(l), &last); err != nil {
+				t.Fatalf("bad line %q: %v", l, err)
+			}
+			stdout += string(last.Stdout)
+			stderr += string(last.Stderr)
+		}
+		return stdout, stderr, last
+	}
+
+	stdout, stderr, last := exec(`{"command":"pwd; echo $PORT $FEATURE; cat; echo oops >&2; exit 3"}` + "\nhello\n")
+	want := fmt.Sprintf("%s\n%d on\nhello\n", filepath.Join(f.dataDir, "slot-aaaa1111"), port)
+	if stdout != want {
+		t.Errorf("stdout = %q, want %q", stdout, want)
+	}
+	if stderr != "oops\n" {
+		t.Errorf("stderr = %q", stderr)
+	}
+	if last.ExitCode == nil || *last.ExitCode != 3 || last.Error != "" {
+		t.Errorf("last line = %+v", last)
+	}
+
+	// A character written in two halves, and bytes that aren't UTF-8 at
+	// all, arrive as they were written.
+	stdout, _, _ = exec(`{"command":"printf '\\303'; sleep 0.1; printf '\\251 \\377\\000'"}`)
+	if stdout != "\u00e9 \xff\x00" {
+		t.Errorf("stdout = %q, want %q", stdout, "\u00e9 \xff\x00")
+	}
+
+	if w := post(`{"command":"true","slot":"prev"}`, "s3cret"); w.Code != 404 {
+		t.Errorf("exec without a prev slot = %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRestart(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{SetupCommand: "make deps"})
+	if _, code := f.Restart(); code != 400 {
+		t.Errorf("restart with nothing live = %d", code)
+	}
+	f.Deploy("aaaa1111")
+	f.Deploy("bbbb2222")
+	old := f.runner.started()[1]
+
+	resp, code := f.Restart()
+	if code != 200 || !resp.Success || resp.Commit != "bbbb2222" || resp.Slot != "slot-bbbb2222" {
+		t.Fatalf("restart = %d %+v", code, resp)
+	}
+	procs := f.runner.started()
+	if len(procs) != 3 || procs[2].dir != filepath.Join(f.dataDir, "slot-bbbb2222") {
+		t.Fatalf("restart should start one process in the live slot, started %d", len(procs))
+	}
+	if len(old.received()) == 0 {
+		t.Error("old live process was not drained")
+	}
+	st := f.status(t)
+	if st.LiveCommit != "bbbb2222" || st.PreviousCommit != "aaaa1111" {
+		t.Errorf("after restart: live %s, prev %s", st.LiveCommit, st.PreviousCommit)
+	}
+	if len(f.runner.setups) != 2 {
+		t.Errorf("restart ran setup: %v", f.runner.setups)
+	}
+
+	// A new process that never turns healthy leaves the old one serving.
+	f.health.results = []bool{false}
+	if resp, _ := f.Restart(); resp.Success || resp.Error != errHealthCheckFailed {
+		t.Errorf("unhealthy restart = %+v", resp)
+	}
+	procs = f.runner.started()
+	if len(procs) != 4 || len(procs[2].received()) != 0 || !slices.Equal(procs[3].received(), []syscall.Signal{syscall.SIGKILL}) {
+		t.Errorf("failed restart should kill only the new process")
+	}
+}
+
+func TestEnvFileWatch(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{EnvFile: ".env"})
+	envPath := filepath.Join(f.repoDir, ".env")
+	os.WriteFile(envPath, []byte("SECRET=one\n"), 0644)
+	f.Deploy("aaaa1111")
+	if f.EnvStale() || f.status(t).EnvStale {
+		t.Fatal("fresh slot reported stale")
+	}
+
+	// Manual: reported, not restarted.
+	os.WriteFile(envPath, []byte("SECRET=two\n"), 0644)
+	if !f.EnvStale() || !f.status(t).EnvStale {
+		t.Fatal("changed env_file not reported")
+	}
+	seen := f.checkEnvFile("")
+	if seen == "" || len(f.runner.started()) != 1 {
+		t.Fatalf("manual: seen %q, %d processes", seen, len(f.runner.started()))
+	}
+
+	// Auto: restarted once per version of the file.
+	f.mu.Lock()
+	f.cfg.EnvReload = "auto"
+	f.mu.Unlock()
+	if again := f.checkEnvFile(seen); again != seen || len(f.runner.started()) != 1 {
+		t.Fatalf("a version already acted on should be left alone")
+	}
+	os.WriteFile(envPath, []byte("SECRET=three\n"), 0644)
+	f.checkEnvFile(seen)
+	if len(f.runner.started()) != 2 || f.EnvStale() {
+		t.Fatalf("auto: %d processes, stale %v", len(f.runner.started()), f.EnvStale())
+	}
+}
+
+func TestRebuildSlotsAfterRestore(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{SetupCommand: "make"})
+	f.Deploy("aaaa1111")
+	f.Deploy("bbbb2222")
+	f.DrainAll()
+
+	// A restored data dir has state.json but none of the slot directories.
+	for _, name := range []string{"slot-aaaa1111", "slot-bbbb2222", "slot-staging", "live", "prev"} {
+		os.RemoveAll(filepath.Join(f.dataDir, name))
+	}
+
+	g := f.restart(t)
+	rebuilt, err := g.RebuildSlots(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(rebuilt, []string{"slot-bbbb2222", "slot-aaaa1111"}) {
+		t.Errorf("rebuilt = %v, want live then prev", rebuilt)
+	}
+	for dir, commit := range map[string]string{"slot-bbbb2222": "bbbb2222", "slot-aaaa1111": "aaaa1111"} {
+		if got := g.worktrees.Commit(filepath.Join(f.dataDir, dir)); got != commit {
+			t.Errorf("%s holds %q, want %s", dir, got, commit)
+		}
+	}
+	if len(g.runner.setups) != 2 {
+		t.Errorf("setup ran %d times, want once per slot", len(g.runner.setups))
+	}
+	if g.symlinkTarget("live") != "slot-bbbb2222" || g.symlinkTarget("prev") != "slot-aaaa1111" {
+		t.Errorf("live → %q, prev → %q", g.symlinkTarget("live"), g.symlinkTarget("prev"))
+	}
+
+	<-g.RecoverState()
+	if !g.HasLive() || g.liveSlot.commit != "bbbb2222" || g.prevSlot == nil {
+		t.Fatalf("after rebuild, recovered live = %+v, prev = %+v", g.liveSlot, g.prevSlot)
+	}
+}
+
+func TestDeployTrackers(t *testing.T) {
+	t.Setenv("TRACKER_TOKEN", "s3cret")
+	type hit struct{ path, auth, body string }
+	hits := make(chan hit, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		auth := r.Header.Get("Authorization") + r.Header.Get("X-Honeycomb-Team")
+		hits <- hit{r.URL.Path, auth, string(body)}
+	}))
+	defer srv.Close()
+
+	f := newFakeEngine(t, Config{DeployTrackers: []DeployTracker{
+		{Type: "sentry", URL: srv.URL, TokenEnv: "TRACKER_TOKEN", Org: "acme", Project: "web"},
+		{Type: "grafana", URL: srv.URL + "/", TokenEnv: "TRACKER_TOKEN", Tags: []string{"prod"}},
+		{Type: "honeycomb", URL: srv.URL, TokenEnv: "TRACKER_TOKEN", Dataset: "web"},
+	}})
+	f.Deploy("aaaa1111")
+
+	got := map[string]hit{}
+	for len(got) < 4 {
+		select {
+		case h := <-hits:
+			got[h.path] = h
+		case <-time.After(5 * time.Second):
+			t.Fatalf("trackers posted %v, want 4 requests", got)
+		}
+	}
+	for path, want := range map[string]string{
+		"/api/0/organizations/acme/releases/":                  `"version":"aaaa1111"`,
+		"/api/0/organizations/acme/releases/aaaa1111/deploys/": `"environment":"production"`,
+		"/api/annotations": `"prod"`,
+		"/1/markers/web":   `"type":"slot-machine deploy"`,
+	} {
+		h, ok := got[path]
+		if !ok || !strings.Contains(h.body, want) {
+			t.Errorf("%s: %+v, want body containing %s", path, h, want)
+		}
+		if !strings.HasSuffix(h.auth, "s3cret") {
+			t.Errorf("%s: auth %q doesn't carry the token", path, h.auth)
+		}
+	}
+
+	// Restarts don't change what's deployed.
+	f.Restart()
+	select {
+	case h := <-hits:
+		t.Errorf("restart was tracked: %+v", h)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestFixedPortMode(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{FixedPortMode: true, FixedPort: 3111})
+	f.Deploy("aaaa1111")
+	if f.liveSlot.appPort != 3111 || f.liveSlot.intPort != 3111 {
+		t.Fatalf("ports = %d/%d, want the fixed port", f.liveSlot.appPort, f.liveSlot.intPort)
+	}
+
+	// The old slot is stopped before the new one starts; when the new one
+	// never gets healthy, the old one is started again.
+	f.health.results = []bool{false}
+	if resp, _ := f.Deploy("bbbb2222"); resp.Success {
+		t.Fatal("deploy should fail")
+	}
+	procs := f.runner.started()
+	if len(procs) != 3 {
+		t.Fatalf("started %d processes, want 3", len(procs))
+	}
+	if sigs := procs[0].received(); len(sigs) == 0 || sigs[0] != syscall.SIGTERM {
+		t.Errorf("old slot got %v, want SIGTERM before the new one started", sigs)
+	}
+	if f.liveSlot.commit != "aaaa1111" || !f.liveSlot.alive || f.liveSlot.appPort != 3111 || procs[2].dir != f.liveSlot.dir {
+		t.Errorf("live = %+v, want aaaa1111 started again", f.liveSlot)
+	}
+	if f.appProxy.Target() != 3111 {
+		t.Errorf("proxy target = %d", f.appProxy.Target())
+	}
+
+	if resp, _ := f.Deploy("bbbb2222"); !resp.Success || f.liveSlot.appPort != 3111 {
+		t.Fatalf("deploy = %+v", resp)
+	}
+	if resp, code := f.StartMirror("cccc3333", 10, false); code != 400 || !strings.Contains(resp.Error, "fixed_port_mode") {
+		t.Errorf("mirror = %d %+v", code, resp)
+	}
+}
+
+func TestBindConflictHint(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	f.health.hold = make(chan struct{})
+	os.WriteFile(filepath.Join(f.dataDir, "slot-staging.log"), []byte("Error: listen EADDRINUSE: address already in use :::3000\n"), 0644)
+	go func() {
+		for len(f.runner.started()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		f.runner.started()[0].exit()
+	}()
+
+	resp, _ := f.Deploy("aaaa1111")
+	if resp.Success || !strings.Contains(resp.HealthError, "fixed_port_mode") {
+		t.Fatalf("health_error = %q", resp.HealthError)
+	}
+}
+
+func TestRecoverStateStopsOrphanedProcesses(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{StartCommand: "sleep 60", DrainTimeoutMs: 2000})
+	f.Orchestrator.runner = execRunner{}
+	if resp, _ := f.Deploy("aaaa1111"); !resp.Success {
+		t.Fatalf("deploy: %s", resp.Error)
+	}
+	orphan := f.liveSlot
+	st := f.loadState()
+	if st == nil || len(st.Procs) != 1 || st.Procs[0].PGID != orphan.pgid || st.Procs[0].Dir != orphan.dir {
+		t.Fatalf("state.json procs = %+v, want %s's group %d", st, orphan.name, orphan.pgid)
+	}
+
+	// Another process under a recorded group ID, outside the data dir:
+	// the ID was reused, and it's left alone.
+	other, err := execRunner{}.Start(t.TempDir(), "sleep 60", nil, filepath.Join(t.TempDir(), "other.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Signal(syscall.SIGKILL)
+	otherDone := make(chan struct{})
+	go func() { other.Wait(); close(otherDone) }()
+	st.Procs = append(st.Procs, procGroup{PGID: other.Pgid(), Dir: filepath.Join(f.dataDir, "slot-bbbb2222")})
+	f.writeStateFile(*st)
+
+	// The daemon was SIGKILLed: nothing drained the slot.
+	g := &fakeEngine{runner: &fakeRunner{}, worktrees: &fakeWorktrees{}, health: &fakeHealth{}}
+	g.Orchestrator = New(Options{Config: f.cfg, RepoDir: f.repoDir, DataDir: f.dataDir, Runner: g.runner, Worktrees: g.worktrees, Health: g.health})
+	t.Cleanup(g.DrainAll)
+	<-g.RecoverState()
+
+	select {
+	case <-orphan.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("orphaned slot process still running")
+	}
+	select {
+	case <-otherDone:
+		t.Error("unrelated process was stopped")
+	default:
+	}
+	if !g.HasLive() || g.liveSlot.commit != "aaaa1111" {
+		t.Errorf("live = %+v", g.liveSlot)
+	}
+}
+
+func TestHandoffKeepsLiveRunning(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{StartCommand: "sleep 0.5; echo after the restart; exec sleep 60"})
+	f.Orchestrator.runner = execRunner{logs: f.logs}
+	if resp, _ := f.Deploy("aaaa1111"); !resp.Success {
+		t.Fatalf("deploy: %s", resp.Error)
+	}
+	live := f.liveSlot
+
+	h, err := f.Handoff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Live == nil || h.Live.Name != live.name || h.Live.Pid != live.pgid || h.Live.Output == 0 {
+		t.Fatalf("handoff = %+v, want %s's process and output", h.Live, live.name)
+	}
+	// What exec does to the old daemon's end of the output pipe.
+	live.proc.(*execProcess).output.Close()
+
+	h, err = ParseHandoff(h.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &fakeEngine{runner: &fakeRunner{}, worktrees: &fakeWorktrees{}, health: &fakeHealth{}}
+	g.Orchestrator = New(Options{Config: f.cfg, RepoDir: f.repoDir, DataDir: f.dataDir, Runner: g.runner, Worktrees: g.worktrees, Health: g.health, Handoff: h})
+	if ok := <-g.RecoverState(); !ok || g.liveSlot == nil || g.liveSlot.pgid != live.pgid {
+		t.Fatalf("recovered %v, live = %+v; want %s taken over", ok, g.liveSlot, live.name)
+	}
+	if n := len(g.runner.started()); n != 0 {
+		t.Errorf("started %d processes, want the running one taken over", n)
+	}
+
+	// Its output still reaches its log.
+	var raw []byte
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(string(raw), "after the restart") && time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		raw, _ = os.ReadFile(live.logPath)
+	}
+	if !strings.Contains(string(raw), "after the restart") {
+		t.Errorf("slot log = %q", raw)
+	}
+
+	g.DrainAll()
+	select {
+	case <-g.liveSlot.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("taken-over process not stopped by a drain")
+	}
+}
+
+func TestCrashRestartAndLoop(t *testing.T) {
+	t.Parallel()
+	hooks := make(chan map[string]any, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]any
+		json.NewDecoder(r.Body).Decode(&event)
+		hooks <- event
+	}))
+	defer srv.Close()
+	f := newFakeEngine(t, Config{CrashRestart: &CrashRestart{MaxCrashes: 2, Webhooks: []string{srv.URL}}})
+	f.Deploy("aaaa1111")
+	f.Deploy("bbbb2222")
+	status := func() StatusResponse {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+		var sr StatusResponse
+		json.Unmarshal(w.Body.Bytes(), &sr)
+		return sr
+	}
+
+	// The first crash is restarted in place, on the same ports.
+	crashed := f.liveSlot
+	f.runner.started()[1].exit()
+	deadline := time.Now().Add(5 * time.Second)
+	for sr := status(); sr.State != "live" || f.LiveCommit() != "bbbb2222" || len(f.runner.started()) != 3; sr = status() {
+		if time.Now().After(deadline) {
+			t.Fatalf("not restarted: %+v", sr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	f.mu.Lock()
+	restarted := f.liveSlot
+	f.mu.Unlock()
+	if restarted == crashed || restarted.appPort != crashed.appPort || restarted.name != "slot-bbbb2222" {
+		t.Errorf("restarted = %+v, crashed = %+v", restarted, crashed)
+	}
+
+	// The second within the window is a crash loop: no more restarts.
+	f.runner.started()[2].exit()
+	select {
+	case event := <-hooks:
+		if event["event"] != "crash_loop" || event["commit"] != "bbbb2222" || event["rollback"] != "aaaa1111" {
+			t.Errorf("webhook = %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no crash_loop webhook")
+	}
+	sr := status()
+	if sr.State != "crash-loop" || sr.CrashLoop == nil || sr.CrashLoop.Crashes != 2 || !strings.Contains(sr.CrashLoop.Suggestion, "roll back to aaaa1111") {
+		t.Errorf("status = %s, %+v", sr.State, sr.CrashLoop)
+	}
+	if n := len(f.runner.started()); n != 3 {
+		t.Errorf("%d processes started, want no restart after the loop", n)
+	}
+
+	// A rollback ends it.
+	if resp, _ := f.Rollback(); !resp.Success {
+		t.Fatalf("rollback: %s", resp.Error)
+	}
+	if sr := status(); sr.State != "live" || sr.CrashLoop != nil {
+		t.Errorf("after rollback: %s, %+v", sr.State, sr.CrashLoop)
+	}
+}
+
+func TestLivezReadyz(t *testing.T) {
+	t.Parallel()
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(500)
+		}
+	}))
+	defer app.Close()
+	_, appPort, _ := net.SplitHostPort(app.Listener.Addr().String())
+	f := newFakeEngine(t, Config{HealthEndpoint: "/health"})
+	probe := func(path string) (int, ProbeResponse) {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var resp ProbeResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+	failing := func(resp ProbeResponse) []string {
+		var names []string
+		for _, c := range resp.Checks {
+			if !c.OK {
+				names = append(names, c.Name)
+			}
+		}
+		return names
+	}
+
+	if code, resp := probe("/livez"); code != 200 || !resp.OK() {
+		t.Errorf("livez = %d %+v", code, resp)
+	}
+	if code, resp := probe("/readyz"); code != 503 || !slices.Equal(failing(resp), []string{"git", "live_slot"}) {
+		t.Errorf("readyz without a repo or live slot = %d %+v", code, resp)
+	}
+
+	exec.Command("git", "init", "-q", f.repoDir).Run()
+	f.Deploy("aaaa1111")
+	f.mu.Lock()
+	f.liveSlot.intPort, _ = strconv.Atoi(appPort)
+	f.mu.Unlock()
+	if code, resp := probe("/readyz"); code != 200 || !resp.OK() {
+		t.Errorf("readyz = %d %+v", code, resp)
+	}
+	f.mu.Lock()
+	f.cfg.HealthEndpoint = "/sick"
+	f.mu.Unlock()
+	if _, resp := probe("/readyz"); !slices.Equal(failing(resp), []string{"live_slot"}) {
+		t.Errorf("readyz with the app unhealthy = %+v", resp)
+	}
+
+	// A proxy that isn't listening, and a data dir that can't be written.
+	port, _ := findFreePort()
+	p := proxy.New(fmt.Sprintf("127.0.0.1:%d", port), nil)
+	if err := checkListener(p); err == nil {
+		t.Error("unbound proxy passed")
+	}
+	p.EnsureListener()
+	defer p.Shutdown()
+	if err := checkListener(p); err != nil {
+		t.Errorf("bound proxy: %v", err)
+	}
+	if err := (&Orchestrator{dataDir: filepath.Join(f.dataDir, "missing")}).checkDataDir(); err == nil {
+		t.Error("missing data dir passed")
+	}
+
+	// A stuck state lock fails liveness.
+	f.mu.Lock()
+	code, resp := probe("/livez")
+	f.mu.Unlock()
+	if code != 503 || !slices.Equal(failing(resp), []string{"lock"}) {
+		t.Errorf("livez with the lock held = %d %+v", code, resp)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{})
+	var journaled []JournalEntry
+	unsubscribe := f.Subscribe(func(e DaemonEvent) { journaled = append(journaled, e.Data.(JournalEntry)) }, EventJournaled)
+	f.Deploy("aaaa1111")
+	unsubscribe()
+	f.LockDeploys("freeze")
+	f.appendJournal("deploy", "bbbb2222", "", "")
+	if len(journaled) != 1 || journaled[0].Action != "deploy" || journaled[0].Commit != "aaaa1111" {
+		t.Errorf("journaled = %+v", journaled)
+	}
+
+	// events reads what GET /events sends before the client goes away.
+	events := func(query string, header http.Header) []DaemonEvent {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		req := httptest.NewRequest("GET", "/events"+query, nil).WithContext(ctx)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+		if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("content type %q", ct)
+		}
+		var out []DaemonEvent
+		for _, frame := range strings.Split(w.Body.String(), "\n\n") {
+			for _, line := range strings.Split(frame, "\n") {
+				if data, ok := strings.CutPrefix(line, "data: "); ok {
+					var e DaemonEvent
+					json.Unmarshal([]byte(data), &e)
+					out = append(out, e)
+				}
+			}
+		}
+		return out
+	}
+	types := func(es []DaemonEvent) []string {
+		var out []string
+		for _, e := range es {
+			if e.Type != "deploy_progress" {
+				out = append(out, e.Type)
+			}
+		}
+		return out
+	}
+
+	all := events("", nil)
+	if got := types(all); !slices.Equal(got, []string{"deploy_started", "journaled", "deploy_finished", "locked", "journaled"}) {
+		t.Fatalf("events = %v", got)
+	}
+	var phases []string
+	for i, e := range all {
+		if e.ID != int64(i+1) {
+			t.Errorf("event %d has ID %d", i, e.ID)
+		}
+		if e.Type == "deploy_progress" {
+			phases = append(phases, e.Data.(map[string]any)["phase"].(string))
+		}
+	}
+	if !slices.Contains(phases, "start") || !slices.Contains(phases, "promote") {
+		t.Errorf("progress phases = %v", phases)
+	}
+	finished := all[len(all)-3]
+	if finished.Commit != "aaaa1111" || finished.Data.(map[string]any)["success"] != true {
+		t.Errorf("deploy_finished = %+v", finished)
+	}
+
+	// A reconnect gets only what it missed; a filter only what it asked for.
+	if got := types(events("", http.Header{"Last-Event-Id": {strconv.FormatInt(finished.ID, 10)}})); !slices.Equal(got, []string{"locked", "journaled"}) {
+		t.Errorf("after Last-Event-ID = %v", got)
+	}
+	if got := types(events("?types=deploy_started,locked", nil)); !slices.Equal(got, []string{"deploy_started", "locked"}) {
+		t.Errorf("types filter = %v", got)
+	}
+	// An ID from before a daemon restart gets everything kept.
+	if got := events("?after=9999", nil); len(got) != len(all) {
+		t.Errorf("after a restart: %d events, want %d", len(got), len(all))
+	}
+
+	// Live events reach a subscriber; one that falls behind is cut off.
+	backlog, ch := f.events.stream(all[len(all)-1].ID)
+	if len(backlog) != 0 {
+		t.Errorf("backlog = %v", backlog)
+	}
+	f.UnlockDeploys()
+	if e := <-ch; e.Type != "unlocked" {
+		t.Errorf("live event = %+v", e)
+	}
+	for range eventBuffer + 1 {
+		f.Publish("test", "", "", nil)
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != eventBuffer {
+		t.Errorf("slow subscriber got %d events before being cut off, want %d", n, eventBuffer)
+	}
+}
+
+func TestDeployLimits(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{DeployRateLimits: map[string]DeployRateLimit{"agent": {Max: 2, WindowSec: 60}}})
+	deploy := func(commit, source string) (DeployResponse, int) {
+		return f.DeployWithOptions(commit, DeployOptions{Source: source})
+	}
+
+	for _, c := range []string{"aaaa1111", "bbbb2222"} {
+		if resp, code := deploy(c, "agent"); code != 200 {
+			t.Fatalf("agent deploy %s: %d %+v", c, code, resp)
+		}
+	}
+	resp, code := deploy("cccc3333", "agent")
+	if code != 429 || resp.RetryAfterMs <= 0 || resp.RetryAfterMs > 60000 || !strings.Contains(resp.Error, "too soon: at most 2 agent deploys every 1m0s") {
+		t.Errorf("third agent deploy: %d %+v", code, resp)
+	}
+	if f.LiveCommit() != "bbbb2222" {
+		t.Errorf("live = %s after a refused deploy", f.LiveCommit())
+	}
+	// Other sources, and the daemon's own deploys, aren't held to it.
+	if _, code := deploy("cccc3333", "human"); code != 200 {
+		t.Errorf("human deploy: %d", code)
+	}
+	if _, code := deploy("dddd4444", ""); code != 200 {
+		t.Errorf("daemon deploy: %d", code)
+	}
+
+	// deploy_min_interval_ms spaces out every source, and the API says
+	// when to retry.
+	f.mu.Lock()
+	f.cfg.DeployMinIntervalMs = 30000
+	f.mu.Unlock()
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("POST", "/deploy", strings.NewReader(`{"commit":"eeee5555","source":"webhook"}`)))
+	if w.Code != 429 || w.Header().Get("Retry-After") == "" || !strings.Contains(w.Body.String(), "deploy_min_interval_ms") {
+		t.Errorf("webhook deploy: %d %q %s", w.Code, w.Header().Get("Retry-After"), w.Body)
+	}
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("POST", "/deploy", strings.NewReader(`{"commit":"eeee5555","source":"robot"}`)))
+	if w.Code != 400 {
+		t.Errorf("unknown source: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestDeployCoalesce(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{DeployCoalesceMs: 200})
+
+	// Three deploys in quick succession: only the last one runs.
+	type result struct {
+		resp DeployResponse
+		code int
+	}
+	results := make([]chan result, 3)
+	for i, c := range []string{"aaaa1111", "bbbb2222", "cccc3333"} {
+		results[i] = make(chan result, 1)
+		go func() {
+			resp, code := f.DeployWithOptions(c, DeployOptions{Source: "agent"})
+			results[i] <- result{resp, code}
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}
+	for i := range 2 {
+		r := <-results[i]
+		if r.code != 409 || r.resp.SupersededBy == "" || r.resp.SupersededBy == r.resp.Commit {
+			t.Errorf("deploy %d: %d %+v", i, r.code, r.resp)
+		}
+	}
+	if r := <-results[2]; r.code != 200 || !r.resp.Success {
+		t.Errorf("last deploy: %d %+v", r.code, r.resp)
+	}
+	if f.LiveCommit() != "cccc3333" {
+		t.Errorf("live = %s", f.LiveCommit())
+	}
+	if n := len(f.runner.started()); n != 1 {
+		t.Errorf("%d processes started, want 1", n)
+	}
+}
+
+func TestChaosDelaysSwitches(t *testing.T) {
+	f := newFakeEngine(t, Config{})
+	f.chaos = NewChaos(20*time.Millisecond, 1)
+
+	check := func(what string) {
+		t.Helper()
+		f.mu.Lock()
+		live := f.liveSlot
+		f.mu.Unlock()
+		if f.appProxy.Target() != live.appPort || f.intProxy.Target() != live.intPort {
+			t.Errorf("after %s: proxies at %d/%d, live slot at %d/%d", what, f.appProxy.Target(), f.intProxy.Target(), live.appPort, live.intPort)
+		}
+	}
+	for _, c := range []string{"aaaa1111", "bbbb2222"} {
+		if resp, _ := f.Deploy(c); !resp.Success {
+			t.Fatalf("deploy %s: %+v", c, resp)
+		}
+		check("deploy " + c)
+	}
+	if resp, _ := f.Rollback(); !resp.Success {
+		t.Fatalf("rollback: %+v", resp)
+	}
+	check("rollback")
+
+	// Each delay stays under the maximum, and a nil Chaos adds none.
+	start := time.Now()
+	for range 10 {
+		f.chaos.delay("test")
+	}
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Errorf("10 delays of at most 20ms took %s", d)
+	}
+	(*Chaos)(nil).delay("test")
+}
+
+func TestProxyAddrs(t *testing.T) {
+	for _, tc := range []struct {
+		json               string
+		app, tls, internal string
+		err                string
+	}{
+		{json: `{"port": 3000, "internal_port": 3000}`, app: ":3000"},
+		{json: `{"port": 3000, "internal_port": 3001, "tls_port": 443}`, app: ":3000", tls: ":443", internal: ":3001"},
+		{json: `{"port": 3000, "bind_address": "127.0.0.1"}`, app: "127.0.0.1:3000"},
+		{json: `{"port": 3000, "internal_port": 3001, "bind_address": ["0.0.0.0", "::"]}`,
+			app: "0.0.0.0:3000 [::]:3000", internal: "0.0.0.0:3001 [::]:3001"},
+		{json: `{"port": 3000, "internal_port": 3001, "bind_address": "0.0.0.0", "internal_bind_address": ["10.0.0.2", "[::1]"]}`,
+			app: "0.0.0.0:3000", internal: "10.0.0.2:3001 [::1]:3001"},
+		{json: `{"port": 3000, "bind_address": "127.0.0.1:80"}`, err: "bind_address"},
+		{json: `{"port": 3000, "internal_port": 3001, "internal_bind_address": [""]}`, err: "internal_bind_address"},
+	} {
+		var cfg Config
+		if err := json.Unmarshal([]byte(tc.json), &cfg); err != nil {
+			t.Fatalf("%s: %v", tc.json, err)
+		}
+		app, tls, internal, err := ProxyAddrs(cfg)
+		if tc.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tc.err+":") {
+				t.Errorf("%s: err = %v, want a %s error", tc.json, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.json, err)
+			continue
+		}
+		got := []string{strings.Join(app, " "), strings.Join(tls, " "), strings.Join(internal, " ")}
+		if want := []string{tc.app, tc.tls, tc.internal}; !slices.Equal(got, want) {
+			t.Errorf("%s: addrs = %q, want %q", tc.json, got, want)
+		}
+	}
+
+	var cfg Config
+	if err := json.Unmarshal([]byte(`{"bind_address": 127}`), &cfg); err == nil {
+		t.Error("numeric bind_address was accepted")
+	}
+}
+
+func TestCheckClientAddrs(t *testing.T) {
+	for _, tc := range []struct {
+		cfg Config
+		err string
+	}{
+		{Config{}, ""},
+		{Config{TrustedProxies: []string{"10.0.0.0/8", "127.0.0.1", "::1", "2001:db8::/32"}, ProxyProtocol: &ProxyProtocol{Accept: true, Send: "v2"}}, ""},
+		{Config{TrustedProxies: []string{"10.0.0.0/33"}}, "trusted_proxies"},
+		{Config{TrustedProxies: []string{"lb.internal"}}, "trusted_proxies"},
+		{Config{ProxyProtocol: &ProxyProtocol{Send: "v3"}}, "proxy_protocol.send"},
+		{Config{ProxyProtocol: &ProxyProtocol{Send: "v1"}, H2C: true}, "h2c"},
+		{Config{ProxyProtocol: &ProxyProtocol{Accept: true}}, "needs trusted_proxies"},
+		{Config{ProxyProtocol: &ProxyProtocol{Send: "v2"}}, ""},
+	} {
+		err := CheckClientAddrs(tc.cfg)
+		if (err == nil) != (tc.err == "") || (err != nil && !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%+v: err = %v, want %q", tc.cfg, err, tc.err)
+		}
+	}
+
+	prefixes, _ := trustedProxies([]string{"10.1.2.3/8", "::ffff:127.0.0.1"})
+	if len(prefixes) != 2 || prefixes[0].String() != "10.0.0.0/8" || prefixes[1].String() != "127.0.0.1/32" {
+		t.Errorf("prefixes = %v", prefixes)
+	}
+
+	// Reload applies trusted_proxies, refuses bad ones, and keeps
+	// proxy_protocol, which the listeners were bound with.
+	f := newFakeEngine(t, Config{})
+	cfg := f.cfg
+	cfg.TrustedProxies = []string{"nonsense"}
+	if _, err := f.Reload(cfg); err == nil {
+		t.Error("reload accepted bad trusted_proxies")
+	}
+	cfg.TrustedProxies = []string{"10.0.0.0/8"}
+	cfg.ProxyProtocol = &ProxyProtocol{Accept: true}
+	kept, err := f.Reload(cfg)
+	if err != nil || !slices.Contains(kept, "proxy_protocol") || f.cfg.ProxyProtocol != nil || len(f.cfg.TrustedProxies) != 1 {
+		t.Errorf("reload: kept %v, %v; cfg %+v", kept, err, f.cfg)
+	}
+}
+
+func TestExposeRestartsTunnel(t *testing.T) {
+	f := newFakeEngine(t, Config{Expose: &Expose{Provider: "cloudflared"}})
+	f.appProxy.SetAddrs(":8080")
+	go f.Expose()
+
+	tunnel := func() ExposeStatus {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.tunnel == nil {
+			return ExposeStatus{}
+		}
+		return *f.tunnel
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s; tunnel %+v", what, tunnel())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitFor("the tunnel", func() bool { return len(f.runner.started()) == 1 && tunnel().Running })
+	if p := f.runner.started()[0]; p.dir != f.dataDir {
+		t.Errorf("tunnel runs in %s", p.dir)
+	}
+	if got := exposeCommand(*f.cfg.Expose, "127.0.0.1:8080"); got != "cloudflared tunnel --no-autoupdate --url http://127.0.0.1:8080" {
+		t.Errorf("command = %q", got)
+	}
+
+	// The URL the tunnel prints is picked up.
+	os.WriteFile(filepath.Join(f.dataDir, exposeLogName), []byte("INF |  https://quiet-fox-rain.trycloudflare.com  |\n"), 0644)
+	waitFor("the URL", func() bool { return tunnel().URL == "https://quiet-fox-rain.trycloudflare.com" })
+
+	// A tunnel that exits is started again, and has to print its URL anew.
+	f.runner.started()[0].exit()
+	waitFor("the tunnel to go down", func() bool { return !tunnel().Running })
+	if st := tunnel(); st.URL != "" || st.Error != "exited" {
+		t.Errorf("after exit: %+v", st)
+	}
+	waitFor("the restart", func() bool { return len(f.runner.started()) == 2 && tunnel().Running })
+	if st := tunnel(); st.Restarts != 1 || st.Error != "" {
+		t.Errorf("after restart: %+v", st)
+	}
+
+	// DrainAll stops it for good.
+	f.DrainAll()
+	if sigs := f.runner.started()[1].received(); !slices.Equal(sigs, []syscall.Signal{syscall.SIGTERM}) {
+		t.Errorf("tunnel received %v", sigs)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if n := len(f.runner.started()); n != 2 {
+		t.Errorf("%d tunnels started after DrainAll", n-2)
+	}
+}
+
+func TestCheckExpose(t *testing.T) {
+	for _, tc := range []struct {
+		e   *Expose
+		err bool
+	}{
+		{nil, false},
+		{&Expose{Provider: "ngrok"}, false},
+		{&Expose{Provider: "cloudflared", Command: "cloudflared tunnel run --token $TOKEN", URL: "https://app.example.com"}, false},
+		{&Expose{}, true},
+		{&Expose{Provider: "tailscale"}, true},
+	} {
+		if err := CheckExpose(Config{Expose: tc.e}); (err != nil) != tc.err {
+			t.Errorf("%+v: err = %v", tc.e, err)
+		}
+	}
+	if got := exposeCommand(Expose{Provider: "ngrok"}, "[::1]:80"); got != "ngrok http [::1]:80 --log stdout --log-format json" {
+		t.Errorf("ngrok command = %q", got)
+	}
+	m := exposeURLs["ngrok"].FindSubmatch([]byte(`{"lvl":"info","msg":"started tunnel","obj":"tunnels","url":"https://ab12.ngrok-free.app"}`))
+	if m == nil || string(m[1]) != "https://ab12.ngrok-free.app" {
+		t.Errorf("ngrok URL = %q", m)
+	}
+}
+
+func TestUpstreamLimits(t *testing.T) {
+	f := newFakeEngine(t, Config{CircuitBreaker: &CircuitBreaker{}})
+	if c := f.appProxy.Stats().Circuit; c != proxy.CircuitClosed {
+		t.Errorf("circuit = %q, want the breaker on with defaults", c)
+	}
+	cfg := f.cfg
+	cfg.CircuitBreaker = nil
+	if _, err := f.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if c := f.appProxy.Stats().Circuit; c != "" {
+		t.Errorf("circuit = %q after reload without circuit_breaker", c)
+	}
+}
+
+func TestSlotPortsReused(t *testing.T) {
+	f := newFakeEngine(t, Config{})
+	ports := func() [2]int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return [2]int{f.liveSlot.appPort, f.liveSlot.intPort}
+	}
+	f.Deploy("aaaa1111")
+	a := ports()
+	f.Deploy("bbbb2222")
+	b := ports()
+	if a == b {
+		t.Fatalf("two live slots on the same ports %v", a)
+	}
+
+	// A deploy takes the ports of the previous slot it retires, and a
+	// rollback gets the release's own back.
+	f.Deploy("cccc3333")
+	if c := ports(); c != a {
+		t.Errorf("third deploy on %v, want the first's %v", c, a)
+	}
+	if resp, _ := f.Rollback(); !resp.Success {
+		t.Fatalf("rollback: %+v", resp)
+	}
+	if got := ports(); got != b {
+		t.Errorf("rolled back onto %v, want %v", got, b)
+	}
+
+	// Ports taken since go to fresh ones.
+	busy, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", a[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	f.Deploy("dddd4444")
+	if d := ports(); d[0] == a[0] || d[1] != a[1] {
+		t.Errorf("deploy with %d busy on %v", a[0], d)
+	}
+
+	// Reserved ports stay bound until released.
+	port, err := f.ports.reserve(0, portRange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+		l.Close()
+		t.Errorf("reserved port %d could be bound", port)
+	}
+	f.ports.release(port)
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Errorf("released port %d: %v", port, err)
+	} else {
+		l.Close()
+	}
+}
+
+func TestSlotPortRange(t *testing.T) {
+	low, err := findFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	low = min(low, 65535-3)
+	f := newFakeEngine(t, Config{SlotPortRange: []int{low, low + 3}})
+	inRange := func(ports ...int) {
+		t.Helper()
+		for _, p := range ports {
+			if p < low || p > low+3 {
+				t.Fatalf("port %d outside %d-%d", p, low, low+3)
+			}
+		}
+	}
+
+	if resp, _ := f.Deploy("aaaa1111"); !resp.Success {
+		t.Fatalf("deploy: %+v", resp)
+	}
+	f.mu.Lock()
+	inRange(f.liveSlot.appPort, f.liveSlot.intPort)
+	f.mu.Unlock()
+
+	// Wrapping around, a preferred port outside the range is passed over.
+	seen := map[int]bool{}
+	for range 4 {
+		app, internal, err := f.reservePorts(1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inRange(app, internal)
+		seen[app], seen[internal] = true, true
+		f.ports.release(app, internal)
+	}
+	if len(seen) < 2 {
+		t.Errorf("reserved only %v", seen)
+	}
+
+	// With every port in the range taken, a deploy fails saying so.
+	for p := low; p <= low+3; p++ {
+		if l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", p)); err == nil {
+			defer l.Close()
+		}
+	}
+	resp, _ := f.Deploy("bbbb2222")
+	if resp.Success || !strings.Contains(resp.Error, "slot_port_range") {
+		t.Errorf("deploy with the range exhausted: %+v", resp)
+	}
+}
+
+func TestReadyCallback(t *testing.T) {
+	f := newFakeEngine(t, Config{HealthTimeoutMs: 10000, ReadyCallbackTimeoutMs: 5000})
+	f.apiURL = "http://127.0.0.1:9100"
+	f.health.hold = make(chan struct{}) // polls never pass
+
+	done := make(chan DeployResponse)
+	go func() {
+		resp, _ := f.Deploy("aaaa1111")
+		done <- resp
+	}()
+	var env []string
+	for env == nil {
+		if procs := f.runner.started(); len(procs) > 0 {
+			env = procs[0].env
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !slices.Contains(env, "SLOT_MACHINE_READY_URL=http://127.0.0.1:9100/ready") {
+		t.Errorf("env without the ready URL: %v", env)
+	}
+	var token string
+	for _, kv := range env {
+		if v, ok := strings.CutPrefix(kv, "SLOT_MACHINE_READY_TOKEN="); ok {
+			token = v
+		}
+	}
+	ready := func(token string) int {
+		req := httptest.NewRequest("POST", "/ready", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := ready("wrong"); code != 401 {
+		t.Errorf("callback with a wrong token: %d", code)
+	}
+	if code := ready(token); code != 204 {
+		t.Fatalf("callback: %d", code)
+	}
+	select {
+	case resp := <-done:
+		if !resp.Success {
+			t.Fatalf("deploy: %+v", resp)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the deploy didn't go on after the callback")
+	}
+	if code := ready(token); code != 401 {
+		t.Errorf("token used twice: %d", code)
+	}
+
+	// Without a callback, the slot is polled once the wait is over.
+	f.mu.Lock()
+	f.cfg.ReadyCallbackTimeoutMs = 50
+	f.mu.Unlock()
+	close(f.health.hold)
+	if resp, _ := f.Deploy("bbbb2222"); !resp.Success {
+		t.Fatalf("deploy without a callback: %+v", resp)
+	}
+	f.health.mu.Lock()
+	defer f.health.mu.Unlock()
+	if n := len(f.health.checked); n != 1 {
+		t.Errorf("%d health checks, want only the second deploy's", n)
+	}
+}
+
+func TestDeployMessage(t *testing.T) {
+	f := newFakeEngine(t, Config{})
+	status := func(f *fakeEngine) StatusResponse {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+		var sr StatusResponse
+		json.Unmarshal(w.Body.Bytes(), &sr)
+		return sr
+	}
+
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("POST", "/deploy", strings.NewReader(`{"commit": "aaaa1111", "message": "hotfix for checkout bug"}`)))
+	if w.Code != 200 {
+		t.Fatalf("deploy: %d %s", w.Code, w.Body)
+	}
+	f.Deploy("bbbb2222")
+	if sr := status(f); sr.LiveMessage != "" || sr.PreviousMessage != "hotfix for checkout bug" {
+		t.Errorf("status messages %q, %q", sr.LiveMessage, sr.PreviousMessage)
+	}
+	if e := f.RecentDeploys(2); e[0].Message != "hotfix for checkout bug" || e[1].Message != "" {
+		t.Errorf("journal = %+v", e)
+	}
+
+	// The message goes with the release: rolled back to, and across a
+	// daemon restart.
+	if resp, _ := f.Rollback(); !resp.Success {
+		t.Fatalf("rollback: %+v", resp)
+	}
+	if sr := status(f); sr.LiveMessage != "hotfix for checkout bug" {
+		t.Errorf("live message after rollback %q", sr.LiveMessage)
+	}
+	g := f.restart(t)
+	<-g.RecoverState()
+	if sr := status(g); sr.LiveMessage != "hotfix for checkout bug" {
+		t.Errorf("live message after restart %q", sr.LiveMessage)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	f := newFakeEngine(t, Config{HealthTimeoutMs: 5000})
+	postRelease := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("POST", "/releases", strings.NewReader(body)))
+		return w
+	}
+	// lastStart returns the env and health timeout the last slot started with.
+	lastStart := func() ([]string, time.Duration) {
+		procs := f.runner.started()
+		f.health.mu.Lock()
+		defer f.health.mu.Unlock()
+		return procs[len(procs)-1].env, f.health.timeouts[len(f.health.timeouts)-1]
+	}
+	healthTimeout := func(f *fakeEngine) int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.cfg.HealthTimeoutMs
+	}
+
+	f.Deploy("aaaa1111")
+	if w := postRelease(`{"commit": "bbbb2222", "env": {"FEATURE_X": "on"}, "config": {"health_timeout_ms": 1234}}`); w.Code != 200 {
+		t.Fatalf("release: %d %s", w.Code, w.Body)
+	}
+	if env, timeout := lastStart(); !slices.Contains(env, "FEATURE_X=on") || timeout != 1234*time.Millisecond {
+		t.Errorf("release started with timeout %s, env %v", timeout, env)
+	}
+	if r := f.status(t).LiveRelease; r == nil || !slices.Equal(r.Env, []string{"FEATURE_X"}) || *r.Config.HealthTimeoutMs != 1234 {
+		t.Errorf("status live_release = %+v", r)
+	}
+
+	// Only what a release may set, and no variables of the daemon's own.
+	for _, body := range []string{`{"config": {"port": 80}}`, `{"env": {"PORT": "80"}}`} {
+		if w := postRelease(body); w.Code != 400 {
+			t.Errorf("%s: %d %s", body, w.Code, w.Body)
+		}
+	}
+
+	// A failed release leaves the live one's config.
+	f.health.results = []bool{false}
+	if w := postRelease(`{"commit": "cccc3333", "config": {"health_timeout_ms": 999}}`); !strings.Contains(w.Body.String(), errHealthCheckFailed) {
+		t.Fatalf("release with a failing health check: %s", w.Body)
+	}
+	if got := healthTimeout(f); got != 1234 {
+		t.Errorf("health_timeout_ms after a failed release = %d", got)
+	}
+
+	// A plain deploy keeps the live release's env and config; {} goes back
+	// to the file's config, keeping the env.
+	f.Deploy("dddd4444")
+	if env, timeout := lastStart(); !slices.Contains(env, "FEATURE_X=on") || timeout != 1234*time.Millisecond {
+		t.Errorf("deploy started with timeout %s, env %v", timeout, env)
+	}
+	if w := postRelease(`{"commit": "eeee5555", "config": {}}`); w.Code != 200 {
+		t.Fatalf("release: %d %s", w.Code, w.Body)
+	}
+	if env, timeout := lastStart(); !slices.Contains(env, "FEATURE_X=on") || timeout != 5*time.Second {
+		t.Errorf("release with config {} started with timeout %s, env %v", timeout, env)
+	}
+
+	// Rollback brings back the previous bundle, which survives a restart.
+	if resp, _ := f.Rollback(); !resp.Success {
+		t.Fatalf("rollback: %+v", resp)
+	}
+	if _, timeout := lastStart(); timeout != 1234*time.Millisecond || healthTimeout(f) != 1234 {
+		t.Errorf("rollback started with timeout %s, config has %d", timeout, healthTimeout(f))
+	}
+	g := f.restart(t)
+	<-g.RecoverState()
+	if got := healthTimeout(g); got != 1234 {
+		t.Errorf("health_timeout_ms after restart = %d", got)
+	}
+	if r := g.status(t).LiveRelease; r == nil || !slices.Equal(r.Env, []string{"FEATURE_X"}) {
+		t.Errorf("status live_release after restart = %+v", r)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	f := newFakeEngine(t, Config{})
+	f.Deploy("aaaa1111")
+	f.adminToken = "s3cret"
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := serve("POST", "/read-only", ""); w.Code != 200 {
+		t.Fatalf("POST /read-only: %d %s", w.Code, w.Body)
+	}
+	for _, path := range []string{"/deploy", "/rollback", "/restart", "/lock", "/exec"} {
+		if w := serve("POST", path, `{"commit": "bbbb2222"}`); w.Code != 403 || !strings.Contains(w.Body.String(), errReadOnly) {
+			t.Errorf("POST %s: %d %s", path, w.Code, w.Body)
+		}
+	}
+	if f.LiveCommit() != "aaaa1111" || f.Locked() != nil {
+		t.Errorf("read-only daemon changed: live %s, lock %v", f.LiveCommit(), f.Locked())
+	}
+	if sr := f.status(t); !sr.ReadOnly || sr.LiveCommit != "aaaa1111" {
+		t.Errorf("status = %+v", sr)
+	}
+	if w := serve("GET", "/history", ""); w.Code != 200 {
+		t.Errorf("GET /history: %d", w.Code)
+	}
+
+	// Leaving read-only mode takes the admin token.
+	if w := serve("DELETE", "/read-only", `{"admin_token": "nope"}`); w.Code != 403 || !f.ReadOnly() {
+		t.Fatalf("DELETE /read-only with a wrong token: %d %s", w.Code, w.Body)
+	}
+	if w := serve("DELETE", "/read-only", `{"admin_token": "s3cret"}`); w.Code != 200 || f.ReadOnly() {
+		t.Fatalf("DELETE /read-only: %d %s", w.Code, w.Body)
+	}
+	if w := serve("POST", "/deploy", `{"commit": "bbbb2222"}`); w.Code != 200 {
+		t.Errorf("deploy after read-write: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestReadOnlyFromConfig(t *testing.T) {
+	// Without an admin token, DELETE undoes a POST.
+	g := newFakeEngine(t, Config{})
+	g.SetReadOnly(true)
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest("DELETE", "/read-only", nil))
+	if w.Code != 200 || g.ReadOnly() {
+		t.Fatalf("DELETE /read-only after POST: %d %s", w.Code, w.Body)
+	}
+
+	for _, token := range []string{"", "s3cret"} {
+		f := newFakeEngine(t, Config{})
+		f.adminToken = token
+		f.readOnly, f.readOnlyConfig = true, true
+		serve := func(method, path, body string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+			return w
+		}
+
+		if token == "" {
+			// Without an admin token, nothing makes it read-write.
+			if w := serve("DELETE", "/read-only", ""); w.Code != 403 || !strings.Contains(w.Body.String(), "config") || !f.ReadOnly() {
+				t.Fatalf("DELETE /read-only without an admin token: %d %s", w.Code, w.Body)
+			}
+			continue
+		}
+		if w := serve("DELETE", "/read-only", ""); w.Code != 403 || !f.ReadOnly() {
+			t.Fatalf("DELETE /read-only without the token: %d %s", w.Code, w.Body)
+		}
+		if w := serve("DELETE", "/read-only", `{"admin_token": "s3cret"}`); w.Code != 200 || f.ReadOnly() {
+			t.Fatalf("DELETE /read-only with the token: %d %s", w.Code, w.Body)
+		}
+	}
+}
+
+func TestStandby(t *testing.T) {
+	primary := newFakeEngine(t, Config{})
+	primary.Deploy("aaaa1111")
+	srv := httptest.NewServer(primary)
+	defer srv.Close()
+
+	f := newFakeEngine(t, Config{Peer: &Peer{Primary: srv.URL}})
+	if err := f.syncPeer(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if e := f.RecentDeploys(10); len(e) != 1 || e[0].Commit != "aaaa1111" {
+		t.Fatalf("replicated journal = %+v", e)
+	}
+	if len(f.runner.started()) != 0 {
+		t.Errorf("a standby started %d processes", len(f.runner.started()))
+	}
+	sr := f.status(t)
+	if sr.State != "standby" || sr.Standby == nil || sr.Standby.WarmCommit != "aaaa1111" || sr.Standby.PrimaryCommit != "aaaa1111" {
+		t.Fatalf("status = %+v, standby %+v", sr, sr.Standby)
+	}
+	if resp, code := f.Deploy("bbbb2222"); code != 409 || resp.Success {
+		t.Errorf("deploy on a standby: %d %+v", code, resp)
+	}
+
+	// A second sync doesn't replicate the same entries again.
+	if err := f.syncPeer(); err != nil {
+		t.Fatalf("second sync: %v", err)
+	}
+	if e := f.RecentDeploys(10); len(e) != 1 {
+		t.Errorf("journal after a second sync has %d entries", len(e))
+	}
+
+	// The warm slot survives a restart of the standby.
+	g := f.restart(t)
+	<-g.RecoverState()
+	if len(g.runner.started()) != 0 {
+		t.Errorf("a restarted standby started %d processes", len(g.runner.started()))
+	}
+
+	resp, code := g.Promote()
+	if code != 200 || !resp.Success {
+		t.Fatalf("promote: %d %+v", code, resp)
+	}
+	if g.LiveCommit() != "aaaa1111" || g.Standby() {
+		t.Errorf("after promote: live %s, standby %v", g.LiveCommit(), g.Standby())
+	}
+	if e := g.RecentDeploys(1); e[0].Action != "promote" {
+		t.Errorf("last journal entry = %+v", e[0])
+	}
+	if _, code := g.Promote(); code != 400 {
+		t.Errorf("promoting a primary: %d", code)
+	}
+
+	// Promoted stays promoted, though the config still has peer.
+	h := g.restart(t)
+	<-h.RecoverState()
+	if h.Standby() || h.LiveCommit() != "aaaa1111" {
+		t.Errorf("after restart: standby %v, live %s", h.Standby(), h.LiveCommit())
+	}
+}
+
+func TestStandbyReleaseEnv(t *testing.T) {
+	primary := newFakeEngine(t, Config{})
+	primary.adminToken = "s3cret"
+	w := httptest.NewRecorder()
+	primary.ServeHTTP(w, httptest.NewRequest("POST", "/releases", strings.NewReader(`{"commit": "aaaa1111", "env": {"API_KEY": "hunter2"}}`)))
+	if w.Code != 200 {
+		t.Fatalf("release: %d %s", w.Code, w.Body)
+	}
+	srv := httptest.NewServer(primary)
+	defer srv.Close()
+
+	// Without the admin token, GET /peer leaves out the env values.
+	w = httptest.NewRecorder()
+	primary.ServeHTTP(w, httptest.NewRequest("GET", "/peer", nil))
+	if strings.Contains(w.Body.String(), "hunter2") || !strings.Contains(w.Body.String(), `"env_withheld":true`) {
+		t.Fatalf("GET /peer without a token = %s", w.Body)
+	}
+
+	// So a standby without it replicates the journal but warms nothing.
+	f := newFakeEngine(t, Config{Peer: &Peer{Primary: srv.URL}})
+	if err := f.syncPeer(); err == nil || !strings.Contains(err.Error(), "SLOT_MACHINE_ADMIN_TOKEN") {
+		t.Fatalf("sync without the admin token: %v", err)
+	}
+	if len(f.RecentDeploys(10)) != 1 || f.warm != nil {
+		t.Fatalf("journal %+v, warm %+v", f.RecentDeploys(10), f.warm)
+	}
+
+	f.adminToken = "s3cret"
+	if err := f.syncPeer(); err != nil {
+		t.Fatalf("sync with the admin token: %v", err)
+	}
+	if f.warm == nil || f.warm.release == nil || f.warm.release.Env["API_KEY"] != "hunter2" {
+		t.Fatalf("warm = %+v", f.warm)
+	}
+}
+
+func TestSlotManifest(t *testing.T) {
+	f := newFakeEngine(t, Config{ManifestIgnore: []string{"log"}})
+	f.worktrees.files = map[string]map[string]string{
+		"aaaa1111": {"app.js": "console.log(1)", "package-lock.json": "{}"},
+	}
+	if resp, _ := f.Deploy("aaaa1111"); !resp.Success {
+		t.Fatalf("deploy: %+v", resp)
+	}
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	w := serve("/slots/live/manifest")
+	var sm SignedManifest
+	if err := json.Unmarshal(w.Body.Bytes(), &sm); err != nil || w.Code != 200 {
+		t.Fatalf("GET /slots/live/manifest: %d %s", w.Code, w.Body)
+	}
+	m := sm.Manifest
+	if m.Slot != "slot-aaaa1111" || m.Commit != "aaaa1111" || len(m.Files) != 2 || m.Lockfiles["package-lock.json"] == "" {
+		t.Errorf("manifest = %+v", m)
+	}
+	if e := f.RecentDeploys(1); e[0].Manifest != m.Digest {
+		t.Errorf("journal manifest = %q, want %q", e[0].Manifest, m.Digest)
+	}
+	pub, _ := base64.StdEncoding.DecodeString(sm.PublicKey)
+	sig, _ := base64.StdEncoding.DecodeString(sm.Signature)
+	body, _ := json.Marshal(m)
+	if !ed25519.Verify(pub, body, sig) {
+		t.Error("manifest signature doesn't verify")
+	}
+
+	if check, code := f.VerifySlot("live"); code != 200 || !check.OK {
+		t.Fatalf("verify untouched slot: %d %+v", code, check)
+	}
+
+	// Edits in prod show up; what manifest_ignore matches doesn't.
+	dir := filepath.Join(f.dataDir, "slot-aaaa1111")
+	os.WriteFile(filepath.Join(dir, "app.js"), []byte("console.log('pwned')"), 0644)
+	os.WriteFile(filepath.Join(dir, "backdoor.js"), []byte("x"), 0644)
+	os.Remove(filepath.Join(dir, "package-lock.json"))
+	os.MkdirAll(filepath.Join(dir, "log"), 0755)
+	os.WriteFile(filepath.Join(dir, "log", "app.log"), []byte("hello"), 0644)
+	check, _ := f.VerifySlot("live")
+	if check.OK || !check.SignatureOK || !slices.Equal(check.Modified, []string{"app.js"}) ||
+		!slices.Equal(check.Added, []string{"backdoor.js"}) || !slices.Equal(check.Deleted, []string{"package-lock.json"}) {
+		t.Errorf("verify edited slot = %+v", check)
+	}
+
+	// A manifest edited to match fails its signature.
+	m.Files["app.js"] = "0000"
+	sm.Manifest = m
+	data, _ := json.Marshal(sm)
+	os.WriteFile(manifestPath(f.dataDir, "slot-aaaa1111"), data, 0644)
+	if check, _ := f.VerifySlot("live"); check.SignatureOK {
+		t.Errorf("tampered manifest verified: %+v", check)
+	}
+
+	if w := serve("/slots/nope/verify"); w.Code != 404 {
+		t.Errorf("verify unknown slot: %d", w.Code)
+	}
+}
+
+func TestDriftCheck(t *testing.T) {
+	t.Parallel()
+	hooks := make(chan map[string]any, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]any
+		json.NewDecoder(r.Body).Decode(&event)
+		hooks <- event
+	}))
+	defer srv.Close()
+	f := newFakeEngine(t, Config{DriftCheck: &DriftCheck{BlockRollback: true, Webhooks: []string{srv.URL}}})
+	f.Deploy("aaaa1111")
+	f.Deploy("bbbb2222")
+
+	f.checkDrift()
+	if sr := f.status(t); len(sr.Drift) != 0 {
+		t.Fatalf("drift in clean slots: %+v", sr.Drift)
+	}
+
+	// Someone hot-patches a file in each slot.
+	patched := WorktreeChanges{Modified: 1}
+	f.worktrees.mu.Lock()
+	f.worktrees.dirChanges = map[string]WorktreeChanges{
+		filepath.Join(f.dataDir, "slot-aaaa1111"): patched,
+		filepath.Join(f.dataDir, "slot-bbbb2222"): patched,
+	}
+	f.worktrees.mu.Unlock()
+	f.checkDrift()
+	sr := f.status(t)
+	if len(sr.Drift) != 2 || sr.Drift[0].Slot != "slot-aaaa1111" || sr.Drift[0].Role != "prev" || sr.Drift[1].Role != "live" {
+		t.Fatalf("drift = %+v", sr.Drift)
+	}
+	for range 2 {
+		select {
+		case event := <-hooks:
+			if event["event"] != "slot_drift" {
+				t.Errorf("webhook = %v", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no slot_drift webhook")
+		}
+	}
+	// Unchanged drift isn't reported again.
+	since := sr.Drift[0].Since
+	f.checkDrift()
+	if sr := f.status(t); sr.Drift[0].Since != since {
+		t.Errorf("since moved: %s -> %s", since, sr.Drift[0].Since)
+	}
+	select {
+	case event := <-hooks:
+		t.Errorf("reported again: %v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// block_rollback refuses to bring the patched prev back, unless forced.
+	if resp, code := f.Rollback(); code != 409 || !strings.Contains(resp.Error, "drifted") {
+		t.Fatalf("rollback to a drifted slot: %d %+v", code, resp)
+	}
+	if resp, code := f.RollbackWithOptions("", RollbackOptions{Force: true}); code != 200 || !resp.Success || f.LiveCommit() != "aaaa1111" {
+		t.Fatalf("forced rollback: %d %+v", code, resp)
+	}
+
+	f.worktrees.mu.Lock()
+	f.worktrees.dirChanges = nil
+	f.worktrees.mu.Unlock()
+	f.checkDrift()
+	if sr := f.status(t); len(sr.Drift) != 0 {
+		t.Errorf("drift after the files were restored: %+v", sr.Drift)
+	}
+}
+
+func TestAgentDeployApproval(t *testing.T) {
+	t.Parallel()
+	f := newFakeEngine(t, Config{AgentDeployApproval: true})
+	f.adminToken = "s3cret"
+	var events []string
+	f.Subscribe(func(e DaemonEvent) { events = append(events, e.Type+" "+e.Commit) }, EventDeployPending, EventDeployApproved, EventDeployRejected)
+	f.Deploy("aaaa1111")
+
+	// The agent's deploys wait; another request for the same commit is the
+	// same pending deploy.
+	resp, code := f.DeployWithOptions("bbbb2222", DeployOptions{Source: "agent", Message: "fix"})
+	if code != 202 || resp.Pending == nil || resp.Success || f.LiveCommit() != "aaaa1111" {
+		t.Fatalf("agent deploy: %d %+v", code, resp)
+	}
+	id := resp.Pending.ID
+	if again, _ := f.DeployWithOptions("bbbb2222", DeployOptions{Source: "agent", Message: "fix, really"}); again.Pending == nil || again.Pending.ID != id {
+		t.Fatalf("second request: %+v", again)
+	}
+	other, _ := f.DeployWithOptions("cccc3333", DeployOptions{Source: "agent"})
+	if sr := f.status(t); len(sr.PendingDeploys) != 2 || sr.PendingDeploys[0].Message != "fix, really" {
+		t.Fatalf("pending = %+v", sr.PendingDeploys)
+	}
+	if _, code := f.DeployWithOptions("dddd4444", DeployOptions{Source: "agent", Artifact: "/tmp/x.tar"}); code != 403 {
+		t.Errorf("agent artifact deploy: %d", code)
+	}
+
+	call := func(method, path, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		f.ServeHTTP(w, r)
+		return w
+	}
+	if w := call("GET", "/deploys/pending", ""); w.Code != 200 || !strings.Contains(w.Body.String(), id) {
+		t.Errorf("GET /deploys/pending: %d %s", w.Code, w.Body)
+	}
+
+	// Deciding takes the admin token: the agent can't approve its own.
+	for _, token := range []string{"", "wrong"} {
+		if w := call("POST", "/deploys/pending/"+id+"/approve", token); w.Code != 401 {
+			t.Fatalf("approve with token %q: %d %s", token, w.Code, w.Body)
+		}
+	}
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, Vouch(httptest.NewRequest("POST", "/deploys/pending/"+other.Pending.ID+"/reject", nil)))
+	if w.Code != 200 {
+		t.Fatalf("reject: %d %s", w.Code, w.Body)
+	}
+	w = call("POST", "/deploys/pending/"+id+"/approve", "s3cret")
+	var dr DeployResponse
+	json.Unmarshal(w.Body.Bytes(), &dr)
+	if w.Code != 200 || !dr.Success || f.LiveCommit() != "bbbb2222" {
+		t.Fatalf("approve: %d %s", w.Code, w.Body)
+	}
+	if w := call("POST", "/deploys/pending/"+id+"/approve", "s3cret"); w.Code != 404 {
+		t.Errorf("approving twice: %d", w.Code)
+	}
+	if sr := f.status(t); len(sr.PendingDeploys) != 0 {
+		t.Errorf("pending after deciding = %+v", sr.PendingDeploys)
+	}
+	want := []string{"deploy_pending bbbb2222", "deploy_pending bbbb2222", "deploy_pending cccc3333", "deploy_rejected cccc3333", "deploy_approved bbbb2222"}
+	if !slices.Equal(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+
+	// Claiming to be a human doesn't help; the admin token does.
+	if resp, code := f.DeployWithOptions("cccc3333", DeployOptions{Source: "human"}); code != 202 || resp.Pending == nil {
+		t.Errorf("deploy claiming to be a human's: %d %+v", code, resp)
+	}
+	r := httptest.NewRequest("POST", "/deploy", strings.NewReader(`{"commit": "cccc3333", "source": "human"}`))
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, r)
+	if w.Code != 200 || f.LiveCommit() != "cccc3333" {
+		t.Errorf("deploy with the admin token: %d %s", w.Code, w.Body)
+	}
+
+	// Once approval is off, anyone deploys at once.
+	f.mu.Lock()
+	f.cfg.AgentDeployApproval = false
+	f.mu.Unlock()
+	if resp, code := f.DeployWithOptions("bbbb2222", DeployOptions{Source: "agent"}); code != 200 || !resp.Success {
+		t.Errorf("agent deploy without approval: %d %+v", code, resp)
+	}
+}
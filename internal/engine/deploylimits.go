@@ -0,0 +1,171 @@
+package engine
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deploys requested from outside the daemon name their source: "agent"
+// (the chat agent's `slot-machine deploy`), "human" (the CLI, dashboard, or
+// API, the default), or "webhook" (a push hook). An over-eager agent can
+// deploy five times a minute, so each source can be held to a rate, and
+// all of them to deploy_min_interval_ms between deploys; one that comes
+// too soon gets a 429 saying when to retry. With deploy_coalesce_ms, a
+// deploy waits that long (and for one already running) before it starts,
+// and if a newer one arrives meanwhile it's superseded: only the latest
+// commit of a quick series is deployed. Deploys the daemon starts itself
+// (auto-deploy, dev mode, upstream) have no source and no limits.
+
+// coalescePoll is how often a coalescing deploy checks whether it may go.
+const coalescePoll = 50 * time.Millisecond
+
+// DeploySources are the values of a deploy's source.
+var DeploySources = []string{"agent", "human", "webhook"}
+
+// DeployRateLimit caps the deploys from one source.
+type DeployRateLimit struct {
+	Max           int `json:"max"`             // deploys per window (0 = no cap)
+	WindowSec     int `json:"window_sec"`      // default: 3600
+	MinIntervalMs int `json:"min_interval_ms"` // between two deploys from this source
+}
+
+func (l DeployRateLimit) window() time.Duration {
+	if l.WindowSec > 0 {
+		return time.Duration(l.WindowSec) * time.Second
+	}
+	return time.Hour
+}
+
+// deployGate holds the deploys that passed the limits, and the latest
+// deploy waiting to coalesce.
+type deployGate struct {
+	mu     sync.Mutex
+	starts []deployStart // oldest first
+	seq    int64         // of the latest coalescing deploy
+	latest string        // its commit
+}
+
+type deployStart struct {
+	source string
+	at     time.Time
+}
+
+// deploySource checks the source a deploy request names; "" means "human".
+func deploySource(source string) (string, error) {
+	if source == "" {
+		return "human", nil
+	}
+	if !slices.Contains(DeploySources, source) {
+		return "", fmt.Errorf("source must be one of %s", strings.Join(DeploySources, ", "))
+	}
+	return source, nil
+}
+
+// coalesceDeploy waits out deploy_coalesce_ms and any deploy in progress.
+// It returns the commit of a newer deploy that arrived meanwhile, which
+// supersedes this one, or "" once this one may start.
+func (o *Orchestrator) coalesceDeploy(commit string) string {
+	o.mu.Lock()
+	window := time.Duration(o.cfg.DeployCoalesceMs) * time.Millisecond
+	o.mu.Unlock()
+	if window <= 0 {
+		return ""
+	}
+
+	g := &o.gate
+	g.mu.Lock()
+	g.seq++
+	seq := g.seq
+	g.latest = commit
+	g.mu.Unlock()
+
+	deadline := time.Now().Add(window)
+	for {
+		time.Sleep(min(coalescePoll, max(time.Until(deadline), time.Millisecond)))
+		g.mu.Lock()
+		superseded, latest := g.seq != seq, g.latest
+		g.mu.Unlock()
+		if superseded {
+			return latest
+		}
+		if _, busy := o.locks.Holder(o.app); !busy && !time.Now().Before(deadline) {
+			return ""
+		}
+	}
+}
+
+// admitDeploy checks a deploy from source against deploy_min_interval_ms
+// and deploy_rate_limits and records it if it may go. Otherwise it returns
+// how long to wait and why.
+func (o *Orchestrator) admitDeploy(source string) (time.Duration, string) {
+	o.mu.Lock()
+	minInterval := time.Duration(o.cfg.DeployMinIntervalMs) * time.Millisecond
+	limits := o.cfg.DeployRateLimits
+	o.mu.Unlock()
+	limit := limits[source]
+
+	g := &o.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+
+	// Forget what no limit looks back at anymore.
+	keep := minInterval
+	for _, l := range limits {
+		keep = max(keep, l.window(), time.Duration(l.MinIntervalMs)*time.Millisecond)
+	}
+	i := sort.Search(len(g.starts), func(i int) bool { return now.Sub(g.starts[i].at) < keep })
+	g.starts = g.starts[i:]
+
+	var retry time.Duration
+	var reason string
+	wait := func(d time.Duration, why string) {
+		if d > retry {
+			retry, reason = d, why
+		}
+	}
+	if n := len(g.starts); n > 0 && minInterval > 0 {
+		if since := now.Sub(g.starts[n-1].at); since < minInterval {
+			wait(minInterval-since, fmt.Sprintf("deploys are at least %s apart (deploy_min_interval_ms)", minInterval))
+		}
+	}
+	var mine []time.Time
+	for _, s := range g.starts {
+		if s.source == source {
+			mine = append(mine, s.at)
+		}
+	}
+	if n := len(mine); n > 0 && limit.MinIntervalMs > 0 {
+		interval := time.Duration(limit.MinIntervalMs) * time.Millisecond
+		if since := now.Sub(mine[n-1]); since < interval {
+			wait(interval-since, fmt.Sprintf("%s deploys are at least %s apart (deploy_rate_limits.%s)", source, interval, source))
+		}
+	}
+	if limit.Max > 0 {
+		var inWindow []time.Time
+		for _, at := range mine {
+			if now.Sub(at) < limit.window() {
+				inWindow = append(inWindow, at)
+			}
+		}
+		if len(inWindow) >= limit.Max {
+			// Wait for enough of them to age out of the window.
+			oldest := inWindow[len(inWindow)-limit.Max]
+			wait(limit.window()-now.Sub(oldest), fmt.Sprintf("at most %d %s deploys every %s (deploy_rate_limits.%s)", limit.Max, source, limit.window(), source))
+		}
+	}
+	if retry > 0 {
+		return retry, reason
+	}
+	g.starts = append(g.starts, deployStart{source: source, at: now})
+	return 0, ""
+}
+
+// tooSoonError is the error of a deploy admitDeploy turned away.
+func tooSoonError(retry time.Duration, reason string) string {
+	return fmt.Sprintf("too soon: %s; retry after %s", reason, (retry + time.Second - 1).Truncate(time.Second))
+}
@@ -0,0 +1,63 @@
+package engine
+
+import (
+	"sync"
+	"time"
+)
+
+// DeployLocks serializes deploys and rollbacks per app. Orchestrators for
+// different apps can share one DeployLocks and still deploy concurrently;
+// two operations on the same app never overlap. The zero value is ready to
+// use, and a nil *DeployLocks holds nothing.
+type DeployLocks struct {
+	mu   sync.Mutex
+	held map[string]DeployHold
+}
+
+// DeployHold describes the operation holding an app's lock.
+type DeployHold struct {
+	Action string // "deploy" or "rollback"
+	Commit string
+	Since  time.Time
+}
+
+// NewDeployLocks returns an empty lock table.
+func NewDeployLocks() *DeployLocks {
+	return &DeployLocks{}
+}
+
+// TryAcquire takes app's lock without waiting. It returns a release func,
+// safe to call more than once and meant to be deferred so a panicking
+// deploy can't leave the app locked, or ok=false with the current holder.
+func (l *DeployLocks) TryAcquire(app, action, commit string) (release func(), holder DeployHold, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if h, busy := l.held[app]; busy {
+		return nil, h, false
+	}
+	h := DeployHold{Action: action, Commit: commit, Since: time.Now()}
+	if l.held == nil {
+		l.held = map[string]DeployHold{}
+	}
+	l.held[app] = h
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			delete(l.held, app)
+			l.mu.Unlock()
+		})
+	}, h, true
+}
+
+// Holder returns the operation currently holding app's lock, if any.
+func (l *DeployLocks) Holder(app string) (DeployHold, bool) {
+	if l == nil {
+		return DeployHold{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, ok := l.held[app]
+	return h, ok
+}
@@ -0,0 +1,169 @@
+package engine
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// People hot-patch files in the live slot to put out a fire, and the patch
+// lives on unseen: in the slot, and later in the release a rollback brings
+// back. With drift_check, the daemon runs git status in the live, previous
+// and retained slots every interval_sec. A slot whose tracked files differ
+// from its commit is listed under "drift" in GET /status, a slot_drift
+// event is published and drift_check.webhooks are told, once per change.
+// With block_rollback, a rollback to a slot that has drifted is refused
+// unless it's forced. Untracked files, which setup usually leaves, and the
+// paths in drift_check.ignore don't count.
+
+const defaultDriftInterval = 5 * time.Minute
+
+// DriftCheck configures the checks of slots against their commits.
+type DriftCheck struct {
+	IntervalSec   int      `json:"interval_sec"`   // default: 300
+	Ignore        []string `json:"ignore"`         // paths setup or the app changes on purpose
+	BlockRollback bool     `json:"block_rollback"` // refuse rollbacks to a drifted slot unless forced
+	Webhooks      []string `json:"webhooks"`       // POSTed a JSON slot_drift event
+}
+
+// SlotDrift is a slot whose tracked files differ from its commit.
+type SlotDrift struct {
+	Slot    string          `json:"slot"`
+	Commit  string          `json:"commit"`
+	Role    string          `json:"role"` // "live", "prev", or "retained"
+	Changes WorktreeChanges `json:"changes"`
+	Since   string          `json:"since"` // RFC3339, when it was first seen
+}
+
+// WatchDrift checks the slots every drift_check.interval_sec, as the
+// config says at the time. It never returns.
+func (o *Orchestrator) WatchDrift() {
+	for {
+		o.mu.Lock()
+		interval := defaultDriftInterval
+		if dc := o.cfg.DriftCheck; dc != nil && dc.IntervalSec > 0 {
+			interval = time.Duration(dc.IntervalSec) * time.Second
+		}
+		o.mu.Unlock()
+		time.Sleep(interval)
+		o.checkDrift()
+	}
+}
+
+// checkDrift runs git status in the live, previous, and retained slots and
+// reports those that drifted since the last check. Without drift_check it
+// forgets what it found.
+func (o *Orchestrator) checkDrift() {
+	type target struct {
+		s    *slot
+		role string
+	}
+	o.mu.Lock()
+	if o.cfg.DriftCheck == nil {
+		o.drift = nil
+		o.mu.Unlock()
+		return
+	}
+	ignore := o.cfg.DriftCheck.Ignore
+	live := o.liveSlot
+	if live == nil {
+		live = o.recovering
+	}
+	targets := []target{{live, "live"}, {o.prevSlot, "prev"}}
+	for _, s := range o.retained {
+		targets = append(targets, target{s, "retained"})
+	}
+	o.mu.Unlock()
+
+	found := map[string]*SlotDrift{}
+	for _, t := range targets {
+		if t.s == nil || isArtifact(t.s.commit) {
+			continue
+		}
+		c, err := o.worktrees.Changes(t.s.dir, ignore)
+		if err != nil {
+			fmt.Printf("warning: drift check of %s: %v\n", t.s.name, err)
+			continue
+		}
+		if c.Dirty() {
+			found[t.s.name] = &SlotDrift{Slot: t.s.name, Commit: t.s.commit, Role: t.role, Changes: c}
+		}
+	}
+
+	var news []SlotDrift
+	o.mu.Lock()
+	for name, d := range found {
+		old := o.drift[name]
+		if old == nil {
+			d.Since = time.Now().UTC().Format(time.RFC3339)
+		} else {
+			d.Since = old.Since
+		}
+		if old == nil || old.Changes != d.Changes {
+			news = append(news, *d)
+		}
+	}
+	o.drift = found
+	o.mu.Unlock()
+
+	sort.Slice(news, func(i, j int) bool { return news[i].Slot < news[j].Slot })
+	for _, d := range news {
+		fmt.Printf("warning: %s (%s) has drifted from %s: %s\n", d.Slot, d.Role, ShortHash(d.Commit), d.Changes)
+		o.Publish(EventSlotDrift, d.Commit, d.Slot, d)
+	}
+}
+
+// slotDrift lists the slots found drifted, by name. o.mu must be held.
+func (o *Orchestrator) slotDrift() []SlotDrift {
+	var list []SlotDrift
+	for _, d := range o.drift {
+		list = append(list, *d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Slot < list[j].Slot })
+	return list
+}
+
+// driftBlocks returns why a rollback to s is refused, or "" if it isn't:
+// with drift_check.block_rollback, s's tracked files must match its commit.
+// It runs git status in s rather than trust the last check.
+func (o *Orchestrator) driftBlocks(s *slot) string {
+	o.mu.Lock()
+	dc := o.cfg.DriftCheck
+	o.mu.Unlock()
+	if dc == nil || !dc.BlockRollback || isArtifact(s.commit) {
+		return ""
+	}
+	c, err := o.worktrees.Changes(s.dir, dc.Ignore)
+	if err != nil || !c.Dirty() {
+		return ""
+	}
+	return fmt.Sprintf("%s has drifted from %s (%s); it would bring back hand-edited files. Deploy %s again, or force the rollback", s.name, ShortHash(s.commit), c, ShortHash(s.commit))
+}
+
+// postDriftWebhooks posts a slot_drift event to drift_check.webhooks.
+func (o *Orchestrator) postDriftWebhooks(e DaemonEvent) {
+	d, ok := e.Data.(SlotDrift)
+	if !ok {
+		return
+	}
+	o.mu.Lock()
+	var hooks []string
+	if o.cfg.DriftCheck != nil {
+		hooks = o.cfg.DriftCheck.Webhooks
+	}
+	o.mu.Unlock()
+
+	event := struct {
+		Event string `json:"event"`
+		App   string `json:"app"`
+		SlotDrift
+	}{EventSlotDrift, o.app, d}
+	for _, url := range hooks {
+		go func() {
+			if err := postTrackerJSON(url, http.Header{}, event); err != nil {
+				fmt.Printf("warning: drift_check webhook %s: %v\n", url, err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"slot-machine/internal/proxy"
+)
+
+// Snapshot is the orchestrator's internal state, for debugging.
+type Snapshot struct {
+	Time       string      `json:"time"`
+	Config     Config      `json:"config"`
+	Live       *SlotInfo   `json:"live,omitempty"`
+	Prev       *SlotInfo   `json:"prev,omitempty"`
+	Recovering *SlotInfo   `json:"recovering,omitempty"`
+	Retained   []*SlotInfo `json:"retained,omitempty"`
+	Deploying  *DeployHold `json:"deploying,omitempty"`
+	AppProxy   ProxyInfo   `json:"app_proxy"`
+	IntProxy   ProxyInfo   `json:"internal_proxy"`
+	Goroutines int         `json:"goroutines"`
+}
+
+// SlotInfo describes one slot in a Snapshot.
+type SlotInfo struct {
+	Name    string `json:"name"`
+	Commit  string `json:"commit"`
+	Dir     string `json:"dir"`
+	AppPort int    `json:"app_port"`
+	IntPort int    `json:"int_port"`
+	Running bool   `json:"running"`
+}
+
+// ProxyInfo describes one proxy in a Snapshot.
+type ProxyInfo struct {
+	Addr   string      `json:"addr"`
+	Target int         `json:"target"`
+	Error  string      `json:"error,omitempty"`
+	Stats  proxy.Stats `json:"stats"`
+}
+
+func newSlotInfo(s *slot) *SlotInfo {
+	if s == nil {
+		return nil
+	}
+	return &SlotInfo{Name: s.name, Commit: s.commit, Dir: s.dir, AppPort: s.appPort, IntPort: s.intPort, Running: s.alive}
+}
+
+func newProxyInfo(p *proxy.Proxy) ProxyInfo {
+	return ProxyInfo{Addr: strings.Join(p.Addrs(), ", "), Target: p.Target(), Error: p.LastError(), Stats: p.Stats()}
+}
+
+// Snapshot returns the current slots, proxy targets, deploy lock holder, and
+// goroutine count.
+func (o *Orchestrator) Snapshot() Snapshot {
+	o.mu.Lock()
+	snap := Snapshot{
+		Time:       time.Now().Format(time.RFC3339),
+		Config:     o.cfg,
+		Live:       newSlotInfo(o.liveSlot),
+		Prev:       newSlotInfo(o.prevSlot),
+		Recovering: newSlotInfo(o.recovering),
+		Goroutines: runtime.NumGoroutine(),
+	}
+	for _, s := range o.retained {
+		snap.Retained = append(snap.Retained, newSlotInfo(s))
+	}
+	o.mu.Unlock()
+	if h, ok := o.locks.Holder(o.app); ok {
+		snap.Deploying = &h
+	}
+	snap.AppProxy = newProxyInfo(o.appProxy)
+	snap.IntProxy = newProxyInfo(o.intProxy)
+	return snap
+}
+
+// DumpState writes a Snapshot followed by every goroutine's stack to
+// dump-<time>.txt in the data dir, and returns the file's path. It's meant
+// for working out why a daemon is stuck.
+func (o *Orchestrator) DumpState() (string, error) {
+	snap, err := json.MarshalIndent(o.Snapshot(), "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	path := filepath.Join(o.dataDir, fmt.Sprintf("dump-%s.txt", time.Now().Format("20060102-150405")))
+	data := fmt.Sprintf("state:\n%s\n\ngoroutines:\n%s", snap, buf)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
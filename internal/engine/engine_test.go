@@ -0,0 +1,1015 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"slot-machine/internal/proxy"
+)
+
+func TestShortHash(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in, want string
+	}{
+		{"abcdef1234567890", "abcdef12"},
+		{"abcdef12", "abcdef12"},
+		{"d4f80a3", "d4f80a3"}, // 7-char short hash (common git default)
+		{"abc", "abc"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := ShortHash(tt.in); got != tt.want {
+			t.Errorf("ShortHash(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLoadEnvFile(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, ".env")
+
+	content := `# comment
+FOO=bar
+BAZ=qux
+
+# another comment
+EMPTY=
+NOEQ
+`
+	os.WriteFile(path, []byte(content), 0644)
+
+	env, err := LoadEnvFile(path)
+	if err != nil {
+		t.Fatalf("LoadEnvFile: %v", err)
+	}
+
+	want := []string{"FOO=bar", "BAZ=qux", "EMPTY="}
+	if len(env) != len(want) {
+		t.Fatalf("got %d entries, want %d: %v", len(env), len(want), env)
+	}
+	for i, w := range want {
+		if env[i] != w {
+			t.Errorf("env[%d] = %q, want %q", i, env[i], w)
+		}
+	}
+}
+
+func TestLoadEnvFileMissing(t *testing.T) {
+	t.Parallel()
+	_, err := LoadEnvFile("/nonexistent/.env")
+	if err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}
+
+func TestAtomicSymlink(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	link := filepath.Join(dir, "live")
+
+	// Create initial symlink.
+	if err := atomicSymlink(link, "slot-a"); err != nil {
+		t.Fatalf("atomicSymlink: %v", err)
+	}
+	target, err := os.Readlink(link)
+	if err != nil {
+		t.Fatalf("readlink: %v", err)
+	}
+	if target != "slot-a" {
+		t.Fatalf("got %q, want slot-a", target)
+	}
+
+	// Overwrite atomically.
+	if err := atomicSymlink(link, "slot-b"); err != nil {
+		t.Fatalf("atomicSymlink overwrite: %v", err)
+	}
+	target, err = os.Readlink(link)
+	if err != nil {
+		t.Fatalf("readlink after overwrite: %v", err)
+	}
+	if target != "slot-b" {
+		t.Fatalf("got %q, want slot-b", target)
+	}
+}
+
+func TestFindFreePort(t *testing.T) {
+	t.Parallel()
+	port, err := findFreePort()
+	if err != nil {
+		t.Fatalf("findFreePort: %v", err)
+	}
+	if port <= 0 || port > 65535 {
+		t.Fatalf("port %d out of range", port)
+	}
+
+	// Port should actually be available.
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("port %d not available: %v", port, err)
+	}
+	l.Close()
+}
+
+func TestBuildEnvIncludesSlotMachine(t *testing.T) {
+	t.Parallel()
+	o := &Orchestrator{cfg: Config{}}
+	env := o.buildEnv(nil, 3000, 3900)
+	found := false
+	for _, e := range env {
+		if e == "SLOT_MACHINE=1" {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Fatal("expected SLOT_MACHINE=1 in env")
+	}
+}
+
+func TestOrchestratorServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	o := &Orchestrator{
+		appProxy: proxy.New("", nil),
+		intProxy: proxy.New("", nil),
+	}
+
+	t.Run("GET /", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		o.ServeHTTP(w, r)
+		if w.Code != 200 {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+	})
+
+	t.Run("GET /status", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/status", nil)
+		o.ServeHTTP(w, r)
+		if w.Code != 200 {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+	})
+
+	t.Run("404", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/nope", nil)
+		o.ServeHTTP(w, r)
+		if w.Code != 404 {
+			t.Fatalf("expected 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("POST /deploy missing body", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/deploy", nil)
+		o.ServeHTTP(w, r)
+		if w.Code != 400 {
+			t.Fatalf("expected 400, got %d", w.Code)
+		}
+	})
+}
+
+func TestStatusHandler(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	o := &Orchestrator{
+		appProxy: proxy.New("", nil),
+		intProxy: proxy.New("", nil),
+		liveSlot: &slot{
+			name:   "slot-abc12345",
+			commit: "abc1234567890",
+			alive:  true,
+		},
+		prevSlot: &slot{
+			name:   "slot-def12345",
+			commit: "def1234567890",
+		},
+		lastDeploy: now,
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/status", nil)
+	o.ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	body := w.Body.String()
+	for _, want := range []string{"slot-abc12345", "abc1234567890", "slot-def12345", "def1234567890", "slot-staging"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body missing %q: %s", want, body)
+		}
+	}
+}
+
+func TestBuildEnvResolvesEnvFileRelativeToRepoDir(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, ".env"), []byte("SECRET=hunter2\n"), 0644)
+
+	o := &Orchestrator{
+		cfg:     Config{EnvFile: ".env"},
+		repoDir: dir,
+	}
+	env := o.buildEnv(nil, 3000, 3900)
+	found := false
+	for _, e := range env {
+		if e == "SECRET=hunter2" {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Fatal("expected SECRET=hunter2 from .env resolved relative to repoDir")
+	}
+}
+
+func TestGitWorktreeChanges(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t", "GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	for _, name := range []string{"a.go", "b.go", "c.go", "data/x.db", ".claude/settings.json"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		os.WriteFile(filepath.Join(dir, name), []byte("one\n"), 0644)
+	}
+	os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*.log\n"), 0644)
+	git("add", ".")
+	git("commit", "-q", "-m", "one")
+
+	w := &gitWorktrees{}
+	ignore := []string{"data", ".claude/settings.json"}
+	if c, err := w.Changes(dir, ignore); err != nil || c.Dirty() || c != (WorktreeChanges{}) {
+		t.Fatalf("clean worktree: %+v, %v", c, err)
+	}
+
+	os.WriteFile(filepath.Join(dir, "a.go"), []byte("two\n"), 0644)
+	os.Remove(filepath.Join(dir, "b.go"))
+	git("mv", "c.go", "d.go")
+	os.WriteFile(filepath.Join(dir, "new.go"), []byte("new\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "out.log"), []byte("ignored\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "data", "x.db"), []byte("shared\n"), 0644)
+	os.WriteFile(filepath.Join(dir, ".claude", "settings.json"), []byte("{}\n"), 0644)
+
+	c, err := w.Changes(dir, ignore)
+	if want := (WorktreeChanges{Modified: 2, Deleted: 1, Untracked: 1}); err != nil || c != want {
+		t.Errorf("changes = %+v, %v; want %+v", c, err, want)
+	}
+	if !c.Dirty() {
+		t.Error("not dirty")
+	}
+
+	// Stashed and applied again, untracked files included.
+	stash, err := w.Stash(dir, ignore)
+	if err != nil || stash == "" {
+		t.Fatalf("stash: %q, %v", stash, err)
+	}
+	if c, _ := w.Changes(dir, ignore); c.Dirty() || c.Untracked != 0 {
+		t.Errorf("after stash: %+v", c)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "data", "x.db")); string(data) != "shared\n" {
+		t.Errorf("shared dir stashed: %q", data)
+	}
+	if conflicts, err := w.Unstash(dir, stash); err != nil || len(conflicts) != 0 {
+		t.Fatalf("unstash: %v, %v", conflicts, err)
+	}
+	if c, _ := w.Changes(dir, ignore); !c.Dirty() || c.Untracked != 1 {
+		t.Errorf("after unstash: %+v", c)
+	}
+
+	// Applied over a conflicting commit, the file is left with markers.
+	stash, _ = w.Stash(dir, ignore)
+	os.WriteFile(filepath.Join(dir, "a.go"), []byte("three\n"), 0644)
+	git("commit", "-q", "-am", "two")
+	if conflicts, err := w.Unstash(dir, stash); err != nil || !slices.Equal(conflicts, []string{"a.go"}) {
+		t.Errorf("conflicting unstash: %v, %v", conflicts, err)
+	}
+	if out, _ := exec.Command("git", "-C", dir, "rev-parse", stashRef).Output(); strings.TrimSpace(string(out)) != stash {
+		t.Errorf("%s = %s, want it kept after a conflict", stashRef, out)
+	}
+
+	// Only untracked files: a checkout keeps them, so it's not dirty.
+	if c := (WorktreeChanges{Untracked: 3}); c.Dirty() {
+		t.Error("untracked files count as dirty")
+	}
+	// Not a checkout at all.
+	if c, err := w.Changes(t.TempDir(), nil); err != nil || c.Dirty() {
+		t.Errorf("plain dir: %+v, %v", c, err)
+	}
+}
+
+func TestApplySharedDirs(t *testing.T) {
+	t.Parallel()
+
+	t.Run("symlinks slot dir to repo dir", func(t *testing.T) {
+		repoDir := t.TempDir()
+		slotDir := t.TempDir()
+
+		// Repo has the canonical data with a file.
+		os.MkdirAll(filepath.Join(repoDir, "data"), 0755)
+		os.WriteFile(filepath.Join(repoDir, "data", "test.db"), []byte("content"), 0644)
+
+		// Slot has a stale copy (from CoW clone).
+		os.MkdirAll(filepath.Join(slotDir, "data"), 0755)
+		os.WriteFile(filepath.Join(slotDir, "data", "stale.db"), []byte("stale"), 0644)
+
+		o := &Orchestrator{
+			cfg:     Config{SharedDirs: []string{"data"}},
+			repoDir: repoDir,
+		}
+		o.applySharedDirs(slotDir)
+
+		// Slot's data should now be a symlink.
+		info, err := os.Lstat(filepath.Join(slotDir, "data"))
+		if err != nil {
+			t.Fatalf("lstat: %v", err)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			t.Fatal("expected symlink")
+		}
+
+		// Slot should see the repo's file, not the stale copy.
+		content, _ := os.ReadFile(filepath.Join(slotDir, "data", "test.db"))
+		if string(content) != "content" {
+			t.Fatal("expected repo file through symlink")
+		}
+		if _, err := os.Stat(filepath.Join(slotDir, "data", "stale.db")); err == nil {
+			t.Fatal("stale file should not be visible")
+		}
+	})
+
+	t.Run("seeds repo dir from slot checkout on first deploy", func(t *testing.T) {
+		repoDir := t.TempDir()
+		slotDir := t.TempDir()
+
+		// Slot has data from the git checkout (first deploy).
+		os.MkdirAll(filepath.Join(slotDir, "data"), 0755)
+		os.WriteFile(filepath.Join(slotDir, "data", "seed.db"), []byte("seeded"), 0644)
+
+		o := &Orchestrator{
+			cfg:     Config{SharedDirs: []string{"data"}},
+			repoDir: repoDir,
+		}
+		o.applySharedDirs(slotDir)
+
+		// Repo's data dir should contain the seeded file.
+		content, err := os.ReadFile(filepath.Join(repoDir, "data", "seed.db"))
+		if err != nil || string(content) != "seeded" {
+			t.Fatal("expected repo data dir to be seeded from slot checkout")
+		}
+
+		// Slot should symlink to it.
+		info, _ := os.Lstat(filepath.Join(slotDir, "data"))
+		if info.Mode()&os.ModeSymlink == 0 {
+			t.Fatal("expected symlink")
+		}
+	})
+
+	t.Run("creates empty repo dir if slot has no data", func(t *testing.T) {
+		repoDir := t.TempDir()
+		slotDir := t.TempDir()
+
+		o := &Orchestrator{
+			cfg:     Config{SharedDirs: []string{"data"}},
+			repoDir: repoDir,
+		}
+		o.applySharedDirs(slotDir)
+
+		// Repo's data dir should have been created (empty).
+		info, err := os.Stat(filepath.Join(repoDir, "data"))
+		if err != nil || !info.IsDir() {
+			t.Fatal("expected repo data dir to be created")
+		}
+
+		// Slot should symlink to it.
+		info, _ = os.Lstat(filepath.Join(slotDir, "data"))
+		if info.Mode()&os.ModeSymlink == 0 {
+			t.Fatal("expected symlink")
+		}
+	})
+
+	t.Run("no shared dirs configured", func(t *testing.T) {
+		slotDir := t.TempDir()
+		os.MkdirAll(filepath.Join(slotDir, "data"), 0755)
+
+		o := &Orchestrator{cfg: Config{}}
+		o.applySharedDirs(slotDir)
+
+		// data should still be a real directory.
+		info, _ := os.Lstat(filepath.Join(slotDir, "data"))
+		if info.Mode()&os.ModeSymlink != 0 {
+			t.Fatal("should not create symlinks when not configured")
+		}
+	})
+
+	t.Run("ignores absolute and dot paths", func(t *testing.T) {
+		repoDir := t.TempDir()
+		slotDir := t.TempDir()
+
+		o := &Orchestrator{
+			cfg:     Config{SharedDirs: []string{"/etc", ".", ".."}},
+			repoDir: repoDir,
+		}
+		o.applySharedDirs(slotDir)
+
+		// No symlinks should have been created in the slot.
+		entries, _ := os.ReadDir(slotDir)
+		for _, e := range entries {
+			if e.Type()&os.ModeSymlink != 0 {
+				t.Fatalf("unexpected symlink: %s", e.Name())
+			}
+		}
+	})
+}
+
+func TestTailFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "app.log")
+	os.WriteFile(path, []byte("one\ntwo\nthree\nfour\n"), 0644)
+
+	lines, err := tailFile(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(lines, ",") != "three,four" {
+		t.Fatalf("got %v, want [three four]", lines)
+	}
+
+	lines, _ = tailFile(path, 0)
+	if len(lines) != 4 {
+		t.Fatalf("n=0 should return all lines, got %v", lines)
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	o := &Orchestrator{dataDir: dir}
+	o.appendJournal("deploy", "aaa111", "slot-aaa111", "")
+	o.appendJournal("deploy", "bbb222", "slot-bbb222", "aaa111")
+	o.appendJournal("rollback", "aaa111", "slot-aaa111", "bbb222")
+
+	// A torn final line must not break parsing.
+	f, _ := os.OpenFile(filepath.Join(dir, "journal.ndjson"), os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"time":"2026`)
+	f.Close()
+
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/history?limit=2", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var entries []JournalEntry
+	json.Unmarshal(w.Body.Bytes(), &entries)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d: %s", len(entries), w.Body.String())
+	}
+	if entries[1].Action != "rollback" || entries[1].Commit != "aaa111" {
+		t.Fatalf("unexpected last entry: %+v", entries[1])
+	}
+}
+
+func TestLogsHandler(t *testing.T) {
+	t.Parallel()
+	logPath := filepath.Join(t.TempDir(), "slot-abc.log")
+	os.WriteFile(logPath, []byte("booting\nlistening on 3000\n"), 0644)
+
+	o := &Orchestrator{liveSlot: &slot{name: "slot-abc", logPath: logPath}}
+
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/logs?lines=1", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var lr LogsResponse
+	json.Unmarshal(w.Body.Bytes(), &lr)
+	if lr.Slot != "slot-abc" || len(lr.Lines) != 1 || lr.Lines[0] != "listening on 3000" {
+		t.Fatalf("unexpected response: %+v", lr)
+	}
+
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/logs?slot=prev", nil))
+	if w.Code != 404 {
+		t.Fatalf("expected 404 for missing prev slot, got %d", w.Code)
+	}
+}
+
+func TestLogsCorrelate(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "access.log"), []byte(
+		"2026-01-02T03:04:05Z 0123abcd GET /a 200 3ms slot-abc\n"+
+			"2026-01-02T03:04:06Z 4567efab GET /b 500 9ms slot-abc\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "slot-abc.log"), []byte("req=4567efab starting\nunrelated\nreq=4567efab panic: nil map\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "slot-def.log"), []byte("req=0123abcd ok\n"), 0644)
+
+	o := &Orchestrator{dataDir: dir}
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/logs?correlate=4567efab", nil))
+	var lr LogsResponse
+	json.Unmarshal(w.Body.Bytes(), &lr)
+	want := []string{
+		"[proxy] 2026-01-02T03:04:06Z 4567efab GET /b 500 9ms slot-abc",
+		"[slot-abc] req=4567efab starting",
+		"[slot-abc] req=4567efab panic: nil map",
+	}
+	if w.Code != 200 || strings.Join(lr.Lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("correlate = %d %q", w.Code, lr.Lines)
+	}
+
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/logs?correlate=45", nil))
+	if w.Code != 400 {
+		t.Errorf("short id: got %d, want 400", w.Code)
+	}
+}
+
+func TestMergedLogStream(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	logs := NewLogStream(filepath.Join(dir, LogStreamName))
+	logs.Append(LogRecord{Source: SourceDaemon, Line: "slot-machine listening on :9100"})
+
+	// A slot's output lands in its own log as is, and in the stream tagged.
+	proc, err := execRunner{logs: logs}.Start(dir, "echo booting; echo oops >&2; printf partial", nil, filepath.Join(dir, "slot-abc1234.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc.Wait()
+	var recs []LogRecord
+	for deadline := time.Now().Add(5 * time.Second); len(recs) < 4 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		recs, _ = logs.Tail("all", 0)
+	}
+	if raw, _ := os.ReadFile(filepath.Join(dir, "slot-abc1234.log")); string(raw) != "booting\noops\npartial" {
+		t.Errorf("slot log = %q", raw)
+	}
+
+	o := &Orchestrator{logs: logs}
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/logs?source=all&lines=3", nil))
+	var lr LogsResponse
+	json.Unmarshal(w.Body.Bytes(), &lr)
+	if w.Code != 200 || len(lr.Records) != 3 {
+		t.Fatalf("source=all = %d %s", w.Code, w.Body.String())
+	}
+	for i, want := range []string{"booting", "oops", "partial"} {
+		if r := lr.Records[i]; r.Source != SourceSlot || r.Slot != "slot-abc1234" || r.Line != want || r.Time == "" {
+			t.Errorf("record %d = %+v, want slot-abc1234 %q", i, r, want)
+		}
+	}
+	if !strings.HasSuffix(lr.Lines[0], " [slot-abc1234] booting") {
+		t.Errorf("formatted line = %q", lr.Lines[0])
+	}
+
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/logs?source=daemon", nil))
+	json.Unmarshal(w.Body.Bytes(), &lr)
+	if len(lr.Records) != 1 || lr.Records[0].Line != "slot-machine listening on :9100" {
+		t.Errorf("source=daemon = %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/logs?source=nope", nil))
+	if w.Code != 400 {
+		t.Errorf("unknown source: got %d, want 400", w.Code)
+	}
+}
+
+func TestStatusReportsProxyError(t *testing.T) {
+	t.Parallel()
+
+	// Occupy the port so the proxy can't bind it.
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	p := proxy.New(busy.Addr().String(), nil)
+	if err := p.SetTarget(12345); err == nil {
+		t.Fatal("expected bind error for busy port")
+	}
+
+	o := New(Options{AppProxy: p})
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	var sr StatusResponse
+	json.Unmarshal(w.Body.Bytes(), &sr)
+	if sr.ProxyError == "" {
+		t.Fatalf("expected proxy_error in status, got %s", w.Body.String())
+	}
+}
+
+func TestJournalChecksums(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	o := &Orchestrator{dataDir: dir}
+	path := filepath.Join(dir, "journal.ndjson")
+
+	// A pre-checksum entry is still accepted.
+	os.WriteFile(path, []byte(`{"time":"2025-01-01T00:00:00Z","action":"deploy","commit":"old000","slot_dir":"slot-old000","prev_commit":""}`+"\n"), 0644)
+
+	if err := o.appendJournal("deploy", "aaa111", "slot-aaa111", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte inside a checksummed record.
+	o.appendJournal("deploy", "bbb222", "slot-bbb222", "aaa111")
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, []byte(strings.Replace(string(data), "bbb222\",\"slot_dir", "bbb223\",\"slot_dir", 1)), 0644)
+
+	// Simulate a crash mid-write, then append after it.
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"time":"2026`)
+	f.Close()
+	if r, _ := VerifyJournal(dir); !r.TornTail {
+		t.Fatal("expected torn tail to be reported")
+	}
+	o.appendJournal("rollback", "aaa111", "slot-aaa111", "bbb222")
+
+	entries, err := o.readJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commits []string
+	for _, e := range entries {
+		if e.CRC != "" {
+			t.Errorf("crc should not leak into entries: %+v", e)
+		}
+		commits = append(commits, e.Action+":"+e.Commit)
+	}
+	if got := strings.Join(commits, ","); got != "deploy:old000,deploy:aaa111,rollback:aaa111" {
+		t.Fatalf("entries = %s", got)
+	}
+
+	r, err := VerifyJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.OK() || r.Entries != 2 || r.Legacy != 1 || len(r.Corrupt) != 2 || r.TornTail {
+		t.Fatalf("report = %+v", r)
+	}
+	if r.Corrupt[0] != 3 || r.Corrupt[1] != 4 {
+		t.Fatalf("corrupt lines = %v, want [3 4]", r.Corrupt)
+	}
+}
+
+func TestHealthzCachesProbe(t *testing.T) {
+	t.Parallel()
+	var polls, status atomic.Int32
+	status.Store(200)
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer app.Close()
+	port := app.Listener.Addr().(*net.TCPAddr).Port
+
+	o := New(Options{Config: Config{HealthEndpoint: "/health", HealthCacheTTLMs: 60000}})
+
+	get := func() (int, HealthzResponse) {
+		w := httptest.NewRecorder()
+		o.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+		var hr HealthzResponse
+		json.Unmarshal(w.Body.Bytes(), &hr)
+		return w.Code, hr
+	}
+
+	if code, hr := get(); code != 503 || hr.Status != "down" {
+		t.Fatalf("no live slot: %d %+v", code, hr)
+	}
+
+	o.liveSlot = &slot{name: "slot-abc", commit: "abc", intPort: port, alive: true}
+	if code, hr := get(); code != 200 || hr.Status != "ok" || hr.Cached {
+		t.Fatalf("first probe: %d %+v", code, hr)
+	}
+	status.Store(500)
+	if code, hr := get(); code != 200 || !hr.Cached {
+		t.Fatalf("second probe should be cached: %d %+v", code, hr)
+	}
+	if n := polls.Load(); n != 1 {
+		t.Fatalf("app polled %d times, want 1", n)
+	}
+
+	// Without a TTL every request probes.
+	o.cfg.HealthCacheTTLMs = 0
+	if code, hr := get(); code != 503 || hr.Status != "unhealthy" || hr.Code != 500 {
+		t.Fatalf("uncached probe: %d %+v", code, hr)
+	}
+}
+
+func TestSelfUpdateJournalsAndHoldsLock(t *testing.T) {
+	t.Parallel()
+	o := &Orchestrator{dataDir: t.TempDir(), app: "app", locks: NewDeployLocks()}
+	o.liveSlot = &slot{name: "slot-aaa111", commit: "aaa111"}
+
+	// A failed install changes nothing.
+	if err := o.SelfUpdate("v1.0.0", "v1.1.0", func() error { return errors.New("rename failed") }, func() error {
+		t.Error("restarted after a failed install")
+		return nil
+	}); err == nil || err.Error() != "rename failed" {
+		t.Fatalf("SelfUpdate with a failed install = %v", err)
+	}
+	if entries, _ := o.readJournal(); len(entries) != 0 {
+		t.Fatalf("journal after a failed install = %+v", entries)
+	}
+
+	installed, restarted := false, false
+	err := o.SelfUpdate("v1.0.0", "v1.1.0", func() error {
+		installed = true
+		if h, ok := o.locks.Holder("app"); !ok || h.Action != "update" {
+			t.Errorf("deploy lock during install = %+v, %v; want held by update", h, ok)
+		}
+		return nil
+	}, func() error {
+		restarted = true
+		if h, ok := o.locks.Holder("app"); !ok || h.Action != "update" {
+			t.Errorf("deploy lock during restart = %+v, %v; want held by update", h, ok)
+		}
+		return errors.New("exec failed")
+	})
+	if !installed || !restarted || err == nil || err.Error() != "exec failed" {
+		t.Fatalf("SelfUpdate = %v (installed %v, restarted %v), want the restart's error", err, installed, restarted)
+	}
+	if _, ok := o.locks.Holder("app"); ok {
+		t.Error("deploy lock still held after SelfUpdate returned")
+	}
+
+	entries, _ := o.readJournal()
+	want := JournalEntry{Action: "update", Commit: "aaa111", SlotDir: "slot-aaa111", Version: "v1.1.0", PrevVersion: "v1.0.0"}
+	if len(entries) != 1 {
+		t.Fatalf("journal = %+v, want one update entry", entries)
+	}
+	got := entries[0]
+	got.Time, got.CRC = "", ""
+	if got != want {
+		t.Errorf("journal entry = %+v, want %+v", got, want)
+	}
+
+	release, _, _ := o.locks.TryAcquire("app", "deploy", "bbb222")
+	defer release()
+	if err := o.SelfUpdate("v1.0.0", "v1.1.0", func() error { t.Error("installed during a deploy"); return nil }, func() error { t.Error("restarted during a deploy"); return nil }); err == nil {
+		t.Error("SelfUpdate during a deploy should fail")
+	}
+}
+
+func TestStartupProbeSchedule(t *testing.T) {
+	t.Parallel()
+	var polls atomic.Int32
+	var times []time.Time
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+		if polls.Add(1) < 4 {
+			w.WriteHeader(503)
+		}
+	}))
+	defer srv.Close()
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+
+	o := &Orchestrator{cfg: Config{StartupProbe: &StartupProbe{InitialDelayMs: 50, IntervalMs: 20, Backoff: 2, MaxIntervalMs: 50}}}
+	sched := o.probeSchedule(5 * time.Second)
+	start := time.Now()
+	if !(httpHealthChecker{}).WaitHealthySchedule(port, "/", sched, nil, nil) {
+		t.Fatal("should turn healthy on the 4th poll")
+	}
+	if times[0].Sub(start) < 50*time.Millisecond {
+		t.Errorf("first poll after %s, want the initial delay", times[0].Sub(start))
+	}
+	// 20ms, then 40ms, then capped at 50ms.
+	for i, want := range []time.Duration{20, 40, 50} {
+		if gap := times[i+1].Sub(times[i]); gap < want*time.Millisecond {
+			t.Errorf("gap %d = %s, want at least %dms", i, gap, want)
+		}
+	}
+
+	// failure_threshold gives up before the timeout.
+	polls.Store(-100)
+	o.cfg.StartupProbe = &StartupProbe{IntervalMs: 1, FailureThreshold: 3}
+	before := polls.Load()
+	if (httpHealthChecker{}).WaitHealthySchedule(port, "/", o.probeSchedule(5*time.Second), nil, nil) {
+		t.Fatal("should give up")
+	}
+	if n := polls.Load() - before; n != 3 {
+		t.Errorf("%d polls, want 3", n)
+	}
+
+	o.cfg.HealthTimeoutMs = 10000
+	if got := o.startupTimeout(); got != 10*time.Second {
+		t.Errorf("startup timeout = %s, want health_timeout_ms", got)
+	}
+	o.cfg.StartupProbe.TimeoutMs = 120000
+	if got := o.startupTimeout(); got != 2*time.Minute {
+		t.Errorf("startup timeout = %s, want startup_probe.timeout_ms", got)
+	}
+}
+
+func TestUpstreamStatus(t *testing.T) {
+	t.Parallel()
+	tmp := t.TempDir()
+	remote, repo := filepath.Join(tmp, "remote"), filepath.Join(tmp, "repo")
+	git := func(dir string, args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t", "GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	os.Mkdir(remote, 0755)
+	git(remote, "init", "-q", "-b", "main")
+	git(remote, "commit", "-q", "--allow-empty", "-m", "one")
+	live := git(remote, "rev-parse", "HEAD")
+	git(tmp, "clone", "-q", remote, repo)
+
+	o := &Orchestrator{repoDir: repo}
+	if u := o.upstreamStatus(live); u == nil || u.Ahead != 0 || u.Behind != 0 || u.FetchedAt != "" {
+		t.Fatalf("before any fetch: %+v", u)
+	}
+
+	git(remote, "commit", "-q", "--allow-empty", "-m", "two")
+	git(remote, "tag", "v1.1")
+	git(remote, "commit", "-q", "--allow-empty", "-m", "three")
+	tip := git(remote, "rev-parse", "HEAD")
+	o.fetchUpstream()
+	u := o.upstreamStatus(live)
+	if u == nil || u.Commit != tip || u.Behind != 2 || u.Ahead != 0 || u.LatestTag != "v1.1" || u.FetchedAt == "" || u.FetchError != "" {
+		t.Fatalf("behind: %+v", u)
+	}
+	if got := u.String(); got != "2 behind origin/main (latest tag v1.1)" {
+		t.Errorf("String() = %q", got)
+	}
+
+	// A hotfix deployed from the server's repo is ahead.
+	git(repo, "checkout", "-q", tip)
+	git(repo, "commit", "-q", "--allow-empty", "-m", "hotfix")
+	if u := o.upstreamStatus(git(repo, "rev-parse", "HEAD")); u.Ahead != 1 || u.Behind != 0 {
+		t.Errorf("hotfix: %+v", u)
+	}
+
+	os.RemoveAll(remote)
+	o.fetchUpstream()
+	if u := o.upstreamStatus(live); u == nil || u.FetchError == "" || u.Commit != tip {
+		t.Errorf("after a failed fetch: %+v", u)
+	}
+
+	o.cfg.Upstream = "origin/missing"
+	if u := o.upstreamStatus(live); u != nil {
+		t.Errorf("missing branch: %+v", u)
+	}
+}
+
+func TestDeployCommitFetch(t *testing.T) {
+	t.Parallel()
+	tmp := t.TempDir()
+	remote, repo := filepath.Join(tmp, "remote"), filepath.Join(tmp, "repo")
+	git := func(dir string, args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t", "GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	os.Mkdir(remote, 0755)
+	git(remote, "init", "-q", "-b", "main")
+	git(remote, "commit", "-q", "--allow-empty", "-m", "one")
+	one := git(remote, "rev-parse", "HEAD")
+	git(tmp, "clone", "-q", remote, repo)
+	git(remote, "commit", "-q", "--allow-empty", "-m", "two")
+	git(remote, "tag", "v2")
+	two := git(remote, "rev-parse", "HEAD")
+
+	o := &Orchestrator{repoDir: repo}
+	for _, tc := range []struct {
+		req    deployRequest
+		commit string
+		code   int
+	}{
+		{deployRequest{Ref: "origin/main"}, one, 200}, // not fetched yet
+		{deployRequest{Ref: "v2"}, "", 400},
+		{deployRequest{Commit: "abc", Ref: "v2"}, "", 400},
+		{deployRequest{Ref: "origin/main", Fetch: true}, two, 200},
+		{deployRequest{Ref: "v2"}, two, 200},
+		{deployRequest{Fetch: true}, two, 200}, // upstream
+		{deployRequest{Commit: two[:8], Fetch: true}, two[:8], 200},
+		{deployRequest{Ref: "--upload-pack=x"}, "", 400},
+	} {
+		commit, code, err := o.deployCommit(tc.req)
+		if commit != tc.commit || code != tc.code || (code == 200) != (err == nil) {
+			t.Errorf("%+v: %q, %d, %v; want %q, %d", tc.req, commit, code, err, tc.commit, tc.code)
+		}
+	}
+
+	o.cfg.Remote = "elsewhere"
+	if _, code, err := o.deployCommit(deployRequest{Fetch: true}); code != 502 || !strings.Contains(fmt.Sprint(err), "git fetch elsewhere") {
+		t.Errorf("unknown remote: %d, %v", code, err)
+	}
+
+	o.cfg.DeployKeyFile = "keys/deploy key"
+	if got, want := o.gitSSHCommand(), "ssh -i '"+filepath.Join(repo, "keys/deploy key")+"' -o IdentitiesOnly=yes"; !strings.HasPrefix(got, want) {
+		t.Errorf("ssh command = %q, want prefix %q", got, want)
+	}
+}
+
+func TestRepairWorktrees(t *testing.T) {
+	t.Parallel()
+	repo, data := t.TempDir(), t.TempDir()
+	git := func(dir string, args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t", "GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git(repo, "init", "-q")
+	git(repo, "commit", "-q", "--allow-empty", "-m", "one")
+	commit := git(repo, "rev-parse", "HEAD")
+	meta := filepath.Join(repo, ".git", "worktrees")
+	add := func(name string) string {
+		git(repo, "worktree", "add", "-q", "--detach", filepath.Join(data, name), commit)
+		return filepath.Join(data, name)
+	}
+
+	// Killed right after Promote's rename.
+	os.Rename(add("slot-staging-aa"), filepath.Join(data, "slot-a"))
+	// Killed after its metadata was renamed, before .git was pointed at it.
+	os.Rename(add("slot-staging-bb"), filepath.Join(data, "slot-b"))
+	os.WriteFile(filepath.Join(meta, "slot-staging-bb", "gitdir"), []byte(filepath.Join(data, "slot-b", ".git")+"\n"), 0644)
+	os.Rename(filepath.Join(meta, "slot-staging-bb"), filepath.Join(meta, "slot-b"))
+	// Its metadata lost.
+	add("slot-c")
+	os.RemoveAll(filepath.Join(meta, "slot-c"))
+	// Fine as it is.
+	add("slot-d")
+	// Gone, metadata left behind.
+	os.RemoveAll(add("slot-e"))
+
+	w := &gitWorktrees{repoDir: repo}
+	dirs := map[string]string{}
+	for _, name := range []string{"slot-a", "slot-b", "slot-c", "slot-d"} {
+		dirs[filepath.Join(data, name)] = commit
+	}
+	fixed := w.Repair(dirs)
+	want := []string{
+		"slot-a: pointed its metadata back at it, renamed its metadata to match",
+		"slot-b: pointed .git at its renamed metadata",
+		"slot-c: its metadata is gone; rebuilt it at " + ShortHash(commit),
+	}
+	if len(fixed) != 4 || !slices.Equal(fixed[:3], want) || !strings.Contains(fixed[3], "slot-e") {
+		t.Errorf("fixed:\n%s", strings.Join(fixed, "\n"))
+	}
+
+	// All four survive a prune, at their commit.
+	git(repo, "worktree", "prune")
+	list := git(repo, "worktree", "list", "--porcelain")
+	for dir := range dirs {
+		if !strings.Contains(list, "worktree "+dir+"\n") {
+			t.Errorf("%s not in worktree list:\n%s", dir, list)
+		}
+		if got := git(dir, "rev-parse", "HEAD"); got != commit {
+			t.Errorf("%s: HEAD = %s", dir, got)
+		}
+	}
+	if fixed := w.Repair(dirs); len(fixed) != 0 {
+		t.Errorf("second pass fixed: %q", fixed)
+	}
+}
@@ -0,0 +1,194 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Each slot records the environment it was started with, so "it only works
+// on the old release" can be traced to a changed variable rather than the
+// code. Values from env_file, a release's env, and the daemon's own
+// environment are stored as short hashes, never in clear; only the
+// variables slot-machine injects itself are shown as is.
+
+// EnvSnapshot is the environment a slot's process was started with.
+type EnvSnapshot struct {
+	Commit       string            `json:"commit"`
+	StartedAt    string            `json:"started_at"`
+	StartCommand string            `json:"start_command"`
+	AppPort      int               `json:"app_port"`
+	IntPort      int               `json:"int_port"`
+	EnvFile      string            `json:"env_file,omitempty"`        // resolved path
+	EnvFileHash  string            `json:"env_file_sha256,omitempty"` // of the whole file
+	Injected     map[string]string `json:"injected"`                  // set by slot-machine, in clear
+	FromEnvFile  map[string]string `json:"env_file_vars"`             // name → value hash
+	FromRelease  map[string]string `json:"release_vars,omitempty"`    // the release's env, name → value hash
+	Inherited    map[string]string `json:"inherited"`                 // daemon's environment, name → value hash
+}
+
+// EnvChange is one difference between the live and previous slots'
+// environments. Live and Prev are values for injected variables and hashes
+// otherwise; empty means unset.
+type EnvChange struct {
+	Name   string `json:"name"`
+	Source string `json:"source"` // "injected", "env_file", "release", or "inherited"
+	Live   string `json:"live,omitempty"`
+	Prev   string `json:"prev,omitempty"`
+}
+
+// SlotDetail is the body of GET /slots/{name}.
+type SlotDetail struct {
+	Name   string       `json:"name"`
+	Commit string       `json:"commit"`
+	Role   string       `json:"role"` // "live", "prev", "retained", "mirror", or "preview"
+	Alive  bool         `json:"alive"`
+	Env    *EnvSnapshot `json:"env,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// secretEnv are injected variables whose values are never reported.
+var secretEnv = map[string]bool{"SLOT_MACHINE_AUTH_SECRET": true, "SLOT_MACHINE_READY_TOKEN": true}
+
+// envDiffIgnored change on every start, so they'd drown out real changes.
+var envDiffIgnored = map[string]bool{"PORT": true, "INTERNAL_PORT": true, "SLOT_MACHINE_READY_TOKEN": true}
+
+func envHash(v string) string {
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:6])
+}
+
+// hashedEnv maps KEY=VALUE pairs to KEY → hash of VALUE. Later pairs win,
+// as they do for the process.
+func hashedEnv(pairs []string) map[string]string {
+	m := make(map[string]string, len(pairs))
+	for _, kv := range pairs {
+		k, v, _ := strings.Cut(kv, "=")
+		m[k] = envHash(v)
+	}
+	return m
+}
+
+func newEnvSnapshot(commit, startCommand, envFile string, appPort, intPort int, inherited, fromFile, fromRelease, injected []string) *EnvSnapshot {
+	snap := &EnvSnapshot{
+		Commit:       commit,
+		StartedAt:    time.Now().UTC().Format(time.RFC3339),
+		StartCommand: startCommand,
+		AppPort:      appPort,
+		IntPort:      intPort,
+		EnvFile:      envFile,
+		Injected:     map[string]string{},
+		FromEnvFile:  hashedEnv(fromFile),
+		FromRelease:  hashedEnv(fromRelease),
+		Inherited:    hashedEnv(inherited),
+	}
+	if envFile != "" {
+		if data, err := os.ReadFile(envFile); err == nil {
+			sum := sha256.Sum256(data)
+			snap.EnvFileHash = hex.EncodeToString(sum[:])
+		}
+	}
+	for _, kv := range injected {
+		k, v, _ := strings.Cut(kv, "=")
+		if secretEnv[k] {
+			v = "(redacted)"
+		}
+		snap.Injected[k] = v
+	}
+	return snap
+}
+
+// diffEnv lists what differs between two snapshots, by variable name.
+// Either may be nil (no snapshot), which yields no diff.
+func diffEnv(live, prev *EnvSnapshot) []EnvChange {
+	if live == nil || prev == nil {
+		return nil
+	}
+	var changes []EnvChange
+	compare := func(source string, l, p map[string]string) {
+		for name, lv := range l {
+			if pv, ok := p[name]; (!ok || pv != lv) && !envDiffIgnored[name] {
+				changes = append(changes, EnvChange{Name: name, Source: source, Live: lv, Prev: pv})
+			}
+		}
+		for name, pv := range p {
+			if _, ok := l[name]; !ok && !envDiffIgnored[name] {
+				changes = append(changes, EnvChange{Name: name, Source: source, Prev: pv})
+			}
+		}
+	}
+	compare("injected", live.Injected, prev.Injected)
+	compare("env_file", live.FromEnvFile, prev.FromEnvFile)
+	compare("release", live.FromRelease, prev.FromRelease)
+	compare("inherited", live.Inherited, prev.Inherited)
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Source != changes[j].Source {
+			return changes[i].Source < changes[j].Source
+		}
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+// --- GET /slots/{name}, /slots/{name}/manifest, /slots/{name}/verify ---
+
+func (o *Orchestrator) handleSlot(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/slots/")
+	if slot, ok := strings.CutSuffix(name, "/manifest"); ok {
+		o.handleManifest(w, slot)
+		return
+	}
+	if slot, ok := strings.CutSuffix(name, "/verify"); ok {
+		o.handleVerify(w, slot)
+		return
+	}
+	info, ok := o.slotInfo(name)
+	if !ok {
+		writeJSON(w, 404, SlotDetail{Name: name, Error: "no slot named " + name})
+		return
+	}
+	writeJSON(w, 200, info)
+}
+
+// slotInfo finds a slot by name, or by "live" or "prev".
+func (o *Orchestrator) slotInfo(name string) (SlotDetail, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s, role := o.findSlot(name)
+	if s == nil {
+		return SlotDetail{}, false
+	}
+	return SlotDetail{Name: s.name, Commit: s.commit, Role: role, Alive: s.alive, Env: s.env}, true
+}
+
+// findSlot returns the slot named name, or the one whose role is name, and
+// its role. o.mu must be held.
+func (o *Orchestrator) findSlot(name string) (*slot, string) {
+	type candidate struct {
+		s    *slot
+		role string
+	}
+	live := o.liveSlot
+	if live == nil {
+		live = o.recovering
+	}
+	candidates := []candidate{{live, "live"}, {o.prevSlot, "prev"}}
+	for _, s := range o.retained {
+		candidates = append(candidates, candidate{s, "retained"})
+	}
+	candidates = append(candidates, candidate{o.mirrorSlot, "mirror"})
+	for _, p := range o.previews {
+		candidates = append(candidates, candidate{p.slot, "preview"})
+	}
+
+	for _, c := range candidates {
+		if c.s != nil && (c.s.name == name || c.role == name) {
+			return c.s, c.role
+		}
+	}
+	return nil, ""
+}
@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A running process read env_file when it started, so editing the file (a
+// rotated secret, a new flag) changes nothing until the next deploy. The
+// daemon watches the file and reports the live slot as stale in GET
+// /status; with env_reload "auto" it also does a rolling restart, once per
+// version of the file.
+
+// envWatchInterval is how often env_file is checked.
+const envWatchInterval = 2 * time.Second
+
+// envFileState returns the resolved env_file path and the sha256 of its
+// contents, as recorded in EnvSnapshot. Both are empty without an
+// env_file; the hash is empty if it can't be read.
+func (o *Orchestrator) envFileState() (path, hash string) {
+	o.mu.Lock()
+	path = o.cfg.EnvFile
+	o.mu.Unlock()
+	if path == "" {
+		return "", ""
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(o.repoDir, path)
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		sum := sha256.Sum256(data)
+		hash = hex.EncodeToString(sum[:])
+	}
+	return path, hash
+}
+
+// EnvStale reports whether env_file differs from what the live slot was
+// started with.
+func (o *Orchestrator) EnvStale() bool {
+	path, hash := o.envFileState()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.envStale(path, hash)
+}
+
+// envStale is EnvStale for a given env_file state. o.mu must be held.
+func (o *Orchestrator) envStale(path, hash string) bool {
+	if o.liveSlot == nil || o.liveSlot.env == nil {
+		return false
+	}
+	env := o.liveSlot.env
+	return env.EnvFile != path || env.EnvFileHash != hash
+}
+
+// WatchEnvFile checks env_file every envWatchInterval and reports when the
+// live slot falls behind it, restarting it with env_reload "auto". It never
+// returns.
+func (o *Orchestrator) WatchEnvFile() {
+	seen := ""
+	for {
+		time.Sleep(envWatchInterval)
+		seen = o.checkEnvFile(seen)
+	}
+}
+
+// checkEnvFile acts on a stale live slot, unless the env_file version is
+// seen, the one it last acted on. It returns the version it acted on.
+func (o *Orchestrator) checkEnvFile(seen string) string {
+	path, hash := o.envFileState()
+	o.mu.Lock()
+	stale := o.envStale(path, hash)
+	auto := o.cfg.EnvReload == "auto"
+	o.mu.Unlock()
+	version := path + "@" + hash
+	if !stale || version == seen {
+		return seen
+	}
+
+	if !auto {
+		fmt.Println("env_file changed; the live slot still has the old values (slot-machine restart --rolling applies them)")
+		return version
+	}
+	fmt.Println("env_file changed; restarting the live slot")
+	resp, code := o.Restart()
+	switch {
+	case code == 409:
+		return seen // a deploy is running; it may pick the file up, or try again next time
+	case !resp.Success:
+		fmt.Printf("warning: restart for env_file change failed: %s\n", resp.Error)
+	}
+	return version
+}
@@ -0,0 +1,265 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Everything the daemon does that changes its state is published as an
+// event on one bus: deploys, rollbacks, and restarts as they start,
+// progress, and finish, crashes of the live slot, health changes, locks,
+// journal entries, and agent runs. Features hang off the bus instead of
+// hooking into the deploy path: deploy trackers and crash-loop webhooks
+// subscribe in-process with Subscribe, and GET /events streams every event
+// as server-sent events to dashboards, the chat UI, and `slot-machine
+// events`. Every event has an ID, and the last eventBacklog are kept, so a
+// client that reconnects with Last-Event-ID (or ?after=) gets what it
+// missed. IDs start over when the daemon restarts.
+
+const (
+	eventBacklog   = 256
+	eventBuffer    = 64 // per stream; one that falls this far behind is cut off
+	eventKeepalive = 15 * time.Second
+)
+
+// Event types, with the type of their data.
+const (
+	EventDeployStarted    = "deploy_started"    // no data
+	EventDeployProgress   = "deploy_progress"   // DeployProgress
+	EventDeployFinished   = "deploy_finished"   // EventOutcome
+	EventDeployPending    = "deploy_pending"    // PendingDeploy: an agent's deploy waits for approval
+	EventDeployApproved   = "deploy_approved"   // PendingDecision
+	EventDeployRejected   = "deploy_rejected"   // PendingDecision
+	EventRollbackStarted  = "rollback_started"  // no data
+	EventRollbackFinished = "rollback_finished" // EventOutcome
+	EventRestartStarted   = "restart_started"   // no data
+	EventRestartFinished  = "restart_finished"  // EventOutcome
+	EventRecoveryStarted  = "recovery_started"  // no data
+	EventRecoveryFinished = "recovery_finished" // EventOutcome
+	EventHealthFailure    = "health_failure"    // HealthFailure: a deploy's new slot failed its health check
+	EventStagingRestored  = "staging_restored"  // StagingRestore
+	EventJournaled        = "journaled"         // JournalEntry
+	EventHealth           = "health"            // HealthzResponse: the live slot's health changed
+	EventSlotCrashed      = "slot_crashed"      // SlotCrash
+	EventSlotRestarted    = "slot_restarted"    // no data
+	EventCrashLoop        = "crash_loop"        // CrashLoop
+	EventSlotDrift        = "slot_drift"        // SlotDrift
+	EventLocked           = "locked"            // Freeze
+	EventUnlocked         = "unlocked"          // no data
+	EventReadOnly         = "read_only"         // no data
+	EventReadWrite        = "read_write"        // no data
+	EventPromoteStarted   = "promote_started"   // no data
+	EventPromoteFinished  = "promote_finished"  // EventOutcome
+)
+
+// DaemonEvent is one event on the bus.
+type DaemonEvent struct {
+	ID     int64  `json:"id"`
+	Time   string `json:"time"` // RFC3339
+	Type   string `json:"type"`
+	Commit string `json:"commit,omitempty"`
+	Slot   string `json:"slot,omitempty"`
+	Data   any    `json:"data,omitempty"` // depends on Type; see the Event constants
+}
+
+// EventOutcome is the data of the *_finished events.
+type EventOutcome struct {
+	Success    bool   `json:"success"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// SlotCrash is the data of slot_crashed.
+type SlotCrash struct {
+	RestartInMs int64 `json:"restart_in_ms"`
+}
+
+// eventBus fans events out to in-process handlers and the streams of
+// GET /events.
+type eventBus struct {
+	mu       sync.Mutex
+	lastID   int64
+	recent   []DaemonEvent // the last eventBacklog, oldest first
+	streams  map[chan DaemonEvent]bool
+	handlers map[int]eventHandler
+	nextSub  int
+}
+
+type eventHandler struct {
+	fn    func(DaemonEvent)
+	types map[string]bool // nil: all
+}
+
+func (b *eventBus) publish(e DaemonEvent) {
+	b.mu.Lock()
+	b.lastID++
+	e.ID = b.lastID
+	e.Time = time.Now().Format(time.RFC3339)
+	b.recent = append(b.recent, e)
+	if len(b.recent) > eventBacklog {
+		b.recent = b.recent[len(b.recent)-eventBacklog:]
+	}
+	for ch := range b.streams {
+		select {
+		case ch <- e:
+		default:
+			// Too slow: cut it off, and it picks up from the backlog
+			// when it reconnects.
+			delete(b.streams, ch)
+			close(ch)
+		}
+	}
+	var fns []func(DaemonEvent)
+	for _, h := range b.handlers {
+		if h.types == nil || h.types[e.Type] {
+			fns = append(fns, h.fn)
+		}
+	}
+	b.mu.Unlock()
+
+	// Outside the lock, so a handler may publish.
+	for _, fn := range fns {
+		fn(e)
+	}
+}
+
+// stream returns the kept events after the one with ID after and a channel
+// with those that follow. An after the bus hasn't reached yet is from
+// before a daemon restart, and gets the whole backlog.
+func (b *eventBus) stream(after int64) ([]DaemonEvent, chan DaemonEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if after > b.lastID {
+		after = 0
+	}
+	var backlog []DaemonEvent
+	for _, e := range b.recent {
+		if e.ID > after {
+			backlog = append(backlog, e)
+		}
+	}
+	ch := make(chan DaemonEvent, eventBuffer)
+	if b.streams == nil {
+		b.streams = make(map[chan DaemonEvent]bool)
+	}
+	b.streams[ch] = true
+	return backlog, ch
+}
+
+func (b *eventBus) closeStream(ch chan DaemonEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.streams[ch] {
+		delete(b.streams, ch)
+		close(ch)
+	}
+}
+
+func (b *eventBus) subscribe(fn func(DaemonEvent), types []string) (unsubscribe func()) {
+	h := eventHandler{fn: fn}
+	if len(types) > 0 {
+		h.types = make(map[string]bool)
+		for _, t := range types {
+			h.types[t] = true
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.handlers == nil {
+		b.handlers = make(map[int]eventHandler)
+	}
+	b.nextSub++
+	id := b.nextSub
+	b.handlers[id] = h
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers, id)
+	}
+}
+
+// Publish sends an event to the bus. data should be the type the Event
+// constant for typ names; streams encode it as JSON.
+func (o *Orchestrator) Publish(typ, commit, slot string, data any) {
+	o.events.publish(DaemonEvent{Type: typ, Commit: commit, Slot: slot, Data: data})
+}
+
+// Subscribe calls fn with each event of the given types, or of every type
+// if none are given, until unsubscribe is called. fn runs on the goroutine
+// that published the event, sometimes in the middle of a deploy, so it
+// must not block: anything slow belongs in a goroutine of its own.
+func (o *Orchestrator) Subscribe(fn func(DaemonEvent), types ...string) (unsubscribe func()) {
+	return o.events.subscribe(fn, types)
+}
+
+// publishOutcome sends a *_finished event for something that began at start.
+func (o *Orchestrator) publishOutcome(typ, commit, slot string, success bool, errMsg string, start time.Time) {
+	o.Publish(typ, commit, slot, EventOutcome{Success: success, Error: errMsg, DurationMs: time.Since(start).Milliseconds()})
+}
+
+// --- GET /events ---
+
+func (o *Orchestrator) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", 500)
+		return
+	}
+
+	// Accept Last-Event-ID (a reconnect) or ?after= (a client that knows
+	// where it left off), and ?types= to follow only some.
+	var after int64
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		after, _ = strconv.ParseInt(lastID, 10, 64)
+	} else if s := r.URL.Query().Get("after"); s != "" {
+		after, _ = strconv.ParseInt(s, 10, 64)
+	}
+	var types map[string]bool
+	if s := r.URL.Query().Get("types"); s != "" {
+		types = make(map[string]bool)
+		for _, t := range strings.Split(s, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+
+	backlog, ch := o.events.stream(after)
+	defer o.events.closeStream(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	write := func(e DaemonEvent) {
+		if types != nil && !types[e.Type] {
+			return
+		}
+		data, _ := json.Marshal(e)
+		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	}
+	for _, e := range backlog {
+		write(e)
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			write(e)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,143 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// POST /exec runs a one-off command (a console, a migration, a debugging
+// script) in a slot's directory with the environment its process was
+// started with, so nobody has to piece PORT and env_file together by hand.
+// The body is a JSON object, optionally followed by the command's stdin.
+// The response streams the output as JSON lines and ends with the exit
+// code. A client that goes away kills the command.
+//
+// A command runs as the app, so it takes the admin token as
+// "Authorization: Bearer <token>"; a daemon without one refuses every exec.
+
+// ExecRequest is the body of POST /exec.
+type ExecRequest struct {
+	Command string `json:"command"`
+	Slot    string `json:"slot"` // "live" (default), "prev", or a slot name
+}
+
+// execLine is a line of POST /exec's response. Output is sent as bytes,
+// base64 in the JSON, so binary output and characters split across two
+// writes arrive as they were written.
+type execLine struct {
+	Stdout   []byte `json:"stdout,omitempty"`
+	Stderr   []byte `json:"stderr,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (o *Orchestrator) handleExec(w http.ResponseWriter, r *http.Request) {
+	if o.adminToken == "" {
+		writeJSON(w, 403, map[string]string{"error": "exec needs SLOT_MACHINE_ADMIN_TOKEN set on the daemon"})
+		return
+	}
+	if token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); !o.checkAdminToken(token) {
+		writeJSON(w, 401, map[string]string{"error": "invalid admin token"})
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var req ExecRequest
+	if err := dec.Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid body"})
+		return
+	}
+	if req.Command == "" {
+		writeJSON(w, 400, map[string]string{"error": "command is required"})
+		return
+	}
+	if req.Slot == "" {
+		req.Slot = "live"
+	}
+
+	o.mu.Lock()
+	s, _ := o.findSlot(req.Slot)
+	var dir string
+	var env []string
+	if s != nil {
+		dir, env = s.dir, s.environ
+		if env == nil {
+			env = o.buildEnv(s.release, s.appPort, s.intPort)
+		}
+	}
+	o.mu.Unlock()
+	if s == nil {
+		writeJSON(w, 404, map[string]string{"error": "no slot named " + req.Slot})
+		return
+	}
+
+	// Whatever follows the JSON object is stdin, minus the newline that
+	// usually ends it.
+	rest, _ := io.ReadAll(dec.Buffered())
+	stdin := io.MultiReader(bytes.NewReader(bytes.TrimPrefix(rest, []byte("\n"))), r.Body)
+
+	cmd := exec.CommandContext(r.Context(), "/bin/sh", "-c", req.Command)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+
+	rc := http.NewResponseController(w)
+	rc.EnableFullDuplex()
+	w.Header().Set("Content-Type", progressContentType)
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	rc.Flush()
+
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	send := func(line execLine) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(line)
+		rc.Flush()
+	}
+	cmd.Stdout = execOutput(func(p []byte) { send(execLine{Stdout: p}) })
+	cmd.Stderr = execOutput(func(p []byte) { send(execLine{Stderr: p}) })
+
+	// Not cmd.Stdin: Wait would wait for the copy, and so for the client to
+	// close its end, after the command has exited.
+	in, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		code := -1
+		send(execLine{ExitCode: &code, Error: err.Error()})
+		return
+	}
+	go func() {
+		io.Copy(in, stdin)
+		in.Close()
+	}()
+
+	err = cmd.Wait()
+	code := cmd.ProcessState.ExitCode()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		send(execLine{ExitCode: &code, Error: err.Error()})
+		return
+	}
+	send(execLine{ExitCode: &code})
+}
+
+// execOutput is an io.Writer that hands each write to fn, which is done
+// with it when it returns.
+type execOutput func([]byte)
+
+func (f execOutput) Write(p []byte) (int, error) {
+	f(p)
+	return len(p), nil
+}
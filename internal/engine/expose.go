@@ -0,0 +1,231 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"time"
+)
+
+// A laptop, or a box behind NAT, has no port the internet can reach. With
+// expose set, the daemon runs a cloudflared or ngrok tunnel to the app
+// proxy, so the app gets a public URL without opening one. The tunnel is a
+// process of the daemon's own, in the data dir, with its output in
+// expose.log; if it exits, it's started again after a delay that doubles
+// up to a minute. GET /status reports the public URL the tunnel printed,
+// or expose.url for a named tunnel that doesn't print one.
+
+const (
+	exposeLogName  = "expose.log"
+	maxExposeDelay = time.Minute
+	exposeURLPoll  = 200 * time.Millisecond
+)
+
+// ExposeProviders are the values of expose.provider.
+var ExposeProviders = []string{"cloudflared", "ngrok"}
+
+// exposeURLs finds the public URL in each provider's output: cloudflared's
+// quick tunnels print it in a banner, and ngrok logs it as JSON.
+var exposeURLs = map[string]*regexp.Regexp{
+	"cloudflared": regexp.MustCompile(`https://[a-z0-9-]+\.trycloudflare\.com`),
+	"ngrok":       regexp.MustCompile(`"url":"(https://[^"]+)"`),
+}
+
+// Expose runs a tunnel that makes the app proxy publicly reachable.
+type Expose struct {
+	Provider string `json:"provider"` // "cloudflared" or "ngrok"
+	Command  string `json:"command"`  // run instead of the provider's default; $PORT is the app proxy's port
+	URL      string `json:"url"`      // the public URL, for a named tunnel that doesn't print it
+}
+
+// ExposeStatus is the tunnel, in GET /status.
+type ExposeStatus struct {
+	Provider string `json:"provider"`
+	URL      string `json:"url,omitempty"` // empty until the tunnel prints it
+	Running  bool   `json:"running"`
+	Restarts int    `json:"restarts"`        // since the daemon started
+	Error    string `json:"error,omitempty"` // why the tunnel last exited
+}
+
+// CheckExpose validates expose.
+func CheckExpose(cfg Config) error {
+	e := cfg.Expose
+	if e == nil {
+		return nil
+	}
+	if exposeURLs[e.Provider] == nil {
+		return fmt.Errorf("expose.provider must be \"cloudflared\" or \"ngrok\", not %q", e.Provider)
+	}
+	return nil
+}
+
+// exposeCommand is the command line that runs e's tunnel to addr.
+func exposeCommand(e Expose, addr string) string {
+	if e.Command != "" {
+		return e.Command
+	}
+	if e.Provider == "ngrok" {
+		return fmt.Sprintf("ngrok http %s --log stdout --log-format json", addr)
+	}
+	return fmt.Sprintf("cloudflared tunnel --no-autoupdate --url http://%s", addr)
+}
+
+// exposeTarget is the address the tunnel connects to: the app proxy's
+// first, through loopback if it listens on all interfaces.
+func (o *Orchestrator) exposeTarget() (string, error) {
+	host, port, err := net.SplitHostPort(o.appProxy.Addr())
+	if err != nil {
+		return "", fmt.Errorf("the app proxy has no address: %w", err)
+	}
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// Expose runs the tunnel expose configures, starting it again whenever it
+// exits, until DrainAll. It returns at once without expose.
+func (o *Orchestrator) Expose() {
+	o.mu.Lock()
+	var e Expose
+	if o.cfg.Expose != nil {
+		e = *o.cfg.Expose
+		o.tunnel = &ExposeStatus{Provider: e.Provider, URL: e.URL}
+	}
+	o.mu.Unlock()
+	if e.Provider == "" {
+		return
+	}
+
+	failures := 0
+	for {
+		started := time.Now()
+		err := o.runTunnel(e)
+		if time.Since(started) > maxExposeDelay {
+			failures = 0 // it was up a while: not failing to start
+		}
+		delay := min(time.Second<<failures, maxExposeDelay)
+		failures++
+
+		o.mu.Lock()
+		stopping := o.stopping
+		o.tunnel.Running = false
+		o.tunnel.URL = e.URL
+		o.tunnel.Error = err.Error()
+		o.mu.Unlock()
+		if stopping {
+			return
+		}
+		fmt.Printf("warning: expose: %s tunnel: %v; starting it again in %s\n", e.Provider, err, delay)
+		time.Sleep(delay)
+
+		o.mu.Lock()
+		stopping = o.stopping
+		o.tunnel.Restarts++
+		o.mu.Unlock()
+		if stopping {
+			return
+		}
+	}
+}
+
+// runTunnel starts e's tunnel and waits for it to exit, recording the
+// public URL once it prints it.
+func (o *Orchestrator) runTunnel(e Expose) error {
+	addr, err := o.exposeTarget()
+	if err != nil {
+		return err
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	logPath := filepath.Join(o.dataDir, exposeLogName)
+	var offset int64
+	if fi, err := os.Stat(logPath); err == nil {
+		offset = fi.Size()
+	}
+
+	env := append(os.Environ(), "PORT="+port)
+	proc, err := o.runner.Start(o.dataDir, exposeCommand(e, addr), env, logPath)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	o.tunnelProc = proc
+	o.tunnel.Running = true
+	o.tunnel.Error = ""
+	stopping := o.stopping
+	o.mu.Unlock()
+	if stopping {
+		proc.Signal(syscall.SIGTERM) // DrainAll came first and missed it
+	}
+	if e.URL == "" {
+		fmt.Printf("expose: started %s tunnel to %s; waiting for its public URL\n", e.Provider, addr)
+	} else {
+		fmt.Printf("expose: started %s tunnel to %s at %s\n", e.Provider, addr, e.URL)
+	}
+
+	exited := make(chan struct{})
+	if e.URL == "" {
+		go o.watchTunnelURL(exposeURLs[e.Provider], logPath, offset, exited)
+	}
+	err = proc.Wait()
+	close(exited)
+
+	o.mu.Lock()
+	o.tunnelProc = nil
+	o.mu.Unlock()
+	if err == nil {
+		err = errors.New("exited")
+	}
+	return err
+}
+
+// watchTunnelURL reads what the tunnel writes to logPath past offset until
+// re finds its public URL, or the tunnel exits.
+func (o *Orchestrator) watchTunnelURL(re *regexp.Regexp, logPath string, offset int64, exited <-chan struct{}) {
+	for {
+		select {
+		case <-exited:
+			return
+		case <-time.After(exposeURLPoll):
+		}
+		f, err := os.Open(logPath)
+		if err != nil {
+			continue
+		}
+		f.Seek(offset, io.SeekStart)
+		out, _ := io.ReadAll(f)
+		f.Close()
+		m := re.FindSubmatch(out)
+		if m == nil {
+			continue
+		}
+		url := string(m[len(m)-1])
+		o.mu.Lock()
+		select {
+		case <-exited: // too late: the URL went with the tunnel
+			o.mu.Unlock()
+			return
+		default:
+			o.tunnel.URL = url
+		}
+		o.mu.Unlock()
+		fmt.Printf("expose: the app is public at %s\n", url)
+		return
+	}
+}
+
+// stopTunnel asks the tunnel to exit. o.mu must be held, with o.stopping
+// set so it isn't started again.
+func (o *Orchestrator) stopTunnel() {
+	if o.tunnelProc != nil {
+		o.tunnelProc.Signal(syscall.SIGTERM)
+	}
+}
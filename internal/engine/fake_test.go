@@ -0,0 +1,324 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Fakes for the engine's dependencies. They let Deploy and Rollback run in
+// milliseconds without git or real processes.
+
+// fakeRunner records setup runs and hands out fakeProcesses.
+type fakeRunner struct {
+	mu         sync.Mutex
+	setupErr   error
+	startErr   error
+	startPanic bool
+	ignoreTerm bool // processes ignore SIGTERM and need SIGKILL
+	setups     []string
+	setupOut   string // written by every setup run
+	procs      []*fakeProcess
+
+	// Runs of the command "smoke" are recorded here instead of in setups.
+	smokeErr    error
+	smokeOutput string
+	smokes      [][]string // env of each run
+
+	// Runs of the command "pre-stop": the dir, and the signals any process
+	// had been sent by then.
+	preStops []string
+}
+
+func (r *fakeRunner) Run(dir, command string, env []string, out io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if command == "smoke" {
+		r.smokes = append(r.smokes, env)
+		io.WriteString(out, r.smokeOutput)
+		return r.smokeErr
+	}
+	if command == "pre-stop" {
+		var sigs []syscall.Signal
+		for _, p := range r.procs {
+			sigs = append(sigs, p.received()...)
+		}
+		r.preStops = append(r.preStops, fmt.Sprintf("%s %v", filepath.Base(dir), sigs))
+		return nil
+	}
+	r.setups = append(r.setups, dir)
+	io.WriteString(out, r.setupOut)
+	return r.setupErr
+}
+
+func (r *fakeRunner) Start(dir, command string, env []string, logPath string) (Process, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.startPanic {
+		panic("fake panic")
+	}
+	if r.startErr != nil {
+		return nil, r.startErr
+	}
+	p := &fakeProcess{dir: dir, env: env, ignoreTerm: r.ignoreTerm, exited: make(chan struct{})}
+	r.procs = append(r.procs, p)
+	return p, nil
+}
+
+func (r *fakeRunner) started() []*fakeProcess {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*fakeProcess(nil), r.procs...)
+}
+
+// fakeProcess runs until signalled (or until exit is called).
+type fakeProcess struct {
+	dir        string
+	env        []string
+	ignoreTerm bool
+
+	mu      sync.Mutex
+	signals []syscall.Signal
+	once    sync.Once
+	exited  chan struct{}
+}
+
+func (p *fakeProcess) Signal(sig syscall.Signal) error {
+	p.mu.Lock()
+	p.signals = append(p.signals, sig)
+	p.mu.Unlock()
+	if sig == syscall.SIGKILL || !p.ignoreTerm {
+		p.exit()
+	}
+	return nil
+}
+
+func (p *fakeProcess) Wait() error {
+	<-p.exited
+	return nil
+}
+
+func (p *fakeProcess) Pgid() int { return 0 }
+
+// exit simulates the process exiting on its own (a crash).
+func (p *fakeProcess) exit() { p.once.Do(func() { close(p.exited) }) }
+
+func (p *fakeProcess) received() []syscall.Signal {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]syscall.Signal(nil), p.signals...)
+}
+
+// fakeWorktrees keeps worktrees as plain directories and remembers which
+// commit each one holds. Checkout writes files[commit] into the directory.
+type fakeWorktrees struct {
+	mu          sync.Mutex
+	checkoutErr error
+	promoteErr  error
+	commits     map[string]string
+	files       map[string]map[string]string
+	changes     WorktreeChanges            // what Changes reports for every dir
+	dirChanges  map[string]WorktreeChanges // what Changes reports for a dir, over changes
+	stashed     WorktreeChanges            // set aside by Stash, put back by Unstash
+	conflicts   []string                   // what Unstash reports
+}
+
+func (w *fakeWorktrees) Checkout(dir, commit string) error {
+	if w.checkoutErr != nil {
+		return w.checkoutErr
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, content := range w.files[commit] {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	w.set(dir, commit)
+	return nil
+}
+
+func (w *fakeWorktrees) Promote(oldDir, newDir string) error {
+	if w.promoteErr != nil {
+		return w.promoteErr
+	}
+	if err := os.Rename(oldDir, newDir); err != nil {
+		return err
+	}
+	w.set(newDir, w.Commit(oldDir))
+	return nil
+}
+
+func (w *fakeWorktrees) Clone(srcDir, dstDir, commit string) error {
+	os.RemoveAll(dstDir)
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		return err
+	}
+	w.set(dstDir, commit)
+	return nil
+}
+
+func (w *fakeWorktrees) Remove(dir string) {
+	os.RemoveAll(dir)
+	w.mu.Lock()
+	delete(w.commits, dir)
+	w.mu.Unlock()
+}
+
+func (w *fakeWorktrees) Commit(dir string) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.commits[dir]
+}
+
+func (w *fakeWorktrees) Changes(dir string, ignore []string) (WorktreeChanges, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if c, ok := w.dirChanges[dir]; ok {
+		return c, nil
+	}
+	return w.changes, nil
+}
+
+func (w *fakeWorktrees) Stash(dir string, ignore []string) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.changes == (WorktreeChanges{}) {
+		return "", nil
+	}
+	w.stashed, w.changes = w.changes, WorktreeChanges{}
+	return "5ta5h000", nil
+}
+
+func (w *fakeWorktrees) Unstash(dir, stash string) ([]string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.changes, w.stashed = w.stashed, WorktreeChanges{}
+	return w.conflicts, nil
+}
+
+func (w *fakeWorktrees) Repair(dirs map[string]string) []string { return nil }
+
+func (w *fakeWorktrees) set(dir, commit string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.commits == nil {
+		w.commits = map[string]string{}
+	}
+	w.commits[dir] = commit
+}
+
+// fakeHealth answers from a queue of results; once empty, every check passes.
+// With hold set, checks block until it is closed or the process exits.
+type fakeHealth struct {
+	mu       sync.Mutex
+	results  []bool
+	hold     chan struct{}
+	timeouts []time.Duration
+	checked  []string // "port path" per call
+}
+
+func (h *fakeHealth) WaitHealthy(port int, path string, timeout time.Duration, exited <-chan struct{}) bool {
+	h.mu.Lock()
+	h.timeouts = append(h.timeouts, timeout)
+	h.checked = append(h.checked, fmt.Sprintf("%d %s", port, path))
+	hold := h.hold
+	h.mu.Unlock()
+	if hold != nil {
+		select {
+		case <-hold:
+		case <-exited:
+			return false
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.results) == 0 {
+		return true
+	}
+	ok := h.results[0]
+	h.results = h.results[1:]
+	return ok
+}
+
+// waitCalls blocks until WaitHealthy has been called n times.
+func (h *fakeHealth) waitCalls(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		h.mu.Lock()
+		got := len(h.timeouts)
+		h.mu.Unlock()
+		if got >= n {
+			return
+		}
+	}
+	t.Fatalf("WaitHealthy not called %d times", n)
+}
+
+// fakeEngine bundles an orchestrator with the fakes it runs on.
+// fakeVerifier answers from sigs and refs; unknown commits are unsigned,
+// with no author, and on no ref.
+type fakeVerifier struct {
+	sigs map[string]CommitSignature
+	refs map[string][]string // commit -> refs it is reachable from
+}
+
+func (v *fakeVerifier) Verify(commit string) (CommitSignature, error) {
+	return v.sigs[commit], nil
+}
+
+func (v *fakeVerifier) Reachable(commit, ref string) (bool, error) {
+	return slices.Contains(v.refs[commit], ref), nil
+}
+
+type fakeEngine struct {
+	*Orchestrator
+	runner    *fakeRunner
+	worktrees *fakeWorktrees
+	health    *fakeHealth
+	verifier  *fakeVerifier
+}
+
+func newFakeEngine(t *testing.T, cfg Config) *fakeEngine {
+	t.Helper()
+	if cfg.StartCommand == "" {
+		cfg.StartCommand = "./app"
+	}
+	if cfg.DrainTimeoutMs == 0 {
+		cfg.DrainTimeoutMs = 1000
+	}
+	f := &fakeEngine{
+		runner:    &fakeRunner{},
+		worktrees: &fakeWorktrees{},
+		health:    &fakeHealth{},
+		verifier:  &fakeVerifier{},
+	}
+	f.Orchestrator = New(Options{
+		Config:    cfg,
+		RepoDir:   t.TempDir(),
+		DataDir:   t.TempDir(),
+		Runner:    f.runner,
+		Worktrees: f.worktrees,
+		Health:    f.health,
+		Verifier:  f.verifier,
+	})
+	t.Cleanup(f.DrainAll)
+	return f
+}
+
+var errFake = errors.New("fake failure")
+
+// symlinkTarget returns where dataDir/name points, or "".
+func (f *fakeEngine) symlinkTarget(name string) string {
+	target, _ := os.Readlink(filepath.Join(f.dataDir, name))
+	return target
+}
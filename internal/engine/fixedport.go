@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// Blue/green needs the new slot listening beside the old one, so every
+// slot gets ports of its own in PORT and INTERNAL_PORT. An app that binds a
+// hardcoded port instead can't do that: its new slot dies with EADDRINUSE.
+// fixed_port_mode gives every slot the app's own port and stops the live
+// slot before starting the next, so deploys, rollbacks, and restarts mean
+// downtime (the proxy's 503 page) while the new process boots. If it never
+// gets healthy the old one is started again.
+
+// slotPorts returns the app and internal ports for a new slot: appPort and
+// intPort if they're free, other free ones otherwise (see ports.go), or the
+// fixed ones in fixed_port_mode.
+func (o *Orchestrator) slotPorts(appPort, intPort int) (int, int, error) {
+	o.mu.Lock()
+	fixed, app, internal := o.cfg.FixedPortMode, o.cfg.FixedPort, o.cfg.FixedInternalPort
+	public := []int{o.cfg.Port, o.cfg.InternalPort}
+	o.mu.Unlock()
+	if fixed {
+		if app == 0 {
+			return 0, 0, errors.New("fixed_port_mode needs fixed_port, the port the app binds")
+		}
+		if internal == 0 {
+			internal = app
+		}
+		if slices.Contains(public, app) || slices.Contains(public, internal) {
+			return 0, 0, errors.New("fixed_port can't be port or internal_port, which the proxy listens on")
+		}
+		return app, internal, nil
+	}
+	return o.reservePorts(appPort, intPort)
+}
+
+// errFixedPort refuses what needs two copies of the app at once.
+func (o *Orchestrator) errFixedPort(what string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.cfg.FixedPortMode {
+		return nil
+	}
+	return fmt.Errorf("%s needs a second copy of the app running, which fixed_port_mode can't do", what)
+}
+
+// vacateFixedPort stops the live slot in fixed_port_mode, so that a new one
+// can bind its port, and returns a func that starts it again should the new
+// one fail. Outside fixed_port_mode, or with nothing live, it does nothing.
+// Call with the deploy lock held.
+func (o *Orchestrator) vacateFixedPort() (undo func()) {
+	o.mu.Lock()
+	if !o.cfg.FixedPortMode {
+		o.mu.Unlock()
+		return func() {}
+	}
+	live := o.liveSlot
+	if live == nil {
+		// Replaced, as far as awaitRecovery is concerned.
+		live, o.recovering = o.recovering, nil
+	}
+	o.mu.Unlock()
+	if live == nil {
+		return func() {}
+	}
+
+	fmt.Printf("fixed_port_mode: stopping %s to free port %d\n", live.name, live.appPort)
+	o.appProxy.ClearTarget()
+	o.intProxy.ClearTarget()
+	o.drain(live)
+
+	return func() {
+		fmt.Printf("fixed_port_mode: starting %s again\n", live.name)
+		s, err := o.startProcess(live.dir, live.commit, live.release, live.appPort, live.intPort)
+		if err != nil {
+			fmt.Printf("warning: fixed_port_mode: restarting %s: %v\n", live.name, err)
+			return
+		}
+		s.name = live.name
+		s.setupHash = live.setupHash
+		s.message = live.message
+		if !o.waitReady(s, o.recoveryTimeout(), nil) {
+			fmt.Printf("warning: fixed_port_mode: %s didn't get healthy again; nothing is live\n", live.name)
+			s.proc.Signal(syscall.SIGKILL)
+			<-s.done
+			return
+		}
+		o.mu.Lock()
+		o.liveSlot = s
+		o.mu.Unlock()
+		o.appProxy.SetSlotInfo(s.proxyInfo())
+		o.switchTargets(s.appPort, s.intPort)
+	}
+}
+
+// bindConflictHint explains a slot that exited because its port was taken,
+// judging by the tail of its output, or returns "".
+func (o *Orchestrator) bindConflictHint(s *slot) string {
+	lines, err := tailFile(s.logPath, healthLogLines)
+	if err != nil {
+		return ""
+	}
+	conflict := false
+	for _, l := range lines {
+		if strings.Contains(l, "EADDRINUSE") || strings.Contains(strings.ToLower(l), "address already in use") {
+			conflict = true
+			break
+		}
+	}
+	if !conflict {
+		return ""
+	}
+	o.mu.Lock()
+	fixed := o.cfg.FixedPortMode
+	o.mu.Unlock()
+	if fixed {
+		return fmt.Sprintf("port %d is in use by something other than slot-machine; free it, or fix fixed_port", s.appPort)
+	}
+	return fmt.Sprintf("the app tried to bind a port that's in use; it was given PORT=%d and INTERNAL_PORT=%d, and most likely binds a fixed port instead. Make it listen on $PORT, or set fixed_port_mode and fixed_port (deploys then take it down while the new process starts)", s.appPort, s.intPort)
+}
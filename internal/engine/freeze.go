@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Locking deploys holds the app at its current release, e.g. during an
+// incident or a release freeze: deploys are refused with 423 until it's
+// unlocked. Rollbacks still go through, since they're how an incident ends.
+// The freeze is kept in state.json, so it survives a restart. It has
+// nothing to do with DeployLocks, the mutex each deploy holds while it runs.
+
+// Freeze is the "locked" field of GET /status and the body of POST /lock.
+type Freeze struct {
+	Reason string `json:"reason,omitempty"`
+	Since  string `json:"since"` // RFC3339
+}
+
+type freezeRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (o *Orchestrator) handleFreeze(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "DELETE" {
+		o.UnlockDeploys()
+		writeJSON(w, 200, map[string]bool{"success": true})
+		return
+	}
+	var req freezeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSON(w, 400, map[string]string{"error": "invalid body"})
+		return
+	}
+	writeJSON(w, 200, o.LockDeploys(req.Reason))
+}
+
+// LockDeploys refuses deploys until UnlockDeploys. Locking again replaces
+// the reason but keeps the original time.
+func (o *Orchestrator) LockDeploys(reason string) Freeze {
+	o.mu.Lock()
+	f := Freeze{Reason: reason, Since: time.Now().Format(time.RFC3339)}
+	if o.freeze != nil {
+		f.Since = o.freeze.Since
+	}
+	o.freeze = &f
+	o.mu.Unlock()
+	if err := o.saveState(); err != nil {
+		fmt.Printf("warning: saving state: %v\n", err)
+	}
+	fmt.Printf("deploys locked: %s\n", reason)
+	o.Publish(EventLocked, "", "", f)
+	return f
+}
+
+// UnlockDeploys lifts a freeze set by LockDeploys.
+func (o *Orchestrator) UnlockDeploys() {
+	o.mu.Lock()
+	was := o.freeze != nil
+	o.freeze = nil
+	o.mu.Unlock()
+	if !was {
+		return
+	}
+	if err := o.saveState(); err != nil {
+		fmt.Printf("warning: saving state: %v\n", err)
+	}
+	fmt.Println("deploys unlocked")
+	o.Publish(EventUnlocked, "", "", nil)
+}
+
+// Locked returns the current freeze, or nil.
+func (o *Orchestrator) Locked() *Freeze {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.freeze
+}
+
+// frozenError is the error for a deploy refused by f.
+func frozenError(f *Freeze) string {
+	msg := "deploys are locked since " + f.Since
+	if f.Reason != "" {
+		msg += ": " + f.Reason
+	}
+	return msg
+}
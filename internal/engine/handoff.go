@@ -0,0 +1,265 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"slot-machine/internal/proxy"
+)
+
+// Restarting onto a new binary (auto_update) doesn't stop the app. The
+// daemon stops accepting connections and lets the requests in flight
+// finish, but keeps its sockets open across an exec of the new binary, so
+// connections arriving meanwhile wait in the kernel's backlog. The live
+// slot's process keeps running: exec keeps the daemon's PID, so it's still
+// the new daemon's child, which takes it over as it is rather than
+// restarting it. Everything else (the previous slot, mirror candidate,
+// previews, the tunnel) is stopped, as on any restart.
+//
+// What the new daemon takes over travels in HandoffEnv as JSON, with the
+// file descriptors it inherits.
+
+// HandoffEnv is the environment variable a Handoff is passed in.
+const HandoffEnv = "SLOT_MACHINE_HANDOFF"
+
+// Handoff is what a daemon re-execing itself leaves the new one.
+type Handoff struct {
+	Listeners map[string]int `json:"listeners,omitempty"` // address → inherited socket
+	Live      *HandoffSlot   `json:"live,omitempty"`
+}
+
+// HandoffSlot is the live slot's running process.
+type HandoffSlot struct {
+	Name   string `json:"name"`
+	Pid    int    `json:"pid"`              // also its process group
+	Log    string `json:"log"`              // its log file
+	Output int    `json:"output,omitempty"` // inherited read end of its output pipe, if it has one
+}
+
+// ParseHandoff decodes a Handoff from HandoffEnv's value, or returns nil
+// for an empty one. The descriptors it names are kept from being inherited
+// again by the processes the daemon starts.
+func ParseHandoff(s string) (*Handoff, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var h Handoff
+	if err := json.Unmarshal([]byte(s), &h); err != nil {
+		return nil, fmt.Errorf("%s: %w", HandoffEnv, err)
+	}
+	for _, fd := range h.Listeners {
+		syscall.CloseOnExec(fd)
+	}
+	if h.Live != nil && h.Live.Output > 0 {
+		syscall.CloseOnExec(h.Live.Output)
+	}
+	return &h, nil
+}
+
+// Encode returns h as HandoffEnv's value.
+func (h *Handoff) Encode() string {
+	data, _ := json.Marshal(h)
+	return string(data)
+}
+
+// TakeListeners returns the inherited sockets by address. Those that can't
+// be used are closed and left out.
+func (h *Handoff) TakeListeners() map[string]net.Listener {
+	if h == nil {
+		return nil
+	}
+	lns := map[string]net.Listener{}
+	for addr, fd := range h.Listeners {
+		f := os.NewFile(uintptr(fd), addr)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			fmt.Printf("warning: inherited listener %s: %v\n", addr, err)
+			continue
+		}
+		lns[addr] = ln
+	}
+	h.Listeners = nil
+	return lns
+}
+
+// AddListener passes ln, bound to addr, on to the new daemon.
+func (h *Handoff) AddListener(addr string, ln net.Listener) error {
+	c, ok := ln.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("listener %s: not a socket", addr)
+	}
+	fd, err := inheritable(c)
+	if err != nil {
+		return fmt.Errorf("listener %s: %w", addr, err)
+	}
+	if h.Listeners == nil {
+		h.Listeners = map[string]int{}
+	}
+	h.Listeners[addr] = fd
+	return nil
+}
+
+// inheritable duplicates c's descriptor without close-on-exec, so it
+// survives an exec.
+func inheritable(c syscall.Conn) (fd int, err error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	if cerr := rc.Control(func(s uintptr) { fd, err = syscall.Dup(int(s)) }); cerr != nil {
+		return -1, cerr
+	}
+	return fd, err
+}
+
+// outputPiper is a Process whose output the daemon reads through a pipe.
+type outputPiper interface {
+	outputPipe() *os.File
+}
+
+// Handoff readies the daemon to exec a new binary that takes over: the
+// proxies stop accepting connections and their requests in flight are
+// answered, and every slot process but the live one is drained. It returns
+// what the new daemon takes over; on an error, nothing was stopped.
+func (o *Orchestrator) Handoff() (*Handoff, error) {
+	// Copies of the sockets, made now: closing the proxies closes theirs.
+	// They become inheritable once the drains' pre-stop commands are done.
+	socks := map[string]*os.File{}
+	closeSocks := func() {
+		for _, f := range socks {
+			f.Close()
+		}
+	}
+	for _, p := range []*proxy.Proxy{o.appProxy, o.intProxy} {
+		for addr, ln := range p.Listeners() {
+			tcp, ok := ln.(*net.TCPListener)
+			if !ok {
+				continue
+			}
+			f, err := tcp.File()
+			if err != nil {
+				closeSocks()
+				return nil, fmt.Errorf("listener %s: %w", addr, err)
+			}
+			socks[addr] = f
+		}
+	}
+	defer closeSocks()
+
+	o.mu.Lock()
+	live := o.liveSlot
+	running := live != nil && live.alive && live.pgid > 0
+	o.mu.Unlock()
+
+	o.closeProxies()
+	o.drainAll(true)
+
+	h := &Handoff{Listeners: map[string]int{}}
+	for addr, f := range socks {
+		fd, err := inheritable(f)
+		if err != nil {
+			fmt.Printf("warning: listener %s: %v; it's closed during the restart\n", addr, err)
+			continue
+		}
+		h.Listeners[addr] = fd
+	}
+	if running {
+		h.Live = &HandoffSlot{Name: live.name, Pid: live.pgid, Log: live.logPath}
+		if p, ok := live.proc.(outputPiper); ok && p.outputPipe() != nil {
+			if fd, err := inheritable(p.outputPipe()); err != nil {
+				fmt.Printf("warning: %s's output: %v; it's lost after the restart\n", live.name, err)
+			} else {
+				h.Live.Output = fd
+			}
+		}
+	}
+	if err := o.saveState(); err != nil {
+		fmt.Printf("warning: saving state: %v\n", err)
+	}
+	return h, nil
+}
+
+// adoptLive makes the process the last daemon handed off the live slot
+// again, as it is, if it's still running live's release. It returns nil
+// otherwise, for the slot to be restarted.
+func (o *Orchestrator) adoptLive(live *slotState) *slot {
+	hs := o.handoff.Live
+	o.handoff.Live = nil
+	dir := filepath.Join(o.dataDir, live.Name)
+	if syscall.Kill(hs.Pid, 0) != nil || !o.ownsGroup(procGroup{PGID: hs.Pid, Dir: dir}) {
+		if hs.Output > 0 {
+			syscall.Close(hs.Output)
+		}
+		return nil
+	}
+	proc, err := os.FindProcess(hs.Pid)
+	if err != nil {
+		return nil
+	}
+	ap := &adoptedProcess{proc: proc}
+	if hs.Output > 0 {
+		ap.output = os.NewFile(uintptr(hs.Output), live.Name+" output")
+		if logFile, err := os.OpenFile(hs.Log, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+			go copyOutput(o.logs, ap.output, logFile)
+		}
+	}
+
+	s := &slot{
+		name:      live.Name,
+		commit:    live.Commit,
+		dir:       dir,
+		proc:      ap,
+		done:      make(chan struct{}),
+		alive:     true,
+		appPort:   live.AppPort,
+		intPort:   live.IntPort,
+		logPath:   hs.Log,
+		env:       live.Env,
+		pgid:      hs.Pid,
+		setupHash: live.SetupHash,
+		message:   live.Message,
+		release:   live.Release,
+	}
+	info := s.proxyInfo()
+	o.appProxy.SetSlotInfo(info)
+	o.trackProcs(s, true)
+	go o.watch(s, info)
+
+	o.mu.Lock()
+	o.useRelease(live.Release.config())
+	o.liveSlot = s
+	if err := o.appProxy.SetTarget(s.appPort); err != nil {
+		fmt.Printf("warning: %v\n", err)
+	}
+	if err := o.intProxy.SetTarget(s.intPort); err != nil {
+		fmt.Printf("warning: %v\n", err)
+	}
+	o.mu.Unlock()
+	fmt.Printf("took over live slot: %s (%s), still running from before the restart\n", live.Name, ShortHash(live.Commit))
+	return s
+}
+
+// adoptedProcess is a slot process the last daemon started. It's still
+// this process's child, so it can be waited for.
+type adoptedProcess struct {
+	proc   *os.Process
+	output *os.File // read end of its output pipe, or nil
+}
+
+func (p *adoptedProcess) Signal(sig syscall.Signal) error {
+	return syscall.Kill(-p.proc.Pid, sig)
+}
+
+func (p *adoptedProcess) Wait() error {
+	_, err := p.proc.Wait()
+	return err
+}
+
+func (p *adoptedProcess) Pgid() int { return p.proc.Pid }
+
+func (p *adoptedProcess) outputPipe() *os.File { return p.output }
@@ -0,0 +1,51 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// When a deploy's new slot never turns healthy, "health check failed" alone
+// says nothing about why. The deploy response carries the reason and the
+// tail of the slot's output, and a health_failure event hands both to
+// whoever subscribed (the daemon stores them in the chat, so the agent that
+// deployed sees what broke).
+
+// healthLogLines is how much of a failed slot's output is reported.
+const healthLogLines = 50
+
+// HealthFailure is a deploy whose new slot never turned healthy.
+type HealthFailure struct {
+	Commit string `json:"commit"`
+	Error  string `json:"error"` // why the slot was judged unhealthy
+	Log    string `json:"log"`   // tail of the slot's stdout/stderr
+}
+
+// healthError says why s failed its health check. Call it before s is
+// killed, or every slot looks like it crashed.
+func (o *Orchestrator) healthError(s *slot) string {
+	select {
+	case <-s.done:
+		if hint := o.bindConflictHint(s); hint != "" {
+			return "process exited before becoming healthy: " + hint
+		}
+		return "process exited before becoming healthy"
+	default:
+	}
+	endpoints := fmt.Sprintf("%s on port %d", o.cfg.HealthEndpoint, s.intPort)
+	if o.cfg.AppHealthEndpoint != "" {
+		endpoints += fmt.Sprintf(" and %s on port %d", o.cfg.AppHealthEndpoint, s.appPort)
+	}
+	return fmt.Sprintf("no healthy answer from %s %s", endpoints, o.probeLimit())
+}
+
+// reportHealthFailure collects the tail of s's output once it has stopped,
+// publishes it as a health_failure event, and returns it.
+func (o *Orchestrator) reportHealthFailure(s *slot, reason string) HealthFailure {
+	f := HealthFailure{Commit: s.commit, Error: reason}
+	if lines, err := tailFile(s.logPath, healthLogLines); err == nil && len(lines) > 0 {
+		f.Log = strings.Join(lines, "\n") + "\n"
+	}
+	o.Publish(EventHealthFailure, s.commit, s.name, f)
+	return f
+}
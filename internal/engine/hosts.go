@@ -0,0 +1,54 @@
+package engine
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"slot-machine/internal/proxy"
+)
+
+// HostConfig routes one Host header on the app proxy. The zero value sends
+// it to this app's live slot, like any host not listed.
+type HostConfig struct {
+	Chat bool   `json:"chat"` // serve only the agent chat on this host
+	Port int    `json:"port"` // forward to another local port, e.g. a second daemon's app port
+	Cert string `json:"cert"` // PEM certificate chain for tls_port
+	Key  string `json:"key"`  // PEM private key for cert
+}
+
+// loadHosts builds the app proxy's host table from cfg, reading each
+// certificate. Paths are relative to the repo. Hosts whose certificate
+// fails to load are still routed, without TLS; the failures are returned
+// together.
+func (o *Orchestrator) loadHosts(cfg Config) (map[string]proxy.Host, error) {
+	hosts := make(map[string]proxy.Host, len(cfg.Hosts))
+	var errs []error
+	for name, hc := range cfg.Hosts {
+		h := proxy.Host{Chat: hc.Chat, Port: hc.Port}
+		if hc.Chat && hc.Port != 0 {
+			errs = append(errs, fmt.Errorf("hosts.%s: chat and port are exclusive", name))
+		}
+		if (hc.Cert == "") != (hc.Key == "") {
+			errs = append(errs, fmt.Errorf("hosts.%s: cert and key go together", name))
+		} else if hc.Cert != "" {
+			cert, err := tls.LoadX509KeyPair(o.repoPath(hc.Cert), o.repoPath(hc.Key))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("hosts.%s: %w", name, err))
+			} else {
+				h.Cert = &cert
+			}
+		}
+		hosts[name] = h
+	}
+	return hosts, errors.Join(errs...)
+}
+
+// repoPath resolves path against the repo unless it's absolute.
+func (o *Orchestrator) repoPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(o.repoDir, path)
+}
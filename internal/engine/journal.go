@@ -0,0 +1,180 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The journal is append-only NDJSON. Each line carries a CRC32 of the entry
+// so a torn or bit-flipped record is detected and skipped instead of
+// poisoning the rest of the file. Lines written before checksums existed
+// have no "crc" and are accepted as-is.
+
+// JournalEntry is one line of journal.ndjson, as served by GET /history.
+type JournalEntry struct {
+	Time        string `json:"time"`
+	Action      string `json:"action"`
+	Commit      string `json:"commit"`
+	SlotDir     string `json:"slot_dir"`
+	PrevCommit  string `json:"prev_commit"`
+	Message     string `json:"message,omitempty"`      // the deploy's, e.g. "hotfix for checkout bug"
+	SmokeOutput string `json:"smoke_output,omitempty"` // tail of a failed smoke_command's output
+	DurationMs  int64  `json:"duration_ms,omitempty"`  // how long the deploy or rollback took
+	Version     string `json:"version,omitempty"`      // slot-machine release an update moved to
+	PrevVersion string `json:"prev_version,omitempty"` // and the one it replaced
+	Manifest    string `json:"manifest,omitempty"`     // digest of the deployed slot's files (see GET /slots/{name}/manifest)
+	CRC         string `json:"crc,omitempty"`
+}
+
+// checksum is the CRC32 of the entry's JSON encoding without the crc field.
+func (e JournalEntry) checksum() string {
+	e.CRC = ""
+	data, _ := json.Marshal(e)
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(data))
+}
+
+func journalPath(dataDir string) string {
+	return filepath.Join(dataDir, "journal.ndjson")
+}
+
+func (o *Orchestrator) appendJournal(action, commit, slotDir, prevCommit string) error {
+	return o.writeJournal(JournalEntry{
+		Action:     action,
+		Commit:     commit,
+		SlotDir:    slotDir,
+		PrevCommit: prevCommit,
+	})
+}
+
+// writeJournal stamps entry with the time and its checksum and appends it.
+func (o *Orchestrator) writeJournal(entry JournalEntry) error {
+	entry.Time = time.Now().Format(time.RFC3339)
+	entry.CRC = entry.checksum()
+	if err := o.appendJournalEntry(entry); err != nil {
+		return err
+	}
+	var slotName string
+	if entry.SlotDir != "" {
+		slotName = filepath.Base(entry.SlotDir)
+	}
+	o.Publish(EventJournaled, entry.Commit, slotName, entry)
+	return nil
+}
+
+// appendJournalEntry appends entry as it is, time and checksum included,
+// without publishing it: a standby's copies of the primary's entries
+// aren't news.
+func (o *Orchestrator) appendJournalEntry(entry JournalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(journalPath(o.dataDir), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// A crash mid-write can leave the last line without its newline. Start
+	// on a fresh line so the torn record doesn't swallow this one.
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			data = append([]byte{'\n'}, data...)
+		}
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// RecentDeploys returns the last n journal entries, oldest first.
+func (o *Orchestrator) RecentDeploys(n int) []JournalEntry {
+	entries, _ := o.readJournal()
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries
+}
+
+// readJournal returns all valid journal entries, oldest first. Corrupt lines
+// are skipped. A missing journal is not an error.
+func (o *Orchestrator) readJournal() ([]JournalEntry, error) {
+	f, err := os.Open(journalPath(o.dataDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, _, err := scanJournal(f)
+	return entries, err
+}
+
+// JournalReport is the result of VerifyJournal.
+type JournalReport struct {
+	Entries  int   `json:"entries"`   // valid, checksummed entries
+	Legacy   int   `json:"legacy"`    // valid entries written without a checksum
+	Corrupt  []int `json:"corrupt"`   // 1-based line numbers that failed to parse or verify
+	TornTail bool  `json:"torn_tail"` // the file doesn't end in a newline
+}
+
+// OK reports whether every line verified.
+func (r JournalReport) OK() bool { return len(r.Corrupt) == 0 }
+
+// VerifyJournal checks every record in dataDir's journal. A missing journal
+// verifies as empty.
+func VerifyJournal(dataDir string) (JournalReport, error) {
+	f, err := os.Open(journalPath(dataDir))
+	if os.IsNotExist(err) {
+		return JournalReport{Corrupt: []int{}}, nil
+	}
+	if err != nil {
+		return JournalReport{}, err
+	}
+	defer f.Close()
+	_, report, err := scanJournal(f)
+	return report, err
+}
+
+func scanJournal(r io.Reader) ([]JournalEntry, JournalReport, error) {
+	report := JournalReport{Corrupt: []int{}}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, report, err
+	}
+	report.TornTail = len(data) > 0 && data[len(data)-1] != '\n'
+
+	var entries []JournalEntry
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var e JournalEntry
+		if json.Unmarshal([]byte(line), &e) != nil {
+			report.Corrupt = append(report.Corrupt, i+1)
+			continue
+		}
+		switch {
+		case e.CRC == "":
+			report.Legacy++
+		case e.CRC == e.checksum():
+			report.Entries++
+			e.CRC = ""
+		default:
+			report.Corrupt = append(report.Corrupt, i+1)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, report, nil
+}
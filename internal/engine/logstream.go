@@ -0,0 +1,214 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// The merged log stream puts everything the daemon hears in one place, a
+// JSON object per line in logs.ndjson: slot output, timestamped and tagged
+// with the slot's name as it's written (the slot's own <slot>.log is kept
+// as before), the daemon's own output, and the agent's stderr. GET
+// /logs?source=all tails it.
+
+// LogStreamName is the merged log stream's file in the data dir.
+const LogStreamName = "logs.ndjson"
+
+// logStreamMax is the size at which the stream is moved to .1 and started
+// afresh.
+const logStreamMax = 16 << 20
+
+// maxLogLine is the longest line kept whole; a longer one is split.
+const maxLogLine = 64 * 1024
+
+// Log sources.
+const (
+	SourceSlot   = "slot"
+	SourceDaemon = "daemon"
+	SourceAgent  = "agent"
+)
+
+// LogRecord is a line of the merged log stream.
+type LogRecord struct {
+	Time         string `json:"time"`
+	Source       string `json:"source"`                 // SourceSlot, SourceDaemon, or SourceAgent
+	Slot         string `json:"slot,omitempty"`         // for slot output
+	Conversation string `json:"conversation,omitempty"` // for agent output
+	Line         string `json:"line"`
+}
+
+// LogStream appends LogRecords to a file. A nil *LogStream discards them.
+type LogStream struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	size int64
+}
+
+// NewLogStream returns a stream writing to path, which is opened on first
+// use.
+func NewLogStream(path string) *LogStream {
+	return &LogStream{path: path}
+}
+
+// Append writes rec, stamping it with the current time if it has none.
+func (l *LogStream) Append(rec LogRecord) {
+	if l == nil {
+		return
+	}
+	if rec.Time == "" {
+		rec.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	data, _ := json.Marshal(rec)
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return
+		}
+		info, _ := f.Stat()
+		l.f, l.size = f, info.Size()
+	}
+	n, _ := l.f.Write(data)
+	l.size += int64(n)
+	if l.size >= logStreamMax {
+		l.f.Close()
+		l.f = nil
+		os.Rename(l.path, l.path+".1")
+	}
+}
+
+// Writer returns a writer that appends each line written to it as a
+// record like tmpl. Close writes what's left of an unfinished line.
+func (l *LogStream) Writer(tmpl LogRecord) io.WriteCloser {
+	return &logLineWriter{stream: l, tmpl: tmpl}
+}
+
+// Tail returns the last n records (all, if n <= 0) from source, or from
+// every source if source is "" or "all".
+func (l *LogStream) Tail(source string, n int) ([]LogRecord, error) {
+	if l == nil {
+		return nil, nil
+	}
+	var recs []LogRecord
+	for _, path := range []string{l.path + ".1", l.path} {
+		lines, err := tailFile(path, 0)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			var rec LogRecord
+			if json.Unmarshal([]byte(line), &rec) != nil {
+				continue
+			}
+			if source == "" || source == "all" || rec.Source == source {
+				recs = append(recs, rec)
+			}
+		}
+	}
+	if n > 0 && len(recs) > n {
+		recs = recs[len(recs)-n:]
+	}
+	return recs, nil
+}
+
+// Close closes the stream's file; the next Append opens it again.
+func (l *LogStream) Close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+}
+
+// logLineWriter splits what's written to it into lines for a LogStream.
+type logLineWriter struct {
+	stream *LogStream
+	tmpl   LogRecord
+	mu     sync.Mutex
+	buf    []byte
+}
+
+func (w *logLineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			if len(w.buf) >= maxLogLine {
+				w.emit(w.buf[:maxLogLine])
+				w.buf = w.buf[maxLogLine:]
+				continue
+			}
+			break
+		}
+		w.emit(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	// Don't hold on to the backing array of a long burst.
+	w.buf = append([]byte(nil), w.buf...)
+	return len(p), nil
+}
+
+func (w *logLineWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.emit(w.buf)
+		w.buf = nil
+	}
+	return nil
+}
+
+func (w *logLineWriter) emit(line []byte) {
+	rec := w.tmpl
+	rec.Line = string(bytes.TrimSuffix(line, []byte("\r")))
+	w.stream.Append(rec)
+}
+
+// handleMergedLogs answers GET /logs?source=, with the stream's last lines
+// both as records and formatted.
+func (o *Orchestrator) handleMergedLogs(w http.ResponseWriter, source string, n int) {
+	switch source {
+	case "all", SourceSlot, SourceDaemon, SourceAgent:
+	default:
+		writeJSON(w, 400, LogsResponse{Error: "source must be all, slot, daemon, or agent"})
+		return
+	}
+	recs, err := o.logs.Tail(source, n)
+	if err != nil {
+		writeJSON(w, 500, LogsResponse{Error: err.Error()})
+		return
+	}
+	resp := LogsResponse{Lines: make([]string, len(recs)), Records: recs}
+	for i, rec := range recs {
+		resp.Lines[i] = rec.String()
+	}
+	writeJSON(w, 200, resp)
+}
+
+// String formats rec as "<time> [<tag>] <line>", the tag being the slot's
+// name, "daemon", or "agent".
+func (rec LogRecord) String() string {
+	tag := rec.Source
+	if rec.Slot != "" {
+		tag = rec.Slot
+	}
+	return rec.Time + " [" + tag + "] " + rec.Line
+}
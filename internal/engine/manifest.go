@@ -0,0 +1,399 @@
+package engine
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Once a slot is set up, nothing should change its files: a file that
+// differs from what was deployed is a manual edit in prod, or tampering.
+// So every deployed slot gets a manifest, written once setup is done and
+// before the app starts: the commit's git tree, and the sha256 of each file
+// in the slot, setup's output included, with the lockfiles listed apart.
+// The manifest is signed with an ed25519 key the daemon keeps in its data
+// dir (manifest.key), and its digest goes in the deploy's journal entry,
+// so the journal is a ledger of what each deploy put on disk. GET
+// /slots/{name}/verify hashes the slot's files again and compares. The
+// slot's .git, what manifest_ignore matches (files the app writes at
+// runtime, like logs), and what shared_dirs links to are left out.
+
+// manifestKeyName is the daemon's signing key, in the data dir.
+const manifestKeyName = "manifest.key"
+
+// knownLockfiles are listed apart in a manifest when they're at the top of
+// the slot, as are setup_cache_keys.
+var knownLockfiles = []string{
+	"package-lock.json", "yarn.lock", "pnpm-lock.yaml", "bun.lockb", "Gemfile.lock", "go.sum",
+	"Cargo.lock", "poetry.lock", "uv.lock", "Pipfile.lock", "composer.lock", "mix.lock",
+}
+
+// SlotManifest is what a slot's files were when it was deployed.
+type SlotManifest struct {
+	Slot      string            `json:"slot"`
+	Commit    string            `json:"commit"`
+	Tree      string            `json:"tree,omitempty"` // the commit's git tree; none for an artifact
+	CreatedAt string            `json:"created_at"`
+	Lockfiles map[string]string `json:"lockfiles,omitempty"` // path → sha256
+	Files     map[string]string `json:"files"`               // path → sha256, or "symlink:<target>"
+	Digest    string            `json:"digest"`              // sha256 of Files, one "<hash>  <path>" line each, by path
+}
+
+// SignedManifest is the body of GET /slots/{name}/manifest.
+type SignedManifest struct {
+	Manifest  SlotManifest `json:"manifest"`
+	PublicKey string       `json:"public_key"` // base64 ed25519
+	Signature string       `json:"signature"`  // base64 ed25519, of the manifest's JSON
+}
+
+// ManifestCheck is the body of GET /slots/{name}/verify.
+type ManifestCheck struct {
+	Slot        string   `json:"slot"`
+	Commit      string   `json:"commit"`
+	Digest      string   `json:"digest,omitempty"` // the manifest's
+	OK          bool     `json:"ok"`
+	SignatureOK bool     `json:"signature_ok"`
+	Modified    []string `json:"modified,omitempty"`
+	Added       []string `json:"added,omitempty"`
+	Deleted     []string `json:"deleted,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+func manifestPath(dataDir, slot string) string {
+	return filepath.Join(dataDir, "manifests", slot+".json")
+}
+
+// buildManifest hashes the files in dir, a slot set up at commit. Its slot
+// name is set when it's saved.
+func (o *Orchestrator) buildManifest(dir, commit string) (*SlotManifest, error) {
+	o.mu.Lock()
+	ignore := o.cfg.ManifestIgnore
+	cacheKeys := o.cfg.SetupCacheKeys
+	o.mu.Unlock()
+
+	files, err := hashSlotFiles(dir, ignore)
+	if err != nil {
+		return nil, err
+	}
+	m := &SlotManifest{
+		Commit:    commit,
+		Tree:      o.commitTree(commit),
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Files:     files,
+		Digest:    filesDigest(files),
+	}
+	for p, sum := range files {
+		if (!strings.Contains(p, "/") && slices.Contains(knownLockfiles, p)) || slices.Contains(cacheKeys, p) {
+			if m.Lockfiles == nil {
+				m.Lockfiles = map[string]string{}
+			}
+			m.Lockfiles[p] = sum
+		}
+	}
+	return m, nil
+}
+
+// commitTree returns commit's tree hash, or "" if git doesn't know it.
+func (o *Orchestrator) commitTree(commit string) string {
+	if isArtifact(commit) {
+		return ""
+	}
+	out, err := exec.Command("git", "-C", o.repoDir, "rev-parse", "--verify", "-q", commit+"^{tree}").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// hashSlotFiles returns the sha256 of every file in dir by slash-separated
+// path, and the target of every symlink, without following it. .git and
+// what ignore matches are skipped.
+func hashSlotFiles(dir string, ignore []string) (map[string]string, error) {
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == ".git" || manifestIgnored(rel, ignore) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			files[rel] = "symlink:" + target
+		case d.Type().IsRegular():
+			sum, err := fileSHA256(p)
+			if err != nil {
+				return err
+			}
+			files[rel] = sum
+		}
+		return nil
+	})
+	return files, err
+}
+
+// manifestIgnored reports whether a manifest_ignore pattern matches rel or
+// a directory it's in.
+func manifestIgnored(rel string, ignore []string) bool {
+	for _, pattern := range ignore {
+		pattern = strings.TrimSuffix(pattern, "/")
+		for p := rel; p != "."; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// filesDigest hashes files as sha256sum would list them, sorted by path.
+func filesDigest(files map[string]string) string {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	h := sha256.New()
+	for _, p := range paths {
+		fmt.Fprintf(h, "%s  %s\n", files[p], p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// manifestKey returns the daemon's signing key, generating it the first
+// time.
+func (o *Orchestrator) manifestKey() (ed25519.PrivateKey, error) {
+	p := filepath.Join(o.dataDir, manifestKeyName)
+	data, err := os.ReadFile(p)
+	if err == nil {
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%s is not an ed25519 seed", p)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(p, []byte(base64.StdEncoding.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// saveManifest signs m as slot's manifest and writes it to the data dir,
+// and drops the manifests of slots that are gone.
+func (o *Orchestrator) saveManifest(m *SlotManifest, slot string) error {
+	key, err := o.manifestKey()
+	if err != nil {
+		return err
+	}
+	m.Slot = slot
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	sm := SignedManifest{
+		Manifest:  *m,
+		PublicKey: base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, body)),
+	}
+	data, err := json.Marshal(sm)
+	if err != nil {
+		return err
+	}
+	p := manifestPath(o.dataDir, slot)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return err
+	}
+
+	others, _ := filepath.Glob(filepath.Join(o.dataDir, "manifests", "*.json"))
+	for _, other := range others {
+		name := strings.TrimSuffix(filepath.Base(other), ".json")
+		if _, err := os.Stat(filepath.Join(o.dataDir, name)); errors.Is(err, os.ErrNotExist) {
+			os.Remove(other)
+		}
+	}
+	return nil
+}
+
+// recordManifest builds and saves the manifest of the slot set up in dir,
+// or says why it couldn't, and returns its digest.
+func (o *Orchestrator) recordManifest(dir, commit string) string {
+	m, err := o.buildManifest(dir, commit)
+	if err == nil {
+		err = o.saveManifest(m, filepath.Base(dir))
+	}
+	if err != nil {
+		fmt.Printf("warning: manifest of %s: %v\n", filepath.Base(dir), err)
+		return ""
+	}
+	return m.Digest
+}
+
+// loadManifest reads slot's manifest; nil if it has none.
+func (o *Orchestrator) loadManifest(slot string) (*SignedManifest, error) {
+	data, err := os.ReadFile(manifestPath(o.dataDir, slot))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sm SignedManifest
+	if err := json.Unmarshal(data, &sm); err != nil {
+		return nil, fmt.Errorf("manifest of %s: %w", slot, err)
+	}
+	return &sm, nil
+}
+
+// verifySignature checks sm's signature, and that it's this daemon's.
+func (o *Orchestrator) verifySignature(sm *SignedManifest) bool {
+	key, err := o.manifestKey()
+	if err != nil {
+		return false
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	sig, err := base64.StdEncoding.DecodeString(sm.Signature)
+	if err != nil || sm.PublicKey != base64.StdEncoding.EncodeToString(pub) {
+		return false
+	}
+	body, err := json.Marshal(sm.Manifest)
+	return err == nil && ed25519.Verify(pub, body, sig)
+}
+
+// VerifySlot hashes the files of the slot named name (or "live", "prev"...)
+// again, and compares them with its manifest.
+func (o *Orchestrator) VerifySlot(name string) (ManifestCheck, int) {
+	o.mu.Lock()
+	s, _ := o.findSlot(name)
+	var dir, slotName, commit string
+	if s != nil {
+		dir, slotName, commit = s.dir, s.name, s.commit
+	}
+	ignore := o.cfg.ManifestIgnore
+	o.mu.Unlock()
+	if s == nil {
+		return ManifestCheck{Slot: name, Error: "no slot named " + name}, 404
+	}
+	check := ManifestCheck{Slot: slotName, Commit: commit}
+
+	sm, err := o.loadManifest(slotName)
+	if err != nil {
+		check.Error = err.Error()
+		return check, 500
+	}
+	if sm == nil {
+		check.Error = slotName + " has no manifest: it was deployed before slot-machine wrote them"
+		return check, 404
+	}
+	check.Digest = sm.Manifest.Digest
+	check.SignatureOK = o.verifySignature(sm) && filesDigest(sm.Manifest.Files) == sm.Manifest.Digest
+
+	files, err := hashSlotFiles(dir, ignore)
+	if err != nil {
+		check.Error = err.Error()
+		return check, 500
+	}
+	for p, sum := range sm.Manifest.Files {
+		now, ok := files[p]
+		switch {
+		case !ok:
+			check.Deleted = append(check.Deleted, p)
+		case now != sum:
+			check.Modified = append(check.Modified, p)
+		}
+	}
+	for p := range files {
+		if _, ok := sm.Manifest.Files[p]; !ok {
+			check.Added = append(check.Added, p)
+		}
+	}
+	sort.Strings(check.Modified)
+	sort.Strings(check.Added)
+	sort.Strings(check.Deleted)
+	check.OK = check.SignatureOK && len(check.Modified)+len(check.Added)+len(check.Deleted) == 0
+	return check, 200
+}
+
+// --- GET /slots/{name}/manifest, GET /slots/{name}/verify ---
+
+func (o *Orchestrator) handleManifest(w http.ResponseWriter, name string) {
+	o.mu.Lock()
+	s, _ := o.findSlot(name)
+	slotName := name
+	if s != nil {
+		slotName = s.name
+	}
+	o.mu.Unlock()
+	if s == nil {
+		writeJSON(w, 404, map[string]string{"error": "no slot named " + name})
+		return
+	}
+	sm, err := o.loadManifest(slotName)
+	switch {
+	case err != nil:
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+	case sm == nil:
+		writeJSON(w, 404, map[string]string{"error": slotName + " has no manifest: it was deployed before slot-machine wrote them"})
+	default:
+		writeJSON(w, 200, sm)
+	}
+}
+
+func (o *Orchestrator) handleVerify(w http.ResponseWriter, name string) {
+	check, code := o.VerifySlot(name)
+	writeJSON(w, code, check)
+}
@@ -0,0 +1,157 @@
+package engine
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"slot-machine/internal/proxy"
+)
+
+// Mirroring boots a candidate commit in its own slot-mirror directory, next
+// to live and staging, and has the app proxy copy a sample of live requests
+// to it. The candidate never answers a client; its status codes are only
+// compared with the live slot's, so a release can be tried on real traffic
+// before it's deployed.
+
+const (
+	mirrorSlotName       = "slot-mirror"
+	defaultMirrorPercent = 10
+)
+
+type mirrorRequest struct {
+	Commit     string `json:"commit"`
+	Percent    int    `json:"percent"`     // of live requests (default 10)
+	AllMethods bool   `json:"all_methods"` // also mirror POST, PUT, DELETE...
+}
+
+// MirrorResponse is the body of POST /mirror.
+type MirrorResponse struct {
+	Success bool   `json:"success"`
+	Slot    string `json:"slot"`
+	Commit  string `json:"commit"`
+	Error   string `json:"error,omitempty"`
+}
+
+// MirrorStatus is the "mirror" field of GET /status.
+type MirrorStatus struct {
+	Commit string `json:"commit"`
+	Alive  bool   `json:"alive"`
+	proxy.MirrorStats
+}
+
+func (o *Orchestrator) handleMirror(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "DELETE" {
+		if !o.StopMirror() {
+			writeJSON(w, 409, MirrorResponse{Error: errDeployInProgress})
+			return
+		}
+		writeJSON(w, 200, MirrorResponse{Success: true})
+		return
+	}
+	var req mirrorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); (err != nil && err != io.EOF) || req.Commit == "" {
+		writeJSON(w, 400, MirrorResponse{Error: "missing commit"})
+		return
+	}
+	resp, code := o.StartMirror(req.Commit, req.Percent, req.AllMethods)
+	writeJSON(w, code, resp)
+}
+
+// StartMirror boots commit in the mirror slot, replacing any candidate
+// already there, and starts copying percent% of live requests to it once
+// it's healthy. Only GET, HEAD, and OPTIONS are copied unless allMethods is
+// set, since the candidate shares the app's data.
+func (o *Orchestrator) StartMirror(commit string, percent int, allMethods bool) (MirrorResponse, int) {
+	if percent == 0 {
+		percent = defaultMirrorPercent
+	}
+	if percent < 0 || percent > 100 {
+		return MirrorResponse{Error: "percent must be between 1 and 100"}, 400
+	}
+
+	if err := o.errFixedPort("mirroring"); err != nil {
+		return MirrorResponse{Error: err.Error()}, 400
+	}
+
+	release, _, ok := o.locks.TryAcquire(o.app, "mirror", commit)
+	if !ok {
+		return MirrorResponse{Error: errDeployInProgress}, 409
+	}
+	defer release()
+
+	o.stopMirror()
+
+	dir := filepath.Join(o.dataDir, mirrorSlotName)
+	if err := o.worktrees.Checkout(dir, commit); err != nil {
+		return MirrorResponse{Error: err.Error()}, 500
+	}
+	o.applySharedDirs(dir)
+
+	// The candidate runs as a deploy of it would: with the live release.
+	o.mu.Lock()
+	rel := o.releaseFor(nil)
+	o.mu.Unlock()
+	appPort, intPort, err := o.reservePorts(0, 0)
+	if err != nil {
+		return MirrorResponse{Error: err.Error()}, 500
+	}
+	defer o.ports.release(appPort, intPort)
+	if o.cfg.SetupCommand != "" {
+		if err := o.runSetup(dir, rel, appPort, intPort, os.Stdout); err != nil {
+			return MirrorResponse{Error: "setup: " + err.Error()}, 500
+		}
+	}
+	s, err := o.startProcess(dir, commit, rel, appPort, intPort)
+	if err != nil {
+		return MirrorResponse{Error: "start: " + err.Error()}, 500
+	}
+	if !o.healthCheck(s, nil) {
+		s.proc.Signal(syscall.SIGKILL)
+		<-s.done
+		return MirrorResponse{Error: errHealthCheckFailed}, 500
+	}
+
+	o.mu.Lock()
+	o.mirrorSlot = s
+	o.mu.Unlock()
+	o.appProxy.SetMirror(appPort, percent, allMethods)
+
+	return MirrorResponse{Success: true, Slot: mirrorSlotName, Commit: commit}, 200
+}
+
+// StopMirror stops mirroring and the candidate slot. It returns false if a
+// deploy or rollback holds the lock.
+func (o *Orchestrator) StopMirror() bool {
+	release, _, ok := o.locks.TryAcquire(o.app, "mirror", "")
+	if !ok {
+		return false
+	}
+	defer release()
+	o.stopMirror()
+	return true
+}
+
+func (o *Orchestrator) stopMirror() {
+	o.appProxy.SetMirror(0, 0, false)
+	o.mu.Lock()
+	s := o.mirrorSlot
+	o.mirrorSlot = nil
+	o.mu.Unlock()
+	if s != nil {
+		o.drain(s)
+		o.worktrees.Remove(s.dir)
+	}
+}
+
+// mirrorStatus reports the candidate and its counters. Caller holds o.mu.
+func (o *Orchestrator) mirrorStatus() *MirrorStatus {
+	if o.mirrorSlot == nil {
+		return nil
+	}
+	st, _ := o.appProxy.MirrorStats()
+	return &MirrorStatus{Commit: o.mirrorSlot.commit, Alive: o.mirrorSlot.alive, MirrorStats: st}
+}
@@ -0,0 +1,1398 @@
+// Package engine is the deploy engine: it checks out commits into slots,
+// starts and health-checks processes, flips the proxies, and serves the
+// daemon API. Processes, worktrees, and health checks go through interfaces
+// so tests can swap them out.
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"slot-machine/internal/proxy"
+)
+
+// Orchestrator owns the slots and the proxies in front of them.
+type Orchestrator struct {
+	cfg        Config // replaced by Reload while holding locks, mu, and healthMu
+	repoDir    string
+	dataDir    string
+	authSecret string // hex HMAC secret, passed to app as SLOT_MACHINE_AUTH_SECRET
+	adminToken string // overrides deploy_policy.allowed_refs; never passed to the app
+	debugToken string // enables /debug; never passed to the app
+
+	stagingIgnore []string // paths in slot-staging the daemon writes itself
+
+	runner    ProcessRunner
+	worktrees WorktreeManager
+	health    HealthChecker
+	verifier  CommitVerifier
+
+	app   string       // key in locks
+	locks *DeployLocks // held for the whole of a deploy or rollback
+
+	mu         sync.Mutex
+	liveSlot   *slot
+	prevSlot   *slot
+	recovering *slot // last run's live slot, started but not yet healthy
+	mirrorSlot *slot // candidate receiving mirrored traffic, if any
+	previews   map[string]*preview
+	retained   []*slot // older releases kept for rollback, newest first
+	lastDeploy time.Time
+
+	freeze   *Freeze // deploys are refused while set (see freeze.go)
+	readOnly bool    // the API refuses changes (see readonly.go)
+
+	// readOnlyConfig is set when read_only or start --read-only turned
+	// read-only mode on, which without an admin token nothing undoes.
+	readOnlyConfig bool
+
+	// Following a primary (see peer.go): standby is nil unless the daemon
+	// is a standby, warm is the slot promote starts, and promoted is set
+	// once it was promoted.
+	standby  *StandbyStatus
+	warm     *slot
+	promoted bool
+
+	crashes   []time.Time           // the live release's recent crashes (see crashloop.go)
+	crashLoop *CrashLoop            // set once it crashed too often to restart
+	drift     map[string]*SlotDrift // slots whose files differ from their commits, by name
+	stopping  bool                  // DrainAll was called: crashes aren't restarted
+
+	upstreamFetched  time.Time // last fetch of the upstream remote
+	upstreamFetchErr string    // how it failed, if it did
+
+	tunnel     *ExposeStatus // nil unless expose is set (see expose.go)
+	tunnelProc Process       // the tunnel running now
+
+	appProxy *proxy.Proxy // proxies Config.Port → live slot's appPort
+	intProxy *proxy.Proxy // proxies Config.InternalPort → live slot's intPort
+
+	logs *LogStream // merged log stream; nil without a data dir
+
+	healthMu   sync.Mutex
+	lastHealth *healthResult // last /healthz probe, reused for HealthCacheTTLMs
+
+	// The slot processes running now, recorded in state.json so the next
+	// daemon can stop them if this one is killed; stateMu serializes its
+	// writes.
+	stateMu sync.Mutex
+	procs   map[*slot]bool
+
+	fetchMu sync.Mutex // serializes git fetches (see remote.go)
+
+	ports portHolds // slot ports reserved until their process starts
+
+	// The config as loaded, for the fields a release may set, and the
+	// live release's config on top of it in cfg.
+	releaseBase Config
+	releaseCfg  *ReleaseConfig
+
+	apiURL     string                // the daemon's API, for SLOT_MACHINE_READY_URL
+	readyWaits map[string]*readyWait // by token; guarded by mu
+
+	gate    deployGate       // deploy rate limits and coalescing
+	pending []*PendingDeploy // the agent's deploys held for approval (see approval.go); guarded by mu
+
+	events eventBus // Publish, Subscribe, and GET /events
+
+	chaos *Chaos // nil unless the daemon runs with --chaos
+
+	handoff *Handoff // left by the daemon that re-exec'd into this one, until RecoverState
+}
+
+// Options configures New. Runner, Worktrees, and Health are optional and
+// default to real processes, git worktrees, and HTTP health checks.
+type Options struct {
+	Config     Config
+	RepoDir    string
+	DataDir    string
+	AuthSecret string
+	AppProxy   *proxy.Proxy
+	IntProxy   *proxy.Proxy
+
+	// App names this app in Locks (default: the repo directory's name).
+	// Orchestrators sharing Locks deploy one at a time per app.
+	App   string
+	Locks *DeployLocks
+
+	Runner    ProcessRunner
+	Worktrees WorktreeManager
+	Health    HealthChecker
+	Verifier  CommitVerifier
+
+	// AdminToken lets a deploy skip deploy_policy.allowed_refs.
+	AdminToken string
+	// DebugToken enables the /debug endpoints for requests that carry it.
+	DebugToken string
+
+	// ReadOnly starts the API in read-only mode.
+	ReadOnly bool
+	// APIURL is where slots reach the daemon's API, for readiness
+	// callbacks (none without it).
+	APIURL string
+
+	// StagingIgnore lists paths in slot-staging, relative to it, that the
+	// daemon writes itself and that don't count as uncommitted changes.
+	StagingIgnore []string
+
+	// Logs is the merged log stream slot output is tagged into (default:
+	// LogStreamName in DataDir).
+	Logs *LogStream
+
+	// Chaos, if set, randomly delays proxy switches and drains (see chaos.go).
+	Chaos *Chaos
+
+	// Handoff, if set, is what the daemon that re-exec'd into this one left
+	// running for RecoverState to take over (see handoff.go).
+	Handoff *Handoff
+}
+
+// New returns an orchestrator with no live slot. Call RecoverState to pick
+// up where a previous daemon left off.
+func New(opts Options) *Orchestrator {
+	o := &Orchestrator{
+		cfg:            opts.Config,
+		releaseBase:    opts.Config,
+		repoDir:        opts.RepoDir,
+		dataDir:        opts.DataDir,
+		authSecret:     opts.AuthSecret,
+		runner:         opts.Runner,
+		worktrees:      opts.Worktrees,
+		health:         opts.Health,
+		verifier:       opts.Verifier,
+		adminToken:     opts.AdminToken,
+		debugToken:     opts.DebugToken,
+		readOnly:       opts.ReadOnly,
+		readOnlyConfig: opts.ReadOnly,
+		apiURL:         opts.APIURL,
+		appProxy:       opts.AppProxy,
+		intProxy:       opts.IntProxy,
+		app:            opts.App,
+		locks:          opts.Locks,
+
+		stagingIgnore: opts.StagingIgnore,
+
+		logs:    opts.Logs,
+		chaos:   opts.Chaos,
+		handoff: opts.Handoff,
+	}
+	if o.logs == nil && o.dataDir != "" {
+		o.logs = NewLogStream(filepath.Join(o.dataDir, LogStreamName))
+	}
+	if o.app == "" {
+		o.app = filepath.Base(opts.RepoDir)
+	}
+	if o.locks == nil {
+		o.locks = NewDeployLocks()
+	}
+	if o.runner == nil {
+		o.runner = execRunner{logs: o.logs}
+	}
+	if o.worktrees == nil {
+		o.worktrees = &gitWorktrees{repoDir: opts.RepoDir}
+	}
+	if o.health == nil {
+		o.health = httpHealthChecker{}
+	}
+	if o.verifier == nil {
+		o.verifier = gitVerifier{repoDir: opts.RepoDir}
+	}
+	if o.appProxy == nil {
+		o.appProxy = proxy.New("", nil)
+	}
+	if o.intProxy == nil {
+		o.intProxy = proxy.New("", nil)
+	}
+	if p := o.cfg.Peer; p != nil {
+		o.standby = &StandbyStatus{Primary: p.Primary}
+	}
+	o.applyHealthCache()
+	o.applyPreviewDomain()
+	hosts, err := o.loadHosts(o.cfg)
+	if err != nil {
+		fmt.Printf("warning: %v\n", err)
+	}
+	o.appProxy.SetHosts(hosts)
+	o.appProxy.SetRetries(o.cfg.ProxyRetries)
+	o.appProxy.SetInterceptPrefix(o.cfg.InterceptPrefix)
+	o.appProxy.SetSlotHeaders(o.cfg.SlotHeaders)
+	if o.dataDir != "" {
+		o.appProxy.SetAccessLog(filepath.Join(o.dataDir, accessLogName))
+	}
+	o.applyAffinity()
+	o.applyUpstreamLimits()
+	if err := o.applyTrustedProxies(); err != nil {
+		fmt.Printf("warning: %v\n", err)
+	}
+	o.Subscribe(o.trackDeploy, EventJournaled)
+	o.Subscribe(o.postCrashWebhooks, EventCrashLoop)
+	o.Subscribe(o.postDriftWebhooks, EventSlotDrift)
+	return o
+}
+
+// applyHealthCache sets up health caching on whichever proxy fronts the
+// internal port, since that's where health polls arrive.
+func (o *Orchestrator) applyHealthCache() {
+	hp := o.intProxy
+	if o.cfg.InternalPort == 0 || o.cfg.InternalPort == o.cfg.Port {
+		hp = o.appProxy
+	}
+	hp.CacheHealth(o.cfg.HealthEndpoint, o.healthCacheTTL())
+}
+
+// HasLive reports whether a slot is currently live.
+func (o *Orchestrator) HasLive() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.liveSlot != nil
+}
+
+// LiveCommit returns the live slot's commit, or "" if none is live.
+func (o *Orchestrator) LiveCommit() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.liveSlot == nil {
+		return ""
+	}
+	return o.liveSlot.commit
+}
+
+// App returns the app's name: Options.App, or the repo directory's name.
+func (o *Orchestrator) App() string { return o.app }
+
+// Recovering reports whether the previous run's live slot is still booting.
+func (o *Orchestrator) Recovering() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.recovering != nil
+}
+
+// ---------------------------------------------------------------------------
+// HTTP API
+// ---------------------------------------------------------------------------
+
+// SpecVersion is the version of the daemon API, reported by GET /version.
+// Bump it whenever an endpoint, field, or header is added or changes, so
+// scripts can check for a feature before they use it.
+const SpecVersion = 8
+
+func (o *Orchestrator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if o.refuseReadOnly(w, r) {
+		return
+	}
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/":
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"ok"}`))
+
+	case r.Method == "POST" && r.URL.Path == "/deploy":
+		o.handleDeploy(w, r)
+
+	case r.Method == "POST" && r.URL.Path == "/releases":
+		o.handleRelease(w, r)
+
+	case r.URL.Path == "/deploys/pending" || strings.HasPrefix(r.URL.Path, "/deploys/pending/"):
+		o.handlePending(w, r)
+
+	case r.Method == "POST" && r.URL.Path == "/rollback":
+		o.handleRollback(w, r)
+
+	case r.Method == "POST" && r.URL.Path == "/restart":
+		o.handleRestart(w, r)
+
+	case r.Method == "GET" && r.URL.Path == "/status":
+		o.handleStatus(w, r)
+
+	case r.Method == "POST" && r.URL.Path == "/ready":
+		o.handleReady(w, r)
+
+	case r.Method == "GET" && r.URL.Path == "/healthz":
+		o.handleHealthz(w, r)
+
+	case r.Method == "GET" && r.URL.Path == "/events":
+		o.handleEvents(w, r)
+
+	case r.Method == "GET" && r.URL.Path == "/livez":
+		writeProbe(w, o.Livez())
+
+	case r.Method == "GET" && r.URL.Path == "/readyz":
+		writeProbe(w, o.Readyz())
+
+	case r.Method == "GET" && r.URL.Path == "/history":
+		o.handleHistory(w, r)
+
+	case r.Method == "GET" && r.URL.Path == "/logs":
+		o.handleLogs(w, r)
+
+	case (r.Method == "POST" || r.Method == "DELETE") && r.URL.Path == "/mirror":
+		o.handleMirror(w, r)
+
+	case strings.HasPrefix(r.URL.Path, "/debug/"):
+		o.handleDebug(w, r)
+
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/slots/"):
+		o.handleSlot(w, r)
+
+	case r.URL.Path == "/previews" || strings.HasPrefix(r.URL.Path, "/previews/"):
+		o.handlePreviews(w, r)
+
+	case (r.Method == "POST" || r.Method == "DELETE") && r.URL.Path == "/lock":
+		o.handleFreeze(w, r)
+
+	case (r.Method == "POST" || r.Method == "DELETE") && r.URL.Path == "/read-only":
+		o.handleReadOnly(w, r)
+
+	case r.Method == "GET" && r.URL.Path == "/peer":
+		o.handlePeer(w, r)
+
+	case r.Method == "POST" && r.URL.Path == "/peer/promote":
+		o.handlePromote(w, r)
+
+	case r.Method == "POST" && r.URL.Path == "/exec":
+		o.handleExec(w, r)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// --- POST /deploy ---
+
+type deployRequest struct {
+	Commit     string `json:"commit"`
+	ForceSetup bool   `json:"force_setup"`
+	Force      bool   `json:"force"` // discard uncommitted changes in slot-staging instead of keeping them
+
+	// Deploy what a ref points at instead of a commit (default: upstream),
+	// after fetching the remote if Fetch is set.
+	Ref   string `json:"ref"`
+	Fetch bool   `json:"fetch"`
+
+	// Deploy a tarball from a URL instead of a commit.
+	ArtifactURL string `json:"artifact_url"`
+	SHA256      string `json:"sha256"`
+
+	AdminToken string `json:"admin_token"` // override deploy_policy.allowed_refs
+
+	Source string `json:"source"` // "agent", "human", or "webhook" (default: "human")
+
+	Message string `json:"message"` // why, for the journal and status
+}
+
+// errHealthCheckFailed is the error reported when a new process never turns
+// healthy. pkg/client matches on it (client.ErrHealthCheckFailed), so keep the
+// two in sync.
+const errHealthCheckFailed = "health check failed"
+
+// errDeployInProgress is returned with a 409 while the app's lock is held.
+const errDeployInProgress = "deploy in progress"
+
+// DeployResponse is the body of POST /deploy.
+type DeployResponse struct {
+	Success        bool   `json:"success"`
+	Slot           string `json:"slot"`
+	Commit         string `json:"commit"`
+	PreviousCommit string `json:"previous_commit"`
+	SetupSkipped   bool   `json:"setup_skipped,omitempty"`
+	SmokeOutput    string `json:"smoke_output,omitempty"` // tail of a failed smoke_command's output
+	RolledBack     bool   `json:"rolled_back,omitempty"`  // the smoke test failed and the previous slot is live again
+	Error          string `json:"error,omitempty"`
+
+	// Set when the new slot failed its health check.
+	HealthError string `json:"health_error,omitempty"` // why, e.g. the process exited
+	LogTail     string `json:"log_tail,omitempty"`     // last lines of its output
+
+	StagingRestore *StagingRestore `json:"staging_restore,omitempty"`
+
+	// Set when the deploy didn't start: it came too soon (429), or a newer
+	// one superseded it while it waited to coalesce (409).
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
+	SupersededBy string `json:"superseded_by,omitempty"`
+
+	// Set, with a 202, when the deploy waits for approval
+	// (agent_deploy_approval).
+	Pending *PendingDeploy `json:"pending,omitempty"`
+}
+
+func (o *Orchestrator) handleDeploy(w http.ResponseWriter, r *http.Request) {
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "multipart/form-data" {
+		o.handleArtifactUpload(w, r)
+		return
+	}
+	var req deployRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Commit == "" && req.Ref == "" && !req.Fetch && req.ArtifactURL == "") {
+		writeJSON(w, 400, DeployResponse{Error: "missing commit"})
+		return
+	}
+	source, err := deploySource(req.Source)
+	if err != nil {
+		writeJSON(w, 400, DeployResponse{Error: err.Error()})
+		return
+	}
+	req.Source = source
+	if req.ArtifactURL != "" {
+		o.handleArtifactURL(w, r, req)
+		return
+	}
+	commit, code, err := o.deployCommit(req)
+	if err != nil {
+		writeJSON(w, code, DeployResponse{Error: err.Error()})
+		return
+	}
+
+	o.serveDeploy(w, r, commit, DeployOptions{ForceSetup: req.ForceSetup, Force: req.Force, AdminToken: req.AdminToken, Source: req.Source, Message: req.Message})
+}
+
+// --- POST /rollback ---
+
+// RollbackResponse is the body of POST /rollback.
+type RollbackResponse struct {
+	Success bool   `json:"success"`
+	Slot    string `json:"slot"`
+	Commit  string `json:"commit"`
+	Error   string `json:"error,omitempty"`
+
+	StagingRestore *StagingRestore `json:"staging_restore,omitempty"`
+}
+
+// rollbackRequest is the optional body of POST /rollback.
+type rollbackRequest struct {
+	Commit string `json:"commit"` // commit prefix or slot name; "" means prev
+	Force  bool   `json:"force"`  // roll back to a slot that drifted from its commit
+}
+
+func (o *Orchestrator) handleRollback(w http.ResponseWriter, r *http.Request) {
+	var req rollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSON(w, 400, RollbackResponse{Error: "invalid body"})
+		return
+	}
+	resp, code := o.RollbackWithOptions(req.Commit, RollbackOptions{Force: req.Force})
+	writeJSON(w, code, resp)
+}
+
+// --- GET /status ---
+
+// StatusResponse is the body of GET /status.
+type StatusResponse struct {
+	LiveSlot       string `json:"live_slot"`
+	LiveCommit     string `json:"live_commit"`
+	PreviousSlot   string `json:"previous_slot"`
+	PreviousCommit string `json:"previous_commit"`
+
+	// The deploy messages of the live and previous releases.
+	LiveMessage     string `json:"live_message,omitempty"`
+	PreviousMessage string `json:"previous_message,omitempty"`
+
+	StagingDir     string `json:"staging_dir"`
+	StagingDirty   bool   `json:"staging_dirty"` // uncommitted changes, stashed across deploys
+	LastDeployTime string `json:"last_deploy_time"`
+	Healthy        bool   `json:"healthy"`
+	State          string `json:"state"` // "live", "recovering", "crash-loop", "standby", or "down"
+	ProxyError     string `json:"proxy_error,omitempty"`
+
+	// Set while a deploy or rollback is running.
+	DeployingSince  string `json:"deploying_since,omitempty"`
+	DeployingCommit string `json:"deploying_commit,omitempty"`
+
+	AppTraffic      proxy.Stats `json:"app_traffic"`
+	InternalTraffic proxy.Stats `json:"internal_traffic"`
+
+	Mirror *MirrorStatus `json:"mirror,omitempty"`
+
+	// How the live slot's environment differs from the previous slot's.
+	EnvDiff []EnvChange `json:"env_diff,omitempty"`
+
+	StagingChanges WorktreeChanges `json:"staging_changes"`
+
+	Head     string  `json:"head,omitempty"`      // the repo's HEAD commit
+	Locked   *Freeze `json:"locked,omitempty"`    // set while deploys are locked
+	ReadOnly bool    `json:"read_only,omitempty"` // the API refuses changes
+
+	EnvStale bool `json:"env_stale,omitempty"` // env_file changed since the live slot started
+
+	Upstream *UpstreamStatus `json:"upstream,omitempty"` // the live commit against the upstream branch
+
+	CrashLoop *CrashLoop `json:"crash_loop,omitempty"` // set while State is "crash-loop"
+
+	Drift []SlotDrift `json:"drift,omitempty"` // slots whose files differ from their commits (drift_check)
+
+	Expose *ExposeStatus `json:"expose,omitempty"` // the tunnel expose runs
+
+	Standby *StandbyStatus `json:"standby,omitempty"` // set while standing by for a primary
+
+	PendingDeploys []PendingDeploy `json:"pending_deploys,omitempty"` // the agent's deploys waiting for approval
+
+	LiveRelease *ReleaseStatus `json:"live_release,omitempty"` // the env and config the live slot's release sets
+}
+
+func (o *Orchestrator) handleStatus(w http.ResponseWriter, r *http.Request) {
+	changes := o.StagingChanges()
+	var head string
+	if o.worktrees != nil {
+		head = o.worktrees.Commit(o.repoDir)
+	}
+	envPath, envHash := o.envFileState()
+	upstream := o.upstreamStatus(o.LiveCommit())
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	resp := StatusResponse{
+		StagingDir:     "slot-staging",
+		StagingDirty:   changes.Dirty(),
+		StagingChanges: changes,
+		State:          "down",
+		Head:           head,
+		Locked:         o.freeze,
+		ReadOnly:       o.readOnly,
+		EnvStale:       o.envStale(envPath, envHash),
+		Upstream:       upstream,
+		Drift:          o.slotDrift(),
+		PendingDeploys: o.pendingDeploys(),
+	}
+
+	switch {
+	case o.liveSlot != nil:
+		resp.LiveSlot = o.liveSlot.name
+		resp.LiveCommit = o.liveSlot.commit
+		resp.LiveMessage = o.liveSlot.message
+		resp.LiveRelease = o.liveSlot.release.status()
+		resp.Healthy = o.liveSlot.alive
+		if resp.Healthy {
+			resp.State = "live"
+		} else if o.crashLoop != nil {
+			resp.State = "crash-loop"
+			resp.CrashLoop = o.crashLoop
+		}
+	case o.recovering != nil:
+		// Report what will be live once it's up, but not as healthy.
+		resp.LiveSlot = o.recovering.name
+		resp.LiveCommit = o.recovering.commit
+		resp.LiveMessage = o.recovering.message
+		resp.LiveRelease = o.recovering.release.status()
+		resp.State = "recovering"
+	}
+	if o.tunnel != nil {
+		t := *o.tunnel
+		resp.Expose = &t
+	}
+	if o.standby != nil {
+		sb := *o.standby
+		resp.Standby = &sb
+		resp.State = "standby"
+	}
+	if o.prevSlot != nil {
+		resp.PreviousSlot = o.prevSlot.name
+		resp.PreviousCommit = o.prevSlot.commit
+		resp.PreviousMessage = o.prevSlot.message
+		live := o.liveSlot
+		if live == nil {
+			live = o.recovering
+		}
+		if live != nil {
+			resp.EnvDiff = diffEnv(live.env, o.prevSlot.env)
+		}
+	}
+	if !o.lastDeploy.IsZero() {
+		resp.LastDeployTime = o.lastDeploy.Format(time.RFC3339)
+	}
+	resp.ProxyError = o.appProxy.LastError()
+	if resp.ProxyError == "" {
+		resp.ProxyError = o.intProxy.LastError()
+	}
+	if h, ok := o.locks.Holder(o.app); ok {
+		resp.DeployingSince = h.Since.Format(time.RFC3339)
+		resp.DeployingCommit = h.Commit
+	}
+	resp.AppTraffic = o.appProxy.Stats()
+	resp.InternalTraffic = o.intProxy.Stats()
+	resp.Mirror = o.mirrorStatus()
+
+	writeJSON(w, 200, resp)
+}
+
+// --- GET /healthz ---
+
+// healthResult is one probe of the live slot's health endpoint.
+type healthResult struct {
+	port      int
+	ok        bool
+	code      int
+	err       string
+	checkedAt time.Time
+}
+
+// HealthzResponse is the body of GET /healthz.
+type HealthzResponse struct {
+	Status    string `json:"status"` // "ok", "unhealthy", "recovering", or "down"
+	Slot      string `json:"slot,omitempty"`
+	Commit    string `json:"commit,omitempty"`
+	Code      int    `json:"code,omitempty"` // the app's own status code
+	Error     string `json:"error,omitempty"`
+	CheckedAt string `json:"checked_at,omitempty"`
+	Cached    bool   `json:"cached"`
+}
+
+func (o *Orchestrator) healthCacheTTL() time.Duration {
+	return time.Duration(o.cfg.HealthCacheTTLMs) * time.Millisecond
+}
+
+// handleHealthz reports the live slot's health as last observed by the
+// daemon, probing the app only when the cached result has expired. Uptime
+// checkers can poll this without putting load on a slow app.
+func (o *Orchestrator) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	live := o.liveSlot
+	var name, commit string
+	var port int
+	alive := false
+	if live != nil {
+		name, commit, port, alive = live.name, live.commit, live.intPort, live.alive
+	} else if rec := o.recovering; rec != nil {
+		o.mu.Unlock()
+		writeJSON(w, 503, HealthzResponse{Status: "recovering", Slot: rec.name, Commit: rec.commit})
+		return
+	}
+	o.mu.Unlock()
+
+	if !alive {
+		writeJSON(w, 503, HealthzResponse{Status: "down", Slot: name, Commit: commit})
+		return
+	}
+
+	res, cached := o.probeHealth(live, port)
+	resp := HealthzResponse{
+		Status:    "ok",
+		Slot:      name,
+		Commit:    commit,
+		Code:      res.code,
+		Error:     res.err,
+		CheckedAt: res.checkedAt.Format(time.RFC3339),
+		Cached:    cached,
+	}
+	code := 200
+	if !res.ok {
+		resp.Status = "unhealthy"
+		code = 503
+	}
+	writeJSON(w, code, resp)
+}
+
+// probeHealth returns a cached result for s's port if fresh, else probes
+// it once. A change from the last probe of s is published as a "health"
+// event.
+func (o *Orchestrator) probeHealth(s *slot, port int) (healthResult, bool) {
+	o.healthMu.Lock()
+	defer o.healthMu.Unlock()
+
+	prev := o.lastHealth
+	if prev != nil && prev.port == port && time.Since(prev.checkedAt) < o.healthCacheTTL() {
+		return *prev, true
+	}
+
+	res := healthResult{port: port, checkedAt: time.Now()}
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, o.cfg.HealthEndpoint))
+	if err != nil {
+		res.err = err.Error()
+	} else {
+		resp.Body.Close()
+		res.code = resp.StatusCode
+		res.ok = resp.StatusCode == 200
+	}
+	o.lastHealth = &res
+
+	// A slot's first probe is news only if it failed.
+	if changed := prev == nil || prev.port != port; (changed && !res.ok) || (!changed && prev.ok != res.ok) {
+		status := "ok"
+		if !res.ok {
+			status = "unhealthy"
+		}
+		o.Publish(EventHealth, s.commit, s.name, HealthzResponse{Status: status, Code: res.code, Error: res.err, CheckedAt: res.checkedAt.Format(time.RFC3339)})
+	}
+	return res, false
+}
+
+// --- GET /history ---
+
+func (o *Orchestrator) handleHistory(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		fmt.Sscanf(v, "%d", &limit)
+	}
+
+	entries, err := o.readJournal()
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+
+	releases := o.releases()
+	history := make([]HistoryEntry, len(entries))
+	for i, e := range entries {
+		history[i] = HistoryEntry{JournalEntry: e, Release: releases[e.SlotDir]}
+	}
+	writeJSON(w, 200, history)
+}
+
+// HistoryEntry is a journal entry as served by GET /history. Release says
+// where the entry's slot directory stands now: "live", "prev", "retained"
+// (still on disk, so a rollback target), or "" once garbage collected.
+type HistoryEntry struct {
+	JournalEntry
+	Release string `json:"release,omitempty"`
+}
+
+// releases maps slot names still on disk to "live", "prev", or "retained".
+func (o *Orchestrator) releases() map[string]string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	m := map[string]string{}
+	for _, s := range o.retained {
+		m[s.name] = "retained"
+	}
+	if o.prevSlot != nil {
+		m[o.prevSlot.name] = "prev"
+	}
+	if o.liveSlot != nil {
+		m[o.liveSlot.name] = "live"
+	}
+	return m
+}
+
+// --- GET /logs ---
+
+// LogsResponse is the body of GET /logs.
+type LogsResponse struct {
+	Slot    string      `json:"slot"`
+	Lines   []string    `json:"lines"`
+	Records []LogRecord `json:"records,omitempty"` // for ?source=
+	Error   string      `json:"error,omitempty"`
+}
+
+func (o *Orchestrator) handleLogs(w http.ResponseWriter, r *http.Request) {
+	if id := r.URL.Query().Get("correlate"); r.URL.Query().Has("correlate") {
+		o.handleCorrelate(w, id)
+		return
+	}
+	lines := 100
+	if v := r.URL.Query().Get("lines"); v != "" {
+		fmt.Sscanf(v, "%d", &lines)
+	}
+	if source := r.URL.Query().Get("source"); source != "" {
+		o.handleMergedLogs(w, source, lines)
+		return
+	}
+
+	o.mu.Lock()
+	s := o.liveSlot
+	if r.URL.Query().Get("slot") == "prev" {
+		s = o.prevSlot
+	}
+	var name, logPath string
+	if s != nil {
+		name, logPath = s.name, s.logPath
+	}
+	o.mu.Unlock()
+
+	if logPath == "" {
+		writeJSON(w, 404, LogsResponse{Error: "no log for slot"})
+		return
+	}
+
+	tail, err := tailFile(logPath, lines)
+	if err != nil {
+		writeJSON(w, 500, LogsResponse{Slot: name, Error: err.Error()})
+		return
+	}
+	if tail == nil {
+		tail = []string{}
+	}
+	writeJSON(w, 200, LogsResponse{Slot: name, Lines: tail})
+}
+
+// ---------------------------------------------------------------------------
+// Deploy logic
+// ---------------------------------------------------------------------------
+
+// DeployOptions tweaks a single deploy.
+type DeployOptions struct {
+	ForceSetup bool         // run setup even if setup_cache_keys are unchanged
+	Force      bool         // discard slot-staging's uncommitted changes instead of stashing them
+	Artifact   string       // tarball to unpack instead of checking out; commit is then its "sha256:<hex>"
+	AdminToken string       // skips deploy_policy.allowed_refs if it's the daemon's admin token
+	Source     string       // who asked: "agent", "human", or "webhook"; "" (the daemon itself) isn't limited
+	Approved   bool         // a person asked for it or approved it, so agent_deploy_approval doesn't hold it
+	Message    string       // why, e.g. "hotfix for checkout bug": journaled and kept with the release
+	Release    *ReleaseSpec // env and config to run with instead of the live release's; nil fields are kept
+
+	// Progress, if set, is called with each step as the deploy runs.
+	Progress func(DeployProgress)
+}
+
+// Deploy checks out commit, starts it, and makes it live once healthy. The
+// int is the HTTP status to report.
+func (o *Orchestrator) Deploy(commit string) (DeployResponse, int) {
+	return o.DeployWithOptions(commit, DeployOptions{})
+}
+
+// DeployWithOptions is Deploy with per-deploy options.
+func (o *Orchestrator) DeployWithOptions(commit string, opts DeployOptions) (resp DeployResponse, code int) {
+	start := time.Now()
+	progress := deployReporter{fn: opts.Progress, start: start, publish: func(p DeployProgress) {
+		o.Publish(EventDeployProgress, commit, "", p)
+	}}
+	if p, err := o.holdDeploy(commit, opts); err != nil {
+		return DeployResponse{Commit: commit, Error: err.Error()}, 403
+	} else if p != nil {
+		return DeployResponse{Commit: commit, Pending: p, Error: "waiting for approval: approve or reject it in the chat or dashboard"}, http.StatusAccepted
+	}
+	if opts.Source != "" {
+		if newer := o.coalesceDeploy(commit); newer != "" {
+			return DeployResponse{Commit: commit, SupersededBy: newer, Error: "superseded by a newer deploy of " + ShortHash(newer)}, 409
+		}
+		if retry, reason := o.admitDeploy(opts.Source); retry > 0 {
+			return DeployResponse{Commit: commit, RetryAfterMs: retry.Milliseconds(), Error: tooSoonError(retry, reason)}, http.StatusTooManyRequests
+		}
+	}
+	release, _, ok := o.locks.TryAcquire(o.app, "deploy", commit)
+	if !ok {
+		return DeployResponse{Error: errDeployInProgress}, 409
+	}
+	defer release()
+	o.Publish(EventDeployStarted, commit, "", nil)
+	defer func() { o.publishOutcome(EventDeployFinished, commit, resp.Slot, resp.Success, resp.Error, start) }()
+
+	o.mu.Lock()
+	oldPrev := o.prevSlot
+	freeze := o.freeze
+	standby := o.standbyError()
+	o.mu.Unlock()
+	if standby != "" {
+		return DeployResponse{Error: standby}, 409
+	}
+	if freeze != nil {
+		return DeployResponse{Error: frozenError(freeze)}, http.StatusLocked
+	}
+
+	override := false
+	if opts.AdminToken != "" {
+		if !o.checkAdminToken(opts.AdminToken) {
+			return DeployResponse{Error: "invalid admin token"}, 403
+		}
+		override = true
+		fmt.Printf("deploy %s: allowed_refs overridden with the admin token\n", ShortHash(commit))
+	}
+	if reason, err := o.checkPolicy(commit, override); err != nil {
+		return DeployResponse{Error: "deploy policy: " + err.Error()}, 500
+	} else if reason != "" {
+		return DeployResponse{Error: reason}, 403
+	}
+
+	// The deploy gets a staging directory of its own, so the agent can
+	// go on working in slot-staging meanwhile. Unless it's promoted, it's
+	// removed again.
+	stagingDir, baseSetup := o.newDeployDir(commit)
+	promoted := false
+	defer func() {
+		if !promoted {
+			o.worktrees.Remove(stagingDir)
+		}
+	}()
+
+	// The new slot is set up and started with its release's config; unless
+	// it's promoted, the live one's is back.
+	o.mu.Lock()
+	rel := o.releaseFor(opts.Release)
+	liveCfg := o.releaseCfg
+	o.useRelease(rel.config())
+	o.mu.Unlock()
+	defer func() {
+		if !promoted {
+			o.mu.Lock()
+			o.useRelease(liveCfg)
+			o.mu.Unlock()
+		}
+	}()
+
+	// 1. Checkout commit (or unpack the artifact) in staging.
+	if opts.Artifact != "" {
+		progress.phase("checkout", "unpacking %s", ShortHash(commit))
+		_, limit := o.artifactLimits()
+		if err := unpackArtifact(opts.Artifact, stagingDir, limit); err != nil {
+			code := 500
+			if artifactStatus(err) == 413 {
+				code = 413
+			}
+			return DeployResponse{Error: "artifact: " + err.Error()}, code
+		}
+	} else {
+		progress.phase("checkout", "checking out %s", ShortHash(commit))
+		if err := o.worktrees.Checkout(stagingDir, commit); err != nil {
+			return DeployResponse{Error: err.Error()}, 500
+		}
+	}
+	o.applySharedDirs(stagingDir)
+
+	// 2. Run setup command.
+	appPort, intPort, err := o.slotPorts(o.retiringPorts())
+	if err != nil {
+		return DeployResponse{Error: err.Error()}, 500
+	}
+	defer o.ports.release(appPort, intPort)
+
+	// Staging was cloned from a slot that's already set up; if the lockfiles
+	// match, its dependencies are good as they are.
+	hash := o.setupHash(stagingDir)
+	skipSetup := o.cfg.SetupCommand != "" && hash != "" && hash == baseSetup && !opts.ForceSetup
+
+	if skipSetup {
+		fmt.Printf("setup skipped: %s unchanged\n", strings.Join(o.cfg.SetupCacheKeys, ", "))
+		progress.phase("setup", "skipped: %s unchanged", strings.Join(o.cfg.SetupCacheKeys, ", "))
+	} else if o.cfg.SetupCommand != "" {
+		progress.phase("setup", "running %s", o.cfg.SetupCommand)
+		out := progress.setupOutput(os.Stdout)
+		err := o.runSetup(stagingDir, rel, appPort, intPort, out)
+		out.Close()
+		if err != nil {
+			return DeployResponse{Error: "setup: " + err.Error()}, 500
+		}
+	}
+
+	// What setup left is what the slot's manifest records, before the app
+	// has a chance to write anything.
+	manifest, err := o.buildManifest(stagingDir, commit)
+	if err != nil {
+		fmt.Printf("warning: manifest: %v\n", err)
+	}
+
+	// 3. Start process with dynamic ports (in fixed_port_mode, on the
+	// app's own port once the live slot has let go of it).
+	undo := o.vacateFixedPort()
+	progress.phase("start", "starting %s", o.cfg.StartCommand)
+	newSlot, err := o.startProcess(stagingDir, commit, rel, appPort, intPort)
+	if err != nil {
+		undo()
+		return DeployResponse{Error: "start: " + err.Error()}, 500
+	}
+	newSlot.setupHash = hash
+	newSlot.message = opts.Message
+
+	// 4. Health check (old live still serving through proxy).
+	progress.phase("health", "waiting for %s (up to %dms)", o.cfg.HealthEndpoint, o.startupTimeout().Milliseconds())
+	if !o.healthCheck(newSlot, progress.healthAttempt()) {
+		reason := o.healthError(newSlot)
+		newSlot.proc.Signal(syscall.SIGKILL)
+		<-newSlot.done
+		undo()
+		f := o.reportHealthFailure(newSlot, reason)
+		return DeployResponse{Error: errHealthCheckFailed, HealthError: f.Error, LogTail: f.Log}, 200
+	}
+
+	// 5. Make sure the public ports can be bound before touching anything else.
+	// A deploy that can't take traffic is a failed deploy.
+	if err := o.EnsureProxies(); err != nil {
+		newSlot.proc.Signal(syscall.SIGKILL)
+		<-newSlot.done
+		undo()
+		return DeployResponse{Error: err.Error()}, 500
+	}
+
+	// 6. Healthy — promote.
+	slotName := fmt.Sprintf("slot-%s", ShortHash(strings.TrimPrefix(commit, artifactPrefix)))
+	progress.phase("promote", "switching traffic to %s", slotName)
+	slotDir := filepath.Join(o.dataDir, slotName)
+
+	// Retire old prev first, and drop any retained copy of this commit, so
+	// nothing else holds slotName when staging is renamed to it.
+	if oldPrev != nil {
+		o.drain(oldPrev)
+		if oldPrev.name == slotName {
+			o.worktrees.Remove(oldPrev.dir)
+		} else {
+			o.retire(oldPrev)
+		}
+	}
+	o.dropRetained(slotName)
+
+	// Rename staging → slot-<hash>.
+	// If the target already exists (re-deploy same commit), move it aside first.
+	// The old process keeps running fine — Unix doesn't invalidate open file handles on rename.
+	drainingDir := ""
+	if _, err := os.Stat(slotDir); err == nil {
+		drainingDir = slotDir + ".draining"
+		os.RemoveAll(drainingDir)
+		os.Rename(slotDir, drainingDir)
+	}
+	promoted = true
+	if err := o.worktrees.Promote(stagingDir, slotDir); err != nil {
+		// Non-fatal: process is running from stagingDir, just use that path.
+		slotDir = stagingDir
+		slotName = filepath.Base(stagingDir)
+	}
+	o.mu.Lock()
+	newSlot.dir = slotDir
+	newSlot.name = slotName
+	o.mu.Unlock()
+	o.appProxy.SetSlotInfo(newSlot.proxyInfo())
+
+	// Switch proxy to new slot.
+	oldLive := o.replaceLive()
+	o.switchTargets(appPort, intPort)
+
+	// Update state BEFORE draining — prevents crash callback from clearing proxy.
+	prevCommit := ""
+	o.mu.Lock()
+	if oldLive != nil {
+		prevCommit = oldLive.commit
+	}
+	o.prevSlot = oldLive
+	o.liveSlot = newSlot
+	o.lastDeploy = time.Now()
+	o.mu.Unlock()
+
+	// Drain old live (it was still serving until proxy switch above).
+	if oldLive != nil {
+		progress.phase("drain", "draining %s", oldLive.name)
+		o.failoverGrace(oldLive)
+		o.drain(oldLive)
+	}
+	if drainingDir != "" {
+		os.RemoveAll(drainingDir)
+	}
+
+	// Persist state, then update symlinks.
+	if err := o.saveState(); err != nil {
+		fmt.Printf("warning: saving state: %v\n", err)
+	}
+	if manifest != nil {
+		if err := o.saveManifest(manifest, slotName); err != nil {
+			fmt.Printf("warning: manifest: %v\n", err)
+			manifest = nil
+		}
+	}
+	atomicSymlink(filepath.Join(o.dataDir, "live"), slotName)
+	if oldLive != nil {
+		atomicSymlink(filepath.Join(o.dataDir, "prev"), oldLive.name)
+	}
+
+	// Replace slot-staging, the agent's workspace, with a clone of the
+	// promoted slot. What the agent hasn't committed is set aside and
+	// applied to the new one.
+	if restore, err := o.stashStaging(opts.Force); err != nil {
+		fmt.Printf("warning: leaving slot-staging as it is: stash: %v\n", err)
+	} else {
+		defer func() { resp.StagingRestore = restore() }()
+		o.createStaging(newSlot)
+	}
+
+	// 7. Smoke test the new slot now that it takes traffic.
+	var smokeOut string
+	var smokeErr error
+	if o.cfg.SmokeCommand != "" {
+		progress.phase("smoke", "running %s", o.cfg.SmokeCommand)
+		smokeOut, smokeErr = o.runSmoke(newSlot)
+	}
+
+	// Journal (best-effort).
+	entry := JournalEntry{Action: "deploy", Commit: commit, SlotDir: slotName, PrevCommit: prevCommit, DurationMs: time.Since(start).Milliseconds(), Message: opts.Message}
+	if manifest != nil {
+		entry.Manifest = manifest.Digest
+	}
+	if smokeErr != nil {
+		entry.SmokeOutput = smokeOut
+	}
+	if err := o.writeJournal(entry); err != nil {
+		fmt.Printf("warning: journal: %v\n", err)
+	}
+
+	resp = DeployResponse{
+		Success:        true,
+		Slot:           slotName,
+		Commit:         commit,
+		PreviousCommit: prevCommit,
+		SetupSkipped:   skipSetup,
+	}
+	if smokeErr != nil {
+		resp.Success = false
+		resp.SmokeOutput = smokeOut
+		return o.smokeFailed(resp, smokeErr)
+	}
+	return resp, 200
+}
+
+// defaultStickyTTL is how long an affinity cookie lasts by default.
+const defaultStickyTTL = time.Hour
+
+// applyAffinity turns slot affinity on the app proxy on or off.
+func (o *Orchestrator) applyAffinity() {
+	if !o.cfg.StickySessions {
+		o.appProxy.SetAffinity(0)
+		return
+	}
+	ttl := time.Duration(o.cfg.StickyTTLMs) * time.Millisecond
+	if ttl <= 0 {
+		ttl = defaultStickyTTL
+	}
+	o.appProxy.SetAffinity(ttl)
+}
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerOpen     = 10 * time.Second
+)
+
+// applyUpstreamLimits hands upstream_timeout_ms, path_timeouts_ms, and
+// circuit_breaker to the app proxy.
+func (o *Orchestrator) applyUpstreamLimits() {
+	paths := map[string]time.Duration{}
+	for prefix, ms := range o.cfg.PathTimeoutsMs {
+		paths[prefix] = time.Duration(ms) * time.Millisecond
+	}
+	o.appProxy.SetTimeouts(time.Duration(o.cfg.UpstreamTimeoutMs)*time.Millisecond, paths)
+
+	b := o.cfg.CircuitBreaker
+	if b == nil {
+		o.appProxy.SetBreaker(0, 0)
+		return
+	}
+	failures, open := defaultBreakerFailures, defaultBreakerOpen
+	if b.Failures > 0 {
+		failures = b.Failures
+	}
+	if b.OpenMs > 0 {
+		open = time.Duration(b.OpenMs) * time.Millisecond
+	}
+	o.appProxy.SetBreaker(failures, open)
+}
+
+// failoverGrace keeps old running as the app proxy's fallback for
+// failover_grace_ms after a switch, so requests the new slot drops while it
+// settles are answered by the old one before it's drained.
+func (o *Orchestrator) failoverGrace(old *slot) {
+	grace := time.Duration(o.cfg.FailoverGraceMs) * time.Millisecond
+	o.mu.Lock()
+	alive := old.alive
+	o.mu.Unlock()
+	if grace <= 0 || !alive {
+		return
+	}
+	o.appProxy.Failover(old.appPort, grace)
+	time.Sleep(grace)
+	o.appProxy.Failover(0, 0)
+}
+
+// replaceLive returns the slot a deploy or rollback is about to replace: the
+// live slot, or else one still recovering, which the new slot supersedes.
+// Called before switching the proxies so recovery can't switch them back.
+func (o *Orchestrator) replaceLive() *slot {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	old := o.liveSlot
+	if old == nil {
+		old = o.recovering
+	}
+	o.recovering = nil
+	o.crashes, o.crashLoop = nil, nil
+	return old
+}
+
+// EnsureProxies binds both proxy listeners, returning the first failure.
+func (o *Orchestrator) EnsureProxies() error {
+	if err := o.appProxy.EnsureListener(); err != nil {
+		return err
+	}
+	return o.intProxy.EnsureListener()
+}
+
+// ---------------------------------------------------------------------------
+// Rollback logic
+// ---------------------------------------------------------------------------
+
+// Rollback restarts the previous slot and makes it live once healthy.
+func (o *Orchestrator) Rollback() (RollbackResponse, int) {
+	return o.RollbackTo("")
+}
+
+// RollbackTo restarts a retained release and makes it live once healthy.
+// ref is a commit prefix or slot name matching prev or one of the releases
+// kept by retain_releases; "" means prev. The current live slot becomes
+// prev, and the old prev is retained in turn.
+func (o *Orchestrator) RollbackTo(ref string) (resp RollbackResponse, code int) {
+	return o.RollbackWithOptions(ref, RollbackOptions{})
+}
+
+// RollbackOptions tune RollbackWithOptions.
+type RollbackOptions struct {
+	Force bool // roll back even to a slot drift_check.block_rollback refuses
+}
+
+// RollbackWithOptions is RollbackTo with options.
+func (o *Orchestrator) RollbackWithOptions(ref string, opts RollbackOptions) (resp RollbackResponse, code int) {
+	start := time.Now()
+	// Peek at the target to label the lock; it's re-read once the lock is held.
+	label := ""
+	if s := o.findRelease(ref); s != nil {
+		label = s.commit
+	}
+
+	release, _, ok := o.locks.TryAcquire(o.app, "rollback", label)
+	if !ok {
+		return RollbackResponse{Error: errDeployInProgress}, 409
+	}
+	defer release()
+	o.Publish(EventRollbackStarted, label, "", nil)
+	defer func() {
+		o.publishOutcome(EventRollbackFinished, resp.Commit, resp.Slot, resp.Success, resp.Error, start)
+	}()
+
+	restore, err := o.stashStaging(false)
+	if err != nil {
+		return RollbackResponse{Error: "stash staging changes: " + err.Error()}, 500
+	}
+	resp, code = o.rollbackLocked(ref, opts.Force)
+	resp.StagingRestore = restore()
+	return resp, code
+}
+
+// rollbackLocked is RollbackWithOptions for a caller already holding the
+// deploy lock.
+func (o *Orchestrator) rollbackLocked(ref string, force bool) (RollbackResponse, int) {
+	start := time.Now()
+	o.mu.Lock()
+	standby := o.standbyError()
+	o.mu.Unlock()
+	if standby != "" {
+		return RollbackResponse{Error: standby}, 409
+	}
+	prev := o.findRelease(ref)
+	if prev == nil && ref == "" {
+		return RollbackResponse{Error: "no previous slot"}, 400
+	}
+	if prev == nil {
+		return RollbackResponse{Error: "no retained release matches " + ref}, 404
+	}
+	if why := o.driftBlocks(prev); why != "" && !force {
+		return RollbackResponse{Error: why}, 409
+	}
+	return o.switchToSlot(prev, "rollback", start)
+}
+
+// switchToSlot starts prev, a stopped slot that's set up, makes it live
+// once healthy, and journals it as action. The deploy lock must be held.
+func (o *Orchestrator) switchToSlot(prev *slot, action string, start time.Time) (RollbackResponse, int) {
+	// prev starts with its own release's config; if it doesn't go live,
+	// the live one's is back.
+	o.mu.Lock()
+	liveCfg := o.releaseCfg
+	o.useRelease(prev.release.config())
+	o.mu.Unlock()
+	rolledBack := false
+	defer func() {
+		if !rolledBack {
+			o.mu.Lock()
+			o.useRelease(liveCfg)
+			o.mu.Unlock()
+		}
+	}()
+
+	// Start prev slot, on its old ports if they're free.
+	appPort, intPort, err := o.slotPorts(prev.appPort, prev.intPort)
+	if err != nil {
+		return RollbackResponse{Error: err.Error()}, 500
+	}
+	defer o.ports.release(appPort, intPort)
+
+	undo := o.vacateFixedPort()
+	newSlot, err := o.startProcess(prev.dir, prev.commit, prev.release, appPort, intPort)
+	if err != nil {
+		undo()
+		return RollbackResponse{Error: "start: " + err.Error()}, 500
+	}
+	newSlot.setupHash = prev.setupHash
+	newSlot.message = prev.message
+
+	if !o.healthCheck(newSlot, nil) {
+		newSlot.proc.Signal(syscall.SIGKILL)
+		<-newSlot.done
+		undo()
+		return RollbackResponse{Error: errHealthCheckFailed}, 500
+	}
+
+	if err := o.EnsureProxies(); err != nil {
+		newSlot.proc.Signal(syscall.SIGKILL)
+		<-newSlot.done
+		undo()
+		return RollbackResponse{Error: err.Error()}, 500
+	}
+
+	// Switch proxy.
+	oldLive := o.replaceLive()
+	o.switchTargets(appPort, intPort)
+
+	// Update state BEFORE draining — prevents crash callback from clearing proxy.
+	newSlot.name = prev.name
+	o.mu.Lock()
+	oldPrev := o.prevSlot
+	o.liveSlot = newSlot
+	o.prevSlot = oldLive
+	o.lastDeploy = time.Now()
+	o.mu.Unlock()
+	rolledBack = true
+
+	// Drain old live.
+	if oldLive != nil {
+		o.failoverGrace(oldLive)
+		o.drain(oldLive)
+	}
+
+	// Rolling back past prev: the target leaves the retained list and the
+	// old prev joins it.
+	if oldPrev != prev {
+		o.takeRetained(prev.name)
+		if oldPrev != nil {
+			o.retire(oldPrev)
+		}
+	}
+
+	// Persist state, then update symlinks.
+	if err := o.saveState(); err != nil {
+		fmt.Printf("warning: saving state: %v\n", err)
+	}
+	atomicSymlink(filepath.Join(o.dataDir, "live"), prev.name)
+	if oldLive != nil {
+		atomicSymlink(filepath.Join(o.dataDir, "prev"), oldLive.name)
+	}
+
+	// Create new staging.
+	o.createStaging(newSlot)
+
+	// Journal (best-effort).
+	prevCommit := ""
+	if oldLive != nil {
+		prevCommit = oldLive.commit
+	}
+	entry := JournalEntry{Action: action, Commit: prev.commit, SlotDir: prev.name, PrevCommit: prevCommit, DurationMs: time.Since(start).Milliseconds()}
+	if err := o.writeJournal(entry); err != nil {
+		fmt.Printf("warning: journal: %v\n", err)
+	}
+
+	return RollbackResponse{
+		Success: true,
+		Slot:    prev.name,
+		Commit:  prev.commit,
+	}, 200
+}
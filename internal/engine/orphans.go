@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Each slot process runs in a process group of its own. A daemon that is
+// SIGKILLed can't stop them, and they go on holding their ports, so the
+// groups running are recorded in state.json, and the next daemon stops
+// those left over before it recovers anything. Process IDs get reused, so a
+// group is only stopped if one of its processes still runs in a slot
+// directory of this data dir.
+
+// procGroup is a slot's process group, as recorded in state.json.
+type procGroup struct {
+	PGID int    `json:"pgid"`
+	Dir  string `json:"dir"` // the slot's directory when recorded
+}
+
+// trackProcs records that s's process started (running true) or exited.
+// A start is written to state.json right away: the process may outlive the
+// daemon before the next saveState.
+func (o *Orchestrator) trackProcs(s *slot, running bool) {
+	o.stateMu.Lock()
+	defer o.stateMu.Unlock()
+	if !running {
+		delete(o.procs, s)
+		return
+	}
+	if o.procs == nil {
+		o.procs = map[*slot]bool{}
+	}
+	o.procs[s] = true
+
+	st := o.loadState()
+	if st == nil {
+		st = o.stateFromSymlinks()
+	}
+	st.Procs = o.procGroups()
+	if err := o.writeStateFile(*st); err != nil {
+		fmt.Printf("warning: recording %s's process group: %v\n", s.name, err)
+	}
+}
+
+// procGroups lists the tracked process groups, oldest first. stateMu must
+// be held.
+func (o *Orchestrator) procGroups() []procGroup {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var groups []procGroup
+	for s := range o.procs {
+		groups = append(groups, procGroup{PGID: s.pgid, Dir: s.dir})
+	}
+	slices.SortFunc(groups, func(a, b procGroup) int { return a.PGID - b.PGID })
+	return groups
+}
+
+// stopOrphans stops the process groups a previous daemon left running:
+// stop_signal to each, then SIGKILL to those still there after
+// drain_timeout_ms.
+func (o *Orchestrator) stopOrphans(groups []procGroup) {
+	var stopped []int
+	for _, g := range groups {
+		if g.PGID <= 1 || g.PGID == syscall.Getpgrp() || !o.ownsGroup(g) {
+			continue
+		}
+		fmt.Printf("stopping %s's processes (group %d), left running by the last daemon\n", filepath.Base(g.Dir), g.PGID)
+		syscall.Kill(-g.PGID, o.stopSignal())
+		stopped = append(stopped, g.PGID)
+	}
+
+	deadline := time.Now().Add(time.Duration(o.cfg.DrainTimeoutMs) * time.Millisecond)
+	for _, pgid := range stopped {
+		for syscall.Kill(-pgid, 0) == nil && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+}
+
+// ownsGroup reports whether one of g's processes runs in g's directory,
+// or in another slot's (promotion renames the directory under it).
+// slot-staging is the agent's, never a slot process's.
+func (o *Orchestrator) ownsGroup(g procGroup) bool {
+	dataDir, err := filepath.EvalSymlinks(o.dataDir)
+	if err != nil {
+		return false
+	}
+	dir, _ := filepath.EvalSymlinks(g.Dir)
+	for _, pid := range groupMembers(g.PGID) {
+		cwd := processCwd(pid)
+		if cwd == "" {
+			continue
+		}
+		if cwd == dir {
+			return true
+		}
+		rel, err := filepath.Rel(dataDir, cwd)
+		if err != nil {
+			continue
+		}
+		top, _, _ := strings.Cut(rel, string(filepath.Separator))
+		if strings.HasPrefix(top, "slot-") && top != "slot-staging" {
+			return true
+		}
+	}
+	return false
+}
+
+// groupMembers lists the processes in process group pgid.
+func groupMembers(pgid int) []int {
+	out, err := exec.Command("ps", "-A", "-o", "pid=", "-o", "pgid=").Output()
+	if err != nil {
+		return nil
+	}
+	var pids []int
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+		pid, err1 := strconv.Atoi(f[0])
+		group, err2 := strconv.Atoi(f[1])
+		if err1 == nil && err2 == nil && group == pgid {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// processCwd returns pid's working directory, or "" if it can't be read:
+// from /proc on Linux, from lsof elsewhere.
+func processCwd(pid int) string {
+	if cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid)); err == nil {
+		return cwd
+	}
+	out, err := exec.Command("lsof", "-a", "-p", strconv.Itoa(pid), "-d", "cwd", "-Fn").Output()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if cwd, ok := strings.CutPrefix(line, "n"); ok {
+			return cwd
+		}
+	}
+	return ""
+}
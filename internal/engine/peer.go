@@ -0,0 +1,366 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// For a second box standing by for the first: with peer.primary set, the
+// daemon starts as a standby. It runs no app. Every peer.poll_sec it asks
+// the primary's GET /peer for the journal entries it hasn't got and for the
+// live and previous slots, appends the entries to its own journal, and
+// keeps a warm checkout of the live release: the commit, fetched from the
+// remote if the repo doesn't have it, checked out in the slot's directory
+// and set up with the release's env and config, ready to start. A standby
+// refuses deploys and rollbacks. When the primary is lost, POST
+// /peer/promote starts the warm slot, and once it's healthy makes it live,
+// and the daemon is a primary from then on: it stops following, and
+// state.json remembers it across restarts. Moving traffic to it (DNS, a
+// floating IP) is up to whoever promotes it. It's not HA: nothing fails
+// over by itself, and nothing stops both daemons being primaries.
+//
+// Release env overrides are often secrets, so GET /peer only includes their
+// values for a caller with the admin token; both daemons need the same
+// SLOT_MACHINE_ADMIN_TOKEN for a release with env to be warmed.
+
+const (
+	defaultPeerPoll = 10 * time.Second
+	peerTimeout     = 10 * time.Second
+)
+
+// Peer makes the daemon a standby for another one.
+type Peer struct {
+	Primary string `json:"primary"`  // the primary daemon's API, e.g. "http://10.0.0.1:9100"
+	PollSec int    `json:"poll_sec"` // seconds between syncs (default: 10)
+}
+
+// StandbyStatus is the "standby" field of GET /status, set while the
+// daemon stands by for a primary.
+type StandbyStatus struct {
+	Primary       string `json:"primary"`
+	LastSync      string `json:"last_sync,omitempty"`      // RFC3339
+	Error         string `json:"error,omitempty"`          // why the last sync failed
+	PrimaryCommit string `json:"primary_commit,omitempty"` // live on the primary
+	WarmSlot      string `json:"warm_slot,omitempty"`      // checked out and set up, for promote
+	WarmCommit    string `json:"warm_commit,omitempty"`
+}
+
+// peerSnapshot is the body of GET /peer: what a standby replicates.
+type peerSnapshot struct {
+	Live    *slotState     `json:"live,omitempty"`
+	Prev    *slotState     `json:"prev,omitempty"`
+	Journal []JournalEntry `json:"journal"` // the entries past ?after=
+	Entries int            `json:"entries"` // in the whole journal
+
+	EnvWithheld bool `json:"env_withheld,omitempty"` // release env left out: no admin token
+}
+
+// CheckPeer validates peer.
+func CheckPeer(cfg Config) error {
+	p := cfg.Peer
+	if p == nil {
+		return nil
+	}
+	u, err := url.Parse(p.Primary)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("peer.primary must be the primary daemon's API URL, like http://10.0.0.1:9100, not %q", p.Primary)
+	}
+	if p.PollSec < 0 {
+		return fmt.Errorf("peer.poll_sec must not be negative")
+	}
+	return nil
+}
+
+// Standby reports whether the daemon stands by for a primary.
+func (o *Orchestrator) Standby() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.standby != nil
+}
+
+// standbyError is the error for a deploy or rollback refused by a standby.
+// o.mu must be held; it's "" if the daemon isn't one.
+func (o *Orchestrator) standbyError() string {
+	if o.standby == nil {
+		return ""
+	}
+	return "standing by for " + o.standby.Primary + "; promote this daemon first"
+}
+
+// --- GET /peer ---
+
+func (o *Orchestrator) handlePeer(w http.ResponseWriter, r *http.Request) {
+	after, _ := strconv.Atoi(r.URL.Query().Get("after"))
+	entries, err := o.readJournal()
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	snap := peerSnapshot{Entries: len(entries), Journal: []JournalEntry{}}
+	if after >= 0 && after < len(entries) {
+		snap.Journal = entries[after:]
+	}
+	o.mu.Lock()
+	live := o.liveSlot
+	if live == nil {
+		live = o.recovering
+	}
+	snap.Live = newSlotState(live)
+	snap.Prev = newSlotState(o.prevSlot)
+	o.mu.Unlock()
+	if !o.checkAdminToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+		for _, s := range []*slotState{snap.Live, snap.Prev} {
+			if s != nil && s.Release != nil && len(s.Release.Env) > 0 {
+				s.Release = &ReleaseSpec{Config: s.Release.Config}
+				snap.EnvWithheld = true
+			}
+		}
+	}
+	writeJSON(w, 200, snap)
+}
+
+// --- Following the primary ---
+
+// FollowPrimary syncs with the primary every peer.poll_sec until the daemon
+// is promoted or stops. It returns at once unless the daemon is a standby.
+func (o *Orchestrator) FollowPrimary() {
+	o.mu.Lock()
+	standby := o.standby != nil
+	poll := defaultPeerPoll
+	if p := o.cfg.Peer; p != nil && p.PollSec > 0 {
+		poll = time.Duration(p.PollSec) * time.Second
+	}
+	o.mu.Unlock()
+	if !standby {
+		return
+	}
+	for {
+		if err := o.syncPeer(); err != nil {
+			fmt.Printf("warning: standby: %v\n", err)
+		}
+		time.Sleep(poll)
+		o.mu.Lock()
+		done := o.stopping || o.standby == nil
+		o.mu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+// syncPeer replicates the primary's journal and warms its live release.
+func (o *Orchestrator) syncPeer() error {
+	err := o.syncPeerOnce()
+	o.mu.Lock()
+	if o.standby != nil {
+		o.standby.LastSync = time.Now().Format(time.RFC3339)
+		o.standby.Error = ""
+		if err != nil {
+			o.standby.Error = err.Error()
+		}
+	}
+	o.mu.Unlock()
+	return err
+}
+
+func (o *Orchestrator) syncPeerOnce() error {
+	o.mu.Lock()
+	if o.standby == nil {
+		o.mu.Unlock()
+		return nil
+	}
+	primary := strings.TrimSuffix(o.standby.Primary, "/")
+	o.mu.Unlock()
+
+	have, err := o.readJournal()
+	if err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+	snap, err := fetchPeerSnapshot(primary, o.adminToken, len(have))
+	if err != nil {
+		return err
+	}
+	if snap.Entries < len(have) {
+		return fmt.Errorf("the primary's journal has %d entries, fewer than the %d replicated here", snap.Entries, len(have))
+	}
+	for _, e := range snap.Journal {
+		if err := o.appendJournalEntry(e); err != nil {
+			return fmt.Errorf("journal: %w", err)
+		}
+	}
+
+	o.mu.Lock()
+	if o.standby != nil && snap.Live != nil {
+		o.standby.PrimaryCommit = snap.Live.Commit
+	}
+	warm := o.warm
+	o.mu.Unlock()
+	if snap.Live == nil || (warm != nil && warm.commit == snap.Live.Commit && reflect.DeepEqual(warm.release, snap.Live.Release)) {
+		return nil
+	}
+	if snap.EnvWithheld {
+		return errors.New("the primary withheld its live release's env: give both daemons the same SLOT_MACHINE_ADMIN_TOKEN")
+	}
+	return o.warmUp(snap.Live)
+}
+
+// fetchPeerSnapshot gets GET /peer from primary, with the journal entries
+// past the first after, and the release env if token is its admin token.
+func fetchPeerSnapshot(primary, token string, after int) (*peerSnapshot, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/peer?after=%d", primary, after), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: peerTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("primary unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("primary answered GET /peer with %s", resp.Status)
+	}
+	var snap peerSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("decoding the primary's GET /peer: %w", err)
+	}
+	return &snap, nil
+}
+
+// warmUp checks out live, the primary's live slot, and sets it up, as the
+// slot promote starts.
+func (o *Orchestrator) warmUp(live *slotState) error {
+	if isArtifact(live.Commit) {
+		return fmt.Errorf("the primary's live release is an artifact (%s), which a standby can't check out", ShortHash(live.Commit))
+	}
+	release, holder, ok := o.locks.TryAcquire(o.app, "standby sync", live.Commit)
+	if !ok {
+		return fmt.Errorf("%s in progress", holder.Action)
+	}
+	defer release()
+
+	o.mu.Lock()
+	old := o.warm
+	standby := o.standby != nil
+	o.mu.Unlock()
+	if !standby {
+		return nil // promoted meanwhile
+	}
+	dir := filepath.Join(o.dataDir, live.Name)
+	if old != nil && old.dir != dir {
+		o.worktrees.Remove(old.dir)
+	}
+	fmt.Printf("standby: warming %s (%s)\n", live.Name, ShortHash(live.Commit))
+
+	if err := o.worktrees.Checkout(dir, live.Commit); err != nil {
+		// The primary may have deployed a commit nobody pushed here yet.
+		if ferr := o.fetchRemote(o.remoteName()); ferr != nil {
+			return fmt.Errorf("checkout %s: %v; %v", ShortHash(live.Commit), err, ferr)
+		}
+		if err := o.worktrees.Checkout(dir, live.Commit); err != nil {
+			return fmt.Errorf("checkout %s: %w", ShortHash(live.Commit), err)
+		}
+	}
+	o.applySharedDirs(dir)
+
+	// Set up with the release's config, as the primary did.
+	o.mu.Lock()
+	liveCfg := o.releaseCfg
+	o.useRelease(live.Release.config())
+	setup := o.cfg.SetupCommand
+	o.mu.Unlock()
+	defer func() {
+		o.mu.Lock()
+		o.useRelease(liveCfg)
+		o.mu.Unlock()
+	}()
+	if setup != "" {
+		appPort, intPort, err := o.reservePorts(0, 0)
+		if err != nil {
+			return err
+		}
+		defer o.ports.release(appPort, intPort)
+		if err := o.runSetup(dir, live.Release, appPort, intPort, os.Stdout); err != nil {
+			return fmt.Errorf("setup of %s: %w", live.Name, err)
+		}
+	}
+
+	o.recordManifest(dir, live.Commit)
+
+	s := o.stoppedSlot(&slotState{Name: live.Name, Commit: live.Commit, SetupHash: o.setupHash(dir), Message: live.Message, Release: live.Release})
+	if s == nil {
+		return errors.New(live.Name + " is gone")
+	}
+	o.mu.Lock()
+	o.warm = s
+	if o.standby != nil {
+		o.standby.WarmSlot, o.standby.WarmCommit = s.name, s.commit
+	}
+	o.mu.Unlock()
+	if err := o.saveState(); err != nil {
+		fmt.Printf("warning: saving state: %v\n", err)
+	}
+	fmt.Printf("standby: %s (%s) is warm\n", live.Name, ShortHash(live.Commit))
+	return nil
+}
+
+// --- POST /peer/promote ---
+
+func (o *Orchestrator) handlePromote(w http.ResponseWriter, r *http.Request) {
+	resp, code := o.Promote()
+	writeJSON(w, code, resp)
+}
+
+// Promote makes a standby the primary: it starts the warm slot and, once
+// it's healthy, makes it live and stops following the old primary.
+func (o *Orchestrator) Promote() (resp RollbackResponse, code int) {
+	start := time.Now()
+	o.mu.Lock()
+	standby, warm := o.standby != nil, o.warm
+	o.mu.Unlock()
+	switch {
+	case !standby:
+		return RollbackResponse{Error: "this daemon isn't a standby"}, 400
+	case warm == nil:
+		return RollbackResponse{Error: "nothing is warm yet: the standby hasn't synced the primary's live release"}, 409
+	}
+
+	release, holder, ok := o.locks.TryAcquire(o.app, "promote", warm.commit)
+	if !ok {
+		return RollbackResponse{Error: holder.Action + " in progress"}, 409
+	}
+	defer release()
+	o.Publish(EventPromoteStarted, warm.commit, "", nil)
+	defer func() {
+		o.publishOutcome(EventPromoteFinished, resp.Commit, resp.Slot, resp.Success, resp.Error, start)
+	}()
+
+	o.mu.Lock()
+	warm = o.warm
+	o.mu.Unlock()
+	resp, code = o.switchToSlot(warm, "promote", start)
+	if !resp.Success {
+		return resp, code
+	}
+	o.mu.Lock()
+	primary := o.standby.Primary
+	o.standby, o.warm, o.promoted = nil, nil, true
+	o.mu.Unlock()
+	if err := o.saveState(); err != nil {
+		fmt.Printf("warning: saving state: %v\n", err)
+	}
+	fmt.Printf("promoted: this daemon is the primary now, instead of %s; remove peer from the config\n", primary)
+	return resp, code
+}
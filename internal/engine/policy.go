@@ -0,0 +1,164 @@
+package engine
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// DeployPolicy restricts which commits may be deployed. With AllowedRefs
+// set, a commit must be reachable from one of them unless the deploy carries
+// the admin token. Then, if AllowedKeys or AllowedAuthors is set, it must
+// carry a good signature from one of AllowedKeys or have its author email in
+// AllowedAuthors. With all lists empty, anything goes.
+type DeployPolicy struct {
+	AllowedRefs    []string `json:"allowed_refs"`    // branches or other refs, e.g. "main"
+	AllowedKeys    []string `json:"allowed_keys"`    // GPG fingerprints or long key IDs, or SSH "SHA256:..." fingerprints
+	AllowedAuthors []string `json:"allowed_authors"` // author emails
+}
+
+func (p *DeployPolicy) enabled() bool {
+	return p != nil && (len(p.AllowedRefs) > 0 || len(p.AllowedKeys) > 0 || len(p.AllowedAuthors) > 0)
+}
+
+// CommitVerifier checks a commit's signature and ancestry.
+type CommitVerifier interface {
+	Verify(commit string) (CommitSignature, error)
+	// Reachable reports whether commit is ref or one of its ancestors.
+	Reachable(commit, ref string) (bool, error)
+}
+
+// CommitSignature is what a CommitVerifier found out about a commit.
+type CommitSignature struct {
+	AuthorEmail string
+	Signed      bool     // the signature checked out
+	Keys        []string // fingerprints of the signing key (subkey and primary), when signed
+	Detail      string   // why the signature didn't check out, if it didn't
+}
+
+// gitVerifier implements CommitVerifier with git verify-commit, so it uses
+// the repo's gpg and gpg.ssh.allowedSignersFile settings.
+type gitVerifier struct {
+	repoDir string
+}
+
+func (g gitVerifier) Verify(commit string) (CommitSignature, error) {
+	var sig CommitSignature
+	out, err := exec.Command("git", "-C", g.repoDir, "show", "-s", "--format=%ae%x00%GF%x00%GP", commit).Output()
+	if err != nil {
+		return sig, fmt.Errorf("git show %s: %w", commit, err)
+	}
+	fields := strings.Split(strings.TrimSpace(string(out)), "\x00")
+	sig.AuthorEmail = fields[0]
+
+	out, err = exec.Command("git", "-C", g.repoDir, "verify-commit", commit).CombinedOutput()
+	if err != nil {
+		sig.Detail, _, _ = strings.Cut(strings.TrimSpace(string(out)), "\n")
+		return sig, nil
+	}
+	sig.Signed = true
+	for _, k := range fields[1:] {
+		if k != "" {
+			sig.Keys = append(sig.Keys, k)
+		}
+	}
+	return sig, nil
+}
+
+func (g gitVerifier) Reachable(commit, ref string) (bool, error) {
+	out, err := exec.Command("git", "-C", g.repoDir, "merge-base", "--is-ancestor", commit, ref).CombinedOutput()
+	if err == nil {
+		return true, nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return false, fmt.Errorf("git merge-base %s %s: %s", commit, ref, strings.TrimSpace(string(out)))
+}
+
+// checkAdminToken reports whether token is the daemon's admin token. With
+// no admin token configured, nothing matches.
+func (o *Orchestrator) checkAdminToken(token string) bool {
+	return o.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(o.adminToken)) == 1
+}
+
+// checkPolicy returns why commit may not be deployed, or "" if it may.
+// override skips the allowed_refs rule.
+func (o *Orchestrator) checkPolicy(commit string, override bool) (reason string, err error) {
+	p := o.cfg.DeployPolicy
+	if !p.enabled() {
+		return "", nil
+	}
+	if len(p.AllowedRefs) > 0 && !override {
+		onRef := false
+		if !isArtifact(commit) {
+			for _, ref := range p.AllowedRefs {
+				if onRef, err = o.verifier.Reachable(commit, ref); err != nil {
+					return "", err
+				}
+				if onRef {
+					break
+				}
+			}
+		}
+		if !onRef {
+			return fmt.Sprintf("deploy policy: %s is not on an allowed ref (%s); deploying it anyway needs the admin token",
+				ShortHash(commit), strings.Join(p.AllowedRefs, ", ")), nil
+		}
+	}
+	if len(p.AllowedKeys) == 0 && len(p.AllowedAuthors) == 0 {
+		return "", nil
+	}
+	if isArtifact(commit) {
+		return "deploy policy: artifacts carry no signature or author to check", nil
+	}
+	sig, err := o.verifier.Verify(commit)
+	if err != nil {
+		return "", err
+	}
+
+	var why []string
+	if len(p.AllowedKeys) > 0 {
+		switch {
+		case sig.Signed && slices.ContainsFunc(sig.Keys, func(k string) bool { return keyAllowed(p.AllowedKeys, k) }):
+			return "", nil
+		case sig.Signed:
+			why = append(why, fmt.Sprintf("signed by %s, which is not an allowed key", strings.Join(sig.Keys, "/")))
+		case sig.Detail != "":
+			why = append(why, "signature not verified: "+sig.Detail)
+		default:
+			why = append(why, "not signed")
+		}
+	}
+	if len(p.AllowedAuthors) > 0 {
+		if slices.ContainsFunc(p.AllowedAuthors, func(a string) bool { return strings.EqualFold(a, sig.AuthorEmail) }) {
+			return "", nil
+		}
+		why = append(why, fmt.Sprintf("author %s is not allowed", sig.AuthorEmail))
+	}
+	return fmt.Sprintf("deploy policy: commit %s rejected: %s", ShortHash(commit), strings.Join(why, "; ")), nil
+}
+
+// keyAllowed matches a signing key fingerprint against the allowlist. GPG
+// entries may be a full fingerprint or a long key ID (its last 16 hex
+// digits), with any case or spacing; SSH fingerprints must match exactly.
+func keyAllowed(allowed []string, key string) bool {
+	for _, a := range allowed {
+		if strings.HasPrefix(a, "SHA256:") {
+			if a == key {
+				return true
+			}
+			continue
+		}
+		a = strings.ToUpper(strings.ReplaceAll(a, " ", ""))
+		k := strings.ToUpper(key)
+		if len(a) >= 16 && strings.HasSuffix(k, a) {
+			return true
+		}
+	}
+	return false
+}
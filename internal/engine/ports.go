@@ -0,0 +1,156 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+)
+
+// A slot's ports used to be picked by binding port 0 and closing the
+// listener, and the app binds them only once setup is done, which can take
+// minutes: time enough for something else to take them. So the daemon
+// keeps the ports it hands out bound until just before the slot's process
+// starts. And a slot gets the ports it had before whenever they're free:
+// the live slot when the daemon restarts, a release rolled back to, and a
+// deploy those of the previous slot it's about to retire, so releases take
+// turns on two pairs of ports. Clients or caches holding an absolute URL
+// with the app's port see few of them.
+//
+// Behind a firewall that only opens some ports, slot_port_range keeps them
+// all within [low, high]. Free ports are then looked for in turn from
+// where the last one was found, wrapping around, skipping those bound or
+// held, and port and internal_port.
+
+// portHolds keeps the listeners of the ports handed out to slots that
+// haven't started yet.
+type portHolds struct {
+	mu   sync.Mutex
+	lns  map[int]net.Listener
+	next int // where to look first within the range
+}
+
+// portRange limits the ports reserve hands out; the zero value is any
+// port the kernel picks.
+type portRange struct {
+	low, high int
+	skip      []int // never handed out: the proxies' ports
+}
+
+func (r portRange) contains(port int) bool {
+	return r.low == 0 || (port >= r.low && port <= r.high && !slices.Contains(r.skip, port))
+}
+
+// CheckSlotPortRange validates slot_port_range.
+func CheckSlotPortRange(cfg Config) error {
+	r := cfg.SlotPortRange
+	if r == nil {
+		return nil
+	}
+	if len(r) != 2 || r[0] < 1 || r[0] > r[1] || r[1] > 65535 {
+		return fmt.Errorf("slot_port_range must be [low, high] with 1 <= low <= high <= 65535, not %v", r)
+	}
+	return nil
+}
+
+// reserve binds port, or a free port in r if it's 0, taken, or outside r,
+// and keeps it bound until release.
+func (h *portHolds) reserve(port int, r portRange) (int, error) {
+	var ln net.Listener
+	if port > 0 && r.contains(port) {
+		ln, _ = listenLocal(port)
+	}
+	if ln == nil {
+		var err error
+		if ln, err = h.free(r); err != nil {
+			return 0, err
+		}
+	}
+	port = ln.Addr().(*net.TCPAddr).Port
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lns == nil {
+		h.lns = map[int]net.Listener{}
+	}
+	h.lns[port] = ln
+	return port, nil
+}
+
+// free binds a free port in r.
+func (h *portHolds) free(r portRange) (net.Listener, error) {
+	if r.low == 0 {
+		return listenLocal(0)
+	}
+	h.mu.Lock()
+	start := h.next
+	h.mu.Unlock()
+	size := r.high - r.low + 1
+	if start < r.low || start > r.high {
+		start = r.low
+	}
+	for i := range size {
+		port := r.low + (start-r.low+i)%size
+		if !r.contains(port) {
+			continue
+		}
+		if ln, err := listenLocal(port); err == nil {
+			h.mu.Lock()
+			h.next = port + 1
+			h.mu.Unlock()
+			return ln, nil
+		}
+	}
+	return nil, fmt.Errorf("slot_port_range %d-%d: all %d ports are in use", r.low, r.high, size)
+}
+
+// listenLocal binds port on loopback.
+func listenLocal(port int) (net.Listener, error) {
+	return net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+}
+
+// release lets go of ports, so the app can bind them. Ports not held are
+// ignored.
+func (h *portHolds) release(ports ...int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, port := range ports {
+		if ln := h.lns[port]; ln != nil {
+			ln.Close()
+			delete(h.lns, port)
+		}
+	}
+}
+
+// reservePorts reserves an app and an internal port for a slot, preferring
+// appPort and intPort (0 for any). Release them with o.ports.release;
+// startProcess does.
+func (o *Orchestrator) reservePorts(appPort, intPort int) (int, int, error) {
+	o.mu.Lock()
+	var r portRange
+	if pr := o.cfg.SlotPortRange; len(pr) == 2 {
+		r = portRange{low: pr[0], high: pr[1], skip: []int{o.cfg.Port, o.cfg.InternalPort, o.cfg.TLSPort}}
+	}
+	o.mu.Unlock()
+
+	app, err := o.ports.reserve(appPort, r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("free port: %w", err)
+	}
+	internal, err := o.ports.reserve(intPort, r)
+	if err != nil {
+		o.ports.release(app)
+		return 0, 0, fmt.Errorf("free port: %w", err)
+	}
+	return app, internal, nil
+}
+
+// retiringPorts returns the ports of the previous slot, which a deploy is
+// about to retire, for the new slot to reuse.
+func (o *Orchestrator) retiringPorts() (appPort, intPort int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.prevSlot == nil {
+		return 0, 0
+	}
+	return o.prevSlot.appPort, o.prevSlot.intPort
+}
@@ -0,0 +1,321 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Previews boot a branch in its own preview-<name> directory, outside the
+// live/prev/staging rotation, and the app proxy routes <name>.<preview_domain>
+// to it. They expire after a TTL and don't survive a daemon restart.
+
+const defaultPreviewTTL = 24 * time.Hour
+
+type preview struct {
+	name    string
+	ref     string
+	host    string
+	slot    *slot
+	created time.Time
+	expires time.Time
+	timer   *time.Timer
+}
+
+// PreviewInfo describes a preview in the /previews API.
+type PreviewInfo struct {
+	Name      string `json:"name"`
+	Ref       string `json:"ref"`
+	Commit    string `json:"commit"`
+	Host      string `json:"host"`
+	Alive     bool   `json:"alive"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at"`
+	Error     string `json:"error,omitempty"`
+}
+
+type previewRequest struct {
+	Ref   string `json:"ref"`
+	TTLMs int    `json:"ttl_ms"` // default: preview_ttl_ms
+}
+
+// previewName turns a ref into a DNS label: "feature/X_1" → "feature-x-1".
+func previewName(ref string) string {
+	ref = strings.TrimPrefix(ref, "refs/heads/")
+	var b strings.Builder
+	for _, c := range strings.ToLower(ref) {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('-')
+		}
+	}
+	name := b.String()
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return strings.Trim(name, "-")
+}
+
+func (o *Orchestrator) previewTTL() time.Duration {
+	if o.cfg.PreviewTTLMs > 0 {
+		return time.Duration(o.cfg.PreviewTTLMs) * time.Millisecond
+	}
+	return defaultPreviewTTL
+}
+
+func (o *Orchestrator) handlePreviews(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/previews"), "/")
+	name, sub, _ := strings.Cut(rest, "/")
+
+	switch {
+	case rest == "" && r.Method == "GET":
+		writeJSON(w, 200, o.Previews())
+
+	case rest == "" && r.Method == "POST":
+		var req previewRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Ref == "" {
+			writeJSON(w, 400, PreviewInfo{Error: "missing ref"})
+			return
+		}
+		ttl := time.Duration(req.TTLMs) * time.Millisecond
+		info, code := o.StartPreview(req.Ref, ttl)
+		writeJSON(w, code, info)
+
+	case sub == "" && r.Method == "GET":
+		for _, p := range o.Previews() {
+			if p.Name == name {
+				writeJSON(w, 200, p)
+				return
+			}
+		}
+		writeJSON(w, 404, PreviewInfo{Error: "no preview named " + name})
+
+	case sub == "" && r.Method == "DELETE":
+		switch code := o.StopPreview(name); code {
+		case 404:
+			writeJSON(w, 404, PreviewInfo{Error: "no preview named " + name})
+		case 409:
+			writeJSON(w, 409, PreviewInfo{Error: errDeployInProgress})
+		default:
+			writeJSON(w, code, PreviewInfo{Name: name})
+		}
+
+	case sub == "logs" && r.Method == "GET":
+		o.handlePreviewLogs(w, r, name)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handlePreviewLogs serves a preview's output. The log outlives the
+// preview, so a failed or expired one can still be inspected.
+func (o *Orchestrator) handlePreviewLogs(w http.ResponseWriter, r *http.Request, name string) {
+	lines := 100
+	if v := r.URL.Query().Get("lines"); v != "" {
+		fmt.Sscanf(v, "%d", &lines)
+	}
+	slotName := "preview-" + previewName(name)
+	tail, err := tailFile(filepath.Join(o.dataDir, slotName+".log"), lines)
+	if os.IsNotExist(err) {
+		writeJSON(w, 404, LogsResponse{Error: "no log for preview " + name})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 500, LogsResponse{Slot: slotName, Error: err.Error()})
+		return
+	}
+	if tail == nil {
+		tail = []string{}
+	}
+	writeJSON(w, 200, LogsResponse{Slot: slotName, Lines: tail})
+}
+
+// StartPreview boots ref and routes its subdomain to it once healthy. A
+// running preview of the same branch is replaced. ttl 0 means
+// preview_ttl_ms.
+func (o *Orchestrator) StartPreview(ref string, ttl time.Duration) (PreviewInfo, int) {
+	name := previewName(ref)
+	if name == "" {
+		return PreviewInfo{Error: "ref has no usable name: " + ref}, 400
+	}
+
+	if err := o.errFixedPort("a preview"); err != nil {
+		return PreviewInfo{Name: name, Error: err.Error()}, 400
+	}
+
+	release, _, ok := o.locks.TryAcquire(o.app, "preview", ref)
+	if !ok {
+		return PreviewInfo{Name: name, Error: errDeployInProgress}, 409
+	}
+	defer release()
+
+	domain := o.cfg.PreviewDomain
+	if domain == "" {
+		return PreviewInfo{Error: "preview_domain is not set"}, 400
+	}
+	if ttl <= 0 {
+		ttl = o.previewTTL()
+	}
+
+	o.mu.Lock()
+	old := o.previews[name]
+	o.mu.Unlock()
+	if old != nil {
+		o.removePreview(old)
+	}
+
+	dir := filepath.Join(o.dataDir, "preview-"+name)
+	if err := o.worktrees.Checkout(dir, ref); err != nil {
+		return PreviewInfo{Name: name, Ref: ref, Error: err.Error()}, 500
+	}
+	commit := o.worktrees.Commit(dir)
+	if commit == "" {
+		commit = ref
+	}
+
+	o.mu.Lock()
+	rel := o.releaseFor(nil) // the live release's env and config
+	o.mu.Unlock()
+	appPort, intPort, err := o.reservePorts(0, 0)
+	if err != nil {
+		return PreviewInfo{Name: name, Error: err.Error()}, 500
+	}
+	defer o.ports.release(appPort, intPort)
+	if o.cfg.SetupCommand != "" {
+		if err := o.runSetup(dir, rel, appPort, intPort, os.Stdout); err != nil {
+			return PreviewInfo{Name: name, Ref: ref, Commit: commit, Error: "setup: " + err.Error()}, 500
+		}
+	}
+	s, err := o.startProcess(dir, commit, rel, appPort, intPort, "SLOT_MACHINE_PREVIEW="+name)
+	if err != nil {
+		return PreviewInfo{Name: name, Ref: ref, Commit: commit, Error: "start: " + err.Error()}, 500
+	}
+	if !o.healthCheck(s, nil) {
+		s.proc.Signal(syscall.SIGKILL)
+		<-s.done
+		o.worktrees.Remove(dir)
+		return PreviewInfo{Name: name, Ref: ref, Commit: commit, Error: errHealthCheckFailed}, 500
+	}
+
+	now := time.Now()
+	p := &preview{
+		name:    name,
+		ref:     ref,
+		host:    name + "." + strings.TrimPrefix(domain, "."),
+		slot:    s,
+		created: now,
+		expires: now.Add(ttl),
+	}
+	p.timer = time.AfterFunc(ttl, func() { o.expirePreview(p) })
+
+	o.mu.Lock()
+	if o.previews == nil {
+		o.previews = map[string]*preview{}
+	}
+	o.previews[name] = p
+	info := p.info()
+	o.mu.Unlock()
+	o.appProxy.Route(p.host, appPort)
+
+	return info, 200
+}
+
+// StopPreview removes a preview now. It reports 404 if there is none and
+// 409 while a deploy or another preview operation runs.
+func (o *Orchestrator) StopPreview(name string) int {
+	release, _, ok := o.locks.TryAcquire(o.app, "preview", "")
+	if !ok {
+		return 409
+	}
+	defer release()
+
+	o.mu.Lock()
+	p := o.previews[previewName(name)]
+	o.mu.Unlock()
+	if p == nil {
+		return 404
+	}
+	o.removePreview(p)
+	return 200
+}
+
+// Previews lists the running previews by name.
+func (o *Orchestrator) Previews() []PreviewInfo {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	list := []PreviewInfo{}
+	for _, p := range o.previews {
+		list = append(list, p.info())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// previewRetry is how long an expired preview waits when a deploy holds
+// the lock.
+const previewRetry = time.Minute
+
+// expirePreview removes p when its TTL runs out.
+func (o *Orchestrator) expirePreview(p *preview) {
+	release, _, ok := o.locks.TryAcquire(o.app, "preview", "")
+	if !ok {
+		p.timer.Reset(previewRetry)
+		return
+	}
+	defer release()
+	o.removePreview(p)
+}
+
+// removePreview unroutes and stops p and deletes its checkout. The log is
+// kept.
+func (o *Orchestrator) removePreview(p *preview) {
+	p.timer.Stop()
+	o.mu.Lock()
+	if o.previews[p.name] != p {
+		o.mu.Unlock()
+		return
+	}
+	delete(o.previews, p.name)
+	host := p.host
+	o.mu.Unlock()
+
+	o.appProxy.Route(host, 0)
+	o.drain(p.slot)
+	o.worktrees.Remove(p.slot.dir)
+}
+
+// applyPreviewDomain reserves preview_domain on the app proxy and moves any
+// running previews onto it. Caller holds o.mu.
+func (o *Orchestrator) applyPreviewDomain() {
+	domain := strings.TrimPrefix(o.cfg.PreviewDomain, ".")
+	o.appProxy.RouteDomain(domain)
+	if domain == "" {
+		return
+	}
+	for _, p := range o.previews {
+		o.appProxy.Route(p.host, 0)
+		p.host = p.name + "." + domain
+		o.appProxy.Route(p.host, p.slot.appPort)
+	}
+}
+
+// info describes p. Caller holds o.mu.
+func (p *preview) info() PreviewInfo {
+	return PreviewInfo{
+		Name:      p.name,
+		Ref:       p.ref,
+		Commit:    p.slot.commit,
+		Host:      p.host,
+		Alive:     p.slot.alive,
+		CreatedAt: p.created.Format(time.RFC3339),
+		ExpiresAt: p.expires.Format(time.RFC3339),
+	}
+}
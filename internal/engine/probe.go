@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+)
+
+// A booting slot is polled on health_endpoint until it answers 200, every
+// 200ms for up to health_timeout_ms. startup_probe paces that for apps that
+// take a while: wait before the first poll, poll less often the longer
+// boot takes, and give up after so many failed polls or a boot timeout of
+// its own, so a slow Rails or JVM boot doesn't mean raising
+// health_timeout_ms or being polled hundreds of times.
+
+// defaultProbeInterval is the time between polls without startup_probe.
+const defaultProbeInterval = 200 * time.Millisecond
+
+// defaultMaxProbeInterval caps a backed-off interval unless
+// startup_probe.max_interval_ms says otherwise.
+const defaultMaxProbeInterval = 5 * time.Second
+
+// StartupProbe paces the health polls of a slot while it boots.
+type StartupProbe struct {
+	InitialDelayMs   int     `json:"initial_delay_ms"`  // before the first poll (default: 0)
+	IntervalMs       int     `json:"interval_ms"`       // between the first polls (default: 200)
+	Backoff          float64 `json:"backoff"`           // the interval is multiplied by this after each failed poll (default: 1, constant)
+	MaxIntervalMs    int     `json:"max_interval_ms"`   // the interval never grows past this (default: 5000)
+	FailureThreshold int     `json:"failure_threshold"` // failed polls before giving up (default: no limit)
+	TimeoutMs        int     `json:"timeout_ms"`        // longest boot (default: health_timeout_ms)
+}
+
+// probeSchedule is how a health checker paces its polls.
+type probeSchedule struct {
+	timeout          time.Duration
+	initialDelay     time.Duration
+	interval         time.Duration
+	backoff          float64
+	maxInterval      time.Duration
+	failureThreshold int
+}
+
+func defaultSchedule(timeout time.Duration) probeSchedule {
+	return probeSchedule{timeout: timeout, interval: defaultProbeInterval}
+}
+
+// next returns the interval after interval, backed off.
+func (s probeSchedule) next(interval time.Duration) time.Duration {
+	if s.backoff <= 1 {
+		return interval
+	}
+	interval = time.Duration(float64(interval) * s.backoff)
+	if s.maxInterval > 0 && interval > s.maxInterval {
+		interval = s.maxInterval
+	}
+	return interval
+}
+
+// probeSchedule returns startup_probe's schedule with the given timeout.
+func (o *Orchestrator) probeSchedule(timeout time.Duration) probeSchedule {
+	sched := defaultSchedule(timeout)
+	p := o.cfg.StartupProbe
+	if p == nil {
+		return sched
+	}
+	sched.initialDelay = time.Duration(p.InitialDelayMs) * time.Millisecond
+	if p.IntervalMs > 0 {
+		sched.interval = time.Duration(p.IntervalMs) * time.Millisecond
+	}
+	sched.backoff = p.Backoff
+	sched.maxInterval = defaultMaxProbeInterval
+	if p.MaxIntervalMs > 0 {
+		sched.maxInterval = time.Duration(p.MaxIntervalMs) * time.Millisecond
+	}
+	sched.failureThreshold = p.FailureThreshold
+	return sched
+}
+
+// startupTimeout is how long a new slot gets to turn healthy.
+func (o *Orchestrator) startupTimeout() time.Duration {
+	if p := o.cfg.StartupProbe; p != nil && p.TimeoutMs > 0 {
+		return time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	return time.Duration(o.cfg.HealthTimeoutMs) * time.Millisecond
+}
+
+// probeLimit describes when the startup wait gives up, for messages.
+func (o *Orchestrator) probeLimit() string {
+	limit := fmt.Sprintf("within %s", o.startupTimeout())
+	if p := o.cfg.StartupProbe; p != nil && p.FailureThreshold > 0 {
+		limit += fmt.Sprintf(" or %d polls", p.FailureThreshold)
+	}
+	return limit
+}
@@ -0,0 +1,188 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"slot-machine/internal/proxy"
+)
+
+// GET / only says the API answers. GET /livez and GET /readyz check the
+// daemon itself, for load balancers, external monitors, and the systemd
+// watchdog. /livez fails only when restarting the daemon would help: its
+// state lock is stuck. /readyz fails whenever the daemon can't serve or
+// deploy: a proxy listener isn't accepting connections, the data dir isn't
+// writable, git doesn't work in the repo, or the live slot isn't healthy.
+
+// probeTimeout bounds each check.
+const probeTimeout = 2 * time.Second
+
+// ProbeCheck is one check of GET /livez or /readyz.
+type ProbeCheck struct {
+	Name  string `json:"name"` // "lock", "app_proxy", "internal_proxy", "data_dir", "git", or "live_slot"
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// ProbeResponse is the body of GET /livez and /readyz, served with a 503
+// unless Status is "ok".
+type ProbeResponse struct {
+	Status string       `json:"status"` // "ok" or "failing"
+	Checks []ProbeCheck `json:"checks"`
+}
+
+// OK reports whether every check passed.
+func (r ProbeResponse) OK() bool { return r.Status == "ok" }
+
+func newProbeResponse(checks []ProbeCheck) ProbeResponse {
+	resp := ProbeResponse{Status: "ok", Checks: checks}
+	for _, c := range checks {
+		if !c.OK {
+			resp.Status = "failing"
+		}
+	}
+	return resp
+}
+
+func probeCheck(name string, err error) ProbeCheck {
+	c := ProbeCheck{Name: name, OK: err == nil}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	return c
+}
+
+// Livez checks that the daemon isn't wedged.
+func (o *Orchestrator) Livez() ProbeResponse {
+	return newProbeResponse([]ProbeCheck{probeCheck("lock", o.checkLock())})
+}
+
+// Readyz checks that the daemon can serve traffic and deploy.
+func (o *Orchestrator) Readyz() ProbeResponse {
+	lockErr := o.checkLock()
+	checks := []ProbeCheck{
+		probeCheck("lock", lockErr),
+		probeCheck("app_proxy", checkListener(o.appProxy)),
+		probeCheck("internal_proxy", checkListener(o.intProxy)),
+		probeCheck("data_dir", o.checkDataDir()),
+		probeCheck("git", o.checkGit()),
+	}
+	if lockErr == nil {
+		checks = append(checks, probeCheck("live_slot", o.checkLive()))
+	} else {
+		checks = append(checks, probeCheck("live_slot", errors.New("not checked: the state lock is stuck")))
+	}
+	return newProbeResponse(checks)
+}
+
+// checkLock fails if o.mu can't be taken within probeTimeout. A deadlocked
+// daemon leaks the goroutine that tried, but it's restarted anyway.
+func (o *Orchestrator) checkLock() error {
+	done := make(chan struct{})
+	go func() {
+		o.mu.Lock()
+		o.mu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(probeTimeout):
+		return fmt.Errorf("the state lock has been held for over %s", probeTimeout)
+	}
+}
+
+// checkListener connects to each of the proxy's addresses.
+func checkListener(p *proxy.Proxy) error {
+	if p == nil || p.Addr() == "" {
+		return nil
+	}
+	if err := p.LastError(); err != "" {
+		return errors.New(err)
+	}
+	for _, addr := range p.Addrs() {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		switch host {
+		case "", "0.0.0.0":
+			host = "127.0.0.1"
+		case "::":
+			host = "::1"
+		}
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), probeTimeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+// checkDataDir writes and removes a file in the data dir.
+func (o *Orchestrator) checkDataDir() error {
+	f, err := os.CreateTemp(o.dataDir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write([]byte("ok\n")); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkGit runs git in the repo.
+func (o *Orchestrator) checkGit() error {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	if out, err := exec.CommandContext(ctx, "git", "-C", o.repoDir, "rev-parse", "--git-dir").CombinedOutput(); err != nil {
+		return fmt.Errorf("git rev-parse: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// checkLive probes the live slot's health endpoint, as GET /healthz does.
+func (o *Orchestrator) checkLive() error {
+	o.mu.Lock()
+	live, rec := o.liveSlot, o.recovering
+	var port int
+	alive := false
+	if live != nil {
+		port, alive = live.intPort, live.alive
+	}
+	o.mu.Unlock()
+	switch {
+	case live == nil && rec != nil:
+		return fmt.Errorf("%s is recovering", rec.name)
+	case live == nil:
+		return errors.New("nothing is live")
+	case !alive:
+		return fmt.Errorf("%s is down", live.name)
+	}
+	if res, _ := o.probeHealth(live, port); !res.ok {
+		if res.err != "" {
+			return fmt.Errorf("%s is unhealthy: %s", live.name, res.err)
+		}
+		return fmt.Errorf("%s is unhealthy: %d", live.name, res.code)
+	}
+	return nil
+}
+
+// writeProbe writes resp, with a 503 if a check failed.
+func writeProbe(w http.ResponseWriter, resp ProbeResponse) {
+	code := 200
+	if !resp.OK() {
+		code = 503
+	}
+	writeJSON(w, code, resp)
+}
@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A deploy can take minutes, mostly in setup and the health check. A client
+// that sends "Accept: application/x-ndjson" with POST /deploy gets each
+// step as a JSON line while it runs: the phase, setup_command's output line
+// by line, and every health check poll that didn't pass. The last line
+// holds the usual response and its status code. The HTTP status is 200,
+// since it's sent before the outcome is known.
+
+const progressContentType = "application/x-ndjson"
+
+// DeployProgress is one step of a deploy, passed to DeployOptions.Progress.
+type DeployProgress struct {
+	Phase     string `json:"phase"` // "checkout", "setup", "start", "health", "promote", "drain", "smoke"
+	Message   string `json:"message,omitempty"`
+	Line      string `json:"line,omitempty"`    // a line of setup output
+	Attempt   int    `json:"attempt,omitempty"` // a failed health check poll
+	ElapsedMs int64  `json:"elapsed_ms"`        // since the deploy started
+}
+
+// progressLine is a line of a streamed deploy response: a step, or the
+// final result.
+type progressLine struct {
+	Progress *DeployProgress `json:"progress,omitempty"`
+	Result   *DeployResponse `json:"result,omitempty"`
+	Code     int             `json:"code,omitempty"`
+}
+
+// deployReporter sends a deploy's steps to DeployOptions.Progress, if set,
+// and its phases, not each line or poll, to GET /events.
+type deployReporter struct {
+	fn      func(DeployProgress)
+	start   time.Time
+	publish func(DeployProgress)
+}
+
+func (d deployReporter) report(p DeployProgress) {
+	p.ElapsedMs = time.Since(d.start).Milliseconds()
+	if d.publish != nil && p.Line == "" && p.Attempt == 0 {
+		d.publish(p)
+	}
+	if d.fn != nil {
+		d.fn(p)
+	}
+}
+
+func (d deployReporter) phase(phase, format string, args ...any) {
+	d.report(DeployProgress{Phase: phase, Message: fmt.Sprintf(format, args...)})
+}
+
+// healthAttempt returns a callback for failed health polls, or nil when
+// nobody is listening.
+func (d deployReporter) healthAttempt() func(int, string) {
+	if d.fn == nil {
+		return nil
+	}
+	return func(n int, result string) {
+		d.report(DeployProgress{Phase: "health", Message: result, Attempt: n})
+	}
+}
+
+// setupOutput is where setup_command's output goes: out, and progress
+// lines if anyone is listening.
+func (d deployReporter) setupOutput(out io.Writer) *lineWriter {
+	return &lineWriter{out: out, d: d}
+}
+
+// lineWriter passes setup output on to out and reports it a line at a
+// time.
+type lineWriter struct {
+	out io.Writer
+	d   deployReporter
+	buf []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	n, err := l.out.Write(p)
+	if l.d.fn == nil {
+		return n, err
+	}
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		l.d.report(DeployProgress{Phase: "setup", Line: strings.TrimRight(string(l.buf[:i]), "\r")})
+		l.buf = l.buf[i+1:]
+	}
+	return n, err
+}
+
+// Close reports a last line with no newline.
+func (l *lineWriter) Close() error {
+	if len(l.buf) > 0 {
+		l.d.report(DeployProgress{Phase: "setup", Line: string(l.buf)})
+	}
+	l.buf = nil
+	return nil
+}
+
+// wantsProgress reports whether r asked for a streamed deploy.
+func wantsProgress(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), progressContentType)
+}
+
+// serveDeploy runs a deploy and writes its response, streamed if r asked
+// for it. A person's request isn't held for approval (see vouched).
+func (o *Orchestrator) serveDeploy(w http.ResponseWriter, r *http.Request, commit string, opts DeployOptions) {
+	opts.Approved = opts.Approved || o.vouched(r)
+	if !wantsProgress(r) {
+		resp, code := o.DeployWithOptions(commit, opts)
+		if resp.RetryAfterMs > 0 {
+			w.Header().Set("Retry-After", strconv.FormatInt((resp.RetryAfterMs+999)/1000, 10))
+		}
+		writeJSON(w, code, resp)
+		return
+	}
+
+	w.Header().Set("Content-Type", progressContentType)
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+
+	// Health polls run in their own goroutines and may still report after
+	// the deploy returns, so lines are serialized and cut off at the end.
+	var mu sync.Mutex
+	done := false
+	opts.Progress = func(p DeployProgress) {
+		mu.Lock()
+		defer mu.Unlock()
+		if done {
+			return
+		}
+		enc.Encode(progressLine{Progress: &p})
+		rc.Flush()
+	}
+	resp, code := o.DeployWithOptions(commit, opts)
+
+	mu.Lock()
+	defer mu.Unlock()
+	done = true
+	enc.Encode(progressLine{Result: &resp, Code: code})
+	rc.Flush()
+}
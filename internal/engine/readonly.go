@@ -0,0 +1,85 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// In read-only mode the API can be looked at but not used to change
+// anything: GET requests are answered as usual, and every other request is
+// refused with 403, so nothing deploys, rolls back, restarts, locks, or
+// runs the agent through it. It's for incident freezes, and for handing
+// the API to monitoring. read_only (or start --read-only) turns it on when
+// the daemon starts; POST /read-only turns it on until the daemon restarts,
+// and DELETE /read-only off, with the admin token if the daemon has one.
+// Without one, DELETE only undoes a POST: a daemon configured read-only,
+// say a monitoring replica, stays so until its config changes.
+// Slots' ready callbacks still go through, and so does what the daemon
+// does on its own: recovery, crash restarts, env_reload, dev mode.
+
+// errReadOnly is the error of a request refused in read-only mode.
+const errReadOnly = "the daemon API is read-only"
+
+type readOnlyRequest struct {
+	AdminToken string `json:"admin_token"`
+}
+
+// refuseReadOnly answers r with 403 and reports true if read-only mode
+// doesn't allow it.
+func (o *Orchestrator) refuseReadOnly(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == "GET" || r.Method == "HEAD" || r.URL.Path == "/ready" || r.URL.Path == "/read-only" || !o.ReadOnly() {
+		return false
+	}
+	writeJSON(w, 403, map[string]string{"error": errReadOnly})
+	return true
+}
+
+func (o *Orchestrator) handleReadOnly(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		o.SetReadOnly(true)
+		writeJSON(w, 200, map[string]bool{"read_only": true})
+		return
+	}
+	var req readOnlyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSON(w, 400, map[string]string{"error": "invalid body"})
+		return
+	}
+	if o.adminToken == "" && o.readOnlyConfig {
+		writeJSON(w, 403, map[string]string{"error": "read_only is set in the config (or by start --read-only), and the daemon has no admin token: only changing that and restarting the daemon makes it read-write"})
+		return
+	}
+	if o.adminToken != "" && !o.checkAdminToken(req.AdminToken) {
+		writeJSON(w, 403, map[string]string{"error": "leaving read-only mode needs the admin token"})
+		return
+	}
+	o.SetReadOnly(false)
+	writeJSON(w, 200, map[string]bool{"read_only": false})
+}
+
+// SetReadOnly turns read-only mode on or off.
+func (o *Orchestrator) SetReadOnly(on bool) {
+	o.mu.Lock()
+	was := o.readOnly
+	o.readOnly = on
+	o.mu.Unlock()
+	if was == on {
+		return
+	}
+	if on {
+		fmt.Println("the daemon API is read-only")
+		o.Publish(EventReadOnly, "", "", nil)
+	} else {
+		fmt.Println("the daemon API is read-write")
+		o.Publish(EventReadWrite, "", "", nil)
+	}
+}
+
+// ReadOnly reports whether the API is read-only.
+func (o *Orchestrator) ReadOnly() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.readOnly
+}
@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Polling health_endpoint finds a slow boot ready a poll late at best. With
+// ready_callback_timeout_ms set, each slot is told where to say so itself:
+// SLOT_MACHINE_READY_URL, to POST to with "Authorization: Bearer
+// $SLOT_MACHINE_READY_TOKEN" once it serves. The token is good once, for
+// that slot. The deploy goes on as soon as the callback comes, without a
+// health poll; if it doesn't come within the timeout, the slot is polled
+// as usual for what's left of the startup timeout.
+
+// readyWait is a slot's pending readiness callback.
+type readyWait struct {
+	token string
+	ready chan struct{} // closed by the callback
+}
+
+// readyCallback returns a new readiness callback and the variables that
+// tell the slot about it, or nothing without ready_callback_timeout_ms or
+// an API URL. o.mu must be held.
+func (o *Orchestrator) readyCallback() (*readyWait, []string) {
+	if o.cfg.ReadyCallbackTimeoutMs <= 0 || o.apiURL == "" {
+		return nil, nil
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	rw := &readyWait{token: hex.EncodeToString(b), ready: make(chan struct{})}
+	if o.readyWaits == nil {
+		o.readyWaits = map[string]*readyWait{}
+	}
+	o.readyWaits[rw.token] = rw
+	return rw, []string{
+		"SLOT_MACHINE_READY_URL=" + strings.TrimSuffix(o.apiURL, "/") + "/ready",
+		"SLOT_MACHINE_READY_TOKEN=" + rw.token,
+	}
+}
+
+// forgetReady drops rw's token, so it can't be used anymore.
+func (o *Orchestrator) forgetReady(rw *readyWait) {
+	if rw == nil {
+		return
+	}
+	o.mu.Lock()
+	delete(o.readyWaits, rw.token)
+	o.mu.Unlock()
+}
+
+// handleReady is POST /ready: a slot saying it's ready.
+func (o *Orchestrator) handleReady(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	o.mu.Lock()
+	rw := o.readyWaits[token]
+	delete(o.readyWaits, token)
+	o.mu.Unlock()
+	if token == "" || rw == nil {
+		writeJSON(w, 401, map[string]string{"error": "unknown or used ready token"})
+		return
+	}
+	close(rw.ready)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// awaitCallback waits up to ready_callback_timeout_ms, and at most timeout,
+// for s to call back, and reports whether it did.
+func (o *Orchestrator) awaitCallback(s *slot, timeout time.Duration) bool {
+	started := time.Now()
+	wait := min(time.Duration(o.cfg.ReadyCallbackTimeoutMs)*time.Millisecond, timeout)
+	select {
+	case <-s.ready.ready:
+		fmt.Printf("%s: the app called back ready after %s\n", s.name, time.Since(started).Round(time.Millisecond))
+		return true
+	case <-s.done:
+	case <-time.After(wait):
+		fmt.Printf("%s: no ready callback within %s; polling %s\n", s.name, wait, o.cfg.HealthEndpoint)
+	}
+	o.forgetReady(s.ready)
+	return false
+}
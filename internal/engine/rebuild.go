@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// RebuildSlots re-creates the slot directories state.json names but the
+// data dir lacks, as after a backup is restored on another machine: each
+// is checked out from the repo at its commit, linked to shared_dirs, and
+// set up. Releases deployed from an artifact have no commit to check out,
+// so they are dropped from the state, as are slots that fail to rebuild.
+// The live and prev symlinks are pointed at what remains. Progress goes
+// to out; the names of the rebuilt slots are returned.
+func (o *Orchestrator) RebuildSlots(out io.Writer) ([]string, error) {
+	st := o.loadState()
+	if st == nil {
+		return nil, errors.New("no usable state.json to rebuild from")
+	}
+
+	var rebuilt []string
+	keep := func(s *slotState) bool {
+		dir := filepath.Join(o.dataDir, s.Name)
+		if _, err := os.Stat(dir); err == nil {
+			return true
+		}
+		if isArtifact(s.Commit) {
+			fmt.Fprintf(out, "%s: deployed from an artifact, can't be rebuilt; dropped\n", s.Name)
+			return false
+		}
+		fmt.Fprintf(out, "%s: checking out %s\n", s.Name, ShortHash(s.Commit))
+		if err := o.worktrees.Checkout(dir, s.Commit); err != nil {
+			fmt.Fprintf(out, "%s: %v; dropped\n", s.Name, err)
+			return false
+		}
+		o.applySharedDirs(dir)
+		if o.cfg.SetupCommand != "" {
+			fmt.Fprintf(out, "%s: running %s\n", s.Name, o.cfg.SetupCommand)
+			if err := o.runSetup(dir, s.Release, s.AppPort, s.IntPort, out); err != nil {
+				fmt.Fprintf(out, "%s: setup: %v; dropped\n", s.Name, err)
+				o.worktrees.Remove(dir)
+				return false
+			}
+		}
+		s.SetupHash = o.setupHash(dir)
+		o.recordManifest(dir, s.Commit)
+		rebuilt = append(rebuilt, s.Name)
+		return true
+	}
+
+	if st.Live != nil && !keep(st.Live) {
+		st.Live = nil
+	}
+	if st.Prev != nil && !keep(st.Prev) {
+		st.Prev = nil
+	}
+	var retained []*slotState
+	for _, r := range st.Retained {
+		if keep(r) {
+			retained = append(retained, r)
+		}
+	}
+	st.Retained = retained
+
+	for _, link := range []struct {
+		name string
+		s    *slotState
+	}{{"live", st.Live}, {"prev", st.Prev}} {
+		path := filepath.Join(o.dataDir, link.name)
+		if link.s == nil {
+			os.Remove(path)
+		} else if err := atomicSymlink(path, link.s.Name); err != nil {
+			return rebuilt, err
+		}
+	}
+	return rebuilt, o.writeState(*st)
+}
@@ -0,0 +1,254 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Changing env_file and deploying are separate steps, so new code can run
+// with the old environment for a while, or the other way around. A release
+// bundles a commit with env overrides and a fragment of the config that
+// says how to set up and start it, and a slot runs exactly that: POST
+// /releases boots a slot with all three, traffic switches to it only once
+// it's healthy, and if it fails nothing changed. Rollback restarts the
+// previous slot with its own bundle, config included. A plain deploy keeps
+// the live release's env and config, so they persist until a release
+// changes them.
+
+// ReleaseSpec is what a slot runs beyond its commit.
+type ReleaseSpec struct {
+	Env    map[string]string `json:"env,omitempty"` // set after env_file, overriding it
+	Config *ReleaseConfig    `json:"config,omitempty"`
+}
+
+// ReleaseConfig is the part of the config a release may set. Everything in
+// it concerns starting a slot, so it takes effect for the slot being
+// deployed without touching the one that's live.
+type ReleaseConfig struct {
+	SetupCommand    *string       `json:"setup_command,omitempty"`
+	SetupCacheKeys  []string      `json:"setup_cache_keys,omitempty"`
+	StartCommand    *string       `json:"start_command,omitempty"`
+	HealthTimeoutMs *int          `json:"health_timeout_ms,omitempty"`
+	StartupProbe    *StartupProbe `json:"startup_probe,omitempty"`
+	WarmupURLs      []string      `json:"warmup_urls,omitempty"`
+	SmokeCommand    *string       `json:"smoke_command,omitempty"`
+}
+
+// releaseConfigKeys are the JSON names of ReleaseConfig's fields.
+var releaseConfigKeys = []string{"setup_command", "setup_cache_keys", "start_command", "health_timeout_ms", "startup_probe", "warmup_urls", "smoke_command"}
+
+// apply sets what rc sets in cfg.
+func (rc *ReleaseConfig) apply(cfg *Config) {
+	if rc == nil {
+		return
+	}
+	if rc.SetupCommand != nil {
+		cfg.SetupCommand = *rc.SetupCommand
+	}
+	if rc.SetupCacheKeys != nil {
+		cfg.SetupCacheKeys = rc.SetupCacheKeys
+	}
+	if rc.StartCommand != nil {
+		cfg.StartCommand = *rc.StartCommand
+	}
+	if rc.HealthTimeoutMs != nil {
+		cfg.HealthTimeoutMs = *rc.HealthTimeoutMs
+	}
+	if rc.StartupProbe != nil {
+		cfg.StartupProbe = rc.StartupProbe
+	}
+	if rc.WarmupURLs != nil {
+		cfg.WarmupURLs = rc.WarmupURLs
+	}
+	if rc.SmokeCommand != nil {
+		cfg.SmokeCommand = *rc.SmokeCommand
+	}
+}
+
+// copyReleaseFields copies the fields a release may set from src to dst.
+func copyReleaseFields(dst *Config, src Config) {
+	dst.SetupCommand = src.SetupCommand
+	dst.SetupCacheKeys = src.SetupCacheKeys
+	dst.StartCommand = src.StartCommand
+	dst.HealthTimeoutMs = src.HealthTimeoutMs
+	dst.StartupProbe = src.StartupProbe
+	dst.WarmupURLs = src.WarmupURLs
+	dst.SmokeCommand = src.SmokeCommand
+}
+
+// config returns r's config; r is nil for a slot without a release.
+func (r *ReleaseSpec) config() *ReleaseConfig {
+	if r == nil {
+		return nil
+	}
+	return r.Config
+}
+
+// environ returns r's env overrides as KEY=VALUE, sorted by name.
+func (r *ReleaseSpec) environ() []string {
+	if r == nil {
+		return nil
+	}
+	env := make([]string, 0, len(r.Env))
+	for k, v := range r.Env {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// ReleaseStatus is a release, in GET /status: its env's names, not their
+// values, which may be secrets.
+type ReleaseStatus struct {
+	Env    []string       `json:"env,omitempty"`
+	Config *ReleaseConfig `json:"config,omitempty"`
+}
+
+// status returns r for GET /status, nil without a release.
+func (r *ReleaseSpec) status() *ReleaseStatus {
+	if r == nil {
+		return nil
+	}
+	st := &ReleaseStatus{Config: r.Config}
+	for k := range r.Env {
+		st.Env = append(st.Env, k)
+	}
+	sort.Strings(st.Env)
+	return st
+}
+
+// checkReleaseEnv refuses variables the daemon sets itself.
+func checkReleaseEnv(env map[string]string) error {
+	for k := range env {
+		switch {
+		case k == "" || strings.ContainsAny(k, "=\x00"):
+			return fmt.Errorf("env: invalid variable name %q", k)
+		case k == "PORT" || k == "INTERNAL_PORT" || strings.HasPrefix(k, "SLOT_MACHINE"):
+			return fmt.Errorf("env: %s is set by slot-machine", k)
+		}
+	}
+	return nil
+}
+
+// useRelease makes o.cfg the config of a slot of a release with config
+// rc: the file's, with rc on top. o.mu must be held.
+func (o *Orchestrator) useRelease(rc *ReleaseConfig) {
+	if rc == o.releaseCfg {
+		return
+	}
+	copyReleaseFields(&o.cfg, o.releaseBase)
+	rc.apply(&o.cfg)
+	o.releaseCfg = rc
+}
+
+// releaseFor is the release a deploy runs: the live one, with what the
+// deploy sets replacing its env or config. o.mu must be held.
+func (o *Orchestrator) releaseFor(changes *ReleaseSpec) *ReleaseSpec {
+	var live *ReleaseSpec
+	if o.liveSlot != nil {
+		live = o.liveSlot.release
+	}
+	if changes == nil {
+		return live
+	}
+	r := &ReleaseSpec{Env: changes.Env, Config: changes.Config}
+	if r.Env == nil && live != nil {
+		r.Env = live.Env
+	}
+	if r.Config == nil {
+		r.Config = live.config()
+	} else if reflect.ValueOf(*r.Config).IsZero() {
+		r.Config = nil // {}: back to the file's
+	}
+	if len(r.Env) == 0 && r.Config == nil {
+		return nil
+	}
+	return r
+}
+
+// --- POST /releases ---
+
+// releaseRequest is the body of POST /releases: a deploy request, with the
+// release's env and config. Either left out is the live release's; {}
+// clears it.
+type releaseRequest struct {
+	deployRequest
+	Env    map[string]string `json:"env"`
+	Config json.RawMessage   `json:"config"`
+}
+
+func (o *Orchestrator) handleRelease(w http.ResponseWriter, r *http.Request) {
+	var req releaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSON(w, 400, DeployResponse{Error: "invalid body"})
+		return
+	}
+	if req.ArtifactURL != "" {
+		writeJSON(w, 400, DeployResponse{Error: "a release deploys a commit, not an artifact"})
+		return
+	}
+	changes := &ReleaseSpec{Env: req.Env}
+	if err := checkReleaseEnv(req.Env); err != nil {
+		writeJSON(w, 400, DeployResponse{Error: err.Error()})
+		return
+	}
+	if len(req.Config) > 0 && string(req.Config) != "null" {
+		rc, err := decodeReleaseConfig(req.Config)
+		if err != nil {
+			writeJSON(w, 400, DeployResponse{Error: err.Error()})
+			return
+		}
+		changes.Config = rc
+	}
+	source, err := deploySource(req.Source)
+	if err != nil {
+		writeJSON(w, 400, DeployResponse{Error: err.Error()})
+		return
+	}
+	commit := o.LiveCommit()
+	if req.Commit != "" || req.Ref != "" || req.Fetch {
+		var code int
+		if commit, code, err = o.deployCommit(req.deployRequest); err != nil {
+			writeJSON(w, code, DeployResponse{Error: err.Error()})
+			return
+		}
+	}
+	if commit == "" {
+		writeJSON(w, 400, DeployResponse{Error: "missing commit"})
+		return
+	}
+
+	o.serveDeploy(w, r, commit, DeployOptions{
+		ForceSetup: req.ForceSetup,
+		Force:      req.Force,
+		AdminToken: req.AdminToken,
+		Source:     source,
+		Message:    req.Message,
+		Release:    changes,
+	})
+}
+
+// decodeReleaseConfig parses a release's config, which may only set
+// releaseConfigKeys.
+func decodeReleaseConfig(data json.RawMessage) (*ReleaseConfig, error) {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	for k := range keys {
+		if !slices.Contains(releaseConfigKeys, k) {
+			return nil, fmt.Errorf("config: a release can't set %s, only %s", k, strings.Join(releaseConfigKeys, ", "))
+		}
+	}
+	var rc ReleaseConfig
+	if err := json.Unmarshal(data, &rc); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	return &rc, nil
+}
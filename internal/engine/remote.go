@@ -0,0 +1,121 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// A deploy can name a ref instead of a commit and have the daemon fetch
+// first: POST /deploy {"ref": "origin/main", "fetch": true} deploys what was
+// pushed to the remote, even a commit nobody pushed to the server's repo.
+// The remote is config's remote, or upstream's; the deploy key (see
+// DeployKey) is what fetches authenticate with.
+
+// remoteName returns the remote deploys fetch from.
+func (o *Orchestrator) remoteName() string {
+	o.mu.Lock()
+	remote := o.cfg.Remote
+	o.mu.Unlock()
+	if remote == "" {
+		_, remote = o.upstreamRef()
+	}
+	return remote
+}
+
+// DeployKeyName is the key `slot-machine keygen` writes in the data dir.
+const DeployKeyName = "deploy_key"
+
+// DeployKey returns the SSH key the daemon's git commands authenticate
+// with: deploy_key_file, or the data dir's deploy_key if keygen made one,
+// or "" to leave it to ssh's own config.
+func DeployKey(cfg Config, repoDir, dataDir string) string {
+	if key := cfg.DeployKeyFile; key != "" {
+		if !filepath.IsAbs(key) {
+			key = filepath.Join(repoDir, key)
+		}
+		return key
+	}
+	if key := filepath.Join(dataDir, DeployKeyName); exists(key) {
+		return key
+	}
+	return ""
+}
+
+// GitSSHCommand returns a GIT_SSH_COMMAND that authenticates with key.
+// It never prompts: the daemon has no one to answer.
+func GitSSHCommand(key string) string {
+	return "ssh -i " + ShellQuote(key) + " -o IdentitiesOnly=yes -o BatchMode=yes -o StrictHostKeyChecking=accept-new -o LogLevel=ERROR"
+}
+
+// gitSSHCommand returns the GIT_SSH_COMMAND for the deploy key, or "".
+func (o *Orchestrator) gitSSHCommand() string {
+	o.mu.Lock()
+	key := DeployKey(o.cfg, o.repoDir, o.dataDir)
+	o.mu.Unlock()
+	if key == "" {
+		return ""
+	}
+	return GitSSHCommand(key)
+}
+
+// fetchRemote fetches remote's branches and tags into the repo. Fetches are
+// serialized, so a deploy's doesn't trip over the upstream watcher's.
+func (o *Orchestrator) fetchRemote(remote string) error {
+	o.fetchMu.Lock()
+	defer o.fetchMu.Unlock()
+	cmd := exec.Command("git", "-C", o.repoDir, "fetch", "--quiet", "--tags", remote)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if ssh := o.gitSSHCommand(); ssh != "" {
+		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND="+ssh)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		msg, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+		if msg == "" {
+			msg = err.Error()
+		}
+		return fmt.Errorf("git fetch %s: %s", remote, msg)
+	}
+	return nil
+}
+
+// resolveRef returns the commit ref points at in the repo.
+func (o *Orchestrator) resolveRef(ref string) (string, error) {
+	if strings.HasPrefix(ref, "-") {
+		return "", fmt.Errorf("invalid ref %q", ref)
+	}
+	out, err := exec.Command("git", "-C", o.repoDir, "rev-parse", "--verify", "-q", ref+"^{commit}").Output()
+	if err != nil {
+		return "", fmt.Errorf("unknown ref %q", ref)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// deployCommit fetches the remote if req asks to, and returns the commit
+// req deploys: its commit, or what its ref points at (default: upstream),
+// with the status code to fail with.
+func (o *Orchestrator) deployCommit(req deployRequest) (string, int, error) {
+	if req.Commit != "" && req.Ref != "" {
+		return "", 400, errors.New("set one of commit and ref")
+	}
+	if req.Fetch {
+		if err := o.fetchRemote(o.remoteName()); err != nil {
+			return "", 502, err
+		}
+	}
+	if req.Commit != "" {
+		return req.Commit, 200, nil
+	}
+	ref := req.Ref
+	if ref == "" {
+		ref, _ = o.upstreamRef()
+	}
+	commit, err := o.resolveRef(ref)
+	if err != nil {
+		return "", 400, err
+	}
+	return commit, 200, nil
+}
@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A slot is a git worktree, tied to the repo by two pointers: the slot's
+// .git file names its metadata dir under .git/worktrees, and that dir's
+// gitdir file names the slot. Promote renames the slot and then updates
+// both; a daemon killed in between leaves them pointing at names that are
+// gone, which git reports confusingly on the next deploy, and which the
+// next `git worktree prune` turns into a slot with no repo at all. The
+// daemon repairs its slots when it starts, before anything prunes, and
+// `slot-machine doctor` does the same for a stopped one.
+
+// RepairWorktrees checks the worktrees of the slots in state.json (or the
+// live/prev symlinks) and slot-staging, repairs their git metadata where a
+// crash left it inconsistent, and prunes that of slots that are gone. It
+// returns a line for each thing it fixed.
+func (o *Orchestrator) RepairWorktrees() []string {
+	st := o.loadState()
+	if st == nil {
+		st = o.stateFromSymlinks()
+	}
+	return o.repairWorktrees(st)
+}
+
+func (o *Orchestrator) repairWorktrees(st *persistedState) []string {
+	dirs := map[string]string{}
+	for _, ss := range append([]*slotState{st.Live, st.Prev}, st.Retained...) {
+		if ss != nil {
+			dirs[filepath.Join(o.dataDir, ss.Name)] = ss.Commit
+		}
+	}
+	// slot-staging was cloned from the live slot; the agent's commits on
+	// top of it are lost with its metadata, but not its files.
+	staging := ""
+	if st.Live != nil {
+		staging = st.Live.Commit
+	}
+	dirs[filepath.Join(o.dataDir, "slot-staging")] = staging
+	return o.worktrees.Repair(dirs)
+}
+
+func (g *gitWorktrees) Repair(dirs map[string]string) []string {
+	var fixed []string
+	for _, dir := range slices.Sorted(maps.Keys(dirs)) {
+		if fix := g.repair(dir, dirs[dir]); fix != "" {
+			fixed = append(fixed, fix)
+		}
+	}
+	out, _ := exec.Command("git", "-C", g.repoDir, "worktree", "prune", "--verbose").CombinedOutput()
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line != "" {
+			fixed = append(fixed, "pruned: "+line)
+		}
+	}
+	return fixed
+}
+
+// repair fixes the worktree at dir, if it needs it, and says how.
+func (g *gitWorktrees) repair(dir, commit string) string {
+	name := filepath.Base(dir)
+	gitFile := filepath.Join(dir, ".git")
+	absGit, _ := filepath.Abs(gitFile)
+	wantMeta, _ := filepath.Abs(filepath.Join(g.repoDir, ".git", "worktrees", name))
+
+	data, err := os.ReadFile(gitFile)
+	if os.IsNotExist(err) {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() || commit == "" || isArtifact(commit) {
+			return "" // gone, or an artifact, which has no .git
+		}
+		return g.rebuild(dir, commit, "it has no .git")
+	}
+	if err != nil {
+		return "" // a repo of its own (.git is a dir), or unreadable
+	}
+	metaDir, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir:")
+	if metaDir = strings.TrimSpace(metaDir); !ok || !filepath.IsAbs(metaDir) {
+		return "" // not a file git wrote
+	}
+
+	var did []string
+	owner, err := readTrimmed(filepath.Join(metaDir, "gitdir"))
+	if err == nil && owner != absGit && !exists(owner) {
+		// Renamed, and its metadata still names the old dir.
+		if os.WriteFile(filepath.Join(metaDir, "gitdir"), []byte(absGit+"\n"), 0644) == nil {
+			owner = absGit
+			did = append(did, "pointed its metadata back at it")
+		}
+	}
+	switch {
+	case err == nil && owner == absGit:
+		// Its metadata is named after the old dir; harmless, but the next
+		// slot of that name would reuse it.
+		if filepath.Base(metaDir) != name && !exists(wantMeta) && os.Rename(metaDir, wantMeta) == nil {
+			os.WriteFile(gitFile, []byte("gitdir: "+wantMeta+"\n"), 0644)
+			did = append(did, "renamed its metadata to match")
+		}
+	case err != nil && metaDir != wantMeta && readGitdir(wantMeta) == absGit:
+		// Its metadata was renamed, its .git not yet pointed at it.
+		if os.WriteFile(gitFile, []byte("gitdir: "+wantMeta+"\n"), 0644) != nil {
+			return ""
+		}
+		did = append(did, "pointed .git at its renamed metadata")
+	case err != nil:
+		return g.rebuild(dir, commit, "its metadata is gone")
+	default:
+		// The metadata belongs to another worktree: a clone cut short
+		// before it got its own.
+		return g.rebuild(dir, commit, "its .git points at "+filepath.Base(filepath.Dir(owner))+"'s metadata")
+	}
+	if len(did) == 0 {
+		return ""
+	}
+	return name + ": " + strings.Join(did, ", ")
+}
+
+// rebuild gives dir new worktree metadata at commit, keeping its files.
+func (g *gitWorktrees) rebuild(dir, commit, why string) string {
+	name := filepath.Base(dir)
+	if commit == "" {
+		return fmt.Sprintf("%s: %s and its commit is unknown; left as is", name, why)
+	}
+	if err := g.fixClonedWorktree(dir, commit); err != nil {
+		return fmt.Sprintf("%s: %s; rebuilding it: %v", name, why, err)
+	}
+	return fmt.Sprintf("%s: %s; rebuilt it at %s", name, why, ShortHash(commit))
+}
+
+func readGitdir(metaDir string) string {
+	s, _ := readTrimmed(filepath.Join(metaDir, "gitdir"))
+	return s
+}
+
+func readTrimmed(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	return strings.TrimSpace(string(data)), err
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
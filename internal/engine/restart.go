@@ -0,0 +1,111 @@
+package engine
+
+import (
+	"fmt"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// A rolling restart boots a fresh process of the live release, in the same
+// directory, on new ports, switches traffic to it once it's healthy and
+// drains the old one: a deploy of the live commit without checkout or
+// setup. It picks up env_file changes and sheds whatever the old process
+// had accumulated. The previous slot is left as it was, so a rollback
+// still goes to the release before.
+
+// RestartResponse is the body of POST /restart.
+type RestartResponse struct {
+	Success bool   `json:"success"`
+	Slot    string `json:"slot"`
+	Commit  string `json:"commit"`
+	Error   string `json:"error,omitempty"`
+
+	// Set when the new process failed its health check.
+	HealthError string `json:"health_error,omitempty"`
+	LogTail     string `json:"log_tail,omitempty"`
+}
+
+func (o *Orchestrator) handleRestart(w http.ResponseWriter, r *http.Request) {
+	resp, code := o.Restart()
+	writeJSON(w, code, resp)
+}
+
+// Restart replaces the live process with a fresh one of the same release
+// once that is healthy.
+func (o *Orchestrator) Restart() (resp RestartResponse, code int) {
+	start := time.Now()
+	// Peek at the live commit to label the lock; it's re-read once the lock
+	// is held.
+	label := o.LiveCommit()
+	release, _, ok := o.locks.TryAcquire(o.app, "restart", label)
+	if !ok {
+		return RestartResponse{Error: errDeployInProgress}, 409
+	}
+	defer release()
+	o.Publish(EventRestartStarted, label, "", nil)
+	defer func() { o.publishOutcome(EventRestartFinished, label, resp.Slot, resp.Success, resp.Error, start) }()
+
+	o.mu.Lock()
+	live := o.liveSlot
+	o.mu.Unlock()
+	if live == nil {
+		return RestartResponse{Error: "no live slot"}, 400
+	}
+
+	appPort, intPort, err := o.slotPorts(0, 0)
+	if err != nil {
+		return RestartResponse{Error: err.Error()}, 500
+	}
+	defer o.ports.release(appPort, intPort)
+
+	undo := o.vacateFixedPort()
+	newSlot, err := o.startProcess(live.dir, live.commit, live.release, appPort, intPort)
+	if err != nil {
+		undo()
+		return RestartResponse{Error: "start: " + err.Error()}, 500
+	}
+	newSlot.name = live.name
+	newSlot.setupHash = live.setupHash
+	newSlot.message = live.message
+
+	if !o.healthCheck(newSlot, nil) {
+		reason := o.healthError(newSlot)
+		newSlot.proc.Signal(syscall.SIGKILL)
+		<-newSlot.done
+		undo()
+		f := o.reportHealthFailure(newSlot, reason)
+		return RestartResponse{Error: errHealthCheckFailed, HealthError: f.Error, LogTail: f.Log}, 200
+	}
+
+	if err := o.EnsureProxies(); err != nil {
+		newSlot.proc.Signal(syscall.SIGKILL)
+		<-newSlot.done
+		undo()
+		return RestartResponse{Error: err.Error()}, 500
+	}
+
+	// Switch proxy, and update state before draining so the old process
+	// exiting doesn't clear it.
+	oldLive := o.replaceLive()
+	o.switchTargets(appPort, intPort)
+	o.mu.Lock()
+	o.liveSlot = newSlot
+	o.mu.Unlock()
+
+	if oldLive != nil {
+		o.failoverGrace(oldLive)
+		o.drain(oldLive)
+	}
+
+	if err := o.saveState(); err != nil {
+		fmt.Printf("warning: saving state: %v\n", err)
+	}
+	entry := JournalEntry{Action: "restart", Commit: live.commit, SlotDir: live.name, PrevCommit: live.commit, DurationMs: time.Since(start).Milliseconds()}
+	if err := o.writeJournal(entry); err != nil {
+		fmt.Printf("warning: journal: %v\n", err)
+	}
+	fmt.Printf("restarted %s (%s)\n", live.name, ShortHash(live.commit))
+
+	return RestartResponse{Success: true, Slot: live.name, Commit: live.commit}, 200
+}
@@ -0,0 +1,73 @@
+package engine
+
+import "strings"
+
+// Releases older than prev are garbage collected on deploy unless
+// retain_releases is set, in which case that many are kept on disk (newest
+// first) so RollbackTo can still reach them.
+
+// findRelease returns prev for an empty ref, else the prev or retained slot
+// whose name or commit matches ref.
+func (o *Orchestrator) findRelease(ref string) *slot {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if ref == "" {
+		return o.prevSlot
+	}
+	matches := func(s *slot) bool {
+		return s != nil && (s.name == ref || strings.HasPrefix(s.commit, ref))
+	}
+	if matches(o.prevSlot) {
+		return o.prevSlot
+	}
+	for _, s := range o.retained {
+		if matches(s) {
+			return s
+		}
+	}
+	return nil
+}
+
+// retire keeps a stopped slot as the newest retained release, removing the
+// oldest ones beyond retain_releases. With retention off it's removed.
+func (o *Orchestrator) retire(s *slot) {
+	o.mu.Lock()
+	kept := []*slot{s}
+	for _, r := range o.retained {
+		if r.name != s.name {
+			kept = append(kept, r)
+		}
+	}
+	n := max(o.cfg.RetainReleases, 0)
+	var drop []*slot
+	if len(kept) > n {
+		drop = kept[n:]
+		kept = kept[:n]
+	}
+	o.retained = kept
+	o.mu.Unlock()
+
+	for _, r := range drop {
+		o.worktrees.Remove(r.dir)
+	}
+}
+
+// takeRetained removes name from the retained list, leaving its directory.
+func (o *Orchestrator) takeRetained(name string) *slot {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, r := range o.retained {
+		if r.name == name {
+			o.retained = append(o.retained[:i:i], o.retained[i+1:]...)
+			return r
+		}
+	}
+	return nil
+}
+
+// dropRetained removes name from the retained list and deletes its directory.
+func (o *Orchestrator) dropRetained(name string) {
+	if r := o.takeRetained(name); r != nil {
+		o.worktrees.Remove(r.dir)
+	}
+}
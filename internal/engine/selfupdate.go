@@ -0,0 +1,40 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SelfUpdate moves the daemon from release from to release to: with the
+// deploy lock held, so no deploy, rollback, or reload starts in between, it
+// calls install to put the new binary in place, records the move in the
+// journal, and calls restart. restart is expected to replace the process
+// and returns only if that fails. Nothing is journaled if install fails.
+func (o *Orchestrator) SelfUpdate(from, to string, install, restart func() error) error {
+	release, holder, ok := o.locks.TryAcquire(o.app, "update", "")
+	if !ok {
+		return fmt.Errorf("%s in progress", holder.Action)
+	}
+	defer release()
+
+	o.mu.Lock()
+	recovering := o.recovering != nil
+	live := o.liveSlot
+	o.mu.Unlock()
+	if recovering {
+		return errors.New("recovery in progress")
+	}
+
+	if err := install(); err != nil {
+		return err
+	}
+
+	entry := JournalEntry{Action: "update", Version: to, PrevVersion: from}
+	if live != nil {
+		entry.Commit, entry.SlotDir = live.commit, live.name
+	}
+	if err := o.writeJournal(entry); err != nil {
+		fmt.Printf("warning: journal: %v\n", err)
+	}
+	return restart()
+}
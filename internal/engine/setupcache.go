@@ -0,0 +1,37 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// setupHash fingerprints the files named by setup_cache_keys (paths or glob
+// patterns relative to dir, typically lockfiles). Two checkouts with the same
+// hash need the same setup, so a staging dir already set up for that hash
+// can skip it. It returns "" when no keys are configured.
+func (o *Orchestrator) setupHash(dir string) string {
+	if len(o.cfg.SetupCacheKeys) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	h.Write([]byte(o.cfg.SetupCommand + "\x00"))
+	for _, pattern := range o.cfg.SetupCacheKeys {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		sort.Strings(matches)
+		h.Write([]byte(pattern + "\x00"))
+		for _, path := range matches {
+			rel, _ := filepath.Rel(dir, path)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			h.Write([]byte(rel + "\x00"))
+			h.Write(data)
+			h.Write([]byte{0})
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
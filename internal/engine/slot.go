@@ -0,0 +1,595 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"slot-machine/internal/proxy"
+)
+
+type slot struct {
+	name    string // directory basename, e.g. "slot-abc1234"
+	commit  string
+	dir     string // absolute path
+	proc    Process
+	done    chan struct{}
+	alive   bool
+	appPort int    // dynamic
+	intPort int    // dynamic
+	logPath string // stdout/stderr of the process
+	env     *EnvSnapshot
+	environ []string   // the process's full environment, if started by this daemon
+	pgid    int        // the process's group, if it's a real one
+	ready   *readyWait // its readiness callback, with ready_callback_timeout_ms
+
+	stopping atomic.Bool // drained on purpose: its exit isn't a crash
+
+	setupHash string       // setup_cache_keys fingerprint its dependencies were set up for
+	message   string       // the deploy's, if it came with one
+	release   *ReleaseSpec // env and config it runs with beyond its commit
+}
+
+// ProcessRunner runs the configured setup and start commands.
+type ProcessRunner interface {
+	// Run executes command in dir, writing its output to out, and waits for
+	// it to finish.
+	Run(dir, command string, env []string, out io.Writer) error
+	// Start launches command in dir in its own process group, sending its
+	// output to logPath.
+	Start(dir, command string, env []string, logPath string) (Process, error)
+}
+
+// Process is a started app process.
+type Process interface {
+	// Signal delivers sig to the process's whole group.
+	Signal(sig syscall.Signal) error
+	// Wait blocks until the process exits.
+	Wait() error
+	// Pgid returns the ID of the process's group, or 0 if it has none.
+	Pgid() int
+}
+
+// HealthChecker decides whether a freshly started slot is ready for traffic.
+type HealthChecker interface {
+	// WaitHealthy polls path on the slot's port until it is healthy, the
+	// process exits (exited is closed), or timeout passes.
+	WaitHealthy(port int, path string, timeout time.Duration, exited <-chan struct{}) bool
+}
+
+// scheduledChecker is a HealthChecker that can also pace its polls by a
+// probeSchedule and report each poll that didn't pass, for deploy progress.
+type scheduledChecker interface {
+	WaitHealthySchedule(port int, path string, sched probeSchedule, exited <-chan struct{}, attempt func(n int, result string)) bool
+}
+
+// execRunner runs commands through /bin/sh. Started processes' output also
+// goes to logs, tagged with the slot's name.
+type execRunner struct {
+	logs *LogStream
+}
+
+func (execRunner) Run(dir, command string, env []string, out io.Writer) error {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return cmd.Run()
+}
+
+func (r execRunner) Start(dir, command string, env []string, logPath string) (Process, error) {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Dir = dir
+	cmd.Env = env
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	var pr *os.File
+	if err == nil && r.logs == nil {
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+		defer logFile.Close()
+	} else if err == nil {
+		// Through a pipe of our own rather than cmd.Stdout = writer, so Wait
+		// doesn't wait on anything the app left holding the pipe open.
+		var pw *os.File
+		pr, pw, err = os.Pipe()
+		if err != nil {
+			logFile.Close()
+			return nil, err
+		}
+		cmd.Stdout = pw
+		cmd.Stderr = pw
+		defer pw.Close()
+		go copyOutput(r.logs, pr, logFile)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &execProcess{cmd: cmd, output: pr}, nil
+}
+
+// copyOutput copies a slot process's output from pr to its log file and,
+// tagged with the log file's name, to logs.
+func copyOutput(logs *LogStream, pr, logFile *os.File) {
+	tagged := logs.Writer(LogRecord{Source: SourceSlot, Slot: strings.TrimSuffix(filepath.Base(logFile.Name()), ".log")})
+	io.Copy(io.MultiWriter(logFile, tagged), pr)
+	tagged.Close()
+	logFile.Close()
+	pr.Close()
+}
+
+type execProcess struct {
+	cmd    *exec.Cmd
+	output *os.File // read end of its output pipe; nil if it writes to its log file
+}
+
+func (p *execProcess) Signal(sig syscall.Signal) error {
+	return syscall.Kill(-p.cmd.Process.Pid, sig)
+}
+
+func (p *execProcess) Wait() error { return p.cmd.Wait() }
+
+// Pgid is the process's own ID: Start makes it the leader of its group.
+func (p *execProcess) Pgid() int { return p.cmd.Process.Pid }
+
+func (p *execProcess) outputPipe() *os.File { return p.output }
+
+// httpHealthChecker polls a GET endpoint until it answers 200.
+type httpHealthChecker struct{}
+
+func (h httpHealthChecker) WaitHealthy(port int, path string, timeout time.Duration, exited <-chan struct{}) bool {
+	return h.WaitHealthySchedule(port, path, defaultSchedule(timeout), exited, nil)
+}
+
+func (httpHealthChecker) WaitHealthySchedule(port int, path string, sched probeSchedule, exited <-chan struct{}, attempt func(int, string)) bool {
+	deadline := time.Now().Add(sched.timeout)
+	url := fmt.Sprintf("http://127.0.0.1:%d%s", port, path)
+	client := &http.Client{Timeout: 500 * time.Millisecond}
+
+	select {
+	case <-exited:
+		return false
+	case <-time.After(sched.initialDelay):
+	}
+	interval := sched.interval
+	for n := 1; time.Now().Before(deadline); n++ {
+		select {
+		case <-exited:
+			return false
+		default:
+		}
+
+		resp, err := client.Get(url)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == 200 {
+				return true
+			}
+		}
+		if attempt != nil {
+			if err != nil {
+				attempt(n, "not answering")
+			} else {
+				attempt(n, resp.Status)
+			}
+		}
+		if sched.failureThreshold > 0 && n >= sched.failureThreshold {
+			return false
+		}
+		select {
+		case <-exited:
+			return false
+		case <-time.After(min(interval, time.Until(deadline))):
+		}
+		interval = sched.next(interval)
+	}
+	return false
+}
+
+func findFreePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	return port, nil
+}
+
+func (o *Orchestrator) runSetup(dir string, rel *ReleaseSpec, appPort, intPort int, out io.Writer) error {
+	return o.runner.Run(dir, o.cfg.SetupCommand, o.buildEnv(rel, appPort, intPort), out)
+}
+
+func (o *Orchestrator) buildEnv(rel *ReleaseSpec, appPort, intPort int) []string {
+	_, fromFile, fromRelease, injected := o.envParts(rel, appPort, intPort)
+	return append(append(append(os.Environ(), fromFile...), fromRelease...), injected...)
+}
+
+// envParts returns the resolved env_file path (empty if none), its
+// variables, rel's env overrides, and the variables slot-machine sets
+// itself, in the order buildEnv applies them after the daemon's own
+// environment.
+func (o *Orchestrator) envParts(rel *ReleaseSpec, appPort, intPort int) (envPath string, fromFile, fromRelease, injected []string) {
+	if o.cfg.EnvFile != "" {
+		envPath = o.cfg.EnvFile
+		if !filepath.IsAbs(envPath) {
+			envPath = filepath.Join(o.repoDir, envPath)
+		}
+		if extra, err := LoadEnvFile(envPath); err == nil {
+			fromFile = extra
+		}
+	}
+	injected = []string{
+		"SLOT_MACHINE=1",
+		fmt.Sprintf("PORT=%d", appPort),
+		fmt.Sprintf("INTERNAL_PORT=%d", intPort),
+	}
+	if o.authSecret != "" {
+		injected = append(injected, "SLOT_MACHINE_AUTH_SECRET="+o.authSecret,
+			fmt.Sprintf("SLOT_MACHINE_AUTH_MAX_AGE=%d", int(AuthMaxAge(o.cfg).Seconds())))
+	}
+	return envPath, fromFile, rel.environ(), injected
+}
+
+func (o *Orchestrator) startProcess(dir, commit string, rel *ReleaseSpec, appPort, intPort int, extraEnv ...string) (*slot, error) {
+	logName := filepath.Base(dir)
+	if strings.HasPrefix(logName, deployDirPrefix) {
+		// A deploy's output goes where it always has, whatever its dir.
+		logName = "slot-staging"
+	}
+	logPath := filepath.Join(o.dataDir, logName+".log")
+	envPath, fromFile, fromRelease, injected := o.envParts(rel, appPort, intPort)
+	injected = append(injected, extraEnv...)
+	o.mu.Lock()
+	ready, readyEnv := o.readyCallback()
+	o.mu.Unlock()
+	injected = append(injected, readyEnv...)
+	inherited := os.Environ()
+	env := append(append(append(append([]string{}, inherited...), fromFile...), fromRelease...), injected...)
+	o.ports.release(appPort, intPort)
+	proc, err := o.runner.Start(dir, o.cfg.StartCommand, env, logPath)
+	if err != nil {
+		o.forgetReady(ready)
+		return nil, err
+	}
+
+	s := &slot{
+		name:    filepath.Base(dir),
+		commit:  commit,
+		dir:     dir,
+		proc:    proc,
+		done:    make(chan struct{}),
+		alive:   true,
+		appPort: appPort,
+		intPort: intPort,
+		logPath: logPath,
+		env:     newEnvSnapshot(commit, o.cfg.StartCommand, envPath, appPort, intPort, inherited, fromFile, fromRelease, injected),
+		environ: env,
+		ready:   ready,
+		release: rel,
+	}
+	info := s.proxyInfo()
+	o.appProxy.SetSlotInfo(info)
+	if s.pgid = proc.Pgid(); s.pgid > 0 {
+		o.trackProcs(s, true)
+	}
+	go o.watch(s, info)
+
+	return s, nil
+}
+
+// watch waits for s's process to exit, marks s dead, and has the live
+// release restarted if it crashed. info is what the app proxy was told
+// about s when it started.
+func (o *Orchestrator) watch(s *slot, info proxy.SlotInfo) {
+	s.proc.Wait()
+	o.forgetReady(s.ready)
+	if s.pgid > 0 {
+		o.trackProcs(s, false)
+	}
+	o.appProxy.ForgetSlot(info)
+	o.mu.Lock()
+	s.alive = false
+	crashed := o.liveSlot == s && !s.stopping.Load() && !o.stopping
+	if o.liveSlot == s {
+		o.appProxy.ClearTarget()
+		o.intProxy.ClearTarget()
+	}
+	o.mu.Unlock()
+	close(s.done)
+	if crashed {
+		o.liveCrashed(s)
+	}
+}
+
+// proxyInfo is what the app proxy reports about s in slot headers and
+// /agent/whoami.
+func (s *slot) proxyInfo() proxy.SlotInfo {
+	return proxy.SlotInfo{Slot: s.name, Commit: s.commit, AppPort: s.appPort, InternalPort: s.intPort}
+}
+
+// DrainAll stops the live, previous, mirror candidate, and preview
+// processes, waiting up to the drain timeout for each.
+func (o *Orchestrator) DrainAll() {
+	o.drainAll(false)
+}
+
+// drainAll is DrainAll, leaving the live slot running if keepLive is set.
+func (o *Orchestrator) drainAll(keepLive bool) {
+	o.mu.Lock()
+	o.stopping = true
+	o.stopTunnel()
+	var slots []*slot
+	if o.liveSlot != nil && !keepLive {
+		slots = append(slots, o.liveSlot)
+	}
+	if o.prevSlot != nil && o.prevSlot.proc != nil {
+		slots = append(slots, o.prevSlot)
+	}
+	if o.recovering != nil {
+		slots = append(slots, o.recovering)
+	}
+	if o.mirrorSlot != nil {
+		slots = append(slots, o.mirrorSlot)
+	}
+	for _, p := range o.previews {
+		slots = append(slots, p.slot)
+	}
+	o.mu.Unlock()
+	for _, s := range slots {
+		o.drain(s)
+	}
+}
+
+// defaultShutdownTimeout is how long Shutdown waits for requests in flight
+// without shutdown_timeout_ms.
+const defaultShutdownTimeout = 10 * time.Second
+
+// Shutdown stops the daemon's traffic in order, so no request is cut off:
+// the proxies stop accepting connections, the requests in flight get up to
+// shutdown_timeout_ms to be answered, and only then are the slots drained.
+func (o *Orchestrator) Shutdown() {
+	o.closeProxies()
+	o.DrainAll()
+}
+
+// closeProxies stops the proxies accepting connections and waits up to
+// shutdown_timeout_ms for the requests in flight.
+func (o *Orchestrator) closeProxies() {
+	o.mu.Lock()
+	timeout := defaultShutdownTimeout
+	if o.cfg.ShutdownTimeoutMs > 0 {
+		timeout = time.Duration(o.cfg.ShutdownTimeoutMs) * time.Millisecond
+	}
+	o.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range []*proxy.Proxy{o.appProxy, o.intProxy} {
+		if p == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !p.Close(timeout) {
+				fmt.Printf("warning: requests to %s still in flight after %s; closing their connections\n", p.Addr(), timeout)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// KillAll sends SIGKILL to every slot process without waiting for a drain.
+// A DrainAll already in progress returns as soon as the processes exit.
+func (o *Orchestrator) KillAll() {
+	o.mu.Lock()
+	var procs []Process
+	for _, s := range []*slot{o.liveSlot, o.prevSlot, o.recovering, o.mirrorSlot} {
+		if s != nil && s.proc != nil {
+			procs = append(procs, s.proc)
+		}
+	}
+	for _, p := range o.previews {
+		procs = append(procs, p.slot.proc)
+	}
+	o.mu.Unlock()
+	for _, p := range procs {
+		p.Signal(syscall.SIGKILL)
+	}
+}
+
+func (o *Orchestrator) drain(s *slot) {
+	if s == nil || s.proc == nil {
+		return
+	}
+
+	s.stopping.Store(true)
+	timeout := time.Duration(o.cfg.DrainTimeoutMs) * time.Millisecond
+	o.waitIdle(s, timeout)
+	if o.cfg.PreStopCommand != "" {
+		o.preStop(s, timeout)
+	}
+	o.chaos.delay("drain of " + s.name)
+	s.proc.Signal(o.stopSignal())
+
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+		s.proc.Signal(syscall.SIGKILL)
+		<-s.done
+	}
+}
+
+// waitIdle waits up to timeout for the requests the proxies sent s before
+// they moved on to finish, so stopping it doesn't cut them off. A proxy
+// still targeting s (nothing replaced it) isn't waited on: it keeps
+// sending s new requests.
+func (o *Orchestrator) waitIdle(s *slot, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for _, pp := range []struct {
+		p    *proxy.Proxy
+		port int
+	}{{o.appProxy, s.appPort}, {o.intProxy, s.intPort}} {
+		if pp.p == nil || pp.port == 0 || pp.p.Target() == pp.port {
+			continue
+		}
+		if !pp.p.WaitIdle(pp.port, time.Until(deadline)) {
+			fmt.Printf("warning: %s: %d requests still in flight after %s; stopping it anyway\n", s.name, pp.p.InFlight(pp.port), timeout)
+			return
+		}
+	}
+}
+
+// preStop runs pre_stop_command for s, in its dir and environment, with
+// its output going to the slot's log, and waits up to timeout for it. A
+// failure is only reported: s is stopped either way.
+func (o *Orchestrator) preStop(s *slot, timeout time.Duration) {
+	var out io.Writer = io.Discard
+	f, err := os.OpenFile(s.logPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err == nil {
+		out = f
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- o.runner.Run(s.dir, o.cfg.PreStopCommand, s.environ, out)
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			fmt.Printf("warning: %s: pre_stop_command: %v\n", s.name, err)
+		}
+	case <-s.done:
+	case <-time.After(timeout):
+		fmt.Printf("warning: %s: pre_stop_command still running after %s; stopping the slot anyway\n", s.name, timeout)
+	}
+}
+
+// stopSignals are the signals stop_signal can name, with or without "SIG".
+var stopSignals = map[string]syscall.Signal{
+	"SIGTERM":  syscall.SIGTERM,
+	"SIGINT":   syscall.SIGINT,
+	"SIGQUIT":  syscall.SIGQUIT,
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGWINCH": syscall.SIGWINCH,
+}
+
+// stopSignal is the signal that asks a slot to stop: stop_signal, or
+// SIGTERM if it's unset or unknown.
+func (o *Orchestrator) stopSignal() syscall.Signal {
+	name := strings.ToUpper(o.cfg.StopSignal)
+	if name == "" {
+		return syscall.SIGTERM
+	}
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig, ok := stopSignals[name]; ok {
+		return sig
+	}
+	fmt.Printf("warning: unknown stop_signal %q; sending SIGTERM\n", o.cfg.StopSignal)
+	return syscall.SIGTERM
+}
+
+// healthCheck waits for s to be ready within the startup timeout. attempt, if
+// not nil, is told about each poll that didn't pass.
+func (o *Orchestrator) healthCheck(s *slot, attempt func(int, string)) bool {
+	return o.waitReady(s, o.startupTimeout(), attempt)
+}
+
+// waitReady health-checks s and then warms it up. A readiness callback
+// from s takes the place of the checks; without one, the internal health
+// endpoint and, when app_health_endpoint is set, the app port are checked
+// concurrently; s is ready once both pass, and not ready as soon as either
+// fails.
+func (o *Orchestrator) waitReady(s *slot, timeout time.Duration, attempt func(int, string)) bool {
+	if s.ready != nil {
+		started := time.Now()
+		if o.awaitCallback(s, timeout) {
+			o.warmup(s)
+			return true
+		}
+		if timeout -= time.Since(started); timeout <= 0 {
+			return false
+		}
+	}
+
+	type check struct {
+		port int
+		path string
+	}
+	checks := []check{{s.intPort, o.cfg.HealthEndpoint}}
+	if o.cfg.AppHealthEndpoint != "" {
+		checks = append(checks, check{s.appPort, o.cfg.AppHealthEndpoint})
+	}
+
+	results := make(chan bool, len(checks))
+	for _, c := range checks {
+		go func() { results <- o.waitHealthy(c.port, c.path, timeout, s.done, attempt) }()
+	}
+	// A failed slot gets killed by the caller, which ends any check still
+	// polling it.
+	for range checks {
+		if !<-results {
+			return false
+		}
+	}
+
+	o.warmup(s)
+	return true
+}
+
+// waitHealthy is o.health.WaitHealthy, paced by startup_probe and telling
+// attempt about failed polls if the checker can.
+func (o *Orchestrator) waitHealthy(port int, path string, timeout time.Duration, exited <-chan struct{}, attempt func(int, string)) bool {
+	h, ok := o.health.(scheduledChecker)
+	if !ok {
+		return o.health.WaitHealthy(port, path, timeout, exited)
+	}
+	var report func(int, string)
+	if attempt != nil {
+		report = func(n int, result string) {
+			attempt(n, fmt.Sprintf(":%d%s %s", port, path, result))
+		}
+	}
+	return h.WaitHealthySchedule(port, path, o.probeSchedule(timeout), exited, report)
+}
+
+// warmupTimeout bounds each warmup request.
+const warmupTimeout = 30 * time.Second
+
+// warmup requests each of warmup_urls from s's app port, in order, so the
+// first real users don't pay for cold caches or JIT. Failures are logged
+// but don't stop the deploy.
+func (o *Orchestrator) warmup(s *slot) {
+	client := &http.Client{Timeout: warmupTimeout}
+	for _, path := range o.cfg.WarmupURLs {
+		resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d%s", s.appPort, path))
+		if err != nil {
+			fmt.Printf("warning: warmup %s: %v\n", path, err)
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			fmt.Printf("warning: warmup %s: status %d\n", path, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// smokeOutputLimit caps the smoke_command output kept in the deploy response
+// and journal. The tail is what usually explains a failure.
+const smokeOutputLimit = 4096
+
+// runSmoke runs smoke_command in s's directory against s, which is already
+// taking traffic. SLOT_MACHINE_URL points straight at the slot's app port.
+// It returns the tail of the output and the command's error.
+func (o *Orchestrator) runSmoke(s *slot) (string, error) {
+	env := append(o.buildEnv(s.release, s.appPort, s.intPort), fmt.Sprintf("SLOT_MACHINE_URL=http://127.0.0.1:%d", s.appPort))
+	var buf bytes.Buffer
+	err := o.runner.Run(s.dir, o.cfg.SmokeCommand, env, io.MultiWriter(os.Stdout, &buf))
+	out := buf.String()
+	if len(out) > smokeOutputLimit {
+		out = "..." + out[len(out)-smokeOutputLimit:]
+	}
+	return out, err
+}
+
+// smokeFailed rolls back a deploy whose smoke test failed and reports it.
+func (o *Orchestrator) smokeFailed(resp DeployResponse, smokeErr error) (DeployResponse, int) {
+	resp.Error = "smoke test failed: " + smokeErr.Error()
+	rb, _ := o.rollbackLocked("", false)
+	if rb.Success {
+		resp.RolledBack = true
+		resp.Error += "; rolled back to " + ShortHash(rb.Commit)
+	} else {
+		resp.Error += "; rollback failed: " + rb.Error
+	}
+	return resp, 200
+}
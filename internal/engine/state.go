@@ -0,0 +1,382 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+)
+
+func atomicSymlink(linkPath, target string) error {
+	tmpLink := linkPath + ".tmp"
+	os.Remove(tmpLink)
+	if err := os.Symlink(target, tmpLink); err != nil {
+		return err
+	}
+	return os.Rename(tmpLink, linkPath)
+}
+
+// stateVersion is bumped whenever persistedState changes incompatibly. Files
+// with another version are ignored and recovery falls back to the symlinks.
+const stateVersion = 1
+
+// persistedState is state.json: everything needed to resume after a restart.
+// The live/prev symlinks are still written for humans poking at the data dir.
+type persistedState struct {
+	Version    int          `json:"version"`
+	Live       *slotState   `json:"live,omitempty"`
+	Prev       *slotState   `json:"prev,omitempty"`
+	Retained   []*slotState `json:"retained,omitempty"`    // newest first
+	LastDeploy string       `json:"last_deploy,omitempty"` // RFC3339
+
+	Freeze *Freeze `json:"lock,omitempty"` // deploys locked
+
+	// A standby's copy of the primary's live release, set up for promote,
+	// and whether it was promoted (see peer.go).
+	Warm     *slotState `json:"warm,omitempty"`
+	Promoted bool       `json:"promoted,omitempty"`
+
+	Procs []procGroup `json:"procs,omitempty"` // slot process groups running when written
+}
+
+type slotState struct {
+	Name    string `json:"name"`
+	Commit  string `json:"commit"`
+	AppPort int    `json:"app_port,omitempty"`
+	IntPort int    `json:"int_port,omitempty"`
+
+	SetupHash string       `json:"setup_hash,omitempty"`
+	Env       *EnvSnapshot `json:"env,omitempty"`     // what it was last started with
+	Message   string       `json:"message,omitempty"` // the deploy's
+	Release   *ReleaseSpec `json:"release,omitempty"`
+}
+
+func newSlotState(s *slot) *slotState {
+	if s == nil {
+		return nil
+	}
+	return &slotState{Name: s.name, Commit: s.commit, AppPort: s.appPort, IntPort: s.intPort, SetupHash: s.setupHash, Env: s.env, Message: s.message, Release: s.release}
+}
+
+// saveState records the current slots in state.json.
+func (o *Orchestrator) saveState() error {
+	o.mu.Lock()
+	live := o.liveSlot
+	if live == nil {
+		live = o.recovering
+	}
+	st := persistedState{
+		Version:  stateVersion,
+		Live:     newSlotState(live),
+		Prev:     newSlotState(o.prevSlot),
+		Freeze:   o.freeze,
+		Warm:     newSlotState(o.warm),
+		Promoted: o.promoted,
+	}
+	for _, s := range o.retained {
+		st.Retained = append(st.Retained, newSlotState(s))
+	}
+	if !o.lastDeploy.IsZero() {
+		st.LastDeploy = o.lastDeploy.Format(time.RFC3339)
+	}
+	o.mu.Unlock()
+	return o.writeState(st)
+}
+
+// writeState writes st to state.json, with the slot processes running now.
+func (o *Orchestrator) writeState(st persistedState) error {
+	o.stateMu.Lock()
+	defer o.stateMu.Unlock()
+	st.Procs = o.procGroups()
+	return o.writeStateFile(st)
+}
+
+// writeStateFile writes st to state.json atomically (temp file, fsync,
+// rename).
+func (o *Orchestrator) writeStateFile(st persistedState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(o.dataDir, "state.json")
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	f.Close()
+	return os.Rename(tmp, path)
+}
+
+// loadState reads state.json. It returns nil if the file is missing,
+// unreadable, or from another version.
+func (o *Orchestrator) loadState() *persistedState {
+	data, err := os.ReadFile(filepath.Join(o.dataDir, "state.json"))
+	if err != nil {
+		return nil
+	}
+	var st persistedState
+	if err := json.Unmarshal(data, &st); err != nil {
+		fmt.Printf("warning: ignoring corrupt state.json: %v\n", err)
+		return nil
+	}
+	if st.Version != stateVersion {
+		fmt.Printf("warning: ignoring state.json version %d (want %d)\n", st.Version, stateVersion)
+		return nil
+	}
+	return &st
+}
+
+// stateFromSymlinks rebuilds what it can from the live/prev symlinks, for
+// data dirs written before state.json existed.
+func (o *Orchestrator) stateFromSymlinks() *persistedState {
+	st := &persistedState{Version: stateVersion}
+	for _, link := range []struct {
+		name string
+		dst  **slotState
+	}{{"live", &st.Live}, {"prev", &st.Prev}} {
+		target, err := os.Readlink(filepath.Join(o.dataDir, link.name))
+		if err != nil {
+			continue
+		}
+		if commit := o.worktrees.Commit(filepath.Join(o.dataDir, target)); commit != "" {
+			*link.dst = &slotState{Name: target, Commit: commit}
+		}
+	}
+	return st
+}
+
+// defaultRecoveryTimeout is how long a restarted live slot gets to come up
+// when recovery_timeout_ms isn't set. Recovery runs in the background, so it
+// can afford to be far more patient than a deploy.
+const defaultRecoveryTimeout = 5 * time.Minute
+
+func (o *Orchestrator) recoveryTimeout() time.Duration {
+	if o.cfg.RecoveryTimeoutMs > 0 {
+		return time.Duration(o.cfg.RecoveryTimeoutMs) * time.Millisecond
+	}
+	return max(defaultRecoveryTimeout, o.startupTimeout())
+}
+
+// RecoverState restarts the slot that was live when the daemon stopped, and
+// remembers the prev slot for rollback. It reads state.json, falling back to
+// the live/prev symlinks, and first repairs the slots' git worktrees.
+//
+// The restarted slot boots in the background: RecoverState returns once the
+// process is started, and the returned channel yields true when the slot
+// passes its health check and goes live, or false if there was nothing to
+// recover, it failed, or a deploy superseded it. A live slot handed off by
+// the daemon that re-exec'd into this one is taken over as it runs, and the
+// channel yields true at once.
+func (o *Orchestrator) RecoverState() <-chan bool {
+	result := make(chan bool, 1)
+
+	st := o.loadState()
+	if st == nil {
+		st = o.stateFromSymlinks()
+	}
+	if t, err := time.Parse(time.RFC3339, st.LastDeploy); err == nil {
+		o.lastDeploy = t
+	}
+	o.freeze = st.Freeze
+	if st.Promoted {
+		o.promoted = true
+		if o.standby != nil {
+			fmt.Printf("warning: this daemon was promoted; ignoring peer.primary %s (remove peer from the config)\n", o.standby.Primary)
+			o.standby = nil
+		}
+	}
+	standby := o.standby != nil
+
+	// Processes the last daemon couldn't stop hold the ports the live slot
+	// would get back. The live slot's, handed off by a daemon that re-exec'd
+	// into this one, is taken over instead.
+	procs := st.Procs
+	if h := o.handoff; h != nil && h.Live != nil {
+		if !standby && st.Live != nil && st.Live.Name == h.Live.Name {
+			procs = slices.DeleteFunc(slices.Clone(procs), func(g procGroup) bool { return g.PGID == h.Live.Pid })
+		} else {
+			o.handoff.Live = nil
+		}
+	}
+	o.stopOrphans(procs)
+
+	// Before anything prunes worktrees: a slot whose metadata a crash left
+	// pointing at the wrong dir would lose it.
+	for _, fix := range o.repairWorktrees(st) {
+		fmt.Printf("worktree repair: %s\n", fix)
+	}
+
+	var keep []string
+	for _, ss := range append([]*slotState{st.Live, st.Prev, st.Warm}, st.Retained...) {
+		if ss != nil {
+			keep = append(keep, ss.Name)
+		}
+	}
+	o.removeDeployDirs(keep)
+
+	// A standby runs nothing: it only keeps the warm slot.
+	if standby {
+		if st.Live != nil {
+			fmt.Printf("standby: not restarting %s, live when this daemon last ran; following %s\n", st.Live.Name, o.standby.Primary)
+		}
+		if st.Warm != nil {
+			if o.warm = o.stoppedSlot(st.Warm); o.warm != nil {
+				o.standby.WarmSlot, o.standby.WarmCommit = o.warm.name, o.warm.commit
+			}
+		}
+		o.saveState()
+		result <- false
+		return result
+	}
+
+	var s *slot
+	adopted := false
+	if st.Live != nil && o.handoff != nil && o.handoff.Live != nil {
+		s = o.adoptLive(st.Live)
+		adopted = s != nil
+	}
+	if st.Live != nil && s == nil {
+		s = o.restartLive(st.Live)
+	}
+	o.handoff = nil
+
+	if st.Prev != nil {
+		if o.prevSlot = o.stoppedSlot(st.Prev); o.prevSlot == nil {
+			os.Remove(filepath.Join(o.dataDir, "prev"))
+		}
+	}
+	for _, r := range st.Retained {
+		if s := o.stoppedSlot(r); s != nil {
+			o.retained = append(o.retained, s)
+		}
+	}
+
+	if st.Live != nil || st.Prev != nil || len(st.Retained) > 0 {
+		o.saveState()
+	}
+
+	if s == nil || adopted {
+		result <- adopted
+		return result
+	}
+	o.Publish(EventRecoveryStarted, s.commit, s.name, nil)
+	go func() {
+		start := time.Now()
+		ok := o.awaitRecovery(s, o.recoveryTimeout())
+		errMsg := ""
+		if !ok {
+			errMsg = "not healthy within recovery_timeout_ms, or replaced"
+		}
+		o.publishOutcome(EventRecoveryFinished, s.commit, s.name, ok, errMsg, start)
+		result <- ok
+	}()
+	return result
+}
+
+// stoppedSlot returns a not-running slot for st, or nil if its directory
+// is gone.
+func (o *Orchestrator) stoppedSlot(st *slotState) *slot {
+	dir := filepath.Join(o.dataDir, st.Name)
+	if _, err := os.Stat(dir); err != nil {
+		return nil
+	}
+	s := &slot{
+		name:      st.Name,
+		commit:    st.Commit,
+		dir:       dir,
+		done:      make(chan struct{}),
+		appPort:   st.AppPort,
+		intPort:   st.IntPort,
+		setupHash: st.SetupHash,
+		env:       st.Env,
+		message:   st.Message,
+		release:   st.Release,
+	}
+	close(s.done) // Not running.
+	return s
+}
+
+// restartLive starts the live slot again, on its previous ports when they're
+// still free, and marks it as recovering.
+func (o *Orchestrator) restartLive(live *slotState) *slot {
+	slotDir := filepath.Join(o.dataDir, live.Name)
+	if _, err := os.Stat(slotDir); err != nil {
+		os.Remove(filepath.Join(o.dataDir, "live"))
+		return nil
+	}
+
+	appPort, intPort, err := o.slotPorts(live.AppPort, live.IntPort)
+	if err != nil {
+		fmt.Printf("warning: failed to restart live slot: %v\n", err)
+		return nil
+	}
+	o.mu.Lock()
+	o.useRelease(live.Release.config())
+	o.mu.Unlock()
+	defer o.ports.release(appPort, intPort)
+
+	s, err := o.startProcess(slotDir, live.Commit, live.Release, appPort, intPort)
+	if err != nil {
+		fmt.Printf("warning: failed to restart live slot: %v\n", err)
+		return nil
+	}
+	s.name = live.Name
+	s.setupHash = live.SetupHash
+	s.message = live.Message
+
+	o.mu.Lock()
+	o.recovering = s
+	o.mu.Unlock()
+	fmt.Printf("recovering live slot: %s (%s)\n", live.Name, ShortHash(live.Commit))
+	return s
+}
+
+// awaitRecovery waits up to timeout for s to become healthy, then makes it
+// live unless a deploy or rollback got there first.
+func (o *Orchestrator) awaitRecovery(s *slot, timeout time.Duration) bool {
+	ok := o.waitReady(s, timeout, nil)
+
+	o.mu.Lock()
+	if o.recovering != s {
+		// Superseded; whoever replaced it drains it.
+		o.mu.Unlock()
+		return false
+	}
+	o.recovering = nil
+	if !ok {
+		o.mu.Unlock()
+		fmt.Printf("warning: recovered slot %s never became healthy\n", s.name)
+		s.proc.Signal(syscall.SIGKILL)
+		<-s.done
+		return false
+	}
+	o.liveSlot = s
+	// Switch under the lock so a concurrent deploy can't be overtaken.
+	if err := o.appProxy.SetTarget(s.appPort); err != nil {
+		fmt.Printf("warning: %v\n", err)
+	}
+	if err := o.intProxy.SetTarget(s.intPort); err != nil {
+		fmt.Printf("warning: %v\n", err)
+	}
+	o.mu.Unlock()
+
+	if err := o.saveState(); err != nil {
+		fmt.Printf("warning: saving state: %v\n", err)
+	}
+	fmt.Printf("recovered live slot: %s (%s)\n", s.name, ShortHash(s.commit))
+	return true
+}
@@ -0,0 +1,139 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Deploy trackers hear about deploys and rollbacks as they are journaled
+// (the journaled event):
+// Sentry gets a release and a deploy of it, Grafana an annotation, and
+// Honeycomb a marker. Each is posted in the background, best-effort; a
+// tracker that's down is logged and never holds up a deploy.
+
+const trackerTimeout = 10 * time.Second
+
+// trackedActions are the journal entries that change what's live.
+var trackedActions = map[string]bool{"deploy": true, "rollback": true}
+
+// trackDeploy tells every configured tracker about a journaled entry.
+func (o *Orchestrator) trackDeploy(e DaemonEvent) {
+	entry, ok := e.Data.(JournalEntry)
+	if !ok {
+		return
+	}
+	o.mu.Lock()
+	trackers := o.cfg.DeployTrackers
+	o.mu.Unlock()
+	if len(trackers) == 0 || !trackedActions[entry.Action] {
+		return
+	}
+	for _, t := range trackers {
+		go func() {
+			if err := o.postTracker(t, entry); err != nil {
+				fmt.Printf("warning: deploy tracker %s: %v\n", t.Type, err)
+			}
+		}()
+	}
+}
+
+func (o *Orchestrator) postTracker(t DeployTracker, entry JournalEntry) error {
+	token := ""
+	if t.TokenEnv != "" {
+		if token = os.Getenv(t.TokenEnv); token == "" {
+			return fmt.Errorf("$%s is not set", t.TokenEnv)
+		}
+	}
+	version := strings.TrimPrefix(entry.Commit, artifactPrefix)
+	text := fmt.Sprintf("%s %s %s", o.app, entry.Action, ShortHash(version))
+	if entry.PrevCommit != "" {
+		text += " (was " + ShortHash(strings.TrimPrefix(entry.PrevCommit, artifactPrefix)) + ")"
+	}
+	if entry.Message != "" {
+		text += ": " + entry.Message
+	}
+
+	bearer := http.Header{}
+	if token != "" {
+		bearer.Set("Authorization", "Bearer "+token)
+	}
+
+	switch t.Type {
+	case "sentry":
+		base := trackerBase(t.URL, "https://sentry.io")
+		releases := base + "/api/0/organizations/" + url.PathEscape(t.Org) + "/releases/"
+		env := t.Environment
+		if env == "" {
+			env = "production"
+		}
+		// Creating a release that exists already is fine (208).
+		if err := postTrackerJSON(releases, bearer, map[string]any{
+			"version":  version,
+			"projects": []string{t.Project},
+		}); err != nil {
+			return err
+		}
+		return postTrackerJSON(releases+url.PathEscape(version)+"/deploys/", bearer, map[string]any{
+			"environment": env,
+			"name":        text,
+		})
+	case "grafana":
+		if t.URL == "" {
+			return fmt.Errorf("url is required")
+		}
+		return postTrackerJSON(trackerBase(t.URL, "")+"/api/annotations", bearer, map[string]any{
+			"time": time.Now().UnixMilli(),
+			"tags": append([]string{"slot-machine", o.app, entry.Action}, t.Tags...),
+			"text": text,
+		})
+	case "honeycomb":
+		dataset := t.Dataset
+		if dataset == "" {
+			dataset = "__all__"
+		}
+		h := http.Header{}
+		h.Set("X-Honeycomb-Team", token)
+		return postTrackerJSON(trackerBase(t.URL, "https://api.honeycomb.io")+"/1/markers/"+url.PathEscape(dataset), h, map[string]any{
+			"message":    text,
+			"type":       "slot-machine " + entry.Action,
+			"start_time": time.Now().Unix(),
+		})
+	default:
+		return fmt.Errorf("unknown type %q (want sentry, grafana, or honeycomb)", t.Type)
+	}
+}
+
+func trackerBase(configured, fallback string) string {
+	if configured == "" {
+		return fallback
+	}
+	return strings.TrimRight(configured, "/")
+}
+
+// postTrackerJSON posts body as JSON with the given headers.
+func postTrackerJSON(endpoint string, header http.Header, body any) error {
+	data, _ := json.Marshal(body)
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header = header.Clone()
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: trackerTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %d", endpoint, resp.StatusCode)
+	}
+	return nil
+}
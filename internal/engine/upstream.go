@@ -0,0 +1,138 @@
+package engine
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// "Are we running the latest?" GET /status answers it by comparing the live
+// commit with the upstream branch, origin/main unless configured: how many
+// commits are live but not upstream (ahead), how many are upstream but not
+// yet deployed (behind), and the latest tag there. The daemon fetches the
+// remote every upstream_fetch_sec, so the answer is at most that old.
+
+// defaultUpstream is the branch compared with when upstream isn't set.
+const defaultUpstream = "origin/main"
+
+// defaultUpstreamFetch is the time between fetches of the remote.
+const defaultUpstreamFetch = 5 * time.Minute
+
+// UpstreamStatus is how the live commit compares with the upstream branch.
+type UpstreamStatus struct {
+	Ref        string `json:"ref"`                   // e.g. "origin/main"
+	Commit     string `json:"commit"`                // the branch's tip, as last fetched
+	Ahead      int    `json:"ahead"`                 // live commits that aren't upstream
+	Behind     int    `json:"behind"`                // upstream commits that aren't live: pending deploy
+	LatestTag  string `json:"latest_tag,omitempty"`  // the newest tag reachable from the branch
+	FetchedAt  string `json:"fetched_at,omitempty"`  // RFC3339; empty until the first fetch
+	FetchError string `json:"fetch_error,omitempty"` // why the last fetch failed
+}
+
+// upstreamRef returns the configured upstream branch and its remote. It
+// defaults to main on the configured remote.
+func (o *Orchestrator) upstreamRef() (ref, remote string) {
+	o.mu.Lock()
+	ref = o.cfg.Upstream
+	if ref == "" && o.cfg.Remote != "" {
+		ref = o.cfg.Remote + "/main"
+	}
+	o.mu.Unlock()
+	if ref == "" {
+		ref = defaultUpstream
+	}
+	remote, _, _ = strings.Cut(ref, "/")
+	return ref, remote
+}
+
+// WatchUpstream fetches the upstream remote every upstream_fetch_sec, so
+// GET /status can tell what hasn't been deployed. It never returns.
+func (o *Orchestrator) WatchUpstream() {
+	for {
+		o.mu.Lock()
+		sec := o.cfg.UpstreamFetchSec
+		o.mu.Unlock()
+		interval := defaultUpstreamFetch
+		if sec > 0 {
+			interval = time.Duration(sec) * time.Second
+		}
+		if sec >= 0 {
+			o.fetchUpstream()
+		}
+		time.Sleep(interval)
+	}
+}
+
+// fetchUpstream fetches the upstream remote and its tags, and records when
+// and how that went.
+func (o *Orchestrator) fetchUpstream() {
+	_, remote := o.upstreamRef()
+	err := o.fetchRemote(remote)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.upstreamFetched = time.Now()
+	o.upstreamFetchErr = ""
+	if err != nil {
+		o.upstreamFetchErr = err.Error()
+	}
+}
+
+// Upstream compares the live commit with the upstream branch, or returns
+// nil if the repo has no such branch.
+func (o *Orchestrator) Upstream() *UpstreamStatus {
+	return o.upstreamStatus(o.LiveCommit())
+}
+
+// upstreamStatus compares commit with the upstream branch, or returns nil
+// if the repo has no such branch. An artifact, which no branch contains,
+// is neither ahead nor behind.
+func (o *Orchestrator) upstreamStatus(commit string) *UpstreamStatus {
+	ref, _ := o.upstreamRef()
+	git := func(args ...string) (string, error) {
+		out, err := exec.Command("git", append([]string{"-C", o.repoDir}, args...)...).Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	tip, err := git("rev-parse", "--verify", "-q", ref+"^{commit}")
+	if err != nil {
+		return nil
+	}
+	st := &UpstreamStatus{Ref: ref, Commit: tip}
+	st.LatestTag, _ = git("describe", "--tags", "--abbrev=0", tip)
+	if commit != "" && !isArtifact(commit) {
+		if counts, err := git("rev-list", "--left-right", "--count", commit+"..."+tip); err == nil {
+			if ahead, behind, ok := strings.Cut(counts, "\t"); ok {
+				st.Ahead, _ = strconv.Atoi(ahead)
+				st.Behind, _ = strconv.Atoi(behind)
+			}
+		}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.upstreamFetched.IsZero() {
+		st.FetchedAt = o.upstreamFetched.Format(time.RFC3339)
+	}
+	st.FetchError = o.upstreamFetchErr
+	return st
+}
+
+// String summarizes s in a line, e.g. "3 behind origin/main (latest tag v1.4.0)".
+func (s *UpstreamStatus) String() string {
+	var where string
+	switch {
+	case s.Ahead == 0 && s.Behind == 0:
+		where = "up to date with " + s.Ref
+	case s.Ahead == 0:
+		where = fmt.Sprintf("%d behind %s", s.Behind, s.Ref)
+	case s.Behind == 0:
+		where = fmt.Sprintf("%d ahead of %s", s.Ahead, s.Ref)
+	default:
+		where = fmt.Sprintf("%d ahead of and %d behind %s", s.Ahead, s.Behind, s.Ref)
+	}
+	if s.LatestTag != "" {
+		where += fmt.Sprintf(" (latest tag %s)", s.LatestTag)
+	}
+	return where
+}
@@ -0,0 +1,454 @@
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// WorktreeManager owns the git checkouts that back each slot.
+type WorktreeManager interface {
+	// Checkout puts commit into dir, creating the worktree if needed.
+	Checkout(dir, commit string) error
+	// Promote renames a worktree from oldDir to newDir.
+	Promote(oldDir, newDir string) error
+	// Clone creates dstDir as a copy of srcDir at commit.
+	Clone(srcDir, dstDir, commit string) error
+	// Remove deletes the worktree at dir.
+	Remove(dir string)
+	// Commit returns the commit checked out in dir, or "" if unknown.
+	Commit(dir string) string
+	// Changes counts the uncommitted changes in dir, leaving out paths
+	// under ignore.
+	Changes(dir string, ignore []string) (WorktreeChanges, error)
+	// Stash sets aside dir's uncommitted changes outside ignore, untracked
+	// files included, and returns the commit holding them ("" if there
+	// were none).
+	Stash(dir string, ignore []string) (string, error)
+	// Unstash applies a commit returned by Stash to dir. Files it couldn't
+	// merge are left with conflict markers and returned.
+	Unstash(dir, stash string) (conflicts []string, err error)
+	// Repair fixes the worktrees at the keys of dirs whose git metadata a
+	// crash left pointing at the wrong place, rebuilding it at the commit
+	// dirs maps them to ("" if unknown) when it's lost, then drops the
+	// metadata of worktrees that are gone. It describes what it fixed.
+	Repair(dirs map[string]string) []string
+}
+
+// WorktreeChanges counts a worktree's uncommitted changes. Untracked files
+// survive a checkout (setup output usually is one), so only changes to
+// tracked files make it dirty.
+type WorktreeChanges struct {
+	Modified  int `json:"modified"` // changed, added to the index, or renamed
+	Deleted   int `json:"deleted"`
+	Untracked int `json:"untracked"` // not ignored by .gitignore
+}
+
+// Dirty reports whether a checkout would discard any of the changes.
+func (c WorktreeChanges) Dirty() bool { return c.Modified+c.Deleted > 0 }
+
+func (c WorktreeChanges) String() string {
+	return fmt.Sprintf("%d modified, %d deleted, %d untracked", c.Modified, c.Deleted, c.Untracked)
+}
+
+// gitWorktrees implements WorktreeManager with git worktrees of repoDir.
+type gitWorktrees struct {
+	repoDir string
+}
+
+func (g *gitWorktrees) Checkout(slotDir, commit string) error {
+	if _, err := os.Stat(filepath.Join(slotDir, ".git")); err == nil {
+		cmd := exec.Command("git", "checkout", "--force", "--detach", commit)
+		cmd.Dir = slotDir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("git checkout in worktree: %s: %w", out, err)
+		}
+		return nil
+	}
+
+	os.RemoveAll(slotDir)
+	exec.Command("git", "-C", g.repoDir, "worktree", "prune").Run()
+
+	cmd := exec.Command("git", "-C", g.repoDir, "worktree", "add", "--detach", slotDir, commit)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git worktree add: %s: %w", out, err)
+	}
+	return nil
+}
+
+// Promote renames slot-staging → slot-<hash> and repairs git worktree metadata.
+func (g *gitWorktrees) Promote(oldDir, newDir string) error {
+	if err := os.Rename(oldDir, newDir); err != nil {
+		return err
+	}
+
+	// Read .git file to find the worktree metadata dir. Artifact deploys are
+	// plain directories with nothing to repair.
+	gitFile := filepath.Join(newDir, ".git")
+	data, err := os.ReadFile(gitFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	metaDir := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(string(data)), "gitdir:"))
+
+	// Update gitdir in metadata to point to new location.
+	absNewGit, _ := filepath.Abs(filepath.Join(newDir, ".git"))
+	os.WriteFile(filepath.Join(metaDir, "gitdir"), []byte(absNewGit+"\n"), 0644)
+
+	// Rename metadata dir to match new slot name.
+	newName := filepath.Base(newDir)
+	newMetaDir := filepath.Join(filepath.Dir(metaDir), newName)
+	if metaDir != newMetaDir {
+		os.Rename(metaDir, newMetaDir)
+		// Update .git file to point to renamed metadata dir.
+		absNewMeta, _ := filepath.Abs(newMetaDir)
+		os.WriteFile(gitFile, []byte("gitdir: "+absNewMeta+"\n"), 0644)
+	}
+
+	return nil
+}
+
+// Clone copies srcDir with a CoW clone where the filesystem supports it,
+// falling back to a fresh worktree.
+func (g *gitWorktrees) Clone(srcDir, dstDir, commit string) error {
+	// Try CoW clone (macOS APFS).
+	cpCmd := exec.Command("cp", "-c", "-R", srcDir, dstDir)
+	if err := cpCmd.Run(); err == nil {
+		// Fix git worktree metadata for the clone.
+		if g.fixClonedWorktree(dstDir, commit) == nil {
+			return nil
+		}
+		// Clone metadata repair failed — remove and fall back.
+		os.RemoveAll(dstDir)
+	}
+
+	// Fallback: fresh worktree.
+	exec.Command("git", "-C", g.repoDir, "worktree", "prune").Run()
+	return exec.Command("git", "-C", g.repoDir, "worktree", "add", "--detach", dstDir, commit).Run()
+}
+
+// fixClonedWorktree sets up proper git worktree metadata for a cloned directory.
+func (g *gitWorktrees) fixClonedWorktree(wtDir, commit string) error {
+	gitFile := filepath.Join(wtDir, ".git")
+	os.Remove(gitFile)
+
+	// Find repo's .git directory.
+	repoGitDir := filepath.Join(g.repoDir, ".git")
+
+	// Ensure it's a directory (not a worktree .git file).
+	info, err := os.Stat(repoGitDir)
+	if err != nil || !info.IsDir() {
+		return fmt.Errorf("repo .git is not a directory")
+	}
+
+	wtName := filepath.Base(wtDir)
+	metaDir := filepath.Join(repoGitDir, "worktrees", wtName)
+
+	os.RemoveAll(metaDir)
+	os.MkdirAll(metaDir, 0755)
+
+	absWtDir, _ := filepath.Abs(wtDir)
+	absGitFile := filepath.Join(absWtDir, ".git")
+	absMetaDir, _ := filepath.Abs(metaDir)
+
+	// Write metadata files.
+	os.WriteFile(filepath.Join(metaDir, "HEAD"), []byte(commit+"\n"), 0644)
+	os.WriteFile(filepath.Join(metaDir, "commondir"), []byte("../..\n"), 0644)
+	os.WriteFile(filepath.Join(metaDir, "gitdir"), []byte(absGitFile+"\n"), 0644)
+
+	// Write .git file in worktree.
+	os.WriteFile(gitFile, []byte("gitdir: "+absMetaDir+"\n"), 0644)
+
+	// Rebuild the index from HEAD so git status is clean.
+	cmd := exec.Command("git", "reset", "--quiet")
+	cmd.Dir = wtDir
+	cmd.Run()
+
+	return nil
+}
+
+func (g *gitWorktrees) Remove(dir string) {
+	cmd := exec.Command("git", "-C", g.repoDir, "worktree", "remove", "--force", dir)
+	if err := cmd.Run(); err != nil {
+		os.RemoveAll(dir)
+		exec.Command("git", "-C", g.repoDir, "worktree", "prune").Run()
+	}
+}
+
+func (g *gitWorktrees) Commit(dir string) string {
+	cmd := exec.Command("git", "-C", dir, "rev-parse", "HEAD")
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func (g *gitWorktrees) Changes(dir string, ignore []string) (WorktreeChanges, error) {
+	var c WorktreeChanges
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		return c, nil // missing, or an unpacked artifact
+	}
+	out, err := exec.Command("git", "-C", dir, "status", "--porcelain", "-z").Output()
+	if err != nil {
+		return c, fmt.Errorf("git status: %w", err)
+	}
+	entries := strings.Split(string(out), "\x00")
+	for i := 0; i < len(entries); i++ {
+		e := entries[i]
+		if len(e) < 4 {
+			continue
+		}
+		xy, path := e[:2], e[3:]
+		if xy[0] == 'R' || xy[0] == 'C' {
+			i++ // the original path follows
+		}
+		if ignored(path, ignore) {
+			continue
+		}
+		switch {
+		case xy == "??":
+			c.Untracked++
+		case xy[0] == 'D' || xy[1] == 'D':
+			c.Deleted++
+		default:
+			c.Modified++
+		}
+	}
+	return c, nil
+}
+
+// stashRef keeps the last stash of slot-staging reachable until it has been
+// re-applied cleanly, without touching the repo's own stash list.
+const stashRef = "refs/slot-machine/staging-stash"
+
+func (g *gitWorktrees) Stash(dir string, ignore []string) (string, error) {
+	args := []string{"-C", dir, "stash", "push", "--include-untracked", "--message", "slot-machine: uncommitted staging changes", "--", "."}
+	for _, p := range ignore {
+		args = append(args, ":(exclude)"+filepath.ToSlash(filepath.Clean(p)))
+	}
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git stash: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	if strings.Contains(string(out), "No local changes") {
+		return "", nil
+	}
+	// The stash list is shared with every worktree of the repo; keep the
+	// commit under our own ref instead.
+	rev, err := exec.Command("git", "-C", dir, "rev-parse", "stash@{0}").Output()
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse stash: %w", err)
+	}
+	stash := strings.TrimSpace(string(rev))
+	if out, err := exec.Command("git", "-C", dir, "update-ref", stashRef, stash).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("git update-ref: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	exec.Command("git", "-C", dir, "stash", "drop", "--quiet").Run()
+	return stash, nil
+}
+
+func (g *gitWorktrees) Unstash(dir, stash string) ([]string, error) {
+	out, applyErr := exec.Command("git", "-C", dir, "stash", "apply", stash).CombinedOutput()
+	unmerged, err := exec.Command("git", "-C", dir, "diff", "--name-only", "--diff-filter=U").Output()
+	if err != nil {
+		return nil, fmt.Errorf("git diff: %w", err)
+	}
+	conflicts := strings.Fields(string(unmerged))
+	if applyErr != nil && len(conflicts) == 0 {
+		return nil, fmt.Errorf("git stash apply: %s: %w", strings.TrimSpace(string(out)), applyErr)
+	}
+	if len(conflicts) == 0 {
+		exec.Command("git", "-C", dir, "update-ref", "-d", stashRef, stash).Run()
+	}
+	return conflicts, nil
+}
+
+// ignored reports whether path is one of prefixes or inside one.
+func ignored(path string, prefixes []string) bool {
+	path = strings.TrimSuffix(path, "/")
+	for _, p := range prefixes {
+		p = strings.TrimSuffix(filepath.ToSlash(filepath.Clean(p)), "/")
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// createStaging creates a new slot-staging directory by cloning the promoted
+// slot, which carries over its installed dependencies (and setup hash).
+func (o *Orchestrator) createStaging(src *slot) {
+	if isArtifact(src.commit) {
+		// No checkout to clone; the next git deploy makes a fresh worktree.
+		return
+	}
+	dstDir := filepath.Join(o.dataDir, "slot-staging")
+	o.worktrees.Clone(src.dir, dstDir, src.commit)
+	o.applySharedDirs(dstDir)
+}
+
+// newDeployDir returns a fresh slot-staging-<id> directory for a deploy of
+// commit, cloned from the live slot when there is one to clone, and the
+// setup hash that clone's dependencies match ("" if it isn't one). Deploys
+// check out there instead of in slot-staging, which stays the agent's.
+func (o *Orchestrator) newDeployDir(commit string) (dir, setupHash string) {
+	b := make([]byte, 4)
+	rand.Read(b)
+	dir = filepath.Join(o.dataDir, deployDirPrefix+hex.EncodeToString(b))
+
+	o.mu.Lock()
+	live := o.liveSlot
+	o.mu.Unlock()
+	if live == nil || isArtifact(live.commit) || isArtifact(commit) {
+		return dir, ""
+	}
+	if err := o.worktrees.Clone(live.dir, dir, live.commit); err != nil {
+		o.worktrees.Remove(dir)
+		return dir, ""
+	}
+	return dir, live.setupHash
+}
+
+// deployDirPrefix starts the name of a deploy's own staging directory.
+const deployDirPrefix = "slot-staging-"
+
+// removeDeployDirs deletes the staging directories of deploys that were
+// cut short by the daemon stopping, leaving those of the slots in keep (a
+// deploy whose promotion failed runs from its own).
+func (o *Orchestrator) removeDeployDirs(keep []string) {
+	if o.worktrees == nil {
+		return
+	}
+	dirs, _ := filepath.Glob(filepath.Join(o.dataDir, deployDirPrefix+"*"))
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() || slices.Contains(keep, filepath.Base(dir)) {
+			continue
+		}
+		o.worktrees.Remove(dir)
+	}
+}
+
+// StagingChanges counts slot-staging's uncommitted changes: what the agent
+// edited but didn't commit, which the next deploy would discard. Shared dirs
+// and Options.StagingIgnore are left out.
+func (o *Orchestrator) StagingChanges() WorktreeChanges {
+	if o.worktrees == nil {
+		return WorktreeChanges{}
+	}
+	c, err := o.worktrees.Changes(filepath.Join(o.dataDir, "slot-staging"), o.stagingIgnored())
+	if err != nil {
+		fmt.Printf("warning: staging changes: %v\n", err)
+	}
+	return c
+}
+
+// stagingIgnored are the paths in slot-staging that aren't the agent's work.
+func (o *Orchestrator) stagingIgnored() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append(slices.Clone(o.cfg.SharedDirs), o.stagingIgnore...)
+}
+
+// StagingRestore is what became of slot-staging's uncommitted changes
+// across a deploy or rollback: they are stashed before staging is checked
+// out or replaced, and applied to the new staging afterwards.
+type StagingRestore struct {
+	Stash     string          `json:"stash"` // commit holding the changes, kept as refs/slot-machine/staging-stash until applied cleanly
+	Changes   WorktreeChanges `json:"changes"`
+	Restored  bool            `json:"restored"`
+	Conflicts []string        `json:"conflicts,omitempty"` // files left with conflict markers
+	Error     string          `json:"error,omitempty"`     // why they couldn't be applied; git stash apply <stash> recovers them
+}
+
+// stashStaging sets aside slot-staging's uncommitted changes, if there are
+// any, and returns a func that applies them to whatever slot-staging is
+// by the time it's called, publishing the result as a staging_restored
+// event. With discard, the changes are left for the checkout to throw away.
+func (o *Orchestrator) stashStaging(discard bool) (restore func() *StagingRestore, err error) {
+	noop := func() *StagingRestore { return nil }
+	changes := o.StagingChanges()
+	if !changes.Dirty() {
+		return noop, nil
+	}
+	dir := filepath.Join(o.dataDir, "slot-staging")
+	if discard {
+		fmt.Printf("discarding uncommitted changes in slot-staging (%s)\n", changes)
+		return noop, nil
+	}
+	stash, err := o.worktrees.Stash(dir, o.stagingIgnored())
+	if err != nil || stash == "" {
+		return noop, err
+	}
+	fmt.Printf("stashed uncommitted changes in slot-staging (%s) as %s\n", changes, ShortHash(stash))
+	return func() *StagingRestore {
+		r := &StagingRestore{Stash: stash, Changes: changes}
+		if o.worktrees.Commit(dir) == "" {
+			r.Error = "slot-staging is not a git checkout"
+		} else if conflicts, err := o.worktrees.Unstash(dir, stash); err != nil {
+			r.Error = err.Error()
+		} else {
+			r.Restored = true
+			r.Conflicts = conflicts
+		}
+		switch {
+		case r.Error != "":
+			fmt.Printf("warning: could not re-apply staging changes %s: %s\n", ShortHash(stash), r.Error)
+		case len(r.Conflicts) > 0:
+			fmt.Printf("warning: re-applied staging changes %s with conflicts in %s\n", ShortHash(stash), strings.Join(r.Conflicts, ", "))
+		}
+		o.Publish(EventStagingRestored, "", "", *r)
+		return r
+	}, nil
+}
+
+// applySharedDirs replaces configured shared_dirs in slotDir with symlinks
+// to the canonical location in the source repo. This ensures all slots and
+// the staging dir share the same data — no duplicate state.
+func (o *Orchestrator) applySharedDirs(slotDir string) {
+	if len(o.cfg.SharedDirs) == 0 {
+		return
+	}
+
+	for _, name := range o.cfg.SharedDirs {
+		name = filepath.Clean(name)
+		if name == "." || name == ".." || filepath.IsAbs(name) {
+			continue
+		}
+
+		target := filepath.Join(o.repoDir, name)
+		slotPath := filepath.Join(slotDir, name)
+
+		// If the canonical location doesn't exist yet, seed it from the slot's
+		// checkout (first deploy) rather than creating an empty directory.
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			if info, err := os.Lstat(slotPath); err == nil && info.IsDir() {
+				os.MkdirAll(filepath.Dir(target), 0755)
+				os.Rename(slotPath, target)
+			} else {
+				os.MkdirAll(target, 0755)
+			}
+		}
+
+		// Remove whatever is at slotPath (real dir from CoW clone, old symlink, etc).
+		os.RemoveAll(slotPath)
+
+		// Ensure parent dirs exist in slot.
+		os.MkdirAll(filepath.Dir(slotPath), 0755)
+
+		// Symlink slot → repo.
+		absTarget, _ := filepath.Abs(target)
+		os.Symlink(absTarget, slotPath)
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Slot affinity keeps a client on the slot that first answered it while two
+// slots serve at once, i.e. during a failover window: responses carry a
+// cookie naming the slot, and requests with it go back to that slot as long
+// as it's still up. The cookie is opaque (a keyed hash of the slot's port)
+// and is stripped before requests reach the app.
+
+// AffinityCookie is the name of the slot affinity cookie.
+const AffinityCookie = "slot_machine_slot"
+
+// SetAffinity turns slot affinity on with cookies lasting ttl, or off when
+// ttl is 0.
+func (p *Proxy) SetAffinity(ttl time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.affinityTTL = ttl
+	if p.affinityKey == nil {
+		p.affinityKey = make([]byte, 16)
+		rand.Read(p.affinityKey)
+	}
+}
+
+// slotID names the slot on port in affinity cookies. Caller holds p.mu.
+func (p *Proxy) slotID(port int) string {
+	mac := hmac.New(sha256.New, p.affinityKey)
+	mac.Write([]byte(strconv.Itoa(port)))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// pinned returns the port r's affinity cookie points at, if that slot still
+// takes traffic, else 0. Caller holds p.mu.
+func (p *Proxy) pinned(r *http.Request) int {
+	c, err := r.Cookie(AffinityCookie)
+	if err != nil {
+		return 0
+	}
+	if p.port > 0 && c.Value == p.slotID(p.port) {
+		return p.port
+	}
+	if p.failoverPort > 0 && time.Now().Before(p.failoverUntil) && c.Value == p.slotID(p.failoverPort) {
+		return p.failoverPort
+	}
+	return 0
+}
+
+// pinResponse sets the affinity cookie on resp for the slot that actually
+// answered, which differs from the chosen one after a failover.
+func (p *Proxy) pinResponse(in *http.Request, resp *http.Response) {
+	_, portStr, err := net.SplitHostPort(resp.Request.URL.Host)
+	if err != nil {
+		return
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	p.mu.RLock()
+	ttl := p.affinityTTL
+	id := p.slotID(port)
+	p.mu.RUnlock()
+	if ttl <= 0 {
+		return
+	}
+	if c, err := in.Cookie(AffinityCookie); err == nil && c.Value == id {
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     AffinityCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(ttl / time.Second),
+		HttpOnly: true,
+		Secure:   in.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
+
+// stripAffinity removes the affinity cookie from a request bound for the
+// app, keeping any others.
+func stripAffinity(req *http.Request) {
+	cookies := req.Cookies()
+	kept := make([]string, 0, len(cookies))
+	found := false
+	for _, c := range cookies {
+		if c.Name == AffinityCookie {
+			found = true
+			continue
+		}
+		kept = append(kept, c.Name+"="+c.Value)
+	}
+	if !found {
+		return
+	}
+	req.Header.Del("Cookie")
+	if len(kept) > 0 {
+		req.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A wedged endpoint holds a proxy goroutine, and its client, for as long
+// as the app takes, which may be forever. SetTimeouts bounds the wait for
+// the app's response headers, overall and by path prefix; a request past
+// it gets a 504. The body isn't timed, so streams and downloads last as
+// long as they last. SetBreaker adds a circuit breaker: after a number of
+// failures in a row (the app couldn't be reached, timed out, or answered
+// 502, 503, or 504) the circuit to that port opens, and requests get a 503
+// at once instead of piling up on it. Once it has been open for a while,
+// one request is let through as a probe (half-open): if it succeeds the
+// circuit closes, otherwise it opens again.
+
+// Circuit states, as reported in Stats.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// errUpstreamTimeout is the error of a request the app didn't answer in
+// time.
+var errUpstreamTimeout = errors.New("upstream timeout")
+
+// SetTimeouts sets how long to wait for the app's response headers: d for
+// every request, or paths[prefix] for those whose path starts with prefix,
+// the longest prefix winning. Zero means no limit.
+func (p *Proxy) SetTimeouts(d time.Duration, paths map[string]time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timeout = d
+	p.pathTimeouts = paths
+}
+
+// timeoutFor returns the timeout for path. p.mu must be held.
+func (p *Proxy) timeoutFor(path string) time.Duration {
+	d, longest := p.timeout, -1
+	for prefix, t := range p.pathTimeouts {
+		if strings.HasPrefix(path, prefix) && len(prefix) > longest {
+			d, longest = t, len(prefix)
+		}
+	}
+	return d
+}
+
+// SetBreaker opens the circuit to a port after failures failed requests
+// in a row, for open before a probe is let through. Zero failures turns
+// the breaker off. The circuits stay as they are if nothing changed.
+func (p *Proxy) SetBreaker(failures int, open time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if failures <= 0 {
+		p.breaker = nil
+		return
+	}
+	if b := p.breaker; b != nil && b.failures == failures && b.open == open {
+		return
+	}
+	p.breaker = &breaker{failures: failures, open: open, ports: map[int]*circuit{}}
+}
+
+// breaker keeps a circuit per port, so a new slot starts closed.
+type breaker struct {
+	failures int
+	open     time.Duration
+
+	mu    sync.Mutex
+	ports map[int]*circuit // closed circuits are left out
+}
+
+type circuit struct {
+	failures  int       // in a row
+	openUntil time.Time // zero while closed
+	probing   bool      // half-open, with the probe in flight
+}
+
+// outcome is how a request the breaker let through went.
+type outcome int
+
+const (
+	succeeded outcome = iota
+	failed
+	abandoned // the client went away: says nothing about the app
+)
+
+// requestOutcome judges a forwarded request by its context and the status
+// it was answered with.
+func requestOutcome(r *http.Request, code int) outcome {
+	switch {
+	case r.Context().Err() != nil:
+		return abandoned
+	case code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout:
+		return failed
+	}
+	return succeeded
+}
+
+// allow reports whether a request to port may go, and whether it's the
+// half-open circuit's probe.
+func (b *breaker) allow(port int) (ok, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.ports[port]
+	switch {
+	case c == nil || c.openUntil.IsZero():
+		return true, false
+	case time.Now().Before(c.openUntil) || c.probing:
+		return false, false
+	}
+	c.probing = true
+	return true, true
+}
+
+// record counts how a request to port went, and reports whether that
+// opened the circuit.
+func (b *breaker) record(port int, probe bool, o outcome) (opened bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.ports[port]
+	if probe && c != nil {
+		c.probing = false
+	}
+	switch o {
+	case abandoned:
+		return false
+	case succeeded:
+		// A request let through before the circuit opened doesn't close it.
+		if c != nil && (probe || c.openUntil.IsZero()) {
+			delete(b.ports, port)
+		}
+		return false
+	}
+	if c == nil {
+		c = &circuit{}
+		b.ports[port] = c
+	}
+	c.failures++
+	if probe || (c.openUntil.IsZero() && c.failures >= b.failures) {
+		c.openUntil = time.Now().Add(b.open)
+		return true
+	}
+	return false
+}
+
+// state returns the state of the circuit to port.
+func (b *breaker) state(port int) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.ports[port]
+	switch {
+	case c == nil || c.openUntil.IsZero():
+		return CircuitClosed
+	case time.Now().Before(c.openUntil):
+		return CircuitOpen
+	}
+	return CircuitHalfOpen
+}
+
+// headerTimeout fails a request whose response headers take longer than
+// d with errUpstreamTimeout.
+type headerTimeout struct {
+	base http.RoundTripper
+	d    time.Duration
+}
+
+func (t *headerTimeout) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The request's context outlives the body, so canceling with it is
+	// enough once the headers are in.
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(t.d, func() { cancel(errUpstreamTimeout) })
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, errUpstreamTimeout
+	}
+	return resp, err
+}
+
+// proxyError answers a request that couldn't be forwarded: 504 if the app
+// took too long, otherwise 502 as httputil.ReverseProxy would.
+func (p *Proxy) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errUpstreamTimeout) {
+		p.timeouts.Add(1)
+		http.Error(w, "the app took too long to answer", http.StatusGatewayTimeout)
+		return
+	}
+	log.Printf("http: proxy error: %v", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
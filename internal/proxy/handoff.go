@@ -0,0 +1,37 @@
+package proxy
+
+import "net"
+
+// A daemon that re-execs itself onto a new binary hands its bound sockets
+// to the new one, so connections arriving during the restart wait in the
+// kernel's backlog instead of being refused. Listeners returns the sockets
+// to pass on; the new daemon gives them back with Inherit before binding.
+
+// Listeners returns the bound sockets by address, plain and HTTPS alike,
+// before any PROXY or TLS wrapping.
+func (p *Proxy) Listeners() map[string]net.Listener {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	lns := map[string]net.Listener{}
+	for _, l := range p.listeners {
+		if l.tcp != nil {
+			lns[l.addr] = l.tcp
+		}
+	}
+	return lns
+}
+
+// Inherit makes the proxy serve addr on ln, a socket bound by the daemon
+// that re-exec'd into this one, when it next binds. It reports whether addr
+// is one of the proxy's; if not, ln is left to the caller.
+func (p *Proxy) Inherit(addr string, ln net.Listener) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, l := range p.listeners {
+		if l.addr == addr && l.srv == nil && l.inherited == nil && !p.closed {
+			l.inherited = ln
+			return true
+		}
+	}
+	return false
+}
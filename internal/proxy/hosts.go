@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Host routing lets one proxy serve several sites: each Host header can go
+// to the live app (the default), to the agent chat alone, or to another
+// local port such as a second daemon's app port. With a TLS address set,
+// the proxy also terminates HTTPS, picking the certificate by SNI.
+
+// Host says where requests for one host name go.
+type Host struct {
+	Chat bool             // serve only the agent chat; "/" redirects to /chat
+	Port int              // forward to this local port instead of the live slot
+	Cert *tls.Certificate // presented for this name on the TLS listener
+}
+
+// SetHosts replaces the host table. Names are matched case-insensitively;
+// "*.example.com" matches any single-label subdomain not listed itself.
+func (p *Proxy) SetHosts(hosts map[string]Host) {
+	table := make(map[string]Host, len(hosts))
+	for name, h := range hosts {
+		table[strings.ToLower(name)] = h
+	}
+	p.mu.Lock()
+	p.hosts = table
+	p.mu.Unlock()
+}
+
+// SetTLSAddr makes the proxy also listen for HTTPS on addrs, once it
+// binds. Certificates come from SetHosts. No addrs disables TLS.
+func (p *Proxy) SetTLSAddr(addrs ...string) {
+	p.setListeners(true, addrs)
+}
+
+// TLSAddr returns the first HTTPS address ("" if the proxy doesn't serve
+// TLS).
+func (p *Proxy) TLSAddr() string {
+	if addrs := p.addrs(true); len(addrs) > 0 {
+		return addrs[0]
+	}
+	return ""
+}
+
+// lookupHost finds the entry for name, exact first, then the wildcard for
+// its parent domain. Caller holds p.mu.
+func (p *Proxy) lookupHost(name string) (Host, bool) {
+	name = strings.ToLower(name)
+	if h, ok := p.hosts[name]; ok {
+		return h, true
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		h, ok := p.hosts["*."+parent]
+		return h, ok
+	}
+	return Host{}, false
+}
+
+// host returns the entry for r's Host header.
+func (p *Proxy) host(r *http.Request) (Host, bool) {
+	name := r.Host
+	if h, _, err := net.SplitHostPort(name); err == nil {
+		name = h
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.lookupHost(name)
+}
+
+// getCertificate picks the certificate for the TLS handshake's server name.
+func (p *Proxy) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if h, ok := p.lookupHost(hello.ServerName); ok && h.Cert != nil {
+		return h.Cert, nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
+
+// serveChat answers a chat-only host: the agent UI and API, nothing else.
+func (p *Proxy) serveChat(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case p.intercept == nil:
+		http.NotFound(w, r)
+	case r.URL.Path == "/":
+		http.Redirect(w, r, p.interceptPrefix()+"/chat", http.StatusFound)
+	default:
+		if path, ok := p.intercepted(r); ok {
+			p.serveIntercept(w, r, path)
+		} else if moved := p.movedPath(r); moved != "" {
+			http.Redirect(w, r, moved, http.StatusFound)
+		} else {
+			http.NotFound(w, r)
+		}
+	}
+}
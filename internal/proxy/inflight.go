@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// The proxy counts the requests it has forwarded to each port and not yet
+// answered, so a slot it no longer targets can finish them before it's
+// stopped. Upgraded connections (WebSockets) aren't counted: they can stay
+// open for hours, and the app closes them when it stops.
+
+// idlePoll is how often WaitIdle checks the count.
+var idlePoll = 10 * time.Millisecond
+
+// track counts r as in flight to port until the returned func is called.
+func (p *Proxy) track(r *http.Request, port int) (done func()) {
+	if r.Header.Get("Upgrade") != "" {
+		return func() {}
+	}
+	p.activeMu.Lock()
+	if p.active == nil {
+		p.active = make(map[int]int)
+	}
+	p.active[port]++
+	p.activeMu.Unlock()
+	return func() {
+		p.activeMu.Lock()
+		if p.active[port]--; p.active[port] <= 0 {
+			delete(p.active, port)
+		}
+		p.activeMu.Unlock()
+	}
+}
+
+// InFlight returns how many requests forwarded to port are unanswered.
+func (p *Proxy) InFlight(port int) int {
+	p.activeMu.Lock()
+	defer p.activeMu.Unlock()
+	return p.active[port]
+}
+
+// WaitIdle waits up to timeout for the requests in flight to port to
+// finish, and reports whether they did.
+func (p *Proxy) WaitIdle(port int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for p.InFlight(port) > 0 {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(min(idlePoll, time.Until(deadline)))
+	}
+	return true
+}
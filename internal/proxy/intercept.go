@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// slot-machine serves the agent UI and API (/agent/*, /chat, /chat/*,
+// /chat.css) on the app's port instead of forwarding them. An app that owns
+// those routes itself can move them under a prefix with intercept_prefix:
+// with "/_slot", /_slot/chat is the chat and /chat goes to the app. The
+// prefix is stripped before the intercept handler sees the request.
+//
+// The old paths keep working where that can't shadow the app: a GET or HEAD
+// the app answers with 404 is redirected under the prefix, and a chat-only
+// host, which has no app behind it, redirects them all.
+//
+// Only with a prefix, <prefix>/dashboard and <prefix>/api/* are intercepted
+// too: the deploy dashboard and the daemon API behind it, for when only the
+// app's port is reachable. Without one, those paths are the app's.
+
+// SetInterceptPrefix moves the intercepted paths under prefix ("" for the
+// root).
+func (p *Proxy) SetInterceptPrefix(prefix string) {
+	prefix = strings.TrimRight(prefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prefix = prefix
+}
+
+func (p *Proxy) interceptPrefix() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.prefix
+}
+
+// agentPath reports whether path is one slot-machine serves.
+func agentPath(path string) bool {
+	return strings.HasPrefix(path, "/agent/") || path == "/chat" || strings.HasPrefix(path, "/chat/") || path == "/chat.css"
+}
+
+// prefixedPath reports whether path is one slot-machine serves only under
+// an intercept prefix.
+func prefixedPath(path string) bool {
+	return path == "/dashboard" || strings.HasPrefix(path, "/api/")
+}
+
+// intercepted reports whether r is for the agent UI or API, or the
+// dashboard under the prefix, and returns its path with the intercept
+// prefix removed.
+func (p *Proxy) intercepted(r *http.Request) (string, bool) {
+	prefix := p.interceptPrefix()
+	path, ok := strings.CutPrefix(r.URL.Path, prefix)
+	if !ok || !(agentPath(path) || prefix != "" && prefixedPath(path)) {
+		return "", false
+	}
+	return path, true
+}
+
+// serveIntercept hands r to the intercept handler as if it were for path.
+func (p *Proxy) serveIntercept(w http.ResponseWriter, r *http.Request, path string) {
+	if path != r.URL.Path {
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		u.Path, u.RawPath = path, ""
+		r2.URL = &u
+		r = r2
+	}
+	p.intercept.ServeHTTP(w, r)
+}
+
+// movedPath is where r would be served under the intercept prefix, if it's
+// for one of the old paths and can safely be redirected there; "" if not.
+func (p *Proxy) movedPath(r *http.Request) string {
+	prefix := p.interceptPrefix()
+	if p.intercept == nil || prefix == "" || (r.Method != "GET" && r.Method != "HEAD") || !agentPath(r.URL.Path) {
+		return ""
+	}
+	return prefix + r.URL.RequestURI()
+}
+
+// redirectNotFound turns the app's 404 into a redirect to location.
+func redirectNotFound(resp *http.Response, location string) {
+	if resp.StatusCode != http.StatusNotFound {
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	resp.StatusCode = http.StatusFound
+	resp.Status = "302 Found"
+	resp.Header = http.Header{"Location": {location}}
+	resp.Body = http.NoBody
+	resp.ContentLength = 0
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Mirroring copies a sample of forwarded requests to a second port, the
+// candidate slot, and compares its status codes with the live slot's. The
+// copies are fire-and-forget: the client only ever sees the live answer.
+
+// mirrorBodyLimit is the largest request body copied; bigger requests
+// aren't mirrored.
+const mirrorBodyLimit = 1 << 20
+
+// mirrorTimeout bounds each mirrored request.
+const mirrorTimeout = 30 * time.Second
+
+// mirrorConcurrency caps mirrored requests in flight, so a slow candidate
+// can't pile up goroutines. Requests beyond it are skipped.
+const mirrorConcurrency = 64
+
+// MirrorStats are the counters for the current mirror target.
+type MirrorStats struct {
+	Port       int    `json:"port"`
+	Percent    int    `json:"percent"`
+	AllMethods bool   `json:"all_methods"`
+	Mirrored   uint64 `json:"mirrored"`
+	Mismatches uint64 `json:"mismatches"` // status code differed from the live slot's
+	Errors     uint64 `json:"errors"`     // the candidate didn't answer
+	Skipped    uint64 `json:"skipped"`    // sampled but not sent: body too big or too many in flight
+}
+
+type mirror struct {
+	port       int
+	percent    int
+	allMethods bool
+	client     *http.Client
+	slots      chan struct{}
+
+	mirrored   atomic.Uint64
+	mismatches atomic.Uint64
+	errors     atomic.Uint64
+	skipped    atomic.Uint64
+}
+
+// SetMirror starts copying percent% of forwarded requests to port, only
+// GET, HEAD, and OPTIONS unless allMethods is set. Port 0 stops mirroring.
+// Counters start from zero on each call.
+func (p *Proxy) SetMirror(port, percent int, allMethods bool) {
+	var m *mirror
+	if port > 0 && percent > 0 {
+		m = &mirror{
+			port:       port,
+			percent:    min(percent, 100),
+			allMethods: allMethods,
+			client:     &http.Client{Timeout: mirrorTimeout},
+			slots:      make(chan struct{}, mirrorConcurrency),
+		}
+	}
+	p.mu.Lock()
+	if m != nil && p.h2c != nil {
+		m.client.Transport = p.h2c
+	}
+	p.mirror = m
+	p.mu.Unlock()
+}
+
+// MirrorStats returns the current mirror's counters, or false if requests
+// aren't being mirrored.
+func (p *Proxy) MirrorStats() (MirrorStats, bool) {
+	p.mu.RLock()
+	m := p.mirror
+	p.mu.RUnlock()
+	if m == nil {
+		return MirrorStats{}, false
+	}
+	return MirrorStats{
+		Port:       m.port,
+		Percent:    m.percent,
+		AllMethods: m.allMethods,
+		Mirrored:   m.mirrored.Load(),
+		Mismatches: m.mismatches.Load(),
+		Errors:     m.errors.Load(),
+		Skipped:    m.skipped.Load(),
+	}, true
+}
+
+// sample reports whether r should be mirrored.
+func (m *mirror) sample(r *http.Request) bool {
+	if r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+	default:
+		if !m.allMethods {
+			return false
+		}
+	}
+	return rand.IntN(100) < m.percent
+}
+
+// start sends a copy of r to the candidate and returns a func to call with
+// the live slot's status code once it's known, or nil if r wasn't sent.
+// r's body is buffered and replaced so the live request still reads it.
+func (m *mirror) start(r *http.Request) func(liveCode int) {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		buf, err := io.ReadAll(io.LimitReader(r.Body, mirrorBodyLimit+1))
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		if err != nil || len(buf) > mirrorBodyLimit {
+			m.skipped.Add(1)
+			return nil
+		}
+		body = buf
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.skipped.Add(1)
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), r.Method,
+		fmt.Sprintf("http://127.0.0.1:%d%s", m.port, r.URL.RequestURI()), bytes.NewReader(body))
+	if err != nil {
+		<-m.slots
+		m.skipped.Add(1)
+		return nil
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set("X-Slot-Machine-Mirror", "1")
+	req.Host = r.Host
+
+	result := make(chan int, 1)
+	go func() {
+		defer func() { <-m.slots }()
+		resp, err := m.client.Do(req)
+		if err != nil {
+			result <- 0
+			return
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, mirrorBodyLimit))
+		resp.Body.Close()
+		result <- resp.StatusCode
+	}()
+
+	m.mirrored.Add(1)
+	return func(liveCode int) {
+		go func() {
+			switch code := <-result; {
+			case code == 0:
+				m.errors.Add(1)
+			case code != liveCode:
+				m.mismatches.Add(1)
+			}
+		}()
+	}
+}
+
+// readCloser reads from one reader and closes another.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
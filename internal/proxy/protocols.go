@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net/http"
+)
+
+// The proxy speaks HTTP/1.1 to the app unless h2c is on, in which case it
+// uses HTTP/2 without TLS (prior knowledge), as gRPC servers expect; then
+// the plain public listener also accepts h2c. The TLS listener offers
+// HTTP/2 through ALPN unless http1Only is set.
+
+// SetProtocols picks the HTTP versions used from now on. The listeners'
+// protocols are fixed once they're bound, so call it before SetTarget.
+// http1Only wins over h2c.
+func (p *Proxy) SetProtocols(h2c, http1Only bool) {
+	var backend *http.Transport
+	if h2c && !http1Only {
+		backend = http.DefaultTransport.(*http.Transport).Clone()
+		backend.Protocols = new(http.Protocols)
+		backend.Protocols.SetUnencryptedHTTP2(true)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.http1Only = http1Only
+	p.h2c = backend
+}
+
+// serverProtocols returns what a listener accepts. Caller holds p.mu.
+func (p *Proxy) serverProtocols(secure bool) *http.Protocols {
+	ps := new(http.Protocols)
+	ps.SetHTTP1(true)
+	switch {
+	case p.http1Only:
+	case secure:
+		ps.SetHTTP2(true)
+	case p.h2c != nil:
+		ps.SetUnencryptedHTTP2(true)
+	}
+	return ps
+}
+
+// nextProtos is the ALPN list for the TLS listener. Caller holds p.mu.
+func (p *Proxy) nextProtos() []string {
+	if p.http1Only {
+		return []string{"http/1.1"}
+	}
+	return []string{"h2", "http/1.1"}
+}
+
+// backend returns the transport for forwarding r to the app, nil for the
+// default. Upgrades (WebSockets) need HTTP/1.1 whatever the setting.
+func (p *Proxy) backend(r *http.Request) http.RoundTripper {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.sendProxy != nil {
+		return p.sendProxy // HTTP/1.1, with a PROXY header
+	}
+	if r.Header.Get("Upgrade") != "" || p.h2c == nil {
+		return nil
+	}
+	return p.h2c
+}
@@ -0,0 +1,648 @@
+// Package proxy is the public-facing reverse proxy. It forwards to whichever
+// local port the live slot listens on and swaps targets without dropping the
+// listener.
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//go:embed static/unavailable.html
+var unavailableHTML string
+
+var unavailableTmpl = template.Must(template.New("unavailable").Parse(unavailableHTML))
+
+// Proxy forwards one public address to a dynamic local port.
+type Proxy struct {
+	mu        sync.RWMutex
+	port      int
+	listeners []*listener  // plain and HTTPS addresses, in order
+	bindErr   error        // first listen failure, nil once all are bound
+	closed    bool         // Close was called: never bind again
+	served    bool         // a target has been set at least once
+	intercept http.Handler // handles /agent/* and /chat before forwarding
+	prefix    string       // intercept_prefix the intercepted paths are under
+
+	healthPath string        // GET path whose responses may be cached
+	healthTTL  time.Duration // 0 disables the cache
+	health     *cachedResponse
+
+	mirror *mirror // copies sampled requests to a candidate slot; nil when off
+
+	h2c       *http.Transport // h2c to the app; nil means HTTP/1.1
+	http1Only bool            // no HTTP/2 on any listener
+
+	acceptProxy bool            // listeners read PROXY headers (see proxyproto.go)
+	sendProxy   *http.Transport // writes a PROXY header to the app; nil when off
+	trusted     []netip.Prefix  // peers whose PROXY and X-Forwarded-* headers count; none = all
+
+	retries       int       // resends of a request the target dropped
+	failoverPort  int       // previous slot, tried when the target can't be reached
+	failoverUntil time.Time // end of the failover window
+
+	timeout      time.Duration            // for the app's response headers; 0 is none (see breaker.go)
+	pathTimeouts map[string]time.Duration // by path prefix
+	breaker      *breaker                 // circuit breaker; nil when off
+
+	affinityTTL time.Duration // slot affinity cookie lifetime; 0 is off
+	affinityKey []byte        // keys the cookie's slot IDs
+
+	slots       map[int]SlotInfo // app port → the slot on it
+	slotHeaders bool             // set X-SlotMachine-* on forwarded requests
+
+	access *accessLog // forwarded requests; nil when off
+
+	routes      map[string]int // Host → port, bypassing the live target
+	routeDomain string         // subdomains reserved for routes
+	hosts       map[string]Host
+
+	activeMu sync.Mutex
+	active   map[int]int // port → requests in flight to it (see inflight.go)
+
+	requests  atomic.Uint64
+	errors    atomic.Uint64
+	cacheHits atomic.Uint64
+	retried   atomic.Uint64
+	failovers atomic.Uint64
+	timeouts  atomic.Uint64
+	rejected  atomic.Uint64
+	opens     atomic.Uint64
+}
+
+// Stats are the proxy's traffic counters since start.
+type Stats struct {
+	Requests  uint64 `json:"requests"`
+	Errors    uint64 `json:"errors"`     // 5xx answers, including 502/503 while no slot is up
+	CacheHits uint64 `json:"cache_hits"` // health polls answered from cache
+	Retries   uint64 `json:"retries"`    // resends after the target dropped a request
+	Failovers uint64 `json:"failovers"`  // requests sent to the previous slot instead
+	Timeouts  uint64 `json:"timeouts"`   // 504s: the app didn't answer in time
+
+	Circuit         string `json:"circuit,omitempty"` // the breaker's state for the target, when on
+	CircuitOpens    uint64 `json:"circuit_opens"`     // times a circuit opened
+	CircuitRejected uint64 `json:"circuit_rejected"`  // 503s while a circuit was open
+}
+
+// cachedResponse is a health response captured from one target port, for
+// one path and query.
+type cachedResponse struct {
+	port   int
+	key    string // path?query
+	code   int
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+// healthBodyMax is the largest health response body that's cached; a
+// larger one is passed on but not kept.
+const healthBodyMax = 64 << 10
+
+// uncachedHeaders aren't kept with a cached health response: they're the
+// proxy's own for each request, or meant for one client alone.
+var uncachedHeaders = []string{HeaderRequestID, "Set-Cookie"}
+
+// bindAttempts and bindBackoff control how hard EnsureListener tries before
+// giving up on a busy port. The backoff doubles after each attempt.
+var (
+	bindAttempts = 5
+	bindBackoff  = 100 * time.Millisecond
+)
+
+// listener is one address the proxy serves.
+type listener struct {
+	addr   string
+	secure bool         // HTTPS, with certificates from SetHosts
+	srv    *http.Server // nil until bound
+	tcp    net.Listener // the socket srv serves, before PROXY or TLS wrapping
+
+	inherited net.Listener // bound by the daemon before a re-exec (see handoff.go)
+}
+
+// New returns a proxy for addr. An empty addr disables listening. intercept,
+// if set, handles /agent/* and /chat instead of the app.
+func New(addr string, intercept http.Handler) *Proxy {
+	p := &Proxy{intercept: intercept}
+	if addr != "" {
+		p.listeners = []*listener{{addr: addr}}
+	}
+	return p
+}
+
+// SetAddrs replaces the plain HTTP addresses the proxy listens on, once it
+// binds; none disables listening. Listeners already bound to addresses
+// that aren't kept are closed.
+func (p *Proxy) SetAddrs(addrs ...string) {
+	p.setListeners(false, addrs)
+}
+
+// setListeners replaces the plain or the HTTPS listeners with addrs,
+// keeping those already bound to an address that stays.
+func (p *Proxy) setListeners(secure bool, addrs []string) {
+	p.mu.Lock()
+	var keep []*listener
+	old := map[string]*listener{}
+	for _, l := range p.listeners {
+		if l.secure == secure {
+			old[l.addr] = l
+		} else {
+			keep = append(keep, l)
+		}
+	}
+	for _, addr := range addrs {
+		if addr == "" {
+			continue
+		}
+		l, ok := old[addr]
+		if !ok {
+			l = &listener{addr: addr, secure: secure}
+		}
+		delete(old, addr)
+		keep = append(keep, l)
+	}
+	p.listeners = keep
+	p.mu.Unlock()
+
+	// Outside the lock: Shutdown waits for requests, which take it.
+	for _, l := range old {
+		if l.srv != nil {
+			l.srv.Shutdown(context.Background())
+		}
+		if l.inherited != nil {
+			l.inherited.Close()
+		}
+	}
+}
+
+// addrs returns the plain or the HTTPS addresses.
+func (p *Proxy) addrs(secure bool) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var addrs []string
+	for _, l := range p.listeners {
+		if l.secure == secure {
+			addrs = append(addrs, l.addr)
+		}
+	}
+	return addrs
+}
+
+// CacheHealth makes GET requests for path reuse the app's last answer for
+// ttl instead of hitting the app on every poll. A zero ttl disables caching.
+func (p *Proxy) CacheHealth(path string, ttl time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.healthPath = path
+	p.healthTTL = ttl
+	p.health = nil
+}
+
+// Stats returns the traffic counters.
+func (p *Proxy) Stats() Stats {
+	st := Stats{
+		Requests:        p.requests.Load(),
+		Errors:          p.errors.Load(),
+		CacheHits:       p.cacheHits.Load(),
+		Retries:         p.retried.Load(),
+		Failovers:       p.failovers.Load(),
+		Timeouts:        p.timeouts.Load(),
+		CircuitOpens:    p.opens.Load(),
+		CircuitRejected: p.rejected.Load(),
+	}
+	p.mu.RLock()
+	b, port := p.breaker, p.port
+	p.mu.RUnlock()
+	if b != nil {
+		st.Circuit = b.state(port)
+	}
+	return st
+}
+
+// SetTarget points the proxy at port, binding the listener if needed.
+// The target is set even when binding fails, so a later EnsureListener
+// picks it up; the bind error is returned and kept for /status.
+func (p *Proxy) SetTarget(port int) error {
+	p.mu.Lock()
+	p.port = port
+	if port > 0 {
+		p.served = true
+	}
+	p.mu.Unlock()
+	if port == 0 {
+		return nil
+	}
+	return p.EnsureListener()
+}
+
+// EnsureListener binds the proxy's addresses, plain and HTTPS, that aren't
+// bound yet, retrying with exponential backoff when a port is busy. Every
+// address is tried; the first failure is returned.
+func (p *Proxy) EnsureListener() error {
+	p.mu.RLock()
+	var unbound []*listener
+	for _, l := range p.listeners {
+		if l.srv == nil && !p.closed {
+			unbound = append(unbound, l)
+		}
+	}
+	p.mu.RUnlock()
+	if len(unbound) == 0 {
+		return nil
+	}
+
+	var first error
+	for _, l := range unbound {
+		if err := p.listen(l); err != nil && first == nil {
+			first = err
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bindErr = first
+	return first
+}
+
+// listen binds l's address and starts serving on it, over TLS if l is
+// secure.
+func (p *Proxy) listen(l *listener) error {
+	p.mu.Lock()
+	ln := l.inherited
+	l.inherited = nil
+	p.mu.Unlock()
+
+	var err error
+	backoff := bindBackoff
+	for i := 0; ln == nil && i < bindAttempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if ln, err = net.Listen("tcp", l.addr); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("proxy listen %s: %w", l.addr, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if l.srv != nil || !slices.Contains(p.listeners, l) || p.closed {
+		ln.Close() // lost a race with another caller, l was replaced, or p closed
+		return nil
+	}
+	l.srv = &http.Server{Handler: p, Protocols: p.serverProtocols(l.secure)}
+	l.tcp = ln
+	if p.acceptProxy {
+		ln = &proxyListener{Listener: ln, trusted: p.proxyPeer}
+	}
+	if l.secure {
+		ln = tls.NewListener(ln, &tls.Config{GetCertificate: p.getCertificate, NextProtos: p.nextProtos()})
+	}
+	go l.srv.Serve(ln)
+	return nil
+}
+
+// Addr returns the first plain HTTP address the proxy listens on ("" if it
+// doesn't).
+func (p *Proxy) Addr() string {
+	if addrs := p.addrs(false); len(addrs) > 0 {
+		return addrs[0]
+	}
+	return ""
+}
+
+// Addrs returns the plain HTTP addresses.
+func (p *Proxy) Addrs() []string { return p.addrs(false) }
+
+// Target returns the port traffic is forwarded to, or 0 if none.
+func (p *Proxy) Target() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.port
+}
+
+// LastError returns the most recent bind failure, or "" when bound.
+func (p *Proxy) LastError() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.bindErr == nil {
+		return ""
+	}
+	return p.bindErr.Error()
+}
+
+// ClearTarget stops forwarding. The listener stays bound so clients get a
+// 503 with Retry-After instead of connection refused.
+func (p *Proxy) ClearTarget() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.port = 0
+}
+
+// Shutdown closes the listeners and the connections on them at once.
+func (p *Proxy) Shutdown() {
+	p.Close(0)
+}
+
+// Close stops accepting connections and closes the idle ones, waits up to
+// timeout for the requests in flight to be answered, then closes the
+// connections left, WebSockets aside. It reports whether the requests all
+// finished in time. The proxy doesn't listen again.
+func (p *Proxy) Close(timeout time.Duration) bool {
+	p.mu.Lock()
+	p.closed = true
+	var srvs []*http.Server
+	for _, l := range p.listeners {
+		if l.srv != nil {
+			srvs = append(srvs, l.srv)
+			l.srv, l.tcp = nil, nil
+		}
+		if l.inherited != nil {
+			l.inherited.Close()
+			l.inherited = nil
+		}
+	}
+	p.mu.Unlock()
+
+	// Outside the lock: the requests being waited for take it.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	var late atomic.Bool
+	for _, srv := range srvs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if srv.Shutdown(ctx) != nil {
+				late.Store(true)
+				srv.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	p.port = 0
+	p.mu.Unlock()
+	return !late.Load()
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	r = p.forwardedFrom(r)
+	r = p.withClientAddr(r)
+	id := requestID(r)
+	r.Header.Set(HeaderRequestID, id)
+	w.Header().Set(HeaderRequestID, id)
+
+	if port, ok := p.route(r); ok {
+		p.setSlotHeaders(r.Header, port)
+		serveRoute(w, r, port, p.backend(r))
+		return
+	}
+	if h, ok := p.host(r); ok {
+		switch {
+		case h.Chat:
+			p.serveChat(w, r)
+			return
+		case h.Port > 0:
+			serveRoute(w, r, h.Port, nil)
+			return
+		}
+	}
+
+	// Intercept /agent/* and /chat — handled by slot-machine, not forwarded.
+	if path, ok := p.intercepted(r); ok && p.intercept != nil {
+		if path == whoamiPath {
+			p.serveWhoami(w, r)
+			return
+		}
+		p.serveIntercept(w, r, path)
+		return
+	}
+	moved := p.movedPath(r)
+
+	p.requests.Add(1)
+	rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+
+	p.mu.RLock()
+	port := p.port
+	served := p.served
+	cacheable := p.healthTTL > 0 && r.Method == "GET" && r.URL.Path == p.healthPath
+	cached := p.health
+	ttl := p.healthTTL
+	m := p.mirror
+	sticky := p.affinityTTL > 0
+	if sticky {
+		if pin := p.pinned(r); pin != 0 {
+			port = pin
+		}
+	}
+	access := p.access
+	timeout := p.timeoutFor(r.URL.Path)
+	b := p.breaker
+	p.mu.RUnlock()
+
+	defer func() {
+		if rec.code >= 500 {
+			p.errors.Add(1)
+		}
+		access.write(start, id, r, rec.code, p.slotName(port), p.clientAddr(r))
+	}()
+
+	if port == 0 {
+		msg := "No release deployed yet"
+		if served {
+			msg = "The app is restarting"
+		}
+		serveUnavailable(rec, r, msg)
+		return
+	}
+	defer p.track(r, port)()
+
+	cacheKey := r.URL.Path + "?" + r.URL.RawQuery
+	if cacheable && cached != nil && cached.port == port && cached.key == cacheKey && time.Since(cached.at) < ttl {
+		p.cacheHits.Add(1)
+		for k, v := range cached.header {
+			w.Header()[k] = slices.Clone(v)
+		}
+		w.Header().Set("X-Slot-Machine-Cache", "hit")
+		rec.WriteHeader(cached.code)
+		w.Write(cached.body)
+		return
+	}
+	if cacheable {
+		rec.capture = true
+	}
+
+	if b != nil {
+		ok, probe := b.allow(port)
+		if !ok {
+			p.rejected.Add(1)
+			serveUnavailable(rec, r, "The app is not responding")
+			return
+		}
+		// Deferred: ReverseProxy panics when the client goes away mid-body.
+		defer func() {
+			if b.record(port, probe, requestOutcome(r, rec.code)) {
+				p.opens.Add(1)
+			}
+		}()
+	}
+
+	var shadow func(liveCode int)
+	var body *wholeBody // the app's health response, as it's read
+	if m != nil && m.sample(r) {
+		shadow = m.start(r)
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = fmt.Sprintf("127.0.0.1:%d", port)
+			setForwardedProto(req)
+			p.setSlotHeaders(req.Header, port)
+			if sticky {
+				stripAffinity(req)
+			}
+		},
+		Transport:    p.transport(r, port),
+		ErrorHandler: p.proxyError,
+	}
+	if timeout > 0 {
+		t := &headerTimeout{base: proxy.Transport, d: timeout}
+		if t.base == nil {
+			t.base = http.DefaultTransport
+		}
+		proxy.Transport = t
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// The proxy's own is already set; an app echoing it would
+		// duplicate it.
+		resp.Header.Del(HeaderRequestID)
+		if sticky {
+			p.pinResponse(r, resp)
+		}
+		if moved != "" {
+			redirectNotFound(resp, moved)
+		}
+		if cacheable {
+			body = &wholeBody{ReadCloser: resp.Body}
+			resp.Body = body
+		}
+		return nil
+	}
+	proxy.ServeHTTP(rec, r)
+	if shadow != nil {
+		shadow(rec.code)
+	}
+
+	// Only a response passed on whole is cached: not one cut short by the
+	// app or the client, or too large to keep.
+	if cacheable && rec.code != http.StatusBadGateway && body != nil && body.done && !rec.partial {
+		header := rec.Header().Clone()
+		for _, h := range uncachedHeaders {
+			header.Del(h)
+		}
+		p.mu.Lock()
+		p.health = &cachedResponse{
+			port:   port,
+			key:    cacheKey,
+			code:   rec.code,
+			header: header,
+			body:   rec.body,
+			at:     time.Now(),
+		}
+		p.mu.Unlock()
+	}
+}
+
+// wholeBody notes whether the app's response body was read to its end.
+type wholeBody struct {
+	io.ReadCloser
+	done bool
+}
+
+func (b *wholeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.done = true
+	}
+	return n, err
+}
+
+// setForwardedProto tells the app the client connected over HTTPS when the
+// proxy terminated TLS itself, since it talks plain HTTP to the app. Plain
+// requests keep whatever a proxy in front of this one set.
+func setForwardedProto(req *http.Request) {
+	if req.TLS != nil {
+		req.Header.Set("X-Forwarded-Proto", "https")
+	}
+}
+
+// statusRecorder remembers the status code, and the body when capture is set
+// (health responses, which are small). partial is set when the body isn't
+// all there: it went over healthBodyMax, or writing it failed.
+type statusRecorder struct {
+	http.ResponseWriter
+	code    int
+	capture bool
+	body    []byte
+	partial bool
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	if r.capture && !r.partial {
+		if err != nil || len(r.body)+n > healthBodyMax {
+			r.partial, r.body = true, nil
+		} else {
+			r.body = append(r.body, b[:n]...)
+		}
+	}
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, which
+// ReverseProxy needs to hijack connections for WebSocket upgrades.
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// serveUnavailable answers with 503 and Retry-After while no slot is live.
+// Browsers get a small self-refreshing page, everything else plain text.
+func serveUnavailable(w http.ResponseWriter, r *http.Request, msg string) {
+	w.Header().Set("Retry-After", "5")
+	w.Header().Set("Cache-Control", "no-store")
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		unavailableTmpl.Execute(w, msg)
+		return
+	}
+	http.Error(w, strings.ToLower(msg), http.StatusServiceUnavailable)
+}
@@ -0,0 +1,1378 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func backendPort(t *testing.T, body string) int {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(backend.Close)
+	return backend.Listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestNoTarget(t *testing.T) {
+	t.Parallel()
+	p := New("", nil)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+
+	// Browsers get the HTML page.
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml")
+	p.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), "No release deployed yet") {
+		t.Fatalf("expected HTML unavailable page, got %q", w.Body.String())
+	}
+}
+
+func TestWithTarget(t *testing.T) {
+	t.Parallel()
+
+	p := New("", nil)
+	p.port = backendPort(t, "ok") // set directly since addr="" means no listener management
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if w.Body.String() != "ok" {
+		t.Fatalf("body = %q", w.Body.String())
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	t.Parallel()
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+	p := New(addr, nil)
+
+	// No target — no listener.
+	conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected connection refused with no target")
+	}
+
+	// Set target — listener should start.
+	p.SetTarget(backendPort(t, "backend"))
+	time.Sleep(50 * time.Millisecond) // let goroutine start
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/", addr))
+	if err != nil {
+		t.Fatalf("GET after SetTarget: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	// Clear target — listener stays bound and answers 503 with Retry-After.
+	p.ClearTarget()
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/", addr))
+	if err != nil {
+		t.Fatalf("GET after ClearTarget: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 after ClearTarget, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After header on 503")
+	}
+	p.Shutdown()
+}
+
+func TestBindFailure(t *testing.T) {
+	t.Parallel()
+
+	// Occupy the port so the proxy can't bind it.
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	p := New(busy.Addr().String(), nil)
+	if err := p.SetTarget(12345); err == nil {
+		t.Fatal("expected bind error for busy port")
+	}
+	if !strings.Contains(p.LastError(), "address already in use") {
+		t.Fatalf("LastError = %q", p.LastError())
+	}
+
+	// Once the port frees up, the proxy binds and the error clears.
+	busy.Close()
+	if err := p.EnsureListener(); err != nil {
+		t.Fatalf("EnsureListener after port freed: %v", err)
+	}
+	if p.LastError() != "" {
+		t.Fatalf("LastError should clear after binding, got %q", p.LastError())
+	}
+	p.Shutdown()
+}
+
+func TestIntercept(t *testing.T) {
+	t.Parallel()
+	agent := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("agent"))
+	})
+	p := New("", agent)
+	p.port = backendPort(t, "app")
+
+	for path, want := range map[string]string{
+		"/chat":                "agent",
+		"/agent/conversations": "agent",
+		"/chatter":             "app",
+		"/":                    "app",
+	} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Body.String() != want {
+			t.Errorf("%s: body = %q, want %q", path, w.Body.String(), want)
+		}
+	}
+}
+
+func TestInterceptPrefix(t *testing.T) {
+	t.Parallel()
+	agent := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("agent " + r.URL.RequestURI()))
+	})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chat" {
+			w.Write([]byte("app chat"))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(backend.Close)
+	p := New("", agent)
+	p.port = backend.Listener.Addr().(*net.TCPAddr).Port
+	p.SetInterceptPrefix("_slot/")
+	p.SetHosts(map[string]Host{"chat.example.com": {Chat: true}})
+
+	for _, tt := range []struct {
+		method, host, path string
+		code               int
+		want               string // body, or Location for a redirect
+	}{
+		{"GET", "", "/_slot/chat", 200, "agent /chat"},
+		{"GET", "", "/_slot/agent/conversations?q=1", 200, "agent /agent/conversations?q=1"},
+		{"GET", "", "/chat", 200, "app chat"}, // the app's own route
+		{"GET", "", "/agent/conversations?q=1", 302, "/_slot/agent/conversations?q=1"},
+		{"POST", "", "/agent/conversations", 404, ""},
+		{"GET", "", "/_slot/other", 404, ""},
+		{"POST", "", "/_slot/api/deploy", 200, "agent /api/deploy"},
+		{"GET", "", "/api/status", 404, ""}, // the app's, never redirected
+		{"GET", "", "/_slot/dashboard", 200, "agent /dashboard"},
+		{"GET", "chat.example.com", "/", 302, "/_slot/chat"},
+		{"GET", "chat.example.com", "/chat", 302, "/_slot/chat"},
+		{"GET", "chat.example.com", "/_slot/chat.css", 200, "agent /chat.css"},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.host != "" {
+			r.Host = tt.host
+		}
+		p.ServeHTTP(w, r)
+		got := w.Body.String()
+		if w.Code == 302 {
+			got = w.Header().Get("Location")
+		}
+		if w.Code != tt.code || (tt.want != "" && got != tt.want) {
+			t.Errorf("%s %s%s: %d %q, want %d %q", tt.method, tt.host, tt.path, w.Code, got, tt.code, tt.want)
+		}
+	}
+}
+
+func TestHealthCache(t *testing.T) {
+	t.Parallel()
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer backend.Close()
+
+	p := New("", nil)
+	p.port = backend.Listener.Addr().(*net.TCPAddr).Port
+	p.CacheHealth("/healthz", time.Minute)
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+		if w.Code != 200 || w.Body.String() != `{"ok":true}` {
+			t.Fatalf("poll %d: %d %q", i, w.Code, w.Body.String())
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("backend polled %d times, want 1", n)
+	}
+
+	// Other paths are never cached.
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if n := hits.Load(); n != 3 {
+		t.Fatalf("backend hit %d times, want 3", n)
+	}
+
+	st := p.Stats()
+	if st.Requests != 5 || st.CacheHits != 2 || st.Errors != 0 {
+		t.Fatalf("stats = %+v", st)
+	}
+
+	// A new target invalidates the cache.
+	p.port = backendPort(t, "other")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Body.String() != "other" {
+		t.Fatalf("expected fresh response after target change, got %q", w.Body.String())
+	}
+
+	// 503s while no target count as errors.
+	p.port = 0
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if p.Stats().Errors != 1 {
+		t.Fatalf("expected 1 error, got %+v", p.Stats())
+	}
+}
+
+func TestHealthCacheKeepsWholeResponses(t *testing.T) {
+	t.Parallel()
+	var hits atomic.Int32
+	large := strings.Repeat("x", healthBodyMax+1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		switch r.URL.Path {
+		case "/big":
+			w.Write([]byte(large))
+		case "/cut":
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("partial"))
+			conn, _, _ := http.NewResponseController(w).Hijack()
+			conn.Close()
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Set-Cookie", "session=alice")
+			fmt.Fprintf(w, `{"verbose":%q}`, r.URL.Query().Get("verbose"))
+		}
+	}))
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	poll := func(p *Proxy, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	// A body over healthBodyMax is passed on whole, and not cached.
+	p := New("", nil)
+	p.port = port
+	p.CacheHealth("/big", time.Minute)
+	for i := 0; i < 2; i++ {
+		if w := poll(p, "/big"); w.Body.String() != large {
+			t.Fatalf("big poll %d: %d bytes", i, w.Body.Len())
+		}
+	}
+	if n := hits.Swap(0); n != 2 {
+		t.Fatalf("big: backend polled %d times, want 2", n)
+	}
+
+	// Nor is a body the app cut short.
+	p = New("", nil)
+	p.port = port
+	p.CacheHealth("/cut", time.Minute)
+	poll(p, "/cut")
+	poll(p, "/cut")
+	if n := hits.Swap(0); n != 2 {
+		t.Fatalf("cut: backend polled %d times, want 2", n)
+	}
+
+	// The query is part of the key, and the app's headers are replayed,
+	// but for its cookies.
+	p = New("", nil)
+	p.port = port
+	p.CacheHealth("/healthz", time.Minute)
+	poll(p, "/healthz")
+	if w := poll(p, "/healthz?verbose=1"); w.Body.String() != `{"verbose":"1"}` {
+		t.Fatalf("?verbose=1 got %q", w.Body.String())
+	}
+	w := poll(p, "/healthz?verbose=1")
+	if w.Body.String() != `{"verbose":"1"}` || w.Header().Get("X-Slot-Machine-Cache") != "hit" {
+		t.Fatalf("cached ?verbose=1: %q %v", w.Body.String(), w.Header())
+	}
+	if w.Header().Get("Cache-Control") != "no-store" || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("cached headers = %v", w.Header())
+	}
+	if w.Header().Get("Set-Cookie") != "" {
+		t.Fatalf("cached response replayed a cookie: %v", w.Header())
+	}
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("backend polled %d times, want 2", n)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	t.Parallel()
+	var got atomic.Int32
+	candidate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.Add(1)
+		if r.Header.Get("X-Slot-Machine-Mirror") != "1" {
+			t.Errorf("mirrored request lacks X-Slot-Machine-Mirror")
+		}
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(500)
+		}
+	}))
+	defer candidate.Close()
+
+	p := New("", nil)
+	p.port = backendPort(t, "live")
+	p.SetMirror(candidate.Listener.Addr().(*net.TCPAddr).Port, 100, false)
+
+	for _, path := range []string{"/", "/broken", "/"} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Body.String() != "live" {
+			t.Fatalf("%s: client got %q, want the live answer", path, w.Body.String())
+		}
+	}
+	// Unsafe methods aren't mirrored unless asked for.
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("x")))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		st, _ := p.MirrorStats()
+		if st.Mirrored == 3 && st.Mismatches == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st, _ := p.MirrorStats(); st.Mirrored != 3 || st.Mismatches != 1 || st.Errors != 0 {
+		t.Fatalf("stats = %+v", st)
+	}
+	if n := got.Load(); n != 3 {
+		t.Fatalf("candidate got %d requests, want 3", n)
+	}
+
+	p.SetMirror(0, 0, false)
+	if _, ok := p.MirrorStats(); ok {
+		t.Fatal("mirror still on after SetMirror(0)")
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	t.Parallel()
+	p := New("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("agent"))
+	}))
+	p.port = backendPort(t, "live")
+	p.RouteDomain("preview.example.com")
+	p.Route("feature-x.preview.example.com", backendPort(t, "feature-x"))
+
+	for _, tt := range []struct {
+		host, path string
+		code       int
+		body       string
+	}{
+		{"example.com", "/", 200, "live"},
+		{"Feature-X.preview.example.com:443", "/", 200, "feature-x"},
+		{"feature-x.preview.example.com", "/chat", 200, "feature-x"},
+		{"gone.preview.example.com", "/", 404, "no such preview\n"},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Host = tt.host
+		p.ServeHTTP(w, r)
+		if w.Code != tt.code || w.Body.String() != tt.body {
+			t.Errorf("%s%s: %d %q, want %d %q", tt.host, tt.path, w.Code, w.Body.String(), tt.code, tt.body)
+		}
+	}
+	if n := p.Stats().Requests; n != 1 {
+		t.Errorf("routed requests counted as live traffic: %d", n)
+	}
+
+	p.Route("feature-x.preview.example.com", 0)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "feature-x.preview.example.com"
+	p.ServeHTTP(w, r)
+	if w.Code != 404 {
+		t.Fatalf("removed route: %d", w.Code)
+	}
+}
+
+func TestHosts(t *testing.T) {
+	t.Parallel()
+	p := New("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("agent"))
+	}))
+	p.port = backendPort(t, "live")
+	p.SetHosts(map[string]Host{
+		"Chat.example.com": {Chat: true},
+		"blog.example.com": {Port: backendPort(t, "blog")},
+		"*.docs.example":   {Port: backendPort(t, "docs")},
+		"example.com":      {},
+	})
+
+	for _, tt := range []struct {
+		host, path string
+		code       int
+		body       string
+	}{
+		{"example.com", "/", 200, "live"},
+		{"example.com", "/chat", 200, "agent"},
+		{"unlisted.example.org", "/", 200, "live"},
+		{"chat.example.com:443", "/agent/conversations", 200, "agent"},
+		{"chat.example.com", "/", 302, ""},
+		{"chat.example.com", "/about", 404, "404 page not found\n"},
+		{"blog.example.com", "/", 200, "blog"},
+		{"v2.docs.example", "/", 200, "docs"},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Host = tt.host
+		p.ServeHTTP(w, r)
+		if w.Code != tt.code || (tt.body != "" && w.Body.String() != tt.body) {
+			t.Errorf("%s%s: %d %q, want %d %q", tt.host, tt.path, w.Code, w.Body.String(), tt.code, tt.body)
+		}
+	}
+}
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// selfSigned returns a certificate for name and a pool that trusts it.
+func selfSigned(t *testing.T, name string) (*tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestTLSHosts(t *testing.T) {
+	t.Parallel()
+	addr := freeAddr(t)
+	p := New("", nil)
+	p.SetTLSAddr(addr)
+	t.Cleanup(p.Shutdown)
+	var proto atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto.Store(r.Header.Get("X-Forwarded-Proto"))
+		w.Write([]byte("live"))
+	}))
+	t.Cleanup(backend.Close)
+
+	siteCert, sitePool := selfSigned(t, "site.test")
+	blogCert, blogPool := selfSigned(t, "blog.test")
+	p.SetHosts(map[string]Host{
+		"site.test": {Cert: siteCert},
+		"blog.test": {Cert: blogCert, Port: backendPort(t, "blog")},
+	})
+	if err := p.SetTarget(backend.Listener.Addr().(*net.TCPAddr).Port); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(name string, pool *x509.CertPool) (string, error) {
+		c := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: name},
+		}}
+		req, _ := http.NewRequest("GET", "https://"+addr+"/", nil)
+		req.Host = name
+		resp, err := c.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), nil
+	}
+
+	if body, err := get("site.test", sitePool); err != nil || body != "live" {
+		t.Fatalf("site.test = %q, %v", body, err)
+	}
+	if got, _ := proto.Load().(string); got != "https" {
+		t.Errorf("X-Forwarded-Proto = %q", got)
+	}
+	if body, err := get("blog.test", blogPool); err != nil || body != "blog" {
+		t.Fatalf("blog.test = %q, %v", body, err)
+	}
+	if _, err := get("unknown.test", sitePool); err == nil {
+		t.Fatal("handshake for a host without a certificate should fail")
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	t.Parallel()
+	// A gRPC-style backend: h2c only, answers with a trailer.
+	var backendProto atomic.Value
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendProto.Store(r.Proto)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetHTTP1(true)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	t.Cleanup(backend.Close)
+	backendPort := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	cert, pool := selfSigned(t, "site.test")
+	start := func(h2c, http1Only bool) (plain, secure string) {
+		plain, secure = freeAddr(t), freeAddr(t)
+		p := New(plain, nil)
+		p.SetTLSAddr(secure)
+		p.SetHosts(map[string]Host{"site.test": {Cert: cert}})
+		p.SetProtocols(h2c, http1Only)
+		t.Cleanup(p.Shutdown)
+		if err := p.SetTarget(backendPort); err != nil {
+			t.Fatal(err)
+		}
+		return plain, secure
+	}
+	call := func(url string, protos *http.Protocols) *http.Response {
+		t.Helper()
+		c := &http.Client{Transport: &http.Transport{
+			Protocols:       protos,
+			TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "site.test"},
+		}}
+		req, _ := http.NewRequest("POST", url, strings.NewReader("\x00\x00\x00\x00\x02hi"))
+		req.Header.Set("Content-Type", "application/grpc")
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	h1 := new(http.Protocols)
+	h1.SetHTTP1(true)
+	h2 := new(http.Protocols)
+	h2.SetHTTP1(true)
+	h2.SetHTTP2(true)
+	h2cOnly := new(http.Protocols)
+	h2cOnly.SetUnencryptedHTTP2(true)
+
+	// Default: HTTP/2 over TLS, HTTP/1.1 to the app.
+	_, secure := start(false, false)
+	if resp := call("https://"+secure+"/", h2); resp.ProtoMajor != 2 {
+		t.Errorf("TLS listener spoke %s", resp.Proto)
+	}
+	if got := backendProto.Load(); got != "HTTP/1.1" {
+		t.Errorf("backend got %v by default", got)
+	}
+
+	// h2c: prior-knowledge HTTP/2 in, h2c out, trailers intact.
+	plain, _ := start(true, false)
+	resp := call("http://"+plain+"/echo.Echo/Say", h2cOnly)
+	if resp.ProtoMajor != 2 || backendProto.Load() != "HTTP/2.0" {
+		t.Errorf("h2c: client %s, backend %v", resp.Proto, backendProto.Load())
+	}
+	if resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("trailer lost: %v", resp.Trailer)
+	}
+	if resp := call("http://"+plain+"/", h1); resp.StatusCode != 200 {
+		t.Errorf("HTTP/1.1 next to h2c = %d", resp.StatusCode)
+	}
+
+	// http1_only wins, on the TLS listener too.
+	_, secure = start(true, true)
+	if resp := call("https://"+secure+"/", h2); resp.ProtoMajor != 1 || backendProto.Load() != "HTTP/1.1" {
+		t.Errorf("http1_only: client %s, backend %v", resp.Proto, backendProto.Load())
+	}
+}
+
+// dropFirst accepts and immediately closes the first n connections.
+type dropFirst struct {
+	net.Listener
+	n atomic.Int32
+}
+
+func (l *dropFirst) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil || l.n.Add(-1) < 0 {
+			return c, err
+		}
+		c.Close()
+	}
+}
+
+func TestRetryAndFailover(t *testing.T) {
+	t.Parallel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flaky := &dropFirst{Listener: ln}
+	flaky.n.Store(1)
+	go http.Serve(flaky, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new"))
+	}))
+	t.Cleanup(func() { ln.Close() })
+
+	send := func(p *Proxy, method string, body io.Reader) (int, string) {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(method, "/", body))
+		return w.Code, w.Body.String()
+	}
+
+	p := New("", nil)
+	p.port = ln.Addr().(*net.TCPAddr).Port
+	p.SetRetries(2)
+	if code, body := send(p, "GET", nil); code != 200 || body != "new" {
+		t.Fatalf("GET through a dropped connection = %d %q", code, body)
+	}
+	if n := p.Stats().Retries; n != 1 {
+		t.Errorf("retries = %d, want 1", n)
+	}
+
+	// Nothing listens on the target: retries run out, then the previous
+	// slot answers during the failover window.
+	p.port, _ = strconv.Atoi(strings.TrimPrefix(freeAddr(t), "127.0.0.1:"))
+	if code, _ := send(p, "GET", nil); code != 502 {
+		t.Fatalf("GET to a dead target = %d", code)
+	}
+	p.Failover(backendPort(t, "prev"), time.Minute)
+	if code, body := send(p, "GET", nil); code != 200 || body != "prev" {
+		t.Fatalf("GET during failover = %d %q", code, body)
+	}
+	if code, body := send(p, "POST", nil); code != 200 || body != "prev" {
+		t.Fatalf("bodiless POST that never connected = %d %q", code, body)
+	}
+	if code, _ := send(p, "POST", strings.NewReader("x=1")); code != 502 {
+		t.Fatalf("POST with a body was resent: %d", code)
+	}
+	if n := p.Stats().Failovers; n != 2 {
+		t.Errorf("failovers = %d, want 2", n)
+	}
+
+	p.Failover(0, 0)
+	if code, _ := send(p, "GET", nil); code != 502 {
+		t.Fatalf("GET after the window = %d", code)
+	}
+}
+
+func TestAffinity(t *testing.T) {
+	t.Parallel()
+	backend := func(name string) int {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s|%s", name, r.Header.Get("Cookie"))
+		}))
+		t.Cleanup(srv.Close)
+		return srv.Listener.Addr().(*net.TCPAddr).Port
+	}
+	p := New("", nil)
+	p.port = backend("new")
+	p.Failover(backend("old"), time.Minute)
+
+	send := func(cookie string) (string, string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		if cookie != "" {
+			r.Header.Set("Cookie", cookie)
+		}
+		p.ServeHTTP(w, r)
+		return w.Body.String(), w.Header().Get("Set-Cookie")
+	}
+
+	if _, set := send(""); set != "" {
+		t.Fatalf("affinity off, but got Set-Cookie %q", set)
+	}
+
+	p.SetAffinity(time.Hour)
+	body, set := send("")
+	if body != "new|" || !strings.HasPrefix(set, AffinityCookie+"=") || !strings.Contains(set, "Max-Age=3600") {
+		t.Fatalf("first request = %q, Set-Cookie %q", body, set)
+	}
+	newID := strings.TrimPrefix(strings.SplitN(set, ";", 2)[0], AffinityCookie+"=")
+
+	p.mu.RLock()
+	oldID := p.slotID(p.failoverPort)
+	p.mu.RUnlock()
+	body, set = send("a=1; " + AffinityCookie + "=" + oldID)
+	if body != "old|a=1" || set != "" {
+		t.Fatalf("pinned to old = %q, Set-Cookie %q", body, set)
+	}
+	if body, set = send(AffinityCookie + "=" + newID); body != "new|" || set != "" {
+		t.Fatalf("pinned to new = %q, Set-Cookie %q", body, set)
+	}
+
+	// Once the old slot is gone, its clients move over and are re-pinned.
+	p.Failover(0, 0)
+	body, set = send(AffinityCookie + "=" + oldID)
+	if body != "new|" || !strings.Contains(set, newID) {
+		t.Fatalf("after the window = %q, Set-Cookie %q", body, set)
+	}
+}
+
+func TestSlotHeaders(t *testing.T) {
+	t.Parallel()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.Header.Get(HeaderSlot), r.Header.Get(HeaderCommit), r.Header.Get(HeaderInternalPort))
+	}))
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	p := New("", http.NotFoundHandler())
+	p.SetInterceptPrefix("/_slot")
+	p.port = port
+	info := SlotInfo{Slot: "slot-abc1234", Commit: "abc1234def", AppPort: port, InternalPort: 4001}
+	p.SetSlotInfo(info)
+
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if len(header) == 2 {
+			r.Header.Set(header[0], header[1])
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get("/", HeaderSlot, "spoofed"); w.Body.String() != "spoofed  " {
+		t.Errorf("headers off: got %q, client headers should pass through", w.Body.String())
+	}
+	p.SetSlotHeaders(true)
+	if w := get("/", HeaderSlot, "spoofed"); w.Body.String() != "slot-abc1234 abc1234def 4001" {
+		t.Errorf("headers on: got %q", w.Body.String())
+	}
+
+	w := get("/_slot/agent/whoami")
+	var got SlotInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got != info {
+		t.Errorf("whoami = %d %s", w.Code, w.Body.String())
+	}
+
+	p.ForgetSlot(SlotInfo{Slot: "slot-staging", Commit: info.Commit, AppPort: port, InternalPort: 4001})
+	if w := get("/_slot/agent/whoami"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("whoami after the slot is gone = %d", w.Code)
+	}
+	if w := get("/", HeaderSlot, "spoofed"); w.Body.String() != "  " {
+		t.Errorf("unknown slot: got %q, client headers should be dropped", w.Body.String())
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	t.Parallel()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderRequestID, r.Header.Get(HeaderRequestID)) // echoed, as apps do
+		fmt.Fprint(w, r.Header.Get(HeaderRequestID))
+	}))
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	logPath := t.TempDir() + "/access.log"
+	p := New("", http.NotFoundHandler())
+	p.SetAccessLog(logPath)
+	p.port = port
+	p.SetSlotInfo(SlotInfo{Slot: "slot-abc1234", AppPort: port})
+
+	get := func(id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/orders?page=2", nil)
+		if id != "" {
+			r.Header.Set(HeaderRequestID, id)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("")
+	id := w.Header().Get(HeaderRequestID)
+	if len(id) != 32 || w.Body.String() != id {
+		t.Fatalf("generated id: header %q, app saw %q", id, w.Body.String())
+	}
+	if n := len(w.Header().Values(HeaderRequestID)); n != 1 {
+		t.Errorf("%d X-Request-Id headers in the response, want 1", n)
+	}
+	if w := get("client-id-42"); w.Body.String() != "client-id-42" || w.Header().Get(HeaderRequestID) != "client-id-42" {
+		t.Errorf("client's id not kept: %q", w.Body.String())
+	}
+	if w := get("bad id\x01"); w.Body.String() == "bad id\x01" || len(w.Body.String()) != 32 {
+		t.Errorf("unprintable id kept: %q", w.Body.String())
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("access log has %d lines, want 3:\n%s", len(lines), data)
+	}
+	fields := strings.Fields(lines[0])
+	if len(fields) != 8 || fields[1] != id || fields[2] != "GET" || fields[3] != "/orders?page=2" || fields[4] != "200" || fields[6] != "slot-abc1234" || fields[7] != "192.0.2.1" {
+		t.Errorf("access log line = %q", lines[0])
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("slow"))
+	}))
+	t.Cleanup(backend.Close)
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	p := New("", nil)
+	p.port = port
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		done <- w.Code
+	}()
+	for p.InFlight(port) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The request holds the port busy after the proxy moves on.
+	p.port = backendPort(t, "new")
+	if p.WaitIdle(port, 50*time.Millisecond) {
+		t.Fatal("WaitIdle returned true with a request in flight")
+	}
+	close(release)
+	if code := <-done; code != 200 {
+		t.Fatalf("in-flight request got %d", code)
+	}
+	if !p.WaitIdle(port, time.Second) || p.InFlight(port) != 0 {
+		t.Fatalf("in flight = %d after the request finished", p.InFlight(port))
+	}
+
+	// Upgrades aren't counted.
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Upgrade", "websocket")
+	p.track(r, port)
+	if n := p.InFlight(port); n != 0 {
+		t.Errorf("upgrade counted: %d in flight", n)
+	}
+}
+
+func TestMultipleAddrs(t *testing.T) {
+	t.Parallel()
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	first, second := freeAddr(t), freeAddr(t)
+
+	p := New("", nil)
+	t.Cleanup(p.Shutdown)
+	p.SetAddrs(first, busy.Addr().String(), second)
+	// The busy address fails, but the others are bound anyway.
+	if err := p.SetTarget(backendPort(t, "ok")); err == nil || !strings.Contains(err.Error(), busy.Addr().String()) {
+		t.Fatalf("SetTarget = %v, want the busy address's bind error", err)
+	}
+	get := func(addr string) error {
+		resp, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if body, _ := io.ReadAll(resp.Body); string(body) != "ok" {
+			return fmt.Errorf("got %q", body)
+		}
+		return nil
+	}
+	for _, addr := range []string{first, second} {
+		if err := get(addr); err != nil {
+			t.Errorf("GET %s: %v", addr, err)
+		}
+	}
+
+	busy.Close()
+	if err := p.EnsureListener(); err != nil || p.LastError() != "" {
+		t.Fatalf("EnsureListener after port freed: %v (LastError %q)", err, p.LastError())
+	}
+	if err := get(busy.Addr().String()); err != nil {
+		t.Errorf("GET formerly busy address: %v", err)
+	}
+
+	// Dropping addresses closes their listeners.
+	p.SetAddrs(first)
+	if err := get(second); err == nil {
+		t.Error("dropped address still answers")
+	}
+	if err := get(first); err != nil {
+		t.Errorf("GET kept address: %v", err)
+	}
+	if got := p.Addrs(); !slices.Equal(got, []string{first}) {
+		t.Errorf("Addrs = %v", got)
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7").To4(), Port: 5555}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 5555}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 80}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80}
+	for _, tc := range []struct {
+		name, in, want, err string
+	}{
+		{"v1 tcp4", "PROXY TCP4 203.0.113.7 10.0.0.1 5555 80\r\n", "203.0.113.7:5555", ""},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::7 2001:db8::1 5555 80\r\n", "[2001:db8::7]:5555", ""},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", ""},
+		{"v1 malformed", "PROXY TCP4 nonsense\r\n", "", "malformed"},
+		{"v1 unterminated", "PROXY TCP4 " + strings.Repeat("1", 200), "", "too long"},
+		{"v2 tcp4", string(proxyHeader("v2", src, dst)), "203.0.113.7:5555", ""},
+		{"v2 tcp6", string(proxyHeader("v2", src6, dst6)), "[2001:db8::7]:5555", ""},
+		{"v2 local", string(proxyHeader("v2", nil, dst)), "", ""},
+		{"v1 written", string(proxyHeader("v1", src, dst)), "203.0.113.7:5555", ""},
+		{"none", "GET / HTTP/1.1\r\n", "", ""},
+		{"put", "PUT / HTTP/1.1\r\n", "", ""},
+	} {
+		r := bufio.NewReader(strings.NewReader(tc.in + "GET / HTTP/1.1\r\n"))
+		addr, err := readProxyHeader(r)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: err = %v, want %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%s: %q, %v; want %q", tc.name, got, err, tc.want)
+		}
+		// What follows the header is left to read.
+		if rest, _ := io.ReadAll(r); !strings.HasSuffix(string(rest), "GET / HTTP/1.1\r\n") || (tc.want != "" && strings.HasPrefix(string(rest), "PROXY")) {
+			t.Errorf("%s: left %q", tc.name, rest)
+		}
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	t.Parallel()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Forwarded-For"))
+	}))
+	defer backend.Close()
+
+	p := New(freeAddr(t), nil)
+	t.Cleanup(p.Shutdown)
+	p.SetProxyProtocol(true, "")
+	p.SetTrustedProxies([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	if err := p.SetTarget(backend.Listener.Addr().(*net.TCPAddr).Port); err != nil {
+		t.Fatal(err)
+	}
+
+	// A trusted peer's header names the client the app sees.
+	send := func(header string) string {
+		t.Helper()
+		conn, err := net.Dial("tcp", p.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "%sGET / HTTP/1.1\r\nHost: x\r\nX-Forwarded-For: 6.6.6.6\r\nConnection: close\r\n\r\n", header)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7").To4(), Port: 5555}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 80}
+	// The client's own X-Forwarded-For is dropped: the client isn't trusted.
+	if got := send("PROXY TCP4 203.0.113.7 10.0.0.1 5555 80\r\n"); got != "203.0.113.7" {
+		t.Errorf("v1: app saw X-Forwarded-For %q", got)
+	}
+	if got := send(string(proxyHeader("v2", src, dst))); got != "203.0.113.7" {
+		t.Errorf("v2: app saw X-Forwarded-For %q", got)
+	}
+	// Without a header the peer is the client, and it's trusted.
+	if got := send(""); got != "6.6.6.6, 127.0.0.1" {
+		t.Errorf("no header: app saw X-Forwarded-For %q", got)
+	}
+	if got := send("PROXY TCP4 bogus\r\n"); strings.Contains(got, "6.6.6.6") {
+		t.Errorf("malformed header: the request reached the app (%q)", got)
+	}
+	// With no trusted proxies listed, no one's PROXY header is believed.
+	p.SetTrustedProxies(nil)
+	if got := send("PROXY TCP4 203.0.113.7 10.0.0.1 5555 80\r\n"); strings.Contains(got, "203.0.113.7") {
+		t.Errorf("untrusted v1: app saw X-Forwarded-For %q", got)
+	}
+}
+
+func TestProxyProtocolSend(t *testing.T) {
+	t.Parallel()
+	// The app reads the header the proxy writes.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.RemoteAddr)
+	})}
+	go app.Serve(&proxyListener{Listener: ln, trusted: func(string) bool { return true }})
+	defer app.Close()
+
+	for _, version := range []string{"v1", "v2"} {
+		p := New("", nil)
+		p.port = ln.Addr().(*net.TCPAddr).Port
+		p.SetProxyProtocol(false, version)
+		for _, client := range []string{"198.51.100.9:1234", "[2001:db8::9]:1234"} {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = client
+			local := "10.0.0.1:443"
+			if strings.HasPrefix(client, "[") {
+				local = "[2001:db8::1]:443"
+			}
+			r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, net.TCPAddrFromAddrPort(netip.MustParseAddrPort(local))))
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+			if w.Body.String() != client {
+				t.Errorf("%s: app saw %q, want %q", version, w.Body.String(), client)
+			}
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	t.Parallel()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s", r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Proto"))
+	}))
+	defer backend.Close()
+
+	logPath := t.TempDir() + "/access.log"
+	p := New("", nil)
+	p.port = backend.Listener.Addr().(*net.TCPAddr).Port
+	p.SetAccessLog(logPath)
+	p.SetTrustedProxies([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+
+	get := func(peer, xff string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = peer
+		r.Header.Set("X-Forwarded-For", xff)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+	// A client can't claim an address or scheme.
+	if got := get("192.0.2.1:1000", "1.2.3.4"); got != "192.0.2.1|" {
+		t.Errorf("untrusted peer: app saw %q", got)
+	}
+	// A trusted balancer's are passed on.
+	if got := get("10.1.1.1:1000", "1.2.3.4, 10.2.2.2"); got != "1.2.3.4, 10.2.2.2, 10.1.1.1|https" {
+		t.Errorf("trusted peer: app saw %q", got)
+	}
+
+	data, _ := os.ReadFile(logPath)
+	var clients []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		clients = append(clients, fields[len(fields)-1])
+	}
+	if want := []string{"192.0.2.1", "1.2.3.4"}; !slices.Equal(clients, want) {
+		t.Errorf("access log clients = %v, want %v", clients, want)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	t.Parallel()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			// Headers right away, then a body slower than any timeout.
+			w.WriteHeader(200)
+			w.(http.Flusher).Flush()
+			time.Sleep(300 * time.Millisecond)
+			io.WriteString(w, "done")
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "slow")
+	}))
+	t.Cleanup(backend.Close)
+
+	p := New("", nil)
+	p.port = backend.Listener.Addr().(*net.TCPAddr).Port
+	p.SetTimeouts(50*time.Millisecond, map[string]time.Duration{"/reports": time.Second, "/reports/live": 0})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	start := time.Now()
+	if w := get("/slow"); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("/slow: %d %q, want 504", w.Code, w.Body)
+	}
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Errorf("timed out after %s", d)
+	}
+	for _, path := range []string{"/reports/monthly", "/reports/live"} {
+		if w := get(path); w.Code != 200 || w.Body.String() != "slow" {
+			t.Errorf("%s: %d %q, want 200", path, w.Code, w.Body)
+		}
+	}
+	if w := get("/stream"); w.Code != 200 || w.Body.String() != "done" {
+		t.Errorf("/stream: %d %q; the body isn't timed", w.Code, w.Body)
+	}
+	if st := p.Stats(); st.Timeouts != 1 || st.Circuit != "" {
+		t.Errorf("stats = %+v", st)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+	var hits atomic.Int32
+	var code atomic.Int32
+	code.Store(503)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(int(code.Load()))
+	}))
+	t.Cleanup(backend.Close)
+
+	p := New("", nil)
+	p.port = backend.Listener.Addr().(*net.TCPAddr).Port
+	p.SetBreaker(3, 100*time.Millisecond)
+	get := func() int {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w.Code
+	}
+
+	// A 500 is the app's own bug, not a failure to answer.
+	code.Store(500)
+	for range 5 {
+		get()
+	}
+	if st := p.Stats(); st.Circuit != CircuitClosed {
+		t.Fatalf("circuit %s after 500s", st.Circuit)
+	}
+
+	// Three 503s in a row open it; then requests don't reach the app.
+	code.Store(503)
+	for range 3 {
+		get()
+	}
+	hits.Store(0)
+	if c := get(); c != 503 || hits.Load() != 0 {
+		t.Fatalf("open circuit: %d, %d hits", c, hits.Load())
+	}
+	if st := p.Stats(); st.Circuit != CircuitOpen || st.CircuitOpens != 1 || st.CircuitRejected != 1 {
+		t.Errorf("stats = %+v", st)
+	}
+
+	// Half-open: a failed probe opens it again.
+	time.Sleep(120 * time.Millisecond)
+	if st := p.Stats(); st.Circuit != CircuitHalfOpen {
+		t.Errorf("circuit %s, want half-open", st.Circuit)
+	}
+	get()
+	if hits.Load() != 1 || p.Stats().Circuit != CircuitOpen {
+		t.Errorf("after a failed probe: %d hits, circuit %s", hits.Load(), p.Stats().Circuit)
+	}
+
+	// A probe that succeeds closes it.
+	code.Store(200)
+	time.Sleep(120 * time.Millisecond)
+	if c := get(); c != 200 {
+		t.Errorf("probe: %d", c)
+	}
+	if c := get(); c != 200 || p.Stats().Circuit != CircuitClosed {
+		t.Errorf("after the probe: %d, circuit %s", c, p.Stats().Circuit)
+	}
+
+	// Each port has a circuit of its own.
+	code.Store(503)
+	for range 3 {
+		get()
+	}
+	p.port = backendPort(t, "new slot")
+	if c := get(); c != 200 {
+		t.Errorf("new target: %d", c)
+	}
+}
+
+func TestClose(t *testing.T) {
+	t.Parallel()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, _ := time.ParseDuration(r.URL.Query().Get("sleep"))
+		time.Sleep(d)
+		io.WriteString(w, "done")
+	}))
+	t.Cleanup(backend.Close)
+
+	for _, tc := range []struct {
+		timeout time.Duration
+		ok      bool
+	}{
+		{time.Second, true},            // the request in flight is answered
+		{50 * time.Millisecond, false}, // its connection is closed
+	} {
+		addr := freeAddr(t)
+		p := New(addr, nil)
+		if err := p.SetTarget(backend.Listener.Addr().(*net.TCPAddr).Port); err != nil {
+			t.Fatal(err)
+		}
+		code := make(chan int, 1)
+		go func() {
+			resp, err := http.Get("http://" + addr + "/?sleep=300ms")
+			if err != nil {
+				code <- 0
+				return
+			}
+			resp.Body.Close()
+			code <- resp.StatusCode
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		closed := make(chan bool)
+		go func() { closed <- p.Close(tc.timeout) }()
+		time.Sleep(50 * time.Millisecond)
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Errorf("timeout %s: still accepting connections", tc.timeout)
+		}
+		if ok := <-closed; ok != tc.ok {
+			t.Errorf("timeout %s: Close = %v", tc.timeout, ok)
+		}
+		if c := <-code; (c == 200) != tc.ok {
+			t.Errorf("timeout %s: request in flight got %d", tc.timeout, c)
+		}
+
+		// It doesn't listen again.
+		if err := p.SetTarget(1234); err != nil {
+			t.Errorf("SetTarget after Close: %v", err)
+		}
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Errorf("timeout %s: listening again after Close", tc.timeout)
+		}
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	t.Parallel()
+	addr := freeAddr(t)
+	old := New(addr, nil)
+	if err := old.SetTarget(backendPort(t, "old")); err != nil {
+		t.Fatal(err)
+	}
+
+	// What a re-exec does: keep a copy of the socket, stop serving.
+	tcp, ok := old.Listeners()[addr].(*net.TCPListener)
+	if !ok {
+		t.Fatalf("Listeners = %v, want %s", old.Listeners(), addr)
+	}
+	f, err := tcp.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Close(time.Second)
+	ln, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A client connecting in between waits in the backlog.
+	answered := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			answered <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		answered <- string(body)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	p := New(addr, nil)
+	t.Cleanup(p.Shutdown)
+	if p.Inherit("127.0.0.1:1", ln) {
+		t.Error("Inherit took an address the proxy doesn't have")
+	}
+	if !p.Inherit(addr, ln) {
+		t.Fatal("Inherit refused the proxy's address")
+	}
+	if err := p.SetTarget(backendPort(t, "new")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-answered; got != "new" {
+		t.Errorf("request during the handoff got %q, want the new proxy's answer", got)
+	}
+}
@@ -0,0 +1,408 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Behind a TCP load balancer (HAProxy, a cloud LB, a tunnel) every
+// connection comes from the balancer, and the client's address is lost
+// unless the balancer sends it in a PROXY protocol header
+// (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt) ahead of
+// the connection's bytes. With accept on, the public listeners read a v1
+// or v2 header from trusted peers, and the request's RemoteAddr becomes
+// the client's. With send set, the proxy writes one to the app in turn,
+// on a connection of its own for each request.
+//
+// Trusted proxies are also the only peers whose X-Forwarded-* headers are
+// passed on; anyone else's are dropped, so a client can't claim another
+// address. With none configured, every peer is trusted, as before, but
+// for PROXY headers, which need a peer listed explicitly.
+
+// proxyHeaderTimeout bounds the wait for a trusted peer's PROXY header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// v2Signature starts every PROXY protocol v2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// forwardedHeaders are dropped from requests by untrusted peers.
+var forwardedHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip"}
+
+// SetProxyProtocol makes the public listeners read PROXY headers (accept)
+// and the proxy send them to the app in version send ("v1", "v2", or ""
+// for none). Listeners are wrapped when they bind, so call it before
+// SetTarget.
+func (p *Proxy) SetProxyProtocol(accept bool, send string) {
+	var backend *http.Transport
+	if send != "" {
+		backend = http.DefaultTransport.(*http.Transport).Clone()
+		backend.DisableKeepAlives = true // a connection carries one client
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		backend.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			src, _ := ctx.Value(clientAddrKey{}).(net.Addr)
+			dst, _ := ctx.Value(http.LocalAddrContextKey).(net.Addr)
+			if _, err := conn.Write(proxyHeader(send, src, dst)); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.acceptProxy = accept
+	p.sendProxy = backend
+}
+
+// SetTrustedProxies sets the peers whose PROXY headers and X-Forwarded-*
+// headers are believed. None trusts every peer's X-Forwarded-* headers and
+// no one's PROXY headers.
+func (p *Proxy) SetTrustedProxies(prefixes []netip.Prefix) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.trusted = prefixes
+}
+
+// trustedPeer reports whether addr ("host:port" or a bare IP) is a
+// trusted proxy.
+func (p *Proxy) trustedPeer(addr string) bool {
+	p.mu.RLock()
+	trusted := p.trusted
+	p.mu.RUnlock()
+	if len(trusted) == 0 {
+		return true
+	}
+	ip, ok := parseIP(addr)
+	if !ok {
+		return false
+	}
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyPeer reports whether addr may send a PROXY header: a trusted proxy,
+// with at least one configured.
+func (p *Proxy) proxyPeer(addr string) bool {
+	p.mu.RLock()
+	configured := len(p.trusted) > 0
+	p.mu.RUnlock()
+	return configured && p.trustedPeer(addr)
+}
+
+// parseIP reads the IP of "host:port" or a bare IP, IPv4-mapped IPv6
+// addresses as IPv4.
+func parseIP(addr string) (netip.Addr, bool) {
+	addr = strings.TrimSpace(addr)
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	ip, err := netip.ParseAddr(strings.Trim(addr, "[]"))
+	return ip.Unmap(), err == nil
+}
+
+// HeaderUser names the signed-in user, for agent_auth trusted: the proxy
+// in front that authenticated them sets it.
+const HeaderUser = "X-SlotMachine-User"
+
+// trustedProxyKey marks a request from a listed trusted proxy.
+type trustedProxyKey struct{}
+
+// FromTrustedProxy reports whether r came through the proxy from a peer
+// listed in trusted_proxies, whose HeaderUser can be believed. Anyone's
+// with none listed, the agent included, can't: it has a shell on this box.
+func FromTrustedProxy(r *http.Request) bool {
+	return r.Context().Value(trustedProxyKey{}) != nil
+}
+
+// forwardedFrom drops r's X-Forwarded-* headers and HeaderUser unless its
+// peer is trusted, and returns r marked if it's a listed trusted proxy.
+func (p *Proxy) forwardedFrom(r *http.Request) *http.Request {
+	if p.proxyPeer(r.RemoteAddr) {
+		return r.WithContext(context.WithValue(r.Context(), trustedProxyKey{}, true))
+	}
+	if p.trustedPeer(r.RemoteAddr) {
+		return r
+	}
+	for _, h := range forwardedHeaders {
+		r.Header.Del(h)
+	}
+	r.Header.Del(HeaderUser)
+	return r
+}
+
+// clientAddr is the address r came from: its peer's, or behind trusted
+// proxies, the last address in X-Forwarded-For that isn't one of them.
+func (p *Proxy) clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	p.mu.RLock()
+	configured := len(p.trusted) > 0
+	p.mu.RUnlock()
+	if !configured || !p.trustedPeer(r.RemoteAddr) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if _, ok := parseIP(hop); !ok {
+			break
+		}
+		host = hop
+		if !p.trustedPeer(hop) {
+			break
+		}
+	}
+	return host
+}
+
+// clientAddrKey carries the client's address to the dialer that sends it
+// to the app.
+type clientAddrKey struct{}
+
+// withClientAddr returns r with its client's address in its context, when
+// PROXY headers are sent to the app.
+func (p *Proxy) withClientAddr(r *http.Request) *http.Request {
+	p.mu.RLock()
+	sending := p.sendProxy != nil
+	p.mu.RUnlock()
+	if !sending {
+		return r
+	}
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), clientAddrKey{}, net.TCPAddrFromAddrPort(ap)))
+}
+
+// proxyListener reads a PROXY header from each connection a trusted peer
+// makes, in the connection's own goroutine: net/http asks for the remote
+// address there, not in Accept.
+type proxyListener struct {
+	net.Listener
+	trusted func(addr string) bool
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, trusted: l.trusted}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	trusted func(addr string) bool
+
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+// init reads the PROXY header, if the peer is trusted and sent one.
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		c.r = bufio.NewReader(c.Conn)
+		if !c.trusted(c.remote.String()) {
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		src, err := readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			c.err = fmt.Errorf("PROXY header from %s: %w", c.remote, err)
+			return
+		}
+		if src != nil {
+			c.remote = src
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// readProxyHeader consumes a v1 or v2 PROXY header from r and returns the
+// client address it names. Without a header it reads nothing and returns
+// nil, as it does for headers that name no address (LOCAL, UNKNOWN, or
+// not TCP).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil // let the server see the error
+	}
+	switch first[0] {
+	case 'P':
+		if prefix, err := r.Peek(6); err != nil || string(prefix) != "PROXY " {
+			return nil, nil
+		}
+		return readV1(r)
+	case v2Signature[0]:
+		if sig, err := r.Peek(len(v2Signature)); err != nil || !bytes.Equal(sig, v2Signature) {
+			return nil, nil
+		}
+		return readV2(r)
+	}
+	return nil, nil
+}
+
+// readV1 reads "PROXY TCP4 <src> <dst> <sport> <dport>\r\n".
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 { // the longest header the spec allows
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("v1 header too long or not CRLF-terminated")
+	}
+	fields := strings.Split(s, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", s)
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed v1 source port %q", fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readV2 reads the binary header: signature, version and command, family
+// and transport, length, then the addresses and any TLVs, which are
+// skipped.
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0x0f == 0 { // LOCAL: the balancer's own health check
+		return nil, nil
+	}
+	var ip netip.Addr
+	var port uint16
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("short v2 IPv4 addresses")
+		}
+		ip = netip.AddrFrom4([4]byte(body[0:4]))
+		port = binary.BigEndian.Uint16(body[8:10])
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short v2 IPv6 addresses")
+		}
+		ip = netip.AddrFrom16([16]byte(body[0:16])).Unmap()
+		port = binary.BigEndian.Uint16(body[32:34])
+	default:
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+}
+
+// proxyHeader is the header telling the app a connection is for src,
+// which reached the proxy at dst. Without both, it says so: UNKNOWN in v1,
+// LOCAL in v2.
+func proxyHeader(version string, src, dst net.Addr) []byte {
+	s, sok := addrPort(src)
+	d, dok := addrPort(dst)
+	known := sok && dok && s.Addr().Is4() == d.Addr().Is4()
+	if version == "v1" {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP4"
+		if !s.Addr().Is4() {
+			family = "TCP6"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, s.Addr(), d.Addr(), s.Port(), d.Port())
+	}
+
+	b := append([]byte(nil), v2Signature...)
+	if !known {
+		return append(b, 0x20, 0x00, 0, 0)
+	}
+	var addrs []byte
+	family := byte(0x11)
+	if s.Addr().Is4() {
+		a, b := s.Addr().As4(), d.Addr().As4()
+		addrs = append(append(addrs, a[:]...), b[:]...)
+	} else {
+		family = 0x21
+		a, b := s.Addr().As16(), d.Addr().As16()
+		addrs = append(append(addrs, a[:]...), b[:]...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, s.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, d.Port())
+	b = append(b, 0x21, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+// addrPort converts a TCP address, IPv4-mapped addresses to IPv4.
+func addrPort(a net.Addr) (netip.AddrPort, bool) {
+	t, ok := a.(*net.TCPAddr)
+	if !ok || t == nil {
+		return netip.AddrPort{}, false
+	}
+	ap := t.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), ap.IsValid()
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Every request through the proxy carries an X-Request-Id, to the app and
+// back to the client: the client's own if it sent a usable one, else a new
+// one. Forwarded requests are written to the access log with their ID, so
+// a failed request can be followed from the proxy into the slot's output
+// when the app logs the header too.
+
+// HeaderRequestID is the request ID header.
+const HeaderRequestID = "X-Request-Id"
+
+// accessLogMax is the size at which the access log is moved to .1 and
+// started afresh, so it never grows past twice this.
+const accessLogMax = 16 << 20
+
+// requestID returns r's X-Request-Id if it's short and printable, or a new
+// random one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(HeaderRequestID); id != "" && len(id) <= 128 {
+		ok := true
+		for _, c := range id {
+			if c <= ' ' || c > '~' {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return id
+		}
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// accessLog appends one line per forwarded request to a file, opened on
+// first use.
+type accessLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	size int64
+}
+
+// SetAccessLog writes a line per forwarded request to path: time, request
+// ID, method, URI, status, duration, the slot that answered ("-" for
+// none), and the client's address. An empty path turns it off.
+func (p *Proxy) SetAccessLog(path string) {
+	p.mu.Lock()
+	old := p.access
+	p.access = nil
+	if path != "" {
+		p.access = &accessLog{path: path}
+	}
+	p.mu.Unlock()
+	old.close()
+}
+
+func (l *accessLog) write(start time.Time, id string, r *http.Request, code int, slot, client string) {
+	if l == nil {
+		return
+	}
+	if slot == "" {
+		slot = "-"
+	}
+	line := fmt.Sprintf("%s %s %s %s %d %dms %s %s\n", start.UTC().Format(time.RFC3339Nano), id, r.Method, r.URL.RequestURI(), code, time.Since(start).Milliseconds(), slot, client)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return
+		}
+		info, _ := f.Stat()
+		l.f, l.size = f, info.Size()
+	}
+	n, _ := l.f.WriteString(line)
+	l.size += int64(n)
+	if l.size >= accessLogMax {
+		l.f.Close()
+		l.f = nil
+		os.Rename(l.path, l.path+".1")
+	}
+}
+
+func (l *accessLog) close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// A freshly promoted slot can drop its first connections while its accept
+// queue fills or its workers fork. Requests that fail to reach it and are
+// safe to send again are retried a few times, and during a failover window
+// right after a switch they go to the previous slot, which keeps running
+// until the window ends.
+
+// retryBackoff is the wait before the first retry; it doubles after each.
+var retryBackoff = 25 * time.Millisecond
+
+// SetRetries sets how many times a failed request that's safe to resend is
+// retried on the target before giving up with a 502. Zero disables retries.
+func (p *Proxy) SetRetries(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retries = max(n, 0)
+}
+
+// Failover sends requests that can't reach the target, and are safe to
+// resend, to port instead for the next d. Port 0 ends the window.
+func (p *Proxy) Failover(port int, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failoverPort = port
+	p.failoverUntil = time.Now().Add(d)
+}
+
+// transport returns the round tripper for forwarding r to port: the backend
+// transport, wrapped to retry and fail over when configured.
+func (p *Proxy) transport(r *http.Request, port int) http.RoundTripper {
+	base := p.backend(r)
+	p.mu.RLock()
+	rt := &retrier{p: p, base: base, retries: p.retries}
+	if p.failoverPort > 0 && p.failoverPort != port && time.Now().Before(p.failoverUntil) {
+		rt.fallback = p.failoverPort
+	}
+	p.mu.RUnlock()
+	if rt.retries == 0 && rt.fallback == 0 {
+		return base
+	}
+	if rt.base == nil {
+		rt.base = http.DefaultTransport
+	}
+	return rt
+}
+
+type retrier struct {
+	p        *Proxy
+	base     http.RoundTripper
+	retries  int
+	fallback int // previous slot's port, 0 for none
+}
+
+func (rt *retrier) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.base.RoundTrip(req)
+	backoff := retryBackoff
+	for i := 0; i < rt.retries && err != nil && resendable(req, err); i++ {
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, err
+		}
+		backoff *= 2
+		rt.p.retried.Add(1)
+		resp, err = rt.base.RoundTrip(req)
+	}
+	if err != nil && rt.fallback > 0 && resendable(req, err) {
+		prev := req.Clone(req.Context())
+		prev.URL.Host = fmt.Sprintf("127.0.0.1:%d", rt.fallback)
+		rt.p.setSlotHeaders(prev.Header, rt.fallback)
+		rt.p.failovers.Add(1)
+		resp, err = rt.base.RoundTrip(prev)
+	}
+	return resp, err
+}
+
+// resendable reports whether req can be sent again after err: it has no
+// body to replay, and either its method is idempotent or the connection
+// was never made, so the app can't have seen it.
+func resendable(req *http.Request, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// Host routes send requests for a given Host header to their own port
+// instead of the live target, e.g. preview slots on subdomains. They skip
+// the agent intercept and the traffic counters.
+
+// Route sends requests for host to port. Port 0 removes the route.
+func (p *Proxy) Route(host string, port int) {
+	host = strings.ToLower(host)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if port == 0 {
+		delete(p.routes, host)
+		return
+	}
+	if p.routes == nil {
+		p.routes = map[string]int{}
+	}
+	p.routes[host] = port
+}
+
+// RouteDomain reserves the subdomains of domain for routes: a request for
+// one without a route gets a 404 instead of reaching the live app. An
+// empty domain reserves nothing.
+func (p *Proxy) RouteDomain(domain string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.routeDomain = strings.ToLower(strings.TrimPrefix(domain, "."))
+}
+
+// route returns the port for r's host, and whether the host is routed at
+// all (a reserved host without a route returns port 0).
+func (p *Proxy) route(r *http.Request) (int, bool) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if port, ok := p.routes[host]; ok {
+		return port, true
+	}
+	if p.routeDomain != "" && strings.HasSuffix(host, "."+p.routeDomain) {
+		return 0, true
+	}
+	return 0, false
+}
+
+// serveRoute forwards r to port over transport (nil for the default).
+func serveRoute(w http.ResponseWriter, r *http.Request, port int, transport http.RoundTripper) {
+	if port == 0 {
+		http.Error(w, "no such preview", http.StatusNotFound)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = fmt.Sprintf("127.0.0.1:%d", port)
+			setForwardedProto(req)
+		},
+		Transport: transport,
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// The proxy knows which slot answers each request, which the app itself
+// doesn't. With slot headers on, a request forwarded to a slot carries its
+// name, commit, and internal port, so the app can report the release that
+// answered or call its own internal endpoints; whatever a client sent under
+// those names is replaced. /agent/whoami (under the intercept prefix, if
+// any) returns the same for the slot a request would reach, whether or not
+// the headers are on.
+
+// Headers set on forwarded requests when slot headers are on.
+const (
+	HeaderSlot         = "X-SlotMachine-Slot"
+	HeaderCommit       = "X-SlotMachine-Commit"
+	HeaderInternalPort = "X-SlotMachine-Internal-Port"
+)
+
+// whoamiPath is the intercepted path that describes the serving slot.
+const whoamiPath = "/agent/whoami"
+
+// SlotInfo describes the slot listening on an app port.
+type SlotInfo struct {
+	Slot         string `json:"slot"`
+	Commit       string `json:"commit"`
+	AppPort      int    `json:"app_port"`
+	InternalPort int    `json:"internal_port"`
+}
+
+// SetSlotInfo records which slot listens on info.AppPort.
+func (p *Proxy) SetSlotInfo(info SlotInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.slots == nil {
+		p.slots = map[int]SlotInfo{}
+	}
+	p.slots[info.AppPort] = info
+}
+
+// ForgetSlot drops what SetSlotInfo recorded for info's port, unless
+// another process has been recorded there since. The slot's name may have
+// changed in between.
+func (p *Proxy) ForgetSlot(info SlotInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cur := p.slots[info.AppPort]; cur.Commit == info.Commit && cur.InternalPort == info.InternalPort {
+		delete(p.slots, info.AppPort)
+	}
+}
+
+// SetSlotHeaders turns the X-SlotMachine-* request headers on or off.
+func (p *Proxy) SetSlotHeaders(on bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.slotHeaders = on
+}
+
+// setSlotHeaders sets the slot headers in h for the slot on port, if they
+// are on.
+func (p *Proxy) setSlotHeaders(h http.Header, port int) {
+	p.mu.RLock()
+	on := p.slotHeaders
+	info, ok := p.slots[port]
+	p.mu.RUnlock()
+	if !on {
+		return
+	}
+	h.Del(HeaderSlot)
+	h.Del(HeaderCommit)
+	h.Del(HeaderInternalPort)
+	if !ok {
+		return
+	}
+	h.Set(HeaderSlot, info.Slot)
+	h.Set(HeaderCommit, info.Commit)
+	h.Set(HeaderInternalPort, strconv.Itoa(info.InternalPort))
+}
+
+// slotName names the slot on port for the access log, or gives the port
+// if it isn't known.
+func (p *Proxy) slotName(port int) string {
+	if port == 0 {
+		return "-"
+	}
+	p.mu.RLock()
+	info, ok := p.slots[port]
+	p.mu.RUnlock()
+	if !ok {
+		return strconv.Itoa(port)
+	}
+	return info.Slot
+}
+
+// serveWhoami answers /agent/whoami with the slot r would be forwarded to.
+func (p *Proxy) serveWhoami(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	port := p.port
+	if p.affinityTTL > 0 {
+		if pin := p.pinned(r); pin != 0 {
+			port = pin
+		}
+	}
+	info, ok := p.slots[port]
+	p.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if port == 0 || !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "no live slot"})
+		return
+	}
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,1108 @@
+// Package client is a Go client for the slot-machine daemon API.
+//
+// The deploy API (deploy, rollback, status, history, logs) is served on the
+// daemon's API port. The agent API (/agent/*) is served on the app's public
+// port, so it needs WithAppURL.
+//
+//	c := client.New(client.WithHost("http://127.0.0.1:9100"))
+//	res, err := c.Deploy(ctx, "abc123")
+//	if errors.Is(err, client.ErrHealthCheckFailed) { ... }
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultHost is the API address used when WithHost is not given.
+const DefaultHost = "http://127.0.0.1:9100"
+
+// Client talks to a single slot-machine daemon. It is safe for concurrent use.
+type Client struct {
+	host       string
+	appURL     string
+	token      string
+	user       string
+	userSecret string // signs user for each request, if set (WithSignedUser)
+	hc         *http.Client
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHost sets the daemon API base URL, e.g. "http://127.0.0.1:9100".
+func WithHost(host string) Option {
+	return func(c *Client) { c.host = strings.TrimRight(host, "/") }
+}
+
+// WithAppURL sets the app's public base URL, where the agent API is served.
+func WithAppURL(u string) Option {
+	return func(c *Client) { c.appURL = strings.TrimRight(u, "/") }
+}
+
+// WithToken sends "Authorization: Bearer <token>" with every request, for
+// daemons that sit behind an authenticating proxy.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithUser sets the X-SlotMachine-User header sent to the agent API. In hmac
+// auth mode this must be a signed value (see SignUser), which expires; use
+// WithSignedUser to sign each request instead.
+func WithUser(user string) Option {
+	return func(c *Client) { c.user, c.userSecret = user, "" }
+}
+
+// WithSignedUser sends X-SlotMachine-User for user, signed with secret (the
+// app's SLOT_MACHINE_AUTH_SECRET) afresh for each request, for the agent
+// API in hmac auth mode.
+func WithSignedUser(user, secret string) Option {
+	return func(c *Client) { c.user, c.userSecret = user, secret }
+}
+
+// SignUser returns the X-SlotMachine-User value for user at t in hmac auth
+// mode: "user:timestamp:nonce:signature", the hex HMAC-SHA256 of
+// "user:timestamp:nonce" keyed with secret, with a random nonce so that no
+// two are the same. The daemon accepts it for agent_auth_max_age_sec
+// (SLOT_MACHINE_AUTH_MAX_AGE) either side of t, and with
+// agent_auth_replay_cache only once.
+func SignUser(secret, user string, t time.Time) string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	signed := user + ":" + strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', 3, 64) + ":" + hex.EncodeToString(nonce)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + ":" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WithHTTPClient replaces the underlying http.Client.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.hc = hc }
+}
+
+// New returns a Client for the daemon at DefaultHost unless overridden.
+func New(opts ...Option) *Client {
+	c := &Client{host: DefaultHost, hc: http.DefaultClient}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ---------------------------------------------------------------------------
+// Errors
+// ---------------------------------------------------------------------------
+
+var (
+	// ErrUnreachable wraps transport failures: the daemon is not running or
+	// not listening where expected.
+	ErrUnreachable = errors.New("cannot reach slot-machine daemon")
+
+	// ErrHealthCheckFailed matches an *APIError for a deploy, rollback, or
+	// restart whose new process never passed its health check.
+	ErrHealthCheckFailed = errors.New("health check failed")
+
+	// ErrDeployInProgress matches an *APIError for a request rejected
+	// because another deploy or rollback is running.
+	ErrDeployInProgress = errors.New("deploy in progress")
+
+	// ErrPolicyRejected matches an *APIError for a deploy refused by the
+	// daemon's deploy_policy.
+	ErrPolicyRejected = errors.New("rejected by deploy policy")
+
+	// ErrNotFound matches an *APIError for a 404 response.
+	ErrNotFound = errors.New("not found")
+
+	// ErrLocked matches an *APIError for a deploy refused because deploys
+	// are locked (see Client.Lock).
+	ErrLocked = errors.New("deploys locked")
+
+	// ErrTooSoon matches an *APIError for a deploy refused by the daemon's
+	// deploy rate limits; DeployResult.RetryAfterMs says when to retry.
+	ErrTooSoon = errors.New("deploy too soon")
+
+	// ErrPendingApproval matches an *APIError for a deploy the daemon holds
+	// until someone approves it (agent_deploy_approval); DeployResult.Pending
+	// is the pending deploy.
+	ErrPendingApproval = errors.New("deploy waiting for approval")
+
+	// ErrReadOnly matches an *APIError for a request refused because the
+	// daemon API is read-only (see Client.ReadOnly).
+	ErrReadOnly = errors.New("the daemon API is read-only")
+)
+
+// APIError is returned when the daemon answers but reports a failure.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("slot-machine: HTTP %d", e.StatusCode)
+	}
+	return "slot-machine: " + e.Message
+}
+
+// Is lets errors.Is match the sentinel errors above.
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrHealthCheckFailed:
+		return e.Message == ErrHealthCheckFailed.Error()
+	case ErrDeployInProgress:
+		return e.StatusCode == http.StatusConflict
+	case ErrPolicyRejected:
+		return e.StatusCode == http.StatusForbidden && e.Message != ErrReadOnly.Error()
+	case ErrReadOnly:
+		return e.StatusCode == http.StatusForbidden && e.Message == ErrReadOnly.Error()
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrLocked:
+		return e.StatusCode == http.StatusLocked
+	case ErrTooSoon:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrPendingApproval:
+		return e.StatusCode == http.StatusAccepted
+	}
+	return false
+}
+
+// ---------------------------------------------------------------------------
+// Deploy API
+// ---------------------------------------------------------------------------
+
+// DeployOption tweaks a single deploy.
+type DeployOption func(*deployRequest)
+
+type deployRequest struct {
+	Commit      string `json:"commit,omitempty"`
+	Ref         string `json:"ref,omitempty"`
+	Fetch       bool   `json:"fetch,omitempty"`
+	ForceSetup  bool   `json:"force_setup,omitempty"`
+	Force       bool   `json:"force,omitempty"`
+	ArtifactURL string `json:"artifact_url,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	AdminToken  string `json:"admin_token,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Message     string `json:"message,omitempty"`
+
+	// Set by ReleaseEnv and ReleaseConfig, which make it a POST /releases.
+	Env    json.RawMessage `json:"env,omitempty"`
+	Config json.RawMessage `json:"config,omitempty"`
+
+	progress func(Progress)
+}
+
+// ForceSetup runs the setup command even if setup_cache_keys say the
+// dependencies haven't changed.
+func ForceSetup() DeployOption {
+	return func(r *deployRequest) { r.ForceSetup = true }
+}
+
+// Force discards uncommitted changes in the staging worktree instead of
+// stashing them and applying them again after the deploy.
+func Force() DeployOption {
+	return func(r *deployRequest) { r.Force = true }
+}
+
+// Override deploys a commit that isn't on one of deploy_policy's
+// allowed_refs. token must be the daemon's SLOT_MACHINE_ADMIN_TOKEN.
+func Override(token string) DeployOption {
+	return func(r *deployRequest) { r.AdminToken = token }
+}
+
+// Source says who asked for the deploy, "agent", "human", or "webhook", for
+// the daemon's deploy_rate_limits. Without it the deploy counts as a
+// human's.
+func Source(source string) DeployOption {
+	return func(r *deployRequest) { r.Source = source }
+}
+
+// DeployMessage attaches a note to the deploy, e.g. "hotfix for checkout
+// bug", kept in the journal and shown in the status of the release.
+func DeployMessage(message string) DeployOption {
+	return func(r *deployRequest) { r.Message = message }
+}
+
+// ReleaseEnv deploys a release whose slots run with env set on top of
+// env_file, instead of the live release's. nil clears the live release's
+// env.
+func ReleaseEnv(env map[string]string) DeployOption {
+	return func(r *deployRequest) {
+		if env == nil {
+			env = map[string]string{}
+		}
+		r.Env, _ = json.Marshal(env)
+	}
+}
+
+// ReleaseConfig deploys a release whose slots are set up and started with
+// config, a JSON object of the config keys a release may set (such as
+// start_command or health_timeout_ms), instead of the live release's. nil
+// clears the live release's config.
+func ReleaseConfig(config json.RawMessage) DeployOption {
+	return func(r *deployRequest) {
+		if config == nil {
+			config = json.RawMessage("{}")
+		}
+		r.Config = config
+	}
+}
+
+// Fetch has the daemon fetch its remote before it resolves what to deploy,
+// so it can deploy commits its repo hasn't seen yet.
+func Fetch() DeployOption {
+	return func(r *deployRequest) { r.Fetch = true }
+}
+
+// OnProgress has the daemon stream the deploy's steps, calling fn with each
+// one as it happens. fn runs on the calling goroutine, before the deploy
+// call returns.
+func OnProgress(fn func(Progress)) DeployOption {
+	return func(r *deployRequest) { r.progress = fn }
+}
+
+// Deploy deploys commit and blocks until the daemon reports the outcome. A
+// failed deploy returns the result alongside an *APIError. With
+// ReleaseEnv or ReleaseConfig, "" means the live commit.
+func (c *Client) Deploy(ctx context.Context, commit string, opts ...DeployOption) (*DeployResult, error) {
+	req := deployRequest{Commit: commit}
+	for _, opt := range opts {
+		opt(&req)
+	}
+	return c.postDeploy(ctx, req)
+}
+
+// DeployRef deploys the commit ref points at in the daemon's repo, e.g.
+// "origin/main" or a tag. With Fetch, the remote is fetched first, and ""
+// means the upstream branch.
+func (c *Client) DeployRef(ctx context.Context, ref string, opts ...DeployOption) (*DeployResult, error) {
+	req := deployRequest{Ref: ref}
+	for _, opt := range opts {
+		opt(&req)
+	}
+	return c.postDeploy(ctx, req)
+}
+
+// DeployArtifact uploads a release tarball (optionally gzipped) and deploys
+// it without git on the server. If sha256 is non-empty the daemon refuses a
+// tarball with a different digest. The deployed commit is "sha256:<hex>".
+func (c *Client) DeployArtifact(ctx context.Context, r io.Reader, sha256 string, opts ...DeployOption) (*DeployResult, error) {
+	var req deployRequest
+	for _, opt := range opts {
+		opt(&req)
+	}
+	q := url.Values{}
+	if req.ForceSetup {
+		q.Set("force_setup", "true")
+	}
+	if req.Force {
+		q.Set("force", "true")
+	}
+	path := "/deploy"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		err := func() error {
+			for name, value := range map[string]string{"sha256": sha256, "admin_token": req.AdminToken, "source": req.Source, "message": req.Message} {
+				if value == "" {
+					continue
+				}
+				if err := mw.WriteField(name, value); err != nil {
+					return err
+				}
+			}
+			part, err := mw.CreateFormFile("artifact", "artifact.tar.gz")
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(part, r); err != nil {
+				return err
+			}
+			return mw.Close()
+		}()
+		pw.CloseWithError(err)
+	}()
+
+	hreq, err := c.newRequest(ctx, c.host, "POST", path, pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", mw.FormDataContentType())
+	return c.sendDeploy(ctx, hreq, req.progress)
+}
+
+// DeployArtifactURL has the daemon download a release tarball from url and
+// deploy it. sha256 is required.
+func (c *Client) DeployArtifactURL(ctx context.Context, url, sha256 string, opts ...DeployOption) (*DeployResult, error) {
+	req := deployRequest{ArtifactURL: url, SHA256: sha256}
+	for _, opt := range opts {
+		opt(&req)
+	}
+	return c.postDeploy(ctx, req)
+}
+
+// progressContentType is the streamed /deploy response, one JSON object
+// per line.
+const progressContentType = "application/x-ndjson"
+
+// postDeploy sends req as the JSON body of POST /deploy, or of POST
+// /releases if it sets a release's env or config.
+func (c *Client) postDeploy(ctx context.Context, req deployRequest) (*DeployResult, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	path := "/deploy"
+	if req.Env != nil || req.Config != nil {
+		path = "/releases"
+	}
+	hreq, err := c.newRequest(ctx, c.host, "POST", path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return c.sendDeploy(ctx, hreq, req.progress)
+}
+
+// sendDeploy performs a /deploy request. With progress set it asks for the
+// streamed response and passes each step to progress; a daemon that
+// answers with plain JSON (an older one, or an early error) still works.
+func (c *Client) sendDeploy(ctx context.Context, req *http.Request, progress func(Progress)) (*DeployResult, error) {
+	if progress == nil {
+		return deployResult(c.send(ctx, req))
+	}
+	req.Header.Set("Accept", progressContentType)
+	resp, err := c.roundTrip(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), progressContentType) {
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnreachable, err)
+		}
+		return deployResult(resp.StatusCode, data, nil)
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64<<10), 8<<20)
+	for sc.Scan() {
+		var line struct {
+			Progress *Progress       `json:"progress"`
+			Result   json.RawMessage `json:"result"`
+			Code     int             `json:"code"`
+		}
+		if json.Unmarshal(sc.Bytes(), &line) != nil {
+			continue
+		}
+		if line.Progress != nil {
+			progress(*line.Progress)
+		} else if line.Result != nil {
+			return deployResult(line.Code, line.Result, nil)
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, fmt.Errorf("%w: deploy stream ended without a result", ErrUnreachable)
+}
+
+// deployResult decodes a /deploy answer.
+func deployResult(code int, data []byte, err error) (*DeployResult, error) {
+	if err != nil {
+		return nil, err
+	}
+	var res DeployResult
+	if json.Unmarshal(data, &res) != nil {
+		return nil, newAPIError(code, data)
+	}
+	if !res.Success {
+		return &res, &APIError{StatusCode: code, Message: res.Error}
+	}
+	return &res, nil
+}
+
+// Rollback swaps the previous slot back in. A failed rollback returns the
+// result alongside an *APIError.
+func (c *Client) Rollback(ctx context.Context) (*RollbackResult, error) {
+	return c.RollbackTo(ctx, "")
+}
+
+// RollbackOption tunes RollbackTo.
+type RollbackOption func(*rollbackRequest)
+
+type rollbackRequest struct {
+	Commit string `json:"commit,omitempty"`
+	Force  bool   `json:"force,omitempty"`
+}
+
+// ForceRollback rolls back even to a slot whose files drifted from its
+// commit, which drift_check.block_rollback otherwise refuses with a 409.
+func ForceRollback() RollbackOption {
+	return func(r *rollbackRequest) { r.Force = true }
+}
+
+// RollbackTo rolls back to a specific retained release, named by commit
+// prefix or slot name; "" means the previous slot. A release that isn't
+// retained returns an error matching ErrNotFound.
+func (c *Client) RollbackTo(ctx context.Context, commit string, opts ...RollbackOption) (*RollbackResult, error) {
+	req := rollbackRequest{Commit: commit}
+	for _, opt := range opts {
+		opt(&req)
+	}
+	var body any
+	if req != (rollbackRequest{}) {
+		body = req
+	}
+	code, data, err := c.do(ctx, c.host, "POST", "/rollback", body)
+	if err != nil {
+		return nil, err
+	}
+	var res RollbackResult
+	if json.Unmarshal(data, &res) != nil {
+		return nil, newAPIError(code, data)
+	}
+	if !res.Success {
+		return &res, &APIError{StatusCode: code, Message: res.Error}
+	}
+	return &res, nil
+}
+
+// Restart boots a fresh process of the live release and switches traffic
+// to it once it's healthy, then drains the old one. A failed restart leaves
+// the old process live and returns the result alongside an *APIError.
+func (c *Client) Restart(ctx context.Context) (*RestartResult, error) {
+	code, data, err := c.do(ctx, c.host, "POST", "/restart", nil)
+	if err != nil {
+		return nil, err
+	}
+	var res RestartResult
+	if json.Unmarshal(data, &res) != nil {
+		return nil, newAPIError(code, data)
+	}
+	if !res.Success {
+		return &res, &APIError{StatusCode: code, Message: res.Error}
+	}
+	return &res, nil
+}
+
+// Promote makes a standby daemon the primary: it starts the release it
+// keeps warm and makes it live once it's healthy. Promoting a daemon that
+// isn't a standby returns an *APIError with status 400; a failed promotion
+// returns the result alongside an *APIError, and the daemon stays a
+// standby.
+func (c *Client) Promote(ctx context.Context) (*RollbackResult, error) {
+	code, data, err := c.do(ctx, c.host, "POST", "/peer/promote", nil)
+	if err != nil {
+		return nil, err
+	}
+	var res RollbackResult
+	if json.Unmarshal(data, &res) != nil {
+		return nil, newAPIError(code, data)
+	}
+	if !res.Success {
+		return &res, &APIError{StatusCode: code, Message: res.Error}
+	}
+	return &res, nil
+}
+
+// PendingDeploys lists the agent's deploys waiting for approval.
+func (c *Client) PendingDeploys(ctx context.Context) ([]PendingDeploy, error) {
+	var list []PendingDeploy
+	if err := c.call(ctx, c.host, "GET", "/deploys/pending", nil, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// ApproveDeploy runs the pending deploy id and returns its result, like
+// Deploy. It needs the daemon's admin token, given with WithToken. A deploy
+// approved or rejected already returns ErrNotFound.
+func (c *Client) ApproveDeploy(ctx context.Context, id string, opts ...DeployOption) (*DeployResult, error) {
+	var req deployRequest
+	for _, opt := range opts {
+		opt(&req)
+	}
+	hreq, err := c.newRequest(ctx, c.host, "POST", "/deploys/pending/"+url.PathEscape(id)+"/approve", nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.sendDeploy(ctx, hreq, req.progress)
+}
+
+// RejectDeploy drops the pending deploy id. Like ApproveDeploy, it needs
+// the admin token.
+func (c *Client) RejectDeploy(ctx context.Context, id string) error {
+	return c.call(ctx, c.host, "POST", "/deploys/pending/"+url.PathEscape(id)+"/reject", nil, nil)
+}
+
+// MirrorOptions tune StartMirror.
+type MirrorOptions struct {
+	Percent    int  // of live requests to copy (default 10)
+	AllMethods bool // also copy POST, PUT, DELETE...; the candidate shares the app's data
+}
+
+// StartMirror boots commit as a candidate and has the daemon copy a sample
+// of live requests to it, comparing status codes (see Status.Mirror). It
+// replaces any candidate already running.
+func (c *Client) StartMirror(ctx context.Context, commit string, opts MirrorOptions) (*MirrorResult, error) {
+	body := map[string]any{"commit": commit, "percent": opts.Percent, "all_methods": opts.AllMethods}
+	code, data, err := c.do(ctx, c.host, "POST", "/mirror", body)
+	if err != nil {
+		return nil, err
+	}
+	var res MirrorResult
+	if json.Unmarshal(data, &res) != nil {
+		return nil, newAPIError(code, data)
+	}
+	if !res.Success {
+		return &res, &APIError{StatusCode: code, Message: res.Error}
+	}
+	return &res, nil
+}
+
+// StopMirror stops mirroring and the candidate.
+func (c *Client) StopMirror(ctx context.Context) error {
+	return c.call(ctx, c.host, "DELETE", "/mirror", nil, nil)
+}
+
+// Lock refuses deploys until Unlock, e.g. during an incident. Rollbacks are
+// still allowed. Locking again replaces the reason.
+func (c *Client) Lock(ctx context.Context, reason string) (*Lock, error) {
+	var l Lock
+	if err := c.call(ctx, c.host, "POST", "/lock", map[string]string{"reason": reason}, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// Unlock lifts a Lock. Unlocking when unlocked is not an error.
+func (c *Client) Unlock(ctx context.Context) error {
+	return c.call(ctx, c.host, "DELETE", "/lock", nil, nil)
+}
+
+// ReadOnly makes the daemon API read-only until ReadWrite or the daemon
+// restarts: everything but GETs is refused with ErrReadOnly.
+func (c *Client) ReadOnly(ctx context.Context) error {
+	return c.call(ctx, c.host, "POST", "/read-only", nil, nil)
+}
+
+// ReadWrite ends read-only mode. adminToken must be the daemon's
+// SLOT_MACHINE_ADMIN_TOKEN if it has one.
+func (c *Client) ReadWrite(ctx context.Context, adminToken string) error {
+	return c.call(ctx, c.host, "DELETE", "/read-only", map[string]string{"admin_token": adminToken}, nil)
+}
+
+// StartPreview boots ref as a preview served on <name>.<preview_domain>,
+// replacing a running preview of the same branch. ttl 0 means the daemon's
+// preview_ttl_ms.
+func (c *Client) StartPreview(ctx context.Context, ref string, ttl time.Duration) (*Preview, error) {
+	body := map[string]any{"ref": ref, "ttl_ms": ttl.Milliseconds()}
+	var p Preview
+	if err := c.call(ctx, c.host, "POST", "/previews", body, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Previews lists the running previews.
+func (c *Client) Previews(ctx context.Context) ([]Preview, error) {
+	var list []Preview
+	if err := c.call(ctx, c.host, "GET", "/previews", nil, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// StopPreview stops a preview and deletes its checkout. An unknown name
+// returns an error matching ErrNotFound.
+func (c *Client) StopPreview(ctx context.Context, name string) error {
+	return c.call(ctx, c.host, "DELETE", "/previews/"+url.PathEscape(name), nil, nil)
+}
+
+// Slot returns a slot by name, or "live" or "prev", with the environment it
+// was started with. An unknown slot returns an error matching ErrNotFound.
+func (c *Client) Slot(ctx context.Context, name string) (*Slot, error) {
+	var s Slot
+	if err := c.call(ctx, c.host, "GET", "/slots/"+url.PathEscape(name), nil, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SlotManifest returns the signed manifest of a slot's files. A slot
+// without one, or an unknown slot, returns an error matching ErrNotFound.
+func (c *Client) SlotManifest(ctx context.Context, name string) (*SlotManifest, error) {
+	var m SlotManifest
+	if err := c.call(ctx, c.host, "GET", "/slots/"+url.PathEscape(name)+"/manifest", nil, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// VerifySlot has the daemon hash a slot's files again and compare them
+// with its manifest. Files that changed are no error: check OK.
+func (c *Client) VerifySlot(ctx context.Context, name string) (*ManifestCheck, error) {
+	var mc ManifestCheck
+	if err := c.call(ctx, c.host, "GET", "/slots/"+url.PathEscape(name)+"/verify", nil, &mc); err != nil {
+		return nil, err
+	}
+	return &mc, nil
+}
+
+// Status returns the daemon's current slots.
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	var st Status
+	if err := c.call(ctx, c.host, "GET", "/status", nil, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Version returns the running daemon's build. Daemons that predate GET
+// /version answer with a 404 *APIError.
+func (c *Client) Version(ctx context.Context) (*Version, error) {
+	var v Version
+	if err := c.call(ctx, c.host, "GET", "/version", nil, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Healthz returns the live slot's health as last observed by the daemon.
+// An unhealthy or missing slot is reported in Status, not as an error.
+func (c *Client) Healthz(ctx context.Context) (*Health, error) {
+	code, data, err := c.do(ctx, c.host, "GET", "/healthz", nil)
+	if err != nil {
+		return nil, err
+	}
+	var h Health
+	if json.Unmarshal(data, &h) != nil || h.Status == "" {
+		return nil, newAPIError(code, data)
+	}
+	return &h, nil
+}
+
+// Livez checks that the daemon itself isn't wedged. Failing checks are
+// reported in the Probe, not as an error.
+func (c *Client) Livez(ctx context.Context) (*Probe, error) {
+	return c.probe(ctx, "/livez")
+}
+
+// Readyz checks that the daemon can serve and deploy: its proxies, data
+// dir, git, and the live slot. Failing checks are reported in the Probe,
+// not as an error.
+func (c *Client) Readyz(ctx context.Context) (*Probe, error) {
+	return c.probe(ctx, "/readyz")
+}
+
+func (c *Client) probe(ctx context.Context, path string) (*Probe, error) {
+	code, data, err := c.do(ctx, c.host, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	var p Probe
+	if json.Unmarshal(data, &p) != nil || p.Status == "" {
+		return nil, newAPIError(code, data)
+	}
+	return &p, nil
+}
+
+// History returns up to limit recent journal entries, oldest first. A limit
+// of zero uses the daemon default.
+func (c *Client) History(ctx context.Context, limit int) ([]HistoryEntry, error) {
+	path := "/history"
+	if limit > 0 {
+		path += fmt.Sprintf("?limit=%d", limit)
+	}
+	var entries []HistoryEntry
+	if err := c.call(ctx, c.host, "GET", path, nil, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Logs returns the last lines of a slot's output. slot is "live" or "prev";
+// lines of zero uses the daemon default.
+func (c *Client) Logs(ctx context.Context, slot string, lines int) (*Logs, error) {
+	q := url.Values{}
+	if slot != "" {
+		q.Set("slot", slot)
+	}
+	if lines > 0 {
+		q.Set("lines", fmt.Sprint(lines))
+	}
+	path := "/logs"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	var l Logs
+	if err := c.call(ctx, c.host, "GET", path, nil, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// MergedLogs returns the last lines of the merged log stream: slot output
+// tagged with the slot's name, the daemon's output, and the agent's stderr.
+// source is "all" (or empty), "slot", "daemon", or "agent".
+func (c *Client) MergedLogs(ctx context.Context, source string, lines int) (*Logs, error) {
+	if source == "" {
+		source = "all"
+	}
+	q := url.Values{"source": {source}}
+	if lines > 0 {
+		q.Set("lines", fmt.Sprint(lines))
+	}
+	var l Logs
+	if err := c.call(ctx, c.host, "GET", "/logs?"+q.Encode(), nil, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// Correlate returns every log line mentioning the request ID id: the
+// proxy's access log line, then slot output, each prefixed with its source.
+func (c *Client) Correlate(ctx context.Context, id string) (*Logs, error) {
+	var l Logs
+	if err := c.call(ctx, c.host, "GET", "/logs?correlate="+url.QueryEscape(id), nil, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// Exec runs command through /bin/sh in a slot's directory, with the
+// environment its process was started with. slot is "live" (or empty),
+// "prev", or a slot name. stdin, if not nil, is copied to the command;
+// its output goes to stdout and stderr as it arrives. Exec returns the
+// command's exit code once it exits, or -1 if it was killed or never ran.
+func (c *Client) Exec(ctx context.Context, slot, command string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	data, err := json.Marshal(map[string]string{"command": command, "slot": slot})
+	if err != nil {
+		return -1, err
+	}
+	var body io.Reader = bytes.NewReader(append(data, '\n'))
+	if stdin != nil {
+		body = io.MultiReader(body, stdin)
+	}
+	req, err := c.newRequest(ctx, c.host, "POST", "/exec", body)
+	if err != nil {
+		return -1, err
+	}
+	resp, err := c.roundTrip(ctx, req)
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		data, _ := io.ReadAll(resp.Body)
+		return -1, newAPIError(resp.StatusCode, data)
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64<<10), 8<<20)
+	for sc.Scan() {
+		var line struct {
+			Stdout   []byte `json:"stdout"` // base64
+			Stderr   []byte `json:"stderr"`
+			ExitCode *int   `json:"exit_code"`
+			Error    string `json:"error"`
+		}
+		if json.Unmarshal(sc.Bytes(), &line) != nil {
+			continue
+		}
+		stdout.Write(line.Stdout)
+		stderr.Write(line.Stderr)
+		if line.ExitCode != nil {
+			if line.Error != "" {
+				return *line.ExitCode, &APIError{StatusCode: resp.StatusCode, Message: line.Error}
+			}
+			return *line.ExitCode, nil
+		}
+	}
+	if ctx.Err() != nil {
+		return -1, ctx.Err()
+	}
+	return -1, fmt.Errorf("%w: exec stream ended without an exit code", ErrUnreachable)
+}
+
+// ---------------------------------------------------------------------------
+// Agent API
+// ---------------------------------------------------------------------------
+
+// ListConversations returns all agent conversations.
+func (c *Client) ListConversations(ctx context.Context) ([]Conversation, error) {
+	var list []Conversation
+	if err := c.call(ctx, c.agentBase(), "GET", "/agent/conversations", nil, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// CreateConversation starts a new conversation. user is only honored when
+// the daemon's agent_auth is not "hmac"; otherwise WithUser decides.
+func (c *Client) CreateConversation(ctx context.Context, user string) (*Conversation, error) {
+	var body any
+	if user != "" {
+		body = map[string]string{"user": user}
+	}
+	var conv Conversation
+	if err := c.call(ctx, c.agentBase(), "POST", "/agent/conversations", body, &conv); err != nil {
+		return nil, err
+	}
+	return &conv, nil
+}
+
+// GetConversation returns a conversation and its full message log.
+func (c *Client) GetConversation(ctx context.Context, id string) (*ConversationDetail, error) {
+	var d ConversationDetail
+	if err := c.call(ctx, c.agentBase(), "GET", "/agent/conversations/"+url.PathEscape(id), nil, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Messages returns a page of a conversation's messages, for reading a long
+// one a piece at a time.
+func (c *Client) Messages(ctx context.Context, id string, q MessageQuery) (*MessagePage, error) {
+	v := url.Values{}
+	if q.After > 0 {
+		v.Set("after", strconv.FormatInt(q.After, 10))
+	}
+	if q.Before > 0 {
+		v.Set("before", strconv.FormatInt(q.Before, 10))
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	path := "/agent/conversations/" + url.PathEscape(id) + "/messages"
+	if len(v) > 0 {
+		path += "?" + v.Encode()
+	}
+	var p MessagePage
+	if err := c.call(ctx, c.agentBase(), "GET", path, nil, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// SendMessage queues a user message and starts the agent on it.
+func (c *Client) SendMessage(ctx context.Context, id, content string) error {
+	path := "/agent/conversations/" + url.PathEscape(id) + "/messages"
+	return c.call(ctx, c.agentBase(), "POST", path, map[string]string{"content": content}, nil)
+}
+
+// Cancel stops the agent running on a conversation.
+func (c *Client) Cancel(ctx context.Context, id string) error {
+	path := "/agent/conversations/" + url.PathEscape(id) + "/cancel"
+	return c.call(ctx, c.agentBase(), "POST", path, nil, nil)
+}
+
+// Usage returns the agent's token use since since: a duration back from now
+// ("24h", "7d"), a date, an RFC 3339 time, or "" for all time. The daemon
+// also serves it on the API port, so it works without WithAppURL.
+func (c *Client) Usage(ctx context.Context, since string) (*Usage, error) {
+	path := "/agent/usage"
+	if since != "" {
+		path += "?since=" + url.QueryEscape(since)
+	}
+	var u Usage
+	if err := c.call(ctx, c.agentBase(), "GET", path, nil, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// AgentStore returns the agent database's size and retention state. Like
+// Usage, it is also served on the API port.
+func (c *Client) AgentStore(ctx context.Context) (*AgentStore, error) {
+	var s AgentStore
+	if err := c.call(ctx, c.agentBase(), "GET", "/agent/store", nil, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Stream replays a conversation's events after afterID and then follows the
+// live run, calling fn for each event. It returns when the stream ends, ctx
+// is done, or fn returns an error.
+func (c *Client) Stream(ctx context.Context, id string, afterID int64, fn func(Event) error) error {
+	path := fmt.Sprintf("/agent/conversations/%s/stream?after=%d", url.PathEscape(id), afterID)
+	req, err := c.newRequest(ctx, c.agentBase(), "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnreachable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return newAPIError(resp.StatusCode, data)
+	}
+	return readEvents(resp.Body, fn)
+}
+
+// Events follows the daemon's event stream, calling fn for each event:
+// first those it kept after afterID (0 for all of them), then new ones as
+// they happen. types, if given, limits it to those event types. It returns
+// when the stream ends, ctx is done, or fn returns an error.
+func (c *Client) Events(ctx context.Context, afterID int64, fn func(DaemonEvent) error, types ...string) error {
+	path := fmt.Sprintf("/events?after=%d", afterID)
+	if len(types) > 0 {
+		path += "&types=" + url.QueryEscape(strings.Join(types, ","))
+	}
+	req, err := c.newRequest(ctx, c.host, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnreachable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return newAPIError(resp.StatusCode, data)
+	}
+	return readEvents(resp.Body, func(ev Event) error {
+		var de DaemonEvent
+		if err := json.Unmarshal([]byte(ev.Data), &de); err != nil {
+			return fmt.Errorf("event %d: %w", ev.ID, err)
+		}
+		return fn(de)
+	})
+}
+
+func (c *Client) agentBase() string {
+	if c.appURL != "" {
+		return c.appURL
+	}
+	return c.host
+}
+
+// ---------------------------------------------------------------------------
+// Transport
+// ---------------------------------------------------------------------------
+
+// call performs a request, treats any non-2xx answer as an *APIError, and
+// decodes a successful JSON body into out.
+func (c *Client) call(ctx context.Context, base, method, path string, in, out any) error {
+	code, data, err := c.do(ctx, base, method, path, in)
+	if err != nil {
+		return err
+	}
+	if code >= 300 {
+		return newAPIError(code, data)
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("decode %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// do performs a request and returns the status code and raw body.
+func (c *Client) do(ctx context.Context, base, method, path string, in any) (int, []byte, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := c.newRequest(ctx, base, method, path, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return c.send(ctx, req)
+}
+
+// send performs a prepared request and returns the status code and raw body.
+func (c *Client) send(ctx context.Context, req *http.Request) (int, []byte, error) {
+	resp, err := c.roundTrip(ctx, req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", ErrUnreachable, err)
+	}
+	return resp.StatusCode, data, nil
+}
+
+// roundTrip performs a prepared request, wrapping transport failures in
+// ErrUnreachable. The caller closes the body.
+func (c *Client) roundTrip(ctx context.Context, req *http.Request) (*http.Response, error) {
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w: %v", ErrUnreachable, err)
+	}
+	return resp, nil
+}
+
+func (c *Client) newRequest(ctx context.Context, base, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	switch {
+	case c.userSecret != "":
+		req.Header.Set("X-SlotMachine-User", SignUser(c.userSecret, c.user, time.Now()))
+	case c.user != "":
+		req.Header.Set("X-SlotMachine-User", c.user)
+	}
+	return req, nil
+}
+
+// newAPIError builds an *APIError from a failed response body, which is
+// either JSON with an "error" field or plain text from http.Error.
+func newAPIError(code int, data []byte) error {
+	var e struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(data, &e) == nil && e.Error != "" {
+		return &APIError{StatusCode: code, Message: e.Error}
+	}
+	return &APIError{StatusCode: code, Message: strings.TrimSpace(string(data))}
+}
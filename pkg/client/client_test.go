@@ -0,0 +1,323 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestDeploy(t *testing.T) {
+	t.Parallel()
+	var gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		var req struct {
+			Commit string `json:"commit"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.Commit {
+		case "good":
+			writeJSON(w, 200, DeployResult{Success: true, Slot: "slot-good", Commit: "good"})
+		case "sick":
+			writeJSON(w, 200, DeployResult{Error: "health check failed"})
+		case "frozen":
+			writeJSON(w, 423, DeployResult{Error: "deploys are locked since 2026-01-31T10:00:00Z"})
+		case "monitoring":
+			writeJSON(w, 403, map[string]string{"error": "the daemon API is read-only"})
+		default:
+			writeJSON(w, 409, DeployResult{Error: "deploy in progress"})
+		}
+	}))
+	defer srv.Close()
+
+	c := New(WithHost(srv.URL+"/"), WithToken("s3cret"))
+	ctx := context.Background()
+
+	res, err := c.Deploy(ctx, "good")
+	if err != nil {
+		t.Fatalf("deploy: %v", err)
+	}
+	if res.Slot != "slot-good" {
+		t.Errorf("slot = %q", res.Slot)
+	}
+	if gotAuth != "Bearer s3cret" {
+		t.Errorf("Authorization = %q", gotAuth)
+	}
+
+	res, err = c.Deploy(ctx, "sick")
+	if !errors.Is(err, ErrHealthCheckFailed) {
+		t.Errorf("expected ErrHealthCheckFailed, got %v", err)
+	}
+	if res == nil || res.Success {
+		t.Errorf("expected failed result alongside error, got %+v", res)
+	}
+
+	if _, err = c.Deploy(ctx, "frozen"); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+	if _, err = c.Deploy(ctx, "monitoring"); !errors.Is(err, ErrReadOnly) || errors.Is(err, ErrPolicyRejected) {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+
+	_, err = c.Deploy(ctx, "busy")
+	if !errors.Is(err, ErrDeployInProgress) {
+		t.Errorf("expected ErrDeployInProgress, got %v", err)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 409 {
+		t.Errorf("expected *APIError with 409, got %v", err)
+	}
+}
+
+func TestDeployProgress(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "application/x-ndjson" {
+			writeJSON(w, 200, DeployResult{Success: true, Commit: "plain"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		fmt.Fprintln(w, `{"progress":{"phase":"checkout","message":"checking out abc","elapsed_ms":1}}`)
+		fmt.Fprintln(w, `{"progress":{"phase":"setup","line":"npm ci","elapsed_ms":5}}`)
+		fmt.Fprintln(w, `{"result":{"success":false,"error":"health check failed"},"code":200}`)
+	}))
+	defer srv.Close()
+	c := New(WithHost(srv.URL))
+
+	var got []Progress
+	res, err := c.Deploy(context.Background(), "abc", OnProgress(func(p Progress) { got = append(got, p) }))
+	if !errors.Is(err, ErrHealthCheckFailed) || res == nil || res.Success {
+		t.Fatalf("deploy = %+v, %v", res, err)
+	}
+	if len(got) != 2 || got[0].Phase != "checkout" || got[1].Line != "npm ci" {
+		t.Errorf("progress = %+v", got)
+	}
+
+	if res, err := c.Deploy(context.Background(), "abc"); err != nil || res.Commit != "plain" {
+		t.Errorf("without progress: %+v, %v", res, err)
+	}
+}
+
+func TestExec(t *testing.T) {
+	t.Parallel()
+	// Echoes stdin back a line at a time, so output has to arrive while
+	// stdin is still open.
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NewResponseController(w).EnableFullDuplex()
+		br := bufio.NewReader(r.Body)
+		var req struct{ Command, Slot string }
+		head, _ := br.ReadBytes('\n')
+		if json.Unmarshal(head, &req) != nil || req.Command != "cat" || req.Slot != "prev" {
+			writeJSON(w, 400, map[string]string{"error": "bad request " + string(head)})
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		enc := json.NewEncoder(w)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				break
+			}
+			enc.Encode(map[string][]byte{"stdout": []byte(line)})
+			w.(http.Flusher).Flush()
+		}
+		enc.Encode(map[string]any{"stderr": []byte("bye\n"), "exit_code": 7})
+	}))
+	srv.EnableHTTP2 = false
+	srv.Start()
+	defer srv.Close()
+
+	stdinR, stdinW := io.Pipe()
+	echoed := make(chan string, 1)
+	var stderr strings.Builder
+	go func() {
+		io.WriteString(stdinW, "ping\n")
+		<-echoed
+		stdinW.Close()
+	}()
+	code, err := New(WithHost(srv.URL)).Exec(context.Background(), "prev", "cat", stdinR,
+		writerFunc(func(p []byte) { echoed <- string(p) }), &stderr)
+	if err != nil || code != 7 || stderr.String() != "bye\n" {
+		t.Fatalf("exec = %d, %v, stderr %q", code, err, stderr.String())
+	}
+}
+
+// writerFunc is an io.Writer that calls itself with each write.
+type writerFunc func([]byte)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	f(p)
+	return len(p), nil
+}
+
+func TestUnreachable(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	_, err := New(WithHost(url)).Status(context.Background())
+	if !errors.Is(err, ErrUnreachable) {
+		t.Fatalf("expected ErrUnreachable, got %v", err)
+	}
+}
+
+func TestStatusHistoryLogs(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/status":
+			writeJSON(w, 200, Status{LiveSlot: "slot-abc", Healthy: true})
+		case "/history":
+			writeJSON(w, 200, []HistoryEntry{{Action: "deploy", Commit: r.URL.Query().Get("limit")}})
+		case "/logs":
+			if r.URL.Query().Get("slot") == "prev" {
+				writeJSON(w, 404, Logs{Error: "no log for slot"})
+				return
+			}
+			writeJSON(w, 200, Logs{Slot: "slot-abc", Lines: []string{r.URL.Query().Get("lines")}})
+		}
+	}))
+	defer srv.Close()
+
+	c := New(WithHost(srv.URL))
+	ctx := context.Background()
+
+	st, err := c.Status(ctx)
+	if err != nil || st.LiveSlot != "slot-abc" || !st.Healthy {
+		t.Errorf("status = %+v, %v", st, err)
+	}
+
+	entries, err := c.History(ctx, 5)
+	if err != nil || len(entries) != 1 || entries[0].Commit != "5" {
+		t.Errorf("history = %+v, %v", entries, err)
+	}
+
+	l, err := c.Logs(ctx, "live", 7)
+	if err != nil || len(l.Lines) != 1 || l.Lines[0] != "7" {
+		t.Errorf("logs = %+v, %v", l, err)
+	}
+
+	_, err = c.Logs(ctx, "prev", 0)
+	if !errors.Is(err, ErrNotFound) || !strings.Contains(err.Error(), "no log for slot") {
+		t.Errorf("expected not-found error with message, got %v", err)
+	}
+}
+
+func TestAgentAPI(t *testing.T) {
+	t.Parallel()
+	var gotUser, gotQuery string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser = r.Header.Get("X-SlotMachine-User")
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/agent/conversations":
+			writeJSON(w, 200, Conversation{ID: "conv-1", Status: "idle"})
+		case r.URL.Path == "/agent/conversations/conv-1":
+			writeJSON(w, 200, ConversationDetail{
+				Conversation: Conversation{ID: "conv-1"},
+				Messages:     []Message{{ID: 1, Type: "user", Content: "hi"}},
+			})
+		case r.Method == "GET" && r.URL.Path == "/agent/conversations/conv-1/messages":
+			gotQuery = r.URL.RawQuery
+			writeJSON(w, 200, MessagePage{Messages: []Message{{ID: 5, Type: "user", Content: "older"}}, HasMore: true})
+		case r.URL.Path == "/agent/conversations/conv-1/messages":
+			w.WriteHeader(200)
+		case r.URL.Path == "/agent/conversations/conv-1/cancel":
+			http.Error(w, "no running agent", 404)
+		case r.URL.Path == "/agent/conversations/conv-1/stream":
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintf(w, "id: 2\nevent: assistant\ndata: {\"text\":\"hello\"}\n\n")
+			fmt.Fprintf(w, "event: status\ndata: {\"status\":\"idle\"}\n\n")
+		}
+	}))
+	defer srv.Close()
+
+	c := New(WithHost("http://127.0.0.1:1"), WithAppURL(srv.URL), WithUser("alice:sig"))
+	ctx := context.Background()
+
+	conv, err := c.CreateConversation(ctx, "")
+	if err != nil || conv.ID != "conv-1" {
+		t.Fatalf("create = %+v, %v", conv, err)
+	}
+	if gotUser != "alice:sig" {
+		t.Errorf("X-SlotMachine-User = %q", gotUser)
+	}
+
+	d, err := c.GetConversation(ctx, "conv-1")
+	if err != nil || len(d.Messages) != 1 {
+		t.Errorf("get = %+v, %v", d, err)
+	}
+
+	page, err := c.Messages(ctx, "conv-1", MessageQuery{Before: 6, Limit: 1})
+	if err != nil || len(page.Messages) != 1 || !page.HasMore || gotQuery != "before=6&limit=1" {
+		t.Errorf("messages = %+v, %v (query %q)", page, err, gotQuery)
+	}
+
+	if err := c.SendMessage(ctx, "conv-1", "hello"); err != nil {
+		t.Errorf("send: %v", err)
+	}
+
+	err = c.Cancel(ctx, "conv-1")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Message != "no running agent" {
+		t.Errorf("expected plain-text APIError, got %v", err)
+	}
+
+	var events []Event
+	err = c.Stream(ctx, "conv-1", 0, func(ev Event) error {
+		events = append(events, ev)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %+v", events)
+	}
+	if events[0].ID != 2 || events[0].Type != "assistant" || events[0].Data != `{"text":"hello"}` {
+		t.Errorf("event 0 = %+v", events[0])
+	}
+	if events[1].Type != "status" {
+		t.Errorf("event 1 = %+v", events[1])
+	}
+
+	signed := New(WithHost("http://127.0.0.1:1"), WithAppURL(srv.URL), WithSignedUser("alice", "s3cret"))
+	if _, err := signed.CreateConversation(ctx, ""); err != nil {
+		t.Fatalf("signed create: %v", err)
+	}
+	parts := strings.Split(gotUser, ":")
+	if len(parts) != 4 || parts[0] != "alice" || parts[2] == "" {
+		t.Fatalf("signed X-SlotMachine-User = %q", gotUser)
+	}
+	if ts, _ := strconv.ParseFloat(parts[1], 64); time.Since(time.UnixMilli(int64(ts*1000))) > time.Minute {
+		t.Errorf("signed timestamp %s isn't current", parts[1])
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte("alice:" + parts[1] + ":" + parts[2]))
+	if parts[3] != hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("signature %s doesn't match", parts[3])
+	}
+	if at := time.Now(); SignUser("s3cret", "alice", at) == SignUser("s3cret", "alice", at) {
+		t.Error("two headers signed at the same time are the same")
+	}
+}
@@ -0,0 +1,555 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DeployResult is the daemon's answer to POST /deploy.
+type DeployResult struct {
+	Success        bool   `json:"success"`
+	Slot           string `json:"slot"`
+	Commit         string `json:"commit"`
+	PreviousCommit string `json:"previous_commit"`
+	SetupSkipped   bool   `json:"setup_skipped,omitempty"`
+	SmokeOutput    string `json:"smoke_output,omitempty"` // tail of a failed smoke_command's output
+	RolledBack     bool   `json:"rolled_back,omitempty"`  // the smoke test failed and the previous slot is live again
+	Error          string `json:"error,omitempty"`
+
+	// Set when the new slot failed its health check.
+	HealthError string `json:"health_error,omitempty"` // why, e.g. the process exited
+	LogTail     string `json:"log_tail,omitempty"`     // last lines of its output
+
+	StagingRestore *StagingRestore `json:"staging_restore,omitempty"`
+
+	// Set when the deploy didn't start: it came too soon (ErrTooSoon), or a
+	// newer one superseded it while it waited to coalesce.
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
+	SupersededBy string `json:"superseded_by,omitempty"`
+
+	// Set when the daemon holds the deploy for approval
+	// (ErrPendingApproval).
+	Pending *PendingDeploy `json:"pending,omitempty"`
+}
+
+// RollbackResult is the daemon's answer to POST /rollback.
+type RollbackResult struct {
+	Success bool   `json:"success"`
+	Slot    string `json:"slot"`
+	Commit  string `json:"commit"`
+	Error   string `json:"error,omitempty"`
+
+	StagingRestore *StagingRestore `json:"staging_restore,omitempty"`
+}
+
+// RestartResult is the daemon's answer to POST /restart.
+type RestartResult struct {
+	Success bool   `json:"success"`
+	Slot    string `json:"slot"`
+	Commit  string `json:"commit"`
+	Error   string `json:"error,omitempty"`
+
+	// Set when the new process failed its health check.
+	HealthError string `json:"health_error,omitempty"`
+	LogTail     string `json:"log_tail,omitempty"`
+}
+
+// Status is the daemon's answer to GET /status.
+type Status struct {
+	LiveSlot       string `json:"live_slot"`
+	LiveCommit     string `json:"live_commit"`
+	PreviousSlot   string `json:"previous_slot"`
+	PreviousCommit string `json:"previous_commit"`
+
+	// The deploy messages of the live and previous releases.
+	LiveMessage     string `json:"live_message,omitempty"`
+	PreviousMessage string `json:"previous_message,omitempty"`
+
+	StagingDir     string `json:"staging_dir"`
+	StagingDirty   bool   `json:"staging_dirty"` // uncommitted changes, stashed across deploys
+	LastDeployTime string `json:"last_deploy_time"`
+	Healthy        bool   `json:"healthy"`
+	State          string `json:"state"` // "live", "recovering", "crash-loop", "standby", or "down"
+	ProxyError     string `json:"proxy_error,omitempty"`
+
+	DeployingSince  string `json:"deploying_since,omitempty"`
+	DeployingCommit string `json:"deploying_commit,omitempty"`
+
+	AppTraffic      Traffic `json:"app_traffic"`
+	InternalTraffic Traffic `json:"internal_traffic"`
+
+	Mirror *Mirror `json:"mirror,omitempty"`
+
+	EnvDiff []EnvChange `json:"env_diff,omitempty"` // live slot's environment against the previous one's
+
+	StagingChanges StagingChanges `json:"staging_changes"`
+
+	Head   string `json:"head,omitempty"` // the repo's HEAD commit
+	Locked *Lock  `json:"locked,omitempty"`
+
+	ReadOnly bool `json:"read_only,omitempty"` // the daemon API refuses changes
+
+	EnvStale bool `json:"env_stale,omitempty"` // env_file changed since the live slot started
+
+	Upstream *Upstream `json:"upstream,omitempty"` // nil if the repo has no upstream branch
+
+	CrashLoop *CrashLoop `json:"crash_loop,omitempty"` // set while State is "crash-loop"
+
+	Drift []SlotDrift `json:"drift,omitempty"` // slots whose files differ from their commits
+
+	Expose *Expose `json:"expose,omitempty"` // nil unless the daemon runs a tunnel
+
+	Standby *Standby `json:"standby,omitempty"` // nil unless the daemon stands by for a primary
+
+	LiveRelease *Release `json:"live_release,omitempty"` // nil unless the live slot's release sets env or config
+
+	PendingDeploys []PendingDeploy `json:"pending_deploys,omitempty"` // the agent's deploys waiting for approval
+}
+
+// Release is the env and config a release sets.
+type Release struct {
+	Env    []string        `json:"env,omitempty"` // names only: the values may be secrets
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// Standby is a daemon following a primary, ready to be promoted.
+type Standby struct {
+	Primary       string `json:"primary"`
+	LastSync      string `json:"last_sync,omitempty"`      // RFC3339
+	Error         string `json:"error,omitempty"`          // why the last sync failed
+	PrimaryCommit string `json:"primary_commit,omitempty"` // live on the primary
+	WarmSlot      string `json:"warm_slot,omitempty"`      // checked out and set up, for Promote
+	WarmCommit    string `json:"warm_commit,omitempty"`
+}
+
+// Expose is the tunnel that makes the app public.
+type Expose struct {
+	Provider string `json:"provider"` // "cloudflared" or "ngrok"
+	URL      string `json:"url,omitempty"`
+	Running  bool   `json:"running"`
+	Restarts int    `json:"restarts"`
+	Error    string `json:"error,omitempty"` // why the tunnel last exited
+}
+
+// CrashLoop is a live slot the daemon stopped restarting because it kept
+// crashing.
+type CrashLoop struct {
+	Slot       string `json:"slot"`
+	Commit     string `json:"commit"`
+	Crashes    int    `json:"crashes"` // within WindowSec
+	WindowSec  int    `json:"window_sec"`
+	Since      string `json:"since"`
+	Rollback   string `json:"rollback,omitempty"` // the commit a rollback would go back to
+	Suggestion string `json:"suggestion"`
+	Log        string `json:"log,omitempty"`
+}
+
+// SlotDrift is a slot whose tracked files differ from its commit, as
+// drift_check last found it.
+type SlotDrift struct {
+	Slot    string         `json:"slot"`
+	Commit  string         `json:"commit"`
+	Role    string         `json:"role"` // "live", "prev", or "retained"
+	Changes StagingChanges `json:"changes"`
+	Since   string         `json:"since"`
+}
+
+// PendingDeploy is a deploy the agent asked for, held until someone
+// approves or rejects it (agent_deploy_approval).
+type PendingDeploy struct {
+	ID          string `json:"id"`
+	Commit      string `json:"commit"`
+	Message     string `json:"message,omitempty"`
+	Source      string `json:"source"`
+	RequestedAt string `json:"requested_at"` // RFC3339
+}
+
+// Upstream is how the live commit compares with the upstream branch, as of
+// the daemon's last fetch.
+type Upstream struct {
+	Ref        string `json:"ref"` // e.g. "origin/main"
+	Commit     string `json:"commit"`
+	Ahead      int    `json:"ahead"`  // live commits that aren't upstream
+	Behind     int    `json:"behind"` // upstream commits that aren't live
+	LatestTag  string `json:"latest_tag,omitempty"`
+	FetchedAt  string `json:"fetched_at,omitempty"`
+	FetchError string `json:"fetch_error,omitempty"`
+}
+
+// Progress is one step of a deploy, passed to the OnProgress callback.
+type Progress struct {
+	Phase     string `json:"phase"` // "checkout", "setup", "start", "health", "promote", "drain", "smoke"
+	Message   string `json:"message,omitempty"`
+	Line      string `json:"line,omitempty"`    // a line of setup output
+	Attempt   int    `json:"attempt,omitempty"` // a failed health check poll
+	ElapsedMs int64  `json:"elapsed_ms"`
+}
+
+// Lock is set in Status while deploys are locked.
+type Lock struct {
+	Reason string `json:"reason,omitempty"`
+	Since  string `json:"since"`
+}
+
+// StagingChanges counts the staging worktree's uncommitted changes. Only
+// modified and deleted files make it dirty.
+type StagingChanges struct {
+	Modified  int `json:"modified"`
+	Deleted   int `json:"deleted"`
+	Untracked int `json:"untracked"`
+}
+
+// StagingRestore is what became of the staging worktree's uncommitted
+// changes, stashed for a deploy or rollback and applied again after it.
+type StagingRestore struct {
+	Stash     string         `json:"stash"` // commit holding the changes
+	Changes   StagingChanges `json:"changes"`
+	Restored  bool           `json:"restored"`
+	Conflicts []string       `json:"conflicts,omitempty"` // files left with conflict markers
+	Error     string         `json:"error,omitempty"`
+}
+
+// Traffic are a proxy's counters since the daemon started.
+type Traffic struct {
+	Requests  uint64 `json:"requests"`
+	Errors    uint64 `json:"errors"`
+	CacheHits uint64 `json:"cache_hits"`
+	Retries   uint64 `json:"retries"`   // resends after the live slot dropped a request
+	Failovers uint64 `json:"failovers"` // requests answered by the previous slot after a switch
+	Timeouts  uint64 `json:"timeouts"`  // 504s: the live slot didn't answer in time
+
+	Circuit         string `json:"circuit,omitempty"` // "closed", "open", or "half-open", with circuit_breaker set
+	CircuitOpens    uint64 `json:"circuit_opens"`
+	CircuitRejected uint64 `json:"circuit_rejected"` // 503s while the circuit was open
+}
+
+// Mirror is the candidate receiving mirrored traffic, in Status.
+type Mirror struct {
+	Commit     string `json:"commit"`
+	Alive      bool   `json:"alive"`
+	Port       int    `json:"port"`
+	Percent    int    `json:"percent"`
+	AllMethods bool   `json:"all_methods"`
+	Mirrored   uint64 `json:"mirrored"`
+	Mismatches uint64 `json:"mismatches"` // status code differed from the live slot's
+	Errors     uint64 `json:"errors"`     // the candidate didn't answer
+	Skipped    uint64 `json:"skipped"`    // sampled but not sent: body too big or too many in flight
+}
+
+// MirrorResult is the daemon's answer to POST /mirror.
+type MirrorResult struct {
+	Success bool   `json:"success"`
+	Slot    string `json:"slot"`
+	Commit  string `json:"commit"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Preview is a branch booted on its own subdomain, from /previews.
+type Preview struct {
+	Name      string `json:"name"`
+	Ref       string `json:"ref"`
+	Commit    string `json:"commit"`
+	Host      string `json:"host"`
+	Alive     bool   `json:"alive"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// Slot is one slot and the environment it was started with, from
+// GET /slots/{name}.
+type Slot struct {
+	Name   string       `json:"name"`
+	Commit string       `json:"commit"`
+	Role   string       `json:"role"` // "live", "prev", "retained", "mirror", or "preview"
+	Alive  bool         `json:"alive"`
+	Env    *EnvSnapshot `json:"env,omitempty"`
+}
+
+// EnvSnapshot is what a slot's process was started with. Variables from
+// env_file and the daemon's environment map to a hash of their value;
+// Injected holds the ones slot-machine sets, in clear except for secrets.
+type EnvSnapshot struct {
+	Commit       string            `json:"commit"`
+	StartedAt    string            `json:"started_at"`
+	StartCommand string            `json:"start_command"`
+	AppPort      int               `json:"app_port"`
+	IntPort      int               `json:"int_port"`
+	EnvFile      string            `json:"env_file,omitempty"`
+	EnvFileHash  string            `json:"env_file_sha256,omitempty"`
+	Injected     map[string]string `json:"injected"`
+	FromEnvFile  map[string]string `json:"env_file_vars"`
+	Inherited    map[string]string `json:"inherited"`
+}
+
+// SlotManifest is what a slot's files were when it was deployed, signed by
+// the daemon, from GET /slots/{name}/manifest.
+type SlotManifest struct {
+	Manifest struct {
+		Slot      string            `json:"slot"`
+		Commit    string            `json:"commit"`
+		Tree      string            `json:"tree,omitempty"` // the commit's git tree
+		CreatedAt string            `json:"created_at"`
+		Lockfiles map[string]string `json:"lockfiles,omitempty"` // path → sha256
+		Files     map[string]string `json:"files"`               // path → sha256, or "symlink:<target>"
+		Digest    string            `json:"digest"`
+	} `json:"manifest"`
+	PublicKey string `json:"public_key"` // base64 ed25519
+	Signature string `json:"signature"`  // base64 ed25519, of the manifest's JSON
+}
+
+// ManifestCheck is how a slot's files compare with its manifest, from
+// GET /slots/{name}/verify.
+type ManifestCheck struct {
+	Slot        string   `json:"slot"`
+	Commit      string   `json:"commit"`
+	Digest      string   `json:"digest,omitempty"`
+	OK          bool     `json:"ok"`
+	SignatureOK bool     `json:"signature_ok"`
+	Modified    []string `json:"modified,omitempty"`
+	Added       []string `json:"added,omitempty"`
+	Deleted     []string `json:"deleted,omitempty"`
+}
+
+// EnvChange is one variable that differs between the live and previous
+// slots. Live or Prev is empty when the variable is unset there.
+type EnvChange struct {
+	Name   string `json:"name"`
+	Source string `json:"source"` // "injected", "env_file", or "inherited"
+	Live   string `json:"live,omitempty"`
+	Prev   string `json:"prev,omitempty"`
+}
+
+// Health is the daemon's answer to GET /healthz.
+type Health struct {
+	Status    string `json:"status"` // "ok", "unhealthy", "recovering", or "down"
+	Slot      string `json:"slot,omitempty"`
+	Commit    string `json:"commit,omitempty"`
+	Code      int    `json:"code,omitempty"`
+	Error     string `json:"error,omitempty"`
+	CheckedAt string `json:"checked_at,omitempty"`
+	Cached    bool   `json:"cached"`
+}
+
+// Probe is the result of GET /livez or /readyz.
+type Probe struct {
+	Status string       `json:"status"` // "ok" or "failing"
+	Checks []ProbeCheck `json:"checks"`
+}
+
+// ProbeCheck is one of a Probe's checks.
+type ProbeCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Version is the daemon's build, from GET /version. SpecVersion goes up
+// whenever the API gains or changes an endpoint or field.
+type Version struct {
+	Version     string `json:"version"`
+	Commit      string `json:"commit,omitempty"`
+	Modified    bool   `json:"modified,omitempty"`
+	BuildDate   string `json:"build_date,omitempty"`
+	GoVersion   string `json:"go_version"`
+	SpecVersion int    `json:"spec_version"`
+}
+
+// HistoryEntry is one deploy or rollback from GET /history.
+type HistoryEntry struct {
+	Time       string `json:"time"`
+	Action     string `json:"action"`
+	Commit     string `json:"commit"`
+	SlotDir    string `json:"slot_dir"`
+	PrevCommit string `json:"prev_commit"`
+	Release    string `json:"release,omitempty"` // "live", "prev", "retained", or "" if gone
+	Message    string `json:"message,omitempty"` // the deploy's, if it came with one
+
+	SmokeOutput string `json:"smoke_output,omitempty"` // tail of a failed smoke_command's output
+	DurationMs  int64  `json:"duration_ms,omitempty"`
+
+	// For "update" entries: the slot-machine releases the daemon moved
+	// between.
+	Version     string `json:"version,omitempty"`
+	PrevVersion string `json:"prev_version,omitempty"`
+
+	Manifest string `json:"manifest,omitempty"` // digest of the deployed slot's files
+}
+
+// Logs is the daemon's answer to GET /logs.
+type Logs struct {
+	Slot    string      `json:"slot"`
+	Lines   []string    `json:"lines"`
+	Records []LogRecord `json:"records,omitempty"` // from MergedLogs
+	Error   string      `json:"error,omitempty"`
+}
+
+// LogRecord is a line of the daemon's merged log stream.
+type LogRecord struct {
+	Time         string `json:"time"`
+	Source       string `json:"source"` // "slot", "daemon", or "agent"
+	Slot         string `json:"slot,omitempty"`
+	Conversation string `json:"conversation,omitempty"`
+	Line         string `json:"line"`
+}
+
+// Conversation is an agent conversation.
+type Conversation struct {
+	ID           string `json:"id"`
+	Title        string `json:"title"`
+	SessionID    string `json:"session_id,omitempty"`
+	User         string `json:"user,omitempty"`
+	InputTokens  int    `json:"input_tokens"`
+	OutputTokens int    `json:"output_tokens"`
+	CacheRead    int    `json:"cache_read"`
+	CacheWrite   int    `json:"cache_write"`
+	CreatedAt    string `json:"created_at"`
+	UpdatedAt    string `json:"updated_at"`
+	Status       string `json:"status"`
+}
+
+// Message is one stored event in a conversation.
+type Message struct {
+	ID             int64  `json:"id"`
+	ConversationID string `json:"conversation_id"`
+	Type           string `json:"type"`
+	Content        string `json:"content"`
+	CreatedAt      string `json:"created_at"`
+}
+
+// ConversationDetail is a conversation with its message log.
+type ConversationDetail struct {
+	Conversation Conversation `json:"conversation"`
+	Messages     []Message    `json:"messages"`
+}
+
+// MessageQuery picks a page of a conversation's messages.
+type MessageQuery struct {
+	After  int64 // the first messages after this ID, if set
+	Before int64 // else the last ones before this ID; 0 for the newest
+	Limit  int   // 0 for the daemon's page size (200); at most 1000
+}
+
+// MessagePage is a page of a conversation's messages, oldest first.
+type MessagePage struct {
+	Messages []Message `json:"messages"`
+	HasMore  bool      `json:"has_more"` // there are more past the page, in the direction it was read
+}
+
+// UsageTotals is agent token use summed over runs. CostUSD is set only when
+// the daemon has agent_prices.
+type UsageTotals struct {
+	Runs         int      `json:"runs"`
+	InputTokens  int      `json:"input_tokens"`
+	OutputTokens int      `json:"output_tokens"`
+	CacheRead    int      `json:"cache_read"`
+	CacheWrite   int      `json:"cache_write"`
+	CostUSD      *float64 `json:"cost_usd,omitempty"`
+}
+
+// UsageGroup is the usage of one day, user, conversation, or model.
+type UsageGroup struct {
+	Day            string `json:"day,omitempty"`
+	User           string `json:"user,omitempty"`
+	ConversationID string `json:"conversation_id,omitempty"`
+	Title          string `json:"title,omitempty"`
+	Model          string `json:"model,omitempty"`
+	UsageTotals
+}
+
+// Usage is the agent's token use since a time, overall and grouped.
+type Usage struct {
+	Since         string       `json:"since,omitempty"`
+	Total         UsageTotals  `json:"total"`
+	Days          []UsageGroup `json:"days"`
+	Users         []UsageGroup `json:"users"`
+	Conversations []UsageGroup `json:"conversations"`
+	Models        []UsageGroup `json:"models"`
+}
+
+// AgentStore is the size of the agent's database and what its retention
+// limits last pruned.
+type AgentStore struct {
+	SizeBytes     int64        `json:"size_bytes"`
+	FreeBytes     int64        `json:"free_bytes"`
+	Conversations int64        `json:"conversations"`
+	Messages      int64        `json:"messages"`
+	OldestMessage string       `json:"oldest_message,omitempty"`
+	RetainDays    int          `json:"retain_days,omitempty"`
+	MaxMB         int          `json:"max_mb,omitempty"`
+	LastPrune     *PruneResult `json:"last_prune,omitempty"`
+
+	LastCheckpoint *Checkpoint `json:"last_checkpoint,omitempty"`
+	WriteErrors    int64       `json:"write_errors"` // events lost since the daemon started
+}
+
+// Checkpoint is what the agent store's last WAL checkpoint did.
+type Checkpoint struct {
+	At    string `json:"at"`
+	Busy  bool   `json:"busy,omitempty"` // readers kept it from finishing
+	Error string `json:"error,omitempty"`
+}
+
+// PruneResult is what one pass of the agent store's retention deleted.
+type PruneResult struct {
+	At            string `json:"at"`
+	Messages      int64  `json:"messages_deleted"`
+	Conversations int64  `json:"conversations_deleted"`
+	SizeBefore    int64  `json:"size_before"`
+	SizeAfter     int64  `json:"size_after"`
+	Error         string `json:"error,omitempty"`
+}
+
+// Event is one server-sent event from a conversation stream. ID is zero for
+// events that aren't stored, such as the final "status" event.
+type Event struct {
+	ID   int64
+	Type string
+	Data string
+}
+
+// DaemonEvent is one event of the daemon's event stream (see
+// Client.Events). Data depends on Type.
+type DaemonEvent struct {
+	ID     int64           `json:"id"`
+	Time   string          `json:"time"`
+	Type   string          `json:"type"` // e.g. "deploy_started", "deploy_finished", "health", "locked", "agent_started"
+	Commit string          `json:"commit,omitempty"`
+	Slot   string          `json:"slot,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+// readEvents parses a text/event-stream body, calling fn per event.
+func readEvents(r io.Reader, fn func(Event) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	var ev Event
+	var data []string
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			if ev.Type != "" || len(data) > 0 {
+				ev.Data = strings.Join(data, "\n")
+				if err := fn(ev); err != nil {
+					return err
+				}
+			}
+			ev, data = Event{}, nil
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			ev.ID, _ = strconv.ParseInt(value, 10, 64)
+		case "event":
+			ev.Type = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+	return sc.Err()
+}
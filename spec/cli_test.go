@@ -231,3 +231,69 @@ func TestDeployNoRunningDaemon(t *testing.T) {
 		t.Fatalf("expected stderr to mention connection failure, got: %s", stderr)
 	}
 }
+
+// ---------------------------------------------------------------------------
+// Test: status --json with no running daemon
+// ---------------------------------------------------------------------------
+
+func TestStatusJSONNoRunningDaemon(t *testing.T) {
+	t.Parallel()
+	_ = orchestratorBinary(t)
+	dir := t.TempDir()
+
+	cfg := map[string]any{"api_port": freePort(t)}
+	data, _ := json.Marshal(cfg)
+	os.WriteFile(filepath.Join(dir, "slot-machine.json"), data, 0644)
+
+	stdout, _, code := runBinary(t, dir, "status", "--json")
+	if code != 2 {
+		t.Fatalf("expected exit code 2 (daemon unreachable), got %d", code)
+	}
+	var out map[string]string
+	if err := json.Unmarshal([]byte(stdout), &out); err != nil {
+		t.Fatalf("expected JSON on stdout, got %q: %v", stdout, err)
+	}
+	if !strings.Contains(out["error"], "cannot reach") {
+		t.Fatalf("expected error to mention connection failure, got: %v", out)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Test: journal verify flags corrupt records
+// ---------------------------------------------------------------------------
+
+func TestJournalVerify(t *testing.T) {
+	t.Parallel()
+	_ = orchestratorBinary(t)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "slot-machine.json"), []byte(`{}`), 0644)
+
+	// No journal yet: verifies as empty.
+	stdout, _, code := runBinary(t, dir, "journal", "verify")
+	if code != 0 {
+		t.Fatalf("expected exit 0 for missing journal, got %d: %s", code, stdout)
+	}
+
+	dataDir := filepath.Join(dir, ".slot-machine")
+	os.MkdirAll(dataDir, 0755)
+	journal := `{"time":"2025-01-01T00:00:00Z","action":"deploy","commit":"abc","slot_dir":"slot-abc","prev_commit":""}
+{"time":"2025-01-02T00:00:00Z","action":"deploy","commit":"def","slot_dir":"slot-def","prev_commit":"abc","crc":"00000000"}
+{"time":"2026`
+	os.WriteFile(filepath.Join(dataDir, "journal.ndjson"), []byte(journal), 0644)
+
+	stdout, _, code = runBinary(t, dir, "journal", "verify", "--json")
+	if code != 1 {
+		t.Fatalf("expected exit 1 for corrupt journal, got %d: %s", code, stdout)
+	}
+	var report struct {
+		Legacy   int   `json:"legacy"`
+		Corrupt  []int `json:"corrupt"`
+		TornTail bool  `json:"torn_tail"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &report); err != nil {
+		t.Fatalf("expected JSON report, got %q: %v", stdout, err)
+	}
+	if report.Legacy != 1 || len(report.Corrupt) != 2 || !report.TornTail {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+}
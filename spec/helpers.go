@@ -15,6 +15,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -501,6 +503,31 @@ func waitForDown(t *testing.T, port int, timeout time.Duration) {
 	t.Fatalf("port %d still responding after %v", port, timeout)
 }
 
+// waitForNoApp polls the public port until no app is behind it: either the
+// connection is refused or the proxy answers 503 (its placeholder page while
+// no slot is live).
+func waitForNoApp(t *testing.T, port int, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	url := fmt.Sprintf("http://127.0.0.1:%d/", port)
+	client := &http.Client{Timeout: 500 * time.Millisecond}
+
+	for time.Now().Before(deadline) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("port %d still serving the app after %v", port, timeout)
+}
+
 // httpGet sends a GET to the given URL and returns the status code and body.
 func httpGet(t *testing.T, url string) (int, string) {
 	t.Helper()
@@ -578,6 +605,89 @@ func startOrchestratorWithAgent(t *testing.T, binary, contractPath, repoDir stri
 	return orch
 }
 
+// startOrchestratorWithChaos is like startOrchestrator but runs the daemon in
+// chaos mode: proxy switches and drains are delayed by up to maxDelay, drawn
+// from seed.
+func startOrchestratorWithChaos(t *testing.T, binary, contractPath, repoDir string, apiPort int, maxDelay time.Duration, seed int64, release func()) *Orchestrator {
+	t.Helper()
+
+	dataDir := t.TempDir()
+
+	cmd := exec.Command(binary,
+		"start",
+		"--config", contractPath,
+		"--repo", repoDir,
+		"--data", dataDir,
+		"--port", fmt.Sprintf("%d", apiPort),
+		"--no-proxy",
+		"--chaos",
+		"--chaos-max-delay", maxDelay.String(),
+		"--chaos-seed", fmt.Sprintf("%d", seed),
+	)
+	cmd.Env = append(os.Environ(), "SLOT_MACHINE_CHAOS=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if release != nil {
+		release()
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting orchestrator: %v", err)
+	}
+
+	orch := &Orchestrator{
+		Cmd:     cmd,
+		APIPort: apiPort,
+		DataDir: dataDir,
+	}
+
+	t.Cleanup(func() {
+		stopOrchestrator(t, orch)
+	})
+
+	waitForHealth(t, apiPort, 5*time.Second)
+
+	return orch
+}
+
+// writeTestContractWithEnv is like writeTestContract but passes env (lines
+// of KEY=value, e.g. the testapp's chaos settings) to the app through an
+// env_file, and merges extra into the contract.
+func writeTestContractWithEnv(t *testing.T, dir string, port, internalPort int, env string, extra map[string]any) string {
+	t.Helper()
+
+	envPath := filepath.Join(dir, "test.env")
+	if err := os.WriteFile(envPath, []byte(env), 0644); err != nil {
+		t.Fatalf("writing env file: %v", err)
+	}
+
+	contract := map[string]any{
+		"start_command":     "./start.sh",
+		"port":              port,
+		"internal_port":     internalPort,
+		"health_endpoint":   "/healthz",
+		"health_timeout_ms": 3000,
+		"drain_timeout_ms":  2000,
+		"agent_auth":        "none",
+		"env_file":          envPath,
+	}
+	for k, v := range extra {
+		contract[k] = v
+	}
+
+	data, err := json.MarshalIndent(contract, "", "  ")
+	if err != nil {
+		t.Fatalf("marshaling contract: %v", err)
+	}
+
+	path := filepath.Join(dir, "app.contract.json")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("writing contract: %v", err)
+	}
+
+	return path
+}
+
 // writeTestContractWithAuth is like writeTestContract but allows specifying the auth mode.
 func writeTestContractWithAuth(t *testing.T, dir string, port, internalPort, drainTimeoutMs int, authMode string) string {
 	t.Helper()
@@ -621,3 +731,96 @@ func httpPost(t *testing.T, url string) int {
 	io.Copy(io.Discard, resp.Body)
 	return resp.StatusCode
 }
+
+// ---------------------------------------------------------------------------
+// Load generation
+// ---------------------------------------------------------------------------
+
+// LoadResult is what a load run saw.
+type LoadResult struct {
+	Requests   int
+	Failures   []string // one per error or non-2xx answer
+	P50        time.Duration
+	MaxLatency time.Duration
+}
+
+// startLoad sends GET requests to url from concurrency clients, each one
+// back to back, until the returned stop func is called. stop waits for the
+// requests in flight and returns what the clients saw.
+func startLoad(t *testing.T, url string, concurrency int) (stop func() LoadResult) {
+	t.Helper()
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		failures  []string
+	)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := &http.Client{Timeout: 10 * time.Second}
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				start := time.Now()
+				resp, err := client.Get(url)
+				var failure string
+				if err != nil {
+					failure = err.Error()
+				} else {
+					_, err = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+					switch {
+					case resp.StatusCode < 200 || resp.StatusCode > 299:
+						failure = fmt.Sprintf("status %d", resp.StatusCode)
+					case err != nil:
+						failure = fmt.Sprintf("reading body: %v", err)
+					}
+				}
+				took := time.Since(start)
+				mu.Lock()
+				latencies = append(latencies, took)
+				if failure != "" {
+					failures = append(failures, failure)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	return func() LoadResult {
+		close(done)
+		wg.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		r := LoadResult{Requests: len(latencies), Failures: failures}
+		if len(latencies) > 0 {
+			slices.Sort(latencies)
+			r.P50 = latencies[len(latencies)/2]
+			r.MaxLatency = latencies[len(latencies)-1]
+		}
+		return r
+	}
+}
+
+// checkLoad fails the test if any request of r failed or took longer than
+// maxLatency.
+func checkLoad(t *testing.T, r LoadResult, maxLatency time.Duration) {
+	t.Helper()
+	if r.Requests == 0 {
+		t.Fatal("load: no requests were made")
+	}
+	if n := len(r.Failures); n > 0 {
+		t.Fatalf("load: %d of %d requests failed, e.g. %s", n, r.Requests, r.Failures[0])
+	}
+	if r.MaxLatency > maxLatency {
+		t.Fatalf("load: slowest of %d requests took %s (median %s), want at most %s", r.Requests, r.MaxLatency, r.P50, maxLatency)
+	}
+	t.Logf("load: %d requests, median %s, slowest %s", r.Requests, r.P50, r.MaxLatency)
+}
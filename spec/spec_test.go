@@ -17,6 +17,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -133,8 +134,8 @@ func TestDeployUnhealthy(t *testing.T) {
 		t.Fatalf("expected empty live_commit after failed deploy, got %s", st.LiveCommit)
 	}
 
-	// The failed process should have been killed — port should not respond.
-	waitForDown(t, appPort, 5*time.Second)
+	// The failed process should have been killed — nothing is served.
+	waitForNoApp(t, appPort, 5*time.Second)
 }
 
 // ---------------------------------------------------------------------------
@@ -341,7 +342,7 @@ func TestProcessCrashDetected(t *testing.T) {
 	httpPost(t, fmt.Sprintf("http://127.0.0.1:%d/control/crash", intPort))
 
 	// Wait for the process to actually die.
-	waitForDown(t, appPort, 5*time.Second)
+	waitForNoApp(t, appPort, 5*time.Second)
 
 	// Give the orchestrator a moment to detect the crash via process exit.
 	time.Sleep(500 * time.Millisecond)
@@ -1054,3 +1055,450 @@ func TestDeployShortHash(t *testing.T) {
 		t.Fatalf("slot = %q, want %q", dr.Slot, expectedSlot)
 	}
 }
+
+// ---------------------------------------------------------------------------
+// Test 34: Second daemon on the same data dir is refused
+// ---------------------------------------------------------------------------
+//
+// Two daemons sharing a data dir would fight over symlinks and worktrees.
+// The second one must exit with a clear error instead of starting.
+
+func TestSecondDaemonRefused(t *testing.T) {
+	t.Parallel()
+	bin := orchestratorBinary(t)
+	appBin := testappBinary(t)
+
+	ports, release := reservePorts(t, 4)
+	apiPort, appPort, intPort, otherAPIPort := ports[0], ports[1], ports[2], ports[3]
+
+	repo := setupTestRepo(t, appBin, appPort, intPort)
+	contract := writeTestContract(t, t.TempDir(), appPort, intPort, 0)
+
+	orch := startOrchestrator(t, bin, contract, repo.Dir, apiPort, release)
+
+	cmd := exec.Command(bin,
+		"start",
+		"--config", contract,
+		"--repo", repo.Dir,
+		"--data", orch.DataDir,
+		"--port", fmt.Sprintf("%d", otherAPIPort),
+	)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatal("expected second daemon to exit with an error")
+	}
+	if !strings.Contains(string(out), "already using") {
+		t.Fatalf("expected error to explain the data dir is in use, got: %s", out)
+	}
+
+	// The first daemon is unaffected.
+	waitForHealth(t, apiPort, 2*time.Second)
+}
+
+// ---------------------------------------------------------------------------
+// Test 35: Public port answers 503 before the first deploy
+// ---------------------------------------------------------------------------
+//
+// The proxy binds the public port at daemon start. Until a slot is live,
+// clients get a 503 with Retry-After rather than connection refused.
+
+func TestProxyServes503BeforeFirstDeploy(t *testing.T) {
+	t.Parallel()
+	bin := orchestratorBinary(t)
+	appBin := testappBinary(t)
+
+	ports, release := reservePorts(t, 3)
+	apiPort, appPort, intPort := ports[0], ports[1], ports[2]
+
+	repo := setupTestRepo(t, appBin, appPort, intPort)
+	contract := writeTestContract(t, t.TempDir(), appPort, intPort, 0)
+
+	// HEAD is the slow-boot commit, so the auto-deploy fails and nothing is live.
+	orch := startOrchestrator(t, bin, contract, repo.Dir, apiPort, release)
+	_ = orch
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/", appPort))
+	if err != nil {
+		t.Fatalf("expected the proxy to accept connections before any deploy: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 before first deploy, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After header")
+	}
+
+	dr, _ := deploy(t, apiPort, repo.CommitA)
+	if !dr.Success {
+		t.Fatal("deploy failed")
+	}
+	code, _ := httpGet(t, fmt.Sprintf("http://127.0.0.1:%d/", appPort))
+	if code != 200 {
+		t.Fatalf("expected 200 after deploy, got %d", code)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Test 36: SIGQUIT dumps state, SIGHUP reloads, neither stops the daemon
+// ---------------------------------------------------------------------------
+
+func TestDaemonSignals(t *testing.T) {
+	t.Parallel()
+	bin := orchestratorBinary(t)
+	appBin := testappBinary(t)
+
+	ports, release := reservePorts(t, 3)
+	apiPort, appPort, intPort := ports[0], ports[1], ports[2]
+
+	repo := setupTestRepo(t, appBin, appPort, intPort)
+	contract := writeTestContract(t, t.TempDir(), appPort, intPort, 0)
+	orch := startOrchestrator(t, bin, contract, repo.Dir, apiPort, release)
+
+	dr, _ := deploy(t, apiPort, repo.CommitA)
+	if !dr.Success {
+		t.Fatal("deploy failed")
+	}
+
+	orch.Cmd.Process.Signal(syscall.SIGQUIT)
+	var dump []byte
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		matches, _ := filepath.Glob(filepath.Join(orch.DataDir, "dump-*.txt"))
+		if len(matches) > 0 {
+			dump, _ = os.ReadFile(matches[0])
+			if len(dump) > 0 {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !strings.Contains(string(dump), repo.CommitA) || !strings.Contains(string(dump), "goroutine ") {
+		t.Fatalf("expected a state dump with the live commit and goroutine stacks, got %d bytes", len(dump))
+	}
+
+	orch.Cmd.Process.Signal(syscall.SIGHUP)
+	time.Sleep(200 * time.Millisecond)
+
+	st := status(t, apiPort)
+	if st.LiveCommit != repo.CommitA || !st.Healthy {
+		t.Fatalf("daemon should keep serving after SIGQUIT and SIGHUP, got %+v", st)
+	}
+	code, _ := httpGet(t, fmt.Sprintf("http://127.0.0.1:%d/", appPort))
+	if code != 200 {
+		t.Fatalf("expected 200 from app, got %d", code)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Test 37: gRPC passes through the proxy over h2c
+// ---------------------------------------------------------------------------
+//
+// With "h2c": true, a client speaking prior-knowledge HTTP/2 to the public
+// port reaches the app over HTTP/2 too, and the response trailers (where
+// gRPC puts its status) come back intact.
+
+func TestGRPCPassThroughH2C(t *testing.T) {
+	t.Parallel()
+	bin := orchestratorBinary(t)
+	appBin := testappBinary(t)
+
+	ports, release := reservePorts(t, 3)
+	apiPort, appPort, intPort := ports[0], ports[1], ports[2]
+
+	repo := setupTestRepo(t, appBin, appPort, intPort)
+	contractDir := t.TempDir()
+	envPath := filepath.Join(contractDir, "test.env")
+	os.WriteFile(envPath, []byte("TESTAPP_H2C=1\n"), 0644)
+
+	contract := map[string]any{
+		"start_command":     "./start.sh",
+		"port":              appPort,
+		"internal_port":     intPort,
+		"health_endpoint":   "/healthz",
+		"health_timeout_ms": 3000,
+		"drain_timeout_ms":  2000,
+		"env_file":          envPath,
+		"h2c":               true,
+	}
+	data, _ := json.MarshalIndent(contract, "", "  ")
+	contractPath := filepath.Join(contractDir, "app.contract.json")
+	os.WriteFile(contractPath, data, 0644)
+
+	orch := startOrchestrator(t, bin, contractPath, repo.Dir, apiPort, release)
+	_ = orch
+
+	dr, _ := deploy(t, apiPort, repo.CommitA)
+	if !dr.Success {
+		t.Fatal("deploy failed")
+	}
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Timeout: 2 * time.Second, Transport: &http.Transport{Protocols: protocols}}
+
+	msg := "\x00\x00\x00\x00\x05hello"
+	req, _ := http.NewRequest("POST", fmt.Sprintf("http://127.0.0.1:%d/echo.Echo/Say", appPort), strings.NewReader(msg))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("h2c request: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2 from the proxy, got %s", resp.Proto)
+	}
+	if got := resp.Header.Get("X-Proto"); got != "HTTP/2.0" {
+		t.Fatalf("expected the app to see HTTP/2.0, got %q", got)
+	}
+	if string(body) != msg {
+		t.Fatalf("expected the message echoed, got %q", body)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Fatalf("expected grpc-status trailer 0, got %q (trailers %v)", got, resp.Trailer)
+	}
+
+	// Plain HTTP/1.1 still works on the same port.
+	code, _ := httpGet(t, fmt.Sprintf("http://127.0.0.1:%d/", appPort))
+	if code != 200 {
+		t.Fatalf("expected 200 over HTTP/1.1, got %d", code)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Test 38: Deploys and rollbacks stay available under chaos
+// ---------------------------------------------------------------------------
+
+func TestChaosSwitchesStayAvailable(t *testing.T) {
+	t.Parallel()
+	bin := orchestratorBinary(t)
+	appBin := testappBinary(t)
+
+	ports, release := reservePorts(t, 3)
+	apiPort, appPort, intPort := ports[0], ports[1], ports[2]
+
+	repo := setupTestRepo(t, appBin, appPort, intPort)
+	// Slow requests are in flight whenever the proxy switches or a slot drains.
+	contract := writeTestContractWithEnv(t, t.TempDir(), appPort, intPort, "TESTAPP_LATENCY_MS=100\n", nil)
+
+	orch := startOrchestratorWithChaos(t, bin, contract, repo.Dir, apiPort, 500*time.Millisecond, 1, release)
+	_ = orch
+
+	dr, _ := deploy(t, apiPort, repo.CommitA)
+	if !dr.Success {
+		t.Fatal("deploy A failed")
+	}
+	waitForHealth(t, appPort, 5*time.Second)
+
+	// Hammer the public port from a few clients while slots switch.
+	stop := startLoad(t, fmt.Sprintf("http://127.0.0.1:%d/", appPort), 4)
+	for _, commit := range []string{repo.CommitB, repo.CommitC, repo.CommitA} {
+		if dr, _ := deploy(t, apiPort, commit); !dr.Success {
+			t.Errorf("deploy %s failed", commit)
+		}
+	}
+	if rr, _ := rollback(t, apiPort); !rr.Success {
+		t.Error("rollback failed")
+	}
+	checkLoad(t, stop(), 5*time.Second)
+	if st := status(t, apiPort); st.LiveCommit != repo.CommitC {
+		t.Fatalf("after rollback: live_commit = %s, want %s", st.LiveCommit, repo.CommitC)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Test 39: Proxy retries hide connection resets
+// ---------------------------------------------------------------------------
+
+func TestChaosResetsRetried(t *testing.T) {
+	t.Parallel()
+	bin := orchestratorBinary(t)
+	appBin := testappBinary(t)
+
+	ports, release := reservePorts(t, 3)
+	apiPort, appPort, intPort := ports[0], ports[1], ports[2]
+
+	repo := setupTestRepo(t, appBin, appPort, intPort)
+	// A fifth of requests are reset; nine tries in a row all reset is
+	// vanishingly rare, and the seed makes the run repeatable anyway.
+	contract := writeTestContractWithEnv(t, t.TempDir(), appPort, intPort,
+		"TESTAPP_RESET_RATE=0.2\nTESTAPP_CHAOS_SEED=1\n", map[string]any{"proxy_retries": 8})
+
+	orch := startOrchestrator(t, bin, contract, repo.Dir, apiPort, release)
+	_ = orch
+
+	dr, _ := deploy(t, apiPort, repo.CommitA)
+	if !dr.Success {
+		t.Fatal("deploy failed")
+	}
+
+	for i := range 50 {
+		code, _ := httpGet(t, fmt.Sprintf("http://127.0.0.1:%d/", appPort))
+		if code != 200 {
+			t.Fatalf("request %d: expected 200 with proxy_retries, got %d", i, code)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Test 40: An app exiting mid-request is restarted
+// ---------------------------------------------------------------------------
+
+func TestChaosExitMidRequest(t *testing.T) {
+	t.Parallel()
+	bin := orchestratorBinary(t)
+	appBin := testappBinary(t)
+
+	ports, release := reservePorts(t, 3)
+	apiPort, appPort, intPort := ports[0], ports[1], ports[2]
+
+	repo := setupTestRepo(t, appBin, appPort, intPort)
+	// Every public request kills the app halfway through its response.
+	contract := writeTestContractWithEnv(t, t.TempDir(), appPort, intPort, "TESTAPP_EXIT_RATE=1\n", nil)
+
+	orch := startOrchestrator(t, bin, contract, repo.Dir, apiPort, release)
+	_ = orch
+
+	dr, _ := deploy(t, apiPort, repo.CommitA)
+	if !dr.Success {
+		t.Fatal("deploy failed")
+	}
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/", appPort))
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil && resp.StatusCode == 200 {
+		t.Fatal("expected the request the app exited during to fail")
+	}
+
+	// The daemon restarts the crashed slot on the same commit.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		st := status(t, apiPort)
+		if st.Healthy && st.LiveCommit == repo.CommitA {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slot not restarted after exiting mid-request: %+v", st)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Test 41: Zero downtime under concurrent load
+// ---------------------------------------------------------------------------
+
+func TestZeroDowntimeUnderLoad(t *testing.T) {
+	t.Parallel()
+	bin := orchestratorBinary(t)
+	appBin := testappBinary(t)
+
+	ports, release := reservePorts(t, 3)
+	apiPort, appPort, intPort := ports[0], ports[1], ports[2]
+
+	repo := setupTestRepo(t, appBin, appPort, intPort)
+	// The testapp exits at once on SIGTERM, so slow requests still in flight
+	// to the old slot when it's stopped would be cut off.
+	contract := writeTestContractWithEnv(t, t.TempDir(), appPort, intPort, "TESTAPP_LATENCY_MS=300\n",
+		map[string]any{"health_timeout_ms": 10000}) // CommitSlow boots in 3s
+
+	orch := startOrchestrator(t, bin, contract, repo.Dir, apiPort, release)
+	_ = orch
+
+	dr, _ := deploy(t, apiPort, repo.CommitA)
+	if !dr.Success {
+		t.Fatal("deploy A failed")
+	}
+	waitForHealth(t, appPort, 5*time.Second)
+
+	stop := startLoad(t, fmt.Sprintf("http://127.0.0.1:%d/", appPort), 16)
+	// Let the load settle before the first switch.
+	time.Sleep(500 * time.Millisecond)
+	for _, commit := range []string{repo.CommitB, repo.CommitSlow, repo.CommitC} {
+		if dr, _ := deploy(t, apiPort, commit); !dr.Success {
+			t.Errorf("deploy %s failed", commit)
+		}
+	}
+	if rr, _ := rollback(t, apiPort); !rr.Success {
+		t.Error("rollback failed")
+	}
+	// No request may fail, and none may wait much beyond the app's own
+	// latency for the switch.
+	checkLoad(t, stop(), 2*time.Second)
+}
+
+// ---------------------------------------------------------------------------
+// Test 42: SIGTERM finishes requests in flight before stopping the app
+// ---------------------------------------------------------------------------
+//
+// On SIGTERM the proxy stops accepting connections first, lets the
+// requests in flight be answered, and only then stops the slots, so a slow
+// request caught by the shutdown still succeeds.
+
+func TestShutdownFinishesInFlight(t *testing.T) {
+	t.Parallel()
+	bin := orchestratorBinary(t)
+	appBin := testappBinary(t)
+
+	ports, release := reservePorts(t, 3)
+	apiPort, appPort, intPort := ports[0], ports[1], ports[2]
+
+	repo := setupTestRepo(t, appBin, appPort, intPort)
+	contract := writeTestContractWithEnv(t, t.TempDir(), appPort, intPort, "TESTAPP_LATENCY_MS=1000\n",
+		map[string]any{"shutdown_timeout_ms": 5000})
+	orch := startOrchestrator(t, bin, contract, repo.Dir, apiPort, release)
+
+	dr, _ := deploy(t, apiPort, repo.CommitA)
+	if !dr.Success {
+		t.Fatal("deploy failed")
+	}
+	waitForHealth(t, appPort, 5*time.Second)
+
+	const n = 8
+	codes := make(chan int, n)
+	client := &http.Client{Timeout: 10 * time.Second}
+	for range n {
+		go func() {
+			resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/", appPort))
+			if err != nil {
+				codes <- 0
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			codes <- resp.StatusCode
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	orch.Cmd.Process.Signal(syscall.SIGTERM)
+
+	// New connections are refused while those requests finish.
+	time.Sleep(100 * time.Millisecond)
+	if conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", appPort), time.Second); err == nil {
+		conn.Close()
+		t.Error("the proxy still accepts connections after SIGTERM")
+	}
+	for range n {
+		if code := <-codes; code != 200 {
+			t.Errorf("request in flight at SIGTERM: got %d, want 200", code)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- orch.Cmd.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("daemon still running 10s after SIGTERM")
+	}
+	t.Logf("daemon exited %s after SIGTERM", time.Since(start).Round(time.Millisecond))
+}
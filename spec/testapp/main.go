@@ -3,6 +3,8 @@
 // A tiny HTTP server the orchestrator can deploy. It serves a public endpoint
 // and internal control/health endpoints on separate ports. Various flags let
 // tests simulate unhealthy starts, slow boots, and processes that refuse to die.
+// Chaos flags inject failures into public requests: random latency,
+// connection resets, and exits in the middle of a request.
 //
 // Port configuration follows the same pattern as real apps: the orchestrator
 // sets PORT and INTERNAL_PORT env vars (like systemd's EnvironmentFile would).
@@ -12,7 +14,8 @@
 //   go build -o testharness/testapp/testapp ./testharness/testapp/
 //
 // Usage:
-//   PORT=3001 INTERNAL_PORT=3901 ./testapp [--start-unhealthy] [--boot-delay 3]
+//   PORT=3001 INTERNAL_PORT=3901 ./testapp [--start-unhealthy] [--boot-delay 3] [--h2c]
+//   ./testapp [--latency-ms 200] [--reset-rate 0.1] [--exit-rate 0.01] [--chaos-seed 1]
 //   ./testapp --port 3001 [--internal-port 3901]   # flags override env
 package main
 
@@ -20,6 +23,9 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -39,11 +45,82 @@ func envInt(key string) int {
 	return 0
 }
 
+// envFloat reads a float from an environment variable, returning 0 if unset.
+func envFloat(key string) float64 {
+	if v := os.Getenv(key); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return 0
+}
+
+// chaos injects failures into the public server's requests.
+type chaos struct {
+	mu        sync.Mutex
+	rng       *rand.Rand
+	latencyMs int     // each request waits a random 0..latencyMs first
+	resetRate float64 // fraction of requests whose connection is reset
+	exitRate  float64 // fraction of requests during which the process exits
+}
+
+func (c *chaos) roll() (delay time.Duration, reset, exit bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.latencyMs > 0 {
+		delay = time.Duration(c.rng.Intn(c.latencyMs+1)) * time.Millisecond
+	}
+	return delay, c.rng.Float64() < c.resetRate, c.rng.Float64() < c.exitRate
+}
+
+func (c *chaos) wrap(next http.Handler) http.Handler {
+	if c.latencyMs <= 0 && c.resetRate <= 0 && c.exitRate <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delay, reset, exit := c.roll()
+		time.Sleep(delay)
+		switch {
+		case exit:
+			// Answer half a response, then die with the request open.
+			w.Header().Set("Content-Length", "100")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, "partial")
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			fmt.Fprintln(os.Stderr, "chaos: exiting mid-request")
+			os.Exit(1)
+		case reset:
+			hj, ok := w.(http.Hijacker)
+			if !ok {
+				break
+			}
+			conn, _, err := hj.Hijack()
+			if err != nil {
+				break
+			}
+			// Linger 0 makes Close send a RST instead of a FIN.
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				tcp.SetLinger(0)
+			}
+			conn.Close()
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func main() {
 	port := flag.Int("port", envInt("PORT"), "Public port (or set PORT env var)")
 	internalPort := flag.Int("internal-port", envInt("INTERNAL_PORT"), "Internal port (or set INTERNAL_PORT env var)")
 	startUnhealthy := flag.Bool("start-unhealthy", false, "Start with health check returning 503")
 	bootDelay := flag.Int("boot-delay", 0, "Seconds to wait before starting HTTP servers")
+	h2c := flag.Bool("h2c", os.Getenv("TESTAPP_H2C") != "", "Also accept HTTP/2 without TLS on the public port (or set TESTAPP_H2C)")
+	latencyMs := flag.Int("latency-ms", envInt("TESTAPP_LATENCY_MS"), "Delay each public request by a random 0..N ms (or set TESTAPP_LATENCY_MS)")
+	resetRate := flag.Float64("reset-rate", envFloat("TESTAPP_RESET_RATE"), "Fraction of public requests whose connection is reset (or set TESTAPP_RESET_RATE)")
+	exitRate := flag.Float64("exit-rate", envFloat("TESTAPP_EXIT_RATE"), "Fraction of public requests during which the process exits (or set TESTAPP_EXIT_RATE)")
+	chaosSeed := flag.Int64("chaos-seed", int64(envInt("TESTAPP_CHAOS_SEED")), "Seed for the chaos flags, 0 for a random one (or set TESTAPP_CHAOS_SEED)")
 	flag.Parse()
 
 	if *port == 0 {
@@ -76,6 +153,17 @@ func main() {
 		})
 	})
 
+	// POST /echo.Echo/Say — gRPC-style echo: returns the length-prefixed
+	// message as sent, the protocol it arrived over, and a grpc-status trailer.
+	pubMux.HandleFunc("/echo.Echo/Say", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("X-Proto", r.Proto)
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+	})
+
 	// --- Internal server ---
 
 	intMux := http.NewServeMux()
@@ -150,8 +238,19 @@ func main() {
 		}
 	}()
 
+	if *chaosSeed == 0 {
+		*chaosSeed = time.Now().UnixNano()
+	}
+	c := &chaos{rng: rand.New(rand.NewSource(*chaosSeed)), latencyMs: *latencyMs, resetRate: *resetRate, exitRate: *exitRate}
+	pub := &http.Server{Addr: fmt.Sprintf(":%d", *port), Handler: c.wrap(pubMux)}
+	if *h2c {
+		pub.Protocols = new(http.Protocols)
+		pub.Protocols.SetHTTP1(true)
+		pub.Protocols.SetUnencryptedHTTP2(true)
+	}
+
 	fmt.Printf("testapp listening: public=:%d internal=:%d\n", *port, *internalPort)
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", *port), pubMux); err != nil {
+	if err := pub.ListenAndServe(); err != nil {
 		fmt.Fprintf(os.Stderr, "public server error: %v\n", err)
 		os.Exit(1)
 	}